@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// withZone adds the zone (interface name) to an IPv6 link-local address that has none.
+// Link-local addresses are useless without it on hosts with more than one interface.
+func withZone(address, zone string) string {
+	addr, err := netip.ParseAddr(address)
+	if err != nil || !addr.Is6() || !addr.IsLinkLocalUnicast() || addr.Zone() != "" || zone == "" {
+		return address
+	}
+	return addr.WithZone(zone).String()
+}
+
+// interfaceName returns the name of a network interface index as printed by chip-tool ("Interface Id: 2").
+func interfaceName(index string) string {
+	i, err := strconv.Atoi(index)
+	if err != nil || i <= 0 {
+		return ""
+	}
+	iface, err := net.InterfaceByIndex(i)
+	if err != nil {
+		return ""
+	}
+	return iface.Name
+}
+
+// onInterface reports whether an address can be used through the named interface: link-local
+// addresses must carry its zone, other addresses must be inside one of its networks.
+func onInterface(addr netip.Addr, name string) bool {
+	if addr.IsLinkLocalUnicast() {
+		return addr.Zone() == name
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return false
+	}
+	ifAddrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range ifAddrs {
+		if prefix, err := netip.ParsePrefix(a.String()); err == nil && prefix.Masked().Contains(addr.WithZone("")) {
+			return true
+		}
+	}
+	return false
+}
+
+// addressRank orders addresses for direct interactions: routable IPv6 (global or ULA) first, then
+// IPv4, then link-local IPv6 with a zone. Link-local addresses without a zone can't be used.
+func addressRank(addr netip.Addr) int {
+	switch {
+	case addr.Is6() && !addr.IsLinkLocalUnicast():
+		return 0
+	case addr.Is4():
+		return 1
+	case addr.Zone() != "":
+		return 2
+	}
+	return -1
+}
+
+// AddressInfo describes one advertised address of a discovered device.
+type AddressInfo struct {
+	Address   string `json:"address"`
+	Family    string `json:"family"`         // "ipv4" or "ipv6"
+	Scope     string `json:"scope"`          // "global", "ula", "private", "link-local" or "other"
+	Zone      string `json:"zone,omitempty"` // Interface of a link-local address
+	Rank      int    `json:"rank"`           // Preference for direct interactions, lower is better; -1 when unusable
+	Reachable bool   `json:"reachable"`      // The host has a route to it (through networkInterface when pinned)
+}
+
+// addressScope classifies an address for AddressInfo.
+func addressScope(addr netip.Addr) string {
+	switch {
+	case addr.IsLinkLocalUnicast():
+		return "link-local"
+	case addr.Is6() && addr.IsPrivate():
+		return "ula"
+	case addr.IsPrivate():
+		return "private"
+	case addr.IsGlobalUnicast():
+		return "global"
+	}
+	return "other"
+}
+
+// addressReachable reports whether the host has a route to an address, through iface when it is
+// not empty. Connecting a UDP socket only selects the route and source address, nothing is sent.
+func addressReachable(addr netip.Addr, iface string) bool {
+	if iface != "" && !onInterface(addr, iface) {
+		return false
+	}
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, 5540)))
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// describeAddress returns the metadata of one address, reachability through iface when it is not
+// empty; unparsable addresses are unusable.
+func describeAddress(address, iface string) AddressInfo {
+	info := AddressInfo{Address: address, Rank: -1, Scope: "other"}
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return info
+	}
+	info.Family = "ipv6"
+	if addr.Is4() || addr.Is4In6() {
+		info.Family = "ipv4"
+	}
+	info.Scope = addressScope(addr)
+	info.Zone = addr.Zone()
+	info.Rank = addressRank(addr)
+	info.Reachable = info.Rank >= 0 && addressReachable(addr, iface)
+	return info
+}
+
+// rankAddresses returns the usable addresses best first: reachable ones before unreachable ones,
+// then by addressRank. When iface is set (the config's networkInterface when empty), only addresses
+// reachable through it are kept.
+func rankAddresses(addresses []string, iface string) []AddressInfo {
+	if iface == "" {
+		iface = appConfig.NetworkInterface
+	}
+	var ranked []AddressInfo
+	for _, a := range addresses {
+		info := describeAddress(a, iface)
+		if info.Rank < 0 || (iface != "" && !info.Reachable) {
+			continue
+		}
+		ranked = append(ranked, info)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Reachable != ranked[j].Reachable {
+			return ranked[i].Reachable
+		}
+		return ranked[i].Rank < ranked[j].Rank
+	})
+	return ranked
+}
+
+// bestAddress picks the address to use for direct interactions with a device.
+func bestAddress(addresses []string) string {
+	ranked := rankAddresses(addresses, "")
+	if len(ranked) == 0 {
+		return ""
+	}
+	return ranked[0].Address
+}
+
+// resolveDiscoveredAddresses adds zone indices to the link-local addresses of discovered devices,
+// describes each of them in AddressInfo, sets IPAddress to the best one and tags the device with
+// the interface it was seen on.
+func resolveDiscoveredAddresses(devices []DiscoveredDevice) {
+	for i := range devices {
+		d := &devices[i]
+		zone := interfaceName(d.InterfaceID)
+		if zone == "" {
+			zone = appConfig.NetworkInterface
+		}
+		d.AddressInfo = nil
+		for j, a := range d.Addresses {
+			d.Addresses[j] = withZone(strings.TrimSpace(a), zone)
+			d.AddressInfo = append(d.AddressInfo, describeAddress(d.Addresses[j], appConfig.NetworkInterface))
+		}
+		if best := bestAddress(d.Addresses); best != "" {
+			d.IPAddress = best
+		}
+		d.Interface = interfaceName(d.InterfaceID)
+		if d.Interface == "" {
+			d.Interface = interfaceOf(d.Addresses)
+		}
+	}
+}
+
+// interfaceOf returns the first local interface one of the addresses can be used through, for
+// builds that don't print the interface of a discovered node.
+func interfaceOf(addresses []string) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, a := range addresses {
+		addr, err := netip.ParseAddr(a)
+		if err != nil {
+			continue
+		}
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagLoopback == 0 && onInterface(addr, iface.Name) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+// seenOnInterfaces reports whether a discovered device was seen on, or has an address usable
+// through, one of the named interfaces.
+func seenOnInterfaces(d DiscoveredDevice, names []string) bool {
+	if containsString(names, d.Interface) {
+		return true
+	}
+	for _, a := range d.Addresses {
+		addr, err := netip.ParseAddr(a)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			if onInterface(addr, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// discoveryInterfaces returns the interfaces a discovery should keep devices from: the requested
+// ones, else the config's discoveryInterfaces, else networkInterface. Empty means all of them.
+func discoveryInterfaces(requested []string) []string {
+	switch {
+	case len(requested) > 0:
+		return requested
+	case len(appConfig.DiscoveryInterfaces) > 0:
+		return appConfig.DiscoveryInterfaces
+	case appConfig.NetworkInterface != "":
+		return []string{appConfig.NetworkInterface}
+	}
+	return nil
+}
+
+// validateInterfaceNames checks that every name is a local network interface.
+func validateInterfaceNames(field string, names []string) error {
+	verr := &ValidationError{}
+	for _, name := range names {
+		if _, err := net.InterfaceByName(name); err != nil {
+			verr.add(field, fmt.Sprintf("no network interface %q", name))
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
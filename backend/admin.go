@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultAdminListen is where the admin API listens unless the config says otherwise: loopback only.
+const defaultAdminListen = "127.0.0.1:8081"
+
+// adminMessageTypes are the destructive WebSocket messages. They are only accepted from connections
+// to the admin listener, unless admin.allowOnMainListener is set. New admin operations (factory reset,
+// ACL edits, certificate uploads...) belong here too.
+var adminMessageTypes = map[string]bool{
+	"remove_device":       true,
+	"unpair_node":         true,
+	"change_wifi_network": true,
+	"disconnect_client":   true,
+	"raw_chiptool":        true,
+	"raw_chiptool_cancel": true,
+	"export_fabric_share": true,
+	"run_retention":       true,
+	"set_read_only":       true,
+	"start_maintenance":   true,
+	"end_maintenance":     true,
+	"reload_config":       true,
+	"set_feature_flag":    true,
+	"start_capture":       true,
+	"stop_capture":        true,
+	"list_captures":       true,
+}
+
+// adminMiddleware rejects admin messages received on the main listener.
+func adminMiddleware(msgType string, next HandlerFunc) HandlerFunc {
+	return func(client *Client, msg ClientMessage) {
+		if adminMessageTypes[msgType] && !client.base().admin && !appConfig.Admin.AllowOnMainListener {
+			client.notifyClient("error", map[string]interface{}{"message": msgType + " is only accepted on the admin API.", "code": errCodeAdminOnly})
+			return
+		}
+		if adminMessageTypes[msgType] {
+			client.audit(msgType, redactSecrets(msg.Payload))
+		}
+		next(client, msg)
+	}
+}
+
+// adminListener opens the admin API listener: a TCP address, or a unix socket with the "unix:" prefix.
+func adminListener(address string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(address, "unix:")
+	if !isUnix {
+		return net.Listen("tcp", address)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	_ = os.Remove(path) // Stale socket of a previous run
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Only the owner and its group may connect
+	if err := os.Chmod(path, 0o660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// startAdminAPI serves the admin API: a WebSocket accepting every message type, including the admin
+// ones, and REST endpoints for the destructive operations. It is disabled with admin.listen "off".
+func startAdminAPI(hub *Hub) {
+	address := appConfig.Admin.Listen
+	if address == "" {
+		address = defaultAdminListen
+	}
+	if address == "off" {
+		log.Println("Admin API disabled")
+		return
+	}
+	listener, err := adminListener(address)
+	if err != nil {
+		log.Printf("WARNING: admin API not available on %s: %v", address, err)
+		return
+	}
+
+	router := gin.New()
+	router.Use(gin.Logger())
+	router.Use(gin.Recovery())
+	router.Use(telemetryMiddleware())
+	router.Use(adminAuth)
+
+	router.GET("/ws", func(c *gin.Context) {
+		serveWs(hub, c.Writer, c.Request, true)
+	})
+
+	// REST endpoints, under /api/v1 and the deprecated /api (see apiversions.go)
+	registerVersionedAPI(router, func(api *gin.RouterGroup) { registerAdminRoutes(api, hub) })
+
+	log.Printf("Admin API listening on %s", address)
+	go func() {
+		if err := http.Serve(listener, router); err != nil {
+			log.Printf("Admin API stopped: %v", err)
+		}
+	}()
+}
+
+// registerAdminRoutes adds the REST endpoints of the admin API to an API version group.
+func registerAdminRoutes(api *gin.RouterGroup, hub *Hub) {
+	// Remove a device from the registry and, unless ?localOnly=true, unpair it
+	api.POST("/admin/devices/:id/remove", func(c *gin.Context) {
+		auditREST(c, "remove_device", gin.H{"deviceId": c.Param("id"), "localOnly": c.Query("localOnly") == "true"})
+		if rejectReadOnlyREST(c, "remove_device") {
+			return
+		}
+		removed, err := removeDevice(nil, c.Param("id"), c.Query("localOnly") != "true")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, removed)
+	})
+
+	// Remove a node from the fabric
+	api.POST("/admin/nodes/:nodeId/unpair", func(c *gin.Context) {
+		auditREST(c, "unpair_node", gin.H{"nodeId": c.Param("nodeId")})
+		if rejectReadOnlyREST(c, "unpair_node") {
+			return
+		}
+		if err := unpairNode(nil, c.Param("nodeId")); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"nodeId": c.Param("nodeId")})
+	})
+
+	// Toggle read-only mode until the next restart
+	api.POST("/admin/read-only", func(c *gin.Context) {
+		var payload SetReadOnlyPayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := payload.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": err.(*ValidationError).Fields})
+			return
+		}
+		auditREST(c, "set_read_only", payload)
+		c.JSON(http.StatusOK, readOnly.Set(*payload.Enabled))
+	})
+
+	// Start ({"active": true, "reason", "expectedMinutes"}) or end ({"active": false}) maintenance
+	registerMaintenanceREST(api)
+
+	// Reload the configuration file, as SIGHUP does; reports what needs a restart
+	registerConfigReloadREST(api)
+
+	// Toggle a feature flag ({"enabled": bool}), or drop the toggle with DELETE
+	registerFeatureFlagsREST(api)
+
+	// Packet captures of a device's traffic, downloadable as pcap files (see capture.go)
+	registerCaptureRoutes(api)
+
+	// Connected clients with their addresses and identities
+	api.GET("/clients", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"clients": hub.Stats().Connections})
+	})
+
+	// Connected clients, their send queue depths, delivered messages per topic, uptime and evictions
+	api.GET("/hub", func(c *gin.Context) {
+		c.JSON(http.StatusOK, hub.Stats())
+	})
+
+	// Force-disconnect a WebSocket client (IDs from /clients)
+	api.POST("/admin/clients/:id/disconnect", func(c *gin.Context) {
+		auditREST(c, "disconnect_client", gin.H{"clientId": c.Param("id")})
+		if !hub.Disconnect(c.Param("id")) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no such client"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"clientId": c.Param("id")})
+	})
+
+	// Share codes of the last export_fabric_share, for migrating to another controller
+	api.GET("/admin/fabric-share", func(c *gin.Context) {
+		report, ok := fabricShare.Last()
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no fabric share exported yet"})
+			return
+		}
+		auditREST(c, "fabric_share_download", gin.H{"generatedAt": report.GeneratedAt})
+		c.Header("Content-Disposition", `attachment; filename="fabric-share.json"`)
+		c.JSON(http.StatusOK, report)
+	})
+
+	// Latest audit records; the full trail is in audit.log in the data directory
+	api.GET("/admin/audit", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"records": auditLog.List()})
+	})
+}
+
+// secretFields are payload fields never written to the audit log.
+var secretFields = []string{"password", "token", "setupCode"}
+
+// redactSecrets returns a payload with its secretFields masked, for the audit log.
+func redactSecrets(payload json.RawMessage) interface{} {
+	var fields map[string]interface{}
+	if json.Unmarshal(payload, &fields) != nil {
+		return nil
+	}
+	for _, name := range secretFields {
+		if _, ok := fields[name]; ok {
+			fields[name] = "***"
+		}
+	}
+	return fields
+}
+
+// auditREST records an admin REST call in the audit log.
+func auditREST(c *gin.Context, action string, details interface{}) {
+	auditLog.Record(AuditRecord{Action: action, Addr: requestClientAddr(c.Request), Details: details})
+}
+
+// adminAuth requires the authToken on REST requests of the admin API, when one is configured
+// (Authorization: Bearer <token>). WebSocket clients authenticate as on the main listener.
+func adminAuth(c *gin.Context) {
+	if appConfig.AuthToken == "" || c.Request.URL.Path == "/ws" {
+		c.Next()
+		return
+	}
+	if !tokensEqual(c.GetHeader("Authorization"), "Bearer "+appConfig.AuthToken) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid bearer token"})
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultAdmissionWait is how long a read-only client waits in the admission queue for a free slot.
+const defaultAdmissionWait = 30 * time.Second
+
+// Admission limits the concurrent WebSocket clients to maxClients. Read-only clients (dashboards,
+// wall displays) may wait in a queue for a slot; the others are turned away at once.
+type Admission struct {
+	mu      sync.Mutex
+	active  int
+	waiting []chan struct{} // Oldest first; a slot is handed over by closing the channel
+}
+
+// NewAdmission creates an Admission without clients.
+func NewAdmission() *Admission {
+	return &Admission{}
+}
+
+// TryAcquire takes a slot if one is free. Without maxClients there is always one.
+func (a *Admission) TryAcquire() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if appConfig.MaxClients > 0 && (a.active >= appConfig.MaxClients || len(a.waiting) > 0) {
+		return false
+	}
+	a.active++
+	return true
+}
+
+// Enqueue puts a client in the admission queue. It returns the channel closed when it got a slot,
+// its position (1 = next) and a function to leave the queue, which reports whether it still was in it.
+func (a *Admission) Enqueue() (<-chan struct{}, int, func() bool) {
+	ready := make(chan struct{})
+	a.mu.Lock()
+	a.waiting = append(a.waiting, ready)
+	position := len(a.waiting)
+	a.mu.Unlock()
+	leave := func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		for i, w := range a.waiting {
+			if w == ready {
+				a.waiting = append(a.waiting[:i], a.waiting[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+	return ready, position, leave
+}
+
+// Release frees a slot, handing it to the first queued client if any.
+func (a *Admission) Release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.waiting) > 0 {
+		close(a.waiting[0])
+		a.waiting = a.waiting[1:]
+		return
+	}
+	a.active--
+}
+
+// Stats returns the admitted and queued client counts.
+func (a *Admission) Stats() (active, queued int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.active, len(a.waiting)
+}
+
+// admit gets a slot for a new connection, queueing read-only clients. It reports false after
+// rejecting the client; the connection is closed then. A client claiming to be read-only is held to
+// it: readOnlyMiddleware refuses it the messages read-only mode refuses.
+func admit(client *Client, r *http.Request) bool {
+	client.readOnly = r.URL.Query().Get("readonly") == "true"
+	if client.admin || admission.TryAcquire() {
+		client.admitted = !client.admin
+		return true
+	}
+	if client.readOnly {
+		ready, position, leave := admission.Enqueue()
+		log.Printf("Client %v queued for admission (position %d)", client.logName(), position)
+		writeDirect(client, "admission_queued", map[string]interface{}{"position": position, "maxClients": appConfig.MaxClients})
+		wait := defaultAdmissionWait
+		if appConfig.AdmissionQueueSeconds > 0 {
+			wait = time.Duration(appConfig.AdmissionQueueSeconds) * time.Second
+		}
+		select {
+		case <-ready:
+			client.admitted = true
+			return true
+		case <-time.After(wait):
+			if !leave() {
+				// The slot arrived while timing out
+				client.admitted = true
+				return true
+			}
+		}
+	}
+	log.Printf("Client %v rejected: %d clients already connected", client.logName(), appConfig.MaxClients)
+	writeDirect(client, "error", map[string]interface{}{"message": "Too many clients connected; try again later.", "code": errCodeTooManyClients, "maxClients": appConfig.MaxClients})
+	_ = client.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too many clients"), time.Now().Add(writeWait))
+	client.conn.Close()
+	return false
+}
+
+// writeDirect writes a message to a connection whose pumps aren't running yet.
+func writeDirect(client *Client, msgType string, payload interface{}) {
+	message, err := json.Marshal(buildServerMessage(msgType, "", payload, client.legacy))
+	if err != nil {
+		return
+	}
+	_ = client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	_ = client.conn.WriteMessage(websocket.TextMessage, message)
+}
+
+var admission = NewAdmission()
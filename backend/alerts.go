@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Alert persistence, relative to the working directory.
+const (
+	alertRulesFile   = "alert_rules.json"
+	alertHistoryFile = "alert_history.json"
+)
+
+const (
+	maxAlertHistory = 500             // Raised/cleared alerts kept in the history
+	alertTick       = 5 * time.Second // How often pending conditions are checked for their duration
+)
+
+// AlertRule raises an alert when an attribute value crosses a threshold, optionally for a minimum
+// duration. Values are compared after unit normalisation (see transform.go), e.g. °C or %.
+type AlertRule struct {
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	Enabled    bool    `json:"enabled"`
+	NodeID     string  `json:"nodeId,omitempty"`     // Empty matches every node
+	EndpointID string  `json:"endpointId,omitempty"` // Empty matches every endpoint
+	Cluster    string  `json:"cluster" validate:"required"`
+	Attribute  string  `json:"attribute" validate:"required"`
+	Operator   string  `json:"operator" validate:"required"` // ">", ">=", "<", "<=", "==" or "!="
+	Threshold  float64 `json:"threshold"`
+	ForSeconds int     `json:"forSeconds,omitempty"` // The condition must hold this long before the alert is raised
+	Severity   string  `json:"severity,omitempty"`   // Free text, e.g. "warning", "critical"
+}
+
+// Validate implements Validator.
+func (r AlertRule) Validate() error {
+	verr := &ValidationError{}
+	if _, ok := alertOperators[r.Operator]; !ok {
+		verr.add("operator", `must be one of ">", ">=", "<", "<=", "==", "!="`)
+	}
+	if r.ForSeconds < 0 {
+		verr.add("forSeconds", "must not be negative")
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+var alertOperators = map[string]func(v, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+// matches reports whether the rule applies to an attribute update.
+func (r AlertRule) matches(update AttributeUpdatePayload) bool {
+	return r.Cluster == update.Cluster && r.Attribute == update.Attribute &&
+		(r.NodeID == "" || sameNodeID(r.NodeID, update.NodeID)) &&
+		(r.EndpointID == "" || r.EndpointID == update.EndpointID)
+}
+
+// Alert is a raised (or cleared) alert, sent in "alert_raised" and "alert_cleared" messages.
+type Alert struct {
+	RuleID     string    `json:"ruleId"`
+	RuleName   string    `json:"ruleName,omitempty"`
+	Severity   string    `json:"severity,omitempty"`
+	NodeID     string    `json:"nodeId"`
+	EndpointID string    `json:"endpointId"`
+	Cluster    string    `json:"cluster"`
+	Attribute  string    `json:"attribute"`
+	Value      float64   `json:"value"` // Latest value
+	Unit       string    `json:"unit,omitempty"`
+	Condition  string    `json:"condition"` // e.g. "> 30"
+	RaisedAt   time.Time `json:"raisedAt"`
+	ClearedAt  time.Time `json:"clearedAt,omitzero"`
+}
+
+// alertState tracks a rule on one node endpoint.
+type alertState struct {
+	ruleID       string
+	pendingSince time.Time // When the condition started to hold, zero when it doesn't
+	alert        *Alert    // Set while the alert is raised
+	last         AttributeUpdatePayload
+}
+
+// AlertEngine evaluates alert rules against the attribute stream.
+type AlertEngine struct {
+	mu          sync.Mutex
+	rules       map[string]*AlertRule
+	states      map[string]*alertState // By rule ID and node endpoint
+	history     []Alert
+	rulesPath   string
+	historyPath string
+}
+
+// NewAlertEngine creates an AlertEngine persisting its rules and history to the given files.
+func NewAlertEngine(rulesPath, historyPath string) *AlertEngine {
+	return &AlertEngine{rules: make(map[string]*AlertRule), states: make(map[string]*alertState), rulesPath: rulesPath, historyPath: historyPath}
+}
+
+// Load reads the persisted rules and history. Missing files are not an error.
+func (e *AlertEngine) Load() error {
+	var rules []*AlertRule
+	if err := loadJSONFile(e.rulesPath, &rules); err != nil {
+		return err
+	}
+	var history []Alert
+	if err := loadJSONFile(e.historyPath, &history); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, rule := range rules {
+		e.rules[rule.ID] = rule
+	}
+	e.history = history
+	log.Printf("Loaded %d alert rule(s) and %d past alert(s)", len(rules), len(history))
+	return nil
+}
+
+func (e *AlertEngine) listLocked() []AlertRule {
+	rules := make([]AlertRule, 0, len(e.rules))
+	for _, rule := range e.rules {
+		rules = append(rules, *rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+	return rules
+}
+
+// List returns all alert rules sorted by ID.
+func (e *AlertEngine) List() []AlertRule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.listLocked()
+}
+
+// Put adds or replaces an alert rule, assigning an ID if it has none. The state of a replaced rule is reset.
+func (e *AlertEngine) Put(rule AlertRule) (AlertRule, error) {
+	if rule.ID == "" {
+		rule.ID = fmt.Sprintf("alert-%d", time.Now().UnixNano())
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules[rule.ID] = &rule
+	e.resetLocked(rule.ID)
+	return rule, saveJSONFile(e.rulesPath, e.listLocked())
+}
+
+// PutIfMissing adds a rule unless a rule with the same ID exists, e.g. built-in rules a user may have edited.
+func (e *AlertEngine) PutIfMissing(rule AlertRule) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.rules[rule.ID]; ok {
+		return nil
+	}
+	e.rules[rule.ID] = &rule
+	return saveJSONFile(e.rulesPath, e.listLocked())
+}
+
+// Delete removes an alert rule by ID.
+func (e *AlertEngine) Delete(id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.rules[id]; !ok {
+		return fmt.Errorf("alert rule %q not found", id)
+	}
+	delete(e.rules, id)
+	e.resetLocked(id)
+	return saveJSONFile(e.rulesPath, e.listLocked())
+}
+
+// resetLocked forgets the state of a rule, clearing its raised alerts.
+func (e *AlertEngine) resetLocked(ruleID string) {
+	for key, state := range e.states {
+		if state.ruleID != ruleID {
+			continue
+		}
+		if state.alert != nil {
+			e.clearLocked(state, time.Now())
+		}
+		delete(e.states, key)
+	}
+}
+
+// Forget drops the state of a removed node endpoint (or the whole node when endpointID is empty),
+// clearing its raised alerts.
+func (e *AlertEngine) Forget(nodeID, endpointID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key, state := range e.states {
+		if !sameNodeID(state.last.NodeID, nodeID) || (endpointID != "" && state.last.EndpointID != endpointID) {
+			continue
+		}
+		if state.alert != nil {
+			e.clearLocked(state, time.Now())
+		}
+		delete(e.states, key)
+	}
+}
+
+// Active returns the alerts currently raised.
+func (e *AlertEngine) Active() []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	alerts := []Alert{}
+	for _, state := range e.states {
+		if state.alert != nil {
+			alerts = append(alerts, *state.alert)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].RaisedAt.Before(alerts[j].RaisedAt) })
+	return alerts
+}
+
+// History returns the past alerts, most recent last.
+func (e *AlertEngine) History() []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Alert{}, e.history...)
+}
+
+// HandleAttributeUpdate evaluates the rules matching an update.
+func (e *AlertEngine) HandleAttributeUpdate(update AttributeUpdatePayload, at time.Time) {
+	value, ok := toFloat(update.Value)
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, rule := range e.rules {
+		if !rule.Enabled || !rule.matches(update) {
+			continue
+		}
+		key := rule.ID + "|" + update.NodeID + "/" + update.EndpointID
+		state, ok := e.states[key]
+		if !ok {
+			state = &alertState{ruleID: rule.ID}
+			e.states[key] = state
+		}
+		state.last = update
+		switch holds := alertOperators[rule.Operator](value, rule.Threshold); {
+		case holds && state.pendingSince.IsZero():
+			state.pendingSince = at
+		case !holds:
+			state.pendingSince = time.Time{}
+			if state.alert != nil {
+				e.clearLocked(state, at)
+			}
+			continue
+		}
+		if state.alert != nil {
+			state.alert.Value = value
+		}
+		e.checkLocked(rule, state, at)
+	}
+}
+
+// checkLocked raises the alert of a state whose condition held long enough.
+func (e *AlertEngine) checkLocked(rule *AlertRule, state *alertState, now time.Time) {
+	if state.alert != nil || state.pendingSince.IsZero() || now.Sub(state.pendingSince) < time.Duration(rule.ForSeconds)*time.Second {
+		return
+	}
+	value, _ := toFloat(state.last.Value)
+	state.alert = &Alert{
+		RuleID:     rule.ID,
+		RuleName:   rule.Name,
+		Severity:   rule.Severity,
+		NodeID:     state.last.NodeID,
+		EndpointID: state.last.EndpointID,
+		Cluster:    state.last.Cluster,
+		Attribute:  state.last.Attribute,
+		Value:      value,
+		Unit:       state.last.Unit,
+		Condition:  fmt.Sprintf("%s %g", rule.Operator, rule.Threshold),
+		RaisedAt:   now,
+	}
+	log.Printf("Alert %s raised: node %s EP%s %s.%s = %g %s", rule.ID, state.alert.NodeID, state.alert.EndpointID, state.alert.Cluster, state.alert.Attribute, value, state.alert.Condition)
+	e.recordLocked(*state.alert)
+	broadcastToClients("alert_raised", *state.alert)
+}
+
+// clearLocked clears the raised alert of a state.
+func (e *AlertEngine) clearLocked(state *alertState, now time.Time) {
+	cleared := *state.alert
+	cleared.ClearedAt = now
+	if value, ok := toFloat(state.last.Value); ok {
+		cleared.Value = value
+	}
+	state.alert = nil
+	log.Printf("Alert %s cleared: node %s EP%s", cleared.RuleID, cleared.NodeID, cleared.EndpointID)
+	e.recordLocked(cleared)
+	broadcastToClients("alert_cleared", cleared)
+}
+
+// recordLocked appends an alert to the persisted history.
+func (e *AlertEngine) recordLocked(alert Alert) {
+	e.history = append(e.history, alert)
+	if len(e.history) > maxAlertHistory {
+		e.history = e.history[len(e.history)-maxAlertHistory:]
+	}
+	if err := saveJSONFile(e.historyPath, e.history); err != nil {
+		log.Printf("Could not save alert history: %v", err)
+	}
+}
+
+// PruneHistoryBefore drops the past alerts cleared before cutoff. It returns how many were dropped.
+func (e *AlertEngine) PruneHistoryBefore(cutoff time.Time) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	kept := e.history[:0]
+	for _, alert := range e.history {
+		at := alert.ClearedAt
+		if at.IsZero() {
+			at = alert.RaisedAt
+		}
+		if !at.Before(cutoff) {
+			kept = append(kept, alert)
+		}
+	}
+	pruned := len(e.history) - len(kept)
+	e.history = kept
+	if pruned > 0 {
+		if err := saveJSONFile(e.historyPath, e.history); err != nil {
+			log.Printf("Could not save alert history: %v", err)
+		}
+	}
+	return pruned
+}
+
+// Run raises the alerts whose condition has held for their duration without a new update, forever.
+func (e *AlertEngine) Run() {
+	for {
+		time.Sleep(alertTick)
+		now := time.Now()
+		e.mu.Lock()
+		for _, state := range e.states {
+			if rule, ok := e.rules[state.ruleID]; ok && rule.Enabled {
+				e.checkLocked(rule, state, now)
+			}
+		}
+		e.mu.Unlock()
+	}
+}
+
+var alertEngine = NewAlertEngine(alertRulesFile, alertHistoryFile)
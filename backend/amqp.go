@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AMQP defaults, used when the config and the URL don't set them.
+const (
+	defaultAMQPExchange = "amq.topic"
+	defaultAMQPPort     = "5672"
+	defaultAMQPSPort    = "5671"
+	amqpMaxFrameSize    = 131072 // Offered when the broker sets no limit
+	amqpChannel         = 1
+)
+
+// AMQP frame types.
+const (
+	amqpFrameMethod = 1
+	amqpFrameHeader = 2
+	amqpFrameBody   = 3
+	amqpFrameEnd    = 0xCE
+)
+
+// amqpMethod identifies an AMQP method by its class and method IDs.
+type amqpMethod struct{ class, method uint16 }
+
+// The AMQP 0-9-1 methods the publisher sends or expects.
+var (
+	amqpConnectionStart   = amqpMethod{10, 10}
+	amqpConnectionStartOk = amqpMethod{10, 11}
+	amqpConnectionTune    = amqpMethod{10, 30}
+	amqpConnectionTuneOk  = amqpMethod{10, 31}
+	amqpConnectionOpen    = amqpMethod{10, 40}
+	amqpConnectionOpenOk  = amqpMethod{10, 41}
+	amqpConnectionClose   = amqpMethod{10, 50}
+	amqpChannelOpen       = amqpMethod{20, 10}
+	amqpChannelOpenOk     = amqpMethod{20, 11}
+	amqpChannelClose      = amqpMethod{20, 40}
+	amqpBasicPublish      = amqpMethod{60, 40}
+	amqpBasicAck          = amqpMethod{60, 80}
+	amqpBasicNack         = amqpMethod{60, 120}
+	amqpConfirmSelect     = amqpMethod{85, 10}
+	amqpConfirmSelectOk   = amqpMethod{85, 11}
+)
+
+// amqpFrame is a frame read from the broker.
+type amqpFrame struct {
+	kind    byte
+	channel uint16
+	payload []byte
+}
+
+// method returns the method of a method frame, and its arguments.
+func (f amqpFrame) method() (amqpMethod, []byte) {
+	if f.kind != amqpFrameMethod || len(f.payload) < 4 {
+		return amqpMethod{}, nil
+	}
+	return amqpMethod{binary.BigEndian.Uint16(f.payload), binary.BigEndian.Uint16(f.payload[2:])}, f.payload[4:]
+}
+
+// amqpCloseError describes the Connection.Close or Channel.Close the broker sent in a frame.
+func amqpCloseError(args []byte) error {
+	if len(args) < 3 || len(args) < 3+int(args[2]) {
+		return errors.New("closed by the broker")
+	}
+	return fmt.Errorf("closed by the broker: %d %s", binary.BigEndian.Uint16(args), args[3:3+int(args[2])])
+}
+
+// amqpShortString encodes a short string (at most 255 bytes).
+func amqpShortString(s string) []byte {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	return append([]byte{byte(len(s))}, s...)
+}
+
+// amqpLongString encodes a long string.
+func amqpLongString(s string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(s))), s...)
+}
+
+// encodeAMQPFrame builds a frame.
+func encodeAMQPFrame(kind byte, channel uint16, payload []byte) []byte {
+	frame := []byte{kind}
+	frame = binary.BigEndian.AppendUint16(frame, channel)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	return append(append(frame, payload...), amqpFrameEnd)
+}
+
+// encodeAMQPMethod builds a method frame.
+func encodeAMQPMethod(channel uint16, m amqpMethod, args ...[]byte) []byte {
+	payload := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, m.class), m.method)
+	for _, arg := range args {
+		payload = append(payload, arg...)
+	}
+	return encodeAMQPFrame(amqpFrameMethod, channel, payload)
+}
+
+// readAMQPFrame reads a frame.
+func readAMQPFrame(r *bufio.Reader) (amqpFrame, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return amqpFrame{}, err
+	}
+	frame := amqpFrame{kind: header[0], channel: binary.BigEndian.Uint16(header[1:]), payload: make([]byte, binary.BigEndian.Uint32(header[3:]))}
+	if _, err := io.ReadFull(r, frame.payload); err != nil {
+		return amqpFrame{}, err
+	}
+	if end, err := r.ReadByte(); err != nil || end != amqpFrameEnd {
+		return amqpFrame{}, errors.New("malformed frame")
+	}
+	return frame, nil
+}
+
+// amqpConfirm is a publisher confirm: the broker took (ack) or refused (nack) the messages up to tag.
+type amqpConfirm struct {
+	tag uint64
+	ack bool
+}
+
+// amqpPublisher is a minimal AMQP 0-9-1 client: it only publishes, persistent messages to an
+// exchange, on a channel in confirm mode so the journal knows the broker got each message. Like
+// the MQTT publisher, it reconnects lazily when a publish finds the connection gone.
+type amqpPublisher struct {
+	mu       sync.Mutex
+	cfg      AMQPConfig
+	conn     net.Conn
+	frameMax int
+	tag      uint64           // Delivery tag of the last message published on conn
+	confirms chan amqpConfirm // Publisher confirms received on conn
+	closeErr chan error       // Channel.Close or Connection.Close received on conn
+	closed   chan struct{}    // Closed when conn is gone
+	exchange string
+	vhost    string
+	user     string
+	password string
+	secure   bool
+	dialAddr string
+	hostname string
+	redacted string
+}
+
+// newAMQPPublisher checks the AMQP settings and creates their publisher, not connected yet.
+func newAMQPPublisher(cfg AMQPConfig) (*amqpPublisher, error) {
+	server, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	p := &amqpPublisher{cfg: cfg, exchange: cfg.Exchange, vhost: "/", user: "guest", password: "guest", hostname: server.Hostname(), redacted: server.Redacted()}
+	port := defaultAMQPPort
+	switch server.Scheme {
+	case "amqp":
+	case "amqps":
+		p.secure, port = true, defaultAMQPSPort
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, use amqp:// or amqps://", server.Scheme)
+	}
+	if p.hostname == "" {
+		return nil, errors.New("the URL has no host")
+	}
+	if server.Port() != "" {
+		port = server.Port()
+	}
+	p.dialAddr = net.JoinHostPort(p.hostname, port)
+	if vhost := strings.TrimPrefix(server.Path, "/"); vhost != "" {
+		p.vhost = vhost
+	}
+	if server.User != nil {
+		p.user = server.User.Username()
+		p.password, _ = server.User.Password()
+	}
+	if p.exchange == "" {
+		p.exchange = defaultAMQPExchange
+	}
+	return p, nil
+}
+
+// connect opens the broker connection, authenticates with PLAIN, opens the channel and puts it in
+// confirm mode. Callers must hold p.mu.
+func (p *amqpPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.dialAddr, brokerDialTimeout)
+	if err != nil {
+		return err
+	}
+	if p.secure {
+		tlsConfig, err := brokerTLSConfig(p.cfg.TLS, p.hostname)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		_ = tlsConn.SetDeadline(time.Now().Add(brokerDialTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return fmt.Errorf("TLS handshake: %w", err)
+		}
+		conn = tlsConn
+	}
+	_ = conn.SetDeadline(time.Now().Add(brokerDialTimeout))
+	r := bufio.NewReader(conn)
+	expect := func(want amqpMethod) ([]byte, error) {
+		for {
+			frame, err := readAMQPFrame(r)
+			if err != nil {
+				return nil, err
+			}
+			m, args := frame.method()
+			switch m {
+			case want:
+				return args, nil
+			case amqpConnectionClose, amqpChannelClose:
+				return nil, amqpCloseError(args)
+			}
+		}
+	}
+	fail := func(step string, err error) error {
+		conn.Close()
+		if err == io.EOF {
+			err = errors.New("connection closed by the broker")
+		}
+		return fmt.Errorf("%s: %w", step, err)
+	}
+
+	if _, err := conn.Write([]byte("AMQP\x00\x00\x09\x01")); err != nil {
+		return fail("protocol header", err)
+	}
+	if _, err := expect(amqpConnectionStart); err != nil {
+		return fail("connection start", err)
+	}
+	emptyTable := []byte{0, 0, 0, 0}
+	response := amqpLongString("\x00" + p.user + "\x00" + p.password)
+	if _, err := conn.Write(encodeAMQPMethod(0, amqpConnectionStartOk, emptyTable, amqpShortString("PLAIN"), response, amqpShortString("en_US"))); err != nil {
+		return fail("authentication", err)
+	}
+	tune, err := expect(amqpConnectionTune)
+	if err != nil {
+		return fail("authentication", err) // A broker refusing the credentials closes the connection here
+	}
+	if len(tune) < 8 {
+		return fail("tuning", errors.New("malformed Connection.Tune"))
+	}
+	channelMax, frameMax := binary.BigEndian.Uint16(tune), binary.BigEndian.Uint32(tune[2:])
+	if frameMax == 0 || frameMax > amqpMaxFrameSize {
+		frameMax = amqpMaxFrameSize
+	}
+	// No heartbeats: the publisher is idle between events and reconnects when a publish fails
+	tuneOk := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint16(nil, channelMax), frameMax), 0)
+	if _, err := conn.Write(append(encodeAMQPMethod(0, amqpConnectionTuneOk, tuneOk), encodeAMQPMethod(0, amqpConnectionOpen, amqpShortString(p.vhost), amqpShortString(""), []byte{0})...)); err != nil {
+		return fail("tuning", err)
+	}
+	if _, err := expect(amqpConnectionOpenOk); err != nil {
+		return fail(fmt.Sprintf("opening virtual host %q", p.vhost), err)
+	}
+	if _, err := conn.Write(encodeAMQPMethod(amqpChannel, amqpChannelOpen, amqpShortString(""))); err != nil {
+		return fail("opening the channel", err)
+	}
+	if _, err := expect(amqpChannelOpenOk); err != nil {
+		return fail("opening the channel", err)
+	}
+	if _, err := conn.Write(encodeAMQPMethod(amqpChannel, amqpConfirmSelect, []byte{0})); err != nil {
+		return fail("enabling publisher confirms", err)
+	}
+	if _, err := expect(amqpConfirmSelectOk); err != nil {
+		return fail("enabling publisher confirms", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	p.conn, p.frameMax, p.tag = conn, int(frameMax), 0
+	p.confirms, p.closeErr, p.closed = make(chan amqpConfirm, 16), make(chan error, 1), make(chan struct{})
+	go p.drain(conn, r, p.confirms, p.closeErr, p.closed)
+	log.Printf("AMQP: connected to %s, publishing to exchange %s", p.redacted, p.exchange)
+	return nil
+}
+
+// drain reads what the broker sends, passing on the publisher confirms and the closes, e.g. of
+// the channel when the exchange doesn't exist, and notices a closed connection.
+func (p *amqpPublisher) drain(conn net.Conn, r *bufio.Reader, confirms chan<- amqpConfirm, closeErr chan<- error, closed chan struct{}) {
+	for {
+		frame, err := readAMQPFrame(r)
+		if err != nil {
+			break
+		}
+		m, args := frame.method()
+		switch m {
+		case amqpBasicAck, amqpBasicNack:
+			if len(args) >= 8 {
+				select {
+				case confirms <- amqpConfirm{tag: binary.BigEndian.Uint64(args), ack: m == amqpBasicAck}:
+				default:
+				}
+			}
+		case amqpConnectionClose, amqpChannelClose:
+			select {
+			case closeErr <- amqpCloseError(args):
+			default:
+			}
+			conn.Close() // Reconnect rather than reopen the channel
+		}
+	}
+	close(closed)
+	p.mu.Lock()
+	if p.conn == conn {
+		p.conn = nil
+	}
+	p.mu.Unlock()
+	conn.Close()
+}
+
+// Publish sends a persistent JSON message to the exchange with routingKey, connecting first if
+// needed, and waits for the broker's confirm.
+func (p *amqpPublisher) Publish(routingKey string, message []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	publish := encodeAMQPMethod(amqpChannel, amqpBasicPublish, []byte{0, 0}, amqpShortString(p.exchange), amqpShortString(routingKey), []byte{0})
+	// Content header: class, weight, body size, then the content-type and delivery-mode properties
+	header := binary.BigEndian.AppendUint16(nil, amqpBasicPublish.class)
+	header = binary.BigEndian.AppendUint16(header, 0)
+	header = binary.BigEndian.AppendUint64(header, uint64(len(message)))
+	header = binary.BigEndian.AppendUint16(header, 0x8000|0x1000)
+	header = append(append(header, amqpShortString("application/json")...), 2) // Persistent
+	packet := append(publish, encodeAMQPFrame(amqpFrameHeader, amqpChannel, header)...)
+	for chunk := p.frameMax - 8; len(message) > 0; {
+		n := min(chunk, len(message))
+		packet = append(packet, encodeAMQPFrame(amqpFrameBody, amqpChannel, message[:n])...)
+		message = message[n:]
+	}
+	_ = p.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err := p.conn.Write(packet); err != nil {
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	p.tag++
+	tag, confirms, closeErr, closed := p.tag, p.confirms, p.closeErr, p.closed
+	timeout := time.NewTimer(brokerAckTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case confirm := <-confirms:
+			if confirm.tag < tag {
+				continue // Of a previous message that timed out
+			}
+			if !confirm.ack {
+				return errors.New("the broker refused the message")
+			}
+			return nil
+		case err := <-closeErr:
+			return err
+		case <-closed:
+			return errors.New("connection closed before the confirm")
+		case <-timeout.C:
+			p.conn.Close() // The broker is unresponsive; the next publish reconnects
+			p.conn = nil
+			return errors.New("no confirm from the broker")
+		}
+	}
+}
+
+// Close closes the broker connection, if any.
+func (p *amqpPublisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// applyAMQP switches the AMQP sink to cfg when it changed.
+func applyAMQP(cfg AMQPConfig) {
+	amqpSink.apply(cfg, cfg.URL, cfg.Types, cfg.RoutingKey, func() (eventPublisher, error) {
+		return newAMQPPublisher(cfg)
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// REST API prefixes. Routes are registered per version, so a /api/v2 group can be added next to
+// /api/v1 with its own routes while /api/v1 keeps serving existing integrations.
+const (
+	apiV1Prefix     = "/api/v1"
+	legacyAPIPrefix = "/api" // Unversioned paths of the first releases, now aliases of /api/v1
+)
+
+// legacyAPIDeprecatedAt is when the unversioned /api paths were deprecated in favor of /api/v1.
+var legacyAPIDeprecatedAt = time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+
+// APIConfig sets the REST API versions (see apiversions.go).
+type APIConfig struct {
+	// RequireAuth requires the authToken on REST calls too (Authorization: Bearer <token>), as on /ws.
+	RequireAuth bool `json:"requireAuth,omitempty"`
+	// LegacySunset is the date (2006-01-02) after which the unversioned /api paths may go away,
+	// announced in their Sunset header.
+	LegacySunset string `json:"legacySunset,omitempty"`
+	// DisableLegacy serves the versioned paths only.
+	DisableLegacy bool `json:"disableLegacy,omitempty"`
+}
+
+// APIDeprecation describes a deprecated API version, announced on each of its responses with the
+// Deprecation (RFC 9745), Sunset (RFC 8594) and Link rel="successor-version" headers.
+type APIDeprecation struct {
+	Since     time.Time
+	Sunset    time.Time // Zero when no date was announced
+	Successor string    // Prefix replacing the deprecated one
+}
+
+// registerVersionedAPI registers routes under /api/v1 and, unless api.disableLegacy is set, under
+// the deprecated unversioned /api prefix.
+func registerVersionedAPI(router *gin.Engine, routes func(api *gin.RouterGroup)) {
+	routes(apiGroup(router, apiV1Prefix, "v1", nil))
+	if appConfig.API.DisableLegacy {
+		return
+	}
+	deprecation := &APIDeprecation{Since: legacyAPIDeprecatedAt, Successor: apiV1Prefix}
+	if appConfig.API.LegacySunset != "" {
+		if sunset, err := time.Parse("2006-01-02", appConfig.API.LegacySunset); err == nil {
+			deprecation.Sunset = sunset
+		}
+	}
+	routes(apiGroup(router, legacyAPIPrefix, "legacy", deprecation))
+}
+
+// apiGroup creates the group of an API version with the middleware its routes share: request
+// metrics, the deprecation headers of a deprecated version and authentication.
+func apiGroup(router *gin.Engine, prefix, version string, deprecation *APIDeprecation) *gin.RouterGroup {
+	group := router.Group(prefix)
+	group.Use(apiMetrics.middleware(version))
+	if deprecation != nil {
+		group.Use(deprecationMiddleware(prefix, *deprecation))
+	}
+	group.Use(apiAuthMiddleware)
+	return group
+}
+
+// deprecationMiddleware announces that the routes under prefix are deprecated, pointing to the
+// same path under the successor prefix.
+func deprecationMiddleware(prefix string, deprecation APIDeprecation) gin.HandlerFunc {
+	since := "@" + strconv.FormatInt(deprecation.Since.Unix(), 10)
+	return func(c *gin.Context) {
+		c.Header("Deprecation", since)
+		if !deprecation.Sunset.IsZero() {
+			c.Header("Sunset", deprecation.Sunset.UTC().Format(http.TimeFormat))
+		}
+		successor := deprecation.Successor + strings.TrimPrefix(c.Request.URL.Path, prefix)
+		c.Header("Link", "<"+externalBasePath(c.Request)+successor+`>; rel="successor-version"`)
+		c.Next()
+	}
+}
+
+// apiAuthMiddleware requires the authToken on REST calls when api.requireAuth is set.
+func apiAuthMiddleware(c *gin.Context) {
+	if !appConfig.API.RequireAuth || appConfig.AuthToken == "" {
+		c.Next()
+		return
+	}
+	if !tokensEqual(c.GetHeader("Authorization"), "Bearer "+appConfig.AuthToken) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid bearer token", "code": errCodeUnauthenticated})
+		return
+	}
+	c.Next()
+}
+
+// APIVersionStats counts the REST requests of an API version, in GET /api/v1/status.
+type APIVersionStats struct {
+	Requests     int            `json:"requests"`
+	ClientErrors int            `json:"clientErrors"` // 4xx answers
+	ServerErrors int            `json:"serverErrors"` // 5xx answers
+	Routes       map[string]int `json:"routes"`       // Requests by route, e.g. to find integrations still on /api
+	LastRequest  time.Time      `json:"lastRequest,omitzero"`
+}
+
+// APIMetrics counts the REST requests by API version.
+type APIMetrics struct {
+	mu       sync.Mutex
+	versions map[string]*APIVersionStats
+}
+
+func (m *APIMetrics) middleware(version string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		stats, ok := m.versions[version]
+		if !ok {
+			stats = &APIVersionStats{Routes: make(map[string]int)}
+			m.versions[version] = stats
+		}
+		stats.Requests++
+		stats.LastRequest = time.Now()
+		switch status := c.Writer.Status(); {
+		case status >= 500:
+			stats.ServerErrors++
+		case status >= 400:
+			stats.ClientErrors++
+		}
+		if route := c.FullPath(); route != "" {
+			stats.Routes[c.Request.Method+" "+route]++
+		}
+	}
+}
+
+// APIStatus is the "api" part of GET /api/v1/status.
+type APIStatus struct {
+	Versions   []string                   `json:"versions"`             // Served prefixes, newest first
+	Deprecated []string                   `json:"deprecated,omitempty"` // Served but deprecated
+	Stats      map[string]APIVersionStats `json:"stats"`
+}
+
+// Status reports the served versions and their request counts.
+func (m *APIMetrics) Status() APIStatus {
+	status := APIStatus{Versions: []string{apiV1Prefix}, Stats: make(map[string]APIVersionStats)}
+	if !appConfig.API.DisableLegacy {
+		status.Versions = append(status.Versions, legacyAPIPrefix)
+		status.Deprecated = []string{legacyAPIPrefix}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for version, stats := range m.versions {
+		copied := *stats
+		copied.Routes = make(map[string]int, len(stats.Routes))
+		for route, n := range stats.Routes {
+			copied.Routes[route] = n
+		}
+		status.Stats[version] = copied
+	}
+	return status
+}
+
+var apiMetrics = &APIMetrics{versions: make(map[string]*APIVersionStats)}
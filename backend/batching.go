@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxAttributeBatchMs bounds the batching interval a client may ask for.
+const maxAttributeBatchMs = 5000
+
+// AttributeUpdateBatchPayload is sent as "attribute_update_batch": the attribute updates
+// reported during one flush interval, oldest first, with only the latest of each attribute.
+type AttributeUpdateBatchPayload struct {
+	Updates []interface{} `json:"updates"` // attribute_update payloads
+}
+
+// batchedUpdate is an attribute update waiting for the flush, with the requestId of the
+// subscription that reported it.
+type batchedUpdate struct {
+	requestID string
+	payload   interface{}
+}
+
+// updateBatch collects the reported attribute updates of one client until its next flush.
+type updateBatch struct {
+	mu      sync.Mutex
+	updates []batchedUpdate
+	index   map[string]int // Position of each attribute in updates, by requestId and stateKey
+	timer   *time.Timer
+}
+
+// attributeBatchInterval returns a connection's batching interval: the batchMs query parameter
+// of /ws, else attributeBatchMs from the config. Zero turns batching off.
+func attributeBatchInterval(r *http.Request) time.Duration {
+	ms := appConfig.AttributeBatchMs
+	if v := r.URL.Query().Get("batchMs"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			ms = n
+		}
+	}
+	ms = min(max(ms, 0), maxAttributeBatchMs)
+	return time.Duration(ms) * time.Millisecond
+}
+
+// batchable reports whether an event may wait for the client's next flush: attribute updates
+// reported by subscriptions and polls. Reads and optimistic updates are never delayed, as a
+// client is waiting for them.
+func (c *Client) batchable(event Event) bool {
+	if c.batchInterval <= 0 || event.Type != "attribute_update" {
+		return false
+	}
+	update, ok := event.Payload.(AttributeUpdatePayload)
+	return ok && (update.Source == sourceSubscription || update.Source == "poll")
+}
+
+// addToBatch queues a localized attribute update until the client's next flush, replacing an
+// update of the same attribute already waiting. The first update of a batch starts the timer.
+func (h *Hub) addToBatch(client *Client, event Event, payload interface{}) {
+	update := event.Payload.(AttributeUpdatePayload)
+	key := event.RequestID + "|" + stateKey(update.NodeID, update.EndpointID, update.Cluster, update.Attribute)
+	b := client.batch
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if i, ok := b.index[key]; ok {
+		b.updates[i].payload = payload
+		return
+	}
+	b.index[key] = len(b.updates)
+	b.updates = append(b.updates, batchedUpdate{requestID: event.RequestID, payload: payload})
+	if b.timer == nil {
+		b.timer = time.AfterFunc(client.batchInterval, func() { h.flushBatch(client) })
+	}
+}
+
+// flushBatch sends the updates a client collected, one message per requestId: a lone update as a
+// plain "attribute_update", several as one "attribute_update_batch".
+func (h *Hub) flushBatch(client *Client) {
+	b := client.batch
+	b.mu.Lock()
+	updates := b.updates
+	b.updates, b.index, b.timer = nil, make(map[string]int), nil
+	b.mu.Unlock()
+	var requestIDs []string
+	byRequest := make(map[string][]interface{})
+	for _, u := range updates {
+		if _, ok := byRequest[u.requestID]; !ok {
+			requestIDs = append(requestIDs, u.requestID)
+		}
+		byRequest[u.requestID] = append(byRequest[u.requestID], u.payload)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.clients[client] {
+		return // Disconnected meanwhile: its send channel is closed
+	}
+	for _, requestID := range requestIDs {
+		payloads := byRequest[requestID]
+		if len(payloads) == 1 {
+			if h.queueMessage(client, "attribute_update", requestID, payloads[0]) {
+				h.delivered[eventTopic("attribute_update")]++
+			}
+			continue
+		}
+		if h.queueMessage(client, "attribute_update_batch", requestID, AttributeUpdateBatchPayload{Updates: payloads}) {
+			h.delivered[eventTopic("attribute_update")]++
+			h.batchedUpdates += len(payloads)
+		}
+	}
+}
+
+// newUpdateBatch creates the batch of a client that batches its attribute updates, nil otherwise.
+func newUpdateBatch(interval time.Duration) *updateBatch {
+	if interval <= 0 {
+		return nil
+	}
+	return &updateBatch{index: make(map[string]int)}
+}
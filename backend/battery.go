@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// powerSourceClusterID is the Matter cluster ID of the PowerSource cluster (0x002F).
+const powerSourceClusterID = 0x002F
+
+// powerSourceFeatureBattery is the BAT bit of the PowerSource FeatureMap.
+const powerSourceFeatureBattery = 0x2
+
+// defaultLowBatteryPercent is the threshold of the built-in low-battery alert rule.
+const defaultLowBatteryPercent = 20
+
+// IDs of the built-in battery alert rules. They are created once and can then be edited or disabled like any rule.
+const (
+	lowBatteryRuleID         = "battery-low"
+	batteryReplacementRuleID = "battery-replacement"
+)
+
+// batChargeLevels maps the BatChargeLevelEnum of the PowerSource cluster to readable levels.
+var batChargeLevels = map[int64]string{0: "ok", 1: "warning", 2: "critical"}
+
+// BatteryStatus is the battery state of a device, mirrored from its PowerSource attributes.
+type BatteryStatus struct {
+	EndpointID        string    `json:"endpointId"`        // Endpoint hosting the PowerSource cluster
+	Percent           *float64  `json:"percent,omitempty"` // BatPercentRemaining, in %
+	ChargeLevel       string    `json:"chargeLevel,omitempty"`
+	ReplacementNeeded bool      `json:"replacementNeeded,omitempty"`
+	UpdatedAt         time.Time `json:"updatedAt"`
+}
+
+// applyBatteryUpdate updates a device's BatteryStatus from a PowerSource attribute update.
+func applyBatteryUpdate(device *RegisteredDevice, update AttributeUpdatePayload) {
+	if device.Battery == nil {
+		device.Battery = &BatteryStatus{}
+	}
+	battery := device.Battery
+	battery.EndpointID, battery.UpdatedAt = update.EndpointID, time.Now()
+	switch update.Attribute {
+	case "bat-percent-remaining":
+		if percent, ok := toFloat(update.Value); ok {
+			battery.Percent = &percent
+		}
+	case "bat-charge-level":
+		if level, ok := toFloat(update.Value); ok {
+			battery.ChargeLevel = batChargeLevels[int64(level)]
+		}
+	case "bat-replacement-needed":
+		if needed, ok := update.Value.(bool); ok {
+			battery.ReplacementNeeded = needed
+		}
+	}
+}
+
+// batteryEndpoint returns the endpoint of a node hosting a battery PowerSource cluster, if any.
+// PowerSource lives on the root endpoint or on the device's own endpoint, depending on the vendor.
+func batteryEndpoint(nodeID, primaryEndpoint string) (string, bool) {
+	for _, endpointID := range []string{primaryEndpoint, "0"} {
+		hasPowerSource, err := endpointHasCluster(nodeID, endpointID, powerSourceClusterID)
+		if err != nil || !hasPowerSource {
+			continue
+		}
+		features, err := introspectionCache.ReadAttribute(nodeID, endpointID, "PowerSource", "feature-map")
+		if err != nil {
+			log.Printf("Could not read PowerSource features of Node %s EP%s: %v", nodeID, endpointID, err)
+			continue
+		}
+		if f, ok := toFloat(features); ok && int64(f)&powerSourceFeatureBattery != 0 {
+			return endpointID, true
+		}
+	}
+	return "", false
+}
+
+// detectAndSubscribeBattery subscribes to the battery attributes of battery powered nodes. Used right after commissioning.
+func detectAndSubscribeBattery(client *Client, nodeID, primaryEndpoint string) {
+	endpointID, ok := batteryEndpoint(nodeID, primaryEndpoint)
+	if !ok {
+		return
+	}
+	client.notifyClientLog("subscription_log", fmt.Sprintf("Node %s EP%s is battery powered, subscribing to its battery level.", nodeID, endpointID))
+	if err := subscribeSensorBundle(client, nodeID, endpointID, "battery"); err != nil {
+		log.Printf("Could not subscribe to the battery of Node %s: %v", nodeID, err)
+	}
+}
+
+// lowBatteryThreshold returns the battery percentage below which a battery counts as low.
+func lowBatteryThreshold() int {
+	if appConfig.Battery.LowPercent > 0 {
+		return appConfig.Battery.LowPercent
+	}
+	return defaultLowBatteryPercent
+}
+
+// ensureBatteryAlertRules creates the built-in low-battery alert rules when they don't exist yet.
+func ensureBatteryAlertRules() {
+	threshold := lowBatteryThreshold()
+	rules := []AlertRule{
+		{
+			ID: lowBatteryRuleID, Name: "Low battery", Enabled: true, Severity: "warning",
+			Cluster: "PowerSource", Attribute: "bat-percent-remaining", Operator: "<", Threshold: float64(threshold),
+		},
+		{
+			ID: batteryReplacementRuleID, Name: "Battery replacement needed", Enabled: true, Severity: "warning",
+			Cluster: "PowerSource", Attribute: "bat-replacement-needed", Operator: "==", Threshold: 1,
+		},
+	}
+	for _, rule := range rules {
+		if err := alertEngine.PutIfMissing(rule); err != nil {
+			log.Printf("Could not create alert rule %s: %v", rule.ID, err)
+		}
+	}
+}
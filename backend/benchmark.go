@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defaults and limits of "benchmark_device".
+const (
+	defaultBenchmarkBursts        = 1
+	defaultBenchmarkBurstSize     = 10
+	defaultBenchmarkBurstInterval = time.Second
+	maxBenchmarkOperations        = 10000 // bursts × burstSize
+	maxBenchmarkConcurrency       = 8
+	maxBenchmarkRetries           = 5
+	maxBenchmarkInterval          = time.Hour
+	maxBenchmarkErrors            = 10 // Distinct error messages reported
+)
+
+// Operation kinds of a benchmark.
+const (
+	benchmarkRead    = "read"
+	benchmarkCommand = "command"
+)
+
+// BenchmarkOperation is an operation of a benchmark: an attribute read or a device command.
+type BenchmarkOperation struct {
+	Kind       string                 `json:"kind"` // "read" or "command"
+	Cluster    string                 `json:"cluster"`
+	Attribute  string                 `json:"attribute,omitempty"`  // For reads
+	EndpointID string                 `json:"endpointId,omitempty"` // For reads; defaults to the device's endpoint
+	Command    string                 `json:"command,omitempty"`    // For commands, e.g. "Toggle"
+	Params     map[string]interface{} `json:"params,omitempty"`
+}
+
+// name is the label of the operation in the report, e.g. "read onoff.on-off" or "OnOff.Toggle".
+func (o BenchmarkOperation) name() string {
+	if o.Kind == benchmarkRead {
+		return fmt.Sprintf("read %s.%s", o.Cluster, o.Attribute)
+	}
+	return o.Cluster + "." + o.Command
+}
+
+// BenchmarkDevicePayload is the payload of "benchmark_device": Bursts bursts of BurstSize
+// operations, BurstIntervalMs apart, cycling through Operations. Within a burst, Concurrency
+// operations are in flight at once, each started IntervalMs after the previous one.
+type BenchmarkDevicePayload struct {
+	DeviceID        string               `json:"deviceId" validate:"required"`
+	Operations      []BenchmarkOperation `json:"operations,omitempty"` // Defaults to a read of the vendor ID, like diagnose_device
+	Bursts          int                  `json:"bursts,omitempty"`
+	BurstSize       int                  `json:"burstSize,omitempty"`
+	BurstIntervalMs int                  `json:"burstIntervalMs,omitempty"`
+	IntervalMs      int                  `json:"intervalMs,omitempty"`
+	Concurrency     int                  `json:"concurrency,omitempty"`
+	Retries         int                  `json:"retries,omitempty"` // Attempts after a failed one, per operation
+}
+
+// Validate implements Validator.
+func (p BenchmarkDevicePayload) Validate() error {
+	verr := &ValidationError{}
+	if p.DeviceID == "" {
+		verr.add("deviceId", "is required")
+	}
+	for i, op := range p.Operations {
+		field := fmt.Sprintf("operations[%d]", i)
+		switch {
+		case op.Kind == benchmarkRead && (op.Cluster == "" || op.Attribute == ""):
+			verr.add(field, "a read needs cluster and attribute")
+		case op.Kind == benchmarkCommand && (op.Cluster == "" || op.Command == ""):
+			verr.add(field, "a command needs cluster and command")
+		case op.Kind != benchmarkRead && op.Kind != benchmarkCommand:
+			verr.add(field+".kind", "must be read or command")
+		}
+	}
+	if p.Bursts < 0 || p.BurstSize < 0 || max(p.Bursts, 1)*max(p.BurstSize, 1) > maxBenchmarkOperations {
+		verr.add("bursts", fmt.Sprintf("bursts × burstSize must be at most %d", maxBenchmarkOperations))
+	}
+	if p.Concurrency < 0 || p.Concurrency > maxBenchmarkConcurrency {
+		verr.add("concurrency", fmt.Sprintf("must be between 1 and %d", maxBenchmarkConcurrency))
+	}
+	if p.Retries < 0 || p.Retries > maxBenchmarkRetries {
+		verr.add("retries", fmt.Sprintf("must be between 0 and %d", maxBenchmarkRetries))
+	}
+	for field, ms := range map[string]int{"intervalMs": p.IntervalMs, "burstIntervalMs": p.BurstIntervalMs} {
+		if ms < 0 || time.Duration(ms)*time.Millisecond > maxBenchmarkInterval {
+			verr.add(field, fmt.Sprintf("must be between 0 and %d", maxBenchmarkInterval.Milliseconds()))
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// withDefaults fills in the settings left out, for device.
+func (p BenchmarkDevicePayload) withDefaults(device RegisteredDevice) BenchmarkDevicePayload {
+	if len(p.Operations) == 0 {
+		op := BenchmarkOperation{Kind: benchmarkRead, Cluster: "BasicInformation", Attribute: "vendor-id", EndpointID: "0"}
+		if device.BridgeID != "" {
+			op.Cluster, op.EndpointID = "BridgedDeviceBasicInformation", device.EndpointID
+		}
+		p.Operations = []BenchmarkOperation{op}
+	}
+	if p.Bursts == 0 {
+		p.Bursts = defaultBenchmarkBursts
+	}
+	if p.BurstSize == 0 {
+		p.BurstSize = defaultBenchmarkBurstSize
+	}
+	if p.BurstIntervalMs == 0 && p.Bursts > 1 {
+		p.BurstIntervalMs = int(defaultBenchmarkBurstInterval.Milliseconds())
+	}
+	p.Concurrency = max(p.Concurrency, 1)
+	return p
+}
+
+// BenchmarkStats sums up a set of benchmark operations.
+type BenchmarkStats struct {
+	Operations  int                  `json:"operations"`
+	Succeeded   int                  `json:"succeeded"`
+	Failed      int                  `json:"failed"` // Still failing after the retries
+	FailureRate float64              `json:"failureRate"`
+	Attempts    int                  `json:"attempts"`
+	Retries     int                  `json:"retries"`           // Attempts after a failed one
+	Recovered   int                  `json:"recovered"`         // Operations that succeeded after a retry
+	Latency     *LatencyDistribution `json:"latency,omitempty"` // Of the successful operations, retries included
+}
+
+// BenchmarkOperationStats are the stats of one operation of the benchmark.
+type BenchmarkOperationStats struct {
+	Operation string `json:"operation"`
+	BenchmarkStats
+}
+
+// BenchmarkBurstStats are the stats of one burst, to see whether the device or network degrades
+// over the benchmark.
+type BenchmarkBurstStats struct {
+	Burst int `json:"burst"`
+	BenchmarkStats
+}
+
+// BenchmarkError counts the operations that failed with an error message.
+type BenchmarkError struct {
+	Message string `json:"message"`
+	Count   int    `json:"count"`
+}
+
+// BenchmarkReport is the result of a "benchmark_device" job, sent as "benchmark_result".
+type BenchmarkReport struct {
+	DeviceID       string                    `json:"deviceId"`
+	NodeID         string                    `json:"nodeId"`
+	JobID          string                    `json:"jobId"`
+	Settings       BenchmarkDevicePayload    `json:"settings"` // With the defaults filled in
+	Simulated      bool                      `json:"simulated"`
+	StartedAt      time.Time                 `json:"startedAt"`
+	DurationMs     float64                   `json:"durationMs"`
+	Throughput     float64                   `json:"throughput"`     // Operations per second
+	FirstLatencyMs float64                   `json:"firstLatencyMs"` // The first operation, which may include setting up the CASE session (see warmup.go)
+	Cancelled      bool                      `json:"cancelled,omitempty"`
+	Overall        BenchmarkStats            `json:"overall"`
+	ByOperation    []BenchmarkOperationStats `json:"byOperation"`
+	ByBurst        []BenchmarkBurstStats     `json:"byBurst"`
+	Errors         []BenchmarkError          `json:"errors,omitempty"` // Most frequent first
+}
+
+// benchmarkOutcome is the outcome of one operation.
+type benchmarkOutcome struct {
+	seq       int // Order the operations started in
+	operation int
+	burst     int
+	attempts  int
+	success   bool
+	latency   time.Duration // Until the success or the last failure
+	err       string
+}
+
+// benchmarkStats sums up outcomes.
+func benchmarkStats(outcomes []benchmarkOutcome) BenchmarkStats {
+	stats := BenchmarkStats{Operations: len(outcomes)}
+	var latencies []time.Duration
+	for _, outcome := range outcomes {
+		stats.Attempts += outcome.attempts
+		stats.Retries += outcome.attempts - 1
+		if !outcome.success {
+			stats.Failed++
+			continue
+		}
+		stats.Succeeded++
+		if outcome.attempts > 1 {
+			stats.Recovered++
+		}
+		latencies = append(latencies, outcome.latency)
+	}
+	if stats.Operations > 0 {
+		stats.FailureRate = float64(stats.Failed) / float64(stats.Operations)
+	}
+	stats.Latency = latencyDistribution(latencies)
+	return stats
+}
+
+// runBenchmarkOperation runs an operation on device, retrying it up to retries times unless the
+// benchmark is cancelled.
+func runBenchmarkOperation(ctx context.Context, device RegisteredDevice, op BenchmarkOperation, retries int) benchmarkOutcome {
+	outcome := benchmarkOutcome{}
+	started := time.Now()
+	for outcome.attempts == 0 || (outcome.attempts <= retries && ctx.Err() == nil) {
+		outcome.attempts++
+		var err error
+		switch op.Kind {
+		case benchmarkRead:
+			endpointID := op.EndpointID
+			if endpointID == "" {
+				endpointID = device.EndpointID
+			}
+			_, err = readAttributeValue(device.NodeID, endpointID, op.Cluster, op.Attribute)
+		default:
+			// Force, so the commands are sent even when the cached state says they change nothing
+			if success, errMsg, _ := runMacroStep(nil, DeviceCommandPayload{DeviceID: device.ID, Cluster: op.Cluster, Command: op.Command, Params: op.Params, Force: true}); !success {
+				err = fmt.Errorf("%s", errMsg)
+			}
+		}
+		outcome.latency = time.Since(started)
+		if err == nil {
+			outcome.success, outcome.err = true, ""
+			return outcome
+		}
+		outcome.err = err.Error()
+	}
+	return outcome
+}
+
+// benchmarkDevice runs the bursts of a benchmark and builds its report. Cancelling the job stops
+// it after the operations in flight; the report covers those done.
+func benchmarkDevice(ctx context.Context, job *Job, device RegisteredDevice, settings BenchmarkDevicePayload) (BenchmarkReport, error) {
+	report := BenchmarkReport{DeviceID: device.ID, NodeID: device.NodeID, JobID: job.Status().ID, Settings: settings, Simulated: *simulateFlag, StartedAt: time.Now()}
+	total := settings.Bursts * settings.BurstSize
+	log.Printf("Benchmarking device %s: %d burst(s) of %d operation(s), concurrency %d", device.ID, settings.Bursts, settings.BurstSize, settings.Concurrency)
+
+	var mu sync.Mutex
+	var outcomes []benchmarkOutcome
+	for burst := 0; burst < settings.Bursts && ctx.Err() == nil; burst++ {
+		if burst > 0 {
+			select {
+			case <-time.After(time.Duration(settings.BurstIntervalMs) * time.Millisecond):
+			case <-ctx.Done():
+			}
+		}
+		slots := make(chan struct{}, settings.Concurrency)
+		var wg sync.WaitGroup
+		for i := 0; i < settings.BurstSize && ctx.Err() == nil; i++ {
+			if i > 0 && settings.IntervalMs > 0 {
+				select {
+				case <-time.After(time.Duration(settings.IntervalMs) * time.Millisecond):
+				case <-ctx.Done():
+					continue
+				}
+			}
+			slots <- struct{}{}
+			seq := burst*settings.BurstSize + i
+			index := seq % len(settings.Operations)
+			wg.Add(1)
+			go func(seq, burst, index int) {
+				defer wg.Done()
+				outcome := runBenchmarkOperation(ctx, device, settings.Operations[index], settings.Retries)
+				outcome.seq, outcome.operation, outcome.burst = seq, index, burst
+				<-slots
+				mu.Lock()
+				outcomes = append(outcomes, outcome)
+				done := len(outcomes)
+				mu.Unlock()
+				job.SetProgress(done*100/total, fmt.Sprintf("Burst %d/%d: %d/%d operations", burst+1, settings.Bursts, done, total))
+			}(seq, burst, index)
+		}
+		wg.Wait()
+	}
+
+	elapsed := time.Since(report.StartedAt)
+	report.DurationMs = durationMs(elapsed)
+	report.Cancelled = ctx.Err() != nil
+	if len(outcomes) > 0 {
+		report.Throughput = float64(len(outcomes)) / elapsed.Seconds()
+	}
+	report.Overall = benchmarkStats(outcomes)
+	byOperation := make([][]benchmarkOutcome, len(settings.Operations))
+	byBurst := make([][]benchmarkOutcome, settings.Bursts)
+	errorCounts := map[string]int{}
+	for _, outcome := range outcomes {
+		byOperation[outcome.operation] = append(byOperation[outcome.operation], outcome)
+		byBurst[outcome.burst] = append(byBurst[outcome.burst], outcome)
+		if !outcome.success {
+			errorCounts[outcome.err]++
+		}
+		if outcome.seq == 0 {
+			report.FirstLatencyMs = durationMs(outcome.latency)
+		}
+	}
+	for i, op := range settings.Operations {
+		report.ByOperation = append(report.ByOperation, BenchmarkOperationStats{Operation: op.name(), BenchmarkStats: benchmarkStats(byOperation[i])})
+	}
+	for i, burst := range byBurst {
+		if len(burst) > 0 {
+			report.ByBurst = append(report.ByBurst, BenchmarkBurstStats{Burst: i, BenchmarkStats: benchmarkStats(burst)})
+		}
+	}
+	for message, count := range errorCounts {
+		report.Errors = append(report.Errors, BenchmarkError{Message: message, Count: count})
+	}
+	sort.Slice(report.Errors, func(i, j int) bool {
+		if report.Errors[i].Count != report.Errors[j].Count {
+			return report.Errors[i].Count > report.Errors[j].Count
+		}
+		return report.Errors[i].Message < report.Errors[j].Message
+	})
+	if len(report.Errors) > maxBenchmarkErrors {
+		report.Errors = report.Errors[:maxBenchmarkErrors]
+	}
+	log.Printf("Benchmark of device %s: %d operation(s), %d failed", device.ID, report.Overall.Operations, report.Overall.Failed)
+	return report, ctx.Err()
+}
+
+// handleBenchmarkDevice starts a "benchmark" job measuring the latency and failure rate of a
+// device; its report is sent as "benchmark_result" and kept as the job result.
+func handleBenchmarkDevice(client *Client, payload BenchmarkDevicePayload) {
+	device, ok := lookupDevice(payload.DeviceID)
+	if !ok {
+		client.notifyClient("error", map[string]interface{}{"message": fmt.Sprintf("benchmark_device failed: unknown device %q", payload.DeviceID)})
+		return
+	}
+	settings := payload.withDefaults(device)
+	for _, op := range settings.Operations {
+		if op.Kind == benchmarkCommand && readOnly.Enabled() {
+			client.notifyClient("error", map[string]interface{}{"message": readOnlyMessage("A benchmark sending commands"), "code": errCodeReadOnly})
+			return
+		}
+	}
+	jobs.Submit(client, "benchmark", func(ctx context.Context, job *Job) (interface{}, error) {
+		report, err := benchmarkDevice(ctx, job, device, settings)
+		client.sendPayload("benchmark_result", report)
+		return report, err
+	})
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BLE commissioning fails in chip-tool with the same generic BLE errors whether the device is out of
+// range or the host's Bluetooth can't work at all (no adapter, rfkill block, adapter powered off).
+// The pre-check tells these apart before any pairing: it checks the adapter, then scans briefly for
+// the Matter commissioning advertisement (service 0xFFF6) of the expected discriminator.
+// commission_device only pairs on-network so far, so it doesn't run the check yet.
+
+// Bluetooth pre-check settings; zero config values use the defaults here.
+const (
+	defaultBluetoothAdapter = "hci0"
+	defaultBLEScanDuration  = 5 * time.Second
+	maxBLEScanDuration      = 30 * time.Second
+	bluetoothctlTimeout     = 10 * time.Second // For the commands besides the scan
+	maxBLEInfoLookups       = 64               // Devices looked at after a scan, in a crowded place
+	matterBLEServiceUUID    = "0000fff6-0000-1000-8000-00805f9b34fb"
+)
+
+// sysClassDir holds the bluetooth and rfkill device classes.
+var sysClassDir = "/sys/class"
+
+// Error codes of the Bluetooth pre-check, distinct from the chip-tool BLE failures.
+const (
+	errCodeBluetoothUnavailable = "bluetooth_adapter_unavailable"
+	errCodeBluetoothBlocked     = "bluetooth_adapter_blocked"
+	errCodeBluetoothPoweredOff  = "bluetooth_adapter_powered_off"
+	errCodeBLEDeviceNotFound    = "ble_device_not_found"
+)
+
+// bluetoothHints tell the user how to fix each pre-check failure.
+var bluetoothHints = map[string]string{
+	errCodeBluetoothUnavailable: "The host has no usable Bluetooth adapter: check that it has one (or plug a USB dongle), that BlueZ (bluetoothd) is running, and that the adapter setting names it.",
+	errCodeBluetoothBlocked:     "The Bluetooth adapter is blocked by rfkill: run \"rfkill unblock bluetooth\". A hard block comes from a hardware switch or the firmware and must be cleared there.",
+	errCodeBluetoothPoweredOff:  "The Bluetooth adapter is powered off: run \"bluetoothctl power on\", or set AutoEnable=true in /etc/bluetooth/main.conf so it stays on.",
+	errCodeBLEDeviceNotFound:    "No Matter device advertises this discriminator over BLE: put the device in pairing mode (most stop advertising after 15 minutes, some need a button press or a power cycle) and bring it closer to the gateway.",
+}
+
+// BluetoothAdapterStatus is the state of the host's Bluetooth adapter.
+type BluetoothAdapterStatus struct {
+	Adapter     string `json:"adapter"`
+	Present     bool   `json:"present"`
+	Address     string `json:"address,omitempty"`
+	Powered     bool   `json:"powered"`
+	SoftBlocked bool   `json:"softBlocked"`
+	HardBlocked bool   `json:"hardBlocked"`
+	Ready       bool   `json:"ready"`          // Present, unblocked and powered: BLE commissioning can work
+	Code        string `json:"code,omitempty"` // Why it isn't ready
+	Error       string `json:"error,omitempty"`
+	Hint        string `json:"hint,omitempty"`
+}
+
+// BLEMatterDevice is a device advertising Matter commissioning over BLE.
+type BLEMatterDevice struct {
+	Address            string `json:"address"`
+	Name               string `json:"name,omitempty"`
+	Discriminator      string `json:"discriminator"`
+	ShortDiscriminator string `json:"shortDiscriminator"`
+	VendorID           string `json:"vendorId"`
+	ProductID          string `json:"productId"`
+	RSSI               *int   `json:"rssi,omitempty"`
+}
+
+// BLEPrecheckResult is the result of a Bluetooth pre-check ("check_bluetooth",
+// GET /api/v1/network/bluetooth?scan=true).
+type BLEPrecheckResult struct {
+	Adapter            BluetoothAdapterStatus `json:"adapter"`
+	Discriminator      string                 `json:"discriminator,omitempty"`
+	ShortDiscriminator string                 `json:"shortDiscriminator,omitempty"`
+	ScanSeconds        int                    `json:"scanSeconds,omitempty"`
+	Devices            []BLEMatterDevice      `json:"devices"` // Every Matter device heard advertising
+	Found              *BLEMatterDevice       `json:"found,omitempty"`
+	Success            bool                   `json:"success"`
+	Code               string                 `json:"code,omitempty"`
+	Error              string                 `json:"error,omitempty"`
+	Hint               string                 `json:"hint,omitempty"`
+}
+
+// CheckBluetoothPayload runs the pre-check ("check_bluetooth"). The discriminator comes from
+// discriminator, shortDiscriminator or a manual pairing code in setupCode; without any, the scan
+// only lists the Matter devices advertising.
+type CheckBluetoothPayload struct {
+	SetupCode          string `json:"setupCode,omitempty"`
+	Discriminator      string `json:"discriminator,omitempty"`
+	ShortDiscriminator string `json:"shortDiscriminator,omitempty"`
+	ScanSeconds        int    `json:"scanSeconds,omitempty"`
+	SkipScan           bool   `json:"skipScan,omitempty"` // Only check the adapter
+}
+
+// Validate checks the payload and derives the discriminators the scan looks for.
+func (p *CheckBluetoothPayload) Validate() error {
+	verr := &ValidationError{}
+	if p.SetupCode != "" {
+		if _, short, err := normalizeSetupCode(p.SetupCode); err != nil {
+			verr.add("setupCode", err.Error())
+		} else if p.ShortDiscriminator == "" {
+			p.ShortDiscriminator = short
+		}
+	}
+	long, err := normalizeDiscriminator(p.Discriminator, maxLongDiscriminator)
+	if err != nil {
+		verr.add("discriminator", err.Error())
+	}
+	short, err := normalizeDiscriminator(p.ShortDiscriminator, maxShortDiscriminator)
+	if err != nil {
+		verr.add("shortDiscriminator", err.Error())
+	}
+	if long != "" && short != "" && shortDiscriminatorOf(long) != short {
+		verr.add("discriminator", "does not match the short discriminator")
+	}
+	if p.ScanSeconds < 0 || time.Duration(p.ScanSeconds)*time.Second > maxBLEScanDuration {
+		verr.add("scanSeconds", fmt.Sprintf("must be between 0 and %d", int(maxBLEScanDuration.Seconds())))
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	p.Discriminator, p.ShortDiscriminator = long, short
+	return nil
+}
+
+// bluetoothSettings returns the Bluetooth config with its defaults applied.
+func bluetoothSettings() (adapter, bluetoothctl string, scan time.Duration) {
+	cfg := appConfig.Bluetooth
+	adapter, bluetoothctl, scan = cfg.Adapter, cfg.Bluetoothctl, defaultBLEScanDuration
+	if adapter == "" {
+		adapter = defaultBluetoothAdapter
+	}
+	if bluetoothctl == "" {
+		bluetoothctl = "bluetoothctl"
+	}
+	if cfg.ScanSeconds > 0 {
+		scan = time.Duration(cfg.ScanSeconds) * time.Second
+	}
+	return adapter, bluetoothctl, scan
+}
+
+// readSysFlag reports whether a sysfs attribute holds "1".
+func readSysFlag(path string) bool {
+	data, err := os.ReadFile(path)
+	return err == nil && strings.TrimSpace(string(data)) == "1"
+}
+
+// runBluetoothctl runs a bluetoothctl command.
+func runBluetoothctl(ctx context.Context, bluetoothctl string, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, bluetoothctl, args...).CombinedOutput()
+	if err != nil && len(out) == 0 {
+		return "", err
+	}
+	return string(out), nil
+}
+
+var (
+	reBluetoothController = regexp.MustCompile(`(?m)^Controller ([0-9A-Fa-f:]{17})`)
+	reBluetoothPowered    = regexp.MustCompile(`(?m)^\s*Powered: (yes|no)`)
+)
+
+// checkBluetoothAdapter checks the adapter: present in sysfs, not blocked by rfkill, and powered
+// according to BlueZ. bluetoothctl shows the default controller, the one chip-tool uses unless told
+// otherwise.
+func checkBluetoothAdapter(ctx context.Context) BluetoothAdapterStatus {
+	adapter, bluetoothctl, _ := bluetoothSettings()
+	status := BluetoothAdapterStatus{Adapter: adapter}
+	fail := func(code, message string) BluetoothAdapterStatus {
+		status.Code, status.Error, status.Hint = code, message, bluetoothHints[code]
+		return status
+	}
+	if _, err := os.Stat(filepath.Join(sysClassDir, "bluetooth", adapter)); err != nil {
+		return fail(errCodeBluetoothUnavailable, fmt.Sprintf("no Bluetooth adapter %s", adapter))
+	}
+	status.Present = true
+	rfkills, _ := filepath.Glob(filepath.Join(sysClassDir, "rfkill", "rfkill*"))
+	for _, dir := range rfkills {
+		kind, _ := os.ReadFile(filepath.Join(dir, "type"))
+		name, _ := os.ReadFile(filepath.Join(dir, "name"))
+		if strings.TrimSpace(string(kind)) == "bluetooth" && strings.TrimSpace(string(name)) == adapter {
+			status.SoftBlocked = readSysFlag(filepath.Join(dir, "soft"))
+			status.HardBlocked = readSysFlag(filepath.Join(dir, "hard"))
+		}
+	}
+	if status.HardBlocked || status.SoftBlocked {
+		kind := "soft"
+		if status.HardBlocked {
+			kind = "hard"
+		}
+		return fail(errCodeBluetoothBlocked, fmt.Sprintf("%s is %s-blocked by rfkill", adapter, kind))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, bluetoothctlTimeout)
+	defer cancel()
+	out, err := runBluetoothctl(ctx, bluetoothctl, "show")
+	if err != nil {
+		return fail(errCodeBluetoothUnavailable, fmt.Sprintf("%s: %v", bluetoothctl, err))
+	}
+	controller := reBluetoothController.FindStringSubmatch(out)
+	if controller == nil {
+		return fail(errCodeBluetoothUnavailable, "BlueZ has no controller: "+strings.TrimSpace(out))
+	}
+	status.Address = strings.ToUpper(controller[1])
+	if m := reBluetoothPowered.FindStringSubmatch(out); m == nil || m[1] != "yes" {
+		return fail(errCodeBluetoothPoweredOff, fmt.Sprintf("%s is powered off", adapter))
+	}
+	status.Powered, status.Ready = true, true
+	return status
+}
+
+var (
+	reBLEScanDevice   = regexp.MustCompile(`Device ([0-9A-Fa-f:]{17})`)
+	reBLEInfoName     = regexp.MustCompile(`^\s*Name: (.*)$`)
+	reBLEInfoRSSI     = regexp.MustCompile(`^\s*RSSI: (?:0x[0-9a-f]+ \()?(-?\d+)`)
+	reBLEServiceData  = regexp.MustCompile(`(?i)ServiceData(?: Key: |\.)` + matterBLEServiceUUID)
+	reBLEHexLine      = regexp.MustCompile(`^\s+((?:[0-9a-f]{2} )*[0-9a-f]{2})(?:\s{2,}|\s*$)`)
+	reBLEInfoProperty = regexp.MustCompile(`^\t\S`)
+)
+
+// parseMatterServiceData decodes the Matter BLE commissioning advertisement: an opcode, then the
+// 12-bit discriminator with the advertisement version, the vendor ID and the product ID, little endian.
+func parseMatterServiceData(data []byte) (BLEMatterDevice, bool) {
+	if len(data) < 7 || data[0] != 0 {
+		return BLEMatterDevice{}, false
+	}
+	discriminator := (int(data[1]) | int(data[2])<<8) & 0xfff
+	return BLEMatterDevice{
+		Discriminator:      strconv.Itoa(discriminator),
+		ShortDiscriminator: strconv.Itoa(discriminator >> 8),
+		VendorID:           strconv.Itoa(int(data[3]) | int(data[4])<<8),
+		ProductID:          strconv.Itoa(int(data[5]) | int(data[6])<<8),
+	}, true
+}
+
+// parseBLEDeviceInfo reads the Matter advertisement out of "bluetoothctl info": the hex dump lines
+// following the 0xFFF6 service data key.
+func parseBLEDeviceInfo(address, info string) (BLEMatterDevice, bool) {
+	var name string
+	var rssi *int
+	var data []byte
+	inServiceData := false
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case reBLEServiceData.MatchString(line):
+			inServiceData = true
+		case inServiceData && reBLEHexLine.MatchString(line):
+			bytes, err := hex.DecodeString(strings.ReplaceAll(reBLEHexLine.FindStringSubmatch(line)[1], " ", ""))
+			if err == nil {
+				data = append(data, bytes...)
+			}
+		case inServiceData && strings.Contains(line, "ServiceData Value"):
+		case reBLEInfoProperty.MatchString(line):
+			inServiceData = false
+			if m := reBLEInfoName.FindStringSubmatch(line); m != nil {
+				name = m[1]
+			} else if m := reBLEInfoRSSI.FindStringSubmatch(line); m != nil {
+				value, _ := strconv.Atoi(m[1])
+				rssi = &value
+			}
+		}
+	}
+	device, ok := parseMatterServiceData(data)
+	device.Address, device.Name, device.RSSI = strings.ToUpper(address), name, rssi
+	return device, ok
+}
+
+// scanMatterBLE scans for BLE advertisements, then reads the service data of the devices seen and
+// returns the Matter ones.
+func scanMatterBLE(ctx context.Context, duration time.Duration) ([]BLEMatterDevice, error) {
+	_, bluetoothctl, _ := bluetoothSettings()
+	seconds := strconv.Itoa(int(duration.Round(time.Second).Seconds()))
+	scanCtx, cancel := context.WithTimeout(ctx, duration+bluetoothctlTimeout)
+	defer cancel()
+	out, err := runBluetoothctl(scanCtx, bluetoothctl, "--timeout", seconds, "scan", "on")
+	if err != nil {
+		return nil, fmt.Errorf("BLE scan: %w", err)
+	}
+	var addresses []string
+	seen := map[string]bool{}
+	for _, m := range reBLEScanDevice.FindAllStringSubmatch(out, -1) {
+		address := strings.ToUpper(m[1])
+		if !seen[address] && len(addresses) < maxBLEInfoLookups {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+	devices := []BLEMatterDevice{}
+	for _, address := range addresses {
+		if ctx.Err() != nil {
+			return devices, ctx.Err()
+		}
+		infoCtx, cancel := context.WithTimeout(ctx, bluetoothctlTimeout)
+		info, err := runBluetoothctl(infoCtx, bluetoothctl, "info", address)
+		cancel()
+		if err != nil {
+			continue
+		}
+		if device, ok := parseBLEDeviceInfo(address, info); ok {
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+// bluetoothPrecheck checks the adapter and, unless skipScan, scans for the device to commission.
+// A failure is reported with one of the pre-check error codes, so a client can tell a host problem
+// from a device problem before running chip-tool.
+func bluetoothPrecheck(ctx context.Context, payload CheckBluetoothPayload) BLEPrecheckResult {
+	result := BLEPrecheckResult{Discriminator: payload.Discriminator, ShortDiscriminator: payload.ShortDiscriminator, Devices: []BLEMatterDevice{}}
+	result.Adapter = checkBluetoothAdapter(ctx)
+	if !result.Adapter.Ready {
+		result.Code, result.Error, result.Hint = result.Adapter.Code, result.Adapter.Error, result.Adapter.Hint
+		return result
+	}
+	if payload.SkipScan {
+		result.Success = true
+		return result
+	}
+	_, _, duration := bluetoothSettings()
+	if payload.ScanSeconds > 0 {
+		duration = time.Duration(payload.ScanSeconds) * time.Second
+	}
+	result.ScanSeconds = int(duration.Seconds())
+	devices, err := scanMatterBLE(ctx, duration)
+	result.Devices = append(result.Devices, devices...)
+	if err != nil {
+		result.Code, result.Error, result.Hint = errCodeBluetoothUnavailable, err.Error(), bluetoothHints[errCodeBluetoothUnavailable]
+		return result
+	}
+	if result.Discriminator == "" && result.ShortDiscriminator == "" {
+		result.Success = true
+		return result
+	}
+	for i, device := range result.Devices {
+		if device.Discriminator == result.Discriminator || result.Discriminator == "" && device.ShortDiscriminator == result.ShortDiscriminator {
+			result.Found, result.Success = &result.Devices[i], true
+			return result
+		}
+	}
+	wanted := result.Discriminator
+	if wanted == "" {
+		wanted = "short " + result.ShortDiscriminator
+	}
+	result.Code, result.Hint = errCodeBLEDeviceNotFound, bluetoothHints[errCodeBLEDeviceNotFound]
+	result.Error = fmt.Sprintf("no device with discriminator %s heard over BLE in %ds (Matter devices advertising: %d)", wanted, result.ScanSeconds, len(result.Devices))
+	return result
+}
+
+// handleCheckBluetooth runs the pre-check in a job and sends "bluetooth_precheck".
+func handleCheckBluetooth(client *Client, payload CheckBluetoothPayload) {
+	jobs.Submit(client, "bluetooth_precheck", func(ctx context.Context, job *Job) (interface{}, error) {
+		job.SetProgress(0, "Checking the Bluetooth adapter")
+		result := bluetoothPrecheck(ctx, payload)
+		client.sendPayload("bluetooth_precheck", result)
+		if !result.Success {
+			return result, fmt.Errorf("%s: %s", result.Code, result.Error)
+		}
+		return result, nil
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// aggregatorDeviceType is the Matter device type of a bridge's Aggregator endpoint (0x000E).
+const aggregatorDeviceType = 0x000E
+
+// Subscription intervals used to track the reachability of bridged devices.
+const (
+	bridgedReachableMinInterval = "1"
+	bridgedReachableMaxInterval = "300"
+)
+
+func containsUint32(values []uint32, want uint32) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+// findAggregatorEndpoints returns the endpoints of a node whose DeviceTypeList contains the Aggregator device type.
+func findAggregatorEndpoints(nodeID string) ([]string, error) {
+	endpoints, err := readDescriptorList(nodeID, "0", "parts-list")
+	if err != nil {
+		return nil, err
+	}
+	var aggregators []string
+	for _, ep := range endpoints {
+		epID := strconv.FormatUint(uint64(ep), 10)
+		types, err := readDeviceTypes(nodeID, epID)
+		if err != nil {
+			log.Printf("Skipping endpoint %s of node %s: %v", epID, nodeID, err)
+			continue
+		}
+		if containsUint32(types, aggregatorDeviceType) {
+			aggregators = append(aggregators, epID)
+		}
+	}
+	return aggregators, nil
+}
+
+// enumerateBridgedDevices checks whether a node is a bridge and, if so, registers every bridged
+// endpoint as its own device with its BridgedDeviceBasicInformation name and reachability.
+// It returns the bridged devices found (none for regular devices).
+func enumerateBridgedDevices(client *Client, nodeID string) ([]RegisteredDevice, error) {
+	aggregators, err := findAggregatorEndpoints(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if len(aggregators) == 0 {
+		return nil, nil
+	}
+	if err := deviceRegistry.Update(nodeID, func(device *RegisteredDevice) { device.IsBridge = true }); err != nil {
+		log.Printf("Node %s is a bridge but is not in the registry yet: %v", nodeID, err)
+	}
+
+	var bridged []RegisteredDevice
+	for _, aggregatorEP := range aggregators {
+		parts, err := readDescriptorList(nodeID, aggregatorEP, "parts-list")
+		if err != nil {
+			return bridged, err
+		}
+		client.notifyClientLog("commissioning_log", fmt.Sprintf("Node %s is a bridge: aggregator EP%s exposes %d bridged endpoint(s).", nodeID, aggregatorEP, len(parts)))
+		for _, part := range parts {
+			epID := strconv.FormatUint(uint64(part), 10)
+			device := RegisteredDevice{
+				ID:         bridgedDeviceID(nodeID, epID),
+				NodeID:     nodeID,
+				EndpointID: epID,
+				BridgeID:   nodeID,
+				Reachable:  true,
+			}
+			if types, err := readDeviceTypes(nodeID, epID); err == nil {
+				device.DeviceTypes = types
+			}
+			if label, err := readAttributeValue(nodeID, epID, "BridgedDeviceBasicInformation", "node-label"); err == nil {
+				device.Name, _ = label.(string)
+			}
+			if device.Name == "" {
+				if name, err := readAttributeValue(nodeID, epID, "BridgedDeviceBasicInformation", "product-name"); err == nil {
+					device.Name, _ = name.(string)
+				}
+			}
+			if device.Name == "" {
+				device.Name = fmt.Sprintf("Bridged device %s", device.ID)
+			}
+			if reachable, err := readAttributeValue(nodeID, epID, "BridgedDeviceBasicInformation", "reachable"); err == nil {
+				device.Reachable, _ = reachable.(bool)
+			}
+			if err := deviceRegistry.Put(device); err != nil {
+				log.Printf("Could not register bridged device %s: %v", device.ID, err)
+				continue
+			}
+			bridged = append(bridged, device)
+			// Reachability changes are applied to the registry by publishAttributeUpdate.
+			go startAttributeSubscription(client, nodeID, epID, "BridgedDeviceBasicInformation", "reachable", bridgedReachableMinInterval, bridgedReachableMaxInterval)
+		}
+	}
+	return bridged, nil
+}
+
+// discoverBridgedDevices runs enumerateBridgedDevices and reports the result to the client.
+func discoverBridgedDevices(client *Client, nodeID string) {
+	bridged, err := enumerateBridgedDevices(client, nodeID)
+	if err != nil {
+		log.Printf("Bridge enumeration for node %s failed: %v", nodeID, err)
+		client.sendPayload("bridged_devices", BridgedDevicesPayload{NodeID: nodeID, Devices: bridged, Error: err.Error()})
+		return
+	}
+	if len(bridged) > 0 {
+		client.sendPayload("bridged_devices", BridgedDevicesPayload{NodeID: nodeID, Devices: bridged})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults shared by the NATS and AMQP sinks.
+const (
+	defaultBrokerSubject = "matter.{type}.{nodeId}.{endpointId}"
+	brokerDialTimeout    = 10 * time.Second
+	brokerAckTimeout     = 10 * time.Second
+)
+
+// brokerSubjectReplacer keeps a placeholder value a single token of a subject or routing key: dots
+// separate the tokens, and the wildcards and spaces aren't allowed in NATS subjects.
+var brokerSubjectReplacer = strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_", "#", "_")
+
+// brokerSubject renders the subject (NATS) or routing key (AMQP) template of an event. The
+// placeholders are {type}, {nodeId}, {endpointId}, {deviceId} (looked up from the node and
+// endpoint when the event doesn't carry it), {cluster} and {attribute}. The tokens left empty are
+// dropped, so "matter.{type}.{nodeId}.{endpointId}" gives "matter.mode_changed" for an event
+// without a device and "matter.attribute_update.12.1" for one of node 12 EP1.
+func brokerSubject(template string, event Event) string {
+	data, _ := json.Marshal(event.Payload)
+	var target struct {
+		NodeID     string `json:"nodeId"`
+		EndpointID string `json:"endpointId"`
+		DeviceID   string `json:"deviceId"`
+		Cluster    string `json:"cluster"`
+		Attribute  string `json:"attribute"`
+	}
+	_ = json.Unmarshal(data, &target)
+	if target.DeviceID == "" && target.NodeID != "" {
+		target.DeviceID, _ = deviceIDForTarget(target.NodeID, target.EndpointID)
+	}
+	values := map[string]string{
+		"type": event.Type, "nodeId": target.NodeID, "endpointId": target.EndpointID,
+		"deviceId": target.DeviceID, "cluster": target.Cluster, "attribute": target.Attribute,
+	}
+	var pairs []string
+	for name, value := range values {
+		pairs = append(pairs, "{"+name+"}", brokerSubjectReplacer.Replace(value))
+	}
+	rendered := strings.NewReplacer(pairs...).Replace(template)
+	var tokens []string
+	for _, token := range strings.Split(rendered, ".") {
+		if token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return strings.Join(tokens, ".")
+}
+
+// brokerTLSConfig builds the TLS configuration of a broker connection to host.
+func brokerTLSConfig(cfg BrokerTLSConfig, host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: cfg.InsecureSkipVerify, MinVersion: tls.VersionTLS12}
+	if cfg.ServerName != "" {
+		tlsConfig.ServerName = cfg.ServerName
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// redactedURL is a broker URL without its password, or its token (a user without a password),
+// for the logs.
+func redactedURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	if u.User != nil {
+		if _, hasPassword := u.User.Password(); !hasPassword {
+			u.User = url.User("xxxxx")
+		}
+	}
+	return u.Redacted()
+}
+
+// eventPublisher publishes messages to a broker, returning once the broker has them.
+type eventPublisher interface {
+	Publish(subject string, message []byte) error
+	Close()
+}
+
+// brokerSink is the sink of a message broker (NATS or AMQP): the settings in use, the connection and
+// the journal, replaced by apply on a config reload.
+type brokerSink struct {
+	kind      string // "nats" or "amqp", naming its journal and event bus subscription
+	mu        sync.Mutex
+	cfg       interface{}
+	url       string
+	types     []string
+	publisher eventPublisher
+	journal   *EventJournal // Nil when no broker is configured
+}
+
+// subscribe subscribes the sink to the event bus, for the message types of its settings.
+func (s *brokerSink) subscribe() {
+	eventBus.Subscribe(s.kind, func(event Event) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.journal != nil && containsString(s.types, event.Type) {
+			s.journal.Append(event)
+		}
+	})
+}
+
+// apply switches the sink to cfg when it changed: the previous connection and journal stop, and
+// the journal of the new broker takes over. newPublisher fails on settings that can't work, e.g.
+// an invalid URL, leaving the sink disabled.
+func (s *brokerSink) apply(cfg interface{}, rawURL string, types []string, template string, newPublisher func() (eventPublisher, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reflect.DeepEqual(cfg, s.cfg) {
+		return
+	}
+	if s.journal != nil {
+		s.journal.Stop()
+		s.publisher.Close()
+		s.journal, s.publisher = nil, nil
+		log.Printf("%s server %s no longer used", strings.ToUpper(s.kind), redactedURL(s.url))
+	}
+	s.cfg, s.url, s.types = cfg, rawURL, types
+	if rawURL == "" {
+		return
+	}
+	if len(types) == 0 {
+		log.Printf("%s server %s ignored: types is required", strings.ToUpper(s.kind), redactedURL(rawURL))
+		return
+	}
+	publisher, err := newPublisher()
+	if err != nil {
+		log.Printf("%s server %s ignored: %v", strings.ToUpper(s.kind), redactedURL(rawURL), err)
+		return
+	}
+	if template == "" {
+		template = defaultBrokerSubject
+	}
+	s.publisher = publisher
+	s.journal = startJournal(journalName(s.kind, rawURL), func(event Event) error {
+		message, err := json.Marshal(WebhookPayload{Type: event.Type, Data: event.Payload, Timestamp: event.Time})
+		if err != nil {
+			return err
+		}
+		return publisher.Publish(brokerSubject(template, event), message)
+	})
+	log.Printf("%s server %s receives %v as %s", strings.ToUpper(s.kind), redactedURL(rawURL), types, template)
+}
+
+// startBrokers subscribes the NATS and AMQP sinks to the event bus.
+func startBrokers() {
+	applyNATS(appConfig.NATS)
+	applyAMQP(appConfig.AMQP)
+	natsSink.subscribe()
+	amqpSink.subscribe()
+}
+
+var (
+	natsSink = &brokerSink{kind: "nats"}
+	amqpSink = &brokerSink{kind: "amqp"}
+)
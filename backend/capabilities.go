@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Global attribute IDs, present in every cluster.
+const (
+	attributeListID        = 0xFFFB
+	featureMapID           = 0xFFFC
+	clusterRevisionID      = 0xFFFD
+	acceptedCommandListID  = 0xFFF9
+	generatedCommandListID = 0xFFF8
+)
+
+// globalAttributes are the chip-tool names of the global attributes.
+var globalAttributes = map[string]uint32{
+	"attribute-list":         attributeListID,
+	"feature-map":            featureMapID,
+	"cluster-revision":       clusterRevisionID,
+	"accepted-command-list":  acceptedCommandListID,
+	"generated-command-list": generatedCommandListID,
+}
+
+// clusterFeatures names the FeatureMap bits of the clusters whose commands are gated (Matter spec).
+var clusterFeatures = map[string]map[string]uint32{
+	"onoff":          {"Lighting": 0x1, "DeadFrontBehavior": 0x2, "OffOnly": 0x4},
+	"levelcontrol":   {"OnOff": 0x1, "Lighting": 0x2, "Frequency": 0x4},
+	"colorcontrol":   {"HueSaturation": 0x1, "EnhancedHue": 0x2, "ColorLoop": 0x4, "XY": 0x8, "ColorTemperature": 0x10},
+	"windowcovering": {"Lift": 0x1, "Tilt": 0x2, "PositionAwareLift": 0x4, "AbsolutePosition": 0x8, "PositionAwareTilt": 0x10},
+}
+
+// commandFeatures are the features a command needs, all of them, by "cluster/command" with the
+// command in lower case without dashes.
+var commandFeatures = map[string][]string{
+	"onoff/offwitheffect":                         {"Lighting"},
+	"onoff/onwithrecallglobalscene":               {"Lighting"},
+	"onoff/onwithtimedoff":                        {"Lighting"},
+	"levelcontrol/movetoclosestfrequency":         {"Frequency"},
+	"colorcontrol/movetohue":                      {"HueSaturation"},
+	"colorcontrol/movehue":                        {"HueSaturation"},
+	"colorcontrol/stephue":                        {"HueSaturation"},
+	"colorcontrol/movetosaturation":               {"HueSaturation"},
+	"colorcontrol/movesaturation":                 {"HueSaturation"},
+	"colorcontrol/stepsaturation":                 {"HueSaturation"},
+	"colorcontrol/movetohueandsaturation":         {"HueSaturation"},
+	"colorcontrol/enhancedmovetohue":              {"EnhancedHue"},
+	"colorcontrol/enhancedmovehue":                {"EnhancedHue"},
+	"colorcontrol/enhancedstephue":                {"EnhancedHue"},
+	"colorcontrol/enhancedmovetohueandsaturation": {"EnhancedHue"},
+	"colorcontrol/colorloopset":                   {"ColorLoop"},
+	"colorcontrol/movetocolor":                    {"XY"},
+	"colorcontrol/movecolor":                      {"XY"},
+	"colorcontrol/stepcolor":                      {"XY"},
+	"colorcontrol/movetocolortemperature":         {"ColorTemperature"},
+	"colorcontrol/movecolortemperature":           {"ColorTemperature"},
+	"colorcontrol/stepcolortemperature":           {"ColorTemperature"},
+	"windowcovering/gotoliftvalue":                {"Lift", "AbsolutePosition"},
+	"windowcovering/gotoliftpercentage":           {"Lift", "PositionAwareLift"},
+	"windowcovering/gototiltvalue":                {"Tilt", "AbsolutePosition"},
+	"windowcovering/gototiltpercentage":           {"Tilt", "PositionAwareTilt"},
+}
+
+// commandExcludingFeatures are the features that take a command away: an OffOnly OnOff cluster
+// can't be turned on.
+var commandExcludingFeatures = map[string][]string{
+	"onoff/on":     {"OffOnly"},
+	"onoff/toggle": {"OffOnly"},
+}
+
+// ClusterCapabilities are the optional parts of a cluster an endpoint implements.
+type ClusterCapabilities struct {
+	Cluster    string   `json:"cluster"` // chip-tool name
+	FeatureMap uint32   `json:"featureMap"`
+	Features   []string `json:"features"`             // Names of the known features set in FeatureMap
+	Attributes []uint32 `json:"attributes,omitempty"` // AttributeList; empty when it couldn't be read
+}
+
+// CapabilitiesPayload is the payload of "get_capabilities".
+type CapabilitiesPayload struct {
+	NodeID     string `json:"nodeId,omitempty"`
+	DeviceID   string `json:"deviceId,omitempty"` // Registry device ID, instead of nodeId/endpointId
+	EndpointID string `json:"endpointId,omitempty"`
+}
+
+// DeviceCapabilitiesPayload is sent in response to "get_capabilities".
+type DeviceCapabilitiesPayload struct {
+	NodeID     string                `json:"nodeId"`
+	EndpointID string                `json:"endpointId"`
+	Clusters   []ClusterCapabilities `json:"clusters"`
+}
+
+// commandKey builds the commandFeatures key of a command, accepting "MoveToHue" and "move-to-hue".
+func commandKey(cluster, command string) string {
+	return strings.ToLower(cluster) + "/" + strings.ToLower(strings.ReplaceAll(command, "-", ""))
+}
+
+// hasFeature reports whether a feature of a cluster is set in its FeatureMap.
+func (c ClusterCapabilities) hasFeature(feature string) bool {
+	return c.FeatureMap&clusterFeatures[c.Cluster][feature] != 0
+}
+
+// hasAttribute reports whether the AttributeList contains an attribute. Without an
+// AttributeList, every attribute is assumed present.
+func (c ClusterCapabilities) hasAttribute(id uint32) bool {
+	if len(c.Attributes) == 0 {
+		return true
+	}
+	return containsUint32(c.Attributes, id)
+}
+
+// readClusterCapabilities reads the FeatureMap and AttributeList of a cluster on an endpoint, from
+// the introspection cache when they were read before. Only a failed FeatureMap read is an error.
+func readClusterCapabilities(nodeID, endpointID, cluster string) (ClusterCapabilities, error) {
+	caps := ClusterCapabilities{Cluster: strings.ToLower(cluster), Features: []string{}}
+	value, err := introspectionCache.ReadAttribute(nodeID, endpointID, caps.Cluster, "feature-map")
+	if err != nil {
+		return caps, err
+	}
+	if f, ok := toFloat(value); ok {
+		caps.FeatureMap = uint32(f)
+	}
+	for name := range clusterFeatures[caps.Cluster] {
+		if caps.hasFeature(name) {
+			caps.Features = append(caps.Features, name)
+		}
+	}
+	sort.Strings(caps.Features)
+	if attributes, err := readListAttribute(nodeID, endpointID, caps.Cluster, "attribute-list"); err == nil {
+		caps.Attributes = attributes
+	}
+	return caps, nil
+}
+
+// endpointCapabilities reads the capabilities of the gated clusters an endpoint implements.
+func endpointCapabilities(nodeID, endpointID string) ([]ClusterCapabilities, error) {
+	servers, err := readDescriptorList(nodeID, endpointID, "server-list")
+	if err != nil {
+		return nil, err
+	}
+	clusters := make([]ClusterCapabilities, 0)
+	for _, id := range servers {
+		name, ok := matterClusterName(id)
+		if !ok || clusterFeatures[name] == nil {
+			continue
+		}
+		caps, err := readClusterCapabilities(nodeID, endpointID, name)
+		if err != nil {
+			log.Printf("No FeatureMap for %s on node %s EP%s: %v", name, nodeID, endpointID, err)
+			continue
+		}
+		clusters = append(clusters, caps)
+	}
+	return clusters, nil
+}
+
+// unsupportedCommand reports why a device can't run a command, judging by the FeatureMap of the
+// cluster. Commands that aren't gated, and devices whose FeatureMap can't be read, are let through.
+func unsupportedCommand(nodeID, endpointID, cluster, command string) (string, bool) {
+	key := commandKey(cluster, command)
+	required, excluding := commandFeatures[key], commandExcludingFeatures[key]
+	if len(required) == 0 && len(excluding) == 0 {
+		return "", false
+	}
+	caps, err := readClusterCapabilities(nodeID, endpointID, cluster)
+	if err != nil {
+		log.Printf("Not checking %s.%s against the features of node %s EP%s: %v", cluster, command, nodeID, endpointID, err)
+		return "", false
+	}
+	for _, feature := range required {
+		if !caps.hasFeature(feature) {
+			return fmt.Sprintf("%s.%s needs the %s feature, which node %s EP%s doesn't support (features: %s)",
+				cluster, command, feature, nodeID, endpointID, featureList(caps)), true
+		}
+	}
+	for _, feature := range excluding {
+		if caps.hasFeature(feature) {
+			return fmt.Sprintf("%s.%s isn't available on node %s EP%s: its %s cluster has the %s feature", cluster, command, nodeID, endpointID, cluster, feature), true
+		}
+	}
+	return "", false
+}
+
+// unsupportedAttribute reports why a device doesn't implement an attribute, judging by the
+// AttributeList of the cluster. Attributes whose ID isn't known are let through.
+func unsupportedAttribute(nodeID, endpointID, cluster, attribute string) (string, bool) {
+	info, ok := matterClusters[strings.ToLower(cluster)]
+	if !ok {
+		return "", false
+	}
+	id, ok := info.Attributes[attribute]
+	if !ok {
+		if id, ok = globalAttributes[attribute]; !ok || id == attributeListID {
+			return "", false
+		}
+	}
+	attributes, err := readListAttribute(nodeID, endpointID, cluster, "attribute-list")
+	if err != nil || len(attributes) == 0 || containsUint32(attributes, id) {
+		return "", false
+	}
+	return fmt.Sprintf("node %s EP%s doesn't implement %s.%s (not in its AttributeList)", nodeID, endpointID, cluster, attribute), true
+}
+
+func featureList(caps ClusterCapabilities) string {
+	if len(caps.Features) == 0 {
+		return "none"
+	}
+	return strings.Join(caps.Features, ", ")
+}
+
+func handleGetCapabilities(client *Client, payload CapabilitiesPayload) {
+	nodeID, endpointID := payload.NodeID, payload.EndpointID
+	if payload.DeviceID != "" {
+		var err error
+		if nodeID, endpointID, err = deviceRegistry.resolveDeviceTarget(payload.DeviceID); err != nil {
+			client.notifyClient("error", map[string]interface{}{"message": "get_capabilities failed: " + err.Error()})
+			return
+		}
+	}
+	if nodeID == "" {
+		client.notifyClient("error", map[string]interface{}{"message": "get_capabilities failed: nodeId or deviceId is required"})
+		return
+	}
+	if endpointID == "" {
+		endpointID = "1"
+	}
+	clusters, err := endpointCapabilities(nodeID, endpointID)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "get_capabilities failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("device_capabilities", DeviceCapabilitiesPayload{NodeID: nodeID, EndpointID: endpointID, Clusters: clusters})
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Packet captures record the Matter traffic of one device while an operation runs, for the
+// debugging sessions where the chip-tool output isn't enough. tcpdump (or tshark) runs on the Matter
+// interface with a filter on the device's addresses and the Matter and mDNS ports; the pcap file is
+// kept in the data directory and linked from the trace bundle of the operation's request.
+
+// Capture settings; zero config values use the defaults here.
+const (
+	capturesDir               = "captures"
+	defaultCaptureTool        = "tcpdump"
+	defaultCaptureMaxDuration = 5 * time.Minute
+	defaultCaptureMaxBytes    = 50 << 20
+	defaultCaptureKeep        = 20
+	captureStartCheck         = 500 * time.Millisecond // A tool still running after this has started capturing
+	captureStopTimeout        = 5 * time.Second        // Time given to flush the file after SIGINT before killing
+	captureTail               = time.Second            // Kept capturing after the operation, for the last replies
+	captureLimitCheck         = time.Second
+	mdnsPort                  = 5353
+)
+
+// Capture states.
+const (
+	captureRunning = "running"
+	captureStopped = "stopped"
+	captureFailed  = "failed"
+)
+
+// CaptureStatus is a packet capture, as listed by the admin API and linked from trace bundles.
+type CaptureStatus struct {
+	ID         string    `json:"id"`
+	DeviceID   string    `json:"deviceId"`
+	RequestID  string    `json:"requestId,omitempty"` // Request whose trace bundle links the capture
+	Operation  string    `json:"operation,omitempty"` // Message type of that request
+	Tool       string    `json:"tool"`
+	Interface  string    `json:"interface"`
+	Filter     string    `json:"filter"`
+	Scoped     bool      `json:"scoped"` // False when the device has no known address: all Matter traffic is captured
+	File       string    `json:"file"`   // In the captures directory of the data directory
+	URL        string    `json:"url"`    // Download on the admin API
+	State      string    `json:"state"`
+	StopReason string    `json:"stopReason,omitempty"` // "requested", "operation_done", "max_duration", "max_bytes" or "exited"
+	Error      string    `json:"error,omitempty"`
+	Bytes      int64     `json:"bytes"`
+	StartedAt  time.Time `json:"startedAt"`
+	StoppedAt  time.Time `json:"stoppedAt,omitzero"`
+}
+
+// StartCapturePayload starts a capture of a device's traffic ("start_capture", POST /admin/captures).
+type StartCapturePayload struct {
+	DeviceID    string `json:"deviceId"`
+	RequestID   string `json:"requestId,omitempty"`   // Links the capture to this request's trace
+	DurationSec int    `json:"durationSec,omitempty"` // Stops the capture after this long; capped by capture.maxSeconds
+}
+
+// Validate checks the payload.
+func (p StartCapturePayload) Validate() error {
+	verr := &ValidationError{}
+	if p.DeviceID == "" {
+		verr.add("deviceId", "is required")
+	}
+	if p.DurationSec < 0 {
+		verr.add("durationSec", "must not be negative")
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// StopCapturePayload stops a running capture ("stop_capture").
+type StopCapturePayload struct {
+	CaptureID string `json:"captureId"`
+}
+
+// Validate checks the payload.
+func (p StopCapturePayload) Validate() error {
+	verr := &ValidationError{}
+	if p.CaptureID == "" {
+		verr.add("captureId", "is required")
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// capture is a capture and, while it runs, its tool process.
+type capture struct {
+	mu      sync.Mutex
+	status  CaptureStatus
+	path    string
+	cmd     *exec.Cmd
+	stderr  bytes.Buffer
+	exited  chan struct{} // Closed when the tool exited
+	limit   time.Duration
+	maxSize int64
+}
+
+// snapshot returns the status with the current file size.
+func (c *capture) snapshot() CaptureStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if info, err := os.Stat(c.path); err == nil {
+		c.status.Bytes = info.Size()
+	}
+	return c.status
+}
+
+// CaptureManager runs the packet captures and remembers the recent ones.
+type CaptureManager struct {
+	mu       sync.Mutex
+	captures map[string]*capture
+	order    []string // Capture IDs, oldest first
+	seq      int
+}
+
+// NewCaptureManager creates a manager without captures.
+func NewCaptureManager() *CaptureManager {
+	return &CaptureManager{captures: make(map[string]*capture)}
+}
+
+var captures = NewCaptureManager()
+
+// captureSettings returns the capture config with its defaults applied.
+func captureSettings() (tool, iface string, maxDuration time.Duration, maxBytes int64, keep int) {
+	cfg := appConfig.Capture
+	tool, iface = cfg.Tool, cfg.Interface
+	if tool == "" {
+		tool = defaultCaptureTool
+	}
+	if iface == "" {
+		iface = appConfig.NetworkInterface
+	}
+	if iface == "" {
+		iface = "any"
+	}
+	maxDuration, maxBytes, keep = defaultCaptureMaxDuration, defaultCaptureMaxBytes, defaultCaptureKeep
+	if cfg.MaxSeconds > 0 {
+		maxDuration = time.Duration(cfg.MaxSeconds) * time.Second
+	}
+	if cfg.MaxBytes > 0 {
+		maxBytes = cfg.MaxBytes
+	}
+	if cfg.Keep > 0 {
+		keep = cfg.Keep
+	}
+	return
+}
+
+// captureFilter builds the BPF filter of a device's traffic: its addresses (without zone, which BPF
+// doesn't accept) on the Matter port, and mDNS for the advertisements. Without a known address every
+// host's Matter traffic is captured, and scoped is false.
+func captureFilter(device RegisteredDevice) (filter string, scoped bool) {
+	var hosts []string
+	seen := map[string]bool{}
+	for _, address := range append([]string{device.Address}, device.Addresses...) {
+		addr, err := netip.ParseAddr(strings.TrimSpace(address))
+		if err != nil {
+			continue
+		}
+		host := addr.WithZone("").String()
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, "host "+host)
+		}
+	}
+	ports := fmt.Sprintf("udp port %d or tcp port %d or udp port %d", matterPort, matterPort, mdnsPort)
+	if len(hosts) == 0 {
+		return ports, false
+	}
+	return "(" + strings.Join(hosts, " or ") + ") and (" + ports + ")", true
+}
+
+// captureArgs returns the arguments of the capture tool writing a pcap file.
+func captureArgs(tool, iface, file, filter string) []string {
+	if strings.HasPrefix(filepath.Base(tool), "tshark") {
+		return []string{"-i", iface, "-q", "-F", "pcap", "-w", file, "-f", filter}
+	}
+	return []string{"-i", iface, "-U", "-s", "0", "-w", file, filter}
+}
+
+// Start starts capturing a device's traffic. It fails when the tool can't be started or exits right
+// away, e.g. without the permission to capture.
+func (m *CaptureManager) Start(payload StartCapturePayload, operation string) (CaptureStatus, error) {
+	device, ok := lookupDevice(payload.DeviceID)
+	if !ok {
+		return CaptureStatus{}, fmt.Errorf("unknown device %q", payload.DeviceID)
+	}
+	tool, iface, maxDuration, maxBytes, keep := captureSettings()
+	limit := maxDuration
+	if requested := time.Duration(payload.DurationSec) * time.Second; requested > 0 && requested < limit {
+		limit = requested
+	}
+	filter, scoped := captureFilter(device)
+	dir := dataFilePath(capturesDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return CaptureStatus{}, err
+	}
+
+	m.mu.Lock()
+	m.seq++
+	id := fmt.Sprintf("cap-%d-%d", time.Now().Unix(), m.seq)
+	m.mu.Unlock()
+	now := time.Now()
+	file := sanitizeFileName(fmt.Sprintf("%s-%s-%s.pcap", now.Format("20060102-150405"), device.ID, id))
+	c := &capture{
+		status: CaptureStatus{
+			ID: id, DeviceID: device.ID, RequestID: payload.RequestID, Operation: operation, Tool: tool,
+			Interface: iface, Filter: filter, Scoped: scoped, File: file, URL: "/admin/captures/" + id + "/pcap",
+			State: captureRunning, StartedAt: now,
+		},
+		path:    filepath.Join(dir, file),
+		exited:  make(chan struct{}),
+		limit:   limit,
+		maxSize: maxBytes,
+	}
+	c.cmd = exec.Command(tool, captureArgs(tool, iface, c.path, filter)...)
+	c.cmd.Stderr = &c.stderr
+	if err := c.cmd.Start(); err != nil {
+		return CaptureStatus{}, fmt.Errorf("starting %s: %w", tool, err)
+	}
+	go func() {
+		err := c.cmd.Wait()
+		c.mu.Lock()
+		if c.status.State == captureRunning {
+			// Not stopped by us: the tool failed or was killed
+			c.status.State, c.status.StopReason, c.status.StoppedAt = captureFailed, "exited", time.Now()
+			c.status.Error = toolError(err, c.stderr.String())
+		}
+		c.mu.Unlock()
+		close(c.exited)
+	}()
+	select {
+	case <-c.exited:
+		status := c.snapshot()
+		_ = os.Remove(c.path)
+		return CaptureStatus{}, fmt.Errorf("%s exited: %s", tool, status.Error)
+	case <-time.After(captureStartCheck):
+	}
+
+	m.mu.Lock()
+	m.captures[id] = c
+	m.order = append(m.order, id)
+	m.pruneLocked(keep)
+	m.mu.Unlock()
+	go m.watch(c)
+	log.Printf("Capture %s of device %s started on %s: %s", id, device.ID, iface, filter)
+	status := c.snapshot()
+	linkCaptureToTrace(status)
+	return status, nil
+}
+
+// toolError describes how a capture tool exited, with the last line it wrote to stderr.
+func toolError(err error, stderr string) string {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	last := strings.TrimSpace(lines[len(lines)-1])
+	switch {
+	case last != "" && err != nil:
+		return err.Error() + ": " + last
+	case err != nil:
+		return err.Error()
+	default:
+		return "exited before being stopped"
+	}
+}
+
+// watch stops a capture when it reaches its duration or size limit.
+func (m *CaptureManager) watch(c *capture) {
+	ticker := time.NewTicker(captureLimitCheck)
+	defer ticker.Stop()
+	deadline := time.NewTimer(c.limit)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-c.exited:
+			linkCaptureToTrace(c.snapshot())
+			return
+		case <-deadline.C:
+			m.stop(c, "max_duration")
+			return
+		case <-ticker.C:
+			if c.snapshot().Bytes >= c.maxSize {
+				m.stop(c, "max_bytes")
+				return
+			}
+		}
+	}
+}
+
+// Stop stops a running capture. Stopping a finished capture returns its status unchanged.
+func (m *CaptureManager) Stop(id string) (CaptureStatus, error) {
+	c, ok := m.get(id)
+	if !ok {
+		return CaptureStatus{}, fmt.Errorf("unknown capture %q", id)
+	}
+	return m.stop(c, "requested"), nil
+}
+
+// stop interrupts the tool, so it flushes the file, and kills it if it doesn't exit in time.
+func (m *CaptureManager) stop(c *capture, reason string) CaptureStatus {
+	c.mu.Lock()
+	if c.status.State != captureRunning {
+		c.mu.Unlock()
+		return c.snapshot()
+	}
+	c.status.State, c.status.StopReason, c.status.StoppedAt = captureStopped, reason, time.Now()
+	c.mu.Unlock()
+	_ = c.cmd.Process.Signal(os.Interrupt)
+	select {
+	case <-c.exited:
+	case <-time.After(captureStopTimeout):
+		_ = c.cmd.Process.Kill()
+		<-c.exited
+	}
+	status := c.snapshot()
+	log.Printf("Capture %s stopped (%s): %d bytes", status.ID, reason, status.Bytes)
+	linkCaptureToTrace(status)
+	return status
+}
+
+// get returns a capture by ID.
+func (m *CaptureManager) get(id string) (*capture, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.captures[id]
+	return c, ok
+}
+
+// Get returns the status of a capture.
+func (m *CaptureManager) Get(id string) (CaptureStatus, bool) {
+	c, ok := m.get(id)
+	if !ok {
+		return CaptureStatus{}, false
+	}
+	return c.snapshot(), true
+}
+
+// List returns the captures, most recent first.
+func (m *CaptureManager) List() []CaptureStatus {
+	m.mu.Lock()
+	list := make([]*capture, 0, len(m.order))
+	for i := len(m.order) - 1; i >= 0; i-- {
+		list = append(list, m.captures[m.order[i]])
+	}
+	m.mu.Unlock()
+	statuses := make([]CaptureStatus, 0, len(list))
+	for _, c := range list {
+		statuses = append(statuses, c.snapshot())
+	}
+	return statuses
+}
+
+// FilePath returns the pcap file of a finished capture.
+func (m *CaptureManager) FilePath(id string) (string, error) {
+	c, ok := m.get(id)
+	if !ok {
+		return "", fmt.Errorf("unknown capture %q", id)
+	}
+	if c.snapshot().State == captureRunning {
+		return "", errors.New("capture still running")
+	}
+	if _, err := os.Stat(c.path); err != nil {
+		return "", errors.New("capture file missing")
+	}
+	return c.path, nil
+}
+
+// pruneLocked forgets the oldest finished captures beyond keep and removes their files, along with
+// the files of captures made before a restart.
+func (m *CaptureManager) pruneLocked(keep int) {
+	for i := 0; len(m.order) > keep && i < len(m.order); {
+		c := m.captures[m.order[i]]
+		if c.snapshot().State == captureRunning {
+			i++
+			continue
+		}
+		_ = os.Remove(c.path)
+		delete(m.captures, m.order[i])
+		m.order = append(m.order[:i], m.order[i+1:]...)
+	}
+	known := map[string]bool{}
+	for _, c := range m.captures {
+		known[filepath.Base(c.path)] = true
+	}
+	entries, _ := os.ReadDir(dataFilePath(capturesDir))
+	var stale []string
+	for _, entry := range entries {
+		if !entry.IsDir() && !known[entry.Name()] {
+			stale = append(stale, entry.Name())
+		}
+	}
+	sort.Strings(stale) // Names start with the capture time
+	for len(stale) > 0 && len(stale)+len(m.order) > keep {
+		_ = os.Remove(filepath.Join(dataFilePath(capturesDir), stale[0]))
+		stale = stale[1:]
+	}
+}
+
+// linkCaptureToTrace records the capture in the trace of its request, when that request is traced.
+func linkCaptureToTrace(status CaptureStatus) {
+	if status.RequestID == "" {
+		return
+	}
+	if trace, ok := traces.Get(status.RequestID); ok {
+		trace.setCapture(status)
+	}
+}
+
+// captureMiddleware captures the traffic of the device targeted by a message sent with
+// "capture": true, while its handler runs. Being the last middleware, it only starts tcpdump for a
+// registered message type that passed authentication and the other checks.
+func captureMiddleware(msgType string, next HandlerFunc) HandlerFunc {
+	return func(client *Client, msg ClientMessage) {
+		if !msg.Capture {
+			next(client, msg)
+			return
+		}
+		stop := client.captureOperation(msg)
+		if stop == nil {
+			return
+		}
+		defer stop()
+		next(client, msg)
+	}
+}
+
+// captureOperation captures the traffic of the device a message targets while the operation runs:
+// the handler, then the jobs it started (same request ID), until they finish or the capture reaches
+// its limits. The returned function, called when the handler returns, ends the capture in the
+// background. Nil is returned when the capture couldn't start, and the client was told why: the
+// operation isn't run, as reproducing the issue without its capture would be wasted.
+func (c *Client) captureOperation(msg ClientMessage) func() {
+	if !c.base().admin && !appConfig.Admin.AllowOnMainListener {
+		c.notifyClient("error", map[string]interface{}{"message": "capture is only accepted on the admin API.", "code": errCodeAdminOnly})
+		return nil
+	}
+	if msg.RequestID == "" {
+		c.notifyClient("error", map[string]interface{}{"message": "capture needs a requestId"})
+		return nil
+	}
+	var target struct {
+		DeviceID   string `json:"deviceId"`
+		NodeID     string `json:"nodeId"`
+		EndpointID string `json:"endpointId"`
+	}
+	_ = json.Unmarshal(msg.Payload, &target)
+	if target.DeviceID == "" && target.NodeID != "" {
+		target.DeviceID, _ = deviceIDForTarget(target.NodeID, target.EndpointID)
+	}
+	if target.DeviceID == "" {
+		c.notifyClient("error", map[string]interface{}{"message": "capture needs a deviceId or nodeId in the payload"})
+		return nil
+	}
+	c.audit("start_capture", map[string]interface{}{"deviceId": target.DeviceID, "requestId": msg.RequestID, "operation": msg.Type})
+	status, err := captures.Start(StartCapturePayload{DeviceID: target.DeviceID, RequestID: msg.RequestID}, msg.Type)
+	if err != nil {
+		c.notifyClient("error", map[string]interface{}{"message": "capture failed: " + err.Error()})
+		return nil
+	}
+	c.sendPayload("capture_started", status)
+	return func() {
+		go func() {
+			for operationRunning(msg.RequestID) {
+				time.Sleep(captureLimitCheck)
+			}
+			time.Sleep(captureTail)
+			if capture, ok := captures.get(status.ID); ok {
+				c.sendPayload("capture_stopped", captures.stop(capture, "operation_done"))
+			}
+		}()
+	}
+}
+
+// operationRunning reports whether a job started by the request is still queued or running.
+func operationRunning(requestID string) bool {
+	for _, job := range jobs.List() {
+		if job.RequestID == requestID && (job.State == jobQueued || job.State == jobRunning) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleStartCapture starts capturing a device's traffic until stop_capture or the duration limit.
+func handleStartCapture(client *Client, payload StartCapturePayload) {
+	status, err := captures.Start(payload, "")
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "start_capture failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("capture_started", status)
+}
+
+// handleStopCapture stops a capture; its file can then be downloaded.
+func handleStopCapture(client *Client, payload StopCapturePayload) {
+	status, err := captures.Stop(payload.CaptureID)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "stop_capture failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("capture_stopped", status)
+}
+
+// handleListCaptures sends the recent captures.
+func handleListCaptures(client *Client) {
+	client.sendPayload("captures", map[string]interface{}{"captures": captures.List()})
+}
+
+// registerCaptureRoutes serves the captures on the admin API.
+func registerCaptureRoutes(api *gin.RouterGroup) {
+	api.GET("/admin/captures", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"captures": captures.List()})
+	})
+
+	api.POST("/admin/captures", func(c *gin.Context) {
+		var payload StartCapturePayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := payload.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": err.(*ValidationError).Fields})
+			return
+		}
+		auditREST(c, "start_capture", payload)
+		if _, ok := lookupDevice(payload.DeviceID); !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no such device"})
+			return
+		}
+		status, err := captures.Start(payload, "")
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, status)
+	})
+
+	api.GET("/admin/captures/:id", func(c *gin.Context) {
+		status, ok := captures.Get(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no such capture"})
+			return
+		}
+		c.JSON(http.StatusOK, status)
+	})
+
+	api.POST("/admin/captures/:id/stop", func(c *gin.Context) {
+		auditREST(c, "stop_capture", gin.H{"captureId": c.Param("id")})
+		status, err := captures.Stop(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, status)
+	})
+
+	// The pcap file, for Wireshark
+	api.GET("/admin/captures/:id/pcap", func(c *gin.Context) {
+		path, err := captures.FilePath(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		auditREST(c, "capture_download", gin.H{"captureId": c.Param("id")})
+		c.FileAttachment(path, filepath.Base(path))
+	})
+}
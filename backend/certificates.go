@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCertExpiryWarningDays flags certificates expiring within this many days, unless the config sets it.
+const defaultCertExpiryWarningDays = 30
+
+// matterEpoch is the origin of the times encoded in Matter certificates and of epoch-us timestamps.
+var matterEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// matterDNAttributes names the distinguished name attributes of Matter certificates, by TLV tag.
+// Tags 1-16 with bit 0x80 set are the same attributes encoded as PrintableString.
+var matterDNAttributes = map[uint64]string{
+	1: "commonName", 2: "surname", 3: "serialNumber", 4: "countryName", 5: "localityName",
+	6: "stateOrProvinceName", 7: "organizationName", 8: "organizationalUnitName", 9: "title",
+	10: "name", 11: "givenName", 12: "initials", 13: "generationQualifier", 14: "dnQualifier",
+	15: "pseudonym", 16: "domainComponent",
+	17: "matterNodeId", 18: "matterFirmwareSigningId", 19: "matterIcacId", 20: "matterRcacId",
+	21: "matterFabricId", 22: "matterNocCat",
+}
+
+// CertificateInfo is a decoded Matter operational certificate (NOC, ICAC or RCAC).
+type CertificateInfo struct {
+	Kind          string            `json:"kind"` // "noc", "icac", "rcac" or "unknown"
+	SerialNumber  string            `json:"serialNumber,omitempty"`
+	Issuer        map[string]string `json:"issuer,omitempty"`
+	Subject       map[string]string `json:"subject,omitempty"`
+	NodeID        string            `json:"nodeId,omitempty"`   // From the subject, for NOCs, in decimal like registry node IDs
+	FabricID      string            `json:"fabricId,omitempty"` // From the subject
+	NotBefore     time.Time         `json:"notBefore,omitzero"`
+	NotAfter      time.Time         `json:"notAfter,omitzero"` // Zero when the certificate has no expiry
+	ExpiresInDays *int              `json:"expiresInDays,omitempty"`
+	Expired       bool              `json:"expired,omitempty"`
+	ExpiringSoon  bool              `json:"expiringSoon,omitempty"`
+	Error         string            `json:"error,omitempty"` // Set when the certificate could not be decoded
+	Hex           string            `json:"hex,omitempty"`   // Raw TLV, when it could not be decoded
+}
+
+// FabricCertificates is the certificate chain a node holds for one fabric.
+type FabricCertificates struct {
+	FabricIndex string           `json:"fabricIndex"`
+	NOC         CertificateInfo  `json:"noc"`
+	ICAC        *CertificateInfo `json:"icac,omitempty"`
+}
+
+// NodeCertificatesPayload is sent to the client in response to "inspect_certificates".
+type NodeCertificatesPayload struct {
+	NodeID       string               `json:"nodeId"`
+	Fabrics      []FabricCertificates `json:"fabrics"`
+	TrustedRoots []CertificateInfo    `json:"trustedRoots"`
+	Warnings     []string             `json:"warnings,omitempty"` // Expired or expiring certificates
+}
+
+// dnValue formats a distinguished name attribute: Matter IDs as 16 hex digits, like chip-tool prints them.
+func dnValue(el tlvElement) string {
+	switch v := el.Value.(type) {
+	case uint64:
+		if el.Tag >= 17 && el.Tag <= 21 {
+			return fmt.Sprintf("%016X", v)
+		}
+		return fmt.Sprintf("%d", v)
+	case string:
+		return v
+	}
+	return fmt.Sprintf("%v", el.Value)
+}
+
+// decodeDN decodes an issuer or subject list.
+func decodeDN(list tlvElement) map[string]string {
+	dn := make(map[string]string)
+	for _, attr := range list.Children {
+		name, ok := matterDNAttributes[attr.Tag&^0x80]
+		if !ok {
+			name = fmt.Sprintf("tag%d", attr.Tag)
+		}
+		dn[name] = dnValue(attr)
+	}
+	return dn
+}
+
+// decodeMatterCertificate decodes a certificate in Matter TLV encoding (Matter core specification, 6.5).
+func decodeMatterCertificate(data []byte, now time.Time, warnWithin time.Duration) CertificateInfo {
+	cert := CertificateInfo{Kind: "unknown"}
+	root, err := decodeTLV(data)
+	if err == nil && root.ElementType != tlvTypeStruct {
+		err = fmt.Errorf("not a TLV structure")
+	}
+	if err != nil {
+		cert.Error, cert.Hex = "decoding certificate: "+err.Error(), strings.ToUpper(hex.EncodeToString(data))
+		return cert
+	}
+	if serial, ok := root.child(1); ok {
+		if b, ok := serial.Value.([]byte); ok {
+			cert.SerialNumber = strings.ToUpper(hex.EncodeToString(b))
+		}
+	}
+	if issuer, ok := root.child(3); ok {
+		cert.Issuer = decodeDN(issuer)
+	}
+	if subject, ok := root.child(6); ok {
+		cert.Subject = decodeDN(subject)
+	}
+	switch {
+	case cert.Subject["matterNodeId"] != "":
+		cert.Kind = "noc"
+		if id, err := strconv.ParseUint(cert.Subject["matterNodeId"], 16, 64); err == nil {
+			cert.NodeID = strconv.FormatUint(id, 10)
+		}
+	case cert.Subject["matterIcacId"] != "":
+		cert.Kind = "icac"
+	case cert.Subject["matterRcacId"] != "":
+		cert.Kind = "rcac"
+	}
+	cert.FabricID = cert.Subject["matterFabricId"]
+	if notBefore, ok := root.child(4); ok {
+		if secs, ok := notBefore.uintValue(); ok {
+			cert.NotBefore = matterEpoch.Add(time.Duration(secs) * time.Second)
+		}
+	}
+	if notAfter, ok := root.child(5); ok {
+		// 0 means "no well-defined expiration date"
+		if secs, ok := notAfter.uintValue(); ok && secs != 0 {
+			cert.NotAfter = matterEpoch.Add(time.Duration(secs) * time.Second)
+			days := int(cert.NotAfter.Sub(now).Hours() / 24)
+			cert.ExpiresInDays = &days
+			cert.Expired = now.After(cert.NotAfter)
+			cert.ExpiringSoon = !cert.Expired && cert.NotAfter.Sub(now) < warnWithin
+		}
+	}
+	return cert
+}
+
+var (
+	reNOCField         = regexp.MustCompile(`\[TOO\]\s+(Noc|Icac|FabricIndex):\s*(\S+)`)
+	reTrustedRootEntry = regexp.MustCompile(`\[TOO\]\s+\[\d+\]:\s*([0-9A-Fa-f]{16,})`)
+)
+
+// certExpiryWarning returns how close to expiry a certificate is flagged.
+func certExpiryWarning() time.Duration {
+	days := appConfig.CertificateExpiryWarningDays
+	if days <= 0 {
+		days = defaultCertExpiryWarningDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// decodeHexCertificate decodes a certificate printed by chip-tool as a hex string.
+func decodeHexCertificate(value string, now time.Time) CertificateInfo {
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		return CertificateInfo{Kind: "unknown", Error: "certificate is not hex encoded: " + err.Error()}
+	}
+	return decodeMatterCertificate(data, now, certExpiryWarning())
+}
+
+// parseNOCs parses the output of "operationalcredentials read nocs".
+func parseNOCs(stdout string, now time.Time) []FabricCertificates {
+	var fabrics []FabricCertificates
+	for _, m := range reNOCField.FindAllStringSubmatch(stripAnsi(stdout), -1) {
+		if m[1] == "Noc" {
+			fabrics = append(fabrics, FabricCertificates{NOC: decodeHexCertificate(m[2], now)})
+			continue
+		}
+		if len(fabrics) == 0 {
+			continue
+		}
+		current := &fabrics[len(fabrics)-1]
+		switch {
+		case m[1] == "Icac" && m[2] != "null":
+			icac := decodeHexCertificate(m[2], now)
+			current.ICAC = &icac
+		case m[1] == "FabricIndex":
+			current.FabricIndex = m[2]
+		}
+	}
+	return fabrics
+}
+
+// certificateWarning describes an expired or expiring certificate, or returns "".
+func certificateWarning(label string, cert CertificateInfo) string {
+	switch {
+	case cert.Expired:
+		return fmt.Sprintf("%s expired on %s", label, cert.NotAfter.Format(time.DateOnly))
+	case cert.ExpiringSoon:
+		return fmt.Sprintf("%s expires in %d day(s), on %s", label, *cert.ExpiresInDays, cert.NotAfter.Format(time.DateOnly))
+	case cert.Error != "":
+		return fmt.Sprintf("%s could not be decoded: %s", label, cert.Error)
+	}
+	return ""
+}
+
+// inspectNodeCertificates reads the OperationalCredentials of a node (NOCs and trusted roots) and decodes them.
+func inspectNodeCertificates(nodeID string) (NodeCertificatesPayload, error) {
+	result := NodeCertificatesPayload{NodeID: nodeID, Fabrics: []FabricCertificates{}, TrustedRoots: []CertificateInfo{}}
+	now := time.Now()
+
+	stdout, stderr, err := runChipTool("operationalcredentials", "read", "nocs", nodeID, "0")
+	if chipToolFailed(stdout, stderr, err) {
+		return result, fmt.Errorf("reading NOCs of node %s failed: %v %s", nodeID, err, strings.TrimSpace(stderr))
+	}
+	result.Fabrics = append(result.Fabrics, parseNOCs(stdout, now)...)
+
+	stdout, stderr, err = runChipTool("operationalcredentials", "read", "trusted-root-certificates", nodeID, "0")
+	if chipToolFailed(stdout, stderr, err) {
+		return result, fmt.Errorf("reading trusted roots of node %s failed: %v %s", nodeID, err, strings.TrimSpace(stderr))
+	}
+	for _, m := range reTrustedRootEntry.FindAllStringSubmatch(stripAnsi(stdout), -1) {
+		result.TrustedRoots = append(result.TrustedRoots, decodeHexCertificate(m[1], now))
+	}
+
+	for _, fabric := range result.Fabrics {
+		if w := certificateWarning("NOC of fabric index "+fabric.FabricIndex, fabric.NOC); w != "" {
+			result.Warnings = append(result.Warnings, w)
+		}
+		if fabric.ICAC != nil {
+			if w := certificateWarning("ICAC of fabric index "+fabric.FabricIndex, *fabric.ICAC); w != "" {
+				result.Warnings = append(result.Warnings, w)
+			}
+		}
+	}
+	for i, root := range result.TrustedRoots {
+		if w := certificateWarning(fmt.Sprintf("Trusted root #%d", i+1), root); w != "" {
+			result.Warnings = append(result.Warnings, w)
+		}
+	}
+	return result, nil
+}
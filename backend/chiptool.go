@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// runChipTool runs a one-shot chip-tool command and returns its stdout and stderr.
+func runChipTool(args ...string) (string, string, error) {
+	if degradedMode.Active() {
+		return "", "", errMatterUnavailable
+	}
+	defer chipToolWatcher.Begin()()
+	cmd := exec.Command(chipToolPath, withChipToolStorage(args)...)
+	var outBuf, errBuf strings.Builder
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+	err := cmd.Run()
+	return outBuf.String(), errBuf.String(), err
+}
+
+// chipToolIdentityFlags returns the --storage-directory/--commissioner-name flags selecting a
+// commissioner identity for one request. Empty values keep chip-tool's defaults; other values
+// must be listed in the chipToolIdentities config.
+func chipToolIdentityFlags(storageDirectory, commissionerName string) ([]string, error) {
+	if verr := validateChipToolIdentity(storageDirectory, commissionerName); verr != nil {
+		return nil, verr
+	}
+	var flags []string
+	if storageDirectory != "" {
+		flags = append(flags, "--storage-directory", storageDirectory)
+	}
+	if commissionerName != "" {
+		flags = append(flags, "--commissioner-name", commissionerName)
+	}
+	return flags, nil
+}
+
+// validateChipToolIdentity checks storageDirectory/commissionerName overrides against the allowlist.
+func validateChipToolIdentity(storageDirectory, commissionerName string) error {
+	verr := &ValidationError{}
+	allowed := appConfig.ChipToolIdentities
+	if storageDirectory != "" && !containsString(allowed.StorageDirectories, storageDirectory) {
+		verr.add("storageDirectory", "is not listed in chipToolIdentities.storageDirectories")
+	}
+	if commissionerName != "" && !containsString(allowed.CommissionerNames, commissionerName) {
+		verr.add("commissionerName", "is not listed in chipToolIdentities.commissionerNames")
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// chipToolFailed reports whether a chip-tool run failed, either by exit status or by an error in its output.
+func chipToolFailed(stdout, stderr string, err error) bool {
+	return err != nil || strings.Contains(stdout, "CHIP Error") || strings.Contains(stderr, "CHIP Error") || strings.Contains(stderr, "Error:")
+}
+
+// reListEntry matches list entries printed by chip-tool, e.g. "[TOO]   [1]: 59"
+var reListEntry = regexp.MustCompile(`\[TOO\]\s+\[\d+\]:\s+(\d+)`)
+
+// readDescriptorList reads a list attribute of the Descriptor cluster (e.g. "server-list", "parts-list")
+// and returns its numeric entries.
+func readDescriptorList(nodeID, endpointID, attribute string) ([]uint32, error) {
+	return readListAttribute(nodeID, endpointID, "descriptor", attribute)
+}
+
+// readListAttribute reads a list of numbers attribute of a cluster (e.g. "attribute-list") and
+// returns its entries.
+func readListAttribute(nodeID, endpointID, cluster, attribute string) ([]uint32, error) {
+	stdout, stderr, err := introspectionCache.ChipToolRead(cluster, attribute, nodeID, endpointID)
+	if chipToolFailed(stdout, stderr, err) {
+		return nil, fmt.Errorf("%s read %s failed on node %s EP%s: %v %s", strings.ToLower(cluster), attribute, nodeID, endpointID, err, strings.TrimSpace(stderr))
+	}
+	var values []uint32
+	for _, match := range reListEntry.FindAllStringSubmatch(stripAnsi(stdout), -1) {
+		v, err := strconv.ParseUint(match[1], 10, 32)
+		if err != nil {
+			log.Printf("Skipping unparsable %s %s entry %q: %v", strings.ToLower(cluster), attribute, match[1], err)
+			continue
+		}
+		values = append(values, uint32(v))
+	}
+	return values, nil
+}
+
+// endpointHasCluster reports whether the endpoint's Descriptor server-list contains clusterID.
+func endpointHasCluster(nodeID, endpointID string, clusterID uint32) (bool, error) {
+	servers, err := readDescriptorList(nodeID, endpointID, "server-list")
+	if err != nil {
+		return false, err
+	}
+	for _, id := range servers {
+		if id == clusterID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// reDeviceTypeEntry matches the DeviceType field of DeviceTypeList struct entries, e.g. "[TOO]       DeviceType: 14"
+var reDeviceTypeEntry = regexp.MustCompile(`\[TOO\]\s+DeviceType:\s*(\d+)`)
+
+// readDeviceTypes reads the Descriptor DeviceTypeList of an endpoint and returns the device type IDs.
+func readDeviceTypes(nodeID, endpointID string) ([]uint32, error) {
+	stdout, stderr, err := introspectionCache.DescriptorRead("device-type-list", nodeID, endpointID)
+	if chipToolFailed(stdout, stderr, err) {
+		return nil, fmt.Errorf("descriptor read device-type-list failed on node %s EP%s: %v %s", nodeID, endpointID, err, strings.TrimSpace(stderr))
+	}
+	var types []uint32
+	for _, match := range reDeviceTypeEntry.FindAllStringSubmatch(stripAnsi(stdout), -1) {
+		if v, err := strconv.ParseUint(match[1], 10, 32); err == nil {
+			types = append(types, uint32(v))
+		}
+	}
+	return types, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// defaultChipToolDebugFlags make chip-tool decode the messages it exchanges, for requests sent
+// with "debug": true, unless chipToolLogging.debugFlags says otherwise.
+var defaultChipToolDebugFlags = []string{"--trace_decode", "1"}
+
+// chipToolLogOptions is what a request picked for its chip-tool runs.
+type chipToolLogOptions struct {
+	debug      bool
+	categories map[string]bool // Forwarded log categories, nil for all
+}
+
+// reLogCategory matches the log category of a chip-tool output line, e.g. "CHIP:DMG:" or "[DIS]".
+var reLogCategory = regexp.MustCompile(`(?:CHIP:|\[)([A-Z]{2,4})[:\]]`)
+
+// withChipToolLog returns a view of the client whose chip-tool runs use the given verbosity and
+// forward the given log categories. Without categories, chipToolLogging.categories applies.
+func (c *Client) withChipToolLog(debug bool, categories []string) *Client {
+	if !debug && len(categories) == 0 && len(appConfig.ChipToolLogging.Categories) == 0 {
+		return c
+	}
+	if len(categories) == 0 {
+		categories = appConfig.ChipToolLogging.Categories
+	}
+	view := c.view()
+	view.chipToolLog = chipToolLogOptions{debug: debug}
+	for _, category := range categories {
+		if category == "*" {
+			view.chipToolLog.categories = nil
+			break
+		}
+		if view.chipToolLog.categories == nil {
+			view.chipToolLog.categories = make(map[string]bool)
+		}
+		view.chipToolLog.categories[strings.ToUpper(category)] = true
+	}
+	return view
+}
+
+// chipToolArgs adds the log flags of the request's verbosity to chip-tool arguments.
+func (c *Client) chipToolArgs(args []string) []string {
+	flags := appConfig.ChipToolLogging.Flags
+	if c != nil && c.chipToolLog.debug {
+		flags = appConfig.ChipToolLogging.DebugFlags
+		if len(flags) == 0 {
+			flags = defaultChipToolDebugFlags
+		}
+	}
+	if len(flags) == 0 {
+		return args
+	}
+	return append(append([]string(nil), args...), flags...)
+}
+
+// lineFilter returns a filter of one output stream, reporting whether each line is forwarded: lines
+// of the forwarded categories, and errors. Lines without a category, such as the continuation of a
+// multi-line entry, follow the line before.
+func (o chipToolLogOptions) lineFilter() func(line string) bool {
+	keep := true
+	return func(line string) bool {
+		if o.categories == nil {
+			return true
+		}
+		if m := reLogCategory.FindStringSubmatch(stripAnsi(line)); m != nil {
+			keep = o.categories[m[1]]
+		}
+		return keep || strings.Contains(line, "CHIP Error") || strings.Contains(line, "Error:")
+	}
+}
+
+// filterChipToolOutput keeps the forwarded lines of an output stream.
+func (o chipToolLogOptions) filterChipToolOutput(output string) string {
+	if o.categories == nil {
+		return output
+	}
+	forward := o.lineFilter()
+	var kept []string
+	for _, line := range strings.Split(output, "\n") {
+		if forward(line) {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// chipToolLineFilter returns the filter of a streamed output of the client's chip-tool runs.
+func (c *Client) chipToolLineFilter() func(line string) bool {
+	if c == nil {
+		return chipToolLogOptions{}.lineFilter()
+	}
+	return c.chipToolLog.lineFilter()
+}
+
+// chipToolOutput formats the output of a chip-tool run for the client, with only the log
+// categories the request forwards.
+func (c *Client) chipToolOutput(stdout, stderr string) string {
+	var options chipToolLogOptions
+	if c != nil {
+		options = c.chipToolLog
+	}
+	return fmt.Sprintf("Stdout:\n%s\nStderr:\n%s", options.filterChipToolOutput(stdout), options.filterChipToolOutput(stderr))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var chipToolFlag = flag.String("chip-tool", "", "path or command name of chip-tool, instead of looking for it (overrides chipToolPath in the configuration)")
+
+// chipToolCandidates are the places chip-tool is looked for, in order, when no path is configured:
+// the PATH, the snaps, then the output directories of source builds. Globs are expanded.
+var chipToolCandidates = []string{
+	"chip-tool",
+	"/snap/bin/chip-tool",
+	"/snap/bin/matter-pi-tool.chip-tool",
+	"/usr/local/bin/chip-tool",
+	"$HOME/connectedhomeip/out/*/chip-tool",
+	"/home/*/connectedhomeip/out/*/chip-tool",
+	"/opt/connectedhomeip/out/*/chip-tool",
+	"./out/*/chip-tool",
+}
+
+// ChipToolCandidate is a location tried while looking for chip-tool.
+type ChipToolCandidate struct {
+	Path  string `json:"path"`
+	Error string `json:"error,omitempty"` // Why it wasn't selected; empty for the selected one
+}
+
+// ChipToolSelection reports which chip-tool the backend runs, in GET /api/status.
+type ChipToolSelection struct {
+	Path       string              `json:"path"`
+	Resolved   string              `json:"resolvedPath,omitempty"` // Found in PATH, symlinks followed
+	Source     string              `json:"source"`                 // "flag", "config", "autodetect" or "simulator"
+	Version    string              `json:"version,omitempty"`      // Snap version, when installed as a snap
+	Found      bool                `json:"found"`
+	Candidates []ChipToolCandidate `json:"candidates,omitempty"` // Locations tried, in order
+}
+
+// chipToolSelection is set by selectChipTool at startup.
+var chipToolSelection ChipToolSelection
+
+// selectChipTool sets chipToolPath: the -chip-tool flag or chipToolPath of the configuration when
+// set, otherwise the first of chipToolCandidates that runs and lists chip-tool's command sets. A
+// configured path is used as is, even when it doesn't work, so a typo isn't papered over by
+// another binary. When nothing is found, chipToolPath keeps its default and the failure is logged.
+func selectChipTool() ChipToolSelection {
+	if *simulateFlag {
+		return ChipToolSelection{Path: chipToolPath, Source: "simulator", Found: true}
+	}
+	var configured, source string
+	switch {
+	case *chipToolFlag != "":
+		configured, source = *chipToolFlag, "flag"
+	case appConfig.ChipToolPath != "":
+		configured, source = appConfig.ChipToolPath, "config"
+	}
+	if configured != "" {
+		selection := ChipToolSelection{Path: configured, Source: source}
+		candidate := ChipToolCandidate{Path: configured}
+		if resolved, err := checkChipToolCandidate(configured); err != nil {
+			candidate.Error = err.Error()
+		} else {
+			selection.Resolved, selection.Found = resolved, true
+		}
+		selection.Candidates = []ChipToolCandidate{candidate}
+		return finishChipToolSelection(selection)
+	}
+
+	selection := ChipToolSelection{Path: chipToolPath, Source: "autodetect"}
+	for _, path := range expandChipToolCandidates() {
+		resolved, err := checkChipToolCandidate(path)
+		if err != nil {
+			selection.Candidates = append(selection.Candidates, ChipToolCandidate{Path: path, Error: err.Error()})
+			continue
+		}
+		selection.Candidates = append(selection.Candidates, ChipToolCandidate{Path: path})
+		selection.Path, selection.Resolved, selection.Found = path, resolved, true
+		break
+	}
+	return finishChipToolSelection(selection)
+}
+
+// finishChipToolSelection applies the selection and logs it.
+func finishChipToolSelection(selection ChipToolSelection) ChipToolSelection {
+	chipToolPath = selection.Path
+	if !selection.Found {
+		tried := make([]string, 0, len(selection.Candidates))
+		for _, candidate := range selection.Candidates {
+			tried = append(tried, candidate.Path+" ("+candidate.Error+")")
+		}
+		log.Printf("WARNING: no working chip-tool found (%s); tried %s. Set chipToolPath in the configuration or pass -chip-tool.", selection.Source, strings.Join(tried, ", "))
+		return selection
+	}
+	selection.Version = snapVersion(selection.Path)
+	version := ""
+	if selection.Version != "" {
+		version = ", version " + selection.Version
+	}
+	log.Printf("Using chip-tool at %s (%s%s)", selection.Path, selection.Source, version)
+	return selection
+}
+
+// expandChipToolCandidates expands $HOME and the globs of chipToolCandidates, skipping duplicates.
+// Matches are made absolute.
+func expandChipToolCandidates() []string {
+	var paths []string
+	for _, candidate := range chipToolCandidates {
+		candidate = os.ExpandEnv(candidate)
+		if !strings.ContainsAny(candidate, "*?[") {
+			paths = appendUnique(paths, candidate)
+			continue
+		}
+		matches, _ := filepath.Glob(candidate)
+		for _, match := range matches {
+			if abs, err := filepath.Abs(match); err == nil {
+				match = abs // Relative to the directory the backend started in
+			}
+			paths = appendUnique(paths, match)
+		}
+	}
+	return paths
+}
+
+// appendUnique appends value unless the slice already holds it.
+func appendUnique(values []string, value string) []string {
+	if containsString(values, value) {
+		return values
+	}
+	return append(values, value)
+}
+
+// checkChipToolCandidate checks that a path or command name runs chip-tool: run without
+// arguments, chip-tool lists its command sets. It returns the resolved path.
+func checkChipToolCandidate(path string) (string, error) {
+	found, err := exec.LookPath(path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(found)
+	if err != nil {
+		return "", err
+	}
+	stdout, stderr, _ := runChipToolBinary(found)
+	if !reCommandSetEntry.MatchString(stripAnsi(stdout + stderr)) {
+		return "", fmt.Errorf("%s runs but doesn't list chip-tool command sets", found)
+	}
+	return resolved, nil
+}
+
+// snapVersion returns the version of the snap providing a /snap/bin command, from its snap.yaml.
+func snapVersion(path string) string {
+	if !strings.HasPrefix(path, "/snap/bin/") {
+		return ""
+	}
+	name, _, _ := strings.Cut(filepath.Base(path), ".")
+	f, err := os.Open(filepath.Join("/snap", name, "current", "meta", "snap.yaml"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if version, ok := strings.CutPrefix(scanner.Text(), "version:"); ok {
+			return strings.Trim(strings.TrimSpace(version), `'"`)
+		}
+	}
+	return ""
+}
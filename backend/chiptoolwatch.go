@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the chip-tool binary watch. The config can override both.
+const (
+	defaultChipToolCheckInterval = 30 * time.Second
+	defaultChipToolDrainTimeout  = 2 * time.Minute
+)
+
+// requiredChipToolCommands are the command sets the backend relies on. A chip-tool build missing
+// one of them is reported as incompatible.
+var requiredChipToolCommands = []string{"pairing", "discover", "descriptor", "basicinformation", "onoff", "operationalcredentials"}
+
+// reCommandSetEntry matches the command sets chip-tool lists when run without arguments, e.g. "  | * onoff    |"
+var reCommandSetEntry = regexp.MustCompile(`(?m)^\s*\|\s+\*\s+([a-z0-9-]+)\s+\|`)
+
+// ChipToolInfo identifies the installed chip-tool binary and what it supports.
+type ChipToolInfo struct {
+	Path         string    `json:"path"`
+	ResolvedPath string    `json:"resolvedPath,omitempty"` // After following symlinks
+	Fingerprint  string    `json:"fingerprint"`            // Snap revision, or size and modification time
+	SHA256       string    `json:"sha256,omitempty"`       // Of the binary, except for snaps
+	CommandSets  []string  `json:"commandSets"`            // Clusters and command groups, from the probe
+	Missing      []string  `json:"missing,omitempty"`      // requiredChipToolCommands not supported
+	Compatible   bool      `json:"compatible"`
+	Error        string    `json:"error,omitempty"` // Set when the binary could not be found or probed
+	ProbedAt     time.Time `json:"probedAt"`
+}
+
+// ChipToolChangedPayload is broadcast as "chip_tool_changed" when the binary was replaced.
+type ChipToolChangedPayload struct {
+	Previous ChipToolInfo `json:"previous"`
+	Current  ChipToolInfo `json:"current"`
+	Added    []string     `json:"added,omitempty"`   // Command sets the new binary supports and the old one didn't
+	Removed  []string     `json:"removed,omitempty"` // Command sets no longer supported
+}
+
+// ChipToolWatcher notices when the chip-tool binary is replaced (e.g. by a snap refresh) while the
+// backend runs. Before probing the new binary it drains the one-shot chip-tool runs in flight and
+// holds new ones back, so they don't fail halfway through the upgrade.
+type ChipToolWatcher struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	draining bool
+	paused   bool // Held by maintenance mode (see maintenance.go)
+	inFlight int
+	info     ChipToolInfo
+}
+
+// NewChipToolWatcher creates an idle watcher; Run starts watching.
+func NewChipToolWatcher() *ChipToolWatcher {
+	w := &ChipToolWatcher{}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// Begin marks the start of a chip-tool run and returns the function marking its end. It waits
+// while the watcher drains for a binary change, and during maintenance.
+func (w *ChipToolWatcher) Begin() func() {
+	w.mu.Lock()
+	for w.draining || w.paused {
+		w.cond.Wait()
+	}
+	w.inFlight++
+	w.mu.Unlock()
+	return func() {
+		w.mu.Lock()
+		w.inFlight--
+		w.cond.Broadcast()
+		w.mu.Unlock()
+	}
+}
+
+// Info returns the result of the latest probe.
+func (w *ChipToolWatcher) Info() ChipToolInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.info
+}
+
+// Run probes the binary, then checks its fingerprint periodically until the process exits.
+func (w *ChipToolWatcher) Run() {
+	info := probeChipTool()
+	w.mu.Lock()
+	w.info = info
+	w.mu.Unlock()
+	logChipToolInfo(info)
+
+	interval := defaultChipToolCheckInterval
+	if appConfig.ChipToolCheckIntervalSeconds > 0 {
+		interval = time.Duration(appConfig.ChipToolCheckIntervalSeconds) * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		fingerprint, _, _ := chipToolFingerprint()
+		if fingerprint == w.Info().Fingerprint || w.Paused() {
+			continue // During maintenance, the binary is probed when it ends
+		}
+		w.handleChange()
+	}
+}
+
+// handleChange drains in-flight runs, re-probes the binary and tells the clients what changed.
+func (w *ChipToolWatcher) handleChange() {
+	previous := w.Info()
+	log.Printf("chip-tool binary changed (was %s), draining in-flight operations before probing it", previous.Fingerprint)
+
+	w.mu.Lock()
+	w.draining = true
+	w.mu.Unlock()
+	w.drain(defaultChipToolDrainTimeout)
+
+	// Give a package manager a moment to finish swapping files before running the new binary
+	time.Sleep(2 * time.Second)
+	current := probeChipTool()
+
+	w.mu.Lock()
+	w.info = current
+	w.draining = false
+	w.cond.Broadcast()
+	w.mu.Unlock()
+	announceChipToolChange(previous, current)
+}
+
+// announceChipToolChange logs the new binary and tells the clients what changed.
+func announceChipToolChange(previous, current ChipToolInfo) {
+	logChipToolInfo(current)
+	broadcastToClients("chip_tool_changed", ChipToolChangedPayload{
+		Previous: previous,
+		Current:  current,
+		Added:    missingFrom(current.CommandSets, previous.CommandSets),
+		Removed:  missingFrom(previous.CommandSets, current.CommandSets),
+	})
+}
+
+// Pause holds new chip-tool runs back and waits for the ones in flight, up to timeout. It returns
+// how many are still running.
+func (w *ChipToolWatcher) Pause(timeout time.Duration) int {
+	w.mu.Lock()
+	w.paused = true
+	w.mu.Unlock()
+	w.drain(timeout)
+	return w.InFlight()
+}
+
+// Resume re-probes the binary if it was replaced while paused, then releases the held runs. It
+// reports whether the binary changed.
+func (w *ChipToolWatcher) Resume() bool {
+	previous := w.Info()
+	fingerprint, _, _ := chipToolFingerprint()
+	changed := fingerprint != previous.Fingerprint
+	var current ChipToolInfo
+	if changed {
+		current = probeChipTool()
+	}
+	w.mu.Lock()
+	if changed {
+		w.info = current
+	}
+	w.paused = false
+	w.cond.Broadcast()
+	w.mu.Unlock()
+	if changed {
+		announceChipToolChange(previous, current)
+	}
+	return changed
+}
+
+// Paused reports whether maintenance holds the chip-tool runs.
+func (w *ChipToolWatcher) Paused() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.paused
+}
+
+// InFlight returns the number of one-shot chip-tool runs in progress.
+func (w *ChipToolWatcher) InFlight() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.inFlight
+}
+
+// drain waits until no chip-tool run is in flight, or until timeout.
+func (w *ChipToolWatcher) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		w.mu.Lock()
+		inFlight := w.inFlight
+		w.mu.Unlock()
+		if inFlight == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Printf("%d chip-tool operation(s) still running after %s, probing the new binary anyway", inFlight, timeout)
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// chipToolFingerprint identifies the installed binary cheaply. Snap commands are all symlinks to
+// /usr/bin/snap, so the fingerprint of a snap is its current revision instead.
+func chipToolFingerprint() (fingerprint, resolved string, err error) {
+	path, err := exec.LookPath(chipToolPath)
+	if err != nil {
+		return "", "", err
+	}
+	if resolved, err = filepath.EvalSymlinks(path); err != nil {
+		return "", "", err
+	}
+	if filepath.Base(resolved) == "snap" && strings.HasPrefix(path, "/snap/bin/") {
+		name, _, _ := strings.Cut(filepath.Base(path), ".")
+		revision, err := os.Readlink(filepath.Join("/snap", name, "current"))
+		if err != nil {
+			return "", resolved, err
+		}
+		return "snap " + name + " revision " + revision, resolved, nil
+	}
+	stat, err := os.Stat(resolved)
+	if err != nil {
+		return "", resolved, err
+	}
+	return fmt.Sprintf("%d bytes, modified %s", stat.Size(), stat.ModTime().UTC().Format(time.RFC3339Nano)), resolved, nil
+}
+
+// hashFile returns the hex SHA-256 of a file.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// probeChipTool identifies the binary and lists the command sets it supports: run without
+// arguments, chip-tool prints them and exits with an error status.
+func probeChipTool() ChipToolInfo {
+	info := ChipToolInfo{Path: chipToolPath, CommandSets: []string{}, ProbedAt: time.Now()}
+	fingerprint, resolved, err := chipToolFingerprint()
+	info.Fingerprint, info.ResolvedPath = fingerprint, resolved
+	if err != nil {
+		info.Error = "locating chip-tool: " + err.Error()
+		info.Missing = requiredChipToolCommands
+		return info
+	}
+	if !strings.HasPrefix(fingerprint, "snap ") {
+		if sum, err := hashFile(resolved); err == nil {
+			info.SHA256 = sum
+		}
+	}
+	stdout, stderr, _ := runChipToolUngated()
+	for _, m := range reCommandSetEntry.FindAllStringSubmatch(stripAnsi(stdout+stderr), -1) {
+		if !containsString(info.CommandSets, m[1]) {
+			info.CommandSets = append(info.CommandSets, m[1])
+		}
+	}
+	sort.Strings(info.CommandSets)
+	if len(info.CommandSets) == 0 {
+		info.Error = "chip-tool printed no command sets; its output format may have changed"
+	}
+	info.Missing = missingFrom(requiredChipToolCommands, info.CommandSets)
+	info.Compatible = info.Error == "" && len(info.Missing) == 0
+	return info
+}
+
+// runChipToolUngated runs chip-tool without arguments, bypassing the watcher (the probe runs while it drains).
+func runChipToolUngated() (string, string, error) {
+	return runChipToolBinary(chipToolPath)
+}
+
+// runChipToolBinary runs a chip-tool binary without arguments.
+func runChipToolBinary(path string) (string, string, error) {
+	cmd := exec.Command(path)
+	var outBuf, errBuf strings.Builder
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+	err := cmd.Run()
+	return outBuf.String(), errBuf.String(), err
+}
+
+// missingFrom returns the values of want not in have.
+func missingFrom(want, have []string) []string {
+	var missing []string
+	for _, v := range want {
+		if !containsString(have, v) {
+			missing = append(missing, v)
+		}
+	}
+	return missing
+}
+
+func logChipToolInfo(info ChipToolInfo) {
+	switch {
+	case info.Error != "":
+		log.Printf("WARNING: chip-tool probe failed: %s", info.Error)
+	case !info.Compatible:
+		log.Printf("WARNING: chip-tool (%s) lacks command sets the backend uses: %s", info.Fingerprint, strings.Join(info.Missing, ", "))
+	default:
+		log.Printf("chip-tool (%s) supports %d command sets", info.Fingerprint, len(info.CommandSets))
+	}
+}
+
+// chipToolWatcher is the watcher of the configured chip-tool binary.
+var chipToolWatcher = NewChipToolWatcher()
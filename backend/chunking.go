@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// defaultMaxOutboundMessageSize is the largest WebSocket frame sent to clients, unless the config sets it.
+// Larger messages (e.g. wildcard read results) are split into "message_chunk" messages.
+const defaultMaxOutboundMessageSize = 64 * 1024
+
+// chunkEnvelopeOverhead is reserved in each chunk for the envelope around the data.
+const chunkEnvelopeOverhead = 512
+
+// chunkSeq numbers chunked messages, so clients can tell interleaved ones apart.
+var chunkSeq atomic.Uint64
+
+// MessageChunkPayload is one segment of a message too large for a single frame. Clients concatenate
+// the Data of the chunks sharing an ID, in Seq order, and parse the result once Final is set: it is
+// the original message, exactly as it would have been sent unsegmented.
+type MessageChunkPayload struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"` // Type of the original message
+	Seq   int    `json:"seq"`  // From 0
+	Total int    `json:"total"`
+	Final bool   `json:"final"`
+	Data  string `json:"data"`
+}
+
+// maxOutboundMessageSize returns the outbound frame size limit.
+func maxOutboundMessageSize() int {
+	if appConfig.MaxOutboundMessageSize > 0 {
+		return appConfig.MaxOutboundMessageSize
+	}
+	return defaultMaxOutboundMessageSize
+}
+
+// splitUTF8 cuts s in pieces of at most size bytes, without splitting a multi-byte character.
+func splitUTF8(s string, size int) []string {
+	var pieces []string
+	for len(s) > size {
+		cut := size
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		pieces = append(pieces, s[:cut])
+		s = s[cut:]
+	}
+	return append(pieces, s)
+}
+
+// frameMessage returns the frames carrying a marshalled message: the message itself when it fits in
+// limit bytes, otherwise a sequence of "message_chunk" messages that each do.
+func frameMessage(message []byte, msgType, requestID string, legacy bool, limit int) ([][]byte, error) {
+	if len(message) <= limit {
+		return [][]byte{message}, nil
+	}
+	// The message is JSON, so <, > and & are already escaped: re-encoding it as a string at most
+	// doubles its size (quotes and backslashes). Half the space left after the envelope always fits.
+	size := (limit - chunkEnvelopeOverhead) / 2
+	if size < utf8.UTFMax {
+		size = utf8.UTFMax
+	}
+	pieces := splitUTF8(string(message), size)
+	id := strconv.FormatUint(chunkSeq.Add(1), 10)
+	frames := make([][]byte, 0, len(pieces))
+	for i, piece := range pieces {
+		chunk := MessageChunkPayload{ID: id, Type: msgType, Seq: i, Total: len(pieces), Final: i == len(pieces)-1, Data: piece}
+		frame, err := json.Marshal(buildServerMessage("message_chunk", requestID, chunk, legacy))
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
@@ -0,0 +1,823 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CoAP message types (RFC 7252).
+const (
+	coapConfirmable    = 0
+	coapNonConfirmable = 1
+	coapAcknowledgment = 2
+	coapReset          = 3
+)
+
+// CoAP method and response codes, as class<<5 | detail.
+const (
+	coapEmpty               = 0
+	coapGET                 = 1
+	coapPOST                = 2
+	coapPUT                 = 3
+	coapChanged             = 2<<5 | 4
+	coapContent             = 2<<5 | 5
+	coapBadRequest          = 4<<5 | 0
+	coapUnauthorized        = 4<<5 | 1
+	coapBadOption           = 4<<5 | 2
+	coapForbidden           = 4<<5 | 3
+	coapNotFound            = 4<<5 | 4
+	coapMethodNotAllowed    = 4<<5 | 5
+	coapInternalServerError = 5<<5 | 0
+	coapBadGateway          = 5<<5 | 2
+	coapServiceUnavailable  = 5<<5 | 3
+)
+
+// CoAP options used by the server (RFC 7252, RFC 7641 Observe, RFC 7959 Block2).
+const (
+	coapOptionObserve       = 6
+	coapOptionURIPath       = 11
+	coapOptionContentFormat = 12
+	coapOptionURIQuery      = 15
+	coapOptionBlock2        = 23
+)
+
+// CoAP content formats.
+const (
+	coapFormatText = 0
+	coapFormatLink = 40
+	coapFormatJSON = 50
+)
+
+// CoAP server defaults and the transmission parameters of RFC 7252 section 4.8.
+const (
+	defaultCoAPMaxObservers = 64
+	coapBlockSize           = 1024 // Largest payload sent in one datagram; larger ones go in Block2 blocks
+	coapBlockSZX            = 6    // log2(coapBlockSize) - 4
+	coapAckTimeout          = 2 * time.Second
+	coapMaxRetransmit       = 4
+	coapExchangeLifetime    = 247 * time.Second // Duplicate requests are answered from the cache this long
+	coapMaxMessageSize      = 64 << 10
+	// coapConfirmNotifications is how often a notification is confirmable, so the observers that
+	// went away without cancelling are noticed (RFC 7641 section 4.5 asks for at least once a day).
+	coapConfirmNotifications = 10 * time.Minute
+)
+
+// coapOption is an option of a CoAP message.
+type coapOption struct {
+	number uint16
+	value  []byte
+}
+
+// coapMessage is a CoAP message.
+type coapMessage struct {
+	kind      byte
+	code      byte
+	messageID uint16
+	token     []byte
+	options   []coapOption
+	payload   []byte
+}
+
+// parseCoAPMessage decodes a datagram.
+func parseCoAPMessage(data []byte) (coapMessage, error) {
+	if len(data) < 4 || data[0]>>6 != 1 {
+		return coapMessage{}, errors.New("not a CoAP version 1 message")
+	}
+	msg := coapMessage{kind: data[0] >> 4 & 3, code: data[1], messageID: binary.BigEndian.Uint16(data[2:])}
+	tokenLength := int(data[0] & 0x0f)
+	if tokenLength > 8 || len(data) < 4+tokenLength {
+		return coapMessage{}, errors.New("invalid token")
+	}
+	msg.token = append([]byte(nil), data[4:4+tokenLength]...)
+	rest := data[4+tokenLength:]
+	number := 0
+	for len(rest) > 0 {
+		if rest[0] == 0xff {
+			msg.payload = rest[1:]
+			break
+		}
+		delta, length := int(rest[0]>>4), int(rest[0]&0x0f)
+		rest = rest[1:]
+		var err error
+		if delta, rest, err = coapExtended(delta, rest); err != nil {
+			return coapMessage{}, err
+		}
+		if length, rest, err = coapExtended(length, rest); err != nil {
+			return coapMessage{}, err
+		}
+		if len(rest) < length {
+			return coapMessage{}, errors.New("truncated option")
+		}
+		number += delta
+		msg.options = append(msg.options, coapOption{number: uint16(number), value: rest[:length]})
+		rest = rest[length:]
+	}
+	return msg, nil
+}
+
+// coapExtended decodes the extended option delta or length that follows a nibble of 13 or 14.
+func coapExtended(nibble int, rest []byte) (int, []byte, error) {
+	switch nibble {
+	case 13:
+		if len(rest) < 1 {
+			return 0, nil, errors.New("truncated option")
+		}
+		return int(rest[0]) + 13, rest[1:], nil
+	case 14:
+		if len(rest) < 2 {
+			return 0, nil, errors.New("truncated option")
+		}
+		return int(binary.BigEndian.Uint16(rest)) + 269, rest[2:], nil
+	case 15:
+		return 0, nil, errors.New("reserved option nibble")
+	}
+	return nibble, rest, nil
+}
+
+// coapNibble encodes an option delta or length, returning its nibble and extended bytes.
+func coapNibble(n int) (byte, []byte) {
+	switch {
+	case n < 13:
+		return byte(n), nil
+	case n < 269:
+		return 13, []byte{byte(n - 13)}
+	default:
+		return 14, binary.BigEndian.AppendUint16(nil, uint16(n-269))
+	}
+}
+
+// encode encodes the message, its options sorted by number.
+func (m coapMessage) encode() []byte {
+	data := []byte{1<<6 | m.kind<<4 | byte(len(m.token)), m.code}
+	data = binary.BigEndian.AppendUint16(data, m.messageID)
+	data = append(data, m.token...)
+	options := append([]coapOption(nil), m.options...)
+	sort.SliceStable(options, func(i, j int) bool { return options[i].number < options[j].number })
+	previous := 0
+	for _, option := range options {
+		deltaNibble, deltaExtended := coapNibble(int(option.number) - previous)
+		lengthNibble, lengthExtended := coapNibble(len(option.value))
+		data = append(data, deltaNibble<<4|lengthNibble)
+		data = append(append(append(data, deltaExtended...), lengthExtended...), option.value...)
+		previous = int(option.number)
+	}
+	if len(m.payload) > 0 {
+		data = append(append(data, 0xff), m.payload...)
+	}
+	return data
+}
+
+// option returns the first value of an option.
+func (m coapMessage) option(number uint16) ([]byte, bool) {
+	for _, option := range m.options {
+		if option.number == number {
+			return option.value, true
+		}
+	}
+	return nil, false
+}
+
+// stringOptions returns the values of a repeatable string option, e.g. the Uri-Path segments.
+func (m coapMessage) stringOptions(number uint16) []string {
+	var values []string
+	for _, option := range m.options {
+		if option.number == number {
+			values = append(values, string(option.value))
+		}
+	}
+	return values
+}
+
+// coapUint encodes an unsigned option value in as few bytes as possible.
+func coapUint(n uint32) []byte {
+	value := binary.BigEndian.AppendUint32(nil, n)
+	for len(value) > 0 && value[0] == 0 {
+		value = value[1:]
+	}
+	return value
+}
+
+// decodeCoAPUint decodes an unsigned option value.
+func decodeCoAPUint(value []byte) uint32 {
+	var n uint32
+	for _, b := range value {
+		n = n<<8 | uint32(b)
+	}
+	return n
+}
+
+// coapResponse is the answer of a resource: a code, and a JSON, link-format or text body.
+type coapResponse struct {
+	code    byte
+	format  int
+	payload []byte
+}
+
+// coapJSON answers with a JSON body.
+func coapJSON(code byte, body interface{}) coapResponse {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return coapError(coapInternalServerError, err.Error())
+	}
+	return coapResponse{code: code, format: coapFormatJSON, payload: data}
+}
+
+// coapError answers with an error code and a diagnostic payload, as RFC 7252 section 5.5.2 suggests.
+func coapError(code byte, message string) coapResponse {
+	return coapResponse{code: code, format: coapFormatText, payload: []byte(message)}
+}
+
+// coapObserver is a client observing a device or one of its attributes (RFC 7641).
+type coapObserver struct {
+	addr       *net.UDPAddr
+	token      []byte
+	path       []string // Uri-Path segments of the observed resource
+	nodeID     string
+	endpointID string
+	cluster    string // Empty when the whole device is observed
+	attribute  string
+	seq        uint32
+	confirmed  time.Time // Last confirmable notification sent, or the registration
+}
+
+// coapExchange is a request being answered or answered recently, for the deduplication of the
+// retransmissions of confirmable requests.
+type coapExchange struct {
+	response []byte // Nil while the request is handled
+	at       time.Time
+}
+
+// CoAPStatus describes the CoAP server in GET /api/v1/status.
+type CoAPStatus struct {
+	Listen    string `json:"listen"`
+	Observers int    `json:"observers"`
+	Requests  int    `json:"requests"` // Handled since startup
+}
+
+// CoAPServer is an optional north-bound CoAP server (RFC 7252) over UDP, so constrained-network
+// experiments can read the devices, observe their state and command them without HTTP. The
+// resources are:
+//
+//	/.well-known/core                           link-format discovery (RFC 6690)
+//	/devices                                    the devices, as in GET /api/v1/devices
+//	/devices/<id>                               a device and its cached attributes (observable)
+//	/devices/<id>/<cluster>/<attribute>         a cached attribute (observable); PUT commands it
+//	/devices/<id>/commands/<cluster>/<command>  PUT or POST runs a device command
+//
+// Payloads are JSON. Retransmitted requests are answered from the recent exchanges, so a command
+// runs once. With an authToken, requests carry a token=<authToken> Uri-Query. There is no DTLS and
+// no LwM2M registration, so the server belongs on a trusted network.
+type CoAPServer struct {
+	mu        sync.Mutex
+	conn      *net.UDPConn
+	listen    string
+	messageID uint16
+	requests  int
+	observers map[string]*coapObserver // By address and token
+	exchanges map[string]*coapExchange // By address and message ID
+	notified  map[uint16]string        // Message ID of the latest notification of each observer, for its resets
+	acks      map[uint16]chan struct{} // Separate responses waiting for their ACK, by message ID
+}
+
+// NewCoAPServer creates a CoAPServer, not listening yet.
+func NewCoAPServer() *CoAPServer {
+	return &CoAPServer{
+		observers: make(map[string]*coapObserver), exchanges: make(map[string]*coapExchange),
+		notified: make(map[uint16]string), acks: make(map[uint16]chan struct{}),
+	}
+}
+
+// Start listens on cfg.Listen, when set, and serves until the process exits.
+func (s *CoAPServer) Start(cfg CoAPConfig) {
+	if cfg.Listen == "" {
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", cfg.Listen)
+	if err != nil {
+		log.Printf("WARNING: CoAP server not started: %v", err)
+		return
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Printf("WARNING: CoAP server not started: %v", err)
+		return
+	}
+	s.mu.Lock()
+	s.conn, s.listen, s.messageID = conn, conn.LocalAddr().String(), uint16(rand.Intn(1<<16))
+	s.mu.Unlock()
+	eventBus.Subscribe("coap", s.notifyObservers)
+	go s.sweep()
+	go s.serve()
+	log.Printf("CoAP server listening on udp %s", conn.LocalAddr())
+}
+
+// Status describes the server, nil when it isn't running.
+func (s *CoAPServer) Status() *CoAPStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return &CoAPStatus{Listen: s.listen, Observers: len(s.observers), Requests: s.requests}
+}
+
+// serve reads the datagrams and handles each request in its own goroutine, since a command or a
+// live read can take seconds.
+func (s *CoAPServer) serve() {
+	buf := make([]byte, coapMaxMessageSize)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("CoAP server stopped: %v", err)
+			return
+		}
+		msg, err := parseCoAPMessage(buf[:n])
+		if err != nil {
+			continue // Silently ignored, as RFC 7252 section 4.2 asks for malformed messages
+		}
+		switch {
+		case msg.kind == coapAcknowledgment:
+			s.acknowledged(msg.messageID)
+		case msg.kind == coapReset:
+			s.reset(msg.messageID)
+		case msg.code == coapEmpty:
+			if msg.kind == coapConfirmable { // CoAP ping
+				s.send(addr, coapMessage{kind: coapReset, messageID: msg.messageID})
+			}
+		case msg.code>>5 == 0:
+			if s.duplicate(addr, msg) {
+				continue
+			}
+			go s.handle(addr, msg)
+		}
+	}
+}
+
+// duplicate reports whether a request was already received, resending the response when it was
+// answered already.
+func (s *CoAPServer) duplicate(addr *net.UDPAddr, msg coapMessage) bool {
+	key := fmt.Sprintf("%s/%d", addr, msg.messageID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if exchange, ok := s.exchanges[key]; ok {
+		if exchange.response != nil && msg.kind == coapConfirmable {
+			_, _ = s.conn.WriteToUDP(exchange.response, addr)
+		}
+		return true
+	}
+	s.exchanges[key] = &coapExchange{at: time.Now()}
+	s.requests++
+	return false
+}
+
+// sweep forgets the exchanges past their lifetime.
+func (s *CoAPServer) sweep() {
+	for range time.Tick(time.Minute) {
+		s.mu.Lock()
+		for key, exchange := range s.exchanges {
+			if time.Since(exchange.at) > coapExchangeLifetime {
+				delete(s.exchanges, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// nextMessageID returns a message ID for a message the server initiates.
+func (s *CoAPServer) nextMessageID() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messageID++
+	return s.messageID
+}
+
+// send writes a message to addr.
+func (s *CoAPServer) send(addr *net.UDPAddr, msg coapMessage) []byte {
+	data := msg.encode()
+	if _, err := s.conn.WriteToUDP(data, addr); err != nil {
+		log.Printf("CoAP: sending to %s: %v", addr, err)
+	}
+	return data
+}
+
+// handle answers a request. Requests that may take a while (commands, live reads) are
+// acknowledged first, if confirmable, and answered with a separate response.
+func (s *CoAPServer) handle(addr *net.UDPAddr, req coapMessage) {
+	acked := false
+	ackEarly := func() {
+		if req.kind == coapConfirmable && !acked {
+			acked = true
+			data := s.send(addr, coapMessage{kind: coapAcknowledgment, messageID: req.messageID})
+			s.remember(addr, req.messageID, data)
+		}
+	}
+	resp, observe := s.route(addr, req, ackEarly)
+
+	reply := coapMessage{kind: coapNonConfirmable, code: resp.code, token: req.token}
+	switch {
+	case req.kind == coapConfirmable && !acked:
+		reply.kind, reply.messageID = coapAcknowledgment, req.messageID
+	case req.kind == coapConfirmable:
+		reply.kind, reply.messageID = coapConfirmable, s.nextMessageID()
+	default:
+		reply.messageID = s.nextMessageID()
+	}
+	if observe != nil {
+		reply.options = append(reply.options, coapOption{number: coapOptionObserve, value: coapUint(*observe)})
+	}
+	s.setBody(&reply, req, resp)
+	data := s.send(addr, reply)
+	if !acked {
+		s.remember(addr, req.messageID, data)
+	}
+	if reply.kind == coapConfirmable {
+		s.retransmit(addr, reply.messageID, data, nil)
+	}
+}
+
+// setBody puts the payload of a response in a message, or the block of it the client asked for
+// when it doesn't fit in a datagram (RFC 7959).
+func (s *CoAPServer) setBody(reply *coapMessage, req coapMessage, resp coapResponse) {
+	if len(resp.payload) == 0 {
+		return
+	}
+	reply.options = append(reply.options, coapOption{number: coapOptionContentFormat, value: coapUint(uint32(resp.format))})
+	num, szx := uint32(0), uint32(coapBlockSZX)
+	if value, ok := req.option(coapOptionBlock2); ok {
+		block := decodeCoAPUint(value)
+		num, szx = block>>4, min(block&7, coapBlockSZX)
+	} else if len(resp.payload) <= coapBlockSize {
+		reply.payload = resp.payload
+		return
+	}
+	size := 1 << (szx + 4)
+	start := int(num) * size
+	if start >= len(resp.payload) {
+		reply.code, reply.payload = coapBadOption, []byte("block out of range")
+		reply.options = nil
+		return
+	}
+	end := min(start+size, len(resp.payload))
+	more := uint32(0)
+	if end < len(resp.payload) {
+		more = 1
+	}
+	reply.options = append(reply.options, coapOption{number: coapOptionBlock2, value: coapUint(num<<4 | more<<3 | szx)})
+	reply.payload = resp.payload[start:end]
+}
+
+// remember keeps the response of a request for its retransmissions.
+func (s *CoAPServer) remember(addr *net.UDPAddr, messageID uint16, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if exchange, ok := s.exchanges[fmt.Sprintf("%s/%d", addr, messageID)]; ok {
+		exchange.response = data
+	}
+}
+
+// retransmit resends a confirmable message until it is acknowledged, with the exponential
+// back-off of RFC 7252 section 4.2, then calls failed, if any.
+func (s *CoAPServer) retransmit(addr *net.UDPAddr, messageID uint16, data []byte, failed func()) {
+	acked := make(chan struct{})
+	s.mu.Lock()
+	s.acks[messageID] = acked
+	s.mu.Unlock()
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.acks, messageID)
+			s.mu.Unlock()
+		}()
+		timeout := coapAckTimeout + time.Duration(rand.Int63n(int64(coapAckTimeout/2)))
+		for attempt := 0; attempt < coapMaxRetransmit; attempt++ {
+			select {
+			case <-acked:
+				return
+			case <-time.After(timeout):
+				_, _ = s.conn.WriteToUDP(data, addr)
+				timeout *= 2
+			}
+		}
+		select {
+		case <-acked:
+		case <-time.After(timeout):
+			if failed != nil {
+				failed()
+			}
+		}
+	}()
+}
+
+// acknowledged stops the retransmission of an acknowledged message.
+func (s *CoAPServer) acknowledged(messageID uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if acked, ok := s.acks[messageID]; ok {
+		close(acked)
+		delete(s.acks, messageID)
+	}
+}
+
+// reset handles a Reset: the client rejected a message, e.g. a notification it no longer wants,
+// which cancels the observation.
+func (s *CoAPServer) reset(messageID uint16) {
+	s.acknowledged(messageID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.notified[messageID]; ok {
+		delete(s.notified, messageID)
+		delete(s.observers, key)
+	}
+}
+
+// coapTokenValid reports whether one of the Uri-Query options is token=<authToken>.
+func coapTokenValid(queries []string) bool {
+	valid := false
+	for _, query := range queries {
+		if strings.HasPrefix(query, "token=") && tokensEqual(strings.TrimPrefix(query, "token="), appConfig.AuthToken) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// route dispatches a request to its resource. It returns the response and, for an accepted
+// observation, the Observe value of the first notification.
+func (s *CoAPServer) route(addr *net.UDPAddr, req coapMessage, ackEarly func()) (coapResponse, *uint32) {
+	if appConfig.AuthToken != "" && !coapTokenValid(req.stringOptions(coapOptionURIQuery)) {
+		return coapError(coapUnauthorized, "missing or invalid token query option"), nil
+	}
+	path := req.stringOptions(coapOptionURIPath)
+	switch {
+	case len(path) == 2 && path[0] == ".well-known" && path[1] == "core":
+		if req.code != coapGET {
+			return coapError(coapMethodNotAllowed, "GET only"), nil
+		}
+		return coapResponse{code: coapContent, format: coapFormatLink, payload: []byte(coapLinkFormat())}, nil
+	case len(path) == 1 && path[0] == "devices":
+		if req.code != coapGET {
+			return coapError(coapMethodNotAllowed, "GET only"), nil
+		}
+		return coapJSON(coapContent, map[string]interface{}{"devices": listDevices()}), nil
+	case len(path) >= 2 && path[0] == "devices":
+		device, ok := lookupDevice(path[1])
+		if !ok {
+			return coapError(coapNotFound, fmt.Sprintf("device %q not found", path[1])), nil
+		}
+		switch {
+		case len(path) == 2:
+			if req.code != coapGET {
+				return coapError(coapMethodNotAllowed, "GET only"), nil
+			}
+			return s.observable(addr, req, path, device, "", "", func() coapResponse {
+				return coapJSON(coapContent, coapDeviceState(device))
+			})
+		case len(path) == 4 && req.code == coapGET:
+			return s.observable(addr, req, path, device, path[2], path[3], func() coapResponse {
+				return coapAttribute(device, path[2], path[3], ackEarly)
+			})
+		case len(path) == 4 && req.code == coapPUT:
+			command, err := coapAttributeCommand(device, path[2], path[3], req.payload)
+			if err != nil {
+				return coapError(coapBadRequest, err.Error()), nil
+			}
+			return coapCommand(command, ackEarly), nil
+		case len(path) == 5 && path[2] == "commands" && (req.code == coapPUT || req.code == coapPOST):
+			command := DeviceCommandPayload{DeviceID: device.ID, Cluster: path[3], Command: path[4]}
+			if len(req.payload) > 0 {
+				if err := json.Unmarshal(req.payload, &command.Params); err != nil {
+					return coapError(coapBadRequest, "the payload must be a JSON object of command parameters"), nil
+				}
+			}
+			return coapCommand(command, ackEarly), nil
+		case len(path) == 4 || (len(path) == 5 && path[2] == "commands"):
+			return coapError(coapMethodNotAllowed, "method not allowed on this resource"), nil
+		}
+	}
+	return coapError(coapNotFound, "no such resource"), nil
+}
+
+// observable answers a GET of an observable resource, registering the client as an observer when
+// it asks with Observe 0 and removing it with Observe 1 (RFC 7641).
+func (s *CoAPServer) observable(addr *net.UDPAddr, req coapMessage, path []string, device RegisteredDevice, cluster, attribute string, get func() coapResponse) (coapResponse, *uint32) {
+	value, observing := req.option(coapOptionObserve)
+	key := fmt.Sprintf("%s/%x", addr, req.token)
+	if !observing {
+		return get(), nil
+	}
+	if decodeCoAPUint(value) == 1 {
+		s.mu.Lock()
+		delete(s.observers, key)
+		s.mu.Unlock()
+		return get(), nil
+	}
+	resp := get()
+	if resp.code != coapContent {
+		return resp, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	observer, exists := s.observers[key]
+	if !exists {
+		maxObservers := appConfig.CoAP.MaxObservers
+		if maxObservers <= 0 {
+			maxObservers = defaultCoAPMaxObservers
+		}
+		if len(s.observers) >= maxObservers {
+			return resp, nil // Served without the observation, as RFC 7641 allows
+		}
+		observer = &coapObserver{addr: addr, token: req.token, path: path, nodeID: device.NodeID, endpointID: device.EndpointID, cluster: cluster, attribute: attribute, confirmed: time.Now()}
+		s.observers[key] = observer
+	}
+	observer.seq++
+	seq := observer.seq
+	return resp, &seq
+}
+
+// notifyObservers sends a notification to the observers of the device or attribute an attribute
+// update is about.
+func (s *CoAPServer) notifyObservers(event Event) {
+	update, ok := event.Payload.(AttributeUpdatePayload)
+	if !ok || event.Type != "attribute_update" {
+		return
+	}
+	s.mu.Lock()
+	var due []*coapObserver
+	for _, observer := range s.observers {
+		if observer.nodeID != update.NodeID || observer.endpointID != update.EndpointID {
+			continue
+		}
+		if observer.cluster == "" || (strings.EqualFold(observer.cluster, update.Cluster) && observer.attribute == update.Attribute) {
+			due = append(due, observer)
+		}
+	}
+	s.mu.Unlock()
+	for _, observer := range due {
+		device, ok := lookupDevice(observer.path[1])
+		if !ok {
+			continue
+		}
+		var resp coapResponse
+		if observer.cluster == "" {
+			resp = coapJSON(coapContent, coapDeviceState(device))
+		} else {
+			resp = coapAttribute(device, observer.cluster, observer.attribute, nil)
+		}
+		s.mu.Lock()
+		key := fmt.Sprintf("%s/%x", observer.addr, observer.token)
+		if s.observers[key] != observer {
+			s.mu.Unlock()
+			continue // Cancelled meanwhile
+		}
+		observer.seq = (observer.seq + 1) & 0xffffff
+		s.messageID++
+		notification := coapMessage{kind: coapNonConfirmable, code: resp.code, messageID: s.messageID, token: observer.token,
+			options: []coapOption{{number: coapOptionObserve, value: coapUint(observer.seq)}}}
+		if time.Since(observer.confirmed) > coapConfirmNotifications {
+			notification.kind, observer.confirmed = coapConfirmable, time.Now()
+		}
+		if len(s.notified) > 4*defaultCoAPMaxObservers {
+			s.notified = make(map[uint16]string)
+		}
+		s.notified[notification.messageID] = key
+		s.mu.Unlock()
+		s.setBody(&notification, coapMessage{}, resp)
+		data := s.send(observer.addr, notification)
+		if notification.kind == coapConfirmable {
+			s.retransmit(observer.addr, notification.messageID, data, func() {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				if s.observers[key] == observer {
+					delete(s.observers, key)
+					log.Printf("CoAP: observer %s of /%s gone", observer.addr, strings.Join(observer.path, "/"))
+				}
+			})
+		}
+	}
+}
+
+// coapLinkFormat lists the resources for /.well-known/core: the devices, their cached attributes
+// and the command resource pattern.
+func coapLinkFormat() string {
+	links := []string{`</devices>;ct=50;title="Devices"`}
+	for _, device := range listDevices() {
+		links = append(links, fmt.Sprintf(`</devices/%s>;ct=50;obs;title=%q`, device.ID, device.Name))
+		for _, state := range coapDeviceState(device).Attributes {
+			links = append(links, fmt.Sprintf(`</devices/%s/%s/%s>;ct=50;obs`, device.ID, state.Cluster, state.Attribute))
+		}
+	}
+	return strings.Join(links, ",")
+}
+
+// CoAPDeviceState is the representation of /devices/<id>: the device and its cached attributes.
+type CoAPDeviceState struct {
+	Device     RegisteredDevice `json:"device"`
+	Attributes []AttributeState `json:"attributes"`
+}
+
+func coapDeviceState(device RegisteredDevice) CoAPDeviceState {
+	state := CoAPDeviceState{Device: device, Attributes: []AttributeState{}}
+	for _, attribute := range stateCache.NodeAttributes(device.NodeID) {
+		if attribute.EndpointID == device.EndpointID {
+			state.Attributes = append(state.Attributes, attribute)
+		}
+	}
+	return state
+}
+
+// coapAttribute answers with the cached state of an attribute. An attribute never seen is read
+// from the device first, acknowledging the request since the read takes a while; notifications
+// (nil ackEarly) only use the cache.
+func coapAttribute(device RegisteredDevice, cluster, attribute string, ackEarly func()) coapResponse {
+	if state, ok := cachedState(device.NodeID, device.EndpointID, cluster, attribute); ok {
+		return coapJSON(coapContent, state)
+	}
+	if ackEarly == nil {
+		return coapError(coapNotFound, "no value yet")
+	}
+	if degradedMode.Active() {
+		return coapError(coapServiceUnavailable, "no value cached and Matter operations are unavailable")
+	}
+	ackEarly()
+	value, err := readAttributeValue(device.NodeID, device.EndpointID, cluster, attribute)
+	if err != nil {
+		return coapError(coapBadGateway, fmt.Sprintf("reading %s.%s: %v", cluster, attribute, err))
+	}
+	publishAttributeUpdate(nil, AttributeUpdatePayload{NodeID: device.NodeID, EndpointID: device.EndpointID, Cluster: cluster, Attribute: attribute, Value: value, Source: "coap"})
+	if state, ok := cachedState(device.NodeID, device.EndpointID, cluster, attribute); ok {
+		return coapJSON(coapContent, state)
+	}
+	return coapJSON(coapContent, map[string]interface{}{"value": value})
+}
+
+// coapAttributeCommand maps a PUT of an attribute to the command setting it: OnOff on-off (true,
+// false, "on", "off") and LevelControl current-level (0-254), the attributes whose command is
+// known (see expectedCommandState).
+func coapAttributeCommand(device RegisteredDevice, cluster, attribute string, payload []byte) (DeviceCommandPayload, error) {
+	text := strings.TrimSpace(string(payload))
+	var value interface{} = text
+	_ = json.Unmarshal([]byte(text), &value)
+	command := DeviceCommandPayload{DeviceID: device.ID, Cluster: cluster}
+	switch {
+	case strings.EqualFold(cluster, "OnOff") && attribute == "on-off":
+		switch v := value.(type) {
+		case bool:
+			command.Command = map[bool]string{true: "On", false: "Off"}[v]
+		case string:
+			if strings.EqualFold(v, "on") || strings.EqualFold(v, "off") || strings.EqualFold(v, "toggle") {
+				command.Command = strings.ToUpper(v[:1]) + strings.ToLower(v[1:])
+			}
+		}
+		if command.Command == "" {
+			return command, errors.New("on-off takes true, false, \"on\", \"off\" or \"toggle\"")
+		}
+	case strings.EqualFold(cluster, "LevelControl") && attribute == "current-level":
+		level, ok := toFloat(value)
+		if !ok {
+			if n, err := strconv.ParseFloat(text, 64); err == nil {
+				level, ok = n, true
+			}
+		}
+		if !ok || level < 0 || level > 254 {
+			return command, errors.New("current-level takes a level from 0 to 254")
+		}
+		command.Command, command.Params = "MoveToLevelWithOnOff", map[string]interface{}{"level": level, "transitionTime": 0}
+	default:
+		return command, fmt.Errorf("%s.%s can't be set; PUT /devices/%s/commands/<cluster>/<command> instead", cluster, attribute, device.ID)
+	}
+	return command, nil
+}
+
+// coapCommand runs a device command, acknowledging the request first since it takes a while. It is
+// refused in read-only and degraded mode, as over the WebSocket, and during maintenance, where a
+// CoAP request would otherwise wait for chip-tool without an answer.
+func coapCommand(command DeviceCommandPayload, ackEarly func()) coapResponse {
+	if readOnly.Enabled() {
+		return coapError(coapForbidden, "the backend is in read-only mode")
+	}
+	if degradedMode.Active() {
+		return coapError(coapServiceUnavailable, "Matter operations are unavailable")
+	}
+	if maintenance.Active() {
+		return coapError(coapServiceUnavailable, "device commands are not available during maintenance, try again once it ends")
+	}
+	ackEarly()
+	log.Printf("CoAP: %s.%s on device %s", command.Cluster, command.Command, command.DeviceID)
+	success, errMsg, details := runMacroStep(nil, command)
+	if !success {
+		return coapError(coapBadGateway, errMsg)
+	}
+	return coapJSON(coapChanged, map[string]interface{}{"success": true, "details": details})
+}
+
+var coapServer = NewCoAPServer()
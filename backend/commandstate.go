@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sourceOptimistic marks the attribute updates published right after a command, before the
+// device confirmed the new state. They are kept out of the history, alerts and house modes.
+const sourceOptimistic = "optimistic"
+
+// Command state defaults, used when the config doesn't set them.
+const (
+	defaultStateMaxAgeSeconds = 300
+	reconcileTimeout          = 30 * time.Second // How long a confirmed read is awaited after a command
+)
+
+// StateCorrectionPayload is broadcast as "state_correction" when the confirmed state of an
+// attribute differs from the optimistic update published after a command.
+type StateCorrectionPayload struct {
+	NodeID     string      `json:"nodeId"`
+	EndpointID string      `json:"endpointId"`
+	Cluster    string      `json:"cluster"`
+	Attribute  string      `json:"attribute"`
+	Expected   interface{} `json:"expected"`
+	Actual     interface{} `json:"actual"`
+	Command    string      `json:"command"`
+}
+
+// expectedState is the attribute value a command should leave on the device.
+type expectedState struct {
+	NodeID, EndpointID string
+	Cluster, Attribute string
+	Value              interface{} // As reported by the device (RawValue for transformed attributes)
+	Command            string
+}
+
+// cachedState returns the cached state of an attribute under its frontend cluster name ("OnOff")
+// or its chip-tool one ("onoff"), whichever was updated last.
+func cachedState(nodeID, endpointID, cluster, attribute string) (AttributeState, bool) {
+	state, ok := stateCache.Get(nodeID, endpointID, cluster, attribute)
+	if other, found := stateCache.Get(nodeID, endpointID, strings.ToLower(cluster), attribute); found && (!ok || other.UpdatedAt.After(state.UpdatedAt)) {
+		state, ok = other, true
+	}
+	return state, ok
+}
+
+// deviceValue returns the value of a cached state as the device reports it.
+func (s AttributeState) deviceValue() interface{} {
+	if s.RawValue != nil {
+		return s.RawValue
+	}
+	return s.Value
+}
+
+// expectedCommandState returns the state a command should lead to, for the commands whose effect is
+// known: OnOff On/Off/Toggle and LevelControl MoveToLevel(WithOnOff).
+func expectedCommandState(payload DeviceCommandPayload, endpointID string) (expectedState, bool) {
+	expected := expectedState{NodeID: payload.NodeID, EndpointID: endpointID, Cluster: payload.Cluster, Command: payload.Cluster + "." + payload.Command}
+	switch {
+	case strings.EqualFold(payload.Cluster, "OnOff"):
+		expected.Cluster, expected.Attribute = "OnOff", "on-off"
+		switch strings.ToLower(payload.Command) {
+		case "on":
+			expected.Value = true
+		case "off":
+			expected.Value = false
+		case "toggle":
+			state, ok := cachedState(payload.NodeID, endpointID, "OnOff", "on-off")
+			on, isBool := state.deviceValue().(bool)
+			if !ok || !isBool {
+				return expected, false
+			}
+			expected.Value = !on
+		default:
+			return expected, false
+		}
+	case strings.EqualFold(payload.Cluster, "LevelControl"):
+		expected.Cluster, expected.Attribute = "LevelControl", "current-level"
+		level, ok := toFloat(payload.Params["level"])
+		if !ok || (payload.Command != "MoveToLevel" && payload.Command != "MoveToLevelWithOnOff") {
+			return expected, false
+		}
+		expected.Value = level
+	default:
+		return expected, false
+	}
+	return expected, true
+}
+
+// sameValue compares attribute values, numbers by value whatever their Go type.
+func sameValue(a, b interface{}) bool {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+// pendingReconciliation is an optimistic update waiting for the device to confirm it.
+type pendingReconciliation struct {
+	expected expectedState
+	deadline time.Time
+}
+
+// CommandStates checks commands against the cached state and reconciles the optimistic updates
+// published after them with the confirmed state.
+type CommandStates struct {
+	mu      sync.Mutex
+	pending map[string]pendingReconciliation // By stateKey
+}
+
+// NewCommandStates creates a CommandStates with nothing pending.
+func NewCommandStates() *CommandStates {
+	return &CommandStates{pending: make(map[string]pendingReconciliation)}
+}
+
+// Precondition reports why a command can be skipped: with commandState.preconditions enabled, a
+// command that would leave a freshly cached attribute unchanged (On while on) is not sent, unless
+// the command has force set.
+func (c *CommandStates) Precondition(payload DeviceCommandPayload, endpointID string) (string, bool) {
+	cfg := appConfig.CommandState
+	if !cfg.Preconditions || payload.Force {
+		return "", false
+	}
+	expected, ok := expectedCommandState(payload, endpointID)
+	if !ok || strings.EqualFold(payload.Command, "toggle") {
+		return "", false
+	}
+	state, ok := cachedState(expected.NodeID, expected.EndpointID, expected.Cluster, expected.Attribute)
+	maxAge := time.Duration(defaultStateMaxAgeSeconds) * time.Second
+	if cfg.MaxAgeSeconds > 0 {
+		maxAge = time.Duration(cfg.MaxAgeSeconds) * time.Second
+	}
+	if !ok || time.Since(state.UpdatedAt) > maxAge || state.Source == sourceOptimistic || !sameValue(state.deviceValue(), expected.Value) {
+		return "", false
+	}
+	return fmt.Sprintf("%s not sent: %s.%s is already %v (set force to send it anyway)", expected.Command, expected.Cluster, expected.Attribute, state.Value), true
+}
+
+// Expect returns the state a command should lead to, to be passed to Apply once it succeeded.
+// It must be called before the command runs, as Toggle depends on the current state.
+func (c *CommandStates) Expect(payload DeviceCommandPayload, endpointID string) (expectedState, bool) {
+	return expectedCommandState(payload, endpointID)
+}
+
+// Apply records the state a successful command set, for the drift check (see drift.go). With
+// optimistic updates, it also publishes that state and waits for the confirmed one, which the
+// follow-up read (or a subscription report) delivers.
+func (c *CommandStates) Apply(client *Client, expected expectedState) {
+	driftMonitor.Commanded(expected)
+	if !appConfig.CommandState.OptimisticUpdates {
+		return
+	}
+	c.mu.Lock()
+	c.pending[stateKey(expected.NodeID, expected.EndpointID, expected.Cluster, expected.Attribute)] = pendingReconciliation{expected: expected, deadline: time.Now().Add(reconcileTimeout)}
+	c.mu.Unlock()
+	publishAttributeUpdate(client, AttributeUpdatePayload{
+		NodeID: expected.NodeID, EndpointID: expected.EndpointID, Cluster: expected.Cluster, Attribute: expected.Attribute,
+		Value: expected.Value, Source: sourceOptimistic,
+	})
+}
+
+// HandleAttributeUpdate compares a confirmed attribute update with the optimistic one awaiting it,
+// broadcasting a "state_correction" when they differ.
+func (c *CommandStates) HandleAttributeUpdate(update AttributeUpdatePayload) {
+	if update.Source == sourceOptimistic {
+		return
+	}
+	updateKey := stateKey(update.NodeID, update.EndpointID, update.Cluster, update.Attribute)
+	var p pendingReconciliation
+	found := false
+	now := time.Now()
+	c.mu.Lock()
+	for key, candidate := range c.pending {
+		switch {
+		case strings.EqualFold(key, updateKey): // The update may use the chip-tool cluster name
+			p, found = candidate, true
+			delete(c.pending, key)
+		case now.After(candidate.deadline):
+			log.Printf("No confirmed state for %s after %s, dropping its reconciliation", key, candidate.expected.Command)
+			delete(c.pending, key)
+		}
+	}
+	c.mu.Unlock()
+	if !found {
+		return
+	}
+	actual := update.Value
+	if update.RawValue != nil {
+		actual = update.RawValue
+	}
+	if sameValue(actual, p.expected.Value) {
+		return
+	}
+	log.Printf("State correction after %s on node %s EP%s: %s.%s is %v, not %v", p.expected.Command, update.NodeID, update.EndpointID, update.Cluster, update.Attribute, actual, p.expected.Value)
+	broadcastToClients("state_correction", StateCorrectionPayload{
+		NodeID: update.NodeID, EndpointID: update.EndpointID, Cluster: p.expected.Cluster, Attribute: p.expected.Attribute,
+		Expected: p.expected.Value, Actual: actual, Command: p.expected.Command,
+	})
+}
+
+var commandStates = NewCommandStates()
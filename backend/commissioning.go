@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxNodeLabelLength is the maximum length of BasicInformation.NodeLabel, in bytes.
+const maxNodeLabelLength = 32
+
+// writeBasicInformation writes a string attribute of the node's BasicInformation cluster (endpoint 0).
+func writeBasicInformation(nodeID, attribute, value string) error {
+	stdout, stderr, err := runChipTool("basicinformation", "write", attribute, value, nodeID, "0")
+	if chipToolFailed(stdout, stderr, err) {
+		return fmt.Errorf("writing BasicInformation.%s on node %s failed: %v %s", attribute, nodeID, err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// applyDeviceAssignment writes the friendly name (NodeLabel) and Location of a freshly commissioned
+// node and stores the name and room in the registry. Location is the ISO 3166-1 country code the
+// spec defines for BasicInformation.Location, so the room itself only lives in the registry.
+func applyDeviceAssignment(client *Client, nodeID, name, room, location string) {
+	if name == "" && room == "" && location == "" {
+		return
+	}
+	if name != "" {
+		label := name
+		if len(label) > maxNodeLabelLength {
+			n := maxNodeLabelLength
+			for n > 0 && !utf8.RuneStart(label[n]) { // Don't cut a multi-byte character in half
+				n--
+			}
+			label = label[:n]
+		}
+		if err := writeBasicInformation(nodeID, "node-label", label); err != nil {
+			log.Println(err)
+			client.notifyClientLog("commissioning_log", fmt.Sprintf("Could not write NodeLabel %q: %v", label, err))
+		} else {
+			client.notifyClientLog("commissioning_log", fmt.Sprintf("NodeLabel of Node %s set to %q.", nodeID, label))
+		}
+	}
+	if location != "" {
+		location = strings.ToUpper(location)
+		if len(location) != 2 {
+			client.notifyClientLog("commissioning_log", fmt.Sprintf("Ignoring location %q: expected a 2-letter country code.", location))
+		} else if err := writeBasicInformation(nodeID, "location", location); err != nil {
+			log.Println(err)
+			client.notifyClientLog("commissioning_log", fmt.Sprintf("Could not write Location %q: %v", location, err))
+		}
+	}
+	err := deviceRegistry.Update(nodeID, func(device *RegisteredDevice) {
+		if name != "" {
+			device.Name = name
+		}
+		if room != "" {
+			device.Room = room
+		}
+	})
+	if err != nil {
+		log.Printf("Could not store name/room of node %s: %v", nodeID, err)
+	}
+}
+
+// deviceTypeNames maps readable names usable in the configuration to Matter device type IDs.
+var deviceTypeNames = map[string]uint32{
+	"door_lock":               0x000A,
+	"window_covering":         0x0202,
+	"thermostat":              0x0301,
+	"fan":                     0x002B,
+	"on_off_light":            0x0100,
+	"dimmable_light":          0x0101,
+	"color_temperature_light": 0x010C,
+	"extended_color_light":    0x010D,
+	"on_off_plug_in_unit":     0x010A,
+	"dimmable_plug_in_unit":   0x010B,
+	"contact_sensor":          0x0015,
+	"occupancy_sensor":        0x0107,
+	"temperature_sensor":      0x0302,
+	"air_quality_sensor":      0x002C,
+	"generic_switch":          0x000F,
+	"robotic_vacuum_cleaner":  0x0074,
+	"aggregator":              aggregatorDeviceType,
+}
+
+// parseDeviceTypeKey resolves a configuration key (name or decimal/hex ID) to a device type ID.
+func parseDeviceTypeKey(key string) (uint32, bool) {
+	if id, ok := deviceTypeNames[strings.ToLower(key)]; ok {
+		return id, true
+	}
+	id, err := strconv.ParseUint(key, 0, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(id), true
+}
+
+// runSetupAction executes a single post-commissioning action on a node endpoint.
+func runSetupAction(client *Client, nodeID, endpointID string, action SetupAction) error {
+	if action.EndpointID != "" {
+		endpointID = action.EndpointID
+	}
+	switch action.Type {
+	case "write":
+		stdout, stderr, err := runChipTool(strings.ToLower(action.Cluster), "write", action.Attribute, action.Value, nodeID, endpointID)
+		if chipToolFailed(stdout, stderr, err) {
+			return fmt.Errorf("write %s.%s=%s failed: %v %s", action.Cluster, action.Attribute, action.Value, err, strings.TrimSpace(stderr))
+		}
+	case "command":
+		params := map[string]interface{}{}
+		for k, v := range action.Params {
+			params[k] = v
+		}
+		params["endpointId"] = endpointID
+		executeDeviceCommand(client, DeviceCommandPayload{NodeID: nodeID, Cluster: action.Cluster, Command: action.Command, Params: params})
+	case "subscribe":
+		minInterval, maxInterval := action.MinInterval, action.MaxInterval
+		if minInterval == "" {
+			minInterval = "1"
+		}
+		if maxInterval == "" {
+			maxInterval = "60"
+		}
+		go startAttributeSubscription(client, nodeID, endpointID, action.Cluster, action.Attribute, minInterval, maxInterval)
+	default:
+		return fmt.Errorf("unknown setup action type %q", action.Type)
+	}
+	return nil
+}
+
+// runPostCommissioningHooks runs the configured setup actions for a freshly commissioned node:
+// the "always" actions on its primary endpoint, then the per device type actions on every
+// endpoint advertising that device type (taken from the composition stored in the registry).
+func runPostCommissioningHooks(client *Client, nodeID, primaryEndpoint string) {
+	hooks := appConfig.PostCommissioning
+	run := func(endpointID string, actions []SetupAction, reason string) {
+		for _, action := range actions {
+			if err := runSetupAction(client, nodeID, endpointID, action); err != nil {
+				log.Printf("Post-commissioning action (%s) on node %s EP%s failed: %v", reason, nodeID, endpointID, err)
+				client.notifyClientLog("commissioning_log", fmt.Sprintf("Setup action %s %s.%s%s failed: %v", action.Type, action.Cluster, action.Attribute, action.Command, err))
+				continue
+			}
+			client.notifyClientLog("commissioning_log", fmt.Sprintf("Setup action (%s) %s %s.%s%s applied on EP%s.", reason, action.Type, action.Cluster, action.Attribute, action.Command, endpointID))
+		}
+	}
+
+	run(primaryEndpoint, hooks.Always, "always")
+	if len(hooks.ByDeviceType) == 0 {
+		return
+	}
+	device, ok := deviceRegistry.Get(nodeID)
+	if !ok {
+		return
+	}
+	for key, actions := range hooks.ByDeviceType {
+		deviceType, ok := parseDeviceTypeKey(key)
+		if !ok {
+			log.Printf("Ignoring post-commissioning hooks for unknown device type %q", key)
+			continue
+		}
+		for _, ep := range device.Endpoints {
+			if containsUint32(ep.DeviceTypes, deviceType) {
+				run(ep.EndpointID, actions, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"regexp"
+)
+
+// Error codes of recognized commissioning failures, set as the code of commissioning_status.
+const (
+	errCodeWrongPasscode        = "wrong_passcode"
+	errCodeAttestationFailed    = "attestation_failed"
+	errCodeNotCommissionable    = "not_in_commissioning_mode"
+	errCodeNetworkUnreachable   = "network_unreachable"
+	errCodeFabricTableFull      = "fabric_table_full"
+	errCodeCommissioningTimeout = "commissioning_timeout"
+)
+
+// commissioningFailure is a chip-tool output signature of a commissioning failure.
+type commissioningFailure struct {
+	code    string
+	pattern *regexp.Regexp
+	hint    string
+}
+
+// commissioningFailures are tried in order, so specific signatures come before the generic
+// timeout most failures end with.
+var commissioningFailures = []commissioningFailure{
+	{
+		code:    errCodeWrongPasscode,
+		pattern: regexp.MustCompile(`(?i)integrity check failed|invalid pase parameter|failed to verify peer's mac|spake2p.*(fail|error|invalid)`),
+		hint:    "The device rejected the setup code. Check the 11-digit manual code or QR code on the device or its packaging; after a factory reset or an opened window, use the new code.",
+	},
+	{
+		code:    errCodeAttestationFailed,
+		pattern: regexp.MustCompile(`(?i)attestation.*(fail|error|invalid|untrusted)|failed in verifying 'attestation`),
+		hint:    "The device's certificates couldn't be verified. Certified devices need the PAA roots in paa-root-certs; test devices need chip-tool's --bypass-attestation-verifier, or their test PAA added to the trust store.",
+	},
+	{
+		code:    errCodeFabricTableFull,
+		pattern: regexp.MustCompile(`(?i)table ?full|no free fabric`),
+		hint:    "The device has no free fabric slot: remove it from a controller it no longer needs (its app's \"remove\" or \"unlink\"), or factory reset it.",
+	},
+	{
+		code:    errCodeNetworkUnreachable,
+		pattern: regexp.MustCompile(`(?i)network is unreachable|no route to host|host is unreachable|posix error 0x000000(65|71)`),
+		hint:    "The device's address can't be reached from the gateway. Check that both are on the same network (VLANs and guest Wi-Fi often block it) and that IPv6 is enabled on the gateway's interface.",
+	},
+	{
+		code:    errCodeNotCommissionable,
+		pattern: regexp.MustCompile(`(?i)discovery timed out|no commissionable|failed to find.*commissionable|not in commissioning mode|commissioning window (is )?(closed|not open)`),
+		hint:    "The device isn't advertising for commissioning. Put it in pairing mode (usually a long press or a factory reset), or open a commissioning window from the controller it is paired with, then retry within its window.",
+	},
+	{
+		code:    errCodeCommissioningTimeout,
+		pattern: regexp.MustCompile(`(?i)0x00000032|timeout|timed out`),
+		hint:    "The device stopped answering. Make sure it is still in commissioning mode and powered, close to the gateway (Thread/Wi-Fi signal), then retry.",
+	},
+}
+
+// diagnoseCommissioningFailure classifies chip-tool output of a failed commissioning, returning
+// its error code and a remediation hint; both are empty for unrecognized failures.
+func diagnoseCommissioningFailure(output string) (code, hint string) {
+	output = stripAnsi(output)
+	for _, failure := range commissioningFailures {
+		if failure.pattern.MatchString(output) {
+			return failure.code, failure.hint
+		}
+	}
+	return "", ""
+}
+
+// withFailureDiagnosis fills in the code and hint of a failed commissioning status from the
+// chip-tool output.
+func (s CommissioningStatusPayload) withFailureDiagnosis(output string) CommissioningStatusPayload {
+	s.Code, s.Hint = diagnoseCommissioningFailure(output)
+	return s
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Commissioning window heuristics. A device opens a basic window (CM=1) on its own after power-up or
+// a factory reset, for at most 15 minutes. An enhanced window (CM=2) is opened by an administrator
+// with a timeout we don't know; 3 minutes is the minimum the spec allows and the common default.
+const (
+	basicWindowMax     = 15 * time.Minute
+	enhancedWindowMin  = 3 * time.Minute
+	windowExpiringSoon = time.Minute
+)
+
+// Commissioning window states reported in discovery results.
+const (
+	windowOpen     = "open"
+	windowExpiring = "expiring" // Open, but estimated to close within windowExpiringSoon
+	windowExpired  = "expired"  // Still advertised, but open for longer than the window usually lasts
+	windowClosed   = "closed"   // Advertised with CM=0: the device is not accepting commissioning
+)
+
+// CommissioningWindowStatus describes whether a discovered device can currently be commissioned.
+type CommissioningWindowStatus struct {
+	Status           string    `json:"status"`
+	Mode             string    `json:"mode,omitempty"` // "basic" or "enhanced"
+	FirstSeen        time.Time `json:"firstSeen"`      // First discovery since the window opened
+	RemainingSeconds *int      `json:"remainingSeconds,omitempty"`
+	Guidance         string    `json:"guidance,omitempty"`
+}
+
+// commissioningWindowGuidance is shown for devices whose window is closed or probably closed.
+const commissioningWindowGuidance = "The device's commissioning window appears closed. Factory-reset the device (or power-cycle it if it was never paired) to reopen it, or ask the current administrator to open a new window (e.g. chip-tool pairing open-commissioning-window)."
+
+// CommissioningWindowTracker remembers when each discovered device was first seen advertising,
+// to estimate how long its commissioning window stays open.
+type CommissioningWindowTracker struct {
+	mu        sync.Mutex
+	firstSeen map[string]time.Time                 // By discovered device ID
+	latest    map[string]CommissioningWindowStatus // By long discriminator, from the last discovery
+}
+
+// NewCommissioningWindowTracker creates an empty CommissioningWindowTracker.
+func NewCommissioningWindowTracker() *CommissioningWindowTracker {
+	return &CommissioningWindowTracker{firstSeen: make(map[string]time.Time), latest: make(map[string]CommissioningWindowStatus)}
+}
+
+// windowStatus estimates the window state of a device advertising mode cm since firstSeen.
+func windowStatus(cm uint8, firstSeen, now time.Time) CommissioningWindowStatus {
+	status := CommissioningWindowStatus{FirstSeen: firstSeen}
+	var maxOpen time.Duration
+	switch cm {
+	case 0:
+		status.Status = windowClosed
+		status.Guidance = commissioningWindowGuidance
+		return status
+	case 1:
+		status.Mode, maxOpen = "basic", basicWindowMax
+	default:
+		status.Mode, maxOpen = "enhanced", enhancedWindowMin
+	}
+	remaining := maxOpen - now.Sub(firstSeen)
+	switch {
+	case remaining <= 0:
+		status.Status = windowExpired
+		status.Guidance = commissioningWindowGuidance
+		remaining = 0
+	case remaining < windowExpiringSoon:
+		status.Status = windowExpiring
+	default:
+		status.Status = windowOpen
+	}
+	seconds := int(remaining.Seconds())
+	status.RemainingSeconds = &seconds
+	return status
+}
+
+// Annotate fills in the commissioning window status of discovered devices. Devices that are no
+// longer advertised are forgotten, so their window is timed again once they reappear.
+func (t *CommissioningWindowTracker) Annotate(devices []DiscoveredDevice) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seen := make(map[string]time.Time)
+	t.latest = make(map[string]CommissioningWindowStatus)
+	for i := range devices {
+		device := &devices[i]
+		first, ok := t.firstSeen[device.ID]
+		if !ok || device.CommissioningMode == 0 {
+			first = now
+		}
+		seen[device.ID] = first
+		status := windowStatus(device.CommissioningMode, first, now)
+		device.CommissioningWindow = &status
+		if device.Discriminator != "" {
+			t.latest[device.Discriminator] = status
+		}
+	}
+	t.firstSeen = seen
+}
+
+// Warning returns a warning for commissioning the device with the given long discriminator,
+// or "" when its window looked open in the last discovery (or the device wasn't discovered).
+func (t *CommissioningWindowTracker) Warning(discriminator string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status, ok := t.latest[discriminator]
+	if !ok || status.Guidance == "" {
+		return ""
+	}
+	return fmt.Sprintf("Commissioning window of discriminator %s is %s. %s", discriminator, status.Status, status.Guidance)
+}
+
+var commissioningWindows = NewCommissioningWindowTracker()
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SemanticTag is one entry of the Descriptor cluster's TagList (SemanticTagStruct).
+type SemanticTag struct {
+	MfgCode     *uint16 `json:"mfgCode,omitempty"` // Set for manufacturer specific namespaces
+	NamespaceID uint8   `json:"namespaceId"`
+	Tag         uint8   `json:"tag"`
+	Label       string  `json:"label,omitempty"`     // Optional label provided by the device
+	Namespace   string  `json:"namespace,omitempty"` // Readable namespace name, for standard namespaces
+	Name        string  `json:"name,omitempty"`      // Readable tag name, for standard namespaces
+}
+
+// EndpointInfo describes one endpoint of a composed device (e.g. each outlet of a dual plug).
+type EndpointInfo struct {
+	EndpointID  string        `json:"endpointId"`
+	DeviceTypes []uint32      `json:"deviceTypes,omitempty"`
+	Tags        []SemanticTag `json:"tags,omitempty"`
+	Label       string        `json:"label,omitempty"` // Name derived from the tags, e.g. "top" or "outlet 1"
+	// Capabilities are the features and attributes of the clusters whose commands depend on them
+	// (see capabilities.go), so the UI only offers what the endpoint supports
+	Capabilities []ClusterCapabilities `json:"capabilities,omitempty"`
+}
+
+// semanticNamespaces maps the common semantic tag namespaces to their name and tag names.
+var semanticNamespaces = map[uint8]struct {
+	name string
+	tags map[uint8]string
+}{
+	0x01: {"closure", map[uint8]string{0: "opening", 1: "closing", 2: "stop"}},
+	0x02: {"compass_direction", map[uint8]string{0: "north", 1: "north_east", 2: "east", 3: "south_east", 4: "south", 5: "south_west", 6: "west", 7: "north_west"}},
+	0x03: {"compass_location", map[uint8]string{0: "north", 1: "north_east", 2: "east", 3: "south_east", 4: "south", 5: "south_west", 6: "west", 7: "north_west"}},
+	0x04: {"direction", map[uint8]string{0: "upward", 1: "downward", 2: "leftward", 3: "rightward", 4: "forward", 5: "backward"}},
+	0x05: {"level", map[uint8]string{0: "low", 1: "medium", 2: "high"}},
+	0x06: {"location", map[uint8]string{0: "indoor", 1: "outdoor", 2: "inside", 3: "outside"}},
+	0x07: {"number", nil}, // Tag value is the number itself
+	0x08: {"position", map[uint8]string{0: "left", 1: "right", 2: "top", 3: "bottom", 4: "middle", 5: "row", 6: "column"}},
+}
+
+var (
+	reTagField = regexp.MustCompile(`\[TOO\]\s+(MfgCode|NamespaceID|Tag|Label):\s*(.*)$`)
+	reTagEnd   = regexp.MustCompile(`\[TOO\]\s+}`)
+)
+
+// describeTag fills in the readable namespace and tag names of a standard semantic tag.
+func describeTag(tag *SemanticTag) {
+	if tag.MfgCode != nil {
+		return
+	}
+	ns, ok := semanticNamespaces[tag.NamespaceID]
+	if !ok {
+		return
+	}
+	tag.Namespace = ns.name
+	if ns.tags == nil {
+		tag.Name = strconv.Itoa(int(tag.Tag))
+	} else if name, ok := ns.tags[tag.Tag]; ok {
+		tag.Name = name
+	}
+}
+
+// parseTagList parses the chip-tool output of "descriptor read tag-list".
+func parseTagList(output string) []SemanticTag {
+	var tags []SemanticTag
+	var current *SemanticTag
+	for _, line := range strings.Split(stripAnsi(output), "\n") {
+		if m := reTagField.FindStringSubmatch(line); len(m) == 3 {
+			if current == nil {
+				current = &SemanticTag{}
+			}
+			value := strings.TrimSpace(m[2])
+			switch m[1] {
+			case "MfgCode":
+				if v, err := strconv.ParseUint(value, 10, 16); err == nil {
+					code := uint16(v)
+					current.MfgCode = &code
+				}
+			case "NamespaceID":
+				if v, err := strconv.ParseUint(value, 10, 8); err == nil {
+					current.NamespaceID = uint8(v)
+				}
+			case "Tag":
+				if v, err := strconv.ParseUint(value, 10, 8); err == nil {
+					current.Tag = uint8(v)
+				}
+			case "Label":
+				if value != "null" {
+					current.Label = strings.Trim(value, `"`)
+				}
+			}
+			continue
+		}
+		if current != nil && reTagEnd.MatchString(line) {
+			describeTag(current)
+			tags = append(tags, *current)
+			current = nil
+		}
+	}
+	return tags
+}
+
+// endpointLabel builds a UI friendly name for an endpoint from its tags.
+// Device provided labels win, otherwise the standard tag names are joined ("top", "outlet 1", ...).
+func endpointLabel(tags []SemanticTag) string {
+	var parts []string
+	for _, tag := range tags {
+		switch {
+		case tag.Label != "":
+			return tag.Label
+		case tag.Namespace == "number":
+			parts = append(parts, "#"+tag.Name)
+		case tag.Name != "":
+			parts = append(parts, tag.Name)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// readTagList reads the Descriptor TagList of an endpoint. Devices without composed endpoints
+// usually don't implement it, which is reported as an empty list.
+func readTagList(nodeID, endpointID string) ([]SemanticTag, error) {
+	stdout, stderr, err := introspectionCache.DescriptorRead("tag-list", nodeID, endpointID)
+	if chipToolFailed(stdout, stderr, err) {
+		return nil, fmt.Errorf("descriptor read tag-list failed on node %s EP%s: %v %s", nodeID, endpointID, err, strings.TrimSpace(stderr))
+	}
+	return parseTagList(stdout), nil
+}
+
+// describeEndpoints reads the device types and semantic tags of every application endpoint of a node.
+func describeEndpoints(nodeID string) ([]EndpointInfo, error) {
+	parts, err := readDescriptorList(nodeID, "0", "parts-list")
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make([]EndpointInfo, 0, len(parts))
+	for _, part := range parts {
+		info := EndpointInfo{EndpointID: strconv.FormatUint(uint64(part), 10)}
+		if types, err := readDeviceTypes(nodeID, info.EndpointID); err == nil {
+			info.DeviceTypes = types
+		}
+		if containsUint32(info.DeviceTypes, aggregatorDeviceType) {
+			continue // Bridges are handled by enumerateBridgedDevices
+		}
+		tags, err := readTagList(nodeID, info.EndpointID)
+		if err != nil {
+			log.Printf("No TagList for node %s EP%s: %v", nodeID, info.EndpointID, err)
+		}
+		info.Tags = tags
+		info.Label = endpointLabel(tags)
+		if capabilities, err := endpointCapabilities(nodeID, info.EndpointID); err == nil {
+			info.Capabilities = capabilities
+		}
+		endpoints = append(endpoints, info)
+	}
+	return endpoints, nil
+}
+
+// refreshDeviceComposition stores the endpoint composition of a node in the registry and sends it to the client.
+func refreshDeviceComposition(client *Client, nodeID string) {
+	endpoints, err := describeEndpoints(nodeID)
+	if err != nil {
+		log.Printf("Could not describe endpoints of node %s: %v", nodeID, err)
+		client.sendPayload("device_endpoints", DeviceEndpointsPayload{NodeID: nodeID, Error: err.Error()})
+		return
+	}
+	if err := deviceRegistry.Update(nodeID, func(device *RegisteredDevice) { device.Endpoints = endpoints }); err != nil {
+		log.Printf("Endpoints of node %s not stored: %v", nodeID, err)
+	}
+	client.sendPayload("device_endpoints", DeviceEndpointsPayload{NodeID: nodeID, Endpoints: endpoints})
+}
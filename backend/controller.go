@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	controllerChipTool     = "chip-tool"
+	controllerMatterServer = "matter-server"
+
+	defaultMatterServerURL     = "ws://localhost:5580/ws"
+	matterServerRequestTimeout = 30 * time.Second
+)
+
+// Controller performs the most common operations on commissioned nodes. The default runs one
+// chip-tool process per operation and scrapes its output; the matter-server one keeps a single
+// WebSocket connection to a python-matter-server (the one Home Assistant uses), which holds the
+// CASE sessions open and answers in JSON. Commissioning, discovery and subscriptions always use chip-tool.
+// The nodes must be on the matter-server's fabric, e.g. shared to it with chip-tool's
+// "pairing open-commissioning-window". There is no cgo binding to the Matter SDK: it would need the
+// SDK built for each target and tie the backend to one SDK version.
+type Controller interface {
+	Name() string
+	// ReadAttribute returns the value of an attribute, named like chip-tool does ("onoff", "on-off").
+	ReadAttribute(nodeID, endpointID, cluster, attribute string) (interface{}, error)
+	// InvokeCommand sends a cluster command, e.g. LevelControl MoveToLevel {"level": 128}.
+	InvokeCommand(nodeID, endpointID, cluster, command string, params map[string]interface{}) error
+}
+
+// newController returns the controller selected by the configuration.
+func newController(cfg ControllerConfig) (Controller, error) {
+	switch cfg.Type {
+	case "", controllerChipTool:
+		return chipToolController{}, nil
+	case controllerMatterServer:
+		if !featureFlags.Enabled(featureNativeController) {
+			return nil, fmt.Errorf("the %s controller is disabled by the %s feature flag", controllerMatterServer, featureNativeController)
+		}
+		url := cfg.URL
+		if url == "" {
+			url = defaultMatterServerURL
+		}
+		return &matterServerController{url: url, pending: make(map[string]chan matterServerResponse)}, nil
+	}
+	return nil, fmt.Errorf("unknown controller type %q (want %q or %q)", cfg.Type, controllerChipTool, controllerMatterServer)
+}
+
+// usesChipTool reports whether device commands run through chip-tool, with its per-cluster argument handling.
+func usesChipTool() bool {
+	_, ok := controller.(chipToolController)
+	return ok
+}
+
+// chipToolController is the default controller: a chip-tool run per operation.
+type chipToolController struct{}
+
+func (chipToolController) Name() string { return controllerChipTool }
+
+func (chipToolController) ReadAttribute(nodeID, endpointID, cluster, attribute string) (interface{}, error) {
+	stdout, stderr, err := runChipTool(strings.ToLower(cluster), "read", attribute, nodeID, endpointID)
+	if chipToolFailed(stdout, stderr, err) {
+		return nil, fmt.Errorf("reading %s.%s on node %s EP%s failed: %v %s", cluster, attribute, nodeID, endpointID, err, strings.TrimSpace(stderr))
+	}
+	value, ok := parseReadValue(stdout)
+	if !ok {
+		return nil, fmt.Errorf("could not parse %s.%s from chip-tool output", cluster, attribute)
+	}
+	return value, nil
+}
+
+func (chipToolController) InvokeCommand(nodeID, endpointID, cluster, command string, params map[string]interface{}) error {
+	args, err := chipToolCommandArgs(cluster, command, params)
+	if err != nil {
+		return err
+	}
+	stdout, stderr, err := runChipTool(append(args, nodeID, endpointID)...)
+	if chipToolFailed(stdout, stderr, err) {
+		return fmt.Errorf("%s.%s on node %s EP%s failed: %v %s", cluster, command, nodeID, endpointID, err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// chipToolCommandFields lists the fields of commands taking several arguments, in chip-tool's
+// positional order. Missing transitionTime/options fields are sent as 0.
+var chipToolCommandFields = map[string][]string{
+	"levelcontrol/move-to-level":              {"level", "transitionTime", "optionsMask", "optionsOverride"},
+	"levelcontrol/move-to-level-with-on-off":  {"level", "transitionTime", "optionsMask", "optionsOverride"},
+	"colorcontrol/move-to-hue":                {"hue", "direction", "transitionTime", "optionsMask", "optionsOverride"},
+	"colorcontrol/move-to-saturation":         {"saturation", "transitionTime", "optionsMask", "optionsOverride"},
+	"colorcontrol/move-to-hue-and-saturation": {"hue", "saturation", "transitionTime", "optionsMask", "optionsOverride"},
+	"colorcontrol/move-to-color-temperature":  {"colorTemperatureMireds", "transitionTime", "optionsMask", "optionsOverride"},
+	"timesynchronization/set-utctime":         {"UTCTime", "granularity"},
+	"levelcontrol/stop":                       {"optionsMask", "optionsOverride"},
+	"colorcontrol/stop-move-step":             {"optionsMask", "optionsOverride"},
+}
+
+// chipToolCommandArgs builds the chip-tool arguments of a command from its named fields.
+// The "endpointId" param selects the endpoint and isn't a command field. Struct and list fields
+// are passed as JSON, as chip-tool expects them.
+func chipToolCommandArgs(cluster, command string, params map[string]interface{}) ([]string, error) {
+	cluster, command = strings.ToLower(cluster), toKebabCase(command)
+	fields := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		if k != "endpointId" {
+			fields[k] = v
+		}
+	}
+	args := []string{cluster, command}
+	order, known := chipToolCommandFields[cluster+"/"+command]
+	if !known {
+		if len(fields) > 1 {
+			return nil, fmt.Errorf("the argument order of %s %s is unknown; send at most one field", cluster, command)
+		}
+		for _, v := range fields {
+			args = append(args, chipToolArgument(v))
+		}
+		return args, nil
+	}
+	for _, field := range order {
+		v, ok := fields[field]
+		if !ok {
+			if field != "transitionTime" && !strings.HasPrefix(field, "options") {
+				return nil, fmt.Errorf("missing %q field for %s %s", field, cluster, command)
+			}
+			v = 0
+		}
+		args = append(args, chipToolArgument(v))
+	}
+	return args, nil
+}
+
+// chipToolArgument formats a command field: JSON for structs and lists, the value itself otherwise.
+func chipToolArgument(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}, []map[string]interface{}:
+		if data, err := json.Marshal(v); err == nil {
+			return string(data)
+		}
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// matterServerResponse is a python-matter-server reply to one of our commands.
+type matterServerResponse struct {
+	MessageID string      `json:"message_id"`
+	Result    interface{} `json:"result"`
+	ErrorCode *int        `json:"error_code"`
+	Details   string      `json:"details"`
+}
+
+// matterServerController talks to python-matter-server over its WebSocket API. The connection is
+// dialed on first use and again after it drops.
+type matterServerController struct {
+	url string
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+	pending map[string]chan matterServerResponse
+	lastID  int64
+}
+
+func (m *matterServerController) Name() string { return controllerMatterServer }
+
+func (m *matterServerController) ReadAttribute(nodeID, endpointID, cluster, attribute string) (interface{}, error) {
+	node, err := parseMatterNodeID(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	path, err := matterAttributePath(endpointID, cluster, attribute)
+	if err != nil {
+		return nil, err
+	}
+	result, err := m.call("read_attribute", map[string]interface{}{"node_id": node, "attribute_path": path})
+	if err != nil {
+		return nil, fmt.Errorf("reading %s.%s on node %s EP%s failed: %v", cluster, attribute, nodeID, endpointID, err)
+	}
+	// Newer servers answer with {"<path>": value}, older ones with the bare value
+	if values, ok := result.(map[string]interface{}); ok {
+		if value, found := values[path]; found {
+			return value, nil
+		}
+	}
+	return result, nil
+}
+
+func (m *matterServerController) InvokeCommand(nodeID, endpointID, cluster, command string, params map[string]interface{}) error {
+	node, err := parseMatterNodeID(nodeID)
+	if err != nil {
+		return err
+	}
+	info, ok := lookupMatterCluster(cluster)
+	if !ok {
+		return fmt.Errorf("cluster %q is not known to the matter-server controller", cluster)
+	}
+	endpoint, err := strconv.Atoi(endpointID)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q", endpointID)
+	}
+	payload := map[string]interface{}{}
+	for k, v := range params {
+		if k != "endpointId" {
+			payload[k] = v
+		}
+	}
+	_, err = m.call("device_command", map[string]interface{}{
+		"node_id":      node,
+		"endpoint_id":  endpoint,
+		"cluster_id":   info.ID,
+		"command_name": toPascalCase(command),
+		"payload":      payload,
+	})
+	if err != nil {
+		return fmt.Errorf("%s.%s on node %s EP%s failed: %v", cluster, command, nodeID, endpointID, err)
+	}
+	return nil
+}
+
+// call sends a command and waits for its response.
+func (m *matterServerController) call(command string, args map[string]interface{}) (interface{}, error) {
+	conn, err := m.connect()
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.lastID++
+	id := strconv.FormatInt(m.lastID, 10)
+	reply := make(chan matterServerResponse, 1)
+	m.pending[id] = reply
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.pending, id)
+		m.mu.Unlock()
+	}()
+
+	m.writeMu.Lock()
+	_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+	err = conn.WriteJSON(map[string]interface{}{"message_id": id, "command": command, "args": args})
+	m.writeMu.Unlock()
+	if err != nil {
+		m.drop(conn)
+		return nil, fmt.Errorf("matter-server: %v", err)
+	}
+
+	select {
+	case resp, ok := <-reply:
+		if !ok {
+			return nil, errors.New("matter-server: connection lost")
+		}
+		if resp.ErrorCode != nil {
+			return nil, fmt.Errorf("matter-server error %d: %s", *resp.ErrorCode, resp.Details)
+		}
+		return resp.Result, nil
+	case <-time.After(matterServerRequestTimeout):
+		return nil, fmt.Errorf("matter-server: no response to %s within %v", command, matterServerRequestTimeout)
+	}
+}
+
+// connect returns the open connection, dialing the server if there is none.
+func (m *matterServerController) connect() (*websocket.Conn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn != nil {
+		return m.conn, nil
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(m.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("matter-server: cannot connect to %s: %v", m.url, err)
+	}
+	// The server greets with its server info before answering commands
+	var info struct {
+		SchemaVersion int    `json:"schema_version"`
+		SDKVersion    string `json:"sdk_version"`
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(matterServerRequestTimeout))
+	if err := conn.ReadJSON(&info); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("matter-server: no server info from %s: %v", m.url, err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	log.Printf("Connected to matter-server %s (schema %d, SDK %s)", m.url, info.SchemaVersion, info.SDKVersion)
+	m.conn = conn
+	go m.readLoop(conn)
+	return conn, nil
+}
+
+// readLoop hands responses to their callers until the connection fails. Events the server
+// pushes (no message_id of ours) are ignored.
+func (m *matterServerController) readLoop(conn *websocket.Conn) {
+	for {
+		var resp matterServerResponse
+		if err := conn.ReadJSON(&resp); err != nil {
+			log.Printf("matter-server connection to %s lost: %v", m.url, err)
+			m.drop(conn)
+			return
+		}
+		m.mu.Lock()
+		reply, ok := m.pending[resp.MessageID]
+		m.mu.Unlock()
+		if ok {
+			reply <- resp
+		}
+	}
+}
+
+// drop closes a failed connection and fails the requests waiting on it.
+func (m *matterServerController) drop(conn *websocket.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn != conn {
+		return
+	}
+	conn.Close()
+	m.conn = nil
+	for id, reply := range m.pending {
+		close(reply)
+		delete(m.pending, id)
+	}
+}
+
+// parseMatterNodeID converts a node ID ("1", "0x1A") to the number python-matter-server expects.
+func parseMatterNodeID(nodeID string) (uint64, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(nodeID), 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid node ID %q", nodeID)
+	}
+	return n, nil
+}
+
+// matterClusterInfo is the ID of a cluster and of the attributes we address by name.
+type matterClusterInfo struct {
+	ID         uint32
+	Attributes map[string]uint32 // chip-tool attribute names, e.g. "measured-value"
+}
+
+// matterClusters maps chip-tool cluster names to their IDs, for controllers addressing clusters
+// and attributes by number. Numeric names ("0x0006", "6") work for anything missing here.
+var matterClusters = map[string]matterClusterInfo{
+	"onoff":        {0x0006, map[string]uint32{"on-off": 0x0000}},
+	"levelcontrol": {0x0008, map[string]uint32{"current-level": 0x0000, "min-level": 0x0002, "max-level": 0x0003}},
+	"descriptor":   {0x001D, map[string]uint32{"device-type-list": 0x0000, "server-list": 0x0001, "client-list": 0x0002, "parts-list": 0x0003}},
+	"basicinformation": {0x0028, map[string]uint32{
+		"vendor-name": 0x0001, "vendor-id": 0x0002, "product-name": 0x0003, "product-id": 0x0004, "node-label": 0x0005,
+		"hardware-version": 0x0007, "software-version": 0x0009, "software-version-string": 0x000A, "serial-number": 0x000F,
+	}},
+	"powersource": {0x002F, map[string]uint32{"status": 0x0000, "bat-voltage": 0x000B, "bat-percent-remaining": 0x000C, "bat-charge-level": 0x000E}},
+	"timesynchronization": {0x0038, map[string]uint32{
+		"utctime": 0x0000, "granularity": 0x0001, "time-source": 0x0002, "time-zone": 0x0005, "dstoffset": 0x0006,
+		"local-time": 0x0007, "feature-map": 0xFFFC,
+	}},
+	"booleanstate":                {0x0045, map[string]uint32{"state-value": 0x0000}},
+	"rvcrunmode":                  {0x0054, map[string]uint32{"supported-modes": 0x0000, "current-mode": 0x0001}},
+	"rvccleanmode":                {0x0055, map[string]uint32{"supported-modes": 0x0000, "current-mode": 0x0001}},
+	"rvcoperationalstate":         {0x0061, map[string]uint32{"operational-state": 0x0004, "operational-error": 0x0005}},
+	"doorlock":                    {0x0101, map[string]uint32{"lock-state": 0x0000, "lock-type": 0x0001}},
+	"colorcontrol":                {0x0300, map[string]uint32{"current-hue": 0x0000, "current-saturation": 0x0001, "color-temperature-mireds": 0x0007}},
+	"temperaturemeasurement":      {0x0402, map[string]uint32{"measured-value": 0x0000}},
+	"relativehumiditymeasurement": {0x0405, map[string]uint32{"measured-value": 0x0000}},
+	"occupancysensing":            {0x0406, map[string]uint32{"occupancy": 0x0000}},
+}
+
+// lookupMatterCluster finds a cluster by chip-tool or PascalCase name ("OnOff") or by number.
+func lookupMatterCluster(name string) (matterClusterInfo, bool) {
+	if info, ok := matterClusters[strings.ToLower(name)]; ok {
+		return info, true
+	}
+	if id, err := strconv.ParseUint(name, 0, 32); err == nil {
+		return matterClusterInfo{ID: uint32(id)}, true
+	}
+	return matterClusterInfo{}, false
+}
+
+// matterClusterName returns the chip-tool name of a cluster ID from matterClusters.
+func matterClusterName(id uint32) (string, bool) {
+	for name, info := range matterClusters {
+		if info.ID == id {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// matterAttributeName returns the chip-tool name of an attribute ID of a cluster in matterClusters.
+func matterAttributeName(cluster string, id uint32) (string, bool) {
+	for name, attrID := range matterClusters[cluster].Attributes {
+		if attrID == id {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// matterAttributePath builds python-matter-server's "endpoint/cluster/attribute" path.
+func matterAttributePath(endpointID, cluster, attribute string) (string, error) {
+	info, ok := lookupMatterCluster(cluster)
+	if !ok {
+		return "", fmt.Errorf("cluster %q is not known to the matter-server controller", cluster)
+	}
+	attrID, ok := info.Attributes[toKebabCase(attribute)]
+	if !ok {
+		id, err := strconv.ParseUint(attribute, 0, 32)
+		if err != nil {
+			return "", fmt.Errorf("attribute %s.%s is not known to the matter-server controller", cluster, attribute)
+		}
+		attrID = uint32(id)
+	}
+	return fmt.Sprintf("%s/%d/%d", endpointID, info.ID, attrID), nil
+}
+
+// toKebabCase turns "MoveToLevel" into chip-tool's "move-to-level"; kebab-case names are kept.
+// Acronyms stay in one word, as in chip-tool: "SetUTCTime" is "set-utctime".
+func toKebabCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 && (name[i-1] >= 'a' && name[i-1] <= 'z' || name[i-1] >= '0' && name[i-1] <= '9') {
+				b.WriteByte('-')
+			}
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// toPascalCase turns chip-tool's "move-to-level" into the spec's "MoveToLevel"; "On" is kept.
+func toPascalCase(name string) string {
+	parts := strings.Split(name, "-")
+	for i, p := range parts {
+		if p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// controller is the controller in use, replaced once at startup from the configuration.
+var controller Controller = chipToolController{}
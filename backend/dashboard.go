@@ -0,0 +1,169 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// recentAlertsOnDashboard is how many past alerts the dashboard includes.
+const recentAlertsOnDashboard = 10
+
+// quickStateAttributes are the attributes shown for favorite devices on the dashboard, when cached.
+var quickStateAttributes = []string{
+	"OnOff/on-off",
+	"LevelControl/current-level",
+	"TemperatureMeasurement/measured-value",
+	"RelativeHumidityMeasurement/measured-value",
+	"OccupancySensing/occupancy",
+	"BooleanState/state-value",
+	"WindowCovering/current-position-lift-percent100ths",
+	"DoorLock/lock-state",
+	"Thermostat/local-temperature",
+}
+
+// DashboardCounts summarises the devices and the backend activity.
+type DashboardCounts struct {
+	Devices             int `json:"devices"`
+	Online              int `json:"online"`
+	Offline             int `json:"offline"`
+	Degraded            int `json:"degraded"` // Flagged by the health thresholds
+	LowBattery          int `json:"lowBattery"`
+	ActiveSubscriptions int `json:"activeSubscriptions"`
+	ActiveAlerts        int `json:"activeAlerts"`
+}
+
+// RoomSummary summarises the devices of a room. Devices without a room are under "".
+type RoomSummary struct {
+	Room    string   `json:"room"`
+	Devices int      `json:"devices"`
+	Online  int      `json:"online"`
+	On      int      `json:"on"`                    // Devices whose OnOff attribute is cached as on
+	Alerts  int      `json:"alerts"`                // Active alerts on devices of the room
+	Temp    *float64 `json:"temperature,omitempty"` // Average cached temperature, in °C
+}
+
+// FavoriteState is the quick state of a favorite device: its cached values of quickStateAttributes.
+type FavoriteState struct {
+	DeviceID  string                 `json:"deviceId"`
+	Name      string                 `json:"name,omitempty"`
+	Room      string                 `json:"room,omitempty"`
+	Reachable bool                   `json:"reachable"`
+	State     map[string]interface{} `json:"state"` // By "Cluster/attribute"
+	Battery   *BatteryStatus         `json:"battery,omitempty"`
+}
+
+// DashboardPayload is everything the frontend needs on load, from GET /api/dashboard or "get_dashboard".
+type DashboardPayload struct {
+	Counts       DashboardCounts `json:"counts"`
+	Rooms        []RoomSummary   `json:"rooms"`
+	Favorites    []FavoriteState `json:"favorites"`
+	ActiveAlerts []Alert         `json:"activeAlerts"`
+	RecentAlerts []Alert         `json:"recentAlerts"` // Latest raised/cleared alerts, most recent first
+	GeneratedAt  time.Time       `json:"generatedAt"`
+}
+
+// withoutGenerationTime returns the dashboard with a zero GeneratedAt, to compare its content.
+func (d DashboardPayload) withoutGenerationTime() DashboardPayload {
+	d.GeneratedAt = time.Time{}
+	return d
+}
+
+// buildDashboard computes the dashboard from the registry, the state cache and the alert engine,
+// without talking to any device.
+func buildDashboard() DashboardPayload {
+	devices := deviceRegistry.List()
+	active := alertEngine.Active()
+	dashboard := DashboardPayload{
+		Rooms:        []RoomSummary{},
+		Favorites:    []FavoriteState{},
+		ActiveAlerts: active,
+		GeneratedAt:  time.Now(),
+	}
+	dashboard.Counts.Devices = len(devices)
+	dashboard.Counts.ActiveSubscriptions = subscriptions.Total()
+	dashboard.Counts.ActiveAlerts = len(active)
+
+	history := alertEngine.History()
+	for i := len(history) - 1; i >= 0 && len(dashboard.RecentAlerts) < recentAlertsOnDashboard; i-- {
+		dashboard.RecentAlerts = append(dashboard.RecentAlerts, history[i])
+	}
+	if dashboard.RecentAlerts == nil {
+		dashboard.RecentAlerts = []Alert{}
+	}
+
+	rooms := make(map[string]*RoomSummary)
+	temps := make(map[string][]float64)
+	for _, device := range devices {
+		if device.Reachable {
+			dashboard.Counts.Online++
+		} else {
+			dashboard.Counts.Offline++
+		}
+		if device.Health == "degraded" {
+			dashboard.Counts.Degraded++
+		}
+		if device.Battery != nil && device.Battery.Percent != nil && *device.Battery.Percent < float64(lowBatteryThreshold()) {
+			dashboard.Counts.LowBattery++
+		}
+
+		room, ok := rooms[device.Room]
+		if !ok {
+			room = &RoomSummary{Room: device.Room}
+			rooms[device.Room] = room
+		}
+		room.Devices++
+		if device.Reachable {
+			room.Online++
+		}
+		if state, ok := stateCache.Get(device.NodeID, device.EndpointID, "OnOff", "on-off"); ok && state.Value == true {
+			room.On++
+		}
+		if state, ok := stateCache.Get(device.NodeID, device.EndpointID, "TemperatureMeasurement", "measured-value"); ok {
+			if t, ok := toFloat(state.Value); ok {
+				temps[device.Room] = append(temps[device.Room], t)
+			}
+		}
+		for _, alert := range active {
+			if sameNodeID(alert.NodeID, device.NodeID) && (device.BridgeID == "" || alert.EndpointID == device.EndpointID) {
+				room.Alerts++
+			}
+		}
+
+		if device.Favorite {
+			dashboard.Favorites = append(dashboard.Favorites, favoriteState(device))
+		}
+	}
+	for name, room := range rooms {
+		if values := temps[name]; len(values) > 0 {
+			sum := 0.0
+			for _, v := range values {
+				sum += v
+			}
+			avg := sum / float64(len(values))
+			room.Temp = &avg
+		}
+		dashboard.Rooms = append(dashboard.Rooms, *room)
+	}
+	sort.Slice(dashboard.Rooms, func(i, j int) bool { return dashboard.Rooms[i].Room < dashboard.Rooms[j].Room })
+	return dashboard
+}
+
+// favoriteState collects the cached quick state of a device.
+func favoriteState(device RegisteredDevice) FavoriteState {
+	fav := FavoriteState{
+		DeviceID:  device.ID,
+		Name:      device.Name,
+		Room:      device.Room,
+		Reachable: device.Reachable,
+		State:     make(map[string]interface{}),
+		Battery:   device.Battery,
+	}
+	for _, key := range quickStateAttributes {
+		cluster, attribute, _ := strings.Cut(key, "/")
+		if state, ok := stateCache.Get(device.NodeID, device.EndpointID, cluster, attribute); ok {
+			fav.State[key] = state.Value
+		}
+	}
+	return fav
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var dataDirFlag = flag.String("data-dir", "", "directory for the backend's state files (default: chosen from how the backend runs)")
+
+// System locations used when the backend runs as root, e.g. as a systemd service installed by a package.
+const (
+	systemDataDir = "/var/lib/matter-backend"
+	systemLogDir  = "/var/log/matter-backend"
+)
+
+// appName names the backend's directories under the XDG base directories.
+const appName = "matter-backend"
+
+// logFileName is the log file written in the log directory, in addition to stderr.
+const logFileName = "backend.log"
+
+// dataDir and logDir are the directories in use, set by initDataDirs at startup.
+var (
+	dataDir string
+	logDir  string
+)
+
+// stateFiles are the files the backend keeps in dataDir, migrated from the working directory of older versions.
+var stateFiles = []string{devicesFile, rulesFile, pollingFile, alertRulesFile, alertHistoryFile}
+
+// defaultDirs picks the data and log directories from how the binary runs:
+//   - -data-dir, or MATTER_BACKEND_DATA_DIR, wins (logs go to its "logs" subdirectory);
+//   - inside a snap, $SNAP_DATA for the root service and $SNAP_USER_DATA for users;
+//   - as root, /var/lib/matter-backend and /var/log/matter-backend;
+//   - otherwise the XDG directories: $XDG_DATA_HOME/matter-backend and $XDG_STATE_HOME/matter-backend.
+func defaultDirs() (string, string, error) {
+	if dir := *dataDirFlag; dir != "" {
+		return dir, filepath.Join(dir, "logs"), nil
+	}
+	if dir := os.Getenv("MATTER_BACKEND_DATA_DIR"); dir != "" {
+		return dir, filepath.Join(dir, "logs"), nil
+	}
+	if os.Getenv("SNAP") != "" {
+		dir := os.Getenv("SNAP_USER_DATA")
+		if os.Geteuid() == 0 {
+			dir = os.Getenv("SNAP_DATA")
+		}
+		if dir != "" {
+			return dir, filepath.Join(dir, "logs"), nil
+		}
+	}
+	if os.Geteuid() == 0 {
+		return systemDataDir, systemLogDir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", err
+	}
+	data := os.Getenv("XDG_DATA_HOME")
+	if data == "" {
+		data = filepath.Join(home, ".local", "share")
+	}
+	state := os.Getenv("XDG_STATE_HOME")
+	if state == "" {
+		state = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(data, appName), filepath.Join(state, appName), nil
+}
+
+// initDataDirs selects and creates the data and log directories, moves state files left in the
+// working directory by older versions and starts writing the log file. When no directory can be
+// used, the working directory is kept, as before.
+func initDataDirs() {
+	data, logs, err := defaultDirs()
+	if err == nil {
+		err = os.MkdirAll(data, 0o755)
+	}
+	if err != nil {
+		log.Printf("WARNING: no usable data directory (%v), keeping state in the working directory", err)
+		dataDir = "."
+		return
+	}
+	dataDir = data
+	log.Printf("Data directory: %s", dataDir)
+	migrateStateFiles()
+
+	if err := os.MkdirAll(logs, 0o755); err != nil {
+		log.Printf("WARNING: could not create log directory %s, logging to stderr only: %v", logs, err)
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(logs, logFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		log.Printf("WARNING: could not open log file, logging to stderr only: %v", err)
+		return
+	}
+	logDir = logs
+	log.SetOutput(io.MultiWriter(os.Stderr, f))
+	log.Printf("Logging to %s", f.Name())
+}
+
+// migrateStateFiles copies state files from the working directory into dataDir when dataDir has none yet.
+// The originals are left in place.
+func migrateStateFiles() {
+	for _, name := range stateFiles {
+		target := filepath.Join(dataDir, name)
+		if _, err := os.Stat(target); err == nil {
+			continue
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		if err := os.WriteFile(target, data, 0o644); err != nil {
+			log.Printf("WARNING: could not move %s to the data directory: %v", name, err)
+			continue
+		}
+		log.Printf("Copied %s from the working directory to %s", name, target)
+	}
+}
+
+// dataFilePath resolves a state file name against dataDir. Absolute paths are kept.
+func dataFilePath(path string) string {
+	if filepath.IsAbs(path) || dataDir == "" {
+		return path
+	}
+	return filepath.Join(dataDir, path)
+}
+
+// chipToolStorageDir returns the chip-tool storage directory passed to every chip-tool run: the
+// chipToolStorageDir config, or the "chip-tool" directory in dataDir when a package created it.
+// Empty means chip-tool's own default (/tmp).
+func chipToolStorageDir() string {
+	if appConfig.ChipToolStorageDir != "" {
+		return appConfig.ChipToolStorageDir
+	}
+	if dataDir == "" {
+		return ""
+	}
+	dir := filepath.Join(dataDir, "chip-tool")
+	if stat, err := os.Stat(dir); err == nil && stat.IsDir() {
+		return dir
+	}
+	return ""
+}
+
+// withChipToolStorage appends --storage-directory to chip-tool arguments, unless the request
+// already selected a storage directory.
+func withChipToolStorage(args []string) []string {
+	dir := chipToolStorageDir()
+	if dir == "" || containsString(args, "--storage-directory") {
+		return args
+	}
+	return append(args, "--storage-directory", dir)
+}
+
+// describeDataDirs summarises the directories in use, for the status endpoint.
+func describeDataDirs() map[string]string {
+	dirs := map[string]string{"data": dataDir, "logs": logDir, "chipToolStorage": chipToolStorageDir()}
+	if dirs["chipToolStorage"] == "" {
+		dirs["chipToolStorage"] = fmt.Sprintf("chip-tool default (%s)", os.TempDir())
+	}
+	return dirs
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sourceSubscription marks the attribute updates delivered by a subscription report.
+const sourceSubscription = "subscription"
+
+// debounceState is what the debouncer knows of one attribute.
+type debounceState struct {
+	last          interface{} // Last published value, as reported by the device
+	lastValue     interface{} // Last published value, normalised (see transform.go)
+	lastChange    time.Time   // When the last published change was published
+	pending       *AttributeUpdatePayload
+	pendingClient *Client
+	timer         *time.Timer
+	hold          int // Counts the held changes, so a stale timer doesn't flush a newer one
+}
+
+// AttributeDebouncer smooths the reports of attributes before they reach the state cache, the
+// clients, the history and the automations, following the debounce rules of the config and the
+// minChange of subscriptions. With dedup, a report repeating the last published value is dropped.
+// With a minChange, a numeric report differing by less than that from the last published value
+// is dropped. With minIntervalMs, a change coming sooner than that after the last published one
+// is held, and only the latest held value is published once the interval elapsed; a value
+// flapping back to the published one within the interval is dropped altogether. Only
+// subscription reports and polls are debounced: reads and optimistic updates always go through,
+// as a client is waiting for them; a read also cancels a held report.
+type AttributeDebouncer struct {
+	mu         sync.Mutex
+	states     map[string]*debounceState // By stateKey, with the cluster in lower case
+	minChanges map[string]float64        // Reportable change of subscribed attributes, by the same key
+}
+
+// NewAttributeDebouncer creates an AttributeDebouncer with no state.
+func NewAttributeDebouncer() *AttributeDebouncer {
+	return &AttributeDebouncer{states: make(map[string]*debounceState), minChanges: make(map[string]float64)}
+}
+
+// deviceValue returns the value of an update as the device reports it.
+func (u AttributeUpdatePayload) deviceValue() interface{} {
+	if u.RawValue != nil {
+		return u.RawValue
+	}
+	return u.Value
+}
+
+// debounceRuleFor returns the first debounce rule matching an update.
+func debounceRuleFor(update AttributeUpdatePayload) (DebounceRule, bool) {
+	for _, rule := range appConfig.Debounce {
+		if strings.EqualFold(rule.Cluster, update.Cluster) && rule.Attribute == update.Attribute &&
+			(rule.NodeID == "" || rule.NodeID == update.NodeID) && (rule.EndpointID == "" || rule.EndpointID == update.EndpointID) {
+			return rule, true
+		}
+	}
+	return DebounceRule{}, false
+}
+
+// debounceKey is the key of an attribute in the debouncer.
+func debounceKey(nodeID, endpointID, cluster, attribute string) string {
+	return stateKey(nodeID, endpointID, strings.ToLower(cluster), attribute)
+}
+
+// SetMinChange sets the reportable change of an attribute, in its normalised unit: reports
+// closer than that to the last published value are dropped. Zero removes it.
+func (d *AttributeDebouncer) SetMinChange(nodeID, endpointID, cluster, attribute string, minChange float64) {
+	key := debounceKey(nodeID, endpointID, cluster, attribute)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if minChange > 0 {
+		d.minChanges[key] = minChange
+	} else {
+		delete(d.minChanges, key)
+	}
+}
+
+// unchanged reports whether an update is no change from the last published value: the same
+// value, or a numeric one within minChange of it.
+func (s *debounceState) unchanged(update AttributeUpdatePayload, minChange float64) bool {
+	if sameValue(update.deviceValue(), s.last) {
+		return true
+	}
+	v, ok := toFloat(update.Value)
+	last, lastOK := toFloat(s.lastValue)
+	return minChange > 0 && ok && lastOK && math.Abs(v-last) < minChange
+}
+
+// publish records an update as the last published value.
+func (s *debounceState) publish(update AttributeUpdatePayload, now time.Time) {
+	s.last, s.lastValue, s.lastChange = update.deviceValue(), update.Value, now
+}
+
+// Hold reports whether an update must not be published now: it is dropped, or held until its
+// rule's min interval elapsed.
+func (d *AttributeDebouncer) Hold(client *Client, update AttributeUpdatePayload, now time.Time) bool {
+	if update.Source == sourceOptimistic {
+		return false
+	}
+	rule, hasRule := debounceRuleFor(update)
+	key := debounceKey(update.NodeID, update.EndpointID, update.Cluster, update.Attribute)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	minChange := d.minChanges[key]
+	if !hasRule && minChange == 0 {
+		return false
+	}
+	state, ok := d.states[key]
+	if !ok {
+		state = &debounceState{}
+		state.publish(update, now)
+		d.states[key] = state
+		return false
+	}
+	if update.Source != sourceSubscription && update.Source != "poll" {
+		// A read goes through, and is fresher than any held report
+		if state.timer != nil {
+			state.timer.Stop()
+		}
+		state.pending, state.pendingClient, state.timer = nil, nil, nil
+		if !sameValue(update.deviceValue(), state.last) {
+			state.publish(update, now)
+		}
+		return false
+	}
+	if state.pending != nil {
+		if state.unchanged(update, minChange) { // Flapped back: nothing changed after all
+			state.timer.Stop()
+			state.pending, state.pendingClient, state.timer = nil, nil, nil
+		} else {
+			state.pending, state.pendingClient = &update, client
+		}
+		return true
+	}
+	if state.unchanged(update, minChange) {
+		return rule.Dedup || !sameValue(update.deviceValue(), state.last)
+	}
+	interval := time.Duration(rule.MinIntervalMs) * time.Millisecond
+	if wait := state.lastChange.Add(interval).Sub(now); wait > 0 {
+		state.pending, state.pendingClient = &update, client
+		state.hold++
+		hold := state.hold
+		state.timer = time.AfterFunc(wait, func() { d.flush(key, hold) })
+		return true
+	}
+	state.publish(update, now)
+	return false
+}
+
+// flush publishes the update held for an attribute, if it is still held.
+func (d *AttributeDebouncer) flush(key string, hold int) {
+	d.mu.Lock()
+	state, ok := d.states[key]
+	if !ok || state.pending == nil || state.hold != hold {
+		d.mu.Unlock()
+		return
+	}
+	update, client := *state.pending, state.pendingClient
+	now := time.Now()
+	state.publish(update, now)
+	state.pending, state.pendingClient, state.timer = nil, nil, nil
+	d.mu.Unlock()
+	recordAttributeUpdate(client, update, now)
+}
+
+// Forget drops the state of a node (or of one of its endpoints), with the updates it holds.
+func (d *AttributeDebouncer) Forget(nodeID, endpointID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prefix := nodeID + "/"
+	if endpointID != "" {
+		prefix += endpointID + "/"
+	}
+	for key, state := range d.states {
+		if strings.HasPrefix(key, prefix) {
+			if state.timer != nil {
+				state.timer.Stop()
+			}
+			delete(d.states, key)
+		}
+	}
+	for key := range d.minChanges {
+		if strings.HasPrefix(key, prefix) {
+			delete(d.minChanges, key)
+		}
+	}
+}
+
+var attributeDebouncer = NewAttributeDebouncer()
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// FieldError describes one invalid field of a client payload.
+type FieldError struct {
+	Field   string `json:"field"` // JSON path of the field, e.g. "trigger.nodeId"; empty for a malformed payload
+	Message string `json:"message"`
+}
+
+// ValidationError lists every problem found while decoding a payload. It is sent to the
+// client as the "fields" of the error message, so the frontend can point at each bad field.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		if f.Field == "" {
+			parts = append(parts, f.Message)
+		} else {
+			parts = append(parts, f.Field+": "+f.Message)
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (e *ValidationError) add(field, message string) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: message})
+}
+
+// decodePayload decodes a raw client payload into T. Unlike a plain json.Unmarshal it rejects
+// unknown fields, checks fields tagged `validate:"required"` and then runs T's Validate method,
+// if any. All problems found are returned together as a *ValidationError.
+func decodePayload[T any](raw json.RawMessage) (T, error) {
+	var payload T
+	verr := &ValidationError{}
+	if len(bytes.TrimSpace(raw)) > 0 && string(bytes.TrimSpace(raw)) != "null" {
+		// Collect every unknown top-level field first; the decoder below stops at the first one
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(raw, &fields) == nil {
+			for _, name := range unknownFields(reflect.TypeOf(payload), fields) {
+				verr.add(name, "unknown field")
+			}
+		}
+		if len(verr.Fields) == 0 {
+			dec := json.NewDecoder(bytes.NewReader(raw))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&payload); err != nil {
+				verr.Fields = append(verr.Fields, decodeFieldError(err))
+			}
+		}
+		if len(verr.Fields) > 0 {
+			return payload, verr
+		}
+	}
+	checkRequired(reflect.ValueOf(&payload).Elem(), "", verr)
+	if len(verr.Fields) > 0 {
+		return payload, verr
+	}
+	if v, ok := any(&payload).(Validator); ok {
+		if err := v.Validate(); err != nil {
+			var fieldErr *ValidationError
+			if errors.As(err, &fieldErr) {
+				return payload, fieldErr
+			}
+			verr.add("", err.Error())
+			return payload, verr
+		}
+	}
+	return payload, nil
+}
+
+// decodeFieldError turns a json decoding error into a FieldError, keeping the field path when known.
+func decodeFieldError(err error) FieldError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return FieldError{Field: typeErr.Field, Message: fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value)}
+	}
+	// json reports nested unknown fields as `json: unknown field "name"`
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return FieldError{Field: strings.Trim(name, `"`), Message: "unknown field"}
+	}
+	return FieldError{Message: "malformed payload: " + err.Error()}
+}
+
+// jsonFieldName returns the JSON name of a struct field, or "" when the field is not encoded.
+func jsonFieldName(f reflect.StructField) string {
+	if !f.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return f.Name
+	}
+	return name
+}
+
+// unknownFields returns the keys of a JSON object that don't match a field of struct type t.
+// Like encoding/json, names are matched case-insensitively. Non-struct types accept anything.
+func unknownFields(t reflect.Type, fields map[string]json.RawMessage) []string {
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	known := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		if name := jsonFieldName(t.Field(i)); name != "" {
+			known[strings.ToLower(name)] = true
+		}
+	}
+	var unknown []string
+	for key := range fields {
+		if !known[strings.ToLower(key)] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// checkRequired reports every zero-valued field tagged `validate:"required"`, descending into nested structs.
+func checkRequired(v reflect.Value, prefix string, verr *ValidationError) {
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := jsonFieldName(field)
+		if name == "" {
+			continue
+		}
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		if field.Tag.Get("validate") == "required" && v.Field(i).IsZero() {
+			verr.add(path, "is required")
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct {
+			checkRequired(v.Field(i), path, verr)
+		}
+	}
+}
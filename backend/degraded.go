@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// What the backend does at startup when no working chip-tool is found (chipToolMissing in the config).
+const (
+	chipToolMissingDegraded = "degraded" // Start without Matter operations (default)
+	chipToolMissingFail     = "fail"     // Exit with exitChipToolMissing
+)
+
+// exitChipToolMissing is the exit code of the backend when chip-tool is missing and
+// chipToolMissing is "fail", so a service manager can tell it from a crash.
+const exitChipToolMissing = 3
+
+// errMatterUnavailable is returned by chip-tool runs in degraded mode.
+var errMatterUnavailable = errors.New("Matter operations are unavailable: chip-tool was not found at startup")
+
+// matterMessageTypes are the messages that talk to Matter devices or to chip-tool, refused in
+// degraded mode. Registry browsing, history, rules, notifications and the other backend-only
+// features keep working.
+var matterMessageTypes = map[string]bool{
+	"discover_devices":         true,
+	"commission_device":        true,
+	"wizard_start":             true,
+	"wizard_step":              true,
+	"adopt_node":               true,
+	"device_command":           true,
+	"run_lighting_transition":  true,
+	"run_macro":                true,
+	"subscribe_attribute":      true,
+	"subscribe_sensor_bundle":  true,
+	"subscribe_switch_events":  true,
+	"enable_subscription":      true,
+	"refresh_device_version":   true,
+	"reconcile_devices":        true,
+	"discover_operational":     true,
+	"diagnose_device":          true,
+	"benchmark_device":         true,
+	"inspect_certificates":     true,
+	"check_fabric":             true,
+	"unpair_node":              true,
+	"discover_bridged_devices": true,
+	"describe_endpoints":       true,
+	"change_wifi_network":      true,
+	"sync_time":                true,
+	"export_fabric_share":      true,
+	"raw_chiptool":             true,
+}
+
+// DegradedState is the "degraded" part of GET /api/status.
+type DegradedState struct {
+	Active bool   `json:"active"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// DegradedMode records that the backend started without Matter operations. The background work
+// that would only fail doesn't start (session warmer, reconciler, address watcher, poller, time sync
+// and fabric check), and clients see matterAvailable: false in hello.
+type DegradedMode struct {
+	mu    sync.RWMutex
+	state DegradedState
+}
+
+// Active reports whether the backend runs without Matter operations.
+func (d *DegradedMode) Active() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.state.Active
+}
+
+// State returns the degraded state.
+func (d *DegradedMode) State() DegradedState {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.state
+}
+
+// applyChipToolPolicy applies chipToolMissing once chip-tool was looked for: it exits, or enters
+// degraded mode, when none was found.
+func applyChipToolPolicy(selection ChipToolSelection) {
+	if selection.Found {
+		return
+	}
+	policy := strings.ToLower(appConfig.ChipToolMissing)
+	switch policy {
+	case chipToolMissingFail:
+		log.Printf("FATAL: no working chip-tool found and chipToolMissing is %q, exiting with code %d", policy, exitChipToolMissing)
+		os.Exit(exitChipToolMissing)
+	case "", chipToolMissingDegraded:
+	default:
+		log.Printf("WARNING: unknown chipToolMissing %q (want %q or %q), using %q", appConfig.ChipToolMissing, chipToolMissingDegraded, chipToolMissingFail, chipToolMissingDegraded)
+	}
+	degradedMode.mu.Lock()
+	degradedMode.state = DegradedState{Active: true, Reason: "chip-tool not found (" + selection.Path + ")"}
+	degradedMode.mu.Unlock()
+	log.Printf("DEGRADED MODE: Matter operations are unavailable; registry browsing, history and the other backend features still work. Install chip-tool or set chipToolPath, then restart.")
+}
+
+// degradedMiddleware refuses the Matter operations in degraded mode.
+func degradedMiddleware(msgType string, next HandlerFunc) HandlerFunc {
+	return func(client *Client, msg ClientMessage) {
+		if matterMessageTypes[msgType] && degradedMode.Active() {
+			client.notifyClient("error", map[string]interface{}{"message": msgType + " failed: " + errMatterUnavailable.Error(), "code": errCodeMatterUnavailable})
+			return
+		}
+		next(client, msg)
+	}
+}
+
+var degradedMode = &DegradedMode{}
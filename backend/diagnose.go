@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// matterPort is the default UDP port of Matter operational traffic.
+const matterPort = 5540
+
+// Diagnostic verdicts.
+const (
+	verdictOK             = "ok"
+	verdictNetworkProblem = "network_problem" // The device doesn't answer on the IP network
+	verdictMatterProblem  = "matter_problem"  // The host answers, the Matter read doesn't
+	verdictNoAddress      = "no_address"      // No known address: run discover_operational first
+)
+
+// PingResult is the outcome of an ICMP echo check.
+type PingResult struct {
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	AvgRttMs float64 `json:"avgRttMs,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// UDPProbeResult is the outcome of a UDP probe of the Matter port. UDP gives no positive answer:
+// "closed" means the host replied with ICMP port unreachable, "open_or_filtered" means no reply.
+type UDPProbeResult struct {
+	Port   int    `json:"port"`
+	Status string `json:"status"` // "open_or_filtered", "closed" or "error"
+	Error  string `json:"error,omitempty"`
+}
+
+// MatterReadResult is the outcome of a lightweight Matter read (BasicInformation.VendorID).
+type MatterReadResult struct {
+	Success   bool    `json:"success"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// SubscriptionDiagnostics summarises the subscriptions and reports of a node.
+type SubscriptionDiagnostics struct {
+	Active             int       `json:"active"`              // Running chip-tool subscription processes
+	LastReport         time.Time `json:"lastReport,omitzero"` // Latest attribute value received from the node
+	SecondsSinceReport float64   `json:"secondsSinceReport,omitempty"`
+}
+
+// DiagnosticReport is sent to the client in response to "diagnose_device".
+type DiagnosticReport struct {
+	DeviceID      string                  `json:"deviceId"`
+	NodeID        string                  `json:"nodeId"`
+	Address       string                  `json:"address,omitempty"`
+	Ping          *PingResult             `json:"ping,omitempty"`
+	UDP           *UDPProbeResult         `json:"udp,omitempty"`
+	MatterRead    MatterReadResult        `json:"matterRead"`
+	Subscriptions SubscriptionDiagnostics `json:"subscriptions"`
+	Health        *DeviceHealthReport     `json:"health,omitempty"`
+	Thread        *ThreadDeviceStatus     `json:"thread,omitempty"` // Thread devices, when a border router is configured (see threadbr.go)
+	WiFi          *WifiDeviceEnvironment  `json:"wifi,omitempty"`   // Wi-Fi devices, when wifiScan is enabled (see wifiscan.go)
+	Verdict       string                  `json:"verdict"`
+}
+
+var (
+	rePingReceived = regexp.MustCompile(`(\d+) packets transmitted, (\d+) (?:packets )?received`)
+	rePingRtt      = regexp.MustCompile(`= [\d.]+/([\d.]+)/`)
+)
+
+// pingAddress sends a few ICMP echo requests with the system ping, which handles IPv6 zones.
+func pingAddress(address string) PingResult {
+	result := PingResult{Sent: 3}
+	out, err := exec.Command("ping", "-c", "3", "-W", "1", address).CombinedOutput()
+	output := string(out)
+	if m := rePingReceived.FindStringSubmatch(output); m != nil {
+		result.Sent, _ = strconv.Atoi(m[1])
+		result.Received, _ = strconv.Atoi(m[2])
+	}
+	if m := rePingRtt.FindStringSubmatch(output); m != nil {
+		result.AvgRttMs, _ = strconv.ParseFloat(m[1], 64)
+	}
+	if err != nil && result.Received == 0 {
+		result.Error = strings.TrimSpace(output)
+		if result.Error == "" {
+			result.Error = err.Error()
+		}
+	}
+	return result
+}
+
+// probeUDP sends a datagram to the Matter port and waits briefly for an ICMP port unreachable.
+func probeUDP(address string, port int) UDPProbeResult {
+	result := UDPProbeResult{Port: port}
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(address, strconv.Itoa(port)), time.Second)
+	if err != nil {
+		result.Status, result.Error = "error", err.Error()
+		return result
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte{0}); err != nil {
+		result.Status, result.Error = "error", err.Error()
+		return result
+	}
+	_, err = conn.Read(make([]byte, 64))
+	var netErr net.Error
+	switch {
+	case err == nil, errors.As(err, &netErr) && netErr.Timeout():
+		result.Status = "open_or_filtered"
+	case strings.Contains(err.Error(), "refused"):
+		result.Status = "closed"
+	default:
+		result.Status, result.Error = "error", err.Error()
+	}
+	return result
+}
+
+// diagnoseDevice runs the network and Matter checks of a registry device and combines them in a report.
+func diagnoseDevice(deviceID string) (DiagnosticReport, error) {
+	device, ok := deviceRegistry.Get(deviceID)
+	if !ok {
+		return DiagnosticReport{}, fmt.Errorf("device %q is not in the registry", deviceID)
+	}
+	report := DiagnosticReport{DeviceID: deviceID, NodeID: device.NodeID, Address: device.Address}
+	if report.Address == "" {
+		report.Address = bestAddress(device.Addresses)
+	}
+	if report.Address != "" {
+		ping := pingAddress(report.Address)
+		report.Ping = &ping
+		udp := probeUDP(report.Address, matterPort)
+		report.UDP = &udp
+	}
+
+	endpointID, cluster := "0", "BasicInformation"
+	if device.BridgeID != "" {
+		endpointID, cluster = device.EndpointID, "BridgedDeviceBasicInformation"
+	}
+	started := time.Now()
+	_, err := readAttributeValue(device.NodeID, endpointID, cluster, "vendor-id")
+	report.MatterRead = MatterReadResult{Success: err == nil, LatencyMs: float64(time.Since(started).Microseconds()) / 1000}
+	if err != nil {
+		report.MatterRead.Error = err.Error()
+	}
+
+	report.Subscriptions.Active = subscriptions.Count(device.NodeID)
+	for _, state := range stateCache.NodeAttributes(device.NodeID) {
+		if state.UpdatedAt.After(report.Subscriptions.LastReport) {
+			report.Subscriptions.LastReport = state.UpdatedAt
+		}
+	}
+	if !report.Subscriptions.LastReport.IsZero() {
+		report.Subscriptions.SecondsSinceReport = time.Since(report.Subscriptions.LastReport).Seconds()
+	}
+	if health, ok := deviceHealth.Report(device.NodeID); ok {
+		report.Health = &health
+	}
+	if thread, ok := threadBorderRouter.DeviceStatus(deviceID); ok {
+		report.Thread = &thread
+	}
+	report.WiFi = wifiDeviceEnvironment(device, report.MatterRead.Success)
+
+	hostAnswers := report.Ping != nil && report.Ping.Received > 0
+	switch {
+	case report.MatterRead.Success:
+		report.Verdict = verdictOK
+	case hostAnswers:
+		report.Verdict = verdictMatterProblem
+	case report.Address == "":
+		report.Verdict = verdictNoAddress
+	default:
+		report.Verdict = verdictNetworkProblem
+	}
+	return report, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxLongDiscriminator  = 0xFFF // 12 bits, advertised over DNS-SD and in QR codes
+	maxShortDiscriminator = 0xF   // The 4 high bits of the long one, all a manual pairing code carries
+	maxSetupPasscode      = 99999998
+)
+
+// normalizeDiscriminator parses a discriminator written in decimal ("3840") or hex ("0xF00", "F00")
+// and returns it in decimal, the form chip-tool prints and expects.
+func normalizeDiscriminator(value string, max uint64) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	base, digits := 10, value
+	if lower := strings.ToLower(value); strings.HasPrefix(lower, "0x") {
+		base, digits = 16, value[2:]
+	} else if strings.ContainsAny(lower, "abcdef") {
+		base = 16
+	}
+	n, err := strconv.ParseUint(digits, base, 16)
+	if err != nil || n > max {
+		return "", fmt.Errorf("must be a number between 0 and %d (decimal or 0x hex)", max)
+	}
+	return strconv.FormatUint(n, 10), nil
+}
+
+// shortDiscriminatorOf returns the short discriminator of a normalized long discriminator.
+func shortDiscriminatorOf(long string) string {
+	n, err := strconv.Atoi(long)
+	if err != nil {
+		return ""
+	}
+	return strconv.Itoa(n >> 8)
+}
+
+// ManualPairingCode is what an 11 or 21 digit manual pairing code decodes to.
+type ManualPairingCode struct {
+	Passcode           string
+	ShortDiscriminator string
+	VendorID           string // Only in 21 digit codes
+	ProductID          string
+}
+
+var verhoeffMultiply = [10][10]int{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+	{1, 2, 3, 4, 0, 6, 7, 8, 9, 5},
+	{2, 3, 4, 0, 1, 7, 8, 9, 5, 6},
+	{3, 4, 0, 1, 2, 8, 9, 5, 6, 7},
+	{4, 0, 1, 2, 3, 9, 5, 6, 7, 8},
+	{5, 9, 8, 7, 6, 0, 4, 3, 2, 1},
+	{6, 5, 9, 8, 7, 1, 0, 4, 3, 2},
+	{7, 6, 5, 9, 8, 2, 1, 0, 4, 3},
+	{8, 7, 6, 5, 9, 3, 2, 1, 0, 4},
+	{9, 8, 7, 6, 5, 4, 3, 2, 1, 0},
+}
+
+var verhoeffPermute = [8][10]int{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+	{1, 5, 7, 6, 2, 8, 3, 0, 9, 4},
+	{5, 8, 0, 3, 7, 9, 6, 1, 4, 2},
+	{8, 9, 1, 6, 0, 4, 3, 5, 2, 7},
+	{9, 4, 5, 3, 1, 2, 6, 8, 7, 0},
+	{4, 2, 8, 6, 5, 7, 3, 9, 0, 1},
+	{2, 7, 9, 3, 8, 0, 6, 4, 1, 5},
+	{7, 0, 4, 6, 9, 1, 3, 2, 5, 8},
+}
+
+// verhoeffValid checks the trailing Verhoeff check digit of a manual pairing code.
+func verhoeffValid(digits string) bool {
+	c := 0
+	for i := 0; i < len(digits); i++ {
+		d := int(digits[len(digits)-1-i] - '0')
+		c = verhoeffMultiply[c][verhoeffPermute[i%8][d]]
+	}
+	return c == 0
+}
+
+// parseManualPairingCode decodes a manual pairing code ("3497-011-2332", "34970112332" or the
+// 21 digit form with vendor and product IDs).
+func parseManualPairingCode(code string) (ManualPairingCode, error) {
+	digits := strings.NewReplacer("-", "", " ", "").Replace(code)
+	if len(digits) != 11 && len(digits) != 21 {
+		return ManualPairingCode{}, errors.New("a manual pairing code has 11 or 21 digits")
+	}
+	if strings.Trim(digits, "0123456789") != "" {
+		return ManualPairingCode{}, errors.New("a manual pairing code only has digits")
+	}
+	if !verhoeffValid(digits) {
+		return ManualPairingCode{}, errors.New("wrong check digit in manual pairing code")
+	}
+	chunk := func(from, to int) int {
+		n, _ := strconv.Atoi(digits[from:to])
+		return n
+	}
+	first, second, third := chunk(0, 1), chunk(1, 6), chunk(6, 10)
+	if first > 7 || (first&0x4 != 0) != (len(digits) == 21) {
+		return ManualPairingCode{}, errors.New("invalid manual pairing code")
+	}
+	result := ManualPairingCode{
+		Passcode:           strconv.Itoa(third<<14 | second&0x3FFF),
+		ShortDiscriminator: strconv.Itoa((first&0x3)<<2 | second>>14),
+	}
+	if len(digits) == 21 {
+		result.VendorID = strconv.Itoa(chunk(10, 15))
+		result.ProductID = strconv.Itoa(chunk(15, 20))
+	}
+	return result, nil
+}
+
+// normalizeSetupCode accepts either a setup passcode or a manual pairing code and returns the
+// passcode chip-tool's pairing commands take, plus the short discriminator when the code has one.
+func normalizeSetupCode(code string) (passcode, shortDiscriminator string, err error) {
+	digits := strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code))
+	if len(digits) == 11 || len(digits) == 21 {
+		manual, err := parseManualPairingCode(digits)
+		if err != nil {
+			return "", "", err
+		}
+		return manual.Passcode, manual.ShortDiscriminator, nil
+	}
+	n, err := strconv.ParseUint(digits, 10, 32)
+	if err != nil || n == 0 || n > maxSetupPasscode {
+		return "", "", fmt.Errorf("must be a setup passcode (1-%d) or an 11/21 digit manual pairing code", maxSetupPasscode)
+	}
+	return strconv.FormatUint(n, 10), "", nil
+}
+
+// normalizeCommissioningPayload rewrites the discriminators and setup code of a commission_device
+// request into the forms chip-tool expects. A manual pairing code fills in the short discriminator.
+func normalizeCommissioningPayload(p *CommissionDevicePayload) error {
+	verr := &ValidationError{}
+	passcode, short, err := normalizeSetupCode(p.SetupCode)
+	if err != nil {
+		verr.add("setupCode", err.Error())
+	} else {
+		p.SetupCode = passcode
+	}
+	if long, err := normalizeDiscriminator(p.LongDiscriminator, maxLongDiscriminator); err != nil {
+		verr.add("discriminator", err.Error())
+	} else {
+		p.LongDiscriminator = long
+	}
+	if given, err := normalizeDiscriminator(p.ShortDiscriminator, maxShortDiscriminator); err != nil {
+		verr.add("shortDiscriminator", err.Error())
+	} else if given != "" {
+		if short != "" && given != short {
+			verr.add("shortDiscriminator", "does not match the manual pairing code")
+		}
+		short = given
+	}
+	if p.LongDiscriminator != "" && short != "" && shortDiscriminatorOf(p.LongDiscriminator) != short {
+		verr.add("discriminator", "does not match the short discriminator")
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	p.ShortDiscriminator = short
+	return nil
+}
+
+// discoveredDiscriminator normalizes a discriminator printed by discovery, keeping the raw value
+// when it can't be parsed so nothing is lost.
+func discoveredDiscriminator(value string, max uint64) string {
+	if normalized, err := normalizeDiscriminator(value, max); err == nil {
+		return normalized
+	}
+	return strings.TrimSpace(value)
+}
+
+// completeDiscriminators derives the short discriminator of discovered devices that only
+// advertise the long one, so a manual pairing code can be matched against discovery results.
+func completeDiscriminators(devices []DiscoveredDevice) {
+	for i := range devices {
+		if devices[i].ShortDiscriminator == "" && devices[i].Discriminator != "" {
+			devices[i].ShortDiscriminator = shortDiscriminatorOf(devices[i].Discriminator)
+		}
+	}
+}
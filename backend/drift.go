@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Defaults of the drift check, used when the drift settings are zero.
+const (
+	defaultDriftIntervalMinutes = 60
+	defaultDriftMinAgeSeconds   = 60
+	sourceDriftCheck            = "drift_check" // Source of the attribute updates published by the check
+)
+
+// Kinds of state drift.
+const (
+	// The device reported a state other than the one commanded: something else set it, e.g. a
+	// controller on another fabric, a local switch or a scene.
+	driftChangedElsewhere = "changed_elsewhere"
+	// The device is in another state than commanded and never reported the change: the command
+	// didn't take effect, or the device reverted without telling.
+	driftSilentFailure = "silent_failure"
+	// The device is in the commanded state but the cache says otherwise: reports were missed.
+	driftStaleCache = "stale_cache"
+	// The device couldn't be read.
+	driftUnreachable = "unreachable"
+)
+
+// DriftConfig controls the drift check (see drift.go).
+type DriftConfig struct {
+	// IntervalMinutes is the time between two checks. Zero uses 60; negative disables the periodic
+	// check, leaving "check_state_drift".
+	IntervalMinutes int `json:"intervalMinutes,omitempty"`
+	// MinAgeSeconds is how old a command must be before its state is checked, so transitions end.
+	// Zero uses 60.
+	MinAgeSeconds int `json:"minAgeSeconds,omitempty"`
+}
+
+func (c DriftConfig) interval() time.Duration {
+	if c.IntervalMinutes > 0 {
+		return time.Duration(c.IntervalMinutes) * time.Minute
+	}
+	return defaultDriftIntervalMinutes * time.Minute
+}
+
+func (c DriftConfig) minAge() time.Duration {
+	if c.MinAgeSeconds > 0 {
+		return time.Duration(c.MinAgeSeconds) * time.Second
+	}
+	return defaultDriftMinAgeSeconds * time.Second
+}
+
+// StateDrift is an attribute whose state on the device diverged from what the gateway last set.
+type StateDrift struct {
+	Kind        string      `json:"kind"` // driftChangedElsewhere, driftSilentFailure, driftStaleCache or driftUnreachable
+	NodeID      string      `json:"nodeId"`
+	EndpointID  string      `json:"endpointId"`
+	DeviceID    string      `json:"deviceId,omitempty"`
+	DeviceName  string      `json:"deviceName,omitempty"`
+	Cluster     string      `json:"cluster"`
+	Attribute   string      `json:"attribute"`
+	Commanded   interface{} `json:"commanded"`
+	Command     string      `json:"command"`
+	CommandedAt time.Time   `json:"commandedAt"`
+	Cached      interface{} `json:"cached,omitempty"`
+	CachedAt    time.Time   `json:"cachedAt,omitzero"`
+	Actual      interface{} `json:"actual,omitempty"` // Fresh read, unless unreachable
+	// Fabrics is the number of fabrics the node is commissioned on, when it could be read: more
+	// than one means other controllers can change it.
+	Fabrics int       `json:"fabrics,omitempty"`
+	Since   time.Time `json:"since"` // First check that found this drift
+	Message string    `json:"message"`
+}
+
+// DriftReport is the result of a drift check, in the "state_drift_report" message and GET /api/v1/drift.
+type DriftReport struct {
+	CheckedAt time.Time    `json:"checkedAt,omitzero"`
+	Checked   int          `json:"checked"` // Commanded attributes read
+	InSync    int          `json:"inSync"`
+	Drifts    []StateDrift `json:"drifts"`
+}
+
+// commandedState is the state a successful command set, and when.
+type commandedState struct {
+	expected expectedState
+	at       time.Time
+}
+
+// DriftMonitor remembers the state the gateway last commanded for each attribute and periodically
+// compares it with fresh reads, to find the devices controlled from elsewhere or failing silently.
+type DriftMonitor struct {
+	mu        sync.Mutex
+	commanded map[string]commandedState // By stateKey
+	since     map[string]time.Time      // First detection of the current drifts, by stateKey
+	last      DriftReport
+	checking  bool
+}
+
+// NewDriftMonitor creates a DriftMonitor with nothing commanded yet.
+func NewDriftMonitor() *DriftMonitor {
+	return &DriftMonitor{commanded: make(map[string]commandedState), since: make(map[string]time.Time), last: DriftReport{Drifts: []StateDrift{}}}
+}
+
+// Commanded records the state a successful command set on a device.
+func (m *DriftMonitor) Commanded(expected expectedState) {
+	key := stateKey(expected.NodeID, expected.EndpointID, expected.Cluster, expected.Attribute)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commanded[key] = commandedState{expected: expected, at: time.Now()}
+	delete(m.since, key)
+}
+
+// Forget drops the commanded states of a node endpoint, or of the whole node when endpointID is empty.
+func (m *DriftMonitor) Forget(nodeID, endpointID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, state := range m.commanded {
+		if state.expected.NodeID == nodeID && (endpointID == "" || state.expected.EndpointID == endpointID) {
+			delete(m.commanded, key)
+			delete(m.since, key)
+		}
+	}
+}
+
+// Last returns the report of the latest check.
+func (m *DriftMonitor) Last() DriftReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last
+}
+
+// Check reads the commanded attributes old enough to have settled and reports those that drifted.
+// Fresh reads are published, so the cache and the dashboards catch up. It returns the report and
+// the drifts found for the first time.
+func (m *DriftMonitor) Check() (DriftReport, []StateDrift, error) {
+	m.mu.Lock()
+	if m.checking {
+		m.mu.Unlock()
+		return DriftReport{}, nil, fmt.Errorf("a drift check is already running")
+	}
+	m.checking = true
+	now := time.Now()
+	var due []commandedState
+	for _, state := range m.commanded {
+		if now.Sub(state.at) >= appConfig.Drift.minAge() {
+			due = append(due, state)
+		}
+	}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.checking = false
+		m.mu.Unlock()
+	}()
+	sort.Slice(due, func(i, j int) bool {
+		return stateKey(due[i].expected.NodeID, due[i].expected.EndpointID, due[i].expected.Cluster, due[i].expected.Attribute) <
+			stateKey(due[j].expected.NodeID, due[j].expected.EndpointID, due[j].expected.Cluster, due[j].expected.Attribute)
+	})
+
+	report := DriftReport{CheckedAt: now, Drifts: []StateDrift{}}
+	fabrics := make(map[string]int) // Per node, read once per check
+	for _, state := range due {
+		drift, drifted := checkDrift(state, fabrics)
+		report.Checked++
+		if !drifted {
+			report.InSync++
+			continue
+		}
+		report.Drifts = append(report.Drifts, drift)
+	}
+
+	var fresh []StateDrift
+	m.mu.Lock()
+	drifting := make(map[string]bool)
+	for i := range report.Drifts {
+		drift := &report.Drifts[i]
+		key := stateKey(drift.NodeID, drift.EndpointID, drift.Cluster, drift.Attribute)
+		state, ok := m.commanded[key]
+		if !ok || state.at.After(now) {
+			continue // Removed, or commanded again during the check
+		}
+		drifting[key] = true
+		if since, seen := m.since[key]; seen {
+			drift.Since = since
+		} else {
+			m.since[key] = drift.Since
+			fresh = append(fresh, *drift)
+		}
+	}
+	for key := range m.since {
+		if !drifting[key] {
+			delete(m.since, key)
+		}
+	}
+	m.last = report
+	m.mu.Unlock()
+	log.Printf("Drift check: %d commanded attribute(s) read, %d in sync, %d drifted (%d new)", report.Checked, report.InSync, len(report.Drifts), len(fresh))
+	return report, fresh, nil
+}
+
+// checkDrift reads a commanded attribute and compares it with the commanded and cached states.
+func checkDrift(state commandedState, fabrics map[string]int) (StateDrift, bool) {
+	expected := state.expected
+	drift := StateDrift{
+		NodeID: expected.NodeID, EndpointID: expected.EndpointID, Cluster: expected.Cluster, Attribute: expected.Attribute,
+		Commanded: expected.Value, Command: expected.Command, CommandedAt: state.at, Since: time.Now(),
+	}
+	if id, ok := deviceIDForTarget(expected.NodeID, expected.EndpointID); ok {
+		drift.DeviceID = id
+		if device, ok := deviceRegistry.Get(id); ok {
+			drift.DeviceName = device.Name
+		}
+	}
+	cached, hasCached := cachedState(expected.NodeID, expected.EndpointID, expected.Cluster, expected.Attribute)
+	if hasCached {
+		drift.Cached, drift.CachedAt = cached.deviceValue(), cached.UpdatedAt
+	}
+	target := fmt.Sprintf("%s.%s on node %s EP%s", expected.Cluster, expected.Attribute, expected.NodeID, expected.EndpointID)
+
+	actual, err := readAttributeValue(expected.NodeID, expected.EndpointID, expected.Cluster, expected.Attribute)
+	if err != nil {
+		drift.Kind = driftUnreachable
+		drift.Message = fmt.Sprintf("%s couldn't be read: %v", target, err)
+		return drift, true
+	}
+	drift.Actual = actual
+	publishAttributeUpdate(nil, AttributeUpdatePayload{
+		NodeID: expected.NodeID, EndpointID: expected.EndpointID, Cluster: expected.Cluster, Attribute: expected.Attribute, Value: actual, Source: sourceDriftCheck,
+	})
+
+	if sameValue(actual, expected.Value) {
+		if hasCached && !sameValue(drift.Cached, actual) {
+			drift.Kind = driftStaleCache
+			drift.Message = fmt.Sprintf("%s is %v as commanded, but the cache had %v: reports were missed", target, actual, drift.Cached)
+			return drift, true
+		}
+		return drift, false
+	}
+
+	// A confirmed report of the actual value after the command means the device told us about the change
+	reported := hasCached && cached.Source != sourceOptimistic && cached.UpdatedAt.After(state.at) && sameValue(drift.Cached, actual)
+	if reported {
+		drift.Kind = driftChangedElsewhere
+		drift.Message = fmt.Sprintf("%s is %v, not %v as set by %s: it was changed elsewhere", target, actual, expected.Value, expected.Command)
+	} else {
+		drift.Kind = driftSilentFailure
+		drift.Message = fmt.Sprintf("%s is %v, not %v as set by %s, and the device never reported the change", target, actual, expected.Value, expected.Command)
+	}
+	count, ok := fabrics[expected.NodeID]
+	if !ok {
+		if value, err := readAttributeValue(expected.NodeID, "0", "OperationalCredentials", "commissioned-fabrics"); err == nil {
+			if n, isNumber := toFloat(value); isNumber {
+				count = int(n)
+			}
+		}
+		fabrics[expected.NodeID] = count
+	}
+	drift.Fabrics = count
+	if count > 1 {
+		drift.Message += fmt.Sprintf("; the node is on %d fabrics, another controller may be driving it", count)
+	}
+	return drift, true
+}
+
+// startDriftCheck runs a drift check as a background job, sending the report to client or, for the
+// periodic check (nil client), broadcasting it when it found new drifts.
+func startDriftCheck(client *Client) {
+	jobs.Submit(client, "drift_check", func(ctx context.Context, job *Job) (interface{}, error) {
+		report, fresh, err := driftMonitor.Check()
+		if err != nil {
+			return nil, err
+		}
+		if client != nil {
+			client.sendPayload("state_drift_report", report)
+		} else if len(fresh) > 0 {
+			broadcastToClients("state_drift_report", report)
+		}
+		return report, nil
+	})
+}
+
+// Run checks for drift periodically, until the process exits.
+func (m *DriftMonitor) Run() {
+	if appConfig.Drift.IntervalMinutes < 0 {
+		log.Printf("Periodic drift check disabled")
+		return
+	}
+	for {
+		time.Sleep(appConfig.Drift.interval())
+		if degradedMode.Active() {
+			continue // No Matter operations to read the devices with
+		}
+		startDriftCheck(nil)
+	}
+}
+
+func handleCheckStateDrift(client *Client) {
+	startDriftCheck(client)
+}
+
+// registerDriftRoutes adds GET /drift, the latest drift report, to an API version group.
+func registerDriftRoutes(api *gin.RouterGroup) {
+	api.GET("/drift", func(c *gin.Context) {
+		c.JSON(http.StatusOK, driftMonitor.Last())
+	})
+}
+
+var driftMonitor = NewDriftMonitor()
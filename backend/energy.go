@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// energyFile is where the energy meters are persisted, relative to the data directory.
+const energyFile = "energy.json"
+
+const (
+	maxEnergyDays      = 400            // Daily consumption kept per device, enough for a year-over-year month
+	maxPowerGap        = time.Hour      // Power samples further apart aren't integrated: the device was probably off-line
+	energySaveInterval = time.Minute    // Meters are saved at most this often; a crash loses less than that
+	energyDateLayout   = "2006-01-02"   // Local dates of the daily buckets and of the from/to report bounds
+	counterValidity    = 24 * time.Hour // A device reporting an energy counter within this window isn't integrated from its power
+)
+
+// Energy reporting periods.
+const (
+	energyPeriodDay   = "day"
+	energyPeriodWeek  = "week"
+	energyPeriodMonth = "month"
+)
+
+// energyDay is the energy used in each local hour of a day, in Wh. Hourly buckets let time-of-use
+// tariffs be applied when a report is built, so a tariff change also prices the past.
+type energyDay [24]float64
+
+// energyMeter accumulates the consumption of one device.
+type energyMeter struct {
+	LastCounter *float64              `json:"lastCounter,omitempty"` // Last CumulativeEnergyImported, in mWh
+	CounterSeen time.Time             `json:"counterSeen,omitzero"`
+	LastPowerW  *float64              `json:"lastPowerW,omitempty"` // Last ActivePower, integrated until the next sample
+	PowerSeen   time.Time             `json:"powerSeen,omitzero"`
+	Days        map[string]*energyDay `json:"days"` // Keyed by local date
+}
+
+// add books wh to the hour of at.
+func (m *energyMeter) add(at time.Time, wh float64) {
+	if wh <= 0 {
+		return
+	}
+	day := at.Format(energyDateLayout)
+	if m.Days[day] == nil {
+		m.Days[day] = &energyDay{}
+		oldest := at.AddDate(0, 0, -maxEnergyDays).Format(energyDateLayout)
+		for d := range m.Days {
+			if d < oldest {
+				delete(m.Days, d)
+			}
+		}
+	}
+	m.Days[day][at.Hour()] += wh
+}
+
+// EnergyReports aggregates the electrical measurements of plugs and other metered devices into
+// consumption per device. The history recorder feeds it every attribute update: energy counters
+// (ElectricalEnergyMeasurement) are used when the device has them, otherwise the active power
+// (ElectricalPowerMeasurement) is integrated over time.
+type EnergyReports struct {
+	mu       sync.Mutex
+	meters   map[string]*energyMeter // By registry device ID
+	path     string
+	lastSave time.Time
+}
+
+// NewEnergyReports creates EnergyReports persisting its meters to path.
+func NewEnergyReports(path string) *EnergyReports {
+	return &EnergyReports{meters: make(map[string]*energyMeter), path: path}
+}
+
+// Load reads the persisted meters. A missing file is not an error.
+func (e *EnergyReports) Load() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := loadJSONFile(e.path, &e.meters); err != nil {
+		return err
+	}
+	for _, meter := range e.meters {
+		if meter.Days == nil {
+			meter.Days = make(map[string]*energyDay)
+		}
+	}
+	return nil
+}
+
+// save writes the meters to disk. The caller must hold e.mu.
+func (e *EnergyReports) save() error {
+	e.lastSave = time.Now()
+	return saveJSONFile(e.path, e.meters)
+}
+
+// energyDeviceID returns the registry device an attribute update belongs to: the bridged device
+// on that endpoint if there is one, otherwise the node.
+func energyDeviceID(nodeID, endpointID string) string {
+	if _, ok := deviceRegistry.Get(bridgedDeviceID(nodeID, endpointID)); ok {
+		return bridgedDeviceID(nodeID, endpointID)
+	}
+	return nodeID
+}
+
+// Record books the energy carried by an attribute update. Other attributes are ignored.
+func (e *EnergyReports) Record(update AttributeUpdatePayload, at time.Time) {
+	key := strings.ToLower(update.Cluster) + "/" + update.Attribute
+	switch key {
+	case "electricalenergymeasurement/cumulative-energy-imported", "electricalenergymeasurement/periodic-energy-imported", "electricalpowermeasurement/active-power":
+	default:
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	deviceID := energyDeviceID(update.NodeID, update.EndpointID)
+	meter, ok := e.meters[deviceID]
+	if !ok {
+		meter = &energyMeter{Days: make(map[string]*energyDay)}
+		e.meters[deviceID] = meter
+	}
+
+	switch key {
+	case "electricalenergymeasurement/cumulative-energy-imported":
+		mwh, ok := energyValue(update.Value)
+		if !ok {
+			return
+		}
+		if meter.LastCounter != nil {
+			delta := mwh - *meter.LastCounter
+			if delta < 0 {
+				delta = mwh // The counter was reset, e.g. by a firmware update
+			}
+			meter.add(at, delta/1000)
+		}
+		meter.LastCounter, meter.CounterSeen = &mwh, at
+	case "electricalenergymeasurement/periodic-energy-imported":
+		mwh, ok := energyValue(update.Value)
+		if !ok {
+			return
+		}
+		meter.add(at, mwh/1000)
+		meter.CounterSeen = at
+	case "electricalpowermeasurement/active-power":
+		watts, ok := toFloat(update.Value) // Normalised to W (see transform.go)
+		if !ok {
+			return
+		}
+		gap := at.Sub(meter.PowerSeen)
+		if meter.LastPowerW != nil && gap > 0 && gap <= maxPowerGap && at.Sub(meter.CounterSeen) > counterValidity {
+			meter.add(at, *meter.LastPowerW*gap.Hours())
+		}
+		meter.LastPowerW, meter.PowerSeen = &watts, at
+	}
+
+	if time.Since(e.lastSave) >= energySaveInterval {
+		if err := e.save(); err != nil {
+			log.Printf("Could not save energy meters: %v", err)
+		}
+	}
+}
+
+// energyValue extracts the energy of an EnergyMeasurementStruct, in mWh. The struct arrives as a
+// map (keyed by field name or ID, depending on the controller) or as a bare number.
+func energyValue(value interface{}) (float64, bool) {
+	if fields, ok := value.(map[string]interface{}); ok {
+		for _, name := range []string{"energy", "Energy", "0"} {
+			if v, found := fields[name]; found {
+				return toFloat(v)
+			}
+		}
+		return 0, false
+	}
+	return toFloat(value)
+}
+
+// Forget drops the meters of removed devices.
+func (e *EnergyReports) Forget(deviceIDs ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	changed := false
+	for _, id := range deviceIDs {
+		if _, ok := e.meters[id]; ok {
+			delete(e.meters, id)
+			changed = true
+		}
+	}
+	if changed {
+		if err := e.save(); err != nil {
+			log.Printf("Could not save energy meters: %v", err)
+		}
+	}
+}
+
+// EnergyReportPayload is the payload of "get_energy_report" and the query of GET /api/energy.
+type EnergyReportPayload struct {
+	Period string `json:"period,omitempty"` // "day" (default), "week" or "month"
+	From   string `json:"from,omitempty"`   // First local date, YYYY-MM-DD. Default: 7 days, 4 weeks or 3 months before To
+	To     string `json:"to,omitempty"`     // Last local date, YYYY-MM-DD. Default: today
+}
+
+// Validate implements Validator.
+func (p EnergyReportPayload) Validate() error {
+	verr := &ValidationError{}
+	switch p.Period {
+	case "", energyPeriodDay, energyPeriodWeek, energyPeriodMonth:
+	default:
+		verr.add("period", "must be day, week or month")
+	}
+	var from, to time.Time
+	var err error
+	if p.From != "" {
+		if from, err = time.ParseInLocation(energyDateLayout, p.From, time.Local); err != nil {
+			verr.add("from", "must be a date like 2024-01-31")
+		}
+	}
+	if p.To != "" {
+		if to, err = time.ParseInLocation(energyDateLayout, p.To, time.Local); err != nil {
+			verr.add("to", "must be a date like 2024-01-31")
+		}
+	}
+	if !from.IsZero() && !to.IsZero() {
+		if from.After(to) {
+			verr.add("from", "must not be after to")
+		} else if to.Sub(from) > maxEnergyDays*24*time.Hour {
+			verr.add("from", fmt.Sprintf("the range must be at most %d days, the consumption kept", maxEnergyDays))
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// EnergyBucket is the consumption of one day, ISO week ("2024-W05") or month ("2024-01").
+type EnergyBucket struct {
+	Period string  `json:"period"`
+	KWh    float64 `json:"kWh"`
+	Cost   float64 `json:"cost"` // Estimated with the configured tariff; zero without one
+}
+
+// EnergyUsage is the consumption of a device or a room over the report's range.
+type EnergyUsage struct {
+	DeviceID  string         `json:"deviceId,omitempty"`
+	Name      string         `json:"name,omitempty"`
+	Room      string         `json:"room,omitempty"`
+	Buckets   []EnergyBucket `json:"buckets"`
+	TotalKWh  float64        `json:"totalKWh"`
+	TotalCost float64        `json:"totalCost"`
+}
+
+// EnergyReport is the reply to "get_energy_report" and GET /api/energy.
+type EnergyReport struct {
+	Period    string        `json:"period"`
+	From      string        `json:"from"`
+	To        string        `json:"to"`
+	Currency  string        `json:"currency,omitempty"`
+	Devices   []EnergyUsage `json:"devices"`
+	Rooms     []EnergyUsage `json:"rooms"` // Devices without a room are counted under ""
+	TotalKWh  float64       `json:"totalKWh"`
+	TotalCost float64       `json:"totalCost"`
+}
+
+// tariffPrice returns the price of a kWh used in a local hour: the first time-of-use period
+// containing it, otherwise the flat price.
+func tariffPrice(hour int) float64 {
+	for _, period := range appConfig.Energy.Periods {
+		from, to := period.FromHour, period.ToHour
+		if (from <= to && hour >= from && hour < to) || (from > to && (hour >= from || hour < to)) {
+			return period.PricePerKWh
+		}
+	}
+	return appConfig.Energy.PricePerKWh
+}
+
+// energyPeriodLabel names the bucket a local date falls in.
+func energyPeriodLabel(period string, day time.Time) string {
+	switch period {
+	case energyPeriodWeek:
+		year, week := day.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case energyPeriodMonth:
+		return day.Format("2006-01")
+	}
+	return day.Format(energyDateLayout)
+}
+
+// energyUsage accumulates the buckets of an EnergyUsage. Days are added in order, so a new bucket
+// starts whenever the label changes.
+type energyUsage struct {
+	usage EnergyUsage
+}
+
+func (u *energyUsage) add(label string, kwh, cost float64) {
+	buckets := u.usage.Buckets
+	if len(buckets) == 0 || buckets[len(buckets)-1].Period != label {
+		u.usage.Buckets = append(buckets, EnergyBucket{Period: label})
+	}
+	bucket := &u.usage.Buckets[len(u.usage.Buckets)-1]
+	bucket.KWh += kwh
+	bucket.Cost += cost
+	u.usage.TotalKWh += kwh
+	u.usage.TotalCost += cost
+}
+
+// result rounds the figures to Wh and to a thousandth of the currency.
+func (u *energyUsage) result() EnergyUsage {
+	round := func(v float64) float64 { return math.Round(v*1000) / 1000 }
+	usage := u.usage
+	usage.Buckets = append([]EnergyBucket{}, usage.Buckets...)
+	for i := range usage.Buckets {
+		usage.Buckets[i].KWh, usage.Buckets[i].Cost = round(usage.Buckets[i].KWh), round(usage.Buckets[i].Cost)
+	}
+	usage.TotalKWh, usage.TotalCost = round(usage.TotalKWh), round(usage.TotalCost)
+	return usage
+}
+
+// Report builds the consumption per device and per room between two local dates. The payload
+// must have been validated.
+func (e *EnergyReports) Report(p EnergyReportPayload) EnergyReport {
+	period := p.Period
+	if period == "" {
+		period = energyPeriodDay
+	}
+	to := time.Now()
+	if p.To != "" {
+		to, _ = time.ParseInLocation(energyDateLayout, p.To, time.Local)
+	}
+	var from time.Time
+	switch period {
+	case energyPeriodWeek:
+		from = to.AddDate(0, 0, -27)
+	case energyPeriodMonth:
+		from = time.Date(to.Year(), to.Month()-2, 1, 0, 0, 0, 0, time.Local)
+	default:
+		from = to.AddDate(0, 0, -6)
+	}
+	if p.From != "" {
+		from, _ = time.ParseInLocation(energyDateLayout, p.From, time.Local)
+	}
+	report := EnergyReport{Period: period, From: from.Format(energyDateLayout), To: to.Format(energyDateLayout), Currency: appConfig.Energy.Currency}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	deviceIDs := make([]string, 0, len(e.meters))
+	for id := range e.meters {
+		deviceIDs = append(deviceIDs, id)
+	}
+	sort.Strings(deviceIDs)
+	rooms := map[string]*energyUsage{}
+	var roomNames []string
+	total := &energyUsage{}
+	for _, id := range deviceIDs {
+		device := &energyUsage{usage: EnergyUsage{DeviceID: id}}
+		if registered, ok := deviceRegistry.Get(id); ok {
+			device.usage.Name, device.usage.Room = registered.Name, registered.Room
+		}
+		room, ok := rooms[device.usage.Room]
+		if !ok {
+			room = &energyUsage{usage: EnergyUsage{Room: device.usage.Room}}
+			rooms[device.usage.Room] = room
+			roomNames = append(roomNames, device.usage.Room)
+		}
+		for day := from; report.To >= day.Format(energyDateLayout); day = day.AddDate(0, 0, 1) {
+			var kwh, cost float64
+			if hours := e.meters[id].Days[day.Format(energyDateLayout)]; hours != nil {
+				for hour, wh := range hours {
+					kwh += wh / 1000
+					cost += wh / 1000 * tariffPrice(hour)
+				}
+			}
+			label := energyPeriodLabel(period, day)
+			device.add(label, kwh, cost)
+			room.add(label, kwh, cost)
+			total.add(label, kwh, cost)
+		}
+		report.Devices = append(report.Devices, device.result())
+	}
+	sort.Strings(roomNames)
+	for _, name := range roomNames {
+		report.Rooms = append(report.Rooms, rooms[name].result())
+	}
+	totals := total.result()
+	report.TotalKWh, report.TotalCost = totals.TotalKWh, totals.TotalCost
+	if report.Devices == nil {
+		report.Devices, report.Rooms = []EnergyUsage{}, []EnergyUsage{}
+	}
+	return report
+}
+
+// handleGetEnergyReport replies with the energy report ("energy_report").
+func handleGetEnergyReport(client *Client, payload EnergyReportPayload) {
+	client.sendPayload("energy_report", energyReports.Report(payload))
+}
+
+var energyReports = NewEnergyReports(energyFile)
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+)
+
+// Status values of an Envelope.
+const (
+	statusOK    = "ok"
+	statusError = "error"
+)
+
+// Error codes carried by error envelopes. Handlers can set a more specific one with a "code"
+// entry in the payload of an "error" message.
+const (
+	errCodeInvalidPayload    = "invalid_payload"
+	errCodeUnauthenticated   = "unauthenticated"
+	errCodeUnknownType       = "unknown_message_type"
+	errCodeAdminOnly         = "admin_only"          // Admin message received on the main listener (see admin.go)
+	errCodeTooManyClients    = "too_many_clients"    // Connection refused by maxClients (see admission.go)
+	errCodeQuotaExceeded     = "quota_exceeded"      // Request refused by the client's quotas (see quotas.go)
+	errCodeUnsupported       = "unsupported_feature" // Command or attribute the device doesn't implement (see capabilities.go)
+	errCodeRequestFailed     = "request_failed"      // "error" message without a specific code
+	errCodeOperationFailed   = "operation_failed"    // Result payload reporting success=false or an error
+	errCodeReadOnly          = "read_only"           // Commissioning, command or write refused in read-only mode (see readonly.go)
+	errCodeMaintenance       = "maintenance"         // Subscription refused during maintenance (see maintenance.go)
+	errCodeMatterUnavailable = "matter_unavailable"  // Matter operation refused in degraded mode (see degraded.go)
+)
+
+// Envelope is the shape of every message sent to the client: responses, logs and event streams.
+type Envelope struct {
+	Type      string      `json:"type"`
+	RequestID string      `json:"requestId,omitempty"`
+	Status    string      `json:"status"` // "ok" or "error"
+	ErrorCode string      `json:"errorCode,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// wantsLegacyMessages tells whether a connection gets the legacy ServerMessage shape ({type, payload}).
+// The legacyMessages config flag sets the default; ?format=legacy or ?format=envelope on /ws overrides it.
+func wantsLegacyMessages(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "legacy":
+		return true
+	case "envelope":
+		return false
+	}
+	return appConfig.LegacyMessages
+}
+
+// buildServerMessage wraps a payload in the shape the client expects.
+func buildServerMessage(msgType, requestID string, payload interface{}, legacy bool) interface{} {
+	if legacy {
+		return ServerMessage{Type: msgType, Payload: payload, RequestID: requestID}
+	}
+	status, code := envelopeStatus(msgType, payload)
+	return Envelope{Type: msgType, RequestID: requestID, Status: status, ErrorCode: code, Data: payload}
+}
+
+// envelopeStatus derives status and error code from a payload: "error" messages, maps with
+// "success": false and result structs with Success == false or a non-empty Error field are errors.
+// A "code" map entry or Code field gives the error code.
+func envelopeStatus(msgType string, payload interface{}) (string, string) {
+	if m, ok := payload.(map[string]interface{}); ok {
+		if code, ok := m["code"].(string); ok && code != "" {
+			return statusError, code
+		}
+		if success, ok := m["success"].(bool); ok && !success {
+			return statusError, errCodeOperationFailed
+		}
+	}
+	if msgType == "error" {
+		return statusError, errCodeRequestFailed
+	}
+	v := reflect.ValueOf(payload)
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return statusOK, ""
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return statusOK, ""
+	}
+	if f := v.FieldByName("Code"); f.IsValid() && f.Kind() == reflect.String && f.String() != "" {
+		return statusError, f.String()
+	}
+	if f := v.FieldByName("Success"); f.IsValid() && f.Kind() == reflect.Bool && !f.Bool() {
+		return statusError, errCodeOperationFailed
+	}
+	if f := v.FieldByName("Error"); f.IsValid() && f.Kind() == reflect.String && f.String() != "" {
+		return statusError, errCodeOperationFailed
+	}
+	return statusOK, ""
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DeviceStatePayload is returned by GET /api/devices/:id/state.
+type DeviceStatePayload struct {
+	DeviceID   string           `json:"deviceId"`
+	Attributes []AttributeState `json:"attributes"`
+}
+
+// deviceState returns the cached attributes of a registry device: its whole node, or only its
+// endpoint for bridged devices.
+func deviceState(device RegisteredDevice) DeviceStatePayload {
+	state := DeviceStatePayload{DeviceID: device.ID, Attributes: []AttributeState{}}
+	for _, attr := range stateCache.NodeAttributes(device.NodeID) {
+		if device.BridgeID == "" || attr.EndpointID == device.EndpointID {
+			state.Attributes = append(state.Attributes, attr)
+		}
+	}
+	return state
+}
+
+// etagMatches reports whether an If-None-Match header lists the ETag. Weak and strong forms match
+// alike, as only GET uses them.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonWithETag answers a GET with body as JSON and an ETag hashing its content. A request whose
+// If-None-Match holds that ETag gets an empty 304 instead, so clients polling an unchanged
+// resource download nothing.
+func jsonWithETag(c *gin.Context, body interface{}) {
+	jsonWithETagOf(c, body, nil)
+}
+
+// jsonWithETagOf is jsonWithETag for bodies carrying a field that changes on every request (a
+// generation time): the ETag hashes content instead, the body without that field.
+func jsonWithETagOf(c *gin.Context, body, content interface{}) {
+	data, err := json.Marshal(body)
+	hashed := data
+	if err == nil && content != nil {
+		hashed, err = json.Marshal(content)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	etag := etagOf(hashed)
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "no-cache") // Cache, but revalidate every time
+	if header := c.GetHeader("If-None-Match"); header != "" && etagMatches(header, etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
+
+// etagOf returns the strong ETag of a JSON body.
+func etagOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
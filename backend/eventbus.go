@@ -0,0 +1,201 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event topics. Subscribers pick the topics they care about.
+const (
+	topicDevice   = "device"   // Attribute updates, button events, alerts, device health/removal...
+	topicLog      = "log"      // *_log progress messages
+	topicJob      = "job"      // Background job updates
+	topicResponse = "response" // Replies to a client request
+)
+
+// deviceEventTypes are the message types published on topicDevice.
+var deviceEventTypes = map[string]bool{
+	"attribute_update":          true,
+	"button_event":              true,
+	"device_health":             true,
+	"device_added":              true,
+	"device_removed":            true,
+	"orphaned_devices":          true,
+	"alert_raised":              true,
+	"alert_cleared":             true,
+	"mode_changed":              true,
+	"state_correction":          true,
+	"device_reachability":       true,
+	"lock_alarm":                true,
+	"notification":              true,
+	"thread_device_unreachable": true,
+}
+
+// eventTopic returns the topic a message type is published on.
+func eventTopic(msgType string) string {
+	switch {
+	case deviceEventTypes[msgType]:
+		return topicDevice
+	case strings.HasSuffix(msgType, "_log"):
+		return topicLog
+	case msgType == "job_update":
+		return topicJob
+	}
+	return topicResponse
+}
+
+// Event is a message published on the bus. Client is the connection a reply is addressed to
+// (nil for backend-originated work); Broadcast events go to every connected client.
+type Event struct {
+	Topic     string
+	Type      string
+	Payload   interface{}
+	Client    *Client
+	RequestID string
+	Broadcast bool
+	Time      time.Time
+}
+
+// EventHandler consumes events. Each subscriber runs in its own goroutine, in publish order.
+type EventHandler func(Event)
+
+// eventQueueSize is how many events a slow subscriber can lag behind before events are dropped for it.
+const eventQueueSize = 1024
+
+type eventSubscription struct {
+	name   string
+	topics map[string]bool // Empty means every topic
+	queue  chan Event
+}
+
+// EventBus decouples the producers of messages (handlers, subscriptions, background jobs) from their
+// consumers (the WebSocket hub, the rules engine, the history recorder...).
+type EventBus struct {
+	mu   sync.RWMutex
+	subs []*eventSubscription
+}
+
+// NewEventBus creates an EventBus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe registers a handler for the given topics (all topics when none are given).
+func (b *EventBus) Subscribe(name string, handler EventHandler, topics ...string) {
+	sub := &eventSubscription{name: name, topics: make(map[string]bool), queue: make(chan Event, eventQueueSize)}
+	for _, topic := range topics {
+		sub.topics[topic] = true
+	}
+	go func() {
+		for event := range sub.queue {
+			handler(event)
+		}
+	}()
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+}
+
+// Publish hands an event to every subscriber of its topic. It never blocks: a subscriber whose
+// queue is full misses the event.
+func (b *EventBus) Publish(event Event) {
+	if event.Topic == "" {
+		event.Topic = eventTopic(event.Type)
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, sub := range b.subs {
+		if len(sub.topics) > 0 && !sub.topics[event.Topic] {
+			continue
+		}
+		select {
+		case sub.queue <- event:
+		default:
+			log.Printf("Event bus: %s is lagging, dropped %s event", sub.name, event.Type)
+		}
+	}
+}
+
+var eventBus = NewEventBus()
+
+// broadcastToClients publishes a message for all connected clients.
+func broadcastToClients(msgType string, payload interface{}) {
+	eventBus.Publish(Event{Type: msgType, Payload: payload, Broadcast: true})
+}
+
+// confirmedAttributeUpdate returns the attribute update carried by an event, unless it is an
+// optimistic one not confirmed by the device yet (see commandstate.go).
+func confirmedAttributeUpdate(event Event) (AttributeUpdatePayload, bool) {
+	update, ok := event.Payload.(AttributeUpdatePayload)
+	return update, ok && event.Type == "attribute_update" && update.Source != sourceOptimistic
+}
+
+// recordAttributeHistory is the history recorder: it appends every attribute update to attributeHistory
+// and books the energy measurements in energyReports.
+func recordAttributeHistory(event Event) {
+	if update, ok := confirmedAttributeUpdate(event); ok {
+		attributeHistory.Append(update, event.Time)
+		energyReports.Record(update, event.Time)
+	}
+}
+
+// dispatchRuleEvents feeds button events, house mode changes and confirmed attribute updates to
+// the rules engine, unless the rulesEngine feature flag is off.
+func dispatchRuleEvents(event Event) {
+	if !featureFlags.Enabled(featureRulesEngine) {
+		return
+	}
+	if update, ok := confirmedAttributeUpdate(event); ok {
+		rulesEngine.HandleAttributeUpdate(update)
+		return
+	}
+	switch payload := event.Payload.(type) {
+	case ButtonEventPayload:
+		rulesEngine.HandleButtonEvent(payload)
+	case ModeChangedPayload:
+		rulesEngine.HandleModeChange(payload)
+	}
+}
+
+// dispatchVirtualEvents feeds confirmed attribute updates to the virtual devices computed from them.
+func dispatchVirtualEvents(event Event) {
+	if update, ok := confirmedAttributeUpdate(event); ok {
+		virtualDevices.HandleAttributeUpdate(update)
+	}
+}
+
+// dispatchModeEvents feeds occupancy reports to the house modes.
+func dispatchModeEvents(event Event) {
+	if update, ok := confirmedAttributeUpdate(event); ok {
+		houseModes.HandleAttributeUpdate(update, event.Time)
+	}
+}
+
+// dispatchAlertEvents feeds attribute updates to the alert engine.
+func dispatchAlertEvents(event Event) {
+	if update, ok := confirmedAttributeUpdate(event); ok {
+		alertEngine.HandleAttributeUpdate(update, event.Time)
+	}
+}
+
+// dispatchReconcileEvents feeds confirmed attribute updates to the command state reconciliation.
+func dispatchReconcileEvents(event Event) {
+	if update, ok := confirmedAttributeUpdate(event); ok {
+		commandStates.HandleAttributeUpdate(update)
+	}
+}
+
+func init() {
+	eventBus.Subscribe("history", recordAttributeHistory, topicDevice)
+	eventBus.Subscribe("rules", dispatchRuleEvents, topicDevice)
+	eventBus.Subscribe("alerts", dispatchAlertEvents, topicDevice)
+	eventBus.Subscribe("modes", dispatchModeEvents, topicDevice)
+	eventBus.Subscribe("reconcile", dispatchReconcileEvents, topicDevice)
+	eventBus.Subscribe("virtual", dispatchVirtualEvents, topicDevice)
+	eventBus.Subscribe("notifications", notificationCenter.HandleEvent, topicDevice)
+}
@@ -0,0 +1,919 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// experimentsDir is where the experiments are kept, relative to the data directory:
+// experiments/<id>.yaml as uploaded, and experiments/runs/<run id>/ with the artifacts of each run.
+const experimentsDir = "experiments"
+
+// Limits of the experiments.
+const (
+	maxExperimentBytes    = 256 * 1024 // Size of an uploaded definition
+	maxExperimentCount    = 10000      // Repetitions of a command or read step
+	maxExperimentInterval = time.Hour  // Interval between repetitions, and length of a wait step
+	maxExperimentRuns     = 50         // Runs kept; starting another one removes the oldest
+)
+
+// Artifacts of a run, downloadable from /experiment-runs/:id/artifacts/:name.
+const (
+	experimentDefinitionArtifact = "experiment.yaml" // The definition as it was run
+	experimentResultsArtifact    = "results.json"    // The ExperimentRun, with the statistics of each step
+	experimentSamplesArtifact    = "samples.csv"     // Every measurement, one per line
+)
+
+// Step actions, as reported in the results.
+const (
+	experimentCommission = "commission"
+	experimentCommand    = "command"
+	experimentRead       = "read"
+	experimentAssert     = "assert"
+	experimentWait       = "wait"
+)
+
+// Step states.
+const (
+	experimentPassed  = "passed"
+	experimentFailed  = "failed"
+	experimentSkipped = "skipped"
+)
+
+// experimentIDPattern restricts the experiment IDs, which name files.
+var experimentIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+var (
+	errExperimentNotFound    = errors.New("experiment not found")
+	errExperimentRunNotFound = errors.New("experiment run not found")
+)
+
+// Experiment is a scripted test sequence, uploaded as YAML (or JSON) to benchmark devices the same
+// way every time, e.g.
+//
+//	id: light-latency
+//	name: Toggle latency of the simulated light
+//	steps:
+//	  - commission: {setupCode: "20202021", discriminator: "3840", as: light, reuse: true}
+//	  - toggle: {device: light, count: 50, interval: 500ms}
+//	  - read: {device: light, cluster: onoff, attribute: on-off, count: 10}
+//	  - assert: {device: light, cluster: onoff, attribute: on-off, equals: false}
+type Experiment struct {
+	ID              string           `json:"id"` // Generated when the upload has none
+	Name            string           `json:"name"`
+	Description     string           `json:"description,omitempty"`
+	ContinueOnError bool             `json:"continueOnError,omitempty"` // Run the remaining steps after a failed one
+	Steps           []ExperimentStep `json:"steps"`
+	UploadedAt      time.Time        `json:"uploadedAt,omitzero"`
+}
+
+// ExperimentStep is a step of an experiment, with exactly one action.
+type ExperimentStep struct {
+	Name       string                `json:"name,omitempty"` // Label of the step in the results
+	Commission *ExperimentCommission `json:"commission,omitempty"`
+	Toggle     *ExperimentCommand    `json:"toggle,omitempty"` // An OnOff toggle: cluster and command are implied
+	Command    *ExperimentCommand    `json:"command,omitempty"`
+	Read       *ExperimentRead       `json:"read,omitempty"`
+	Assert     *ExperimentAssert     `json:"assert,omitempty"`
+	Wait       string                `json:"wait,omitempty"` // A pause, e.g. "5s"
+}
+
+// ExperimentCommission commissions a device, like "commission_device", and names it for the next
+// steps. The time the pairing took is recorded.
+type ExperimentCommission struct {
+	SetupCode     string `json:"setupCode"`
+	Discriminator string `json:"discriminator,omitempty"`
+	VendorID      string `json:"vendorId,omitempty"`
+	ProductID     string `json:"productId,omitempty"`
+	PairingMode   string `json:"pairingMode,omitempty"` // "mdns" (default) or "address", with ipAddress and port
+	IPAddress     string `json:"ipAddress,omitempty"`
+	Port          string `json:"port,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Room          string `json:"room,omitempty"`
+	As            string `json:"as"`              // Name of the device in the next steps
+	Reuse         bool   `json:"reuse,omitempty"` // Use the registered device with this discriminator, if any, instead of pairing again
+}
+
+// payload is the "commission_device" payload of the step.
+func (c ExperimentCommission) payload() CommissionDevicePayload {
+	return CommissionDevicePayload{
+		SetupCode: c.SetupCode, LongDiscriminator: c.Discriminator, VendorID: c.VendorID, ProductID: c.ProductID,
+		PairingMode: c.PairingMode, IPAddress: c.IPAddress, Port: c.Port, Name: c.Name, Room: c.Room,
+	}
+}
+
+// ExperimentCommand sends a device command Count times (once by default), waiting Interval between
+// one finishing and the next starting. The latency of each one is recorded.
+type ExperimentCommand struct {
+	Device   string                 `json:"device"` // Device ID, or the name given by a commission step
+	Cluster  string                 `json:"cluster"`
+	Command  string                 `json:"command"`
+	Params   map[string]interface{} `json:"params,omitempty"`
+	Count    int                    `json:"count,omitempty"`
+	Interval string                 `json:"interval,omitempty"` // e.g. "500ms"
+}
+
+// ExperimentRead reads an attribute Count times (once by default), Interval apart, recording the
+// values and latencies.
+type ExperimentRead struct {
+	Device    string `json:"device"`
+	Cluster   string `json:"cluster"`
+	Attribute string `json:"attribute"`
+	Count     int    `json:"count,omitempty"`
+	Interval  string `json:"interval,omitempty"`
+}
+
+// ExperimentAssert reads an attribute and checks its value: equal to Equals, and within Min and
+// Max for numbers.
+type ExperimentAssert struct {
+	Device    string      `json:"device"`
+	Cluster   string      `json:"cluster"`
+	Attribute string      `json:"attribute"`
+	Equals    interface{} `json:"equals,omitempty"`
+	Min       *float64    `json:"min,omitempty"`
+	Max       *float64    `json:"max,omitempty"`
+}
+
+// action returns the action of the step and its label.
+func (s ExperimentStep) action() (string, string) {
+	action, label := "", ""
+	switch {
+	case s.Commission != nil:
+		action, label = experimentCommission, "commission "+s.Commission.As
+	case s.Toggle != nil:
+		action, label = experimentCommand, "toggle "+s.Toggle.Device
+	case s.Command != nil:
+		action, label = experimentCommand, fmt.Sprintf("%s.%s %s", s.Command.Cluster, s.Command.Command, s.Command.Device)
+	case s.Read != nil:
+		action, label = experimentRead, fmt.Sprintf("read %s.%s %s", s.Read.Cluster, s.Read.Attribute, s.Read.Device)
+	case s.Assert != nil:
+		action, label = experimentAssert, fmt.Sprintf("assert %s.%s %s", s.Assert.Cluster, s.Assert.Attribute, s.Assert.Device)
+	case s.Wait != "":
+		action, label = experimentWait, "wait "+s.Wait
+	}
+	if s.Name != "" {
+		label = s.Name
+	}
+	return action, label
+}
+
+// Validate implements Validator.
+func (e Experiment) Validate() error {
+	verr := &ValidationError{}
+	if e.ID != "" && !experimentIDPattern.MatchString(e.ID) {
+		verr.add("id", "must be 1 to 64 letters, digits, '-' or '_'")
+	}
+	if e.Name == "" {
+		verr.add("name", "is required")
+	}
+	if len(e.Steps) == 0 {
+		verr.add("steps", "needs at least one step")
+	}
+	for i, step := range e.Steps {
+		field := fmt.Sprintf("steps[%d]", i)
+		actions := 0
+		for _, set := range []bool{step.Commission != nil, step.Toggle != nil, step.Command != nil, step.Read != nil, step.Assert != nil, step.Wait != ""} {
+			if set {
+				actions++
+			}
+		}
+		if actions != 1 {
+			verr.add(field, "needs exactly one of commission, toggle, command, read, assert or wait")
+			continue
+		}
+		switch {
+		case step.Commission != nil:
+			if step.Commission.SetupCode == "" {
+				verr.add(field+".commission.setupCode", "is required")
+			}
+			if step.Commission.As == "" {
+				verr.add(field+".commission.as", "is required, to name the device in the next steps")
+			}
+		case step.Toggle != nil:
+			validateExperimentRepeat(verr, field+".toggle", step.Toggle.Device, step.Toggle.Count, step.Toggle.Interval)
+		case step.Command != nil:
+			validateExperimentRepeat(verr, field+".command", step.Command.Device, step.Command.Count, step.Command.Interval)
+			if step.Command.Cluster == "" || step.Command.Command == "" {
+				verr.add(field+".command", "needs cluster and command")
+			}
+		case step.Read != nil:
+			validateExperimentRepeat(verr, field+".read", step.Read.Device, step.Read.Count, step.Read.Interval)
+			if step.Read.Cluster == "" || step.Read.Attribute == "" {
+				verr.add(field+".read", "needs cluster and attribute")
+			}
+		case step.Assert != nil:
+			validateExperimentRepeat(verr, field+".assert", step.Assert.Device, 0, "")
+			if step.Assert.Cluster == "" || step.Assert.Attribute == "" {
+				verr.add(field+".assert", "needs cluster and attribute")
+			}
+			if step.Assert.Equals == nil && step.Assert.Min == nil && step.Assert.Max == nil {
+				verr.add(field+".assert", "needs equals, min or max")
+			}
+		default:
+			if _, err := parseExperimentDuration(step.Wait); err != nil {
+				verr.add(field+".wait", err.Error())
+			}
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// validateExperimentRepeat checks the device, count and interval of a step.
+func validateExperimentRepeat(verr *ValidationError, field, device string, count int, interval string) {
+	if device == "" {
+		verr.add(field+".device", "is required")
+	}
+	if count < 0 || count > maxExperimentCount {
+		verr.add(field+".count", fmt.Sprintf("must be between 1 and %d", maxExperimentCount))
+	}
+	if interval != "" {
+		if _, err := parseExperimentDuration(interval); err != nil {
+			verr.add(field+".interval", err.Error())
+		}
+	}
+}
+
+// parseExperimentDuration parses an interval or wait, e.g. "500ms" or "2m".
+func parseExperimentDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 || d > maxExperimentInterval {
+		return 0, fmt.Errorf("must be a duration like 500ms or 2s, up to %s", maxExperimentInterval)
+	}
+	return d, nil
+}
+
+// parseExperiment decodes a definition, YAML or JSON. Numbers given to the commission settings,
+// e.g. an unquoted discriminator, are taken as the strings chip-tool gets; unknown keys are errors,
+// so a misspelt setting doesn't silently change the experiment.
+func parseExperiment(source []byte) (Experiment, error) {
+	var raw interface{}
+	if err := yaml.Unmarshal(source, &raw); err != nil {
+		return Experiment{}, fmt.Errorf("invalid YAML: %w", err)
+	}
+	if top, ok := raw.(map[string]interface{}); ok {
+		steps, _ := top["steps"].([]interface{})
+		for _, step := range steps {
+			if step, ok := step.(map[string]interface{}); ok {
+				if commission, ok := step["commission"].(map[string]interface{}); ok {
+					for key, value := range commission {
+						switch value.(type) {
+						case int, float64:
+							commission[key] = fmt.Sprint(value)
+						}
+					}
+				}
+			}
+		}
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return Experiment{}, fmt.Errorf("invalid definition: %w", err)
+	}
+	var experiment Experiment
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&experiment); err != nil {
+		return Experiment{}, fmt.Errorf("invalid definition: %w", err)
+	}
+	return experiment, nil
+}
+
+// ExperimentSample is a measurement of a run: a commissioning, command, read or assertion.
+type ExperimentSample struct {
+	Step      int         `json:"step"`
+	Iteration int         `json:"iteration"`
+	Action    string      `json:"action"`
+	Device    string      `json:"device,omitempty"` // Device ID
+	Target    string      `json:"target,omitempty"` // cluster.command or cluster.attribute
+	StartedAt time.Time   `json:"startedAt"`
+	LatencyMs float64     `json:"latencyMs"`
+	Success   bool        `json:"success"`
+	Value     interface{} `json:"value,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// experimentSampleColumns are the CSV columns of samples.csv, in the order of ExperimentSample.
+var experimentSampleColumns = []string{"step", "iteration", "action", "device", "target", "startedAt", "latencyMs", "success", "value", "error"}
+
+func (s ExperimentSample) csvRecord() []string {
+	return []string{fmt.Sprint(s.Step), fmt.Sprint(s.Iteration), s.Action, s.Device, s.Target, exportTime(s.StartedAt),
+		exportValue(s.LatencyMs), fmt.Sprint(s.Success), exportValue(s.Value), s.Error}
+}
+
+// ExperimentStepResult sums up a step of a run.
+type ExperimentStepResult struct {
+	Step       int                  `json:"step"`
+	Name       string               `json:"name"`
+	Action     string               `json:"action"`
+	State      string               `json:"state"` // "passed", "failed", "cancelled" (while it ran) or "skipped"
+	Samples    int                  `json:"samples"`
+	Failures   int                  `json:"failures"`
+	Latency    *LatencyDistribution `json:"latency,omitempty"`
+	Error      string               `json:"error,omitempty"` // The first failure
+	StartedAt  time.Time            `json:"startedAt,omitzero"`
+	FinishedAt time.Time            `json:"finishedAt,omitzero"`
+}
+
+// ExperimentRun is a run of an experiment, saved as results.json next to the other artifacts.
+type ExperimentRun struct {
+	ID           string                 `json:"id"`
+	ExperimentID string                 `json:"experimentId"`
+	Name         string                 `json:"name"`
+	JobID        string                 `json:"jobId"`
+	State        string                 `json:"state"` // A job state: "running", "done", "failed" or "cancelled"
+	Error        string                 `json:"error,omitempty"`
+	Simulated    bool                   `json:"simulated"`         // Run against the simulated devices (-simulate)
+	Devices      map[string]string      `json:"devices,omitempty"` // Device IDs of the names given by commission steps
+	StartedAt    time.Time              `json:"startedAt,omitzero"`
+	FinishedAt   time.Time              `json:"finishedAt,omitzero"`
+	Steps        []ExperimentStepResult `json:"steps,omitempty"` // Left out of the run list
+	Artifacts    []string               `json:"artifacts"`
+}
+
+// ExperimentStore keeps the experiments and the artifacts of their runs on disk.
+type ExperimentStore struct {
+	dir string
+}
+
+// path returns a file of the store; the parts are checked IDs or artifact names.
+func (s *ExperimentStore) path(parts ...string) string {
+	return filepath.Join(append([]string{dataFilePath(s.dir)}, parts...)...)
+}
+
+// List returns the experiments, sorted by ID. Definitions that no longer parse are skipped.
+func (s *ExperimentStore) List() []Experiment {
+	entries, _ := os.ReadDir(s.path())
+	experiments := []Experiment{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".yaml")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		experiment, _, err := s.Get(id)
+		if err != nil {
+			log.Printf("Skipping experiment %s: %v", id, err)
+			continue
+		}
+		experiments = append(experiments, experiment)
+	}
+	return experiments
+}
+
+// Get returns an experiment and its definition as uploaded.
+func (s *ExperimentStore) Get(id string) (Experiment, []byte, error) {
+	if !experimentIDPattern.MatchString(id) {
+		return Experiment{}, nil, errExperimentNotFound
+	}
+	path := s.path(id + ".yaml")
+	source, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Experiment{}, nil, errExperimentNotFound
+	}
+	if err != nil {
+		return Experiment{}, nil, err
+	}
+	experiment, err := parseExperiment(source)
+	if err != nil {
+		return Experiment{}, nil, err
+	}
+	experiment.ID = id // The file name wins, for definitions uploaded without an ID
+	if info, err := os.Stat(path); err == nil {
+		experiment.UploadedAt = info.ModTime()
+	}
+	return experiment, source, nil
+}
+
+// Put checks and stores a definition, replacing the experiment with the same ID.
+func (s *ExperimentStore) Put(source []byte) (Experiment, error) {
+	experiment, err := parseExperiment(source)
+	if err != nil {
+		verr := &ValidationError{}
+		verr.add("definition", err.Error())
+		return experiment, verr
+	}
+	if err := experiment.Validate(); err != nil {
+		return experiment, err
+	}
+	if experiment.ID == "" {
+		experiment.ID = fmt.Sprintf("experiment-%d", time.Now().UnixNano())
+	}
+	if err := os.MkdirAll(s.path(), 0o755); err != nil {
+		return experiment, err
+	}
+	path := s.path(experiment.ID + ".yaml")
+	if err := os.WriteFile(path+".tmp", source, 0o644); err != nil {
+		return experiment, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return experiment, err
+	}
+	experiment.UploadedAt = time.Now()
+	log.Printf("Stored experiment %s (%s), %d step(s)", experiment.ID, experiment.Name, len(experiment.Steps))
+	return experiment, nil
+}
+
+// Delete removes an experiment. The artifacts of its runs are kept.
+func (s *ExperimentStore) Delete(id string) error {
+	if !experimentIDPattern.MatchString(id) {
+		return errExperimentNotFound
+	}
+	if err := os.Remove(s.path(id + ".yaml")); os.IsNotExist(err) {
+		return errExperimentNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Run queues an experiment as an "experiment" job, so it shares the job concurrency limit with the
+// other chip-tool work and can be cancelled like any job. The run and its artifacts are saved as
+// the steps complete.
+func (s *ExperimentStore) Run(id string) (ExperimentRun, error) {
+	experiment, source, err := s.Get(id)
+	if err != nil {
+		return ExperimentRun{}, err
+	}
+	run := &ExperimentRun{
+		ID:           time.Now().Format("20060102-150405.000") + "-" + experiment.ID,
+		ExperimentID: experiment.ID,
+		Name:         experiment.Name,
+		State:        jobQueued,
+		Simulated:    *simulateFlag,
+		Devices:      map[string]string{},
+		Steps:        []ExperimentStepResult{},
+		Artifacts:    []string{experimentDefinitionArtifact, experimentResultsArtifact, experimentSamplesArtifact},
+	}
+	if err := os.MkdirAll(s.path("runs", run.ID), 0o755); err != nil {
+		return ExperimentRun{}, err
+	}
+	if err := os.WriteFile(s.path("runs", run.ID, experimentDefinitionArtifact), source, 0o644); err != nil {
+		return ExperimentRun{}, err
+	}
+	s.pruneRuns()
+	job := jobs.Submit(nil, "experiment", func(ctx context.Context, job *Job) (interface{}, error) {
+		return s.execute(ctx, job, experiment, run)
+	})
+	run.JobID = job.Status().ID
+	if err := s.saveRun(run, nil); err != nil {
+		log.Printf("Could not save the results of experiment run %s: %v", run.ID, err)
+	}
+	return *run, nil
+}
+
+// Runs returns the runs whose artifacts are kept, newest first, without their steps.
+func (s *ExperimentStore) Runs() []ExperimentRun {
+	entries, _ := os.ReadDir(s.path("runs"))
+	runs := []ExperimentRun{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if run, err := s.GetRun(entries[i].Name()); err == nil {
+			run.Steps = nil
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+// GetRun returns a run, as last saved.
+func (s *ExperimentStore) GetRun(id string) (ExperimentRun, error) {
+	var run ExperimentRun
+	path, err := s.ArtifactPath(id, experimentResultsArtifact)
+	if err != nil {
+		return run, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return run, err
+	}
+	return run, json.Unmarshal(data, &run)
+}
+
+// ArtifactPath returns the file of an artifact of a run.
+func (s *ExperimentStore) ArtifactPath(runID, name string) (string, error) {
+	switch name {
+	case experimentDefinitionArtifact, experimentResultsArtifact, experimentSamplesArtifact:
+	default:
+		return "", errExperimentRunNotFound
+	}
+	if runID == "" || runID != filepath.Base(runID) || strings.HasPrefix(runID, ".") {
+		return "", errExperimentRunNotFound
+	}
+	path := s.path("runs", runID, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", errExperimentRunNotFound
+	}
+	return path, nil
+}
+
+// pruneRuns removes the oldest runs beyond maxExperimentRuns. Run IDs start with their start time,
+// so they sort oldest first.
+func (s *ExperimentStore) pruneRuns() {
+	entries, _ := os.ReadDir(s.path("runs"))
+	for len(entries) > maxExperimentRuns {
+		if err := os.RemoveAll(s.path("runs", entries[0].Name())); err != nil {
+			log.Printf("Could not remove experiment run %s: %v", entries[0].Name(), err)
+		}
+		entries = entries[1:]
+	}
+}
+
+// saveRun writes results.json and, when given, samples.csv.
+func (s *ExperimentStore) saveRun(run *ExperimentRun, samples []ExperimentSample) error {
+	if err := saveJSONFile(filepath.Join(s.dir, "runs", run.ID, experimentResultsArtifact), run); err != nil {
+		return err
+	}
+	if samples == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write(experimentSampleColumns)
+	for _, sample := range samples {
+		_ = w.Write(sample.csvRecord())
+	}
+	w.Flush()
+	path := s.path("runs", run.ID, experimentSamplesArtifact)
+	if err := os.WriteFile(path+".tmp", buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// experimentRunner runs the steps of an experiment, collecting the samples.
+type experimentRunner struct {
+	ctx     context.Context
+	run     *ExperimentRun
+	job     *Job
+	samples []ExperimentSample
+}
+
+// execute runs the steps in order, saving the results after each. A failed step stops the run
+// unless continueOnError is set; the steps left are reported as skipped.
+func (s *ExperimentStore) execute(ctx context.Context, job *Job, experiment Experiment, run *ExperimentRun) (interface{}, error) {
+	log.Printf("Running experiment %s (%s), %d step(s), as run %s", experiment.ID, experiment.Name, len(experiment.Steps), run.ID)
+	r := &experimentRunner{ctx: ctx, run: run, job: job, samples: []ExperimentSample{}}
+	run.State, run.StartedAt = jobRunning, time.Now()
+	failed := 0
+	for i, step := range experiment.Steps {
+		action, name := step.action()
+		result := ExperimentStepResult{Step: i, Name: name, Action: action}
+		if ctx.Err() != nil || (failed > 0 && !experiment.ContinueOnError) {
+			result.State = experimentSkipped
+			run.Steps = append(run.Steps, result)
+			continue
+		}
+		job.SetProgress(i*100/len(experiment.Steps), fmt.Sprintf("Step %d/%d: %s", i+1, len(experiment.Steps), name))
+		result.StartedAt = time.Now()
+		first := len(r.samples)
+		err := r.step(i, step)
+		result.FinishedAt = time.Now()
+
+		var latencies []time.Duration
+		for _, sample := range r.samples[first:] {
+			result.Samples++
+			if !sample.Success {
+				result.Failures++
+				if result.Error == "" {
+					result.Error = sample.Error
+				}
+				continue
+			}
+			latencies = append(latencies, time.Duration(sample.LatencyMs*float64(time.Millisecond)))
+		}
+		if action != experimentCommission && action != experimentWait {
+			result.Latency = latencyDistribution(latencies)
+		}
+		if err != nil && result.Error == "" {
+			result.Error = err.Error()
+		}
+		switch {
+		case ctx.Err() != nil:
+			result.State, result.Error = jobCancelled, "the run was cancelled"
+		case err != nil || result.Failures > 0:
+			result.State = experimentFailed
+			failed++
+		default:
+			result.State = experimentPassed
+		}
+		run.Steps = append(run.Steps, result)
+		if err := s.saveRun(run, r.samples); err != nil {
+			log.Printf("Could not save the results of experiment run %s: %v", run.ID, err)
+		}
+	}
+
+	run.FinishedAt = time.Now()
+	var err error
+	switch {
+	case ctx.Err() != nil:
+		run.State, err = jobCancelled, ctx.Err()
+	case failed > 0:
+		err = fmt.Errorf("%d of %d step(s) failed", failed, len(experiment.Steps))
+		run.State, run.Error = jobFailed, err.Error()
+	default:
+		run.State = jobDone
+	}
+	if err := s.saveRun(run, r.samples); err != nil {
+		log.Printf("Could not save the results of experiment run %s: %v", run.ID, err)
+	}
+	log.Printf("Experiment run %s finished: %s", run.ID, run.State)
+	result := *run
+	return result, err
+}
+
+// step runs a step. Failed measurements are samples; the error is for a step that couldn't run at
+// all, e.g. an unknown device.
+func (r *experimentRunner) step(index int, step ExperimentStep) error {
+	switch {
+	case step.Commission != nil:
+		return r.commission(index, *step.Commission)
+	case step.Toggle != nil:
+		command := *step.Toggle
+		command.Cluster, command.Command = "OnOff", "Toggle"
+		return r.command(index, command)
+	case step.Command != nil:
+		return r.command(index, *step.Command)
+	case step.Read != nil:
+		return r.read(index, *step.Read)
+	case step.Assert != nil:
+		return r.assert(index, *step.Assert)
+	}
+	d, _ := parseExperimentDuration(step.Wait)
+	return r.sleep(d)
+}
+
+// sleep waits d, unless the run is cancelled.
+func (r *experimentRunner) sleep(d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+// device resolves a device reference: a name given by a commission step, or a device ID.
+func (r *experimentRunner) device(ref string) (RegisteredDevice, error) {
+	if id, ok := r.run.Devices[ref]; ok {
+		ref = id
+	}
+	device, ok := lookupDevice(ref)
+	if !ok {
+		return device, fmt.Errorf("unknown device %q", ref)
+	}
+	return device, nil
+}
+
+// commission pairs a device, or reuses the registered one with its discriminator when asked.
+func (r *experimentRunner) commission(index int, step ExperimentCommission) error {
+	payload := step.payload()
+	if err := normalizeCommissioningPayload(&payload); err != nil {
+		return err
+	}
+	sample := ExperimentSample{Step: index, Action: experimentCommission, StartedAt: time.Now()}
+	if step.Reuse {
+		for _, device := range deviceRegistry.List() {
+			if payload.LongDiscriminator != "" && device.Discriminator == payload.LongDiscriminator && device.BridgeID == "" {
+				sample.Device, sample.Success, sample.Value = device.ID, true, "reused"
+				r.run.Devices[step.As] = device.ID
+				r.samples = append(r.samples, sample)
+				return nil
+			}
+		}
+	}
+	fillDiscoveredAddress(&payload)
+	result, err := commissionDevice(r.ctx, r.job, nil, payload)
+	sample.LatencyMs = durationMs(time.Since(sample.StartedAt))
+	if status, ok := result.(CommissioningStatusPayload); ok && err == nil {
+		sample.Device, sample.Success, sample.Value = status.NodeID, true, "commissioned"
+		r.run.Devices[step.As] = status.NodeID
+	} else if err != nil {
+		sample.Error = err.Error()
+	}
+	r.samples = append(r.samples, sample)
+	return nil
+}
+
+// command sends the command of a step as many times as asked.
+func (r *experimentRunner) command(index int, step ExperimentCommand) error {
+	device, err := r.device(step.Device)
+	if err != nil {
+		return err
+	}
+	interval, _ := parseExperimentDuration(step.Interval)
+	for i := range max(step.Count, 1) {
+		if i > 0 {
+			if err := r.sleep(interval); err != nil {
+				return err
+			}
+		}
+		sample := ExperimentSample{Step: index, Iteration: i, Action: experimentCommand, Device: device.ID,
+			Target: step.Cluster + "." + step.Command, StartedAt: time.Now()}
+		// Force, so the commands are sent even when the cached state says they change nothing
+		success, errMsg, _ := runMacroStep(nil, DeviceCommandPayload{DeviceID: device.ID, Cluster: step.Cluster, Command: step.Command, Params: step.Params, Force: true})
+		sample.LatencyMs, sample.Success, sample.Error = durationMs(time.Since(sample.StartedAt)), success, errMsg
+		r.samples = append(r.samples, sample)
+	}
+	return nil
+}
+
+// readValue reads an attribute of a device into a sample.
+func (r *experimentRunner) readValue(index, iteration int, action string, device RegisteredDevice, cluster, attribute string) ExperimentSample {
+	sample := ExperimentSample{Step: index, Iteration: iteration, Action: action, Device: device.ID, Target: cluster + "." + attribute, StartedAt: time.Now()}
+	value, err := readAttributeValue(device.NodeID, device.EndpointID, cluster, attribute)
+	sample.LatencyMs = durationMs(time.Since(sample.StartedAt))
+	if err != nil {
+		sample.Error = err.Error()
+	} else {
+		sample.Success, sample.Value = true, value
+	}
+	return sample
+}
+
+// read reads the attribute of a step as many times as asked.
+func (r *experimentRunner) read(index int, step ExperimentRead) error {
+	device, err := r.device(step.Device)
+	if err != nil {
+		return err
+	}
+	if device.Remote != "" {
+		return fmt.Errorf("device %s is on remote hub %s; only local devices can be read", device.ID, device.Remote)
+	}
+	interval, _ := parseExperimentDuration(step.Interval)
+	for i := range max(step.Count, 1) {
+		if i > 0 {
+			if err := r.sleep(interval); err != nil {
+				return err
+			}
+		}
+		r.samples = append(r.samples, r.readValue(index, i, experimentRead, device, step.Cluster, step.Attribute))
+	}
+	return nil
+}
+
+// assert reads the attribute of a step and checks its value.
+func (r *experimentRunner) assert(index int, step ExperimentAssert) error {
+	device, err := r.device(step.Device)
+	if err != nil {
+		return err
+	}
+	if device.Remote != "" {
+		return fmt.Errorf("device %s is on remote hub %s; only local devices can be read", device.ID, device.Remote)
+	}
+	sample := r.readValue(index, 0, experimentAssert, device, step.Cluster, step.Attribute)
+	if sample.Success {
+		if reason := experimentMismatch(sample.Value, step); reason != "" {
+			sample.Success, sample.Error = false, reason
+		}
+	}
+	r.samples = append(r.samples, sample)
+	return nil
+}
+
+// experimentMismatch explains why a value fails an assertion, or returns "" when it passes. Numbers
+// compare by value, so equals: 1 matches 1.0; other values by their text.
+func experimentMismatch(value interface{}, step ExperimentAssert) string {
+	if step.Equals != nil {
+		want, wantNumber := toFloat(step.Equals)
+		got, gotNumber := toFloat(value)
+		_, wantBool := step.Equals.(bool)
+		equal := fmt.Sprint(value) == fmt.Sprint(step.Equals) || reflect.DeepEqual(value, step.Equals)
+		if wantNumber && gotNumber && !wantBool {
+			equal = got == want
+		}
+		if !equal {
+			return fmt.Sprintf("got %s, want %s", exportValue(value), exportValue(step.Equals))
+		}
+	}
+	if step.Min == nil && step.Max == nil {
+		return ""
+	}
+	got, ok := toFloat(value)
+	if !ok {
+		return fmt.Sprintf("got %s, want a number", exportValue(value))
+	}
+	if step.Min != nil && got < *step.Min {
+		return fmt.Sprintf("got %s, want at least %s", exportValue(got), exportValue(*step.Min))
+	}
+	if step.Max != nil && got > *step.Max {
+		return fmt.Sprintf("got %s, want at most %s", exportValue(got), exportValue(*step.Max))
+	}
+	return ""
+}
+
+// experimentErrorStatus maps an experiment store error to its HTTP status.
+func experimentErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errExperimentNotFound), errors.Is(err, errExperimentRunNotFound):
+		return http.StatusNotFound
+	case errors.As(err, new(*ValidationError)):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// registerExperimentRoutes adds the experiment runner to an API version group:
+//   - GET and POST /experiments list and upload experiments (a YAML or JSON body, replacing the
+//     experiment with the same ID); GET and DELETE /experiments/:id, ?format=yaml for the
+//     definition as uploaded;
+//   - POST /experiments/:id/run starts a run as a job;
+//   - GET /experiment-runs and /experiment-runs/:id give the runs and their results, and
+//     /experiment-runs/:id/artifacts/:name downloads experiment.yaml, results.json or samples.csv.
+func registerExperimentRoutes(api *gin.RouterGroup) {
+	api.GET("/experiments", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"experiments": experiments.List()})
+	})
+	api.POST("/experiments", func(c *gin.Context) {
+		source, err := io.ReadAll(io.LimitReader(c.Request.Body, maxExperimentBytes+1))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(source) > maxExperimentBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("the definition is larger than %d bytes", maxExperimentBytes)})
+			return
+		}
+		experiment, err := experiments.Put(source)
+		if verr, ok := err.(*ValidationError); ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": verr.Fields})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, experiment)
+	})
+	api.GET("/experiments/:id", func(c *gin.Context) {
+		experiment, source, err := experiments.Get(c.Param("id"))
+		if err != nil {
+			c.JSON(experimentErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		if c.Query("format") == "yaml" {
+			c.Data(http.StatusOK, "application/yaml; charset=utf-8", source)
+			return
+		}
+		c.JSON(http.StatusOK, experiment)
+	})
+	api.DELETE("/experiments/:id", func(c *gin.Context) {
+		if err := experiments.Delete(c.Param("id")); err != nil {
+			c.JSON(experimentErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+	api.POST("/experiments/:id/run", func(c *gin.Context) {
+		if rejectReadOnlyREST(c, "Running an experiment") {
+			return
+		}
+		run, err := experiments.Run(c.Param("id"))
+		if err != nil {
+			c.JSON(experimentErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, run)
+	})
+
+	api.GET("/experiment-runs", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"runs": experiments.Runs()})
+	})
+	api.GET("/experiment-runs/:id", func(c *gin.Context) {
+		run, err := experiments.GetRun(c.Param("id"))
+		if err != nil {
+			c.JSON(experimentErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, run)
+	})
+	api.GET("/experiment-runs/:id/artifacts/:name", func(c *gin.Context) {
+		path, err := experiments.ArtifactPath(c.Param("id"), c.Param("name"))
+		if err != nil {
+			c.JSON(experimentErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.FileAttachment(path, c.Param("id")+"-"+c.Param("name"))
+	})
+}
+
+var experiments = &ExperimentStore{dir: experimentsDir}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportDateLayout is the date-only form accepted for the bounds of a telemetry export.
+const exportDateLayout = "2006-01-02"
+
+// InventoryRow is a device of the inventory export.
+type InventoryRow struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	Room            string    `json:"room"`
+	NodeID          string    `json:"nodeId"`
+	EndpointID      string    `json:"endpointId"`
+	VendorID        string    `json:"vendorId"`
+	ProductID       string    `json:"productId"`
+	DeviceTypes     []uint32  `json:"deviceTypes"`
+	SoftwareVersion string    `json:"softwareVersion"`
+	HardwareVersion string    `json:"hardwareVersion"`
+	SerialNumber    string    `json:"serialNumber"`
+	BridgeID        string    `json:"bridgeId"`
+	Remote          string    `json:"remote"` // Remote hub of federated devices (see federation.go)
+	Reachable       bool      `json:"reachable"`
+	Health          string    `json:"health"`
+	Orphaned        bool      `json:"orphaned"`
+	BatteryPercent  *float64  `json:"batteryPercent"`
+	Address         string    `json:"address"`
+	LastSeen        time.Time `json:"lastSeen,omitzero"`
+}
+
+// inventoryColumns are the CSV columns of the inventory export, in the order of InventoryRow.
+var inventoryColumns = []string{"id", "name", "room", "nodeId", "endpointId", "vendorId", "productId", "deviceTypes", "softwareVersion",
+	"hardwareVersion", "serialNumber", "bridgeId", "remote", "reachable", "health", "orphaned", "batteryPercent", "address", "lastSeen"}
+
+func (r InventoryRow) csvRecord() []string {
+	deviceTypes := make([]string, len(r.DeviceTypes))
+	for i, deviceType := range r.DeviceTypes {
+		deviceTypes[i] = strconv.FormatUint(uint64(deviceType), 10)
+	}
+	battery := ""
+	if r.BatteryPercent != nil {
+		battery = exportValue(*r.BatteryPercent)
+	}
+	return []string{r.ID, r.Name, r.Room, r.NodeID, r.EndpointID, r.VendorID, r.ProductID, strings.Join(deviceTypes, ";"), r.SoftwareVersion,
+		r.HardwareVersion, r.SerialNumber, r.BridgeID, r.Remote, strconv.FormatBool(r.Reachable), r.Health, strconv.FormatBool(r.Orphaned),
+		battery, r.Address, exportTime(r.LastSeen)}
+}
+
+// TelemetryRow is an attribute sample of the telemetry export.
+type TelemetryRow struct {
+	Timestamp  time.Time   `json:"timestamp"`
+	DeviceID   string      `json:"deviceId"`
+	DeviceName string      `json:"deviceName"`
+	Room       string      `json:"room"`
+	NodeID     string      `json:"nodeId"`
+	EndpointID string      `json:"endpointId"`
+	Cluster    string      `json:"cluster"`
+	Attribute  string      `json:"attribute"`
+	Value      interface{} `json:"value"`
+	RawValue   interface{} `json:"rawValue"`
+	Unit       string      `json:"unit"`
+}
+
+// telemetryColumns are the CSV columns of the telemetry export, in the order of TelemetryRow.
+var telemetryColumns = []string{"timestamp", "deviceId", "deviceName", "room", "nodeId", "endpointId", "cluster", "attribute", "value", "rawValue", "unit"}
+
+func (r TelemetryRow) csvRecord() []string {
+	return []string{exportTime(r.Timestamp), r.DeviceID, r.DeviceName, r.Room, r.NodeID, r.EndpointID, r.Cluster, r.Attribute,
+		exportValue(r.Value), exportValue(r.RawValue), r.Unit}
+}
+
+// exportValue formats a value for a CSV cell: numbers and booleans as such, structured values as JSON.
+func exportValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32, int, int64, uint64, uint32, int32:
+		return fmt.Sprint(v)
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// exportTime formats a time for a CSV cell, in RFC 3339 with milliseconds, or empty when unknown.
+func exportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+// ExportQuery is the query of the export endpoints. The telemetry export takes the bounds and
+// filters; the inventory export only the format.
+type ExportQuery struct {
+	Format    string // "json" (default) or "csv"; Accept: text/csv also selects CSV
+	From      string // RFC 3339 time, or a local date (YYYY-MM-DD) for its start
+	To        string // RFC 3339 time, or a local date (YYYY-MM-DD) for its end
+	DeviceID  string
+	NodeID    string
+	Cluster   string // Case-insensitive, so "OnOff" also matches the chip-tool name "onoff"
+	Attribute string
+}
+
+// Validate implements Validator.
+func (q ExportQuery) Validate() error {
+	verr := &ValidationError{}
+	switch q.Format {
+	case "", "json", "csv":
+	default:
+		verr.add("format", "must be json or csv")
+	}
+	from, fromErr := parseExportBound(q.From, false)
+	if fromErr != nil {
+		verr.add("from", fromErr.Error())
+	}
+	to, toErr := parseExportBound(q.To, true)
+	if toErr != nil {
+		verr.add("to", toErr.Error())
+	}
+	if fromErr == nil && toErr == nil && !from.IsZero() && !to.IsZero() && from.After(to) {
+		verr.add("from", "must not be after to")
+	}
+	if q.DeviceID != "" {
+		if _, ok := lookupDevice(q.DeviceID); !ok {
+			verr.add("deviceId", fmt.Sprintf("unknown device %q", q.DeviceID))
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// parseExportBound parses a bound of the telemetry range. A date stands for its first instant,
+// or for its last one when it ends the range.
+func parseExportBound(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	day, err := time.ParseInLocation(exportDateLayout, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("must be an RFC 3339 time like 2024-01-31T18:00:00Z or a date like 2024-01-31")
+	}
+	if end {
+		return day.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	return day, nil
+}
+
+// exportInventory lists the devices, local and remote, sorted by ID.
+func exportInventory() []InventoryRow {
+	devices := listDevices()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	rows := make([]InventoryRow, 0, len(devices))
+	for _, device := range devices {
+		row := InventoryRow{
+			ID: device.ID, Name: device.Name, Room: device.Room, NodeID: device.NodeID, EndpointID: device.EndpointID,
+			VendorID: device.VendorID, ProductID: device.ProductID, DeviceTypes: device.DeviceTypes, BridgeID: device.BridgeID,
+			Remote: device.Remote, Reachable: device.Reachable, Health: device.Health, Orphaned: device.Orphaned,
+			Address: device.Address, LastSeen: device.LastSeen,
+		}
+		if row.DeviceTypes == nil {
+			row.DeviceTypes = []uint32{}
+		}
+		if version := device.Version; version != nil {
+			row.SoftwareVersion, row.HardwareVersion, row.SerialNumber = version.SoftwareVersionString, version.HardwareVersionString, version.SerialNumber
+			if row.SoftwareVersion == "" && version.SoftwareVersion != nil {
+				row.SoftwareVersion = strconv.FormatUint(*version.SoftwareVersion, 10)
+			}
+			if row.HardwareVersion == "" && version.HardwareVersion != nil {
+				row.HardwareVersion = strconv.FormatUint(*version.HardwareVersion, 10)
+			}
+		}
+		if device.Battery != nil {
+			row.BatteryPercent = device.Battery.Percent
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// exportTelemetry lists the recorded samples matching the query, by attribute then time. Only the
+// samples still in the attribute history are available (see retention).
+func exportTelemetry(q ExportQuery) []TelemetryRow {
+	from, _ := parseExportBound(q.From, false)
+	to, _ := parseExportBound(q.To, true)
+	nodeID, endpointID := q.NodeID, ""
+	if q.DeviceID != "" {
+		device, _ := lookupDevice(q.DeviceID)
+		nodeID, endpointID = device.NodeID, device.EndpointID
+	}
+	series := attributeHistory.Range(func(key string) bool {
+		parts := strings.SplitN(key, "/", 4)
+		return len(parts) == 4 && (nodeID == "" || parts[0] == nodeID) && (endpointID == "" || parts[1] == endpointID) &&
+			(q.Cluster == "" || strings.EqualFold(parts[2], q.Cluster)) && (q.Attribute == "" || parts[3] == q.Attribute)
+	}, from, to)
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	rows := []TelemetryRow{}
+	for _, key := range keys {
+		parts := strings.SplitN(key, "/", 4)
+		base := TelemetryRow{NodeID: parts[0], EndpointID: parts[1], Cluster: parts[2], Attribute: parts[3]}
+		if id, ok := deviceIDForTarget(base.NodeID, base.EndpointID); ok {
+			base.DeviceID = id
+			if device, ok := lookupDevice(id); ok {
+				base.DeviceName, base.Room = device.Name, device.Room
+			}
+		}
+		if state, ok := stateCache.Get(base.NodeID, base.EndpointID, base.Cluster, base.Attribute); ok {
+			base.Unit = state.Unit
+		}
+		for _, point := range series[key] {
+			row := base
+			row.Timestamp, row.Value, row.RawValue = point.Timestamp, point.Value, point.RawValue
+			if row.Unit == "" && point.Reading != nil {
+				row.Unit = point.Reading.Unit
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// wantsCSV reports whether an export request asks for CSV, with format=csv or Accept: text/csv.
+func wantsCSV(c *gin.Context, format string) bool {
+	return format == "csv" || (format == "" && strings.Contains(c.GetHeader("Accept"), "text/csv"))
+}
+
+// writeCSVExport sends a CSV attachment named <name>-<time>.csv.
+func writeCSVExport(c *gin.Context, name string, header []string, records [][]string) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.csv"`, name, time.Now().Format("20060102-150405")))
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	_ = w.Write(header)
+	_ = w.WriteAll(records)
+}
+
+// registerExportRoutes adds GET /export/devices and GET /export/telemetry to an API version group:
+// the device inventory and the recorded attribute samples, as JSON or CSV for spreadsheets and
+// notebooks, e.g. /api/v1/export/telemetry?format=csv&from=2024-01-01&to=2024-01-31&cluster=TemperatureMeasurement.
+func registerExportRoutes(api *gin.RouterGroup) {
+	api.GET("/export/devices", func(c *gin.Context) {
+		query := ExportQuery{Format: c.Query("format")}
+		if err := query.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": err.(*ValidationError).Fields})
+			return
+		}
+		rows := exportInventory()
+		if !wantsCSV(c, query.Format) {
+			c.JSON(http.StatusOK, gin.H{"exportedAt": time.Now(), "devices": rows})
+			return
+		}
+		records := make([][]string, len(rows))
+		for i, row := range rows {
+			records[i] = row.csvRecord()
+		}
+		writeCSVExport(c, "devices", inventoryColumns, records)
+	})
+
+	api.GET("/export/telemetry", func(c *gin.Context) {
+		query := ExportQuery{
+			Format: c.Query("format"), From: c.Query("from"), To: c.Query("to"), DeviceID: c.Query("deviceId"),
+			NodeID: c.Query("nodeId"), Cluster: c.Query("cluster"), Attribute: c.Query("attribute"),
+		}
+		if err := query.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": err.(*ValidationError).Fields})
+			return
+		}
+		rows := exportTelemetry(query)
+		if !wantsCSV(c, query.Format) {
+			c.JSON(http.StatusOK, gin.H{"exportedAt": time.Now(), "count": len(rows), "samples": rows})
+			return
+		}
+		records := make([][]string, len(rows))
+		for i, row := range rows {
+			records[i] = row.csvRecord()
+		}
+		writeCSVExport(c, "telemetry", telemetryColumns, records)
+	})
+}
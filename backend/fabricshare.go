@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Enhanced commissioning window limits (Matter spec): the timeout is 3 to 15 minutes, the PBKDF
+// iteration count 1000 to 100000.
+const (
+	defaultShareWindowSeconds = 900
+	minShareWindowSeconds     = 180
+	maxShareWindowSeconds     = 900
+	shareWindowIterations     = 1000
+)
+
+// ExportFabricSharePayload is the payload of "export_fabric_share". Without deviceIds, every
+// registered node is shared.
+type ExportFabricSharePayload struct {
+	DeviceIDs     []string `json:"deviceIds,omitempty"`
+	WindowSeconds int      `json:"windowSeconds,omitempty"` // How long each window stays open; default 900
+}
+
+// Validate implements Validator.
+func (p ExportFabricSharePayload) Validate() error {
+	if p.WindowSeconds != 0 && (p.WindowSeconds < minShareWindowSeconds || p.WindowSeconds > maxShareWindowSeconds) {
+		verr := &ValidationError{}
+		verr.add("windowSeconds", fmt.Sprintf("must be between %d and %d", minShareWindowSeconds, maxShareWindowSeconds))
+		return verr
+	}
+	return nil
+}
+
+// FabricShareEntry is the share code of one node. Bridged devices are shared with their bridge.
+type FabricShareEntry struct {
+	NodeID        string    `json:"nodeId"`
+	DeviceIDs     []string  `json:"deviceIds"` // Registry devices shared by this window: the node and its bridged devices
+	Name          string    `json:"name,omitempty"`
+	Room          string    `json:"room,omitempty"`
+	VendorID      string    `json:"vendorId,omitempty"`
+	ProductID     string    `json:"productId,omitempty"`
+	Discriminator int       `json:"discriminator"`
+	ManualCode    string    `json:"manualCode,omitempty"`
+	QRCode        string    `json:"qrCode,omitempty"`
+	OpenedAt      time.Time `json:"openedAt,omitzero"`
+	ExpiresAt     time.Time `json:"expiresAt,omitzero"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// FabricShareReport is sent as "fabric_share_report" to the client that asked, and served by
+// GET /api/admin/fabric-share until the next export. It holds setup codes, so it never goes
+// through the broadcast job updates or the audit log.
+type FabricShareReport struct {
+	GeneratedAt   time.Time          `json:"generatedAt"`
+	WindowSeconds int                `json:"windowSeconds"`
+	Entries       []FabricShareEntry `json:"entries"`
+	Opened        int                `json:"opened"`
+	Failed        int                `json:"failed"`
+}
+
+// reManualPairingCode and reSetupQRCode match the codes chip-tool prints for a new window, e.g.
+// "[CTL] Manual pairing code: [36217551633]" and "[CTL] SetupQRCode: [MT:4CT9142C00KA0648G00]".
+var (
+	reManualPairingCode = regexp.MustCompile(`Manual pairing code: \[(\d+)\]`)
+	reSetupQRCode       = regexp.MustCompile(`SetupQRCode: \[(MT:[0-9A-Z.\-]+)\]`)
+)
+
+// shareDiscriminator picks a random 12-bit discriminator for a window.
+func shareDiscriminator() int {
+	var b [2]byte
+	randomBytes(b[:])
+	return int(binary.BigEndian.Uint16(b[:]) & 0xFFF)
+}
+
+// fabricShareEntries groups the selected registry devices by node, bridged devices with their
+// bridge, sorted by node ID. Unknown device IDs are an error.
+func fabricShareEntries(deviceIDs []string) ([]FabricShareEntry, error) {
+	devices := deviceRegistry.List()
+	selected := make(map[string]bool)
+	for _, id := range deviceIDs {
+		device, ok := deviceRegistry.Get(id)
+		if !ok {
+			return nil, fmt.Errorf("unknown device %q", id)
+		}
+		selected[device.NodeID] = true
+	}
+	byNode := make(map[string]*FabricShareEntry)
+	for _, device := range devices {
+		if device.NodeID == "" || (len(deviceIDs) > 0 && !selected[device.NodeID]) {
+			continue
+		}
+		entry, ok := byNode[device.NodeID]
+		if !ok {
+			entry = &FabricShareEntry{NodeID: device.NodeID}
+			byNode[device.NodeID] = entry
+		}
+		entry.DeviceIDs = append(entry.DeviceIDs, device.ID)
+		if device.BridgeID == "" {
+			entry.Name, entry.Room, entry.VendorID, entry.ProductID = device.Name, device.Room, device.VendorID, device.ProductID
+		}
+	}
+	entries := make([]FabricShareEntry, 0, len(byNode))
+	for _, entry := range byNode {
+		sort.Strings(entry.DeviceIDs)
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, _ := strconv.ParseUint(entries[i].NodeID, 10, 64)
+		b, _ := strconv.ParseUint(entries[j].NodeID, 10, 64)
+		return a < b
+	})
+	return entries, nil
+}
+
+// openShareWindow opens an enhanced commissioning window on a node with a new random passcode and
+// fills in the codes chip-tool prints for it. The run isn't traced, as its output holds the codes.
+func openShareWindow(entry *FabricShareEntry, windowSeconds int) {
+	entry.Discriminator = shareDiscriminator()
+	args := []string{"pairing", "open-commissioning-window", entry.NodeID, "1", strconv.Itoa(windowSeconds), strconv.Itoa(shareWindowIterations), strconv.Itoa(entry.Discriminator)}
+	started := time.Now()
+	stdout, stderr, err := runChipTool(args...)
+	if chipToolFailed(stdout, stderr, err) {
+		entry.Error = fmt.Sprintf("opening the commissioning window failed: %v %s", err, strings.TrimSpace(stderr))
+		return
+	}
+	output := stripAnsi(stdout)
+	if m := reManualPairingCode.FindStringSubmatch(output); m != nil {
+		entry.ManualCode = m[1]
+	}
+	if m := reSetupQRCode.FindStringSubmatch(output); m != nil {
+		entry.QRCode = m[1]
+	}
+	if entry.ManualCode == "" && entry.QRCode == "" {
+		entry.Error = "the window opened, but chip-tool printed no setup code"
+		return
+	}
+	entry.OpenedAt = started
+	entry.ExpiresAt = started.Add(time.Duration(windowSeconds) * time.Second)
+}
+
+// FabricShare exports the commissioned devices for another controller: it opens their
+// commissioning windows one after the other and collects the share codes in one report.
+type FabricShare struct {
+	mu   sync.Mutex
+	last *FabricShareReport
+}
+
+// Start queues a "fabric_share" job. The job result only counts the windows; the report with the
+// codes goes to the client.
+func (f *FabricShare) Start(client *Client, payload ExportFabricSharePayload) (*Job, error) {
+	entries, err := fabricShareEntries(payload.DeviceIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no commissioned device to share")
+	}
+	windowSeconds := payload.WindowSeconds
+	if windowSeconds == 0 {
+		windowSeconds = defaultShareWindowSeconds
+	}
+	return jobs.Submit(client, "fabric_share", func(ctx context.Context, job *Job) (interface{}, error) {
+		report := FabricShareReport{WindowSeconds: windowSeconds, Entries: entries}
+		for i := range report.Entries {
+			entry := &report.Entries[i]
+			if ctx.Err() != nil {
+				entry.Error = "cancelled"
+				report.Failed++
+				continue
+			}
+			job.SetProgress(i*100/len(report.Entries), fmt.Sprintf("Opening the commissioning window of node %s", entry.NodeID))
+			openShareWindow(entry, windowSeconds)
+			if entry.Error != "" {
+				log.Printf("Fabric share: node %s: %s", entry.NodeID, entry.Error)
+				report.Failed++
+			} else {
+				report.Opened++
+			}
+		}
+		report.GeneratedAt = time.Now()
+		f.mu.Lock()
+		f.last = &report
+		f.mu.Unlock()
+		client.audit("fabric_share_report", map[string]interface{}{"opened": report.Opened, "failed": report.Failed, "windowSeconds": windowSeconds})
+		client.sendPayload("fabric_share_report", report)
+		summary := map[string]int{"opened": report.Opened, "failed": report.Failed}
+		if ctx.Err() != nil {
+			return summary, ctx.Err()
+		}
+		if report.Failed > 0 {
+			return summary, fmt.Errorf("could not open the window of %d of %d node(s)", report.Failed, len(report.Entries))
+		}
+		return summary, nil
+	}), nil
+}
+
+// Last returns the last report, with windows that may have closed since.
+func (f *FabricShare) Last() (FabricShareReport, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.last == nil {
+		return FabricShareReport{}, false
+	}
+	return *f.last, true
+}
+
+func handleExportFabricShare(client *Client, payload ExportFabricSharePayload) {
+	if _, err := fabricShare.Start(client, payload); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "export_fabric_share failed: " + err.Error()})
+	}
+}
+
+var fabricShare = &FabricShare{}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// chipToolStorageGlobs locate chip-tool's INI storage when the config doesn't set chipToolStorageDir:
+// chip-tool writes to /tmp, which the snap confines to its private /tmp.
+var chipToolStorageGlobs = []string{
+	"/tmp/chip_tool_*.ini",
+	"/tmp/snap-private-tmp/snap.chip-tool/tmp/chip_tool_*.ini",
+}
+
+// reSessionResumptionKey matches the CASE session resumption keys chip-tool keeps for each node it
+// has an operational session with: "f/<fabric index>/s/<node ID as 16 hex digits>".
+var reSessionResumptionKey = regexp.MustCompile(`^f/[0-9a-fA-F]+/s/([0-9a-fA-F]{16})=`)
+
+// Fabric discrepancy kinds.
+const (
+	discrepancyMissingFromFabric   = "missing_from_fabric"   // Registry device unknown to chip-tool
+	discrepancyMissingFromRegistry = "missing_from_registry" // Node known to chip-tool but not in the registry
+)
+
+// FabricFix is a fix offered for a discrepancy: a WebSocket message the client can send as is.
+type FabricFix struct {
+	Label   string      `json:"label"`
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// FabricDiscrepancy is a difference between the device registry and chip-tool's fabric state.
+type FabricDiscrepancy struct {
+	Kind     string      `json:"kind"`
+	NodeID   string      `json:"nodeId"`
+	DeviceID string      `json:"deviceId,omitempty"`
+	Message  string      `json:"message"`
+	Fixes    []FabricFix `json:"fixes"`
+}
+
+// FabricCheckReport is sent in "fabric_discrepancies" messages.
+type FabricCheckReport struct {
+	CheckedAt     time.Time           `json:"checkedAt"`
+	Sources       []string            `json:"sources"`     // Where fabric nodes were found
+	FabricNodes   []string            `json:"fabricNodes"` // Decimal node IDs
+	Discrepancies []FabricDiscrepancy `json:"discrepancies"`
+	Error         string              `json:"error,omitempty"`
+}
+
+// chipToolStorageFiles returns the chip-tool storage files to read.
+func chipToolStorageFiles() []string {
+	globs := chipToolStorageGlobs
+	if dir := chipToolStorageDir(); dir != "" {
+		globs = []string{filepath.Join(dir, "chip_tool_*.ini")}
+	}
+	var files []string
+	for _, pattern := range globs {
+		matches, _ := filepath.Glob(pattern)
+		files = append(files, matches...)
+	}
+	return files
+}
+
+// storedFabricNodes returns the decimal IDs of the nodes chip-tool has session data for.
+func storedFabricNodes() ([]string, error) {
+	files := chipToolStorageFiles()
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no chip-tool storage found")
+	}
+	var nodes []string
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			m := reSessionResumptionKey.FindStringSubmatch(scanner.Text())
+			if m == nil {
+				continue
+			}
+			if id, err := strconv.ParseUint(m[1], 16, 64); err == nil && !containsString(nodes, strconv.FormatUint(id, 10)) {
+				nodes = append(nodes, strconv.FormatUint(id, 10))
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading %s: %v", path, err)
+		}
+	}
+	return nodes, nil
+}
+
+// FabricSync compares the device registry with the nodes chip-tool knows on its fabric.
+type FabricSync struct {
+	mu   sync.Mutex
+	last FabricCheckReport
+}
+
+// NewFabricSync creates a FabricSync that hasn't checked yet.
+func NewFabricSync() *FabricSync {
+	return &FabricSync{}
+}
+
+// Check collects the fabric nodes from chip-tool's storage and the operational advertisements on our
+// fabric, and reports the differences with the registry. Registry devices are only reported missing
+// when chip-tool's storage could be read: a node that doesn't advertise may just be offline.
+func (f *FabricSync) Check() FabricCheckReport {
+	report := FabricCheckReport{CheckedAt: time.Now(), Discrepancies: []FabricDiscrepancy{}}
+	registered := deviceRegistry.List()
+
+	stored, storageErr := storedFabricNodes()
+	if storageErr == nil {
+		report.Sources = append(report.Sources, "chip-tool storage")
+	}
+	fabricNodes := stored
+	instances, browseErr := browseOperationalNodes()
+	if browseErr == nil {
+		report.Sources = append(report.Sources, "operational discovery")
+		ourFabric := ourCompressedFabricID(instances, registered)
+		for _, inst := range instances {
+			if ourFabric != "" && inst.CompressedFabricID == ourFabric && !containsString(fabricNodes, inst.NodeID) {
+				fabricNodes = append(fabricNodes, inst.NodeID)
+			}
+		}
+	}
+	if storageErr != nil && browseErr != nil {
+		report.Error = fmt.Sprintf("fabric state unavailable: %v; %v", storageErr, browseErr)
+		f.store(report)
+		return report
+	}
+	sort.Strings(fabricNodes)
+	report.FabricNodes = fabricNodes
+
+	onFabric := func(nodeID string) bool {
+		for _, n := range fabricNodes {
+			if sameNodeID(n, nodeID) {
+				return true
+			}
+		}
+		return false
+	}
+	if storageErr == nil {
+		for _, device := range registered {
+			if device.BridgeID != "" || onFabric(device.NodeID) {
+				continue
+			}
+			report.Discrepancies = append(report.Discrepancies, FabricDiscrepancy{
+				Kind:     discrepancyMissingFromFabric,
+				NodeID:   device.NodeID,
+				DeviceID: device.ID,
+				Message:  fmt.Sprintf("Device %s (node %s) is in the registry but chip-tool doesn't know the node.", device.ID, device.NodeID),
+				Fixes: []FabricFix{
+					{Label: "Remove from registry", Type: "remove_device", Payload: RemoveDevicePayload{DeviceID: device.ID, LocalOnly: true}},
+					{Label: "Diagnose", Type: "diagnose_device", Payload: DiagnoseDevicePayload{DeviceID: device.ID}},
+				},
+			})
+		}
+	}
+	for _, nodeID := range fabricNodes {
+		known := false
+		for _, device := range registered {
+			if sameNodeID(device.NodeID, nodeID) {
+				known = true
+				break
+			}
+		}
+		if known {
+			continue
+		}
+		report.Discrepancies = append(report.Discrepancies, FabricDiscrepancy{
+			Kind:    discrepancyMissingFromRegistry,
+			NodeID:  nodeID,
+			Message: fmt.Sprintf("Node %s is on the fabric but not in the registry.", nodeID),
+			Fixes: []FabricFix{
+				{Label: "Add to registry", Type: "adopt_node", Payload: FabricNodePayload{NodeID: nodeID}},
+				{Label: "Unpair from fabric", Type: "unpair_node", Payload: FabricNodePayload{NodeID: nodeID}},
+			},
+		})
+	}
+	log.Printf("Fabric check: %d fabric node(s) from %v, %d discrepancies", len(fabricNodes), report.Sources, len(report.Discrepancies))
+	f.store(report)
+	return report
+}
+
+func (f *FabricSync) store(report FabricCheckReport) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.last = report
+}
+
+// Last returns the report of the latest check.
+func (f *FabricSync) Last() FabricCheckReport {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.last
+}
+
+var fabricSync = NewFabricSync()
+
+// startFabricCheck runs a fabric check as a background job, sending the report to client or, for the
+// check at startup (nil client), broadcasting it when there are discrepancies.
+func startFabricCheck(client *Client) {
+	jobs.Submit(client, "fabric_check", func(ctx context.Context, job *Job) (interface{}, error) {
+		report := fabricSync.Check()
+		if client != nil {
+			client.sendPayload("fabric_discrepancies", report)
+		} else if len(report.Discrepancies) > 0 {
+			broadcastToClients("fabric_discrepancies", report)
+		}
+		if report.Error != "" {
+			return report, fmt.Errorf("%s", report.Error)
+		}
+		return report, nil
+	})
+}
+
+// adoptNode adds a node found on the fabric to the registry, with the first endpoint of its parts list.
+func adoptNode(client *Client, nodeID string) (RegisteredDevice, error) {
+	introspectionCache.Invalidate(nodeID, "adopted")
+	parts, err := readDescriptorList(nodeID, "0", "parts-list")
+	if err != nil {
+		return RegisteredDevice{}, err
+	}
+	if len(parts) == 0 {
+		return RegisteredDevice{}, fmt.Errorf("node %s has no application endpoint", nodeID)
+	}
+	device := RegisteredDevice{
+		ID:         nodeID,
+		NodeID:     nodeID,
+		EndpointID: strconv.FormatUint(uint64(parts[0]), 10),
+		Name:       "Node " + nodeID,
+		Reachable:  true,
+	}
+	if err := deviceRegistry.Put(device); err != nil {
+		return device, err
+	}
+	if registered, ok := deviceRegistry.Get(device.ID); ok {
+		broadcastToClients("device_added", registered)
+	}
+	client.notifyClientLog("commissioning_log", fmt.Sprintf("Node %s added to the registry with endpoint %s", nodeID, device.EndpointID))
+	go func() {
+		discoverBridgedDevices(client, nodeID)
+		refreshDeviceComposition(client, nodeID)
+	}()
+	return device, nil
+}
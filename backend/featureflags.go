@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// featureFlagsFile is where the runtime toggles are persisted, relative to the data directory.
+const featureFlagsFile = "feature_flags.json"
+
+// Feature flags, gating the experimental subsystems.
+const (
+	featureNativeController = "nativeController" // The matter-server controller (controller.type)
+	featureMQTTBridge       = "mqttBridge"       // Publishing events to the MQTT broker (mqtt)
+	featureRulesEngine      = "rulesEngine"      // Running the automation rules
+)
+
+// featureDefinition describes a feature flag.
+type featureDefinition struct {
+	description string
+	enabled     bool // Default, when neither the configuration nor a runtime toggle sets it
+	restart     bool // Read at startup only
+}
+
+// featureDefinitions are the known feature flags. The defaults keep the behavior of the
+// releases without flags, so a rollout starts by switching a flag off in "features".
+var featureDefinitions = map[string]featureDefinition{
+	featureNativeController: {description: "Device commands and reads through the matter-server controller, when controller.type selects it", enabled: true, restart: true},
+	featureMQTTBridge:       {description: "Publish the events selected in mqtt.types to the MQTT broker", enabled: true},
+	featureRulesEngine:      {description: "Run the automation rules on button events, mode changes and attribute updates", enabled: true},
+}
+
+// FeatureFlag is the state of a feature flag, in the "feature_flags" message and GET /api/v1/features.
+type FeatureFlag struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	Source      string `json:"source"` // "default", "config" or "runtime"
+	// RestartRequired is set when the flag is only read at startup and changed since
+	RestartRequired bool      `json:"restartRequired,omitempty"`
+	ChangedAt       time.Time `json:"changedAt,omitzero"` // Of the runtime toggle
+}
+
+// FeatureFlagsPayload is the payload of "feature_flags", sent in response to "get_feature_flags" and
+// broadcast when a flag is toggled.
+type FeatureFlagsPayload struct {
+	Flags []FeatureFlag `json:"flags"`
+}
+
+// featureOverride is a runtime toggle, kept across restarts until it is reset.
+type featureOverride struct {
+	Name      string    `json:"name"`
+	Enabled   bool      `json:"enabled"`
+	ChangedAt time.Time `json:"changedAt"`
+}
+
+// FeatureFlags resolves the feature flags: a runtime toggle wins over the "features" setting, which
+// wins over the default. It lets a subsystem be rolled out, or switched off on a misbehaving
+// installation, without a separate build.
+type FeatureFlags struct {
+	mu        sync.RWMutex
+	overrides map[string]featureOverride
+	startup   map[string]bool // Value of the restart-only flags when the backend started
+	path      string
+}
+
+// NewFeatureFlags creates a FeatureFlags persisting the runtime toggles to path.
+func NewFeatureFlags(path string) *FeatureFlags {
+	return &FeatureFlags{overrides: make(map[string]featureOverride), startup: make(map[string]bool), path: path}
+}
+
+// Load reads the persisted runtime toggles and records the startup value of the restart-only
+// flags. A missing file is not an error.
+func (f *FeatureFlags) Load() error {
+	var overrides []featureOverride
+	err := loadJSONFile(f.path, &overrides)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, override := range overrides {
+		if _, known := featureDefinitions[override.Name]; known {
+			f.overrides[override.Name] = override
+		}
+	}
+	for name, def := range featureDefinitions {
+		if def.restart {
+			f.startup[name] = f.resolveLocked(name).Enabled
+		}
+		if flag := f.resolveLocked(name); flag.Enabled != def.enabled {
+			log.Printf("Feature %s %s (%s)", name, enabledWord(flag.Enabled), flag.Source)
+		}
+	}
+	return err
+}
+
+// resolveLocked computes the state of a known flag. The caller holds f.mu.
+func (f *FeatureFlags) resolveLocked(name string) FeatureFlag {
+	def := featureDefinitions[name]
+	flag := FeatureFlag{Name: name, Description: def.description, Enabled: def.enabled, Source: "default"}
+	if enabled, ok := appConfig.Features[name]; ok {
+		flag.Enabled, flag.Source = enabled, "config"
+	}
+	if override, ok := f.overrides[name]; ok {
+		flag.Enabled, flag.Source, flag.ChangedAt = override.Enabled, "runtime", override.ChangedAt
+	}
+	if started, ok := f.startup[name]; ok && started != flag.Enabled {
+		flag.RestartRequired = true
+	}
+	return flag
+}
+
+// Enabled reports whether a feature is on. Restart-only flags keep their startup value.
+func (f *FeatureFlags) Enabled(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if started, ok := f.startup[name]; ok {
+		return started
+	}
+	if _, known := featureDefinitions[name]; !known {
+		return false
+	}
+	return f.resolveLocked(name).Enabled
+}
+
+// List returns the state of every flag, sorted by name.
+func (f *FeatureFlags) List() []FeatureFlag {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	flags := make([]FeatureFlag, 0, len(featureDefinitions))
+	for name := range featureDefinitions {
+		flags = append(flags, f.resolveLocked(name))
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags
+}
+
+// Active returns the flags in effect, for the hello payload.
+func (f *FeatureFlags) Active() map[string]bool {
+	active := make(map[string]bool, len(featureDefinitions))
+	for name := range featureDefinitions {
+		active[name] = f.Enabled(name)
+	}
+	return active
+}
+
+// Set toggles a flag at runtime, or with enabled nil drops the toggle to go back to the
+// configuration, then broadcasts the flags.
+func (f *FeatureFlags) Set(name string, enabled *bool) (FeatureFlag, error) {
+	f.mu.Lock()
+	previous, existed := f.overrides[name]
+	if enabled == nil {
+		delete(f.overrides, name)
+	} else {
+		f.overrides[name] = featureOverride{Name: name, Enabled: *enabled, ChangedAt: time.Now()}
+	}
+	if err := f.saveLocked(); err != nil {
+		if existed {
+			f.overrides[name] = previous
+		} else {
+			delete(f.overrides, name)
+		}
+		f.mu.Unlock()
+		return FeatureFlag{}, err
+	}
+	flag := f.resolveLocked(name)
+	f.mu.Unlock()
+	if flag.RestartRequired {
+		log.Printf("Feature %s %s (%s), from the next restart", name, enabledWord(flag.Enabled), flag.Source)
+	} else {
+		log.Printf("Feature %s %s (%s)", name, enabledWord(flag.Enabled), flag.Source)
+	}
+	broadcastToClients("feature_flags", FeatureFlagsPayload{Flags: f.List()})
+	return flag, nil
+}
+
+// saveLocked writes the runtime toggles to disk, sorted by name. The caller holds f.mu.
+func (f *FeatureFlags) saveLocked() error {
+	overrides := make([]featureOverride, 0, len(f.overrides))
+	for _, override := range f.overrides {
+		overrides = append(overrides, override)
+	}
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].Name < overrides[j].Name })
+	return saveJSONFile(f.path, overrides)
+}
+
+func enabledWord(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+// SetFeatureFlagPayload toggles a feature flag at runtime (admin API). Reset drops the toggle, so
+// the "features" setting or the default applies again.
+type SetFeatureFlagPayload struct {
+	Name    string `json:"name"`
+	Enabled *bool  `json:"enabled,omitempty"`
+	Reset   bool   `json:"reset,omitempty"`
+}
+
+// Validate implements Validator.
+func (p SetFeatureFlagPayload) Validate() error {
+	verr := &ValidationError{}
+	if _, known := featureDefinitions[p.Name]; !known {
+		verr.add("name", fmt.Sprintf("unknown feature flag %q", p.Name))
+	}
+	if (p.Enabled == nil) == !p.Reset {
+		verr.add("enabled", "set either enabled or reset")
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+func handleGetFeatureFlags(client *Client) {
+	client.sendPayload("feature_flags", FeatureFlagsPayload{Flags: featureFlags.List()})
+}
+
+func handleSetFeatureFlag(client *Client, payload SetFeatureFlagPayload) {
+	if _, err := featureFlags.Set(payload.Name, payload.Enabled); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "set_feature_flag failed: " + err.Error()})
+	}
+	// The client gets the broadcast "feature_flags" like everyone else
+}
+
+// registerFeatureFlagsREST adds PUT and DELETE /admin/features/:name to an API version group of
+// the admin API: PUT {"enabled": bool} toggles a flag, DELETE drops the toggle.
+func registerFeatureFlagsREST(api *gin.RouterGroup) {
+	set := func(c *gin.Context, payload SetFeatureFlagPayload) {
+		if err := payload.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": err.(*ValidationError).Fields})
+			return
+		}
+		auditREST(c, "set_feature_flag", payload)
+		flag, err := featureFlags.Set(payload.Name, payload.Enabled)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, flag)
+	}
+	api.PUT("/admin/features/:name", func(c *gin.Context) {
+		payload := SetFeatureFlagPayload{}
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		payload.Name, payload.Reset = c.Param("name"), false
+		set(c, payload)
+	})
+	api.DELETE("/admin/features/:name", func(c *gin.Context) {
+		set(c, SetFeatureFlagPayload{Name: c.Param("name"), Reset: true})
+	})
+}
+
+var featureFlags = NewFeatureFlags(featureFlagsFile)
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// remoteNodePrefix starts the node and device IDs of the devices of remote hubs:
+// "remote:<hub>:<id on the hub>", e.g. "remote:floor2:1234" or "remote:floor2:5:3" for a bridged device.
+const remoteNodePrefix = "remote:"
+
+const (
+	federationListRequest    = "federation-devices" // requestId of the device list requests
+	federationRequestTTL     = 2 * time.Minute      // A forwarded request's replies are routed back this long after the last one
+	federationReconnectMin   = 2 * time.Second
+	federationReconnectMax   = time.Minute
+	federationRelistDelay    = time.Second // Device changes on a remote hub are batched into one device list request
+	federationMaxChunks      = 1024        // Chunks of one message from a hub: 64 MiB at the default chunk size
+	errCodeRemoteUnavailable = "remote_unavailable"
+)
+
+// reRemoteHubName is the form of remote hub names, which are part of the IDs of their devices.
+var reRemoteHubName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// federatedEventTypes are the events of a remote hub relayed to the local clients, with the IDs
+// rewritten. attribute_update goes through the local state cache first.
+var federatedEventTypes = map[string]bool{
+	"attribute_update":    true,
+	"state_correction":    true,
+	"device_reachability": true,
+	"device_health":       true,
+	"button_event":        true,
+	"device_added":        true,
+	"device_removed":      true,
+	"device_readdressed":  true,
+}
+
+// deviceListEvents are the events after which the device list of a remote hub is fetched again.
+var deviceListEvents = map[string]bool{
+	"device_added":       true,
+	"device_removed":     true,
+	"device_readdressed": true,
+	"device_health":      true,
+}
+
+// localMessageTypes are answered by this backend even for remote devices: their data is local.
+var localMessageTypes = map[string]bool{
+	"get_attribute_history": true, // Remote updates are recorded locally too
+}
+
+// FederationConfig lists the remote hubs whose devices this backend presents as its own (see federation.go).
+type FederationConfig struct {
+	Remotes []RemoteHubConfig `json:"remotes,omitempty"`
+}
+
+// RemoteHubConfig is another instance of this backend, e.g. the one of another floor or building.
+type RemoteHubConfig struct {
+	Name  string `json:"name"`            // Short and unique, part of the IDs of its devices, e.g. "floor2"
+	URL   string `json:"url"`             // WebSocket URL of its main listener, e.g. "ws://floor2.local:8080/ws"
+	Token string `json:"token,omitempty"` // Its authToken, if set
+}
+
+// RemoteHubStatus is the state of a remote hub connection, in GET /api/v1/federation and the
+// "federation_status" message broadcast when it changes.
+type RemoteHubStatus struct {
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`
+	Connected   bool      `json:"connected"`
+	ConnectedAt time.Time `json:"connectedAt,omitzero"`
+	Devices     int       `json:"devices"`
+	Pending     int       `json:"pending"` // Forwarded requests whose replies are still routed back
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// federatedRequest is a request forwarded to a remote hub, whose replies go back to client.
+type federatedRequest struct {
+	client   *Client // Nil for the backend's own requests, e.g. a rule's command
+	msgType  string
+	lastSeen time.Time
+}
+
+// RemoteHub is the upstream WebSocket connection to a remote hub. Its devices are listed with the
+// local ones, requests about them are forwarded, and its events are relayed.
+type RemoteHub struct {
+	cfg     RemoteHubConfig
+	stop    chan struct{}
+	writeMu sync.Mutex // gorilla/websocket allows one writer at a time
+
+	mu          sync.Mutex
+	conn        *websocket.Conn
+	connectedAt time.Time
+	devices     []RegisteredDevice
+	lastError   string
+	pending     map[string]*federatedRequest
+	seq         uint64
+	chunks      map[string][]string // Data of the message_chunk messages being reassembled, by chunk ID
+	relist      *time.Timer
+}
+
+// newRemoteHub creates the connection to a remote hub; run starts it.
+func newRemoteHub(cfg RemoteHubConfig) *RemoteHub {
+	return &RemoteHub{cfg: cfg, stop: make(chan struct{}), pending: make(map[string]*federatedRequest), chunks: make(map[string][]string)}
+}
+
+// prefix is the start of the local IDs of the hub's devices.
+func (r *RemoteHub) prefix() string {
+	return remoteNodePrefix + r.cfg.Name + ":"
+}
+
+// run keeps the connection up until the hub is removed from the configuration, reconnecting with
+// a backoff.
+func (r *RemoteHub) run() {
+	backoff := federationReconnectMin
+	for {
+		connected, err := r.session()
+		r.disconnected(err)
+		if connected {
+			backoff = federationReconnectMin
+		}
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, federationReconnectMax)
+	}
+}
+
+// session connects to the hub, asks for its devices and handles its messages until the connection
+// ends. It reports whether it got connected.
+func (r *RemoteHub) session() (bool, error) {
+	target, err := url.Parse(r.cfg.URL)
+	if err != nil {
+		return false, err
+	}
+	query := target.Query()
+	query.Set("format", "envelope")
+	if r.cfg.Token != "" {
+		query.Set("token", r.cfg.Token)
+	}
+	target.RawQuery = query.Encode()
+	conn, _, err := websocket.DefaultDialer.Dial(target.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	r.mu.Lock()
+	select {
+	case <-r.stop:
+		r.mu.Unlock()
+		return false, errors.New("removed from the configuration")
+	default:
+	}
+	r.conn, r.connectedAt, r.lastError = conn, time.Now(), ""
+	r.mu.Unlock()
+	log.Printf("Federation: connected to remote hub %s (%s)", r.cfg.Name, r.cfg.URL)
+	broadcastToClients("federation_status", federation.Status())
+
+	// The hub pings its clients; a silent one is considered gone
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPingHandler(func(data string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+		r.writeMu.Lock()
+		defer r.writeMu.Unlock()
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+	})
+	if err := r.write(ClientMessage{Type: "list_devices", RequestID: federationListRequest}); err != nil {
+		return true, err
+	}
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return true, err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+		r.handle(data)
+	}
+}
+
+// disconnected forgets the connection after a session ended. The devices of the hub stay listed,
+// unreachable, until it is back.
+func (r *RemoteHub) disconnected(err error) {
+	r.mu.Lock()
+	wasConnected := r.conn != nil
+	r.conn, r.connectedAt = nil, time.Time{}
+	for i := range r.devices {
+		r.devices[i].Reachable = false
+	}
+	r.chunks = make(map[string][]string)
+	r.pending = make(map[string]*federatedRequest)
+	if err != nil {
+		r.lastError = err.Error()
+	}
+	r.mu.Unlock()
+	if wasConnected {
+		log.Printf("Federation: lost remote hub %s: %v", r.cfg.Name, err)
+		broadcastToClients("federation_status", federation.Status())
+	}
+}
+
+// close stops the connection for good.
+func (r *RemoteHub) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	close(r.stop)
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	if r.relist != nil {
+		r.relist.Stop()
+	}
+}
+
+// write sends a message to the hub.
+func (r *RemoteHub) write(msg ClientMessage) error {
+	r.mu.Lock()
+	conn := r.conn
+	r.mu.Unlock()
+	if conn == nil {
+		return fmt.Errorf("remote hub %s is not connected", r.cfg.Name)
+	}
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteJSON(msg)
+}
+
+// Forward sends a request to the hub, its IDs already translated, and routes the replies to client.
+func (r *RemoteHub) Forward(client *Client, msgType string, payload json.RawMessage) error {
+	r.mu.Lock()
+	now := time.Now()
+	for id, request := range r.pending {
+		if now.Sub(request.lastSeen) > federationRequestTTL {
+			delete(r.pending, id)
+		}
+	}
+	r.seq++
+	requestID := fmt.Sprintf("federation-%d", r.seq)
+	r.pending[requestID] = &federatedRequest{client: client, msgType: msgType, lastSeen: now}
+	r.mu.Unlock()
+	if err := r.write(ClientMessage{Type: msgType, Payload: payload, RequestID: requestID}); err != nil {
+		r.mu.Lock()
+		delete(r.pending, requestID)
+		r.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// remoteEnvelope is a message received from the hub.
+type remoteEnvelope struct {
+	Type      string          `json:"type"`
+	RequestID string          `json:"requestId"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// handle processes a message of the hub: device lists, replies to forwarded requests and events.
+func (r *RemoteHub) handle(data []byte) {
+	var msg remoteEnvelope
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("Federation: unreadable message from %s: %v", r.cfg.Name, err)
+		return
+	}
+	if msg.Type == "message_chunk" {
+		if whole, ok := r.reassemble(msg.Data); ok {
+			r.handle(whole)
+		}
+		return
+	}
+	if msg.RequestID == federationListRequest && msg.Type == "device_list" {
+		r.setDevices(msg.Data)
+		return
+	}
+
+	r.mu.Lock()
+	request, forwarded := r.pending[msg.RequestID]
+	if forwarded {
+		request.lastSeen = time.Now()
+	}
+	r.mu.Unlock()
+	if !forwarded && !federatedEventTypes[msg.Type] {
+		return // The hub's own notices (heartbeat, maintenance...) stay there
+	}
+	var client *Client
+	if forwarded {
+		client = request.client
+		if client == nil {
+			if msg.Type == "error" || msg.Type == "command_response" {
+				log.Printf("Federation: %s on %s: %s", request.msgType, r.cfg.Name, msg.Data)
+			}
+			if msg.Type != "attribute_update" {
+				return
+			}
+		}
+	}
+
+	if msg.Type == "attribute_update" {
+		var update AttributeUpdatePayload
+		if err := json.Unmarshal(msg.Data, &update); err != nil || strings.HasPrefix(update.NodeID, remoteNodePrefix) {
+			return
+		}
+		update.NodeID = r.prefix() + update.NodeID
+		publishAttributeUpdate(client, update) // Cached, recorded and run through the rules like a local update
+		return
+	}
+	var payload interface{}
+	if err := json.Unmarshal(msg.Data, &payload); err != nil {
+		return
+	}
+	payload = r.localIDs(msg.Type, payload)
+	if client != nil {
+		client.sendPayload(msg.Type, payload)
+		return
+	}
+	broadcastToClients(msg.Type, payload)
+	if deviceListEvents[msg.Type] {
+		r.scheduleRelist()
+	}
+}
+
+// reassemble collects a message_chunk and returns the original message once complete. A chunk
+// whose total is out of bounds, or differs from the first chunk's, drops the message.
+func (r *RemoteHub) reassemble(data json.RawMessage) ([]byte, bool) {
+	var chunk MessageChunkPayload
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return nil, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	parts := r.chunks[chunk.ID]
+	if chunk.Total <= 0 || chunk.Total > federationMaxChunks || (parts != nil && chunk.Total != len(parts)) {
+		log.Printf("Federation: dropping chunked message %q from %s: invalid total %d", chunk.ID, r.cfg.Name, chunk.Total)
+		delete(r.chunks, chunk.ID)
+		return nil, false
+	}
+	if parts == nil {
+		parts = make([]string, chunk.Total)
+	}
+	if chunk.Seq < 0 || chunk.Seq >= len(parts) {
+		delete(r.chunks, chunk.ID)
+		return nil, false
+	}
+	parts[chunk.Seq] = chunk.Data
+	r.chunks[chunk.ID] = parts
+	if !chunk.Final {
+		return nil, false
+	}
+	delete(r.chunks, chunk.ID)
+	return []byte(strings.Join(parts, "")), true
+}
+
+// setDevices replaces the devices of the hub with a device_list it sent. Devices the hub itself
+// federates are left out: federation is one level deep, which also rules out loops.
+func (r *RemoteHub) setDevices(data json.RawMessage) {
+	var list DeviceListPayload
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Federation: unreadable device list from %s: %v", r.cfg.Name, err)
+		return
+	}
+	devices := make([]RegisteredDevice, 0, len(list.Devices))
+	for _, device := range list.Devices {
+		if strings.HasPrefix(device.ID, remoteNodePrefix) || device.Remote != "" {
+			continue
+		}
+		device.ID = r.prefix() + device.ID
+		device.NodeID = r.prefix() + device.NodeID
+		if device.BridgeID != "" {
+			device.BridgeID = r.prefix() + device.BridgeID
+		}
+		device.Remote = r.cfg.Name
+		devices = append(devices, device)
+	}
+	r.mu.Lock()
+	r.devices = devices
+	r.mu.Unlock()
+	log.Printf("Federation: %d device(s) on remote hub %s", len(devices), r.cfg.Name)
+	broadcastToClients("federation_status", federation.Status())
+}
+
+// scheduleRelist fetches the device list again shortly, once for a burst of device changes.
+func (r *RemoteHub) scheduleRelist() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.relist != nil {
+		r.relist.Stop()
+	}
+	r.relist = time.AfterFunc(federationRelistDelay, func() {
+		if err := r.write(ClientMessage{Type: "list_devices", RequestID: federationListRequest}); err != nil {
+			log.Printf("Federation: could not list the devices of %s: %v", r.cfg.Name, err)
+		}
+	})
+}
+
+// localIDs rewrites the node and device IDs at the top level of a payload of the hub to their
+// local form.
+func (r *RemoteHub) localIDs(msgType string, payload interface{}) interface{} {
+	fields, ok := payload.(map[string]interface{})
+	if !ok {
+		return payload
+	}
+	keys := []string{"nodeId", "deviceId", "bridgeId"}
+	if msgType == "device_added" {
+		keys = append(keys, "id") // A RegisteredDevice
+	}
+	for _, key := range keys {
+		if id, ok := fields[key].(string); ok && id != "" {
+			fields[key] = r.prefix() + id
+		}
+	}
+	if removed, ok := fields["removedDevices"].([]interface{}); ok {
+		for i, id := range removed {
+			if s, ok := id.(string); ok {
+				removed[i] = r.prefix() + s
+			}
+		}
+	}
+	return fields
+}
+
+// Status describes the connection.
+func (r *RemoteHub) Status() RemoteHubStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return RemoteHubStatus{
+		Name: r.cfg.Name, URL: r.cfg.URL, Connected: r.conn != nil, ConnectedAt: r.connectedAt,
+		Devices: len(r.devices), Pending: len(r.pending), LastError: r.lastError,
+	}
+}
+
+// Federation aggregates the devices of remote hubs, e.g. one backend per floor or building of a
+// campus, so the frontend sees a single gateway.
+type Federation struct {
+	mu      sync.RWMutex
+	remotes map[string]*RemoteHub
+}
+
+// NewFederation creates a Federation without remote hubs.
+func NewFederation() *Federation {
+	return &Federation{remotes: make(map[string]*RemoteHub)}
+}
+
+// Apply connects to the configured remote hubs: new ones are connected, changed ones reconnected
+// and removed ones disconnected, leaving the others alone.
+func (f *Federation) Apply(remotes []RemoteHubConfig) {
+	wanted := make(map[string]RemoteHubConfig)
+	for _, cfg := range remotes {
+		if !reRemoteHubName.MatchString(cfg.Name) || cfg.URL == "" {
+			log.Printf("WARNING: remote hub %q ignored: a name of letters, digits, - and _ and a url are required", cfg.Name)
+			continue
+		}
+		if _, duplicate := wanted[cfg.Name]; duplicate {
+			log.Printf("WARNING: remote hub %q ignored: the name is already used", cfg.Name)
+			continue
+		}
+		wanted[cfg.Name] = cfg
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name, remote := range f.remotes {
+		if cfg, ok := wanted[name]; !ok || !reflect.DeepEqual(cfg, remote.cfg) {
+			remote.close()
+			delete(f.remotes, name)
+			log.Printf("Federation: remote hub %s disconnected", name)
+		}
+	}
+	for name, cfg := range wanted {
+		if _, ok := f.remotes[name]; ok {
+			continue
+		}
+		remote := newRemoteHub(cfg)
+		f.remotes[name] = remote
+		go remote.run()
+	}
+}
+
+// remote returns the hub owning a local node or device ID, and the ID on that hub.
+func (f *Federation) remote(id string) (*RemoteHub, string, bool) {
+	rest, ok := strings.CutPrefix(id, remoteNodePrefix)
+	if !ok {
+		return nil, "", false
+	}
+	name, remoteID, ok := strings.Cut(rest, ":")
+	if !ok {
+		return nil, "", false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	remote, ok := f.remotes[name]
+	return remote, remoteID, ok
+}
+
+// Route finds the hub a request is about, from the nodeId or deviceId of its payload, and returns
+// the payload with the IDs the hub knows them by. ok is false for requests about local devices.
+func (f *Federation) Route(payload json.RawMessage) (remote *RemoteHub, translated json.RawMessage, ok bool, err error) {
+	if len(payload) == 0 || !strings.Contains(string(payload), remoteNodePrefix) {
+		return nil, nil, false, nil
+	}
+	var fields map[string]interface{}
+	if json.Unmarshal(payload, &fields) != nil {
+		return nil, nil, false, nil
+	}
+	for _, key := range []string{"deviceId", "nodeId"} {
+		id, _ := fields[key].(string)
+		if !strings.HasPrefix(id, remoteNodePrefix) {
+			continue
+		}
+		hub, remoteID, found := f.remote(id)
+		if !found {
+			return nil, nil, true, fmt.Errorf("%s is on an unknown remote hub", id)
+		}
+		if remote != nil && remote != hub {
+			return nil, nil, true, errors.New("the request names devices on different remote hubs")
+		}
+		remote, fields[key] = hub, remoteID
+	}
+	if remote == nil {
+		return nil, nil, false, nil
+	}
+	translated, err = json.Marshal(fields)
+	return remote, translated, true, err
+}
+
+// Devices returns the devices of the connected remote hubs, with their local IDs.
+func (f *Federation) Devices() []RegisteredDevice {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var devices []RegisteredDevice
+	for _, remote := range f.remotes {
+		remote.mu.Lock()
+		devices = append(devices, remote.devices...)
+		remote.mu.Unlock()
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices
+}
+
+// Device returns a device of a remote hub by its local ID.
+func (f *Federation) Device(id string) (RegisteredDevice, bool) {
+	remote, _, ok := f.remote(id)
+	if !ok {
+		return RegisteredDevice{}, false
+	}
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+	for _, device := range remote.devices {
+		if device.ID == id {
+			return device, true
+		}
+	}
+	return RegisteredDevice{}, false
+}
+
+// Status describes the remote hubs, sorted by name.
+func (f *Federation) Status() []RemoteHubStatus {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	statuses := make([]RemoteHubStatus, 0, len(f.remotes))
+	for _, remote := range f.remotes {
+		statuses = append(statuses, remote.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// federationMiddleware forwards the requests about devices of remote hubs to their hub. The replies
+// come back with the requestId of the request. Read-only mode and admin checks apply before it.
+func federationMiddleware(msgType string, next HandlerFunc) HandlerFunc {
+	return func(client *Client, msg ClientMessage) {
+		if localMessageTypes[msgType] {
+			next(client, msg)
+			return
+		}
+		remote, payload, ok, err := federation.Route(msg.Payload)
+		if !ok {
+			next(client, msg)
+			return
+		}
+		if err == nil {
+			err = remote.Forward(client, msgType, payload)
+		}
+		if err != nil {
+			client.notifyClient("error", map[string]interface{}{"message": msgType + " failed: " + err.Error(), "code": errCodeRemoteUnavailable})
+		}
+	}
+}
+
+// forwardDeviceCommand sends a command the backend itself runs, e.g. from a rule, to the hub of a
+// remote device. It reports whether the command was for a remote device.
+func forwardDeviceCommand(client *Client, payload DeviceCommandPayload) bool {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return false
+	}
+	remote, translated, ok, err := federation.Route(data)
+	if !ok {
+		return false
+	}
+	if err == nil {
+		err = remote.Forward(client, "device_command", translated)
+	}
+	if err != nil {
+		client.sendPayload("command_response", CommandResponsePayload{Success: false, NodeID: payload.NodeID, Error: err.Error(), Code: errCodeRemoteUnavailable})
+	}
+	return true
+}
+
+// registerFederationRoutes adds GET /federation, the state of the remote hubs, to an API version group.
+func registerFederationRoutes(api *gin.RouterGroup) {
+	api.GET("/federation", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"remotes": federation.Status()})
+	})
+}
+
+var federation = NewFederation()
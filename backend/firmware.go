@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// DeviceVersionInfo holds the firmware and hardware identification of a device, read from its
+// BasicInformation (or BridgedDeviceBasicInformation for bridged devices) cluster.
+type DeviceVersionInfo struct {
+	SoftwareVersion       *uint64   `json:"softwareVersion,omitempty"` // Comparable version number
+	SoftwareVersionString string    `json:"softwareVersionString,omitempty"`
+	HardwareVersion       *uint64   `json:"hardwareVersion,omitempty"`
+	HardwareVersionString string    `json:"hardwareVersionString,omitempty"`
+	SerialNumber          string    `json:"serialNumber,omitempty"`
+	ReadAt                time.Time `json:"readAt"`
+}
+
+// versionAttributes are the chip-tool names of the attributes making up DeviceVersionInfo.
+var versionAttributes = []string{"software-version", "software-version-string", "hardware-version", "hardware-version-string", "serial-number"}
+
+// readDeviceVersion reads the version attributes of a registry device. Optional attributes the
+// device doesn't implement are skipped; it only fails when nothing could be read.
+func readDeviceVersion(device RegisteredDevice) (DeviceVersionInfo, error) {
+	cluster, endpointID := "BasicInformation", "0"
+	if device.BridgeID != "" {
+		cluster, endpointID = "BridgedDeviceBasicInformation", device.EndpointID
+	}
+	info := DeviceVersionInfo{ReadAt: time.Now()}
+	var lastErr error
+	read := 0
+	for _, attribute := range versionAttributes {
+		value, err := readAttributeValue(device.NodeID, endpointID, cluster, attribute)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		read++
+		switch attribute {
+		case "software-version", "hardware-version":
+			if f, ok := toFloat(value); ok {
+				v := uint64(f)
+				if attribute == "software-version" {
+					info.SoftwareVersion = &v
+				} else {
+					info.HardwareVersion = &v
+				}
+			}
+		case "software-version-string":
+			info.SoftwareVersionString = fmt.Sprint(value)
+		case "hardware-version-string":
+			info.HardwareVersionString = fmt.Sprint(value)
+		case "serial-number":
+			info.SerialNumber = fmt.Sprint(value)
+		}
+	}
+	if read == 0 {
+		return info, lastErr
+	}
+	return info, nil
+}
+
+// refreshDeviceVersion reads the version information of a device and stores it in the registry,
+// for "refresh_device_version" and after commissioning.
+func refreshDeviceVersion(client *Client, deviceID string) (RegisteredDevice, error) {
+	device, ok := deviceRegistry.Get(deviceID)
+	if !ok {
+		return device, fmt.Errorf("device %q is not in the registry", deviceID)
+	}
+	info, err := readDeviceVersion(device)
+	if err != nil {
+		return device, err
+	}
+	if err := deviceRegistry.Update(deviceID, func(d *RegisteredDevice) { d.Version = &info }); err != nil {
+		return device, err
+	}
+	log.Printf("Device %s runs software %q (hardware %q)", deviceID, info.SoftwareVersionString, info.HardwareVersionString)
+	client.notifyClientLog("commissioning_log", fmt.Sprintf("Device %s runs software version %s.", deviceID, info.SoftwareVersionString))
+	device, _ = deviceRegistry.Get(deviceID)
+	return device, nil
+}
+
+// FirmwareEntry is one device in the firmware report.
+type FirmwareEntry struct {
+	DeviceID              string `json:"deviceId"`
+	Name                  string `json:"name,omitempty"`
+	SoftwareVersionString string `json:"softwareVersionString,omitempty"`
+	SoftwareVersion       uint64 `json:"softwareVersion"`
+	// Outdated is set when another device of the same vendor and product runs a newer version.
+	Outdated bool `json:"outdated,omitempty"`
+}
+
+// FirmwareGroup lists the devices of one vendor/product with their versions.
+type FirmwareGroup struct {
+	VendorID       string          `json:"vendorId"`
+	ProductID      string          `json:"productId"`
+	LatestVersion  string          `json:"latestVersion"` // Newest SoftwareVersionString seen for this product
+	Devices        []FirmwareEntry `json:"devices"`
+	OutdatedCount  int             `json:"outdatedCount"`
+	UnknownVersion []string        `json:"unknownVersion,omitempty"` // Devices whose version wasn't read yet
+}
+
+// firmwareReport groups the registered devices by vendor and product, flagging devices running an
+// older version than the newest one seen on the same product.
+func firmwareReport() []FirmwareGroup {
+	groups := make(map[string]*FirmwareGroup)
+	var keys []string
+	for _, device := range deviceRegistry.List() {
+		key := device.VendorID + "/" + device.ProductID
+		group, ok := groups[key]
+		if !ok {
+			group = &FirmwareGroup{VendorID: device.VendorID, ProductID: device.ProductID, Devices: []FirmwareEntry{}}
+			groups[key] = group
+			keys = append(keys, key)
+		}
+		if device.Version == nil || device.Version.SoftwareVersion == nil {
+			group.UnknownVersion = append(group.UnknownVersion, device.ID)
+			continue
+		}
+		group.Devices = append(group.Devices, FirmwareEntry{
+			DeviceID:              device.ID,
+			Name:                  device.Name,
+			SoftwareVersionString: device.Version.SoftwareVersionString,
+			SoftwareVersion:       *device.Version.SoftwareVersion,
+		})
+	}
+	sort.Strings(keys)
+	report := make([]FirmwareGroup, 0, len(keys))
+	for _, key := range keys {
+		group := groups[key]
+		var latest uint64
+		for _, entry := range group.Devices {
+			if entry.SoftwareVersion >= latest {
+				latest, group.LatestVersion = entry.SoftwareVersion, entry.SoftwareVersionString
+			}
+		}
+		for i := range group.Devices {
+			if group.Devices[i].SoftwareVersion < latest {
+				group.Devices[i].Outdated = true
+				group.OutdatedCount++
+			}
+		}
+		report = append(report, *group)
+	}
+	return report
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+)
+
+// Adaptive subscription defaults, used when the config doesn't set them.
+const (
+	defaultFocusedMaxInterval = 10  // Seconds, for nodes shown on a device page
+	defaultRelaxedMaxInterval = 600 // Seconds, for nodes nobody looks at
+)
+
+// FocusDevicePayload is the payload of "focus_device", sent when the UI opens a device's detail
+// page. Empty IDs mean the page was closed.
+type FocusDevicePayload struct {
+	NodeID   string `json:"nodeId"`
+	DeviceID string `json:"deviceId,omitempty"` // Registry device ID, instead of nodeId
+}
+
+// DeviceFocusPayload is sent in response to "focus_device".
+type DeviceFocusPayload struct {
+	NodeID    string `json:"nodeId,omitempty"` // Empty when the client no longer looks at a device
+	Restarted int    `json:"restartedSubscriptions"`
+}
+
+// SubscriptionFocus tracks the node each client is looking at. With adaptiveSubscriptions enabled,
+// the subscriptions of a node somebody looks at run with a short max interval, so its page stays
+// fresh, and those of the other nodes with a long one, which cuts the empty reports on busy fabrics.
+// Changing the interval restarts the chip-tool subscribe process.
+type SubscriptionFocus struct {
+	mu      sync.Mutex
+	focused map[*Client]string // Node each connection looks at
+}
+
+// NewSubscriptionFocus creates a SubscriptionFocus where nobody looks at any node.
+func NewSubscriptionFocus() *SubscriptionFocus {
+	return &SubscriptionFocus{focused: make(map[*Client]string)}
+}
+
+// isFocusedLocked reports whether a client looks at the node. Callers must hold f.mu.
+func (f *SubscriptionFocus) isFocusedLocked(nodeID string) bool {
+	for _, focused := range f.focused {
+		if focused == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxInterval returns the max interval a subscription asking for maxInterval should run with, in
+// seconds. It is maxInterval itself when adaptive subscriptions are disabled; never below minInterval.
+func (f *SubscriptionFocus) MaxInterval(nodeID, minInterval, maxInterval string) string {
+	cfg := appConfig.AdaptiveSubscriptions
+	requested, err := strconv.Atoi(maxInterval)
+	if !cfg.Enabled || err != nil {
+		return maxInterval
+	}
+	f.mu.Lock()
+	focused := f.isFocusedLocked(nodeID)
+	f.mu.Unlock()
+	var interval int
+	if focused {
+		limit := defaultFocusedMaxInterval
+		if cfg.FocusedMaxInterval > 0 {
+			limit = cfg.FocusedMaxInterval
+		}
+		interval = min(requested, limit)
+	} else {
+		limit := defaultRelaxedMaxInterval
+		if cfg.RelaxedMaxInterval > 0 {
+			limit = cfg.RelaxedMaxInterval
+		}
+		interval = max(requested, limit)
+	}
+	if floor, err := strconv.Atoi(minInterval); err == nil {
+		interval = max(interval, floor)
+	}
+	return strconv.Itoa(interval)
+}
+
+// Focus records the node a client looks at ("" for none) and retunes the subscriptions of the
+// nodes whose focus changed. It returns how many subscriptions were restarted.
+func (f *SubscriptionFocus) Focus(client *Client, nodeID string) int {
+	client = client.base()
+	f.mu.Lock()
+	previous := f.focused[client]
+	if nodeID == "" {
+		delete(f.focused, client)
+	} else {
+		f.focused[client] = nodeID
+	}
+	f.mu.Unlock()
+	if previous == nodeID {
+		return 0
+	}
+	restarted := 0
+	for _, node := range []string{previous, nodeID} {
+		if node != "" {
+			restarted += subscriptions.Retune(node)
+		}
+	}
+	if restarted > 0 {
+		log.Printf("Client %v moved from node %q to %q: restarted %d subscription(s)", client.logName(), previous, nodeID, restarted)
+	}
+	return restarted
+}
+
+// Release forgets a disconnected client's focus.
+func (f *SubscriptionFocus) Release(client *Client) {
+	f.Focus(client, "")
+}
+
+func handleFocusDevice(client *Client, payload FocusDevicePayload) {
+	nodeID := payload.NodeID
+	if payload.DeviceID != "" {
+		resolved, _, err := deviceRegistry.resolveDeviceTarget(payload.DeviceID)
+		if err != nil {
+			client.notifyClient("error", map[string]interface{}{"message": "focus_device failed: " + err.Error()})
+			return
+		}
+		nodeID = resolved
+	}
+	restarted := subscriptionFocus.Focus(client, nodeID)
+	client.sendPayload("device_focus", DeviceFocusPayload{NodeID: nodeID, Restarted: restarted})
+}
+
+var subscriptionFocus = NewSubscriptionFocus()
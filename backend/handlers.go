@@ -3,7 +3,9 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -14,17 +16,20 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// chipToolPath is the command to run chip-tool. It is selected at startup from the configuration or
+// by looking in the usual places (see chiptoolpath.go); simulation mode replaces it (see simulator.go).
+// If it's in PATH: "chip-tool"
+// If installed via snap: "/snap/bin/chip-tool" or "matter-pi-tool.chip-tool"
+// If built from source: path to your compiled chip-tool executable, e.g., "/home/pi/connectedhomeip/out/chip-tool-arm64/chip-tool"
+var chipToolPath = "/snap/bin/chip-tool" // Used when nothing is found
+
 const (
-	// chipToolPath should be the command to run chip-tool.
-	// If it's in PATH: "chip-tool"
-	// If installed via snap: "/snap/bin/chip-tool" or "matter-pi-tool.chip-tool"
-	// If built from source: path to your compiled chip-tool executable, e.g., "/home/pi/connectedhomeip/out/chip-tool-arm64/chip-tool"
-	chipToolPath      = "/snap/bin/chip-tool" // IMPORTANT: Verify this path on your RPi
 	paaTrustStorePath = "/paa-root-certs/dcld_mirror_CN_Basics_PAA_vid_0x137B.der"
 
 	// paaTrustStorePath might be needed for commissioning production devices.
@@ -37,13 +42,8 @@ const (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow all connections for development.
-		// For production, you should validate the origin:
-		// origin := r.Header.Get("Origin")
-		// return origin == "http://localhost:5173" // Your Vue3 dev server
-		return true
-	},
+	// All origins are allowed for development unless allowedOrigins is configured (see proxy.go).
+	CheckOrigin: checkWebSocketOrigin,
 }
 
 // Constants for WebSocket handling
@@ -51,7 +51,7 @@ const (
 	writeWait      = 10 * time.Second    // Time allowed to write a message to the peer.
 	pongWait       = 60 * time.Second    // Time allowed to read the next pong message from the peer.
 	pingPeriod     = (pongWait * 9) / 10 // Send pings to peer with this period. Must be less than pongWait.
-	maxMessageSize = 1024 * 10           // Maximum message size allowed from peer.
+	maxMessageSize = 1024 * 10           // Maximum message size allowed from peer. Larger messages close the connection.
 )
 
 // Client is a middleman between the WebSocket connection and the hub.
@@ -59,21 +59,73 @@ type Client struct {
 	hub *Hub
 	// The WebSocket connection.
 	conn *websocket.Conn
-	// Buffered channel of outbound messages.
+	// Buffered channel of outbound messages: the bulk lane of writePump.
 	send chan []byte
-	// Mutex to protect concurrent writes to the WebSocket connection
-	writeMu sync.Mutex
+	// control is the priority lane of writePump, for close frames that must not wait behind data
+	control chan controlFrame
+	// Set once the client proved it knows the configured authToken
+	authenticated atomic.Bool
+	// requestID is echoed in every message sent while handling a request (see forRequest)
+	requestID string
+	// origin is the connection's Client when this one is a per-request view of it
+	origin *Client
+	// legacy selects the old {type, payload} message shape instead of Envelope (see envelope.go)
+	legacy bool
+	// admin is set on connections to the admin listener, which accept admin messages (see admin.go)
+	admin bool
+	// addr is the client's address, behind the reverse proxy if any (see proxy.go)
+	addr string
+	// connectedAt is when the WebSocket connection was accepted
+	connectedAt time.Time
+	// id identifies the connection in the admin API's /clients and in logs (see identity.go)
+	id string
+	// identity is what the client sent with "identify", nil until then
+	identity atomic.Pointer[ClientIdentity]
+	// admitted is set when the client holds one of the maxClients slots (see admission.go)
+	admitted bool
+	// readOnly is set for connections to /ws?readonly=true, which are refused readOnlyMessageTypes
+	readOnly bool
+	// trace records the request this view handles, when the client asked for it (see tracing.go)
+	trace *Trace
+	// span is the OpenTelemetry span of the request this view handles, nil when telemetry is off (see telemetry.go)
+	span *Span
+	// chipToolLog is the chip-tool verbosity and forwarded log categories the request picked (see chiptoollog.go)
+	chipToolLog chipToolLogOptions
+	// observe, when set, is called with every message sent through this view (see macros.go)
+	observe func(msgType string, payload interface{})
+	// batchInterval is how long broadcast attribute updates wait to be sent together, zero when they
+	// aren't batched; batch collects them meanwhile (see batching.go)
+	batchInterval time.Duration
+	batch         *updateBatch
+	// units are the client's unit preferences, nil until it sends "set_unit_preferences" (see units.go)
+	units atomic.Pointer[UnitPreferences]
 	// activeSubscriptions map[string]*exec.Cmd // For robust subscription management
 	// subMu sync.Mutex
 }
 
 type SubscribeAttributePayload struct {
-	NodeID      string `json:"nodeId"`
+	NodeID      string `json:"nodeId" validate:"required"`
 	EndpointID  string `json:"endpointId"` // Default to "1" if not provided by client
-	Cluster     string `json:"cluster"`
-	Attribute   string `json:"attribute"`
+	Cluster     string `json:"cluster" validate:"required"`
+	Attribute   string `json:"attribute" validate:"required"`
 	MinInterval string `json:"minInterval"` // In seconds, e.g., "1"
 	MaxInterval string `json:"maxInterval"` // In seconds, e.g., "10"
+	// MinChange is the reportable change, in the attribute's normalised unit (e.g. 0.2 for °C):
+	// reports closer than that to the last published value are dropped (see debounce.go)
+	MinChange float64 `json:"minChange,omitempty"`
+	// StorageDirectory and CommissionerName select another chip-tool identity, from the chipToolIdentities allowlist
+	StorageDirectory string `json:"storageDirectory,omitempty"`
+	CommissionerName string `json:"commissionerName,omitempty"`
+}
+
+// Validate implements Validator.
+func (p SubscribeAttributePayload) Validate() error {
+	if p.MinChange < 0 {
+		verr := &ValidationError{}
+		verr.add("minChange", "must not be negative")
+		return verr
+	}
+	return validateChipToolIdentity(p.StorageDirectory, p.CommissionerName)
 }
 
 // readPump pumps messages from the WebSocket connection to the hub.
@@ -84,7 +136,7 @@ func (c *Client) readPump() {
 		// TODO: When a client disconnects, all its active subscriptions should be stopped.
 		// This would involve iterating c.activeSubscriptions and calling cmd.Process.Kill()
 		c.conn.Close()
-		log.Printf("Client %v disconnected from readPump", c.conn.RemoteAddr())
+		log.Printf("Client %v disconnected from readPump", c.logName())
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
 	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait)) // Initial read deadline
@@ -97,70 +149,105 @@ func (c *Client) readPump() {
 		_, messageBytes, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNormalClosure) {
-				log.Printf("Client %v read error: %v", c.conn.RemoteAddr(), err)
+				log.Printf("Client %v read error: %v", c.logName(), err)
 			} else {
-				log.Printf("Client %v WebSocket closed: %v", c.conn.RemoteAddr(), err)
+				log.Printf("Client %v WebSocket closed: %v", c.logName(), err)
 			}
 			break
 		}
 
 		var clientMsg ClientMessage // Assuming ClientMessage is defined in models.go
 		if err := json.Unmarshal(messageBytes, &clientMsg); err != nil {
-			log.Printf("Error unmarshalling client message from %v: %v. Message: %s", c.conn.RemoteAddr(), err, string(messageBytes))
+			log.Printf("Error unmarshalling client message from %v: %v. Message: %s", c.logName(), err, string(messageBytes))
 			c.notifyClient("error", map[string]interface{}{"message": "Invalid message format: " + err.Error()})
 			continue
 		}
 
-		log.Printf("Received message from client %v: Type: %s, Payload: %+v", c.conn.RemoteAddr(), clientMsg.Type, clientMsg.Payload)
+		debugf("Received message from client %v: Type: %s, Payload: %s", c.logName(), clientMsg.Type, clientMsg.Payload)
 		go handleClientMessage(c, clientMsg) // Handle each message in a new goroutine
 	}
 }
 
-// writePump pumps messages from the hub to the WebSocket connection.
+// controlFrame is a WebSocket control frame queued on a client's priority lane.
+type controlFrame struct {
+	messageType int // websocket.CloseMessage or websocket.PingMessage
+	data        []byte
+}
+
+// closeWith asks writePump to send a close frame with the code and reason and then close the
+// connection; readPump then fails and unregisters the client. It never blocks.
+func (c *Client) closeWith(code int, reason string) {
+	select {
+	case c.base().control <- controlFrame{messageType: websocket.CloseMessage, data: websocket.FormatCloseMessage(code, reason)}:
+	default: // A close is already queued
+	}
+}
+
+// writePump is the only writer of the WebSocket connection. It has two lanes: control frames
+// (pings and closes) go first, ahead of the bulk messages queued by the hub, so a client flooded
+// with attribute updates still gets its pings and can be closed promptly.
 func (c *Client) writePump() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
-		log.Printf("Client %v disconnected from writePump", c.conn.RemoteAddr())
+		log.Printf("Client %v disconnected from writePump", c.logName())
 	}()
 	for {
+		// Control frames first; the bulk lane is only read when none is pending
 		select {
+		case frame := <-c.control:
+			if !c.writeControl(frame) {
+				return
+			}
+			continue
+		case <-ticker.C:
+			if !c.writeControl(controlFrame{messageType: websocket.PingMessage}) {
+				return
+			}
+			continue
+		default:
+		}
+
+		select {
+		case frame := <-c.control:
+			if !c.writeControl(frame) {
+				return
+			}
+		case <-ticker.C:
+			if !c.writeControl(controlFrame{messageType: websocket.PingMessage}) {
+				return
+			}
 		case message, ok := <-c.send:
-			c.writeMu.Lock() // Protect concurrent writes
-			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
-				log.Printf("Client %v send channel closed, sending close message.", c.conn.RemoteAddr())
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				c.writeMu.Unlock()
+				log.Printf("Client %v send channel closed, sending close message.", c.logName())
+				c.writeControl(controlFrame{messageType: websocket.CloseMessage, data: websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")})
 				return
 			}
-
 			// Send the message as a whole. No batching with NextWriter.
-			err := c.conn.WriteMessage(websocket.TextMessage, message)
-			if err != nil {
-				log.Printf("Client %v error writing message: %v", c.conn.RemoteAddr(), err)
-				c.writeMu.Unlock()
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeDeadline()))
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				log.Printf("Client %v error writing message: %v", c.logName(), err)
+				c.hub.recordWriteTimeout(c, err)
 				return // Exit on write error
 			}
-			c.writeMu.Unlock()
-
-		case <-ticker.C:
-			c.writeMu.Lock() // Protect concurrent writes
-			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.Printf("Client %v error sending ping: %v", c.conn.RemoteAddr(), err)
-				c.writeMu.Unlock()
-				return // Exit if ping fails
-			}
-			c.writeMu.Unlock()
 		}
 	}
 }
 
-// serveWs handles WebSocket requests from the peer.
-func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+// writeControl writes a control frame. It reports false when writePump must stop: after a close
+// frame, or when the write failed.
+func (c *Client) writeControl(frame controlFrame) bool {
+	if err := c.conn.WriteControl(frame.messageType, frame.data, time.Now().Add(writeDeadline())); err != nil {
+		log.Printf("Client %v error sending control frame %d: %v", c.logName(), frame.messageType, err)
+		return false
+	}
+	return frame.messageType != websocket.CloseMessage
+}
+
+// serveWs handles WebSocket requests from the peer. admin is set for the admin listener.
+func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request, admin bool) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("WebSocket upgrade error:", err)
@@ -168,15 +255,63 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	}
 	// For robust subscription management, initialize activeSubscriptions map here:
 	// client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), activeSubscriptions: make(map[string]*exec.Cmd)}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), control: make(chan controlFrame, 1), legacy: wantsLegacyMessages(r), admin: admin, addr: requestClientAddr(r), connectedAt: time.Now(), id: newClientID()}
+	client.batchInterval = attributeBatchInterval(r)
+	client.batch = newUpdateBatch(client.batchInterval)
+	if token := r.URL.Query().Get("token"); token != "" && tokensEqual(token, appConfig.AuthToken) {
+		client.authenticated.Store(true)
+	}
+	if !admit(client, r) {
+		return
+	}
+	// Queued directly: the hub may not have registered the client yet when a bus event is delivered
+	if hello, err := json.Marshal(buildServerMessage("hello", "", buildHello(r, admin), client.legacy)); err == nil {
+		client.send <- hello
+	}
 	client.hub.register <- client
 
-	log.Printf("Client %v connected via WebSocket", conn.RemoteAddr())
+	log.Printf("Client %v connected via WebSocket", client.logName())
 
 	go client.writePump()
 	go client.readPump()
 }
 
+// forRequest returns a view of the client whose messages carry requestID, so the frontend can
+// match responses to the request that caused them. It shares the connection and send channel.
+func (c *Client) forRequest(requestID string) *Client {
+	if requestID == "" {
+		return c
+	}
+	view := c.view()
+	view.requestID = requestID
+	return view
+}
+
+// view returns a per-request view of the client carrying everything the request picked (requestId,
+// trace, span, chip-tool log options, observer); the with* helpers override one of them. The
+// per-connection state isn't copied (its atomics must not be): it is read through base().
+func (c *Client) view() *Client {
+	return &Client{hub: c.hub, conn: c.conn, send: c.send, requestID: c.requestID, origin: c.base(), legacy: c.legacy,
+		trace: c.trace, span: c.span, chipToolLog: c.chipToolLog, observe: c.observe}
+}
+
+// base returns the Client of the connection, for identity comparisons and per-connection state.
+func (c *Client) base() *Client {
+	if c.origin != nil {
+		return c.origin
+	}
+	return c
+}
+
+// remoteAddr returns the client's address, behind the reverse proxy if any.
+func (c *Client) remoteAddr() string {
+	return c.base().addr
+}
+
+func (c *Client) isAuthenticated() bool {
+	return c.base().authenticated.Load()
+}
+
 // ANSI escape code stripper
 var ansiRegex = regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]`)
 
@@ -184,402 +319,1041 @@ func stripAnsi(str string) string {
 	return ansiRegex.ReplaceAllString(str, "")
 }
 
-// handleClientMessage processes messages from the client and interacts with chip-tool.
+// handleClientMessage routes a message from the client to its registered handler (see router.go).
+// Every response sent while handling it carries the message's requestId.
 func handleClientMessage(client *Client, msg ClientMessage) { // ClientMessage should be defined in models.go
-	switch msg.Type {
-	case "discover_devices":
-		log.Println("Handling discover_devices request (for 'commissionables' devices)")
-		client.notifyClientLog("discovery_log", "Starting 'discover commissionables' via chip-tool...")
+	client = client.forRequest(msg.RequestID)
+	if span := tracer.StartRequest("ws "+msg.Type, msg.RequestID); span != nil {
+		client = client.withSpan(span)
+		span.SetAttribute("matter.message_type", msg.Type)
+		span.SetAttribute("matter.client_id", client.base().id)
+		defer span.End()
+	}
+	client = client.withChipToolLog(msg.Debug, msg.LogCategories)
+	if msg.Trace && msg.RequestID != "" {
+		client.trace = traces.Start(msg)
+		defer client.trace.handlerDone()
+	}
+	if messageHandlers.Dispatch(client, msg) {
+		return
+	}
+	if dispatchCustomMessage(client, msg) {
+		return
+	}
+	log.Printf("Unknown message type from client %v: %s", client.logName(), msg.Type)
+	client.notifyClient("error", map[string]interface{}{"message": "Unknown command type received: " + msg.Type, "code": errCodeUnknownType})
+}
 
-		discoveryTimeout := 60 * time.Second // Adjust as needed
+// tokensEqual compares tokens in constant time, so a token can't be guessed from response times.
+func tokensEqual(given, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(want)) == 1
+}
 
-		ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
-		defer cancel() // Ensure context resources are cleaned up
+// handleAuthenticate checks the token against the configured authToken.
+func handleAuthenticate(client *Client, payload AuthenticatePayload) {
+	if appConfig.AuthToken != "" && !tokensEqual(payload.Token, appConfig.AuthToken) {
+		client.sendPayload("authenticated", map[string]interface{}{"success": false})
+		return
+	}
+	client.base().authenticated.Store(true)
+	client.sendPayload("authenticated", map[string]interface{}{"success": true})
+}
 
-		// cmd := exec.CommandContext(ctx, chipToolPath, "discover", "commissionables", "--discover-once", "false")
-		cmd := exec.CommandContext(ctx, chipToolPath, "discover", "commissionables")
-		var outBuf, errBuf strings.Builder
-		cmd.Stdout = &outBuf
-		cmd.Stderr = &errBuf
+// handleDiscoverDevices starts a discovery job (see discoverCommissionables).
+func handleDiscoverDevices(client *Client, payload DiscoverDevicesPayload) {
+	log.Println("Handling discover_devices request (for 'commissionables' devices)")
+	interfaces := discoveryInterfaces(payload.Interfaces)
+	jobs.Submit(client, "discovery", func(ctx context.Context, job *Job) (interface{}, error) {
+		return discoverCommissionables(ctx, job, client, interfaces)
+	})
+}
 
-		err := cmd.Run() // This will block until the command completes, errors, or the context times out.
+// discoverCommissionables runs "chip-tool discover commissionables" and sends the parsed devices,
+// only those seen on the given interfaces unless the list is empty. chip-tool browses every
+// interface, so the results are filtered afterwards.
+func discoverCommissionables(jobCtx context.Context, job *Job, client *Client, interfaces []string) (interface{}, error) {
+	client.notifyClientLog("discovery_log", "Starting 'discover commissionables' via chip-tool...")
+	job.SetProgress(0, "Browsing commissionable devices")
 
-		stdout := outBuf.String()
-		stderr := errBuf.String()
+	discoveryTimeout := 60 * time.Second // Adjust as needed
 
-		if stdout != "" {
-			log.Printf("chip-tool 'discover commissionables' stdout:\n%s", stdout)
-		} else {
-			log.Println("chip-tool 'discover commissionables' stdout was empty.")
-		}
-		if stderr != "" {
-			log.Printf("chip-tool 'discover commissionables' stderr:\n%s", stderr)
-		}
+	ctx, cancel := context.WithTimeout(jobCtx, discoveryTimeout)
+	defer cancel() // Ensure context resources are cleaned up
 
-		errMsg := ""
-		if ctx.Err() == context.DeadlineExceeded {
-			errMsg = fmt.Sprintf("Discovery command timed out after %s. Stdout: %s, Stderr: %s", discoveryTimeout, stdout, stderr)
-			log.Println(errMsg)
-			client.notifyClientLog("discovery_log", "Discovery timed out: "+errMsg)
-		} else {
-			errMsg = fmt.Sprintf("Error running chip-tool 'discover commissionables': %v. Stdout: %s, Stderr: %s", err, stdout, stderr)
-			log.Println(errMsg)
-			client.notifyClientLog("discovery_log", "Error during discovery: "+errMsg)
-		}
+	// cmd := exec.CommandContext(ctx, chipToolPath, "discover", "commissionables", "--discover-once", "false")
+	cmd := exec.CommandContext(ctx, chipToolPath, withChipToolStorage(client.chipToolArgs([]string{"discover", "commissionables"}))...)
+	var outBuf, errBuf strings.Builder
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+
+	started := time.Now()
+	err := cmd.Run() // This will block until the command completes, errors, or the context times out.
 
-		client.sendPayload("discovery_result", DiscoveryResultPayload{Devices: []DiscoveredDevice{}, Error: errMsg})
+	stdout := outBuf.String()
+	stderr := errBuf.String()
+	client.traceChipToolRun(cmd.Args[1:], started, stdout, stderr, err)
+
+	if stdout != "" {
+		log.Printf("chip-tool 'discover commissionables' stdout:\n%s", stdout)
+	} else {
+		log.Println("chip-tool 'discover commissionables' stdout was empty.")
+	}
+	if stderr != "" {
+		log.Printf("chip-tool 'discover commissionables' stderr:\n%s", stderr)
+	}
 
-		// If err is nil, the command completed successfully (exit status 0) before the timeout.
-		// This is unlikely for "discover --discover-once false" unless chip-tool has internal logic to stop.
-		client.notifyClientLog("discovery_log", "Discovery command 'discover commissionables' finished. Output processing...")
-		discovered := parseDiscoveryOutput(stdout, client)
-		client.sendPayload("discovery_result", DiscoveryResultPayload{Devices: discovered})
+	errMsg := ""
+	if jobCtx.Err() != nil {
+		client.notifyClientLog("discovery_log", "Discovery cancelled.")
+		return nil, jobCtx.Err()
+	} else if ctx.Err() == context.DeadlineExceeded {
+		errMsg = fmt.Sprintf("Discovery command timed out after %s. %s", discoveryTimeout, client.chipToolOutput(stdout, stderr))
+		log.Println(errMsg)
+		client.notifyClientLog("discovery_log", "Discovery timed out: "+errMsg)
+	} else {
+		errMsg = fmt.Sprintf("Error running chip-tool 'discover commissionables': %v. %s", err, client.chipToolOutput(stdout, stderr))
+		log.Println(errMsg)
+		client.notifyClientLog("discovery_log", "Error during discovery: "+errMsg)
+	}
 
-	case "commission_device":
-		var payload CommissionDevicePayload // Assumes CommissionDevicePayload is in models.go
-		payloadBytes, _ := json.Marshal(msg.Payload)
-		if err := json.Unmarshal(payloadBytes, &payload); err != nil {
-			client.notifyClientLog("commissioning_log", "Invalid payload for commission_device: "+err.Error())
-			client.sendPayload("commissioning_status", CommissioningStatusPayload{Success: false, Error: "Invalid payload: " + err.Error()}) // Assumes CommissioningStatusPayload is in models.go
-			return
+	client.sendPayload("discovery_result", DiscoveryResultPayload{Devices: []DiscoveredDevice{}, Error: errMsg})
+
+	// If err is nil, the command completed successfully (exit status 0) before the timeout.
+	// This is unlikely for "discover --discover-once false" unless chip-tool has internal logic to stop.
+	client.notifyClientLog("discovery_log", "Discovery command 'discover commissionables' finished. Output processing...")
+	job.SetProgress(70, "Parsing discovered devices")
+	discovered := parseDiscoveryOutput(stdout, client)
+	resolveDiscoveredAddresses(discovered)
+	completeDiscriminators(discovered)
+	if len(interfaces) > 0 {
+		kept := discovered[:0]
+		for _, d := range discovered {
+			if seenOnInterfaces(d, interfaces) {
+				kept = append(kept, d)
+			}
 		}
-		log.Printf("Handling commission_device request: %+v", payload)
-		if payload.SetupCode == "" { // Discriminator might not be strictly needed for 'pairing code' if device is uniquely identified by IP context
-			client.notifyClientLog("commissioning_log", "Missing setupCode or nodeIdToAssign for commissioning.")
-			client.sendPayload("commissioning_status", CommissioningStatusPayload{Success: false, Error: "Missing setupCode or nodeIdToAssign.", OriginalDiscriminator: payload.LongDiscriminator})
+		client.notifyClientLog("discovery_log", fmt.Sprintf("Kept %d of %d devices seen on %s", len(kept), len(discovered), strings.Join(interfaces, ", ")))
+		discovered = kept
+	}
+	commissioningWindows.Annotate(discovered)
+	job.SetProgress(80, "Checking pairing state")
+	pairingStates.Classify(discovered)
+	result := DiscoveryResultPayload{Devices: discovered, Interfaces: interfaces}
+	client.sendPayload("discovery_result", result)
+	return result, nil
+}
+
+// pairingCommand returns the mDNS based chip-tool pairing command for a normalized payload: by
+// long discriminator when known, by short discriminator (manual pairing codes), else the first
+// commissionable device that accepts the passcode.
+func pairingCommand(payload CommissionDevicePayload) []string {
+	switch {
+	case payload.LongDiscriminator != "":
+		return []string{"pairing", "onnetwork-long", payload.NodeID, payload.SetupCode, payload.LongDiscriminator}
+	case payload.ShortDiscriminator != "":
+		return []string{"pairing", "onnetwork-short", payload.NodeID, payload.SetupCode, payload.ShortDiscriminator}
+	}
+	return []string{"pairing", "onnetwork", payload.NodeID, payload.SetupCode}
+}
+
+// Pairing modes of commission_device.
+const (
+	pairingModeMDNS    = "mdns"    // Resolve the device over mDNS by discriminator, then try its addresses
+	pairingModeAddress = "address" // Pair straight to the discovered IP and port ("pairing already-discovered")
+)
+
+// addressPairingCommands returns a "pairing already-discovered" command for each advertised address
+// of the device, best reachable first.
+func addressPairingCommands(payload CommissionDevicePayload) [][]string {
+	if payload.Port == "" {
+		return nil
+	}
+	addresses := payload.Addresses
+	if len(addresses) == 0 && payload.IPAddress != "" {
+		addresses = []string{payload.IPAddress}
+	}
+	var commands [][]string
+	for _, info := range rankAddresses(addresses, payload.Interface) {
+		commands = append(commands, []string{"pairing", "already-discovered", payload.NodeID, payload.SetupCode, withZone(info.Address, payload.Interface), payload.Port})
+	}
+	return commands
+}
+
+// pairingAttempts returns the chip-tool pairing commands to try in order. The mDNS based command
+// comes first unless the payload asks for the address mode, which skips the second mDNS resolution
+// that often fails on hosts with several interfaces and only falls back to it.
+func pairingAttempts(payload CommissionDevicePayload) [][]string {
+	mdns, byAddress := pairingCommand(payload), addressPairingCommands(payload)
+	if payload.PairingMode == pairingModeAddress {
+		return append(byAddress, mdns)
+	}
+	return append([][]string{mdns}, byAddress...)
+}
+
+// fillDiscoveredAddress completes the addresses and port of a commissioning request from the last
+// discovery result for its long discriminator.
+func fillDiscoveredAddress(payload *CommissionDevicePayload) {
+	device, ok := pairingStates.Lookup(payload.LongDiscriminator)
+	if !ok {
+		return
+	}
+	if len(payload.Addresses) == 0 && payload.IPAddress == "" {
+		payload.Addresses = device.Addresses
+		payload.IPAddress = device.IPAddress
+	}
+	if payload.Port == "" && device.Port > 0 {
+		payload.Port = strconv.Itoa(device.Port)
+	}
+	if payload.Interface == "" {
+		payload.Interface = device.Interface
+	}
+}
+
+// handleCommissionDevice pairs a discovered device and runs the post-commissioning steps.
+func handleCommissionDevice(client *Client, payload CommissionDevicePayload) {
+	log.Printf("Handling commission_device request: %+v", payload)
+	if payload.SetupCode == "" { // Discriminator might not be strictly needed for 'pairing code' if device is uniquely identified by IP context
+		client.notifyClientLog("commissioning_log", "Missing setupCode or nodeIdToAssign for commissioning.")
+		client.sendPayload("commissioning_status", CommissioningStatusPayload{Success: false, Error: "Missing setupCode or nodeIdToAssign.", OriginalDiscriminator: payload.LongDiscriminator})
+		return
+	}
+
+	if err := normalizeCommissioningPayload(&payload); err != nil {
+		client.sendPayload("commissioning_status", CommissioningStatusPayload{Success: false, Error: err.Error(), OriginalDiscriminator: payload.LongDiscriminator})
+		return
+	}
+
+	fillDiscoveredAddress(&payload)
+	if payload.PairingMode == pairingModeAddress && len(addressPairingCommands(payload)) == 0 {
+		msg := "Pairing mode 'address' needs a usable ipAddress/addresses and a port; run discovery first or send them."
+		client.notifyClientLog("commissioning_log", msg)
+		client.sendPayload("commissioning_status", CommissioningStatusPayload{Success: false, Error: msg, OriginalDiscriminator: payload.LongDiscriminator})
+		return
+	}
+
+	if known, ok := pairingStates.Lookup(payload.LongDiscriminator); ok && !payload.Force {
+		switch known.PairingState {
+		case pairingStateCommissionedHere:
+			msg := fmt.Sprintf("Device with discriminator %s is already commissioned by this gateway as node %s. Send force to pair it again.", payload.LongDiscriminator, known.CommissionedNodeID)
+			client.notifyClientLog("commissioning_log", msg)
+			client.sendPayload("commissioning_status", CommissioningStatusPayload{Success: false, Error: msg, OriginalDiscriminator: payload.LongDiscriminator})
 			return
+		case pairingStateOtherFabric:
+			client.sendPayload("commissioning_warning", map[string]interface{}{"discriminator": payload.LongDiscriminator, "message": "Device is already commissioned on another fabric; it will be shared with this gateway (multi-admin)."})
 		}
+	}
+	if warning := commissioningWindows.Warning(payload.LongDiscriminator); warning != "" {
+		// Only a heuristic: warn, but still try
+		log.Printf("commission_device: %s", warning)
+		client.notifyClientLog("commissioning_log", "WARNING: "+warning)
+		client.sendPayload("commissioning_warning", map[string]interface{}{"discriminator": payload.LongDiscriminator, "message": warning})
+	}
+
+	jobs.Submit(client, "commissioning", func(ctx context.Context, job *Job) (interface{}, error) {
+		return commissionDevice(ctx, job, client, payload)
+	})
+}
 
-		client.notifyClientLog("commissioning_log", fmt.Sprintf("Attempting to commission Node ID %s with setup code %s (using 'pairing code')", payload.CommissioningMode, payload.SetupCode))
+// commissionDevice pairs the device with chip-tool, finds its endpoint and runs the post-commissioning steps.
+func commissionDevice(ctx context.Context, job *Job, client *Client, payload CommissionDevicePayload) (interface{}, error) {
+	client.notifyClientLog("commissioning_log", fmt.Sprintf("Attempting to commission Node ID %s with setup code %s (using 'pairing code')", payload.CommissioningMode, payload.SetupCode))
 
-		var _, err = os.Getwd()
-		if err != nil {
-			fmt.Println("Error getting current working directory:", err)
-			return
+	var _, err = os.Getwd()
+	if err != nil {
+		fmt.Println("Error getting current working directory:", err)
+		return nil, err
+	}
+	payload.NodeID = fmt.Sprintf("%04d", rand.Intn(100000))
+	fmt.Println("\n FDS NODE ID:", payload.NodeID)
+
+	//TODO DEFINIR PAYLOAD.ENDPOINTID
+
+	cmdArgs := pairingCommand(payload)
+	fmt.Println("\nCMDARGS:", cmdArgs)
+	fmt.Println("\nPAYLOAD:", payload)
+	fmt.Println("\nPAYLOAD NODE ID TO ASSIGN:", payload.CommissioningMode)
+	fmt.Println("\nPAYLOAD Discriminator:", payload.LongDiscriminator)
+	fmt.Println("\nPAYLOAD ProductID:", payload.ProductID)
+	fmt.Println("\nPAYLOAD SetupCode:", payload.SetupCode)
+	fmt.Println("\nPAYLOAD VendorID:", payload.VendorID)
+	fmt.Println("\nPAYLOAD EndpointId:", payload.EndpointId)
+	// cmdArgs := []string{"pairing", "onnetwork-long", payload.NodeIDToAssign, payload.SetupCode, payload.Discriminator}
+
+	// if paaTrustStorePath != "" { // Add PAA trust store if needed for production devices
+	//    cmdArgs = append(cmdArgs, "--paa-trust-store-path", paaTrustStorePath)
+	// }
+
+	identityFlags, err := chipToolIdentityFlags(payload.StorageDirectory, payload.CommissionerName)
+	if err != nil {
+		client.sendPayload("commissioning_status", CommissioningStatusPayload{Success: false, Error: err.Error(), OriginalDiscriminator: payload.LongDiscriminator})
+		return nil, err
+	}
+
+	job.SetProgress(10, "Pairing node "+payload.NodeID)
+	var commissioningOutput, pairingOutput string
+	for i, attempt := range pairingAttempts(payload) {
+		if i > 0 {
+			client.notifyClientLog("commissioning_log", fmt.Sprintf("Pairing failed (%v); retrying with 'pairing %s'", err, attempt[1]))
 		}
-		payload.NodeID = fmt.Sprintf("%04d", rand.Intn(100000))
-		fmt.Println("\n FDS NODE ID:", payload.NodeID)
-
-		//TODO DEFINIR PAYLOAD.ENDPOINTID
-
-		cmdArgs := []string{"pairing", "onnetwork-long", payload.NodeID, payload.SetupCode, payload.LongDiscriminator}
-		fmt.Println("\nCMDARGS:", cmdArgs)
-		fmt.Println("\nPAYLOAD:", payload)
-		fmt.Println("\nPAYLOAD NODE ID TO ASSIGN:", payload.CommissioningMode)
-		fmt.Println("\nPAYLOAD Discriminator:", payload.LongDiscriminator)
-		fmt.Println("\nPAYLOAD ProductID:", payload.ProductID)
-		fmt.Println("\nPAYLOAD SetupCode:", payload.SetupCode)
-		fmt.Println("\nPAYLOAD VendorID:", payload.VendorID)
-		fmt.Println("\nPAYLOAD EndpointId:", payload.EndpointId)
-		// cmdArgs := []string{"pairing", "onnetwork-long", payload.NodeIDToAssign, payload.SetupCode, payload.Discriminator}
-
-		// if paaTrustStorePath != "" { // Add PAA trust store if needed for production devices
-		//    cmdArgs = append(cmdArgs, "--paa-trust-store-path", paaTrustStorePath)
-		// }
-
-		cmd := exec.Command(chipToolPath, cmdArgs...)
-		fmt.Println("[DEBUG - TESTE - COMMISSIONABLES] - CMD", cmd)
-		fmt.Println("[DEBUG - TESTE - COMMISSIONABLES] - CMD", strings.Join(cmdArgs, " "))
+		cmdArgs = withChipToolStorage(client.chipToolArgs(append(attempt, identityFlags...)))
+		cmd := exec.CommandContext(ctx, chipToolPath, cmdArgs...)
 		client.notifyClientLog("commissioning_log", fmt.Sprintf("Executing: %s %s", chipToolPath, strings.Join(cmdArgs, " ")))
 		var outBuf, errBuf strings.Builder
 		cmd.Stdout = &outBuf
 		cmd.Stderr = &errBuf
+		release := chipToolWatcher.Begin()
+		started := time.Now()
 		err = cmd.Run()
+		release()
 		stdout := outBuf.String()
 		stderr := errBuf.String()
-		commissioningOutput := fmt.Sprintf("Stdout:\n%s\nStderr:\n%s", stdout, stderr)
-		log.Printf("chip-tool pairing output:\n%s", commissioningOutput)
+		client.traceChipToolRun(cmdArgs, started, stdout, stderr, err)
+		log.Printf("chip-tool pairing output:\nStdout:\n%s\nStderr:\n%s", stdout, stderr)
+		commissioningOutput, pairingOutput = client.chipToolOutput(stdout, stderr), stdout+"\n"+stderr
 		client.notifyClientLog("commissioning_log", "Commissioning command output:\n"+commissioningOutput)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		client.sendPayload("commissioning_status", CommissioningStatusPayload{Success: false, Error: "Commissioning cancelled.", OriginalDiscriminator: payload.LongDiscriminator})
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		status := CommissioningStatusPayload{
+			Success:                            false,
+			Error:                              fmt.Sprintf("Pairing failed: %v", err),
+			Details:                            commissioningOutput,
+			OriginalDiscriminator:              payload.LongDiscriminator,
+			DiscriminatorAssociatedWithRequest: payload.LongDiscriminator,
+		}.withFailureDiagnosis(pairingOutput)
+		if status.Hint != "" {
+			client.notifyClientLog("commissioning_log", "Hint: "+status.Hint)
+		}
+		client.sendPayload("commissioning_status", status)
+		return status, errors.New(status.Error)
+	}
 
-		cmdArgs = []string{"descriptor", "read", "parts-list", payload.NodeID, "0"}
-
-		cmd = exec.Command(chipToolPath, cmdArgs...)
+	job.SetProgress(60, "Reading endpoints of node "+payload.NodeID)
+	cmdArgs = withChipToolStorage(client.chipToolArgs(append([]string{"descriptor", "read", "parts-list", payload.NodeID, "0"}, identityFlags...)))
 
-		// var outBuf, errBuf strings.Builder
-		cmd.Stdout = &outBuf
-		cmd.Stderr = &errBuf
-		err = cmd.Run()
-		stdout = outBuf.String()
-		stderr = errBuf.String()
-
-		// re := regexp.MustCompile(`Data = \[\s*(?:\[\d+\.\d+\] \[\d+:\d+\] \[DMG\]\s*)*([0-9]+) \(unsigned\)`)
-		re := regexp.MustCompile(`\[TOO\]\s+\[\d+\]:\s+(\d+)`)
-		fmt.Println("=== CHIP TOOL RAW OUTPUT ===")
-		fmt.Println(stdout)
-		fmt.Println("===========================")
-		match := re.FindStringSubmatch(stdout)
-
-		if len(match) < 2 {
-			log.Printf("Failed to parse endpointId from descriptor read output. stdout: %s", stdout)
-			client.sendPayload("commissioning_status", CommissioningStatusPayload{
-				Success:                            false,
-				Error:                              "NodeID: " + payload.NodeID + "Failed to extract endpointId from descriptor read",
-				Details:                            stdout,
-				OriginalDiscriminator:              payload.LongDiscriminator,
-				DiscriminatorAssociatedWithRequest: payload.LongDiscriminator,
-			})
-			return
-		}
+	cmd := exec.CommandContext(ctx, chipToolPath, cmdArgs...)
 
-		fmt.Printf("match[0]: %s\n", match[0])
-		fmt.Printf("match[1] (EndpointId): %s\n", match[1])
+	var outBuf, errBuf strings.Builder
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+	started := time.Now()
+	err = cmd.Run()
+	stdout := outBuf.String()
+	stderr := errBuf.String()
+	client.traceChipToolRun(cmdArgs, started, stdout, stderr, err)
+
+	// re := regexp.MustCompile(`Data = \[\s*(?:\[\d+\.\d+\] \[\d+:\d+\] \[DMG\]\s*)*([0-9]+) \(unsigned\)`)
+	re := regexp.MustCompile(`\[TOO\]\s+\[\d+\]:\s+(\d+)`)
+	fmt.Println("=== CHIP TOOL RAW OUTPUT ===")
+	fmt.Println(stdout)
+	fmt.Println("===========================")
+	match := re.FindStringSubmatch(stdout)
+
+	if len(match) < 2 {
+		log.Printf("Failed to parse endpointId from descriptor read output. stdout: %s", stdout)
+		status := CommissioningStatusPayload{
+			Success:                            false,
+			Error:                              "NodeID: " + payload.NodeID + "Failed to extract endpointId from descriptor read",
+			Details:                            stdout,
+			OriginalDiscriminator:              payload.LongDiscriminator,
+			DiscriminatorAssociatedWithRequest: payload.LongDiscriminator,
+		}.withFailureDiagnosis(stdout + "\n" + stderr)
+		client.sendPayload("commissioning_status", status)
+		return status, errors.New(status.Error)
+	}
 
-		if err != nil && len(match) < 1 {
-			errMsg := fmt.Sprintf("Error commissioning device: %v. Output: %s", err, commissioningOutput)
-			log.Println(errMsg)
-			client.sendPayload("commissioning_status", CommissioningStatusPayload{
-				Success:                            false,
-				Error:                              errMsg,
-				Details:                            commissioningOutput,
-				OriginalDiscriminator:              payload.LongDiscriminator, // Still useful to send back for frontend context
-				DiscriminatorAssociatedWithRequest: payload.LongDiscriminator,
-			})
-			return
+	fmt.Printf("match[0]: %s\n", match[0])
+	fmt.Printf("match[1] (EndpointId): %s\n", match[1])
+
+	if err != nil && len(match) < 1 {
+		errMsg := fmt.Sprintf("Error commissioning device: %v. Output: %s", err, commissioningOutput)
+		log.Println(errMsg)
+		status := CommissioningStatusPayload{
+			Success:                            false,
+			Error:                              errMsg,
+			Details:                            commissioningOutput,
+			OriginalDiscriminator:              payload.LongDiscriminator, // Still useful to send back for frontend context
+			DiscriminatorAssociatedWithRequest: payload.LongDiscriminator,
 		}
+		client.sendPayload("commissioning_status", status)
+		return status, errors.New(errMsg)
+	}
 
-		// Parse commissioning output for success and actual Node ID
-		// reNodeID := regexp.MustCompile(`Successfully commissioned device with node ID (0x[0-9a-fA-F]+|\d+)`)
+	// Parse commissioning output for success and actual Node ID
+	// reNodeID := regexp.MustCompile(`Successfully commissioned device with node ID (0x[0-9a-fA-F]+|\d+)`)
+
+	log.Printf("Successfully parsed commissioned Node ID: %s", payload.NodeID)
+	// log.Println("Match[0]", match[0])
+	// log.Println("Match[1]", match[1])
+	payload.EndpointId = match[1]
+	result := CommissioningStatusPayload{
+		Success:                            true,
+		NodeID:                             payload.NodeID,
+		Details:                            "Device commissioned successfully. " + commissioningOutput,
+		EndpointId:                         payload.EndpointId,
+		OriginalDiscriminator:              payload.LongDiscriminator,
+		DiscriminatorAssociatedWithRequest: payload.LongDiscriminator,
+	}
+	client.sendPayload("commissioning_status", result)
+	job.SetProgress(80, "Registering node "+payload.NodeID)
+	introspectionCache.Invalidate(payload.NodeID, "commissioned again") // The node ID may now be another device
+
+	log.Printf("PAYLOAD: %+v", payload)
+	log.Printf("PAYLOAD.endpointId: %s", payload.EndpointId)
+
+	//TODO: RENATO 08/06 - 13:00
+	// go readAttribute(client, payload.NodeID, payload.EndpointId, "BasicInformation", "NodeLabel")
+	go readAttribute(client, payload.NodeID, payload.EndpointId, "BasicInformation", "product-name")
+	go detectAndSubscribeSwitchEvents(client, payload.NodeID, payload.EndpointId)
+	go detectAndSubscribeBattery(client, payload.NodeID, payload.EndpointId)
+	go detectAndSubscribeLockAlarms(client, payload.NodeID, payload.EndpointId)
+
+	device := RegisteredDevice{
+		ID:            payload.NodeID,
+		NodeID:        payload.NodeID,
+		EndpointID:    payload.EndpointId,
+		Name:          payload.Hostname,
+		Hostname:      payload.Hostname,
+		InstanceName:  payload.InstanceName,
+		Discriminator: payload.LongDiscriminator,
+		VendorID:      payload.VendorID,
+		ProductID:     payload.ProductID,
+		Reachable:     true,
+	}
+	if err := deviceRegistry.Put(device); err != nil {
+		log.Printf("Could not add Node %s to the device registry: %v", payload.NodeID, err)
+	} else if registered, ok := deviceRegistry.Get(device.ID); ok {
+		broadcastToClients("device_added", registered)
+	}
+	go func() {
+		applyDeviceAssignment(client, payload.NodeID, payload.Name, payload.Room, payload.Location)
+		if _, err := refreshDeviceVersion(client, payload.NodeID); err != nil {
+			log.Printf("Could not read the versions of Node %s: %v", payload.NodeID, err)
+		}
+		discoverBridgedDevices(client, payload.NodeID)
+		refreshDeviceComposition(client, payload.NodeID)
+		runPostCommissioningHooks(client, payload.NodeID, payload.EndpointId)
+	}()
+	// go readAttribute(client, payload.NodeID, "0", "BasicInformation", "NodeLabel")
 
-		log.Printf("Successfully parsed commissioned Node ID: %s", payload.NodeID)
-		// log.Println("Match[0]", match[0])
-		// log.Println("Match[1]", match[1])
-		payload.EndpointId = match[1]
+	if strings.Contains(stdout, "Commissioning success") || strings.Contains(stdout, "commissioning complete") ||
+		strings.Contains(stderr, "Commissioning success") || strings.Contains(stderr, "commissioning complete") && stderr == "" { // Added check for empty stderr
+		log.Printf("Commissioning reported success (discriminator %s), but Node ID not directly parsed. Output: %s", payload.LongDiscriminator, commissioningOutput)
 		client.sendPayload("commissioning_status", CommissioningStatusPayload{
-			Success:                            true,
-			NodeID:                             payload.NodeID,
-			Details:                            "Device commissioned successfully. " + commissioningOutput,
-			EndpointId:                         payload.EndpointId,
+			Success:                            true, // Assume success based on message
+			Details:                            "Commissioning reported success. Node ID may need to be queried or was already known. Output: " + commissioningOutput,
 			OriginalDiscriminator:              payload.LongDiscriminator,
 			DiscriminatorAssociatedWithRequest: payload.LongDiscriminator,
 		})
-
-		log.Printf("PAYLOAD: %s", payload)
-		log.Printf("PAYLOAD.endpointId: %s", payload.EndpointId)
-
-		//TODO: RENATO 08/06 - 13:00
-		// go readAttribute(client, payload.NodeID, payload.EndpointId, "BasicInformation", "NodeLabel")
-		go readAttribute(client, payload.NodeID, payload.EndpointId, "BasicInformation", "product-name")
-		// go readAttribute(client, payload.NodeID, "0", "BasicInformation", "NodeLabel")
-
-		if strings.Contains(stdout, "Commissioning success") || strings.Contains(stdout, "commissioning complete") ||
-			strings.Contains(stderr, "Commissioning success") || strings.Contains(stderr, "commissioning complete") && stderr == "" { // Added check for empty stderr
-			log.Printf("Commissioning reported success (discriminator %s), but Node ID not directly parsed. Output: %s", payload.LongDiscriminator, commissioningOutput)
-			client.sendPayload("commissioning_status", CommissioningStatusPayload{
-				Success:                            true, // Assume success based on message
-				Details:                            "Commissioning reported success. Node ID may need to be queried or was already known. Output: " + commissioningOutput,
-				OriginalDiscriminator:              payload.LongDiscriminator,
-				DiscriminatorAssociatedWithRequest: payload.LongDiscriminator,
-			})
-		} else {
-			log.Printf("Commissioning for discriminator %s may have failed or Node ID not found. Output: %s", payload.LongDiscriminator, commissioningOutput)
-			client.sendPayload("commissioning_status", CommissioningStatusPayload{
-				Success:                            false,
-				Error:                              "Commissioning finished, but success or Node ID unclear from output. Check logs.",
-				Details:                            commissioningOutput,
-				OriginalDiscriminator:              payload.LongDiscriminator,
-				DiscriminatorAssociatedWithRequest: payload.LongDiscriminator,
-			})
-		}
+	} else {
+		log.Printf("Commissioning for discriminator %s may have failed or Node ID not found. Output: %s", payload.LongDiscriminator, commissioningOutput)
+		client.sendPayload("commissioning_status", CommissioningStatusPayload{
+			Success:                            false,
+			Error:                              "Commissioning finished, but success or Node ID unclear from output. Check logs.",
+			Details:                            commissioningOutput,
+			OriginalDiscriminator:              payload.LongDiscriminator,
+			DiscriminatorAssociatedWithRequest: payload.LongDiscriminator,
+		})
+	}
+	return result, nil
 	// case "get_status":
-	// 	var payload GetStatusPayload
-	// 	payloadBytes, _ := json.Marshal(msg.Payload)
-	// 	fmt.Println("msg Payload" , msg.Payload)
-	// 	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
-	// 		client.notifyClientLog("status_response", "Invalid payload for get_status: "+err.Error())
-	// 		client.sendPayload("status_response", StatusResponsePayload{Success: false, Error: "Invalid payload: " + err.Error()}) // Assumes StatusResponsePayload is in models.go
-	// 		return
-	// 	}
-	// 	log.Printf("Handling get_status request: %+v", payload)
-	// 	if payload.NodeID == "" {
-	// 		client.sendPayload("get_status", StatusResponsePayload{Success: false, NodeID: payload.NodeID, EndpointId: payload.EndpointId, Error: "Missing nodeId or EndpointId"})
-	// 		return
-	// 	}
-	// 	cmdArgs := []string{"onoff", "read", "on-off", payload.NodeID, payload.EndpointId}
-	// 	cmd := exec.Command(chipToolPath, cmdArgs...) // Re-declare cmd
-	// 	client.notifyClientLog("status_response", fmt.Sprintf("Executing: %s %s", chipToolPath, strings.Join(cmdArgs, " ")))
-	// 	var outBuf, errBuf strings.Builder // Re-declare for this scope
-	// 	cmd.Stdout = &outBuf
-	// 	cmd.Stderr = &errBuf
-	// 	err := cmd.Run() // Re-declare err
-	// 	stdout := outBuf.String() // Re-declare
-	// 	stderr := errBuf.String() // Re-declare
-	// 	cmdOutput := fmt.Sprintf("Stdout:\n%s\nStderr:\n%s", stdout, stderr)
-	// 	log.Printf("chip-tool command output for %s.%s %s %s:\n%s", payload.NodeID, "chip-tool onoff read on-off", payload.NodeID, payload.EndpointId, cmdOutput)
-	// 	if err != nil {
-	// 		errMsg := fmt.Sprintf("Error executing %s.%s %s %s:\n%s", payload.NodeID, "chip-tool onoff read on-off", payload.NodeID, payload.EndpointId, cmdOutput)
-	// 		log.Println(errMsg)
-	// 		client.sendPayload("status_response", CommandResponsePayload{Success: false, NodeID: payload.NodeID, Error: errMsg, Details: cmdOutput})
-	// 		return
-	// 	}
-	// 	if strings.Contains(stdout, "CHIP Error") || strings.Contains(stderr, "CHIP Error") || strings.Contains(stderr, "Error:") {
-	// 		errMsg := "Command executed but chip-tool reported an error in its output."
-	// 		log.Println(errMsg, "Details:", cmdOutput)
-	// 		client.sendPayload("status_response", CommandResponsePayload{Success: false, NodeID: payload.NodeID, Error: errMsg, Details: cmdOutput})
-	// 	} else {
-	// 		// log.Printf("Command %s.%s on Node %s executed. Output: %s", payload.Cluster, payload.Command, payload.NodeID, cmdOutput)
-	// 		client.sendPayload("status_response", CommandResponsePayload{Success: true, NodeID: payload.NodeID, Details: "Command executed. Output: " + cmdOutput})
-	// 		if payload.Cluster == "OnOff" && (payload.Command == "On" || payload.Command == "Off" || payload.Command == "Toggle") {
-	// 			go readAttribute(client, payload.NodeID, endpointID, "OnOff", "OnOff")
-	// 		}
-	// 		if payload.Cluster == "LevelControl" && payload.Command == "MoveToLevel" {
-	// 			go readAttribute(client, payload.NodeID, endpointID, "LevelControl", "CurrentLevel")
-	// 		}
-	// 	}
-
-	case "device_command":
-		var payload DeviceCommandPayload
-		payloadBytes, _ := json.Marshal(msg.Payload)
-		fmt.Println("msg Payload:", msg.Payload)
-
-		if err := json.Unmarshal(payloadBytes, &payload); err != nil {
-			client.notifyClientLog("command_response", "Invalid payload for device_command: "+err.Error())
-			client.sendPayload("command_response", CommandResponsePayload{
-				Success: false,
-				Error:   "Invalid payload: " + err.Error(),
-			})
-			return
-		}
+	//
+	//	var payload GetStatusPayload
+	//	payloadBytes, _ := json.Marshal(msg.Payload)
+	//	fmt.Println("msg Payload" , msg.Payload)
+	//	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+	//		client.notifyClientLog("status_response", "Invalid payload for get_status: "+err.Error())
+	//		client.sendPayload("status_response", StatusResponsePayload{Success: false, Error: "Invalid payload: " + err.Error()}) // Assumes StatusResponsePayload is in models.go
+	//		return
+	//	}
+	//	log.Printf("Handling get_status request: %+v", payload)
+	//	if payload.NodeID == "" {
+	//		client.sendPayload("get_status", StatusResponsePayload{Success: false, NodeID: payload.NodeID, EndpointId: payload.EndpointId, Error: "Missing nodeId or EndpointId"})
+	//		return
+	//	}
+	//	cmdArgs := []string{"onoff", "read", "on-off", payload.NodeID, payload.EndpointId}
+	//	cmd := exec.Command(chipToolPath, cmdArgs...) // Re-declare cmd
+	//	client.notifyClientLog("status_response", fmt.Sprintf("Executing: %s %s", chipToolPath, strings.Join(cmdArgs, " ")))
+	//	var outBuf, errBuf strings.Builder // Re-declare for this scope
+	//	cmd.Stdout = &outBuf
+	//	cmd.Stderr = &errBuf
+	//	err := cmd.Run() // Re-declare err
+	//	stdout := outBuf.String() // Re-declare
+	//	stderr := errBuf.String() // Re-declare
+	//	cmdOutput := fmt.Sprintf("Stdout:\n%s\nStderr:\n%s", stdout, stderr)
+	//	log.Printf("chip-tool command output for %s.%s %s %s:\n%s", payload.NodeID, "chip-tool onoff read on-off", payload.NodeID, payload.EndpointId, cmdOutput)
+	//	if err != nil {
+	//		errMsg := fmt.Sprintf("Error executing %s.%s %s %s:\n%s", payload.NodeID, "chip-tool onoff read on-off", payload.NodeID, payload.EndpointId, cmdOutput)
+	//		log.Println(errMsg)
+	//		client.sendPayload("status_response", CommandResponsePayload{Success: false, NodeID: payload.NodeID, Error: errMsg, Details: cmdOutput})
+	//		return
+	//	}
+	//	if strings.Contains(stdout, "CHIP Error") || strings.Contains(stderr, "CHIP Error") || strings.Contains(stderr, "Error:") {
+	//		errMsg := "Command executed but chip-tool reported an error in its output."
+	//		log.Println(errMsg, "Details:", cmdOutput)
+	//		client.sendPayload("status_response", CommandResponsePayload{Success: false, NodeID: payload.NodeID, Error: errMsg, Details: cmdOutput})
+	//	} else {
+	//		// log.Printf("Command %s.%s on Node %s executed. Output: %s", payload.Cluster, payload.Command, payload.NodeID, cmdOutput)
+	//		client.sendPayload("status_response", CommandResponsePayload{Success: true, NodeID: payload.NodeID, Details: "Command executed. Output: " + cmdOutput})
+	//		if payload.Cluster == "OnOff" && (payload.Command == "On" || payload.Command == "Off" || payload.Command == "Toggle") {
+	//			go readAttribute(client, payload.NodeID, endpointID, "OnOff", "OnOff")
+	//		}
+	//		if payload.Cluster == "LevelControl" && payload.Command == "MoveToLevel" {
+	//			go readAttribute(client, payload.NodeID, endpointID, "LevelControl", "CurrentLevel")
+	//		}
+	//	}
+}
 
-		log.Printf("Handling device_command request: %+v", payload)
+// handleDeviceCommand runs a device command (see executeDeviceCommand).
+func handleDeviceCommand(client *Client, payload DeviceCommandPayload) {
+	executeDeviceCommand(client, payload)
+}
 
-		if payload.NodeID == "" || payload.Cluster == "" || payload.Command == "" {
-			client.sendPayload("command_response", CommandResponsePayload{
-				Success: false,
-				NodeID:  payload.NodeID,
-				Error:   "Missing nodeId, cluster, or command",
-			})
-			return
+// handleSubscribeAttribute starts a chip-tool attribute subscription.
+func handleSubscribeAttribute(client *Client, payload SubscribeAttributePayload) {
+	log.Printf("Handling subscribe_attribute request: %+v", payload)
+	if isVirtualNode(payload.NodeID) {
+		if err := virtualDevices.Subscribe(client, payload.NodeID); err != nil {
+			client.notifyClient("error", map[string]interface{}{"message": "subscribe_attribute failed: " + err.Error()})
 		}
+		return
+	}
 
-		endpointID := "13"
-		fmt.Println("payload.Params", payload.Params["endpointId"])
-		if val, ok := payload.Params["endpointId"].(string); ok && val != "" {
-			endpointID = val
+	// Known sensor attributes fall back to sensible default intervals (see sensors.go)
+	if def, ok := lookupSensorDefinition(payload.Cluster, payload.Attribute); ok {
+		if payload.MinInterval == "" {
+			payload.MinInterval = def.MinInterval
+		}
+		if payload.MaxInterval == "" {
+			payload.MaxInterval = def.MaxInterval
 		}
+	}
+	if payload.NodeID == "" || payload.Cluster == "" || payload.Attribute == "" || payload.MinInterval == "" || payload.MaxInterval == "" {
+		client.notifyClientLog("subscription_log", "Missing parameters for subscribe_attribute.")
+		client.notifyClient("error", map[string]interface{}{"message": "Missing parameters for subscribe_attribute (nodeId, cluster, attribute, minInterval, maxInterval required)."})
+		return
+	}
+	epId := payload.EndpointID
+	if epId == "" {
+		epId = "1"
+	}
+	identityFlags, err := chipToolIdentityFlags(payload.StorageDirectory, payload.CommissionerName)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "subscribe_attribute failed: " + err.Error()})
+		return
+	}
+	if reason, unsupported := unsupportedAttribute(payload.NodeID, epId, payload.Cluster, payload.Attribute); unsupported {
+		client.notifyClient("error", map[string]interface{}{"message": "subscribe_attribute refused: " + reason, "code": errCodeUnsupported})
+		return
+	}
+	attributeDebouncer.SetMinChange(payload.NodeID, epId, payload.Cluster, payload.Attribute, payload.MinChange)
+	go startAttributeSubscriptionWith(client, identityFlags, payload.NodeID, epId, payload.Cluster, payload.Attribute, payload.MinInterval, payload.MaxInterval)
+}
 
-		var cmdArgs []string
+// handleSubscribeSensorBundle subscribes every attribute of a sensor bundle (see sensors.go).
+func handleSubscribeSensorBundle(client *Client, payload SubscribeSensorBundlePayload) {
+	epId := payload.EndpointID
+	if epId == "" {
+		epId = "1"
+	}
+	if err := subscribeSensorBundle(client, payload.NodeID, epId, payload.Bundle); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "subscribe_sensor_bundle failed: " + err.Error()})
+	}
+}
 
-		switch payload.Cluster {
-		case "OnOff":
-			if strings.ToLower(payload.Command) == "read" {
-				go readAttribute(client, payload.NodeID, endpointID, "OnOff", "on-off")
-			} else {
-				cmdArgs = []string{
-					"onoff",
-					strings.ToLower(payload.Command),
-					payload.NodeID,
-					endpointID,
-				}
-			}
+// handleSubscribeSwitchEvents subscribes to the Switch cluster events of an endpoint.
+func handleSubscribeSwitchEvents(client *Client, payload GetStatusPayload) {
+	epId := payload.EndpointId
+	if epId == "" {
+		epId = "1"
+	}
+	subscribeSwitchEvents(client, payload.NodeID, epId)
+}
 
-		case "LevelControl":
-			if payload.Command == "MoveToLevel" {
-				levelVal, okL := payload.Params["level"].(float64)
-				ttVal, _ := payload.Params["transitionTime"].(float64)
-				if !okL {
-					client.sendPayload("command_response", CommandResponsePayload{
-						Success: false,
-						NodeID:  payload.NodeID,
-						Error:   "Missing or invalid 'level' parameter for MoveToLevel",
-					})
-					return
-				}
+// handleDiscoverOperational browses _matter._tcp and refreshes the registry (see operational.go).
+func handleDiscoverOperational(client *Client) {
+	discoverOperational(client)
+}
 
-				cmdArgs = []string{
-					"levelcontrol",
-					"move-to-level",
-					strconv.Itoa(int(levelVal)),
-					strconv.Itoa(int(ttVal)),
-					"0", // With On/Off
-					"0", // Endpoint ID (or more options)
-					endpointID,
-					payload.NodeID,
-				}
-			}
-		default:
-			cmdArgs = []string{
-				strings.ToLower(payload.Cluster),
-				strings.ToLower(payload.Command),
-			}
-			for _, v := range payload.Params {
-				cmdArgs = append(cmdArgs, fmt.Sprintf("%v", v))
-			}
-			cmdArgs = append(cmdArgs, payload.NodeID, endpointID)
-		}
+// handleDiagnoseDevice checks network reachability, a Matter read and subscriptions of a device (see diagnose.go).
+func handleDiagnoseDevice(client *Client, payload DiagnoseDevicePayload) {
+	report, err := diagnoseDevice(payload.DeviceID)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "diagnose_device failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("device_diagnostics", report)
+}
 
-		// Execute the chip-tool command
-		cmd := exec.Command(chipToolPath, cmdArgs...)
-		client.notifyClientLog("command_response", fmt.Sprintf("Executing: %s %s", chipToolPath, strings.Join(cmdArgs, " ")))
+// handleInspectCertificates decodes the operational certificates held by a node (see certificates.go).
+func handleInspectCertificates(client *Client, payload FabricNodePayload) {
+	report, err := inspectNodeCertificates(payload.NodeID)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "inspect_certificates failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("node_certificates", report)
+}
 
-		var outBuf, errBuf strings.Builder
-		cmd.Stdout = &outBuf
-		cmd.Stderr = &errBuf
+// handleCheckFabric compares the registry with chip-tool's fabric state (see fabricsync.go).
+func handleCheckFabric(client *Client) {
+	startFabricCheck(client)
+}
 
-		err := cmd.Run()
-		stdout := outBuf.String()
-		stderr := errBuf.String()
-		cmdOutput := fmt.Sprintf("Stdout:\n%s\nStderr:\n%s", stdout, stderr)
+// handleAdoptNode adds a node found on the fabric but missing from the registry.
+func handleAdoptNode(client *Client, payload FabricNodePayload) {
+	if _, err := adoptNode(client, payload.NodeID); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "adopt_node failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("device_list", DeviceListPayload{Devices: listDevices()})
+}
 
-		log.Printf("chip-tool output for %s.%s on %s:\n%s", payload.Cluster, payload.Command, payload.NodeID, cmdOutput)
+// handleUnpairNode removes a node missing from the registry from the fabric.
+func handleUnpairNode(client *Client, payload FabricNodePayload) {
+	if err := unpairNode(client, payload.NodeID); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "unpair_node failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("node_unpaired", map[string]interface{}{"nodeId": payload.NodeID})
+}
 
-		reValue := regexp.MustCompile(`Data\s*=\s*(true|false),`)
+// unpairNode removes a node from the fabric with "chip-tool pairing unpair".
+func unpairNode(client *Client, nodeID string) error {
+	client.notifyClientLog("commissioning_log", fmt.Sprintf("Unpairing node %s...", nodeID))
+	stdout, stderr, err := runChipTool("pairing", "unpair", nodeID)
+	if chipToolFailed(stdout, stderr, err) {
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
 
-		matches := reValue.FindStringSubmatch(stdout)
-		fmt.Println("Regex Matched", matches)
-		if len(matches) > 1 {
-			client.sendPayload("command_response", CommandResponsePayload{
-				Success: true,
-				NodeID:  payload.NodeID,
-				Details: "Command executed. Output: " + matches[1],
-			})
+// handleListPollingProfiles sends the polling profiles (see poller.go).
+func handleListPollingProfiles(client *Client) {
+	client.sendPayload("polling_profiles", map[string]interface{}{"profiles": poller.List()})
+}
+
+// handleSetPollingProfile creates or replaces the polling profile of a device.
+func handleSetPollingProfile(client *Client, profile PollingProfile) {
+	profile.Auto = false // Profiles set by users are kept when subscriptions recover
+	if err := poller.Put(profile); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "set_polling_profile failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("polling_profiles", map[string]interface{}{"profiles": poller.List()})
+}
+
+// handleDeletePollingProfile stops polling a device.
+func handleDeletePollingProfile(client *Client, payload DeviceIDPayload) {
+	if err := poller.Delete(payload.DeviceID); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "delete_polling_profile failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("polling_profiles", map[string]interface{}{"profiles": poller.List()})
+}
+
+// handleListJobs sends the status of the background jobs.
+func handleListJobs(client *Client) {
+	client.sendPayload("job_list", map[string]interface{}{"jobs": jobs.List()})
+}
+
+// handleCancelJob cancels a queued or running job; its final state arrives as a "job_update".
+func handleCancelJob(client *Client, payload JobIDPayload) {
+	if err := jobs.Cancel(payload.JobID); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "cancel_job failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("job_cancelling", map[string]interface{}{"jobId": payload.JobID})
+}
+
+// handleRemoveDevice unpairs a device (unless localOnly) and removes everything referring to it.
+func handleRemoveDevice(client *Client, payload RemoveDevicePayload) {
+	if _, err := removeDevice(client, payload.DeviceID, !payload.LocalOnly); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "remove_device failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("device_list", DeviceListPayload{Devices: listDevices()})
+}
+
+// handleReconcileDevices runs the orphan detection immediately instead of waiting for the next interval.
+func handleReconcileDevices(client *Client) {
+	client.sendPayload("orphaned_devices", DeviceListPayload{Devices: reconciler.Reconcile()})
+}
+
+func handleListDevices(client *Client) {
+	client.sendPayload("device_list", DeviceListPayload{Devices: listDevices()})
+}
+
+// handleGetChipToolInfo sends the result of the latest chip-tool probe.
+func handleGetChipToolInfo(client *Client) {
+	client.sendPayload("chip_tool_info", chipToolWatcher.Info())
+}
+
+// handleGetDashboard sends the aggregated dashboard (see dashboard.go).
+func handleGetDashboard(client *Client) {
+	client.sendPayload("dashboard", buildDashboard())
+}
+
+// handleGetDevice sends a single registry device with its details.
+func handleGetDevice(client *Client, payload DeviceIDPayload) {
+	device, ok := lookupDevice(payload.DeviceID)
+	if !ok {
+		client.notifyClient("error", map[string]interface{}{"message": fmt.Sprintf("get_device failed: device %q is not in the registry", payload.DeviceID)})
+		return
+	}
+	client.sendPayload("device_details", device)
+}
+
+// handleRefreshDeviceVersion reads the firmware/hardware versions of a device again (see firmware.go).
+func handleRefreshDeviceVersion(client *Client, payload DeviceIDPayload) {
+	device, err := refreshDeviceVersion(client, payload.DeviceID)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "refresh_device_version failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("device_details", device)
+}
+
+func handleDiscoverBridgedDevices(client *Client, payload GetStatusPayload) {
+	discoverBridgedDevices(client, payload.NodeID)
+}
+
+func handleDescribeEndpoints(client *Client, payload GetStatusPayload) {
+	refreshDeviceComposition(client, payload.NodeID)
+}
+
+func handleChangeWiFiNetwork(client *Client, payload ChangeWiFiNetworkPayload) {
+	log.Printf("Handling change_wifi_network request for node %s (SSID %s)", payload.NodeID, payload.SSID)
+	changeWiFiNetwork(client, payload)
+}
+
+func handleSetFavorite(client *Client, payload SetFavoritePayload) {
+	if err := deviceRegistry.Update(payload.DeviceID, func(device *RegisteredDevice) { device.Favorite = payload.Favorite }); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "set_favorite failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("device_list", DeviceListPayload{Devices: listDevices()})
+}
+
+// handleGetHubStats sends the hub's client and delivery statistics; the per-client detail only
+// to connections to the admin listener.
+func handleGetHubStats(client *Client) {
+	stats := client.hub.Stats()
+	if client.base().admin {
+		client.sendPayload("hub_stats", stats)
+		return
+	}
+	client.sendPayload("hub_stats", stats.Summary())
+}
+
+func handleGetLatencyMetrics(client *Client) {
+	client.sendPayload("latency_metrics", sessionWarmer.Metrics())
+}
+
+func handleGetDeviceHealth(client *Client) {
+	client.sendPayload("device_health_report", DeviceHealthListPayload{Devices: deviceHealth.Reports()})
+}
+
+func handleListRules(client *Client) {
+	client.sendPayload("rules_list", RulesListPayload{Rules: rulesEngine.List()})
+}
+
+func handleAddRule(client *Client, rule Rule) {
+	saved, err := rulesEngine.Put(rule)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "add_rule failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("rule_saved", saved)
+}
+
+func handleDeleteRule(client *Client, payload RuleIDPayload) {
+	if err := rulesEngine.Delete(payload.ID); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "delete_rule failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("rules_list", RulesListPayload{Rules: rulesEngine.List()})
+}
+
+func handleListAlertRules(client *Client) {
+	client.sendPayload("alert_rules_list", AlertRulesListPayload{Rules: alertEngine.List()})
+}
+
+func handleAddAlertRule(client *Client, rule AlertRule) {
+	saved, err := alertEngine.Put(rule)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "add_alert_rule failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("alert_rule_saved", saved)
+}
+
+func handleDeleteAlertRule(client *Client, payload RuleIDPayload) {
+	if err := alertEngine.Delete(payload.ID); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "delete_alert_rule failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("alert_rules_list", AlertRulesListPayload{Rules: alertEngine.List()})
+}
+
+func handleListAlerts(client *Client) {
+	client.sendPayload("alerts", AlertsPayload{Active: alertEngine.Active(), History: alertEngine.History()})
+}
+
+func handleGetSensorReadings(client *Client, payload GetStatusPayload) {
+	client.sendPayload("sensor_readings", SensorReadingsPayload{NodeID: payload.NodeID, Readings: sensorReadingsForNode(payload.NodeID)})
+}
+
+func handleGetAttributeHistory(client *Client, payload AttributeHistoryRequestPayload) {
+	if payload.EndpointID == "" {
+		payload.EndpointID = "1"
+	}
+	limit, ok := historyLimit(client, payload.Limit)
+	if !ok {
+		return
+	}
+	client.sendPayload("attribute_history", AttributeHistoryPayload{
+		NodeID:     payload.NodeID,
+		EndpointID: payload.EndpointID,
+		Cluster:    payload.Cluster,
+		Attribute:  payload.Attribute,
+		Points:     attributeHistory.Query(payload.NodeID, payload.EndpointID, payload.Cluster, payload.Attribute, limit),
+	})
+}
+
+func handleListCustomMessages(client *Client) {
+	client.sendPayload("custom_messages", map[string]interface{}{"types": customMessageTypes()})
+}
+
+// executeDeviceCommand runs a device command through chip-tool and reports the result to the client.
+// client may be nil when the command originates from the backend itself (e.g. a rule).
+func executeDeviceCommand(client *Client, payload DeviceCommandPayload) {
+	log.Printf("Handling device_command request: %+v", payload)
+
+	if (payload.NodeID == "" && payload.DeviceID == "") || payload.Cluster == "" || payload.Command == "" {
+		client.sendPayload("command_response", CommandResponsePayload{
+			Success: false,
+			NodeID:  payload.NodeID,
+			Error:   "Missing nodeId (or deviceId), cluster, or command",
+		})
+		return
+	}
+	if forwardDeviceCommand(client, payload) { // A device of a remote hub (see federation.go)
+		return
+	}
+
+	endpointID := "13"
+	fmt.Println("payload.Params", payload.Params["endpointId"])
+	if val, ok := payload.Params["endpointId"].(string); ok && val != "" {
+		endpointID = val
+	}
+	// Registry devices (e.g. devices behind a bridge) are addressed by deviceId and routed to their own endpoint
+	if payload.DeviceID != "" {
+		nodeID, deviceEndpoint, err := deviceRegistry.resolveDeviceTarget(payload.DeviceID)
+		if err != nil {
+			client.sendPayload("command_response", CommandResponsePayload{Success: false, NodeID: payload.NodeID, Error: err.Error()})
+			return
+		}
+		payload.NodeID, endpointID = nodeID, deviceEndpoint
+	}
+	if reason, unsupported := unsupportedCommand(payload.NodeID, endpointID, payload.Cluster, payload.Command); unsupported {
+		client.sendPayload("command_response", CommandResponsePayload{Success: false, NodeID: payload.NodeID, Error: reason, Code: errCodeUnsupported})
+		return
+	}
+	if reason, skip := commandStates.Precondition(payload, endpointID); skip {
+		client.sendPayload("command_response", CommandResponsePayload{Success: true, NodeID: payload.NodeID, Details: reason, Skipped: true})
+		return
+	}
+	expected, known := commandStates.Expect(payload, endpointID)
+	if !usesChipTool() {
+		invokeDeviceCommand(client, payload, endpointID, expected, known)
+		return
+	}
+
+	var cmdArgs []string
+
+	switch payload.Cluster {
+	case "OnOff":
+		if strings.ToLower(payload.Command) == "read" {
+			go readAttribute(client, payload.NodeID, endpointID, "OnOff", "on-off")
+		} else {
+			cmdArgs = []string{
+				"onoff",
+				strings.ToLower(payload.Command),
+				payload.NodeID,
+				endpointID,
+			}
 		}
 
-		if err != nil || strings.Contains(stdout, "CHIP Error") || strings.Contains(stderr, "CHIP Error") || strings.Contains(stderr, "Error:") {
-			errMsg := "Command failed or chip-tool reported an error."
-			if err != nil {
-				errMsg = fmt.Sprintf("Execution error: %v", err)
+	case "LevelControl":
+		if payload.Command == "MoveToLevel" {
+			levelVal, okL := payload.Params["level"].(float64)
+			ttVal, _ := payload.Params["transitionTime"].(float64)
+			if !okL {
+				client.sendPayload("command_response", CommandResponsePayload{
+					Success: false,
+					NodeID:  payload.NodeID,
+					Error:   "Missing or invalid 'level' parameter for MoveToLevel",
+				})
+				return
 			}
+
+			cmdArgs = []string{
+				"levelcontrol",
+				"move-to-level",
+				strconv.Itoa(int(levelVal)),
+				strconv.Itoa(int(ttVal)),
+				"0", // With On/Off
+				"0", // Endpoint ID (or more options)
+				endpointID,
+				payload.NodeID,
+			}
+		}
+	case "RvcRunMode", "RvcCleanMode", "RvcOperationalState":
+		args, err := buildRvcCommandArgs(payload, endpointID)
+		if err != nil {
 			client.sendPayload("command_response", CommandResponsePayload{
 				Success: false,
 				NodeID:  payload.NodeID,
-				Error:   errMsg,
-				Details: cmdOutput,
+				Error:   err.Error(),
 			})
 			return
 		}
-
-		// Optional follow-up reads
-		if payload.Cluster == "OnOff" && (payload.Command == "On" || payload.Command == "Off" || payload.Command == "Toggle") {
-			go readAttribute(client, payload.NodeID, endpointID, "OnOff", "on-off")
+		cmdArgs = args
+	default:
+		cmdArgs = []string{
+			strings.ToLower(payload.Cluster),
+			strings.ToLower(payload.Command),
 		}
-		if payload.Cluster == "LevelControl" && payload.Command == "MoveToLevel" {
-			go readAttribute(client, payload.NodeID, endpointID, "LevelControl", "current-level")
+		for _, v := range payload.Params {
+			cmdArgs = append(cmdArgs, fmt.Sprintf("%v", v))
 		}
+		cmdArgs = append(cmdArgs, payload.NodeID, endpointID)
+	}
 
-	case "subscribe_attribute":
-		var payload SubscribeAttributePayload // Already defined globally in this file for the example
-		payloadBytes, _ := json.Marshal(msg.Payload)
-		if err := json.Unmarshal(payloadBytes, &payload); err != nil {
-			client.notifyClientLog("subscription_log", "Invalid payload for subscribe_attribute: "+err.Error())
-			client.notifyClient("error", map[string]interface{}{"message": "Invalid subscribe_attribute payload: " + err.Error()})
-			return
-		}
-		log.Printf("Handling subscribe_attribute request: %+v", payload)
+	identityFlags, err := chipToolIdentityFlags(payload.StorageDirectory, payload.CommissionerName)
+	if err != nil {
+		client.sendPayload("command_response", CommandResponsePayload{Success: false, NodeID: payload.NodeID, Error: err.Error()})
+		return
+	}
+	cmdArgs = withChipToolStorage(client.chipToolArgs(append(cmdArgs, identityFlags...)))
 
-		if payload.NodeID == "" || payload.Cluster == "" || payload.Attribute == "" || payload.MinInterval == "" || payload.MaxInterval == "" {
-			client.notifyClientLog("subscription_log", "Missing parameters for subscribe_attribute.")
-			client.notifyClient("error", map[string]interface{}{"message": "Missing parameters for subscribe_attribute (nodeId, cluster, attribute, minInterval, maxInterval required)."})
-			return
-		}
-		epId := payload.EndpointID
-		if epId == "" {
-			epId = "1"
+	// Execute the chip-tool command
+	cmd := exec.Command(chipToolPath, cmdArgs...)
+	client.notifyClientLog("command_response", fmt.Sprintf("Executing: %s %s", chipToolPath, strings.Join(cmdArgs, " ")))
+
+	var outBuf, errBuf strings.Builder
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+
+	wasWarm := sessionWarmer.IsWarm(payload.NodeID)
+	waiting := client.traceSpan().Child("chip-tool wait") // Held while chip-tool is being replaced
+	release := chipToolWatcher.Begin()
+	waiting.End()
+	started := time.Now()
+	err = cmd.Run()
+	release()
+	stdout := outBuf.String()
+	stderr := errBuf.String()
+	client.traceChipToolRun(cmdArgs, started, stdout, stderr, err)
+	parsing := client.traceSpan().Child("parse output")
+	defer parsing.End()
+	cmdOutput := client.chipToolOutput(stdout, stderr)
+	latency, succeeded := time.Since(started), !chipToolFailed(stdout, stderr, err)
+	sessionWarmer.RecordCommand(payload.NodeID, latency, wasWarm, succeeded)
+	deviceHealth.Record(payload.NodeID, latency, succeeded)
+
+	log.Printf("chip-tool output for %s.%s on %s:\nStdout:\n%s\nStderr:\n%s", payload.Cluster, payload.Command, payload.NodeID, stdout, stderr)
+
+	reValue := regexp.MustCompile(`Data\s*=\s*(true|false),`)
+
+	matches := reValue.FindStringSubmatch(stdout)
+	fmt.Println("Regex Matched", matches)
+	if len(matches) > 1 {
+		client.sendPayload("command_response", CommandResponsePayload{
+			Success: true,
+			NodeID:  payload.NodeID,
+			Details: "Command executed. Output: " + matches[1],
+		})
+	}
+
+	if err != nil || strings.Contains(stdout, "CHIP Error") || strings.Contains(stderr, "CHIP Error") || strings.Contains(stderr, "Error:") {
+		errMsg := "Command failed or chip-tool reported an error."
+		if err != nil {
+			errMsg = fmt.Sprintf("Execution error: %v", err)
 		}
-		go startAttributeSubscription(client, payload.NodeID, epId, payload.Cluster, payload.Attribute, payload.MinInterval, payload.MaxInterval)
+		client.sendPayload("command_response", CommandResponsePayload{
+			Success: false,
+			NodeID:  payload.NodeID,
+			Error:   errMsg,
+			Details: cmdOutput,
+		})
+		return
+	}
 
-	default:
-		log.Printf("Unknown message type from client %v: %s", client.conn.RemoteAddr(), msg.Type)
-		client.notifyClient("error", map[string]interface{}{"message": "Unknown command type received: " + msg.Type})
+	if known {
+		commandStates.Apply(client, expected)
+	}
+	// Optional follow-up reads
+	if payload.Cluster == "OnOff" && (payload.Command == "On" || payload.Command == "Off" || payload.Command == "Toggle") {
+		go readAttribute(client, payload.NodeID, endpointID, "OnOff", "on-off")
+	}
+	if payload.Cluster == "LevelControl" && payload.Command == "MoveToLevel" {
+		go readAttribute(client, payload.NodeID, endpointID, "LevelControl", "current-level")
+	}
+	if isRvcCluster(payload.Cluster) {
+		go readAttribute(client, payload.NodeID, endpointID, payload.Cluster, rvcStateAttributes[payload.Cluster])
+	}
+}
+
+// invokeDeviceCommand runs a device command through a controller other than chip-tool. "read"
+// commands read the cluster's state attribute instead, as with chip-tool. When known is set,
+// the expected state is applied once the command succeeded (see commandstate.go).
+func invokeDeviceCommand(client *Client, payload DeviceCommandPayload, endpointID string, expected expectedState, known bool) {
+	if strings.ToLower(payload.Command) == "read" && payload.Cluster == "OnOff" {
+		go readAttribute(client, payload.NodeID, endpointID, "OnOff", "on-off")
+		return
+	}
+	wasWarm := sessionWarmer.IsWarm(payload.NodeID)
+	started := time.Now()
+	err := controller.InvokeCommand(payload.NodeID, endpointID, payload.Cluster, payload.Command, payload.Params)
+	latency := time.Since(started)
+	sessionWarmer.RecordCommand(payload.NodeID, latency, wasWarm, err == nil)
+	deviceHealth.Record(payload.NodeID, latency, err == nil)
+	if err != nil {
+		client.sendPayload("command_response", CommandResponsePayload{Success: false, NodeID: payload.NodeID, Error: err.Error()})
+		return
+	}
+	client.sendPayload("command_response", CommandResponsePayload{
+		Success: true,
+		NodeID:  payload.NodeID,
+		Details: fmt.Sprintf("%s.%s sent through %s", payload.Cluster, payload.Command, controller.Name()),
+	})
+	if known {
+		commandStates.Apply(client, expected)
+	}
+	readBackState(client, payload.NodeID, endpointID, payload.Cluster)
+}
+
+// readBackState reads the state attribute of a cluster after a command changed it, so every client
+// sees the new state. The cluster may be named like chip-tool ("onoff") or the frontend ("OnOff").
+func readBackState(client *Client, nodeID, endpointID, cluster string) {
+	switch strings.ToLower(cluster) {
+	case "onoff":
+		go readAttribute(client, nodeID, endpointID, "OnOff", "on-off")
+	case "levelcontrol":
+		go readAttribute(client, nodeID, endpointID, "LevelControl", "current-level")
+	}
+	for rvcCluster, attribute := range rvcStateAttributes {
+		if strings.EqualFold(cluster, rvcCluster) {
+			go readAttribute(client, nodeID, endpointID, rvcCluster, attribute)
+		}
 	}
 }
 
@@ -594,6 +1368,55 @@ func extractValueAfterKey(line, key string) string {
 	return ""
 }
 
+// reIPAddressLine matches the "IP Address #N: <address>" lines of a discovered node; some builds omit "#N"
+var reIPAddressLine = regexp.MustCompile(`IP Address(?: #(\d+))?:\s*(\S+)`)
+
+// discoveryMarkers tag discovery log lines: "[DIS]" in most chip-tool builds, "CHIP:DIS:" in older ones.
+var discoveryMarkers = []string{"[DIS]", "CHIP:DIS:"}
+
+// reLogPrefix matches the bracketed timestamp/thread prefixes of chip-tool log lines, e.g. "[1700000000.123][1234:1234] "
+var reLogPrefix = regexp.MustCompile(`^(?:\[[^\]]*\]\s*)+`)
+
+// reDiscoveryKey matches the key of a "Key: value" discovery field once the log prefix is removed,
+// without the "#N" of the IP Address lines
+var reDiscoveryKey = regexp.MustCompile(`^([A-Za-z][A-Za-z ]*?)(?: #\d+)?:`)
+
+// discoveryKeys are the fields of a discovered node, the only untagged lines accepted.
+var discoveryKeys = map[string]bool{
+	"Hostname": true, "IP Address": true, "Interface Id": true, "Port": true,
+	"Mrp Interval idle": true, "Mrp Interval active": true, "Mrp Active Threshold": true,
+	"TCP Client Supported": true, "TCP Server Supported": true, "ICD": true,
+	"Vendor ID": true, "Product ID": true, "Long Discriminator": true, "Short Discriminator": true,
+	"Discriminator": true, "Pairing Hint": true, "Instance Name": true, "Commissioning Mode": true,
+	"Supports Commissioner Generated Passcode": true,
+}
+
+// discoveryLineContent returns the part of a discovery output line after its [DIS] tag. Newer builds
+// may log discovery fields untagged: inside a device block (inBlock), a line is accepted when its key
+// is a discovery field and it has no other log category ("CHIP:DL:", "[DL]"), so the lines of other
+// modules are not parsed as fields of the device.
+func discoveryLineContent(line string, inBlock bool) (string, bool) {
+	for _, marker := range discoveryMarkers {
+		if idx := strings.Index(line, marker); idx != -1 {
+			return strings.TrimSpace(line[idx+len(marker):]), true
+		}
+	}
+	if idx := strings.Index(line, "Discovered commissionable/commissioner node:"); idx != -1 {
+		return line[idx:], true
+	}
+	if !inBlock {
+		return "", false
+	}
+	if reLogCategory.MatchString(line) {
+		return "", false
+	}
+	content := strings.TrimSpace(reLogPrefix.ReplaceAllString(line, ""))
+	if m := reDiscoveryKey.FindStringSubmatch(content); m == nil || !discoveryKeys[m[1]] {
+		return "", false
+	}
+	return content, true
+}
+
 // parseDiscoveryOutput parses the output of `chip-tool discover commissionables`
 func parseDiscoveryOutput(output string, client *Client) []DiscoveredDevice { // DiscoveredDevice should be in models.go
 	var devices []DiscoveredDevice
@@ -605,20 +1428,17 @@ func parseDiscoveryOutput(output string, client *Client) []DiscoveredDevice { //
 		rawLine := scanner.Text()
 		strippedLine := stripAnsi(rawLine) // Remove ANSI codes first
 
-		disMarker := "[DIS]"
-		idxDis := strings.Index(strippedLine, disMarker)
-		if idxDis == -1 {
+		contentAfterDis, ok := discoveryLineContent(strippedLine, currentDevice != nil)
+		if !ok {
 			// client.notifyClientLog("discovery_log", "Skipping non-DIS line: '"+strippedLine+"'")
 			continue
 		}
-
-		contentAfterDis := strings.TrimSpace(strippedLine[idxDis+len(disMarker):])
 		if client != nil {
 			client.notifyClientLog("discovery_log", "Processing content after [DIS]: '"+contentAfterDis+"'")
 		}
 
 		if strings.HasPrefix(contentAfterDis, "Discovered commissionable/commissioner node:") {
-			if currentDevice != nil && (currentDevice.Discriminator != "" || currentDevice.InstanceName != "") {
+			if currentDevice != nil && (currentDevice.Discriminator != "" || currentDevice.ShortDiscriminator != "" || currentDevice.InstanceName != "") {
 				if currentDevice.ID == "" {
 					if currentDevice.InstanceName != "" {
 						currentDevice.ID = fmt.Sprintf("dnsd_instance_%s", currentDevice.InstanceName)
@@ -655,11 +1475,19 @@ func parseDiscoveryOutput(output string, client *Client) []DiscoveredDevice { //
 				if client != nil {
 					client.notifyClientLog("discovery_log", fmt.Sprintf("Parsed Hostname (as Name): %s", currentDevice.Name))
 				}
-			} else if val = extractValueAfterKey(contentAfterDis, "IP Address #1:"); val != "" {
-				currentDevice.IPAddress = val // Assign to the new IPAddress field
+			} else if m := reIPAddressLine.FindStringSubmatch(contentAfterDis); m != nil {
+				// Every address is kept (see addressing.go); #1 stays the default until the best one is chosen
+				if !containsString(currentDevice.Addresses, m[2]) {
+					currentDevice.Addresses = append(currentDevice.Addresses, m[2])
+				}
+				if m[1] == "1" || currentDevice.IPAddress == "" {
+					currentDevice.IPAddress = m[2]
+				}
 				if client != nil {
-					client.notifyClientLog("discovery_log", fmt.Sprintf("Parsed IP Address: %s", currentDevice.IPAddress))
+					client.notifyClientLog("discovery_log", fmt.Sprintf("Parsed IP Address #%s: %s", m[1], m[2]))
 				}
+			} else if val = extractValueAfterKey(contentAfterDis, "Interface Id:"); val != "" {
+				currentDevice.InterfaceID = val
 			} else if val = extractValueAfterKey(contentAfterDis, "Port:"); val != "" {
 				if port, err := strconv.Atoi(val); err == nil {
 					currentDevice.Port = port // Assign to the new Port field
@@ -714,10 +1542,14 @@ func parseDiscoveryOutput(output string, client *Client) []DiscoveredDevice { //
 					client.notifyClientLog("discovery_log", fmt.Sprintf("Parsed Product ID: %s", currentDevice.ProductID))
 				}
 			} else if val = extractValueAfterKey(contentAfterDis, "Long Discriminator:"); val != "" {
-				currentDevice.Discriminator = val // Still a string as per updated struct
+				currentDevice.Discriminator = discoveredDiscriminator(val, maxLongDiscriminator)
 				if client != nil {
 					client.notifyClientLog("discovery_log", fmt.Sprintf("Parsed Long Discriminator: %s", currentDevice.Discriminator))
 				}
+			} else if val = extractValueAfterKey(contentAfterDis, "Short Discriminator:"); val != "" {
+				currentDevice.ShortDiscriminator = discoveredDiscriminator(val, maxShortDiscriminator)
+			} else if val = extractValueAfterKey(contentAfterDis, "Discriminator:"); val != "" {
+				currentDevice.Discriminator = discoveredDiscriminator(val, maxLongDiscriminator) // Builds printing a single "Discriminator:" line
 			} else if val = extractValueAfterKey(contentAfterDis, "Pairing Hint:"); val != "" {
 				if ph, err := strconv.ParseUint(val, 10, 16); err == nil {
 					currentDevice.PairingHint = uint16(ph)
@@ -763,7 +1595,7 @@ func parseDiscoveryOutput(output string, client *Client) []DiscoveredDevice { //
 		}
 	}
 
-	if currentDevice != nil && (currentDevice.Discriminator != "" || currentDevice.InstanceName != "") {
+	if currentDevice != nil && (currentDevice.Discriminator != "" || currentDevice.ShortDiscriminator != "" || currentDevice.InstanceName != "") {
 		if currentDevice.ID == "" {
 			if currentDevice.InstanceName != "" {
 				currentDevice.ID = fmt.Sprintf("dnsd_instance_%s", currentDevice.InstanceName)
@@ -797,31 +1629,24 @@ func parseDiscoveryOutput(output string, client *Client) []DiscoveredDevice { //
 }
 
 func (c *Client) notifyClientLog(logType string, data string) {
-	msg := ServerMessage{Type: logType, Payload: data} // ServerMessage should be in models.go
-	bytes, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("Error marshalling log message for client %v: %v", c.conn.RemoteAddr(), err)
-		return
-	}
-	select {
-	case c.send <- bytes:
-	default:
-		log.Printf("Client %v send channel full, log message dropped: %s", c.conn.RemoteAddr(), logType)
-	}
+	c.notifyClient(logType, data)
 }
 
+// notifyClient publishes a message addressed to the client on the event bus; the hub delivers it.
+// Backend-originated work (rules, background jobs) has no client: its events only reach internal subscribers.
 func (c *Client) notifyClient(msgType string, payload interface{}) {
-	msg := ServerMessage{Type: msgType, Payload: payload} // ServerMessage should be in models.go
-	bytes, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("Error marshalling server message for client %v: %v", c.conn.RemoteAddr(), err)
-		return
-	}
-	select {
-	case c.send <- bytes:
-	default:
-		log.Printf("Client %v send channel full, message dropped: %s", c.conn.RemoteAddr(), msgType)
+	event := Event{Type: msgType, Payload: payload}
+	if c != nil {
+		event.Client, event.RequestID = c.base(), c.requestID
+		if c.trace != nil {
+			c.trace.addMessage(msgType, payload)
+		}
+		c.span.recordMessage(msgType, payload)
+		if c.observe != nil {
+			c.observe(msgType, payload)
+		}
 	}
+	eventBus.Publish(event)
 }
 
 func (c *Client) sendPayload(msgType string, payload interface{}) {
@@ -835,17 +1660,32 @@ func readAttribute(client *Client, nodeID, endpointID, clusterName, attributeNam
 	}
 	log.Printf("Attempting to read attribute %s.%s for Node %s Endpoint %s", clusterName, attributeName, nodeID, endpointID)
 	client.notifyClientLog("commissioning_log", fmt.Sprintf("Reading attribute %s.%s for Node %s...", clusterName, attributeName, nodeID))
+	if !usesChipTool() {
+		value, err := controller.ReadAttribute(nodeID, endpointID, clusterName, attributeName)
+		if err != nil {
+			log.Printf("Error reading attribute: %v", err)
+			client.notifyClientLog("commissioning_log", fmt.Sprintf("Failed to read %s.%s. Reason: %v", clusterName, attributeName, err))
+			return
+		}
+		publishAttributeUpdate(client, AttributeUpdatePayload{NodeID: nodeID, EndpointID: endpointID, Cluster: clusterName, Attribute: attributeName, Value: value})
+		return
+	}
 
 	cmdArgs := []string{strings.ToLower(clusterName), "read", attributeName, nodeID, endpointID} // Attribute name often PascalCase for chip-tool read
+	cmdArgs = withChipToolStorage(client.chipToolArgs(cmdArgs))
 	fmt.Println("PRINTING: CMD ARGS", cmdArgs)
 
 	cmd := exec.Command(chipToolPath, cmdArgs...)
 	var outBuf, errBuf strings.Builder
 	cmd.Stdout = &outBuf
 	cmd.Stderr = &errBuf
+	release := chipToolWatcher.Begin()
+	started := time.Now()
 	err := cmd.Run()
+	release()
 	stdout := outBuf.String()
 	stderr := errBuf.String()
+	client.traceChipToolRun(cmdArgs, started, stdout, stderr, err)
 	cmdOutput := fmt.Sprintf("Read Attribute Stdout:\n%s\nRead Attribute Stderr:\n%s", stdout, stderr)
 	log.Println(cmdOutput)
 
@@ -859,53 +1699,76 @@ func readAttribute(client *Client, nodeID, endpointID, clusterName, attributeNam
 		return
 	}
 
-	var value interface{}
-	parsed := false
-	reValue := regexp.MustCompile(`Data\s*=\s*(true|false),`)
-
-	matches := reValue.FindStringSubmatch(stdout)
-	fmt.Println("Regex Matched", matches)
-	if len(matches) > 1 {
-		valStr := strings.TrimSpace(matches[1])
-		if bVal, err := strconv.ParseBool(valStr); err == nil {
-			value = bVal
-			parsed = true
-		} else if iVal, err := strconv.ParseInt(valStr, 10, 64); err == nil {
-			value = iVal
-			parsed = true
-		} else if fVal, err := strconv.ParseFloat(valStr, 64); err == nil {
-			value = fVal
-			parsed = true
-		} else {
-			if strings.HasPrefix(valStr, `"`) && strings.HasSuffix(valStr, `"`) {
-				value = strings.Trim(valStr, `"`)
-			} else {
-				value = valStr
-			}
-			parsed = true
-		}
-	}
+	value, parsed := parseReadValue(stdout)
 	if !parsed {
 		log.Printf("Could not parse value for attribute %s.%s from output: %s", clusterName, attributeName, stdout)
 		client.notifyClientLog("commissioning_log", fmt.Sprintf("Could not parse value for %s.%s", clusterName, attributeName))
 		value = "Raw: " + stdout
 	}
 	log.Printf("Attribute %s.%s for Node %s read. Value: %v (Parsed: %t)", clusterName, attributeName, nodeID, value, parsed)
-	client.sendPayload("attribute_update", AttributeUpdatePayload{ // Assumes AttributeUpdatePayload is in models.go
+	publishAttributeUpdate(client, AttributeUpdatePayload{ // Assumes AttributeUpdatePayload is in models.go
 		NodeID: nodeID, EndpointID: endpointID, Cluster: clusterName, Attribute: attributeName, Value: value,
 	})
 }
 
+// reReadValue matches the value line of a chip-tool attribute read, e.g. `Data = true,` or `Data = "Lamp",`
+var reReadValue = regexp.MustCompile(`Data\s*=\s*(true|false|-?[0-9]+(?:\.[0-9]+)?|"[^"]*")`)
+
+// parseReadValue extracts the attribute value from chip-tool read output.
+func parseReadValue(stdout string) (interface{}, bool) {
+	matches := reReadValue.FindStringSubmatch(stdout)
+	fmt.Println("Regex Matched", matches)
+	if len(matches) < 2 {
+		return nil, false
+	}
+	valStr := strings.TrimSpace(matches[1])
+	// Numbers first, and only the true/false literals as booleans: ParseBool would also take the
+	// integers 0 and 1 (enums, AirQuality, MeasurementUnit...)
+	if iVal, err := strconv.ParseInt(valStr, 10, 64); err == nil {
+		return iVal, true
+	} else if fVal, err := strconv.ParseFloat(valStr, 64); err == nil {
+		return fVal, true
+	} else if valStr == "true" || valStr == "false" {
+		return valStr == "true", true
+	}
+	if strings.HasPrefix(valStr, `"`) && strings.HasSuffix(valStr, `"`) {
+		return strings.Trim(valStr, `"`), true
+	}
+	return valStr, true
+}
+
+// readAttributeValue reads an attribute synchronously and returns its parsed value without notifying any client.
+func readAttributeValue(nodeID, endpointID, clusterName, attributeName string) (interface{}, error) {
+	return controller.ReadAttribute(nodeID, endpointID, clusterName, attributeName)
+}
+
 func startAttributeSubscription(client *Client, nodeID, endpointID, clusterName, attributeName, minInterval, maxInterval string) {
+	startAttributeSubscriptionWith(client, nil, nodeID, endpointID, clusterName, attributeName, minInterval, maxInterval)
+}
+
+// startAttributeSubscriptionWith starts a subscription, appending extra chip-tool flags (see chipToolIdentityFlags).
+// The process may run with another max interval than maxInterval, depending on whether a client
+// is looking at the node (see focus.go).
+func startAttributeSubscriptionWith(client *Client, extraFlags []string, nodeID, endpointID, clusterName, attributeName, minInterval, maxInterval string) {
 	subscriptionID := fmt.Sprintf("sub-%s-%s-%s-%s", nodeID, endpointID, clusterName, attributeName)
+	runningMax := subscriptionFocus.MaxInterval(nodeID, minInterval, maxInterval)
 	log.Printf("[%s] Starting subscription for Node %s, Endpoint %s, Cluster %s, Attribute %s, MinInterval %ss, MaxInterval %ss",
-		subscriptionID, nodeID, endpointID, clusterName, attributeName, minInterval, maxInterval)
+		subscriptionID, nodeID, endpointID, clusterName, attributeName, minInterval, runningMax)
 
+	if entry, disabled := subscriptionBudget.Disabled(subscriptionID); disabled {
+		log.Printf("[%s] Not starting a disabled subscription: %s", subscriptionID, entry.Reason)
+		client.sendPayload("subscription_disabled", entry)
+		return
+	}
+	if !allowSubscription(client, subscriptionID) {
+		return
+	}
 	client.notifyClientLog("subscription_log", fmt.Sprintf("Attempting to subscribe to %s/%s on Node %s EP%s", clusterName, attributeName, nodeID, endpointID))
 
 	cmdArgs := []string{
-		strings.ToLower(clusterName), "subscribe", attributeName, minInterval, maxInterval, nodeID, endpointID,
+		strings.ToLower(clusterName), "subscribe", attributeName, minInterval, runningMax, nodeID, endpointID,
 	}
+	cmdArgs = withChipToolStorage(client.chipToolArgs(append(cmdArgs, extraFlags...)))
 	cmd := exec.Command(chipToolPath, cmdArgs...)
 
 	stdoutPipe, err := cmd.StdoutPipe()
@@ -924,17 +1787,43 @@ func startAttributeSubscription(client *Client, nodeID, endpointID, clusterName,
 	if err := cmd.Start(); err != nil {
 		log.Printf("[%s] Error starting chip-tool subscribe command: %v", subscriptionID, err)
 		client.notifyClientLog("subscription_log", fmt.Sprintf("Error starting subscription command for %s: %v", attributeName, err))
+		poller.SubscriptionFailed(subscriptionID, nodeID, endpointID, clusterName, attributeName)
 		return
 	}
 
 	log.Printf("[%s] chip-tool subscribe process started (PID: %d). Monitoring output.", subscriptionID, cmd.Process.Pid)
+	started := time.Now()
+	restart := func() {
+		startAttributeSubscriptionWith(client, extraFlags, nodeID, endpointID, clusterName, attributeName, minInterval, maxInterval)
+	}
+	subscriptions.Track(subscriptionID, trackedSubscription{
+		nodeID: nodeID, endpointID: endpointID, cmd: cmd, owner: quotaOwner(client),
+		minInterval: minInterval, maxInterval: maxInterval, running: runningMax,
+		restart: restart,
+	})
 	client.notifyClientLog("subscription_log", fmt.Sprintf("Subscription process started for %s/%s.", clusterName, attributeName))
 
+	var lastErrorMu sync.Mutex
+	lastError := "" // Last error line of chip-tool, reported if the subscription gets disabled
+	noteError := func(line string) {
+		if strings.Contains(line, "Error") || strings.Contains(line, "failure") {
+			lastErrorMu.Lock()
+			lastError = strings.TrimSpace(stripAnsi(line))
+			lastErrorMu.Unlock()
+		}
+	}
+	stderrDone := make(chan struct{})
 	go func() { // Stderr
+		defer close(stderrDone)
 		scanner := bufio.NewScanner(stderrPipe)
+		forward := client.chipToolLineFilter()
 		for scanner.Scan() {
 			line := scanner.Text()
+			noteError(line)
 			log.Printf("[%s] Stderr: %s", subscriptionID, line)
+			if !forward(line) {
+				continue
+			}
 			client.notifyClientLog("subscription_log", fmt.Sprintf("[%s] Error Stream: %s", attributeName, line))
 		}
 		if err := scanner.Err(); err != nil {
@@ -947,9 +1836,11 @@ func startAttributeSubscription(client *Client, nodeID, endpointID, clusterName,
 		reDataLine := regexp.MustCompile(`CHIP:DMG:\s+Data = (.*) \((.*)\)`)
 		reReportStart := regexp.MustCompile(`CHIP:DMG: ReportDataMessage =`)
 		inReportBlock := false
+		reported := false
 		for scanner.Scan() {
 			line := scanner.Text()
 			log.Printf("[%s] Stdout: %s", subscriptionID, line)
+			noteError(line)
 			if reReportStart.MatchString(line) {
 				inReportBlock = true
 				log.Printf("[%s] Detected report start.", subscriptionID)
@@ -966,7 +1857,7 @@ func startAttributeSubscription(client *Client, nodeID, endpointID, clusterName,
 						value, parseErr = strconv.ParseBool(valStr)
 					case "INT8S", "INT16S", "INT32S", "INT64S", "UINT8", "UINT16", "UINT32", "UINT64", "INT8U", "INT16U", "INT32U", "INT64U":
 						value, parseErr = strconv.ParseInt(valStr, 10, 64)
-					case "FLOAT", "DOUBLE":
+					case "FLOAT", "DOUBLE", "SINGLE":
 						value, parseErr = strconv.ParseFloat(valStr, 64)
 					case "UTF8S", "OCTET_STRING":
 						if strings.HasPrefix(valStr, `"`) && strings.HasSuffix(valStr, `"`) {
@@ -982,7 +1873,12 @@ func startAttributeSubscription(client *Client, nodeID, endpointID, clusterName,
 						log.Printf("[%s] Error parsing value '%s' as type '%s': %v.", subscriptionID, valStr, typeStr, parseErr)
 						value = valStr
 					}
-					client.sendPayload("attribute_update", AttributeUpdatePayload{NodeID: nodeID, EndpointID: endpointID, Cluster: clusterName, Attribute: attributeName, Value: value}) // Assumes AttributeUpdatePayload is in models.go
+					publishAttributeUpdate(client, AttributeUpdatePayload{NodeID: nodeID, EndpointID: endpointID, Cluster: clusterName, Attribute: attributeName, Value: value, Source: sourceSubscription}) // Assumes AttributeUpdatePayload is in models.go
+					poller.SubscriptionReported(subscriptionID, nodeID, endpointID, clusterName, attributeName)
+					if !reported {
+						subscriptionBudget.Reported(subscriptionID)
+						reported = true
+					}
 					inReportBlock = false
 				} else if strings.Contains(line, "CHIP:DMG: }") {
 					inReportBlock = false
@@ -996,7 +1892,26 @@ func startAttributeSubscription(client *Client, nodeID, endpointID, clusterName,
 		}
 		log.Printf("[%s] Stdout pipe closed.", subscriptionID)
 		waitErr := cmd.Wait()
+		stillTracked := subscriptions.Untrack(subscriptionID, cmd)
 		log.Printf("[%s] chip-tool subscribe command finished. Exit error: %v", subscriptionID, waitErr)
 		client.notifyClientLog("subscription_log", fmt.Sprintf("Subscription for %s/%s on Node %s ended. Error: %v", clusterName, attributeName, nodeID, waitErr))
+		if !stillTracked { // Stopped or restarted on purpose
+			return
+		}
+		// Subscriptions are meant to run until stopped or restarted
+		poller.SubscriptionFailed(subscriptionID, nodeID, endpointID, clusterName, attributeName)
+		<-stderrDone
+		lastErrorMu.Lock()
+		reason := lastError
+		lastErrorMu.Unlock()
+		target := SubscriptionBudgetEntry{SubscriptionID: subscriptionID, NodeID: nodeID, EndpointID: endpointID, Cluster: clusterName, Attribute: attributeName}
+		delay, entry, disabled := subscriptionBudget.Failed(target, time.Since(started), reported, reason)
+		if disabled {
+			log.Printf("[%s] Subscription disabled: %s", subscriptionID, entry.Reason)
+			client.sendPayload("subscription_disabled", entry)
+			return
+		}
+		log.Printf("[%s] Restarting the subscription in %v (%d rapid failure(s) in a row)", subscriptionID, delay, entry.Failures)
+		subscriptions.ScheduleRestart(subscriptionID, nodeID, endpointID, delay, restart)
 	}()
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Discovery output layouts of different chip-tool builds.
+const (
+	discoveryOutputShortDiscriminator = `[1700000000.100][4242:4243] CHIP:DIS: Discovered commissionable/commissioner node:
+[1700000000.100][4242:4243] CHIP:DIS: 	Hostname: 0E1F2A3B4C5D0000
+[1700000000.100][4242:4243] CHIP:DIS: 	IP Address #1: 192.168.1.50
+[1700000000.100][4242:4243] CHIP:DIS: 	Port: 5540
+[1700000000.100][4242:4243] CHIP:DIS: 	Vendor ID: 65521
+[1700000000.100][4242:4243] CHIP:DIS: 	Product ID: 32769
+[1700000000.100][4242:4243] CHIP:DIS: 	Short Discriminator: 15
+[1700000000.100][4242:4243] CHIP:DIS: 	Commissioning Mode: 1
+[1700000000.100][4242:4243] CHIP:DIS: 	Instance Name: 1A2B3C4D5E6F7A8B
+`
+	discoveryOutputMultipleIPs = `[1700000000.200][4242:4243] [DIS] Discovered commissionable/commissioner node:
+[1700000000.200][4242:4243] [DIS] 	Hostname: 0E1F2A3B4C5D0001
+[1700000000.200][4242:4243] [DIS] 	IP Address #1: fe80::1%eth0
+[1700000000.200][4242:4243] [DIS] 	IP Address #2: fd00::50
+[1700000000.200][4242:4243] [DIS] 	IP Address #3: 192.168.1.51
+[1700000000.200][4242:4243] [DIS] 	Port: 5540
+[1700000000.200][4242:4243] [DIS] 	Long Discriminator: 3840
+[1700000000.200][4242:4243] [DIS] 	Vendor ID: 65521
+[1700000000.200][4242:4243] [DIS] 	Product ID: 32769
+`
+	discoveryOutputUntagged = `[1700000000.300][4242:4243] Discovered commissionable/commissioner node:
+[1700000000.300][4242:4243] 	Hostname: 0E1F2A3B4C5D0002
+[1700000000.300][4242:4243] 	IP Address: 192.168.1.52
+[1700000000.300][4242:4243] 	Port: 5540
+[1700000000.300][4242:4243] 	Discriminator: 0xF00
+[1700000000.300][4242:4243] 	Vendor ID: 65521
+[1700000000.300][4242:4243] CHIP:DL: Mdns: Discriminator: 99
+[1700000000.300][4242:4243] [DL] Port: 1
+`
+)
+
+func FuzzParseDiscoveryOutput(f *testing.F) {
+	f.Add(discoveryOutputShortDiscriminator)
+	f.Add(discoveryOutputMultipleIPs)
+	f.Add(discoveryOutputUntagged)
+	f.Add(discoveryOutputShortDiscriminator + discoveryOutputMultipleIPs + discoveryOutputUntagged)
+	f.Fuzz(func(t *testing.T, output string) {
+		for _, device := range parseDiscoveryOutput(output, nil) {
+			if device.ID == "" || device.Name == "" {
+				t.Errorf("device without ID or name: %+v", device)
+			}
+			if device.IPAddress != "" && !containsString(device.Addresses, device.IPAddress) {
+				t.Errorf("ipAddress %q not in addresses %v", device.IPAddress, device.Addresses)
+			}
+			seen := map[string]bool{}
+			for _, address := range device.Addresses {
+				if seen[address] {
+					t.Errorf("address %q listed twice", address)
+				}
+				seen[address] = true
+			}
+			if strings.ContainsAny(device.Discriminator+device.ShortDiscriminator, "\r\n") {
+				t.Errorf("discriminator spans lines: %q / %q", device.Discriminator, device.ShortDiscriminator)
+			}
+		}
+	})
+}
+
+func TestParseDiscoveryOutputLayouts(t *testing.T) {
+	devices := parseDiscoveryOutput(discoveryOutputShortDiscriminator+discoveryOutputMultipleIPs+discoveryOutputUntagged, nil)
+	if len(devices) != 3 {
+		t.Fatalf("got %d devices, want 3: %+v", len(devices), devices)
+	}
+	if d := devices[0]; d.ShortDiscriminator != "15" || d.Discriminator != "" || d.Type != "BLE" {
+		t.Errorf("short discriminator layout: %+v", d)
+	}
+	if d := devices[1]; len(d.Addresses) != 3 || d.IPAddress != "fe80::1%eth0" || d.Discriminator != "3840" {
+		t.Errorf("multiple IP layout: %+v", d)
+	}
+	d := devices[2]
+	if d.Discriminator != strconv.Itoa(0xF00) || d.Port != 5540 || d.IPAddress != "192.168.1.52" || d.VendorID != "65521" {
+		t.Errorf("untagged layout: %+v", d)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defaults for device health tracking, used when the configuration doesn't set them.
+const (
+	defaultHealthWindow       = 50   // Commands kept per device
+	defaultHealthMinSamples   = 5    // Commands needed before a device can be flagged
+	defaultHealthP95LatencyMs = 3000 // p95 latency above which a device is degraded
+	defaultHealthMaxErrorRate = 0.2  // Error rate above which a device is degraded
+)
+
+// Device health states.
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+)
+
+type commandSample struct {
+	latency time.Duration
+	success bool
+}
+
+// DeviceHealthReport summarises the recent command round trips of a node.
+type DeviceHealthReport struct {
+	NodeID    string   `json:"nodeId"`
+	Status    string   `json:"status"` // "ok" or "degraded"
+	Samples   int      `json:"samples"`
+	P50Ms     float64  `json:"p50Ms"`
+	P95Ms     float64  `json:"p95Ms"`
+	P99Ms     float64  `json:"p99Ms"`
+	ErrorRate float64  `json:"errorRate"`
+	Reasons   []string `json:"reasons,omitempty"` // Why the device is degraded
+}
+
+// DeviceHealthTracker keeps a sliding window of command results per node and flags nodes whose
+// latency or error rate exceed the configured thresholds.
+type DeviceHealthTracker struct {
+	mu      sync.Mutex
+	samples map[string][]commandSample
+	status  map[string]string
+}
+
+// NewDeviceHealthTracker creates an empty DeviceHealthTracker.
+func NewDeviceHealthTracker() *DeviceHealthTracker {
+	return &DeviceHealthTracker{samples: make(map[string][]commandSample), status: make(map[string]string)}
+}
+
+// healthThresholds returns the configured thresholds, falling back to the defaults.
+func healthThresholds() HealthConfig {
+	cfg := appConfig.Health
+	if cfg.Window <= 0 {
+		cfg.Window = defaultHealthWindow
+	}
+	if cfg.MinSamples <= 0 {
+		cfg.MinSamples = defaultHealthMinSamples
+	}
+	if cfg.P95LatencyMs <= 0 {
+		cfg.P95LatencyMs = defaultHealthP95LatencyMs
+	}
+	if cfg.MaxErrorRate <= 0 {
+		cfg.MaxErrorRate = defaultHealthMaxErrorRate
+	}
+	return cfg
+}
+
+// percentile returns the p-th percentile (0-100) of sorted latencies, in milliseconds.
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted)-1) * p / 100)
+	return float64(sorted[idx].Microseconds()) / 1000
+}
+
+// LatencyDistribution is the distribution of a set of latencies, in milliseconds (experiments and benchmarks).
+type LatencyDistribution struct {
+	Min    float64 `json:"min"`
+	Mean   float64 `json:"mean"`
+	P50    float64 `json:"p50"`
+	P95    float64 `json:"p95"`
+	P99    float64 `json:"p99"`
+	Max    float64 `json:"max"`
+	StdDev float64 `json:"stdDev"`
+}
+
+// latencyDistribution computes the distribution of latencies, nil when there are none.
+func latencyDistribution(latencies []time.Duration) *LatencyDistribution {
+	if len(latencies) == 0 {
+		return nil
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	stats := &LatencyDistribution{
+		Min: durationMs(latencies[0]), Max: durationMs(latencies[len(latencies)-1]),
+		P50: percentile(latencies, 50), P95: percentile(latencies, 95), P99: percentile(latencies, 99),
+	}
+	for _, latency := range latencies {
+		stats.Mean += durationMs(latency)
+	}
+	stats.Mean /= float64(len(latencies))
+	for _, latency := range latencies {
+		stats.StdDev += math.Pow(durationMs(latency)-stats.Mean, 2)
+	}
+	stats.StdDev = math.Sqrt(stats.StdDev / float64(len(latencies)))
+	return stats
+}
+
+// durationMs is a duration in milliseconds, to the microsecond.
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// buildReport computes the health report of a node. Callers must hold t.mu.
+func (t *DeviceHealthTracker) buildReport(nodeID string, cfg HealthConfig) DeviceHealthReport {
+	samples := t.samples[nodeID]
+	report := DeviceHealthReport{NodeID: nodeID, Status: healthOK, Samples: len(samples)}
+	if len(samples) == 0 {
+		return report
+	}
+	latencies := make([]time.Duration, 0, len(samples))
+	failures := 0
+	for _, s := range samples {
+		latencies = append(latencies, s.latency)
+		if !s.success {
+			failures++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	report.P50Ms = percentile(latencies, 50)
+	report.P95Ms = percentile(latencies, 95)
+	report.P99Ms = percentile(latencies, 99)
+	report.ErrorRate = float64(failures) / float64(len(samples))
+
+	if len(samples) >= cfg.MinSamples {
+		if report.P95Ms > float64(cfg.P95LatencyMs) {
+			report.Reasons = append(report.Reasons, "p95 latency above threshold")
+		}
+		if report.ErrorRate > cfg.MaxErrorRate {
+			report.Reasons = append(report.Reasons, "error rate above threshold")
+		}
+		if len(report.Reasons) > 0 {
+			report.Status = healthDegraded
+		}
+	}
+	return report
+}
+
+// Record adds a command result. When the node's status changes, the registry is updated and a
+// device_health event is broadcast to all clients.
+func (t *DeviceHealthTracker) Record(nodeID string, latency time.Duration, success bool) {
+	cfg := healthThresholds()
+	t.mu.Lock()
+	samples := append(t.samples[nodeID], commandSample{latency: latency, success: success})
+	if len(samples) > cfg.Window {
+		samples = samples[len(samples)-cfg.Window:]
+	}
+	t.samples[nodeID] = samples
+	report := t.buildReport(nodeID, cfg)
+	previous, known := t.status[nodeID]
+	t.status[nodeID] = report.Status
+	t.mu.Unlock()
+
+	if (!known && report.Status == healthOK) || previous == report.Status {
+		return
+	}
+	log.Printf("Device health of node %s changed to %s (p95 %.0fms, error rate %.2f)", nodeID, report.Status, report.P95Ms, report.ErrorRate)
+	for _, device := range deviceRegistry.List() {
+		if device.NodeID == nodeID {
+			_ = deviceRegistry.Update(device.ID, func(d *RegisteredDevice) { d.Health = report.Status })
+		}
+	}
+	broadcastToClients("device_health", report)
+}
+
+// Reports returns the health report of every node with recorded commands.
+func (t *DeviceHealthTracker) Reports() []DeviceHealthReport {
+	cfg := healthThresholds()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	reports := make([]DeviceHealthReport, 0, len(t.samples))
+	for nodeID := range t.samples {
+		reports = append(reports, t.buildReport(nodeID, cfg))
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].NodeID < reports[j].NodeID })
+	return reports
+}
+
+// Report returns the health report of a node, if it has recorded commands.
+func (t *DeviceHealthTracker) Report(nodeID string) (DeviceHealthReport, bool) {
+	cfg := healthThresholds()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.samples[nodeID]; !ok {
+		return DeviceHealthReport{}, false
+	}
+	return t.buildReport(nodeID, cfg), true
+}
+
+// Forget drops the command samples and status of a node.
+func (t *DeviceHealthTracker) Forget(nodeID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.samples, nodeID)
+	delete(t.status, nodeID)
+}
+
+var deviceHealth = NewDeviceHealthTracker()
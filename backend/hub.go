@@ -1,8 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 // Hub maintains the set of active clients and broadcasts messages to the clients.
@@ -22,9 +27,23 @@ type Hub struct {
 	// Unregister requests from clients.
 	unregister chan *Client
 
-	// Mutex to protect the clients map
+	// Mutex to protect the clients map and the delivery counters
 	mu sync.Mutex
 
+	// started is when the hub was created, for the uptime in Stats
+	started time.Time
+
+	// delivered counts the messages queued to clients, by event topic
+	delivered map[string]int
+
+	// batchedUpdates counts the attribute updates sent in attribute_update_batch messages (see batching.go)
+	batchedUpdates int
+
+	// consumers tracks how the clients keep up with their send queue, evictions the clients
+	// disconnected for not keeping up (see slowconsumers.go)
+	consumers map[*Client]*consumerHealth
+	evictions EvictionStats
+
 	// broadcastMessage is used if the hub itself needs to send a message to all clients
 	// e.g. for a global notification or a shared log message initiated by the server.
 	// For now, most messages are specific responses or logs per client.
@@ -37,6 +56,9 @@ func NewHub() *Hub {
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		clients:    make(map[*Client]bool),
+		started:    time.Now(),
+		delivered:  make(map[string]int),
+		consumers:  make(map[*Client]*consumerHealth),
 		// broadcastMessage: make(chan []byte), // If general broadcast needed
 	}
 }
@@ -54,7 +76,13 @@ func (h *Hub) Run() {
 			h.mu.Lock()
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
+				delete(h.consumers, client)
 				close(client.send) // Close the client's send channel
+				if client.admitted {
+					admission.Release()
+				}
+				go subscriptionFocus.Release(client) // Restarts subscriptions, not under h.mu
+				go rawChipTool.Release(client)
 				log.Printf("Client unregistered. Total clients: %d", len(h.clients))
 			}
 			h.mu.Unlock()
@@ -74,6 +102,192 @@ func (h *Hub) Run() {
 	}
 }
 
+// deliver sends a bus event to the WebSocket clients it is addressed to: every client for broadcasts,
+// the requesting client for replies. Events without a client are internal and not sent.
+func (h *Hub) deliver(event Event) {
+	if !event.Broadcast && event.Client == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock() // Held while sending so Run can't close a send channel in between
+	for client := range h.clients {
+		if !event.Broadcast && client != event.Client {
+			continue
+		}
+		payload := localizePayload(event.Payload, client.unitPreferences())
+		if client.batchable(event) {
+			h.addToBatch(client, event, payload) // Sent with the client's next flush (see batching.go)
+			continue
+		}
+		if h.queueMessage(client, event.Type, event.RequestID, payload) {
+			h.delivered[event.Topic]++
+		}
+	}
+}
+
+// queueMessage marshals a message in the client's shape and queues its frames, reporting whether
+// it was queued. The caller holds h.mu.
+func (h *Hub) queueMessage(client *Client, msgType, requestID string, payload interface{}) bool {
+	bytes, err := json.Marshal(buildServerMessage(msgType, requestID, payload, client.legacy))
+	if err != nil {
+		log.Printf("Error marshalling %s message for client %v: %v", msgType, client.logName(), err)
+		return false
+	}
+	frames, err := frameMessage(bytes, msgType, requestID, client.legacy, maxOutboundMessageSize())
+	if err != nil {
+		log.Printf("Error segmenting %s message for client %v: %v", msgType, client.logName(), err)
+		return false
+	}
+	// Chunks are queued all or nothing: a partial sequence could never be reassembled
+	if len(frames) > cap(client.send)-len(client.send) {
+		log.Printf("Client %v send channel full, message dropped: %s", client.logName(), msgType)
+		h.recordDrop(client)
+		return false
+	}
+	for _, frame := range frames {
+		client.send <- frame
+	}
+	return true
+}
+
+// ClientStats describes one connected WebSocket client.
+type ClientStats struct {
+	ID            string          `json:"id"`
+	Addr          string          `json:"addr"`
+	Identity      *ClientIdentity `json:"identity,omitempty"` // Set once the client sent "identify"
+	ConnectedAt   time.Time       `json:"connectedAt"`
+	Admin         bool            `json:"admin,omitempty"`
+	Legacy        bool            `json:"legacy,omitempty"`
+	Authenticated bool            `json:"authenticated"`
+	Queued        int             `json:"queued"`             // Messages waiting in the send queue
+	QueueCapacity int             `json:"queueCapacity"`      // Size of the send queue; messages are dropped when it is full
+	BatchMs       int64           `json:"batchMs,omitempty"`  // Attribute update batching interval, zero when off
+	Dropped       int             `json:"dropped,omitempty"`  // Messages dropped because the queue was full
+	SlowSince     time.Time       `json:"slowSince,omitzero"` // Since when the queue is above the slow-consumer threshold
+}
+
+// HubStats is a consistent snapshot of the hub, taken under its lock.
+type HubStats struct {
+	Clients        int            `json:"clients"`
+	MaxClients     int            `json:"maxClients,omitempty"`    // Zero when unlimited
+	QueuedClients  int            `json:"queuedClients,omitempty"` // Read-only clients waiting for a slot
+	Connections    []ClientStats  `json:"connections"`
+	Delivered      map[string]int `json:"delivered"`                // Messages queued to clients since startup, by event topic
+	BatchedUpdates int            `json:"batchedUpdates,omitempty"` // Attribute updates sent in attribute_update_batch messages
+	StartedAt      time.Time      `json:"startedAt"`
+	UptimeSeconds  int64          `json:"uptimeSeconds"`
+	Evictions      EvictionStats  `json:"evictions"` // Clients disconnected for not keeping up (see slowconsumers.go)
+}
+
+// HubSummary is the part of the hub stats every client may see: counts only, without the
+// addresses and identities of the connections and evictions, which stay on the admin API.
+type HubSummary struct {
+	Clients        int            `json:"clients"`
+	MaxClients     int            `json:"maxClients,omitempty"`
+	QueuedClients  int            `json:"queuedClients,omitempty"`
+	Delivered      map[string]int `json:"delivered"`
+	BatchedUpdates int            `json:"batchedUpdates,omitempty"`
+	StartedAt      time.Time      `json:"startedAt"`
+	UptimeSeconds  int64          `json:"uptimeSeconds"`
+	Evictions      EvictionStats  `json:"evictions"` // Without the recent evictions
+}
+
+// Summary drops the per-client detail of the stats.
+func (s HubStats) Summary() HubSummary {
+	evictions := s.Evictions
+	evictions.Recent = nil
+	return HubSummary{
+		Clients:        s.Clients,
+		MaxClients:     s.MaxClients,
+		QueuedClients:  s.QueuedClients,
+		Delivered:      s.Delivered,
+		BatchedUpdates: s.BatchedUpdates,
+		StartedAt:      s.StartedAt,
+		UptimeSeconds:  s.UptimeSeconds,
+		Evictions:      evictions,
+	}
+}
+
+// Stats returns the client count, the send queue depth of each client, the messages delivered
+// per topic and the uptime.
+func (h *Hub) Stats() HubStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := HubStats{
+		Clients:        len(h.clients),
+		Connections:    make([]ClientStats, 0, len(h.clients)),
+		Delivered:      make(map[string]int, len(h.delivered)),
+		StartedAt:      h.started,
+		UptimeSeconds:  int64(time.Since(h.started).Seconds()),
+		BatchedUpdates: h.batchedUpdates,
+	}
+	_, stats.QueuedClients = admission.Stats()
+	stats.MaxClients = appConfig.MaxClients
+	for client := range h.clients {
+		var health consumerHealth
+		if tracked, ok := h.consumers[client]; ok {
+			health = *tracked
+		}
+		stats.Connections = append(stats.Connections, ClientStats{
+			ID:            client.id,
+			Addr:          client.remoteAddr(),
+			Identity:      client.identity.Load(),
+			ConnectedAt:   client.connectedAt,
+			Admin:         client.admin,
+			Legacy:        client.legacy,
+			Authenticated: client.authenticated.Load(),
+			Queued:        len(client.send),
+			QueueCapacity: cap(client.send),
+			BatchMs:       client.batchInterval.Milliseconds(),
+			Dropped:       health.dropped,
+			SlowSince:     health.slowSince,
+		})
+	}
+	sort.Slice(stats.Connections, func(i, j int) bool { return stats.Connections[i].ConnectedAt.Before(stats.Connections[j].ConnectedAt) })
+	for topic, n := range h.delivered {
+		stats.Delivered[topic] = n
+	}
+	stats.Evictions = h.evictions
+	stats.Evictions.ByReason = make(map[string]int, len(h.evictions.ByReason))
+	for reason, n := range h.evictions.ByReason {
+		stats.Evictions.ByReason[reason] = n
+	}
+	stats.Evictions.Recent = append([]Eviction(nil), h.evictions.Recent...)
+	return stats
+}
+
+// Disconnect closes the connection of the client with the given ID. Its pumps notice and
+// unregister it as for any other disconnection.
+func (h *Hub) Disconnect(id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		if client.id == id {
+			log.Printf("Disconnecting client %s on request", client.logName())
+			client.closeWith(websocket.ClosePolicyViolation, "disconnected by an administrator")
+			return true
+		}
+	}
+	return false
+}
+
+// defaultHeartbeatInterval is how often the hub broadcasts a "heartbeat" with its stats.
+const defaultHeartbeatInterval = 30 * time.Second
+
+// RunHeartbeat broadcasts the hub summary to every client periodically, so dashboards can show the
+// backend is alive and how loaded it is.
+func (h *Hub) RunHeartbeat() {
+	interval := defaultHeartbeatInterval
+	if appConfig.HeartbeatIntervalSeconds > 0 {
+		interval = time.Duration(appConfig.HeartbeatIntervalSeconds) * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		broadcastToClients("heartbeat", h.Stats().Summary())
+	}
+}
+
 // sendToAllClients sends a message to all connected clients.
 // Useful for global notifications or logs not tied to a specific client's request.
 // Currently not used extensively as most communication is request/response per client.
@@ -86,7 +300,7 @@ func (h *Hub) sendToAllClients(message []byte) {
 		case client.send <- message:
 		default:
 			// If the client's send buffer is full, assume it's slow or disconnected.
-			log.Printf("Client %v send channel full, closing client.", client.conn.RemoteAddr())
+			log.Printf("Client %v send channel full, closing client.", client.logName())
 			close(client.send)
 			delete(h.clients, client)
 		}
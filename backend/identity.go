@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxIdentityFieldLength bounds each field of a client identity, which ends up in every log line.
+const maxIdentityFieldLength = 64
+
+// ClientIdentity is how a client describes itself with the "identify" message.
+type ClientIdentity struct {
+	App     string `json:"app" validate:"required"` // e.g. "matter-dashboard"
+	Version string `json:"version,omitempty"`
+	User    string `json:"user,omitempty"`
+	Device  string `json:"device,omitempty"` // e.g. "kitchen-tablet"
+}
+
+// Validate implements Validator.
+func (p ClientIdentity) Validate() error {
+	verr := &ValidationError{}
+	for field, value := range map[string]string{"app": p.App, "version": p.Version, "user": p.User, "device": p.Device} {
+		if len(value) > maxIdentityFieldLength {
+			verr.add(field, fmt.Sprintf("must be at most %d characters", maxIdentityFieldLength))
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// String formats the identity for logs, e.g. "matter-dashboard 1.2 (alice@kitchen-tablet)".
+func (p ClientIdentity) String() string {
+	s := p.App
+	if p.Version != "" {
+		s += " " + p.Version
+	}
+	switch {
+	case p.User != "" && p.Device != "":
+		s += " (" + p.User + "@" + p.Device + ")"
+	case p.User != "" || p.Device != "":
+		s += " (" + p.User + p.Device + ")"
+	}
+	return s
+}
+
+var lastClientID atomic.Int64
+
+// newClientID returns the ID of a new connection, listed by the admin API and used to disconnect it.
+func newClientID() string {
+	return "c" + strconv.FormatInt(lastClientID.Add(1), 10)
+}
+
+// logName names the client in logs: its ID, address and, once it identified, its identity.
+func (c *Client) logName() string {
+	base := c.base()
+	name := base.id + " " + base.addr
+	if identity := base.identity.Load(); identity != nil {
+		name += " [" + identity.String() + "]"
+	}
+	return name
+}
+
+// handleIdentify records the identity a client sends as its first message, accepted before
+// "authenticate". It can't be changed later.
+func handleIdentify(client *Client, payload ClientIdentity) {
+	base := client.base()
+	if !base.identity.CompareAndSwap(nil, &payload) {
+		client.notifyClient("error", map[string]interface{}{"message": "identify failed: the client already identified as " + base.identity.Load().String()})
+		return
+	}
+	log.Printf("Client %s identified", client.logName())
+	client.audit("identify", payload)
+	client.sendPayload("identified", map[string]interface{}{"clientId": base.id})
+}
+
+// DisconnectClientPayload is the payload of the admin "disconnect_client" message.
+type DisconnectClientPayload struct {
+	ClientID string `json:"clientId" validate:"required"`
+}
+
+// handleDisconnectClient force-disconnects another client (admin API only).
+func handleDisconnectClient(client *Client, payload DisconnectClientPayload) {
+	if !client.hub.Disconnect(payload.ClientID) {
+		client.notifyClient("error", map[string]interface{}{"message": "disconnect_client failed: no client " + payload.ClientID})
+		return
+	}
+	client.audit("disconnect_client", payload)
+	client.sendPayload("client_disconnected", payload)
+}
+
+// auditFile is where audit records are appended as JSON lines, in the data directory.
+const auditFile = "audit.log"
+
+// maxAuditRecords is how many audit records are kept in memory for /api/admin/audit.
+const maxAuditRecords = 500
+
+// AuditRecord is one security-relevant action: an admin operation, an identification or a
+// forced disconnection, with who asked for it.
+type AuditRecord struct {
+	Time     time.Time       `json:"time"`
+	Action   string          `json:"action"`
+	ClientID string          `json:"clientId,omitempty"` // Empty for REST calls
+	Addr     string          `json:"addr,omitempty"`
+	Identity *ClientIdentity `json:"identity,omitempty"`
+	Details  interface{}     `json:"details,omitempty"`
+}
+
+// AuditLog keeps the latest audit records in memory and appends every record to auditFile, in
+// batches (see writebatch.go).
+type AuditLog struct {
+	mu      sync.Mutex
+	records []AuditRecord
+	file    *BatchWriter
+}
+
+// NewAuditLog creates an empty AuditLog.
+func NewAuditLog() *AuditLog {
+	return &AuditLog{file: NewBatchWriter(auditFile, 0o600)}
+}
+
+// Record stores a record. Failing to write the file is logged by the batch writer, never fatal.
+func (a *AuditLog) Record(record AuditRecord) {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.records = append(a.records, record)
+	if len(a.records) > maxAuditRecords {
+		a.records = a.records[len(a.records)-maxAuditRecords:]
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Audit: could not encode %s record: %v", record.Action, err)
+		return
+	}
+	a.file.Append(line)
+}
+
+// List returns the records kept in memory, oldest first.
+func (a *AuditLog) List() []AuditRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]AuditRecord(nil), a.records...)
+}
+
+// audit records an action requested by the client. A nil client (backend-originated work) is fine.
+func (c *Client) audit(action string, details interface{}) {
+	record := AuditRecord{Action: action, Details: details}
+	if c != nil {
+		base := c.base()
+		record.ClientID, record.Addr, record.Identity = base.id, base.addr, base.identity.Load()
+	}
+	auditLog.Record(record)
+}
+
+var auditLog = NewAuditLog()
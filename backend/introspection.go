@@ -0,0 +1,219 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// introspectionAttributes are the attributes describing a device's structure rather than its
+// state: they only change with its firmware, so their reads are cached.
+var introspectionAttributes = map[string]bool{
+	"device-type-list":       true,
+	"server-list":            true,
+	"client-list":            true,
+	"parts-list":             true,
+	"tag-list":               true,
+	"feature-map":            true,
+	"attribute-list":         true,
+	"accepted-command-list":  true,
+	"generated-command-list": true,
+}
+
+// introspectionEntry is a cached read: the chip-tool output of a descriptor read, or a parsed value.
+type introspectionEntry struct {
+	stdout string
+	value  interface{}
+}
+
+// introspectionNode holds the cached reads of a node, valid for one software version.
+type introspectionNode struct {
+	softwareVersion string
+	entries         map[string]introspectionEntry // By "endpoint/cluster/attribute", "/raw" added for chip-tool output
+	cachedAt        time.Time
+}
+
+// IntrospectionNodeStats describes the cached reads of a node.
+type IntrospectionNodeStats struct {
+	NodeID          string    `json:"nodeId"`
+	SoftwareVersion string    `json:"softwareVersion,omitempty"` // Version the reads were made with, empty when unknown
+	Entries         int       `json:"entries"`
+	CachedAt        time.Time `json:"cachedAt"`
+}
+
+// IntrospectionCacheStats is returned by GET /api/introspection-cache and sent as "introspection_cache".
+type IntrospectionCacheStats struct {
+	Nodes  []IntrospectionNodeStats `json:"nodes"`
+	Hits   int                      `json:"hits"`
+	Misses int                      `json:"misses"`
+}
+
+// ClearIntrospectionCachePayload is the payload of "clear_introspection_cache". An empty nodeId
+// clears every node.
+type ClearIntrospectionCachePayload struct {
+	NodeID string `json:"nodeId,omitempty"`
+}
+
+// IntrospectionCache keeps the reads of structural attributes (Descriptor lists, feature maps,
+// attribute lists) per node and software version, so opening a device's structure again doesn't
+// walk all its endpoints with chip-tool. A node's reads are dropped when its software version
+// changes (an OTA update, seen by refresh_device_version or a BasicInformation report), when it is
+// commissioned again or removed, and on "clear_introspection_cache". Only successful reads are
+// cached, and a bridge's parts lists never are, as bridged devices come and go. The cache is in
+// memory only.
+type IntrospectionCache struct {
+	mu           sync.Mutex
+	nodes        map[string]*introspectionNode
+	hits, misses int
+}
+
+// NewIntrospectionCache creates an empty IntrospectionCache.
+func NewIntrospectionCache() *IntrospectionCache {
+	return &IntrospectionCache{nodes: make(map[string]*introspectionNode)}
+}
+
+// nodeSoftwareVersion returns the software version the registry knows for a node, or "".
+func nodeSoftwareVersion(nodeID string) string {
+	device, ok := deviceRegistry.Get(nodeID)
+	if !ok || device.Version == nil || device.Version.SoftwareVersion == nil {
+		return ""
+	}
+	return strconv.FormatUint(*device.Version.SoftwareVersion, 10)
+}
+
+// cacheable reports whether a read may be cached.
+func cacheable(nodeID, attribute string) bool {
+	if !introspectionAttributes[attribute] {
+		return false
+	}
+	if attribute == "parts-list" {
+		device, ok := deviceRegistry.Get(nodeID)
+		return !ok || !device.IsBridge
+	}
+	return true
+}
+
+// node returns the cache of a node for its current software version, dropping reads made with
+// another one. The caller holds the lock.
+func (c *IntrospectionCache) node(nodeID string) *introspectionNode {
+	version := nodeSoftwareVersion(nodeID)
+	node, ok := c.nodes[nodeID]
+	if ok && node.softwareVersion != version {
+		log.Printf("Software version of node %s changed from %q to %q, dropping %d cached introspection reads", nodeID, node.softwareVersion, version, len(node.entries))
+		ok = false
+	}
+	if !ok {
+		node = &introspectionNode{softwareVersion: version, entries: make(map[string]introspectionEntry), cachedAt: time.Now()}
+		c.nodes[nodeID] = node
+	}
+	return node
+}
+
+func (c *IntrospectionCache) get(nodeID, key string) (introspectionEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.node(nodeID).entries[key]
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return entry, ok
+}
+
+func (c *IntrospectionCache) put(nodeID, key string, entry introspectionEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.node(nodeID).entries[key] = entry
+}
+
+// DescriptorRead runs "descriptor read <attribute>" on an endpoint, or returns the output of the
+// last successful run.
+func (c *IntrospectionCache) DescriptorRead(attribute, nodeID, endpointID string) (string, string, error) {
+	return c.ChipToolRead("descriptor", attribute, nodeID, endpointID)
+}
+
+// ChipToolRead runs "<cluster> read <attribute>" on an endpoint, or returns the output of the
+// last successful run.
+func (c *IntrospectionCache) ChipToolRead(cluster, attribute, nodeID, endpointID string) (string, string, error) {
+	cluster = strings.ToLower(cluster)
+	if !cacheable(nodeID, attribute) {
+		return runChipTool(cluster, "read", attribute, nodeID, endpointID)
+	}
+	key := endpointID + "/" + cluster + "/" + attribute + "/raw"
+	if entry, ok := c.get(nodeID, key); ok {
+		return entry.stdout, "", nil
+	}
+	stdout, stderr, err := runChipTool(cluster, "read", attribute, nodeID, endpointID)
+	if !chipToolFailed(stdout, stderr, err) {
+		c.put(nodeID, key, introspectionEntry{stdout: stdout})
+	}
+	return stdout, stderr, err
+}
+
+// ReadAttribute reads an attribute like readAttributeValue, from the cache for structural ones.
+func (c *IntrospectionCache) ReadAttribute(nodeID, endpointID, clusterName, attributeName string) (interface{}, error) {
+	if !cacheable(nodeID, attributeName) {
+		return readAttributeValue(nodeID, endpointID, clusterName, attributeName)
+	}
+	key := endpointID + "/" + strings.ToLower(clusterName) + "/" + attributeName
+	if entry, ok := c.get(nodeID, key); ok {
+		return entry.value, nil
+	}
+	value, err := readAttributeValue(nodeID, endpointID, clusterName, attributeName)
+	if err == nil {
+		c.put(nodeID, key, introspectionEntry{value: value})
+	}
+	return value, err
+}
+
+// Invalidate drops the cached reads of a node.
+func (c *IntrospectionCache) Invalidate(nodeID, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if node, ok := c.nodes[nodeID]; ok {
+		log.Printf("Dropping %d cached introspection reads of node %s: %s", len(node.entries), nodeID, reason)
+		delete(c.nodes, nodeID)
+	}
+}
+
+// Clear drops every cached read.
+func (c *IntrospectionCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodes = make(map[string]*introspectionNode)
+}
+
+// Stats describes the cached reads of each node, sorted by node ID.
+func (c *IntrospectionCache) Stats() IntrospectionCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := IntrospectionCacheStats{Nodes: make([]IntrospectionNodeStats, 0, len(c.nodes)), Hits: c.hits, Misses: c.misses}
+	for nodeID, node := range c.nodes {
+		if len(node.entries) == 0 {
+			continue
+		}
+		stats.Nodes = append(stats.Nodes, IntrospectionNodeStats{NodeID: nodeID, SoftwareVersion: node.softwareVersion, Entries: len(node.entries), CachedAt: node.cachedAt})
+	}
+	sort.Slice(stats.Nodes, func(i, j int) bool { return stats.Nodes[i].NodeID < stats.Nodes[j].NodeID })
+	return stats
+}
+
+func handleGetIntrospectionCache(client *Client) {
+	client.sendPayload("introspection_cache", introspectionCache.Stats())
+}
+
+func handleClearIntrospectionCache(client *Client, payload ClearIntrospectionCachePayload) {
+	if payload.NodeID != "" {
+		introspectionCache.Invalidate(payload.NodeID, "cleared by "+client.logName())
+	} else {
+		introspectionCache.Clear()
+		log.Printf("Introspection cache cleared by %s", client.logName())
+	}
+	client.sendPayload("introspection_cache", introspectionCache.Stats())
+}
+
+var introspectionCache = NewIntrospectionCache()
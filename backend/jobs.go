@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job states.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+const (
+	defaultMaxConcurrentJobs = 2   // chip-tool shares its storage between runs, keep parallelism low
+	maxFinishedJobs          = 100 // Finished jobs kept for /api/jobs
+)
+
+// errJobNotFound is returned for unknown or already forgotten job IDs.
+var errJobNotFound = errors.New("job not found")
+
+// JobStatus is the state of a job, as listed by /api/jobs and streamed in "job_update" messages.
+type JobStatus struct {
+	ID         string      `json:"id"`
+	Kind       string      `json:"kind"` // e.g. "discovery", "commissioning"
+	State      string      `json:"state"`
+	Progress   int         `json:"progress"` // Percentage
+	Message    string      `json:"message,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	RequestID  string      `json:"requestId,omitempty"` // Request that started the job
+	CreatedAt  time.Time   `json:"createdAt"`
+	StartedAt  time.Time   `json:"startedAt,omitzero"`
+	FinishedAt time.Time   `json:"finishedAt,omitzero"`
+}
+
+// JobFunc is the work of a job. It must stop when ctx is cancelled; its result is kept in the job status.
+type JobFunc func(ctx context.Context, job *Job) (interface{}, error)
+
+// Job is a long-running operation (discovery, commissioning...) run in the background by the JobManager.
+type Job struct {
+	mu     sync.Mutex
+	status JobStatus
+	cancel context.CancelFunc
+	owner  string // quotaOwner of the client that submitted it (see quotas.go)
+	span   *Span  // Child of the submitting request's span, nil when it isn't traced (see telemetry.go)
+}
+
+// Status returns a copy of the job status.
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// SetProgress updates the progress percentage and message of a running job and publishes it.
+func (j *Job) SetProgress(percent int, message string) {
+	j.update(func(s *JobStatus) {
+		s.Progress, s.Message = min(max(percent, 0), 100), message
+	})
+}
+
+func (j *Job) update(change func(*JobStatus)) {
+	j.mu.Lock()
+	change(&j.status)
+	status := j.status
+	j.mu.Unlock()
+	eventBus.Publish(Event{Type: "job_update", Payload: status, Broadcast: true})
+}
+
+// finished reports whether the job reached a final state.
+func (s JobStatus) finished() bool {
+	return s.State == jobDone || s.State == jobFailed || s.State == jobCancelled
+}
+
+// JobManager runs jobs with bounded concurrency (maxConcurrentJobs in the config) and keeps their status.
+type JobManager struct {
+	mu        sync.Mutex
+	jobs      map[string]*Job
+	seq       int
+	slots     chan struct{}
+	slotsOnce sync.Once // The limit is read from the config on first use, once it is loaded
+}
+
+// NewJobManager creates an empty JobManager.
+func NewJobManager() *JobManager {
+	return &JobManager{jobs: make(map[string]*Job)}
+}
+
+// Submit queues a job and returns it. Progress logs and results still go to client; every connected
+// client gets the "job_update" messages.
+func (m *JobManager) Submit(client *Client, kind string, run JobFunc) *Job {
+	m.slotsOnce.Do(func() {
+		limit := appConfig.MaxConcurrentJobs
+		if limit <= 0 {
+			limit = defaultMaxConcurrentJobs
+		}
+		m.slots = make(chan struct{}, limit)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mu.Lock()
+	m.seq++
+	job := &Job{cancel: cancel, status: JobStatus{
+		ID:        fmt.Sprintf("%s-%d", kind, m.seq),
+		Kind:      kind,
+		State:     jobQueued,
+		CreatedAt: time.Now(),
+	}}
+	if client != nil {
+		job.status.RequestID = client.requestID
+		job.owner = quotaOwner(client)
+		job.span = client.traceSpan().Child("job " + kind)
+		job.span.SetAttribute("matter.job_id", job.status.ID)
+	}
+	m.jobs[job.status.ID] = job
+	m.pruneLocked()
+	m.mu.Unlock()
+
+	log.Printf("Job %s queued", job.status.ID)
+	job.update(func(*JobStatus) {})
+	go m.run(ctx, job, run)
+	return job
+}
+
+// ActiveFor returns the number of queued or running jobs submitted by a quota owner.
+func (m *JobManager) ActiveFor(owner string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, job := range m.jobs {
+		if job.owner == owner && !job.Status().finished() {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *JobManager) run(ctx context.Context, job *Job, run JobFunc) {
+	defer job.cancel()
+	if maintenance.Active() {
+		job.update(func(s *JobStatus) { s.Message = "Waiting for the maintenance to end" })
+	}
+	if maintenance.Wait(ctx) != nil {
+		job.update(func(s *JobStatus) { s.State, s.FinishedAt = jobCancelled, time.Now() })
+		job.span.SetError("cancelled while queued")
+		job.span.End()
+		return
+	}
+	select {
+	case m.slots <- struct{}{}:
+		defer func() { <-m.slots }()
+	case <-ctx.Done():
+		job.update(func(s *JobStatus) { s.State, s.FinishedAt = jobCancelled, time.Now() })
+		job.span.SetError("cancelled while queued")
+		job.span.End()
+		return
+	}
+	job.span.ChildAt("job queue", job.Status().CreatedAt).End()
+
+	job.update(func(s *JobStatus) { s.State, s.StartedAt = jobRunning, time.Now() })
+	result, err := run(ctx, job)
+	job.update(func(s *JobStatus) {
+		s.FinishedAt, s.Result = time.Now(), result
+		switch {
+		case ctx.Err() != nil:
+			s.State = jobCancelled
+		case err != nil:
+			s.State, s.Error = jobFailed, err.Error()
+		default:
+			s.State, s.Progress = jobDone, 100
+		}
+	})
+	log.Printf("Job %s finished: %s", job.status.ID, job.Status().State)
+	if status := job.Status(); status.State != jobDone {
+		job.span.SetError(string(status.State) + " " + status.Error)
+	}
+	job.span.End()
+}
+
+// Cancel stops a queued or running job.
+func (m *JobManager) Cancel(id string) error {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	m.mu.Unlock()
+	if !ok {
+		return errJobNotFound
+	}
+	if job.Status().finished() {
+		return fmt.Errorf("job %s already finished", id)
+	}
+	job.cancel()
+	return nil
+}
+
+// Get returns the status of a job.
+func (m *JobManager) Get(id string) (JobStatus, bool) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	m.mu.Unlock()
+	if !ok {
+		return JobStatus{}, false
+	}
+	return job.Status(), true
+}
+
+// List returns the status of every known job, oldest first.
+func (m *JobManager) List() []JobStatus {
+	m.mu.Lock()
+	statuses := make([]JobStatus, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		statuses = append(statuses, job.Status())
+	}
+	m.mu.Unlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].CreatedAt.Before(statuses[j].CreatedAt) })
+	return statuses
+}
+
+// pruneLocked forgets the oldest finished jobs beyond maxFinishedJobs.
+func (m *JobManager) pruneLocked() {
+	var finished []JobStatus
+	for _, job := range m.jobs {
+		if status := job.Status(); status.finished() {
+			finished = append(finished, status)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].FinishedAt.Before(finished[j].FinishedAt) })
+	for _, status := range finished[:len(finished)-maxFinishedJobs] {
+		delete(m.jobs, status.ID)
+	}
+}
+
+var jobs = NewJobManager()
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// journalDir holds the outbound event journals, relative to the data directory.
+const journalDir = "journal"
+
+// Journal defaults, used when the config doesn't set them.
+const (
+	defaultJournalMaxEntries = 10000
+	journalCompactAfter      = 256 // Delivered entries before the file is rewritten without them
+	journalRetryMin          = time.Second
+	journalRetryMax          = time.Minute
+)
+
+// journalRecord is a line of a journal file: an event to deliver, or an ack of every event up to Ack.
+type journalRecord struct {
+	Seq  uint64          `json:"seq,omitempty"`
+	Type string          `json:"type,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+	Time time.Time       `json:"time,omitzero"`
+	Ack  uint64          `json:"ack,omitempty"`
+}
+
+// JournalStatus describes a journal in GET /api/journals.
+type JournalStatus struct {
+	Name          string    `json:"name"`
+	Pending       int       `json:"pending"`
+	Dropped       int       `json:"dropped"` // Oldest entries dropped because the journal was full, since startup
+	Oldest        time.Time `json:"oldest,omitzero"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastDelivered time.Time `json:"lastDelivered,omitzero"`
+}
+
+// EventJournal is the write-ahead journal of an integration sink (a webhook, the MQTT broker).
+// Events are appended to a file in the journal directory before being delivered, in order, by Run,
+// which retries until the sink accepts them. Delivered events are acked in the same file, so the
+// ones pending at shutdown are delivered again on restart: delivery is at least once.
+type EventJournal struct {
+	mu            sync.Mutex
+	name          string
+	path          string
+	deliver       func(Event) error
+	file          *os.File
+	pending       []journalRecord
+	seq           uint64
+	acked         int // Ack records written since the file was last rewritten
+	dropped       int
+	lastError     string
+	lastDelivered time.Time
+	wake          chan struct{}
+	stop          chan struct{} // Closed by Stop
+}
+
+// journalName names the journal of a sink, e.g. "webhook-1a2b3c4d" for a webhook URL.
+func journalName(kind, target string) string {
+	h := fnv.New32a()
+	h.Write([]byte(target))
+	return fmt.Sprintf("%s-%08x", kind, h.Sum32())
+}
+
+// NewEventJournal creates the journal of a sink, delivering its events with deliver.
+func NewEventJournal(name string, deliver func(Event) error) *EventJournal {
+	return &EventJournal{name: name, path: filepath.Join(journalDir, name+".jsonl"), deliver: deliver, wake: make(chan struct{}, 1), stop: make(chan struct{})}
+}
+
+// Open loads the events left pending by the previous run and opens the file for appending.
+func (j *EventJournal) Open() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	path := dataFilePath(j.path)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if f, err := os.Open(path); err == nil {
+		var acked uint64
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var record journalRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				log.Printf("Journal %s: skipping a damaged line: %v", j.name, err) // e.g. cut by a crash
+				continue
+			}
+			if record.Ack > 0 {
+				acked = max(acked, record.Ack)
+				continue
+			}
+			j.pending = append(j.pending, record)
+			j.seq = max(j.seq, record.Seq)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		kept := j.pending[:0]
+		for _, record := range j.pending {
+			if record.Seq > acked {
+				kept = append(kept, record)
+			}
+		}
+		j.pending = kept
+		if len(j.pending) > 0 {
+			log.Printf("Journal %s: replaying %d event(s) not delivered before the restart", j.name, len(j.pending))
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return j.rewrite()
+}
+
+// rewrite replaces the file with the pending events only. Callers must hold j.mu.
+func (j *EventJournal) rewrite() error {
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	path := dataFilePath(j.path)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, record := range j.pending {
+		line, _ := json.Marshal(record)
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	j.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	j.acked = 0
+	return err
+}
+
+// writeRecord appends a record to the file, syncing it when it is an event. Callers must hold j.mu.
+func (j *EventJournal) writeRecord(record journalRecord) error {
+	if j.file == nil {
+		return nil // In memory only (see startJournal)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if record.Ack > 0 {
+		return nil // A lost ack only means a redelivery
+	}
+	return j.file.Sync()
+}
+
+// Append journals an event for delivery. When the journal is full the oldest event is dropped.
+func (j *EventJournal) Append(event Event) {
+	data, err := json.Marshal(event.Payload)
+	if err != nil {
+		log.Printf("Journal %s: %s not journaled: %v", j.name, event.Type, err)
+		return
+	}
+	limit := appConfig.Journal.MaxEntries
+	if limit <= 0 {
+		limit = defaultJournalMaxEntries
+	}
+	j.mu.Lock()
+	if len(j.pending) >= limit {
+		dropped := j.pending[0]
+		j.pending = j.pending[1:]
+		j.dropped++
+		if err := j.writeRecord(journalRecord{Ack: dropped.Seq}); err != nil {
+			log.Printf("Journal %s: %v", j.name, err)
+		}
+		if j.dropped == 1 || j.dropped%1000 == 0 {
+			log.Printf("Journal %s is full (%d events): dropped %d event(s) so far", j.name, limit, j.dropped)
+		}
+	}
+	j.seq++
+	record := journalRecord{Seq: j.seq, Type: event.Type, Data: data, Time: event.Time}
+	if err := j.writeRecord(record); err != nil {
+		log.Printf("Journal %s: %s kept in memory only: %v", j.name, event.Type, err)
+	}
+	j.pending = append(j.pending, record)
+	j.mu.Unlock()
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers the journaled events in order, retrying with a growing delay while the sink fails.
+func (j *EventJournal) Run() {
+	retry := journalRetryMin
+	for {
+		j.mu.Lock()
+		if len(j.pending) == 0 {
+			j.mu.Unlock()
+			select {
+			case <-j.wake:
+			case <-j.stop:
+				return
+			}
+			continue
+		}
+		record := j.pending[0]
+		j.mu.Unlock()
+
+		err := j.deliver(Event{Type: record.Type, Payload: record.Data, Time: record.Time})
+		j.mu.Lock()
+		if err != nil {
+			j.lastError = err.Error()
+			pending := len(j.pending)
+			j.mu.Unlock()
+			log.Printf("Journal %s: %s not delivered (%d pending), retrying in %v: %v", j.name, record.Type, pending, retry, err)
+			select {
+			case <-time.After(retry):
+			case <-j.stop:
+				return
+			}
+			retry = min(retry*2, journalRetryMax)
+			continue
+		}
+		retry = journalRetryMin
+		j.lastError, j.lastDelivered = "", time.Now()
+		if len(j.pending) > 0 && j.pending[0].Seq == record.Seq { // Unless it was dropped meanwhile
+			j.pending = j.pending[1:]
+		}
+		if err := j.ack(record.Seq); err != nil {
+			log.Printf("Journal %s: %v", j.name, err)
+		}
+		j.mu.Unlock()
+	}
+}
+
+// ack records a delivered event. The file is emptied once everything was delivered, and rewritten
+// without the delivered events once it holds enough of them. Callers must hold j.mu.
+func (j *EventJournal) ack(seq uint64) error {
+	switch {
+	case j.file == nil:
+		return nil
+	case len(j.pending) == 0:
+		j.acked = 0
+		return j.file.Truncate(0)
+	case j.acked+1 >= journalCompactAfter:
+		return j.rewrite()
+	}
+	j.acked++
+	return j.writeRecord(journalRecord{Ack: seq})
+}
+
+// Status describes the journal.
+func (j *EventJournal) Status() JournalStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := JournalStatus{Name: j.name, Pending: len(j.pending), Dropped: j.dropped, LastError: j.lastError, LastDelivered: j.lastDelivered}
+	if len(j.pending) > 0 {
+		status.Oldest = j.pending[0].Time
+	}
+	return status
+}
+
+var (
+	journalsMu sync.Mutex
+	journals   []*EventJournal
+)
+
+// startJournal opens a sink's journal and starts delivering it. The journal still works from
+// memory when its file can't be used.
+func startJournal(name string, deliver func(Event) error) *EventJournal {
+	journal := NewEventJournal(name, deliver)
+	if err := journal.Open(); err != nil {
+		log.Printf("WARNING: journal %s not persisted: %v", name, err)
+	}
+	journalsMu.Lock()
+	journals = append(journals, journal)
+	journalsMu.Unlock()
+	go journal.Run()
+	return journal
+}
+
+// Stop stops delivering a sink's journal, e.g. a webhook removed from the configuration. The events
+// still pending stay in its file and are delivered if the sink is configured again.
+func (j *EventJournal) Stop() {
+	j.mu.Lock()
+	close(j.stop)
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	j.mu.Unlock()
+	journalsMu.Lock()
+	defer journalsMu.Unlock()
+	for i, journal := range journals {
+		if journal == j {
+			journals = append(journals[:i], journals[i+1:]...)
+			break
+		}
+	}
+}
+
+// journalStatuses lists the journals of the configured sinks.
+func journalStatuses() []JournalStatus {
+	journalsMu.Lock()
+	defer journalsMu.Unlock()
+	statuses := make([]JournalStatus, 0, len(journals))
+	for _, journal := range journals {
+		statuses = append(statuses, journal.Status())
+	}
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].Name < statuses[k].Name })
+	return statuses
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Lighting transition limits. transitionTime is in tenths of a second, at most 65534 in
+// LevelControl and ColorControl.
+const (
+	maxTransitionTenths       = 65534
+	maxLightingKeyframes      = 50
+	maxLightingHoldMs         = 3600 * 1000
+	maxColorTemperatureMireds = 65279
+)
+
+// LightTarget is the state one light fades to. At least one of level, colorTemperatureMireds or
+// hue and saturation is set.
+type LightTarget struct {
+	DeviceID               string `json:"deviceId"`
+	Level                  *int   `json:"level,omitempty"`                  // 0-254; 0 fades out and turns the light off, more turns it on
+	ColorTemperatureMireds *int   `json:"colorTemperatureMireds,omitempty"` // 1-65279
+	Hue                    *int   `json:"hue,omitempty"`                    // 0-254, with saturation
+	Saturation             *int   `json:"saturation,omitempty"`             // 0-254, with hue
+}
+
+// LightingKeyframe is one stage of a transition: every light reaches its target durationMs after
+// the end of the previous keyframe, then holds it holdMs.
+type LightingKeyframe struct {
+	DurationMs int           `json:"durationMs"`
+	HoldMs     int           `json:"holdMs,omitempty"`
+	Lights     []LightTarget `json:"lights"`
+}
+
+// RunLightingTransitionPayload is the payload of "run_lighting_transition": keyframes, or for a
+// single fade just durationMs and lights.
+type RunLightingTransitionPayload struct {
+	Keyframes  []LightingKeyframe `json:"keyframes,omitempty"`
+	DurationMs int                `json:"durationMs,omitempty"`
+	Lights     []LightTarget      `json:"lights,omitempty"`
+}
+
+// keyframes returns the keyframes of the transition, the single fade form included.
+func (p RunLightingTransitionPayload) keyframes() []LightingKeyframe {
+	if len(p.Lights) > 0 {
+		return append([]LightingKeyframe{{DurationMs: p.DurationMs, Lights: p.Lights}}, p.Keyframes...)
+	}
+	return p.Keyframes
+}
+
+// Validate implements Validator.
+func (p RunLightingTransitionPayload) Validate() error {
+	verr := &ValidationError{}
+	keyframes := p.keyframes()
+	if len(keyframes) == 0 {
+		verr.add("keyframes", "is required, or lights for a single fade")
+	}
+	if len(keyframes) > maxLightingKeyframes {
+		verr.add("keyframes", fmt.Sprintf("at most %d", maxLightingKeyframes))
+	}
+	inRange := func(field string, v *int, low, high int) {
+		if v != nil && (*v < low || *v > high) {
+			verr.add(field, fmt.Sprintf("must be between %d and %d", low, high))
+		}
+	}
+	for i, keyframe := range keyframes {
+		prefix := fmt.Sprintf("keyframes[%d].", i)
+		if keyframe.DurationMs < 0 || keyframe.DurationMs > maxTransitionTenths*100 {
+			verr.add(prefix+"durationMs", fmt.Sprintf("must be between 0 and %d", maxTransitionTenths*100))
+		}
+		if keyframe.HoldMs < 0 || keyframe.HoldMs > maxLightingHoldMs {
+			verr.add(prefix+"holdMs", fmt.Sprintf("must be between 0 and %d", maxLightingHoldMs))
+		}
+		if len(keyframe.Lights) == 0 {
+			verr.add(prefix+"lights", "is required")
+		}
+		for j, light := range keyframe.Lights {
+			field := fmt.Sprintf("%slights[%d].", prefix, j)
+			if light.DeviceID == "" {
+				verr.add(field+"deviceId", "is required")
+			}
+			if light.Level == nil && light.ColorTemperatureMireds == nil && light.Hue == nil && light.Saturation == nil {
+				verr.add(field+"level", "level, colorTemperatureMireds or hue and saturation are required")
+			}
+			if (light.Hue == nil) != (light.Saturation == nil) {
+				verr.add(field+"hue", "hue and saturation go together")
+			}
+			if light.ColorTemperatureMireds != nil && light.Hue != nil {
+				verr.add(field+"colorTemperatureMireds", "can't be combined with hue and saturation")
+			}
+			inRange(field+"level", light.Level, 0, 254)
+			inRange(field+"colorTemperatureMireds", light.ColorTemperatureMireds, 1, maxColorTemperatureMireds)
+			inRange(field+"hue", light.Hue, 0, 254)
+			inRange(field+"saturation", light.Saturation, 0, 254)
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// LightingKeyframeResult is sent as "lighting_transition_keyframe" once the commands of a
+// keyframe were sent.
+type LightingKeyframeResult struct {
+	JobID    string   `json:"jobId"`
+	Keyframe int      `json:"keyframe"`
+	Commands int      `json:"commands"`
+	Failed   int      `json:"failed"`
+	Errors   []string `json:"errors,omitempty"`
+	SkewMs   int64    `json:"skewMs"` // How late the last command was sent after the keyframe's start, shortening its transitionTime
+}
+
+// lightCommand is a command sent to a light for a keyframe. transitionTime is added when it is sent.
+type lightCommand struct {
+	device  RegisteredDevice
+	cluster string
+	command string
+	params  map[string]interface{}
+}
+
+// lightCommands returns the commands moving a light to its target: LevelControl for the level,
+// ColorControl for the color, sent together so both fade at once.
+func lightCommands(device RegisteredDevice, target LightTarget) []lightCommand {
+	var commands []lightCommand
+	if target.Level != nil {
+		commands = append(commands, lightCommand{device, "LevelControl", "MoveToLevelWithOnOff", map[string]interface{}{"level": *target.Level}})
+	}
+	if target.ColorTemperatureMireds != nil {
+		commands = append(commands, lightCommand{device, "ColorControl", "MoveToColorTemperature", map[string]interface{}{"colorTemperatureMireds": *target.ColorTemperatureMireds}})
+	}
+	if target.Hue != nil && target.Saturation != nil {
+		commands = append(commands, lightCommand{device, "ColorControl", "MoveToHueAndSaturation", map[string]interface{}{"hue": *target.Hue, "saturation": *target.Saturation}})
+	}
+	return commands
+}
+
+// transitionTenths is the transitionTime of a command sent now that must finish at end.
+func transitionTenths(end time.Time) int {
+	return min(max(int(time.Until(end).Round(100*time.Millisecond)/(100*time.Millisecond)), 0), maxTransitionTenths)
+}
+
+// LightingEngine runs lighting transitions: fades across several lights that start together and
+// end together, chained into keyframes. A light only fades to one place at a time, so a transition
+// cancels those still running on its lights.
+type LightingEngine struct {
+	mu      sync.Mutex
+	running map[string]*Job // Transition driving each light, by device ID
+}
+
+// NewLightingEngine creates an engine with no transition running.
+func NewLightingEngine() *LightingEngine {
+	return &LightingEngine{running: make(map[string]*Job)}
+}
+
+// Start resolves the lights and queues a "lighting_transition" job. Lights whose device lacks a
+// needed feature, e.g. color temperature, are refused up front.
+func (e *LightingEngine) Start(client *Client, payload RunLightingTransitionPayload) (*Job, error) {
+	keyframes := payload.keyframes()
+	plan := make([][]lightCommand, len(keyframes))
+	lights := make(map[string]bool) // Device IDs
+	for i, keyframe := range keyframes {
+		for _, target := range keyframe.Lights {
+			device, ok := deviceRegistry.Get(target.DeviceID)
+			if !ok {
+				return nil, fmt.Errorf("unknown device %q", target.DeviceID)
+			}
+			commands := lightCommands(device, target)
+			for _, command := range commands {
+				if reason, unsupported := unsupportedCommand(device.NodeID, device.EndpointID, command.cluster, command.command); unsupported {
+					return nil, fmt.Errorf("device %s: %s", device.ID, reason)
+				}
+			}
+			plan[i] = append(plan[i], commands...)
+			lights[device.ID] = true
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	superseded := make(map[*Job]bool)
+	for id := range lights {
+		if job, ok := e.running[id]; ok {
+			superseded[job] = true
+		}
+	}
+	for job := range superseded {
+		log.Printf("Lighting transition %s superseded", job.Status().ID)
+		jobs.Cancel(job.Status().ID)
+	}
+	job := jobs.Submit(client, "lighting_transition", func(ctx context.Context, job *Job) (interface{}, error) {
+		defer e.release(job)
+		return e.run(ctx, job, client, keyframes, plan)
+	})
+	for id := range lights {
+		e.running[id] = job
+	}
+	return job, nil
+}
+
+// release forgets the lights a finished transition was driving.
+func (e *LightingEngine) release(job *Job) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for id, running := range e.running {
+		if running == job {
+			delete(e.running, id)
+		}
+	}
+}
+
+// run sends the commands of each keyframe at its planned start, all lights at once. Each
+// command's transitionTime is what is left until the keyframe's planned end, so lights reached
+// late, or keyframes delayed by slow commands, still end together and on schedule.
+func (e *LightingEngine) run(ctx context.Context, job *Job, client *Client, keyframes []LightingKeyframe, plan [][]lightCommand) (interface{}, error) {
+	jobID := job.Status().ID
+	results := make([]LightingKeyframeResult, 0, len(keyframes))
+	failed := 0
+	start := time.Now()
+	for i, keyframe := range keyframes {
+		select {
+		case <-time.After(time.Until(start)):
+		case <-ctx.Done():
+			e.stop(job, plan)
+			return results, ctx.Err()
+		}
+		end := start.Add(time.Duration(keyframe.DurationMs) * time.Millisecond)
+		job.SetProgress(i*100/len(keyframes), fmt.Sprintf("Keyframe %d/%d: %d light(s) over %d ms", i+1, len(keyframes), len(keyframe.Lights), keyframe.DurationMs))
+		result := sendKeyframe(jobID, i, start, end, plan[i])
+		failed += result.Failed
+		results = append(results, result)
+		client.sendPayload("lighting_transition_keyframe", result)
+		start = end.Add(time.Duration(keyframe.HoldMs) * time.Millisecond)
+	}
+	select {
+	case <-time.After(time.Until(start)):
+	case <-ctx.Done():
+		e.stop(job, plan)
+		return results, ctx.Err()
+	}
+	read := make(map[string]bool)
+	for _, commands := range plan {
+		for _, command := range commands {
+			if command.cluster == "LevelControl" && !read[command.device.ID] {
+				read[command.device.ID] = true
+				readBackState(client, command.device.NodeID, command.device.EndpointID, command.cluster)
+			}
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%d command(s) failed", failed)
+	}
+	return results, nil
+}
+
+// sendKeyframe sends the commands of a keyframe concurrently.
+func sendKeyframe(jobID string, index int, start, end time.Time, commands []lightCommand) LightingKeyframeResult {
+	result := LightingKeyframeResult{JobID: jobID, Keyframe: index, Commands: len(commands)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, command := range commands {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			params := make(map[string]interface{}, len(command.params)+1)
+			for k, v := range command.params {
+				params[k] = v
+			}
+			sent := time.Now()
+			params["transitionTime"] = transitionTenths(end)
+			err := controller.InvokeCommand(command.device.NodeID, command.device.EndpointID, command.cluster, command.command, params)
+			mu.Lock()
+			defer mu.Unlock()
+			result.SkewMs = max(result.SkewMs, sent.Sub(start).Milliseconds())
+			if err != nil {
+				result.Failed++
+				result.Errors = append(result.Errors, fmt.Sprintf("%s %s.%s: %v", command.device.ID, command.cluster, command.command, err))
+			}
+		}()
+	}
+	wg.Wait()
+	return result
+}
+
+// lightingStopCommands stop a fade in progress, by cluster.
+var lightingStopCommands = map[string]string{"LevelControl": "Stop", "ColorControl": "StopMoveStep"}
+
+// stop halts the fades of a cancelled transition, leaving its lights where they are. Lights
+// another transition took over are left to it.
+func (e *LightingEngine) stop(job *Job, plan [][]lightCommand) {
+	e.mu.Lock()
+	stops := make(map[string]lightCommand)
+	for _, commands := range plan {
+		for _, command := range commands {
+			if e.running[command.device.ID] == job {
+				stops[command.device.ID+"/"+command.cluster] = lightCommand{device: command.device, cluster: command.cluster, command: lightingStopCommands[command.cluster]}
+			}
+		}
+	}
+	e.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, stop := range stops {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := controller.InvokeCommand(stop.device.NodeID, stop.device.EndpointID, stop.cluster, stop.command, nil); err != nil {
+				log.Printf("Could not stop the transition of %s: %v", stop.device.ID, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func handleRunLightingTransition(client *Client, payload RunLightingTransitionPayload) {
+	if _, err := lightingEngine.Start(client, payload); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "run_lighting_transition failed: " + err.Error()})
+	}
+}
+
+var lightingEngine = NewLightingEngine()
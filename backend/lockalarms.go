@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// doorLockClusterID is the Matter cluster ID of the DoorLock cluster (0x0101).
+const doorLockClusterID = 0x0101
+
+// lockAlarms maps the AlarmCodeEnum of DoorLockAlarm events to readable alarms.
+var lockAlarms = map[int]string{
+	0: "Lock jammed",
+	1: "Lock factory reset",
+	3: "Lock radio power cycled",
+	4: "Wrong code entry limit reached",
+	5: "Front escutcheon removed",
+	6: "Door forced open",
+	7: "Door ajar",
+	8: "Forced user",
+}
+
+// lockAlarmSeverity rates a lock alarm: a jammed or forced lock is critical, a lock reset or
+// power cycled is informational.
+func lockAlarmSeverity(code int) string {
+	switch code {
+	case 0, 4, 6, 8:
+		return severityCritical
+	case 1, 3:
+		return severityInfo
+	}
+	return severityWarning
+}
+
+// LockAlarmPayload is published as "lock_alarm" for each DoorLockAlarm event of a lock.
+type LockAlarmPayload struct {
+	NodeID     string    `json:"nodeId"`
+	EndpointID string    `json:"endpointId"`
+	AlarmCode  int       `json:"alarmCode"`
+	Alarm      string    `json:"alarm"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// detectAndSubscribeLockAlarms checks the endpoint's Descriptor for the DoorLock cluster and, if
+// present, subscribes to its alarm events. Used right after commissioning.
+func detectAndSubscribeLockAlarms(client *Client, nodeID, endpointID string) {
+	hasLock, err := endpointHasCluster(nodeID, endpointID, doorLockClusterID)
+	if err != nil {
+		log.Printf("Could not check DoorLock cluster on Node %s EP%s: %v", nodeID, endpointID, err)
+		return
+	}
+	if !hasLock {
+		return
+	}
+	client.notifyClientLog("subscription_log", fmt.Sprintf("Node %s EP%s exposes the DoorLock cluster, subscribing to lock alarms.", nodeID, endpointID))
+	go startLockAlarmSubscription(client, nodeID, endpointID)
+}
+
+// startLockAlarmSubscription runs a chip-tool DoorLockAlarm event subscription and publishes each
+// reported alarm until the subscription ends.
+func startLockAlarmSubscription(client *Client, nodeID, endpointID string) {
+	subscriptionID := fmt.Sprintf("evt-%s-%s-doorlock-alarm", nodeID, endpointID)
+	cmdArgs := []string{"doorlock", "subscribe-event", "door-lock-alarm", switchEventMinInterval, switchEventMaxInterval, nodeID, endpointID}
+	cmd := exec.Command(chipToolPath, withChipToolStorage(cmdArgs)...)
+
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Printf("[%s] Error creating stdout pipe for event subscription: %v", subscriptionID, err)
+		client.notifyClientLog("subscription_log", fmt.Sprintf("Error starting DoorLock alarm subscription: %v", err))
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("[%s] Error starting chip-tool subscribe-event command: %v", subscriptionID, err)
+		client.notifyClientLog("subscription_log", fmt.Sprintf("Error starting DoorLock alarm subscription: %v", err))
+		return
+	}
+	log.Printf("[%s] chip-tool subscribe-event process started (PID: %d).", subscriptionID, cmd.Process.Pid)
+	subscriptions.Track(subscriptionID, trackedSubscription{nodeID: nodeID, endpointID: endpointID, cmd: cmd})
+	defer subscriptions.Untrack(subscriptionID, cmd)
+
+	scanner := bufio.NewScanner(stdoutPipe)
+	inEvent := false
+	for scanner.Scan() {
+		line := stripAnsi(scanner.Text())
+		if reEventHeader.MatchString(line) {
+			inEvent = true
+			continue
+		}
+		if m := reEventField.FindStringSubmatch(line); inEvent && len(m) == 3 && m[1] == "AlarmCode" {
+			inEvent = false
+			code, _ := strconv.Atoi(m[2])
+			publishLockAlarm(client, LockAlarmPayload{NodeID: nodeID, EndpointID: endpointID, AlarmCode: code})
+		}
+	}
+	waitErr := cmd.Wait()
+	log.Printf("[%s] chip-tool subscribe-event command finished. Exit error: %v", subscriptionID, waitErr)
+	client.notifyClientLog("subscription_log", fmt.Sprintf("DoorLock alarm subscription on Node %s EP%s ended. Error: %v", nodeID, endpointID, waitErr))
+}
+
+// publishLockAlarm publishes a lock alarm; the notification center subscribes to it.
+func publishLockAlarm(client *Client, alarm LockAlarmPayload) {
+	alarm.Timestamp = time.Now()
+	alarm.Alarm = lockAlarms[alarm.AlarmCode]
+	if alarm.Alarm == "" {
+		alarm.Alarm = fmt.Sprintf("Lock alarm %d", alarm.AlarmCode)
+	}
+	log.Printf("Lock alarm: Node %s EP%s %s (code %d)", alarm.NodeID, alarm.EndpointID, alarm.Alarm, alarm.AlarmCode)
+	client.sendPayload("lock_alarm", alarm)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Log levels (logLevel in the configuration). The default, "debug", logs everything, as before
+// the setting existed.
+const (
+	logLevelDebug = "debug" // Everything, including each WebSocket message and REST request
+	logLevelInfo  = "info"  // Without the per-message and per-request lines
+	logLevelWarn  = "warn"  // Warnings and errors only
+)
+
+// warnLogMarkers flag the log lines kept at the "warn" level.
+var warnLogMarkers = [][]byte{[]byte("WARNING"), []byte("ERROR"), []byte("FATAL"), []byte("rror"), []byte("failed")}
+
+// logLevel returns the configured level, read on each line so a config reload applies at once.
+func logLevel() string {
+	switch level := strings.ToLower(appConfig.LogLevel); level {
+	case logLevelInfo, logLevelWarn:
+		return level
+	}
+	return logLevelDebug
+}
+
+// debugf logs a per-message or per-request line, only at the "debug" level.
+func debugf(format string, args ...interface{}) {
+	if logLevel() == logLevelDebug {
+		log.Output(2, fmt.Sprintf(format, args...))
+	}
+}
+
+// levelWriter drops the log lines below the "warn" level when it is selected.
+type levelWriter struct {
+	out io.Writer
+}
+
+func (w levelWriter) Write(p []byte) (int, error) {
+	if logLevel() == logLevelWarn {
+		keep := false
+		for _, marker := range warnLogMarkers {
+			if bytes.Contains(p, marker) {
+				keep = true
+				break
+			}
+		}
+		if !keep {
+			return len(p), nil
+		}
+	}
+	return w.out.Write(p)
+}
+
+// applyLogLevel filters the log output by logLevel from now on.
+func applyLogLevel() {
+	log.SetOutput(levelWriter{out: log.Writer()})
+}
+
+// requestLogger is gin's request log, written at the "debug" level only.
+func requestLogger() gin.HandlerFunc {
+	return gin.LoggerWithConfig(gin.LoggerConfig{Skip: func(*gin.Context) bool { return logLevel() != logLevelDebug }})
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// macrosFile is where macros are persisted, relative to the data directory.
+const macrosFile = "macros.json"
+
+// maxMacroDelay bounds the delay before a macro step.
+const maxMacroDelay = time.Hour
+
+// MacroStep is one device command of a macro, run after waiting DelayMs.
+type MacroStep struct {
+	DelayMs int                  `json:"delayMs,omitempty"` // Wait before the command, e.g. for a light to finish dimming
+	Action  DeviceCommandPayload `json:"action"`
+}
+
+// Macro is a named, ordered list of device commands (e.g. "Movie time") run with one "run_macro".
+type Macro struct {
+	ID              string      `json:"id"`
+	Name            string      `json:"name"`
+	Steps           []MacroStep `json:"steps"`
+	ContinueOnError bool        `json:"continueOnError,omitempty"` // Run the remaining steps after a failed one
+}
+
+// Validate implements Validator.
+func (m Macro) Validate() error {
+	verr := &ValidationError{}
+	if m.Name == "" {
+		verr.add("name", "is required")
+	}
+	if len(m.Steps) == 0 {
+		verr.add("steps", "needs at least one step")
+	}
+	for i, step := range m.Steps {
+		field := fmt.Sprintf("steps[%d]", i)
+		if step.DelayMs < 0 || time.Duration(step.DelayMs)*time.Millisecond > maxMacroDelay {
+			verr.add(field+".delayMs", fmt.Sprintf("must be between 0 and %d", maxMacroDelay.Milliseconds()))
+		}
+		if (step.Action.NodeID == "" && step.Action.DeviceID == "") || step.Action.Cluster == "" || step.Action.Command == "" {
+			verr.add(field+".action", "needs nodeId (or deviceId), cluster and command")
+		}
+		if err := step.Action.Validate(); err != nil {
+			verr.add(field+".action", err.Error())
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// MacroIDPayload is the payload of "run_macro" and "delete_macro".
+type MacroIDPayload struct {
+	ID string `json:"id" validate:"required"`
+}
+
+// MacrosListPayload is sent in response to "list_macros" and "delete_macro".
+type MacrosListPayload struct {
+	Macros []Macro `json:"macros"`
+}
+
+// MacroStartedPayload is sent in response to "run_macro"; the run can be cancelled with "cancel_job".
+type MacroStartedPayload struct {
+	MacroID string `json:"macroId"`
+	JobID   string `json:"jobId"`
+}
+
+// MacroStepResult is streamed as "macro_step" after each step, and the list of them is the job result.
+type MacroStepResult struct {
+	MacroID string `json:"macroId"`
+	JobID   string `json:"jobId"`
+	Step    int    `json:"step"` // Index in the macro's steps
+	Cluster string `json:"cluster"`
+	Command string `json:"command"`
+	Success bool   `json:"success"`
+	Skipped bool   `json:"skipped,omitempty"` // Not run because an earlier step failed
+	Error   string `json:"error,omitempty"`
+	Details string `json:"details,omitempty"`
+}
+
+// MacroStore keeps the macros.
+type MacroStore struct {
+	mu     sync.RWMutex
+	macros map[string]*Macro
+	path   string
+}
+
+// NewMacroStore creates a MacroStore persisting its macros to path.
+func NewMacroStore(path string) *MacroStore {
+	return &MacroStore{macros: make(map[string]*Macro), path: path}
+}
+
+// Load reads the persisted macros. A missing file is not an error.
+func (s *MacroStore) Load() error {
+	var macros []*Macro
+	if err := loadJSONFile(s.path, &macros); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, macro := range macros {
+		s.macros[macro.ID] = macro
+	}
+	log.Printf("Loaded %d macro(s) from %s", len(macros), s.path)
+	return nil
+}
+
+// save writes the macros to disk. Callers must hold s.mu.
+func (s *MacroStore) save() error {
+	return saveJSONFile(s.path, s.listLocked())
+}
+
+func (s *MacroStore) listLocked() []Macro {
+	macros := make([]Macro, 0, len(s.macros))
+	for _, macro := range s.macros {
+		macros = append(macros, *macro)
+	}
+	sort.Slice(macros, func(i, j int) bool { return macros[i].ID < macros[j].ID })
+	return macros
+}
+
+// List returns all macros sorted by ID.
+func (s *MacroStore) List() []Macro {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.listLocked()
+}
+
+// Get returns a macro by ID.
+func (s *MacroStore) Get(id string) (Macro, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	macro, ok := s.macros[id]
+	if !ok {
+		return Macro{}, false
+	}
+	return *macro, true
+}
+
+// Put adds or replaces a macro, assigning an ID if it has none.
+func (s *MacroStore) Put(macro Macro) (Macro, error) {
+	if err := macro.Validate(); err != nil {
+		return macro, err
+	}
+	if macro.ID == "" {
+		macro.ID = fmt.Sprintf("macro-%d", time.Now().UnixNano())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.macros[macro.ID] = &macro
+	return macro, s.save()
+}
+
+// Delete removes a macro by ID.
+func (s *MacroStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.macros[id]; !ok {
+		return fmt.Errorf("macro %q not found", id)
+	}
+	delete(s.macros, id)
+	return s.save()
+}
+
+// Run queues a macro as a "macro" job, so it shares the job concurrency limit with the other
+// chip-tool work and can be cancelled with "cancel_job". Each step's result is sent to client as a
+// "macro_step" message while the macro runs.
+func (s *MacroStore) Run(client *Client, id string) (*Job, error) {
+	macro, ok := s.Get(id)
+	if !ok {
+		return nil, fmt.Errorf("macro %q not found", id)
+	}
+	return jobs.Submit(client, "macro", func(ctx context.Context, job *Job) (interface{}, error) {
+		return runMacro(ctx, job, client, macro)
+	}), nil
+}
+
+// runMacro runs the steps in order. A failed step stops the macro unless continueOnError is set;
+// the steps left are reported as skipped.
+func runMacro(ctx context.Context, job *Job, client *Client, macro Macro) (interface{}, error) {
+	jobID := job.Status().ID
+	log.Printf("Running macro %s (%s), %d step(s)", macro.ID, macro.Name, len(macro.Steps))
+	results := make([]MacroStepResult, 0, len(macro.Steps))
+	failed := 0
+	for i, step := range macro.Steps {
+		result := MacroStepResult{MacroID: macro.ID, JobID: jobID, Step: i, Cluster: step.Action.Cluster, Command: step.Action.Command}
+		if failed > 0 && !macro.ContinueOnError {
+			result.Skipped, result.Error = true, "an earlier step failed"
+			results = append(results, result)
+			client.sendPayload("macro_step", result)
+			continue
+		}
+		if step.DelayMs > 0 {
+			job.SetProgress(i*100/len(macro.Steps), fmt.Sprintf("Waiting %d ms before step %d", step.DelayMs, i+1))
+			select {
+			case <-time.After(time.Duration(step.DelayMs) * time.Millisecond):
+			case <-ctx.Done():
+				return results, ctx.Err()
+			}
+		}
+		job.SetProgress(i*100/len(macro.Steps), fmt.Sprintf("Step %d/%d: %s.%s", i+1, len(macro.Steps), step.Action.Cluster, step.Action.Command))
+		result.Success, result.Error, result.Details = runMacroStep(client, step.Action)
+		if !result.Success {
+			failed++
+		}
+		results = append(results, result)
+		client.sendPayload("macro_step", result)
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d step(s) failed", failed, len(macro.Steps))
+	}
+	return results, nil
+}
+
+// runMacroStep runs a device command and reports its outcome from the "command_response" messages
+// it sent: executeDeviceCommand only reports failures reliably, so a step without one succeeded.
+func runMacroStep(client *Client, action DeviceCommandPayload) (bool, string, string) {
+	var mu sync.Mutex
+	success, errMsg, details := true, "", ""
+	view := client.observed(func(msgType string, payload interface{}) {
+		response, ok := payload.(CommandResponsePayload)
+		if !ok || msgType != "command_response" {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !response.Success {
+			success, errMsg = false, response.Error
+		}
+		details = response.Details
+	})
+	executeDeviceCommand(view, action)
+	mu.Lock()
+	defer mu.Unlock()
+	return success, errMsg, details
+}
+
+// observed returns a view of the client that also passes each message it sends to observe. client
+// may be nil, in which case the messages only reach observe and the internal subscribers.
+func (c *Client) observed(observe func(msgType string, payload interface{})) *Client {
+	if c == nil {
+		return &Client{observe: observe}
+	}
+	view := c.view()
+	view.observe = observe
+	return view
+}
+
+func handleListMacros(client *Client) {
+	client.sendPayload("macros_list", MacrosListPayload{Macros: macroStore.List()})
+}
+
+func handleAddMacro(client *Client, macro Macro) {
+	saved, err := macroStore.Put(macro)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "add_macro failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("macro_saved", saved)
+}
+
+func handleDeleteMacro(client *Client, payload MacroIDPayload) {
+	if err := macroStore.Delete(payload.ID); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "delete_macro failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("macros_list", MacrosListPayload{Macros: macroStore.List()})
+}
+
+func handleRunMacro(client *Client, payload MacroIDPayload) {
+	job, err := macroStore.Run(client, payload.ID)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "run_macro failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("macro_started", MacroStartedPayload{MacroID: payload.ID, JobID: job.Status().ID})
+}
+
+var macroStore = NewMacroStore(macrosFile)
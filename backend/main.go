@@ -4,7 +4,7 @@ import (
 	"flag"
 	"log"
 	"net/http"
-	"os/exec"
+	"os"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -13,27 +13,116 @@ import (
 var addr = flag.String("addr", ":8080", "http service address for the backend")
 
 func main() {
+	if url := os.Getenv(simulatorURLEnv); url != "" {
+		os.Exit(runSimulatedChipTool(url, os.Args[1:])) // Running as the simulated chip-tool
+	}
 	flag.Parse()
 	log.SetFlags(log.LstdFlags | log.Lshortfile) // Add file and line number to logs
+	initDataDirs()                                // State files, log file and chip-tool storage locations
+
+	if *simulateFlag {
+		if err := startSimulation(*addr); err != nil {
+			log.Fatalf("Could not start simulation mode: %v", err)
+		}
+	}
 
-	// Check if chip-tool is accessible (basic check)
-	// This doesn't guarantee it works, but checks if the command exists.
-	cmd := exec.Command(chipToolPath, "--version")
-	if err := cmd.Run(); err != nil {
-		log.Printf("WARNING: chip-tool command '%s' not found or not executable. Please ensure it's installed and in PATH, or chipToolPath is set correctly in handlers.go. Error: %v", chipToolPath, err)
-		log.Println("The backend might not function correctly for Matter device interactions.")
-		// os.Exit(1) // Optionally exit if chip-tool is critical and not found.
+	if err := loadConfig(*configPath); err != nil {
+		log.Printf("WARNING: could not load configuration, using defaults: %v", err)
+	}
+	applyLogLevel() // logLevel: debug, info or warn
+	go watchConfigReload() // Reload the configuration on SIGHUP
+	readOnly.Init() // -read-only or readOnly in the configuration
+	chipToolSelection = selectChipTool() // -chip-tool, chipToolPath, or the first chip-tool found
+	applyChipToolPolicy(chipToolSelection) // Exit or degrade when none was found
+	runSchemaMigrations() // Before any store loads its state file
+	if err := featureFlags.Load(); err != nil {
+		log.Printf("WARNING: could not load feature flags: %v", err)
+	}
+	if selected, err := newController(appConfig.Controller); err != nil {
+		log.Printf("WARNING: %v; using chip-tool", err)
 	} else {
-		log.Printf("chip-tool found at '%s' and seems executable.", chipToolPath)
+		controller = selected
+		log.Printf("Device commands and reads go through the %s controller", controller.Name())
+	}
+	if err := deviceRegistry.Load(); err != nil {
+		log.Printf("WARNING: could not load device registry: %v", err)
+	}
+	if err := attributeHistory.Load(); err != nil {
+		log.Printf("WARNING: could not load attribute history: %v", err)
+	}
+	if err := rulesEngine.Load(); err != nil {
+		log.Printf("WARNING: could not load rules: %v", err)
+	}
+	if err := macroStore.Load(); err != nil {
+		log.Printf("WARNING: could not load macros: %v", err)
+	}
+	if err := virtualDevices.Load(); err != nil {
+		log.Printf("WARNING: could not load virtual devices: %v", err)
+	}
+	if err := notificationCenter.Load(); err != nil {
+		log.Printf("WARNING: could not load notifications: %v", err)
+	}
+	if err := poller.Load(); err != nil {
+		log.Printf("WARNING: could not load polling profiles: %v", err)
 	}
+	if err := alertEngine.Load(); err != nil {
+		log.Printf("WARNING: could not load alerts: %v", err)
+	}
+	if err := wizards.Load(); err != nil {
+		log.Printf("WARNING: could not load onboarding sessions: %v", err)
+	}
+	if err := energyReports.Load(); err != nil {
+		log.Printf("WARNING: could not load energy meters: %v", err)
+	}
+	if err := houseModes.Load(); err != nil {
+		log.Printf("WARNING: could not load the house mode: %v", err)
+	}
+	if err := setup.Load(); err != nil {
+		log.Printf("WARNING: could not load the setup progress: %v", err)
+	}
+	if err := uiPreferences.Load(); err != nil {
+		log.Printf("WARNING: could not load the UI preferences: %v", err)
+	}
+	ensureBatteryAlertRules()
 
+	if !degradedMode.Active() { // Without chip-tool, these would only fail (and flag every device as gone)
+		go sessionWarmer.Run() // Keep favorite devices warm
+		go reconciler.Run()    // Flag registry entries no longer on the fabric
+		go addressWatcher.Run() // Follow nodes that moved to another address
+		go poller.Run()        // Poll devices whose subscriptions don't work
+		go timeSync.Run()      // Keep the device clocks in sync
+		go driftMonitor.Run()  // Compare the commanded states with fresh reads
+		startFabricCheck(nil)  // Compare the registry with chip-tool's fabric state
+	}
+	go alertEngine.Run()   // Raise alerts whose condition held long enough
+	go houseModes.Run()    // Follow occupancy with the house mode
+	go chipToolWatcher.Run() // Probe chip-tool and notice when it is replaced
+	go threadBorderRouter.Run() // Follow the Thread network health, when threadBorderRouter.url is set
+	go retention.Loop()      // Prune old history, traces, audit records and logs
+	go runBatchWriters()     // Write the history and audit log in batches, flush them on SIGTERM
+	startWebhooks()        // Deliver selected events to webhooks and MQTT
+	startMQTT()
+	startBrokers()         // and to NATS and AMQP
+	federation.Apply(appConfig.Federation.Remotes) // Connect to the remote hubs, if any
+	coapServer.Start(appConfig.CoAP)                // CoAP resources, when coap.listen is set
+	tracer.Start(appConfig.Telemetry) // OpenTelemetry spans, when telemetry.endpoint is set
 
 	hub := NewHub()
+	eventBus.Subscribe("hub", hub.deliver) // Deliver bus events to the WebSocket clients
 	go hub.Run() // Start the WebSocket hub in a separate goroutine
+	go hub.RunHeartbeat() // Broadcast the hub stats periodically
+	go hub.RunSlowConsumerCheck() // Evict the clients that can't keep up
+
+	startAdminAPI(hub) // Destructive operations, on their own listener
+	matterServerAPI.start() // python-matter-server clients, when matterServerApi.listen is set
 
 	router := gin.New() // Use gin.New() for more control over middleware
-	router.Use(gin.Logger())   // Gin's default logger
+	if err := router.SetTrustedProxies(trustedProxies()); err != nil { // X-Forwarded-For in the request logs
+		log.Printf("WARNING: invalid trustedProxies: %v", err)
+	}
+	router.Use(requestLogger())   // Gin's default logger, at the debug log level
 	router.Use(gin.Recovery()) // Gin's default recovery middleware
+	router.Use(telemetryMiddleware()) // OpenTelemetry spans of the REST calls (see telemetry.go)
 
 	// Configure CORS
 	// The frontend runs on http://localhost:5173 (default Vite port)
@@ -42,30 +131,33 @@ func main() {
 	// Allow specific origins. For development, localhost for Vue and potentially RPi's IP if accessing directly.
 	// For production, replace with your frontend's actual domain.
 	config.AllowOrigins = []string{"http://localhost:5173", "http://127.0.0.1:5173"} 
+	// The configured origins are read per request, so a config reload applies to them
+	config.AllowOriginFunc = func(origin string) bool { return containsString(appConfig.AllowedOrigins, origin) }
 	// If accessing frontend from another machine on the network, you might need to add that origin too,
 	// or allow all origins for wider testing (config.AllowAllOrigins = true), but be cautious.
 	// config.AllowAllOrigins = true // For easier testing, but less secure for production
 	config.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
-	config.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization"}
+	config.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization", "If-None-Match", "traceparent", "X-Request-Id"}
+	config.ExposeHeaders = []string{"ETag", "traceparent", "Deprecation", "Sunset", "Link"} // Lets browser integrations poll conditionally (see etag.go) and see deprecations (see apiversions.go)
 	config.AllowCredentials = true // Important for WebSocket if it ever needs credentials/cookies
 
 	router.Use(cors.New(config))
 
 	// WebSocket endpoint
 	router.GET("/ws", func(c *gin.Context) {
-		serveWs(hub, c.Writer, c.Request)
+		serveWs(hub, c.Writer, c.Request, false)
 	})
 
-	// Example REST endpoint (optional, if needed for non-realtime tasks or health checks)
-	router.GET("/api/status", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":          "Matter Backend Running",
-			"websocket_clients": len(hub.clients), // Example of exposing some hub info
-		})
-	})
+	// Scripting of the virtual devices, in simulation mode only
+	if *simulateFlag {
+		registerSimulatorRoutes(router)
+	}
+
+	// REST endpoints, under /api/v1 and the deprecated /api (see apiversions.go)
+	registerVersionedAPI(router, func(api *gin.RouterGroup) { registerAPIRoutes(api, hub) })
 
-	log.Printf("Matter Backend Server starting on %s", *addr)
-	if err := router.Run(*addr); err != nil {
+	log.Printf("Matter Backend Server starting on %s (base path %q)", *addr, normalizeBasePath(appConfig.BasePath))
+	if err := http.ListenAndServe(*addr, withBasePath(router)); err != nil {
 		log.Fatalf("Failed to run server: %v", err)
 	}
 }
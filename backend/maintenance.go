@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maintenanceDrainTimeout bounds how long starting maintenance waits for the chip-tool runs in flight.
+const maintenanceDrainTimeout = 30 * time.Second
+
+// maintenanceMessageTypes are the messages starting a subscription, refused during maintenance.
+var maintenanceMessageTypes = map[string]bool{
+	"subscribe_attribute":     true,
+	"subscribe_sensor_bundle": true,
+	"subscribe_switch_events": true,
+	"enable_subscription":     true,
+}
+
+// MaintenanceState is broadcast as "maintenance" when maintenance starts and ends, and shown in
+// GET /api/status.
+type MaintenanceState struct {
+	Active          bool      `json:"active"`
+	Reason          string    `json:"reason,omitempty"`
+	StartedBy       string    `json:"startedBy,omitempty"`
+	Since           time.Time `json:"since,omitzero"`
+	ExpectedMinutes int       `json:"expectedMinutes,omitempty"` // Announced duration, for the clients' notice
+	InFlight        int       `json:"inFlight"`                  // chip-tool runs still finishing
+	// Set when maintenance ended:
+	EndedAt         time.Time `json:"endedAt,omitzero"`
+	ChipToolChanged bool      `json:"chipToolChanged,omitempty"` // The binary was replaced meanwhile
+	Resubscribed    int       `json:"resubscribed,omitempty"`    // Attribute subscriptions restarted
+}
+
+// Maintenance pauses the backend's work on the devices while an admin swaps chip-tool or restores
+// the commissioner storage: one-shot chip-tool runs and queued jobs wait, new subscriptions are
+// refused, and running jobs and subscriptions are left to finish. Ending it re-probes chip-tool,
+// restarts the attribute subscriptions on the new binary and storage, and releases what waited.
+type Maintenance struct {
+	ops     sync.Mutex // Serializes Start and End
+	mu      sync.Mutex
+	state   MaintenanceState
+	resumed chan struct{} // Closed when maintenance ends
+}
+
+// Start enters maintenance and broadcasts the notice. It returns once the chip-tool runs in
+// flight finished, or after maintenanceDrainTimeout.
+func (m *Maintenance) Start(reason, by string, expectedMinutes int) (MaintenanceState, error) {
+	m.ops.Lock()
+	defer m.ops.Unlock()
+	m.mu.Lock()
+	if m.state.Active {
+		m.mu.Unlock()
+		return MaintenanceState{}, fmt.Errorf("maintenance already started by %s at %s", m.state.StartedBy, m.state.Since.Format(time.RFC3339))
+	}
+	m.state = MaintenanceState{Active: true, Reason: reason, StartedBy: by, Since: time.Now(), ExpectedMinutes: expectedMinutes}
+	m.resumed = make(chan struct{})
+	state := m.state
+	m.mu.Unlock()
+	log.Printf("Maintenance started by %s: %s", by, reason)
+	broadcastToClients("maintenance", state)
+
+	inFlight := chipToolWatcher.Pause(maintenanceDrainTimeout)
+	m.mu.Lock()
+	m.state.InFlight = inFlight
+	state = m.state
+	m.mu.Unlock()
+	if inFlight > 0 {
+		log.Printf("Maintenance: %d chip-tool run(s) still in flight", inFlight)
+	}
+	return state, nil
+}
+
+// End leaves maintenance: it re-probes chip-tool, restarts the attribute subscriptions and
+// releases the waiting runs and jobs, then broadcasts the end of the notice.
+func (m *Maintenance) End() (MaintenanceState, error) {
+	m.ops.Lock()
+	defer m.ops.Unlock()
+	m.mu.Lock()
+	if !m.state.Active {
+		m.mu.Unlock()
+		return MaintenanceState{}, fmt.Errorf("no maintenance in progress")
+	}
+	m.mu.Unlock()
+
+	changed := chipToolWatcher.Resume()
+	resubscribed := subscriptions.ResubscribeAll()
+
+	m.mu.Lock()
+	m.state.Active, m.state.EndedAt, m.state.InFlight = false, time.Now(), 0
+	m.state.ChipToolChanged, m.state.Resubscribed = changed, resubscribed
+	close(m.resumed)
+	state := m.state
+	m.mu.Unlock()
+	log.Printf("Maintenance ended after %s (chip-tool changed: %v, %d subscription(s) restarted)", state.EndedAt.Sub(state.Since).Round(time.Second), changed, resubscribed)
+	broadcastToClients("maintenance", state)
+	return state, nil
+}
+
+// State returns the current or latest maintenance.
+func (m *Maintenance) State() MaintenanceState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state := m.state
+	if state.Active {
+		state.InFlight = chipToolWatcher.InFlight()
+	}
+	return state
+}
+
+// Active reports whether maintenance is in progress.
+func (m *Maintenance) Active() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state.Active
+}
+
+// Wait blocks while maintenance is in progress, until it ends or ctx is done.
+func (m *Maintenance) Wait(ctx context.Context) error {
+	m.mu.Lock()
+	active, resumed := m.state.Active, m.resumed
+	m.mu.Unlock()
+	if !active {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// maintenanceMiddleware refuses new subscriptions during maintenance.
+func maintenanceMiddleware(msgType string, next HandlerFunc) HandlerFunc {
+	return func(client *Client, msg ClientMessage) {
+		if maintenanceMessageTypes[msgType] && maintenance.Active() {
+			client.notifyClient("error", map[string]interface{}{"message": msgType + " is not available during maintenance, try again once it ends.", "code": errCodeMaintenance})
+			return
+		}
+		next(client, msg)
+	}
+}
+
+// StartMaintenancePayload is the payload of "start_maintenance" (admin API).
+type StartMaintenancePayload struct {
+	Reason          string `json:"reason" validate:"required"`
+	ExpectedMinutes int    `json:"expectedMinutes,omitempty"`
+}
+
+// Validate requires a reason, shown to the clients, and a positive expected duration if any.
+func (p StartMaintenancePayload) Validate() error {
+	verr := &ValidationError{}
+	if p.Reason == "" {
+		verr.add("reason", "is required")
+	}
+	if p.ExpectedMinutes < 0 {
+		verr.add("expectedMinutes", "must not be negative")
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// MaintenanceRequest is the body of POST /api/admin/maintenance.
+type MaintenanceRequest struct {
+	Active *bool `json:"active"`
+	StartMaintenancePayload
+}
+
+// apply starts or ends maintenance.
+func (p MaintenanceRequest) apply(by string) (MaintenanceState, error) {
+	if p.Active == nil {
+		return MaintenanceState{}, &ValidationError{Fields: []FieldError{{Field: "active", Message: "is required"}}}
+	}
+	if !*p.Active {
+		return maintenance.End()
+	}
+	if err := p.StartMaintenancePayload.Validate(); err != nil {
+		return MaintenanceState{}, err
+	}
+	return maintenance.Start(p.Reason, by, p.ExpectedMinutes)
+}
+
+func handleStartMaintenance(client *Client, payload StartMaintenancePayload) {
+	state, err := maintenance.Start(payload.Reason, notificationActor(client), payload.ExpectedMinutes)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "start_maintenance failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("maintenance", state)
+}
+
+func handleEndMaintenance(client *Client) {
+	state, err := maintenance.End()
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "end_maintenance failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("maintenance", state)
+}
+
+func handleGetMaintenance(client *Client) {
+	client.sendPayload("maintenance", maintenance.State())
+}
+
+// registerMaintenanceREST adds POST /admin/maintenance to an API version group of the admin API.
+func registerMaintenanceREST(api *gin.RouterGroup) {
+	api.POST("/admin/maintenance", func(c *gin.Context) {
+		var payload MaintenanceRequest
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		auditREST(c, "maintenance", payload)
+		state, err := payload.apply(requestClientAddr(c.Request))
+		if verr, ok := err.(*ValidationError); ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": verr.Fields})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, state)
+	})
+}
+
+var maintenance = &Maintenance{}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The python-matter-server API schema we implement, and the error codes of its clients.
+const (
+	matterAPISchemaVersion       = 11
+	matterAPIMinSchemaVersion    = 9
+	matterAPIErrUnknown          = 0
+	matterAPIErrNodeNotExists    = 5
+	matterAPIErrInvalidArguments = 8
+	matterAPIErrInvalidCommand   = 9
+)
+
+// matterAPIRequest is a command of a python-matter-server client.
+type matterAPIRequest struct {
+	MessageID string          `json:"message_id"`
+	Command   string          `json:"command"`
+	Args      json.RawMessage `json:"args"`
+}
+
+// matterAPIError is a failed command, reported with one of the python-matter-server error codes.
+type matterAPIError struct {
+	code    int
+	details string
+}
+
+func (e *matterAPIError) Error() string { return e.details }
+
+// matterAPISession is one client of the python-matter-server compatible API.
+type matterAPISession struct {
+	conn      *websocket.Conn
+	addr      string
+	writeMu   sync.Mutex
+	listening atomic.Bool // Set by start_listening; events are only sent afterwards
+}
+
+// send writes a message, dropping the connection when it can't be written.
+func (s *matterAPISession) send(message interface{}) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := s.conn.WriteJSON(message); err != nil {
+		s.conn.Close()
+	}
+}
+
+// MatterServerAPI serves the WebSocket API of home-assistant-libs/python-matter-server, so its
+// clients (the Home Assistant Matter integration, matter-server dashboards) can use this gateway
+// in its place. Nodes come from the device registry and their attributes from the state cache.
+type MatterServerAPI struct {
+	mu       sync.Mutex
+	sessions map[*matterAPISession]bool
+}
+
+// NewMatterServerAPI creates a MatterServerAPI without sessions.
+func NewMatterServerAPI() *MatterServerAPI {
+	return &MatterServerAPI{sessions: make(map[*matterAPISession]bool)}
+}
+
+// start serves the API on matterServerApi.listen; it is disabled when that is empty.
+func (a *MatterServerAPI) start() {
+	address := appConfig.MatterServerAPI.Listen
+	if address == "" {
+		return
+	}
+	eventBus.Subscribe("matter-server-api", a.forwardEvent, topicDevice)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", a.serve)
+	log.Printf("python-matter-server compatible API listening on %s", address)
+	go func() {
+		if err := http.ListenAndServe(address, mux); err != nil {
+			log.Printf("WARNING: python-matter-server compatible API stopped: %v", err)
+		}
+	}()
+}
+
+// serve handles one client connection: the server info greeting, then commands until it disconnects.
+func (a *MatterServerAPI) serve(w http.ResponseWriter, r *http.Request) {
+	if appConfig.AuthToken != "" && !tokensEqual(r.URL.Query().Get("token"), appConfig.AuthToken) {
+		http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("python-matter-server API: upgrade failed: %v", err)
+		return
+	}
+	session := &matterAPISession{conn: conn, addr: requestClientAddr(r)}
+	a.mu.Lock()
+	a.sessions[session] = true
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		delete(a.sessions, session)
+		a.mu.Unlock()
+		conn.Close()
+		log.Printf("python-matter-server API client %s disconnected", session.addr)
+	}()
+	log.Printf("python-matter-server API client %s connected", session.addr)
+	conn.SetReadLimit(maxMessageSize)
+
+	session.send(matterAPIServerInfo())
+	for {
+		var request matterAPIRequest
+		if err := conn.ReadJSON(&request); err != nil {
+			return
+		}
+		// Commands may take long (device commands, reads); answer them in any order like the original
+		go a.handle(session, request)
+	}
+}
+
+// handle runs a command and sends its result or error.
+func (a *MatterServerAPI) handle(session *matterAPISession, request matterAPIRequest) {
+	result, err := a.run(session, request)
+	if err != nil {
+		code := matterAPIErrUnknown
+		if apiErr, ok := err.(*matterAPIError); ok {
+			code = apiErr.code
+		}
+		session.send(map[string]interface{}{"message_id": request.MessageID, "error_code": code, "details": err.Error()})
+		return
+	}
+	session.send(map[string]interface{}{"message_id": request.MessageID, "result": result})
+}
+
+// run executes a command. Commissioning, node removal and the other write operations are left to
+// this gateway's own API.
+func (a *MatterServerAPI) run(session *matterAPISession, request matterAPIRequest) (interface{}, error) {
+	var args struct {
+		NodeID        *uint64                `json:"node_id"`
+		EndpointID    int                    `json:"endpoint_id"`
+		ClusterID     uint32                 `json:"cluster_id"`
+		CommandName   string                 `json:"command_name"`
+		Payload       map[string]interface{} `json:"payload"`
+		AttributePath string                 `json:"attribute_path"`
+	}
+	if len(request.Args) > 0 {
+		if err := json.Unmarshal(request.Args, &args); err != nil {
+			return nil, &matterAPIError{matterAPIErrInvalidArguments, "invalid args: " + err.Error()}
+		}
+	}
+	nodeID := func() (string, error) {
+		if args.NodeID == nil {
+			return "", &matterAPIError{matterAPIErrInvalidArguments, "node_id is required"}
+		}
+		id := strconv.FormatUint(*args.NodeID, 10)
+		if _, ok := deviceRegistry.Get(id); !ok {
+			return "", &matterAPIError{matterAPIErrNodeNotExists, fmt.Sprintf("Node %s does not exist or is not yet interviewed", id)}
+		}
+		return id, nil
+	}
+
+	switch request.Command {
+	case "server_info":
+		return matterAPIServerInfo(), nil
+	case "get_nodes":
+		return matterAPINodes(), nil
+	case "start_listening":
+		session.listening.Store(true)
+		return matterAPINodes(), nil
+	case "get_node":
+		id, err := nodeID()
+		if err != nil {
+			return nil, err
+		}
+		device, _ := deviceRegistry.Get(id)
+		return matterAPINode(device), nil
+	case "read_attribute":
+		id, err := nodeID()
+		if err != nil {
+			return nil, err
+		}
+		endpoint, cluster, attribute, err := parseMatterAttributePath(args.AttributePath)
+		if err != nil {
+			return nil, &matterAPIError{matterAPIErrInvalidArguments, err.Error()}
+		}
+		value, err := controller.ReadAttribute(id, endpoint, cluster, attribute)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{args.AttributePath: value}, nil
+	case "device_command":
+		if readOnly.Enabled() {
+			return nil, &matterAPIError{matterAPIErrInvalidCommand, readOnlyMessage("device_command")}
+		}
+		id, err := nodeID()
+		if err != nil {
+			return nil, err
+		}
+		cluster, ok := matterClusterName(args.ClusterID)
+		if !ok {
+			cluster = strconv.FormatUint(uint64(args.ClusterID), 10)
+		}
+		if usesChipTool() && !ok {
+			return nil, &matterAPIError{matterAPIErrInvalidArguments, fmt.Sprintf("cluster %d is not supported", args.ClusterID)}
+		}
+		endpoint := strconv.Itoa(args.EndpointID)
+		if err := controller.InvokeCommand(id, endpoint, cluster, args.CommandName, args.Payload); err != nil {
+			return nil, err
+		}
+		readBackState(nil, id, endpoint, cluster) // Reported as attribute_updated, like a subscription would
+		return nil, nil
+	}
+	return nil, &matterAPIError{matterAPIErrInvalidCommand, fmt.Sprintf("command %q is not supported by this gateway", request.Command)}
+}
+
+// forwardEvent turns hub events into python-matter-server events for the listening sessions.
+func (a *MatterServerAPI) forwardEvent(event Event) {
+	var message map[string]interface{}
+	switch payload := event.Payload.(type) {
+	case AttributeUpdatePayload:
+		node, err := parseMatterNodeID(payload.NodeID)
+		if err != nil {
+			return
+		}
+		path, err := matterAttributePath(payload.EndpointID, payload.Cluster, payload.Attribute)
+		if err != nil {
+			return // Attributes missing from matterClusters can't be addressed by ID
+		}
+		value := payload.Value
+		if payload.RawValue != nil {
+			value = payload.RawValue // Clients expect the device's own units
+		}
+		message = map[string]interface{}{"event": "attribute_updated", "data": []interface{}{node, path, value}}
+	case RegisteredDevice:
+		if payload.BridgeID != "" {
+			return
+		}
+		message = map[string]interface{}{"event": "node_added", "data": matterAPINode(payload)}
+	case DeviceRemovedPayload:
+		node, err := parseMatterNodeID(payload.NodeID)
+		if err != nil || payload.DeviceID != payload.NodeID {
+			return // Only whole nodes are removed from matter-server clients
+		}
+		message = map[string]interface{}{"event": "node_removed", "data": node}
+	default:
+		return
+	}
+	a.mu.Lock()
+	sessions := make([]*matterAPISession, 0, len(a.sessions))
+	for session := range a.sessions {
+		sessions = append(sessions, session)
+	}
+	a.mu.Unlock()
+	for _, session := range sessions {
+		if session.listening.Load() {
+			session.send(message)
+		}
+	}
+}
+
+// matterAPIServerInfo is the greeting of every connection and the result of server_info.
+func matterAPIServerInfo() map[string]interface{} {
+	compressedFabricID, _ := strconv.ParseUint(appConfig.CompressedFabricID, 16, 64)
+	return map[string]interface{}{
+		"fabric_id":                    1,
+		"compressed_fabric_id":         compressedFabricID,
+		"schema_version":               matterAPISchemaVersion,
+		"min_supported_schema_version": matterAPIMinSchemaVersion,
+		"sdk_version":                  "matter-backend (" + controller.Name() + ")",
+		"wifi_credentials_set":         false,
+		"thread_credentials_set":       false,
+		"bluetooth_enabled":            false,
+	}
+}
+
+// matterAPINodes returns every registered node, bridged devices being endpoints of their bridge.
+func matterAPINodes() []map[string]interface{} {
+	nodes := []map[string]interface{}{}
+	for _, device := range deviceRegistry.List() {
+		if device.BridgeID == "" {
+			nodes = append(nodes, matterAPINode(device))
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i]["node_id"].(uint64) < nodes[j]["node_id"].(uint64) })
+	return nodes
+}
+
+// matterAPINode builds the python-matter-server node of a registered device: its attributes come
+// from the registry (identity, device types) and from the state cache, as "endpoint/cluster/attribute".
+func matterAPINode(device RegisteredDevice) map[string]interface{} {
+	node, _ := parseMatterNodeID(device.NodeID)
+	attributes := map[string]interface{}{}
+	deviceTypes := map[string][]uint32{}
+	if len(device.DeviceTypes) > 0 {
+		deviceTypes[device.EndpointID] = device.DeviceTypes
+	}
+	for _, endpoint := range device.Endpoints {
+		if len(endpoint.DeviceTypes) > 0 {
+			deviceTypes[endpoint.EndpointID] = endpoint.DeviceTypes
+		}
+	}
+	for _, other := range deviceRegistry.List() {
+		if other.BridgeID == device.ID && len(other.DeviceTypes) > 0 {
+			deviceTypes[other.EndpointID] = other.DeviceTypes
+		}
+	}
+	for endpoint, types := range deviceTypes {
+		list := make([]map[string]interface{}, 0, len(types))
+		for _, t := range types {
+			list = append(list, map[string]interface{}{"0": t, "1": 1}) // DeviceTypeStruct {deviceType, revision}
+		}
+		attributes[endpoint+"/29/0"] = list
+	}
+	if id, err := strconv.ParseUint(device.VendorID, 0, 16); err == nil {
+		attributes["0/40/2"] = id
+	}
+	if id, err := strconv.ParseUint(device.ProductID, 0, 16); err == nil {
+		attributes["0/40/4"] = id
+	}
+	if device.Name != "" {
+		attributes["0/40/5"] = device.Name
+	}
+	for _, state := range stateCache.NodeAttributes(device.NodeID) {
+		path, err := matterAttributePath(state.EndpointID, state.Cluster, state.Attribute)
+		if err != nil {
+			continue
+		}
+		if state.RawValue != nil {
+			attributes[path] = state.RawValue
+		} else {
+			attributes[path] = state.Value
+		}
+	}
+	return map[string]interface{}{
+		"node_id":                 node,
+		"date_commissioned":       device.CreatedAt.Format(time.RFC3339),
+		"last_interview":          device.UpdatedAt.Format(time.RFC3339),
+		"interview_version":       1,
+		"available":               device.Reachable && !device.Orphaned,
+		"is_bridge":               device.IsBridge,
+		"attributes":              attributes,
+		"attribute_subscriptions": []interface{}{},
+	}
+}
+
+// parseMatterAttributePath splits an "endpoint/cluster/attribute" path of IDs into the endpoint and
+// the chip-tool cluster and attribute names. Wildcards aren't supported.
+func parseMatterAttributePath(path string) (endpoint, cluster, attribute string, err error) {
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 {
+		return "", "", "", fmt.Errorf("invalid attribute path %q", path)
+	}
+	ids := make([]uint32, 3)
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return "", "", "", fmt.Errorf("invalid attribute path %q: wildcards are not supported", path)
+		}
+		ids[i] = uint32(n)
+	}
+	cluster, ok := matterClusterName(ids[1])
+	if !ok {
+		return "", "", "", fmt.Errorf("cluster %d is not supported", ids[1])
+	}
+	attribute, ok = matterAttributeName(cluster, ids[2])
+	if !ok {
+		return "", "", "", fmt.Errorf("attribute %d of cluster %d is not supported", ids[2], ids[1])
+	}
+	return parts[0], cluster, attribute, nil
+}
+
+var matterServerAPI = NewMatterServerAPI()
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// schemaFile records the schema version of the state files, relative to the data directory.
+const schemaFile = "schema.json"
+
+// schemaBackupDir holds the copies of the state files taken before migrating them, relative to
+// the data directory.
+const schemaBackupDir = "backups"
+
+// migration upgrades the state files from version-1 to version. Migrations only ever get
+// appended: a migration that shipped is never edited, since deployments may have applied it.
+// apply works on the files in the data directory, typically loading one with loadJSONFile into
+// generic values ([]map[string]interface{}), rewriting fields and saving it with saveJSONFile.
+type migration struct {
+	version int
+	name    string
+	apply   func() error
+}
+
+// migrations are the schema changes of the state files, in version order.
+var migrations = []migration{
+	{version: 1, name: "record the schema version of existing state files", apply: func() error { return nil }},
+}
+
+// latestSchemaVersion is the version the state files have once every migration ran.
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// AppliedMigration records a migration that ran on this data directory.
+type AppliedMigration struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	AppliedAt time.Time `json:"appliedAt"`
+	Backup    string    `json:"backup,omitempty"` // Copy of the state files taken before it ran
+}
+
+// SchemaState is the content of schema.json, also shown by GET /api/status.
+type SchemaState struct {
+	Version int                `json:"version"`
+	Latest  int                `json:"latest,omitempty"` // Version of this build, in GET /api/status
+	Applied []AppliedMigration `json:"applied,omitempty"`
+}
+
+// schemaState is the schema of the data directory, set by runSchemaMigrations at startup.
+var schemaState SchemaState
+
+// schemaStatus returns the schema version of the data directory and the migrations applied to it.
+func schemaStatus() SchemaState {
+	state := schemaState
+	state.Latest = latestSchemaVersion()
+	return state
+}
+
+// stateFileNames lists the JSON state files of the data directory, schema.json excluded.
+func stateFileNames() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dataFilePath("."), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, match := range matches {
+		if name := filepath.Base(match); name != schemaFile {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// copyStateFiles copies the named files from one directory to another.
+func copyStateFiles(names []string, from, to string) error {
+	if err := os.MkdirAll(to, 0o755); err != nil {
+		return err
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(from, name))
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(to, name), data, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runSchemaMigrations brings the state files to the latest schema version before any store
+// loads them. Each pending migration runs after a copy of the state files is saved under
+// backups/, and is recorded in schema.json once it succeeded. A failed migration puts the copy
+// back and stops the backend, as do state files written by a newer version: both would otherwise
+// be loaded wrongly and saved over.
+func runSchemaMigrations() {
+	var state SchemaState
+	if err := loadJSONFile(schemaFile, &state); err != nil {
+		log.Fatalf("Could not read %s: %v", schemaFile, err)
+	}
+	latest := latestSchemaVersion()
+	if state.Version > latest {
+		log.Fatalf("The state files in %s have schema version %d, newer than this build's %d. Run a newer version of the backend, or restore a backup from %s.",
+			dataFilePath("."), state.Version, latest, dataFilePath(schemaBackupDir))
+	}
+	names, err := stateFileNames()
+	if err != nil {
+		log.Fatalf("Could not list the state files: %v", err)
+	}
+	if state.Version == 0 && len(names) == 0 {
+		state.Version = latest // A new data directory starts at the latest schema
+	}
+	for _, m := range migrations {
+		if m.version <= state.Version {
+			continue
+		}
+		backup := filepath.Join(schemaBackupDir, fmt.Sprintf("schema-v%d-%s", state.Version, time.Now().Format("20060102-150405")))
+		if err := copyStateFiles(names, dataFilePath("."), dataFilePath(backup)); err != nil {
+			log.Fatalf("Could not back up the state files before schema migration %d: %v", m.version, err)
+		}
+		log.Printf("Migrating the state files to schema version %d: %s (backup in %s)", m.version, m.name, dataFilePath(backup))
+		if err := m.apply(); err != nil {
+			if restoreErr := copyStateFiles(names, dataFilePath(backup), dataFilePath(".")); restoreErr != nil {
+				log.Printf("Could not restore the state files from %s: %v", dataFilePath(backup), restoreErr)
+			}
+			log.Fatalf("Schema migration %d (%s) failed, state files restored from %s: %v", m.version, m.name, dataFilePath(backup), err)
+		}
+		state.Version = m.version
+		state.Applied = append(state.Applied, AppliedMigration{Version: m.version, Name: m.name, AppliedAt: time.Now(), Backup: backup})
+		if err := saveJSONFile(schemaFile, state); err != nil {
+			log.Fatalf("Could not record schema version %d: %v", m.version, err)
+		}
+	}
+	if err := saveJSONFile(schemaFile, state); err != nil {
+		log.Printf("WARNING: could not save %s: %v", schemaFile, err)
+	}
+	schemaState = state
+	log.Printf("State files at schema version %d (%d state file(s))", state.Version, len(names))
+}
@@ -1,16 +1,29 @@
 package main
 
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
 // ClientMessage represents a message received from the WebSocket client (Vue frontend)
 type ClientMessage struct {
 	Type    string      `json:"type"`              // e.g., "discover_devices", "commission_device", "device_command"
-	Payload interface{} `json:"payload,omitempty"` // Flexible payload based on message type
+	Payload json.RawMessage `json:"payload,omitempty"` // Decoded by the handler of the message type (see decode.go)
+	RequestID string    `json:"requestId,omitempty"` // Optional, echoed in the responses to this message
+	Trace     bool      `json:"trace,omitempty"`     // Record the request in a trace bundle (see tracing.go); needs a requestId
+	Debug     bool      `json:"debug,omitempty"`     // Run chip-tool verbosely for this request (see chiptoollog.go)
+	LogCategories []string `json:"logCategories,omitempty"` // chip-tool log categories forwarded to the client, e.g. ["DIS", "DMG"]
+	Capture   bool      `json:"capture,omitempty"`   // Capture the target device's packets while the request runs (see capture.go); admin only, needs a requestId
 }
 
-// ServerMessage represents a message sent to the WebSocket client (Vue frontend)
+// ServerMessage represents a message sent to the WebSocket client (Vue frontend) in the legacy shape.
+// Clients that don't ask for it get an Envelope instead (see envelope.go).
 type ServerMessage struct {
 	Type    string      `json:"type"`              // e.g., "discovery_result", "commissioning_status", "attribute_update", "log"
 	Payload interface{} `json:"payload,omitempty"` // Flexible payload
 	Data    interface{} `json:"data,omitempty"`    // Alternative field for payload, matching frontend's internal_log/error
+	RequestID string    `json:"requestId,omitempty"` // requestId of the client message this responds to
 }
 
 // DiscoveredDevice represents information about a device found during discovery
@@ -19,7 +32,11 @@ type DiscoveredDevice struct {
     ID                              string `json:"id"`                       // Unique identifier for the frontend
     Name                            string `json:"name,omitempty"`           // Name of the device (often maps to Hostname)
     Type                            string `json:"type,omitempty"`           // e.g., "BLE", "OnNetwork (DNS-SD)" derived from CommissioningMode
-    IPAddress                       string `json:"ipAddress,omitempty"`      // IP Address #1
+    IPAddress                       string `json:"ipAddress,omitempty"`      // Best address for direct interactions (see addressing.go)
+    Addresses                       []string `json:"addresses,omitempty"`  // Every advertised address, link-local ones with their zone (fe80::1%eth0)
+    AddressInfo                     []AddressInfo `json:"addressInfo,omitempty"` // Family, scope and reachability of each entry of Addresses
+    InterfaceID                     string `json:"interfaceId,omitempty"`    // Interface the device was discovered on
+    Interface                       string `json:"interface,omitempty"`      // Name of that interface, or of the one its addresses are reachable through
     Port                            int    `json:"port,omitempty"`           // Port
     MrpIntervalIdle                 string `json:"mrpIntervalIdle,omitempty"`    // Mrp Interval idle (e.g., "not present")
     MrpIntervalActive               string `json:"mrpIntervalActive,omitempty"`  // Mrp Interval active (e.g., "not present")
@@ -28,6 +45,7 @@ type DiscoveredDevice struct {
     TCPServerSupported              bool   `json:"tcpServerSupported,omitempty"` // TCP Server Supported (0 or 1, converted to bool)
     ICD                             string `json:"icd,omitempty"`                // ICD (e.g., "not present")
     Discriminator                   string `json:"discriminator"`            // Long Discriminator
+    ShortDiscriminator              string `json:"shortDiscriminator,omitempty"` // When the build prints it, or only it
     VendorID                        string `json:"vendorId,omitempty"`       // Vendor ID
     ProductID                       string `json:"productId,omitempty"`      // Product ID
     NodeID                          string `json:"nodeId,omitempty"`         // Assigned Matter Node ID after commissioning (can be string or int)
@@ -37,6 +55,9 @@ type DiscoveredDevice struct {
     CommissioningMode               uint8  `json:"commissioningMode,omitempty"` // Commissioning mode
     InstanceName                    string `json:"instanceName,omitempty"` // Instance name (often from DNS-SD)
     SupportsCommissionerGeneratedPasscode bool `json:"supportsCommissionerGeneratedPasscode,omitempty"` // Supports Commissioner Generated Passcode
+    CommissioningWindow *CommissioningWindowStatus `json:"commissioningWindow,omitempty"` // Whether the window looks open, from the CM field (see commwindow.go)
+    PairingState string `json:"pairingState,omitempty"` // "new", "commissioned_here" or "commissioned_other_fabric" (see operational.go)
+    CommissionedNodeID string `json:"commissionedNodeId,omitempty"` // Our node ID, for devices commissioned by this gateway
 }
 
 // CommissionDevicePayload is the expected structure for "commission_device" message from client
@@ -44,7 +65,10 @@ type CommissionDevicePayload struct {
 	SetupCode                             string `json:"setupCode"`
     Hostname                              string `json:"hostname"`
     IPAddress                             string `json:"ipAddress"`
+    Addresses                             []string `json:"addresses,omitempty"` // Every advertised address; pairing falls back to them when mDNS resolution fails
     Port                                  string `json:"port"` 
+    Interface                             string `json:"interface,omitempty"`   // Only pair through this network interface; defaults to the one the device was discovered on
+    PairingMode                           string `json:"pairingMode,omitempty"` // "mdns" (default) or "address" to pair straight to ipAddress/addresses and port
     MrpIntervalIdle                       string `json:"mrpIntervalIdle,omitempty"`    // Using string as "not present" is a value
     MrpIntervalActive                     string `json:"mrpIntervalActive,omitempty"`  // Using string as "not present" is a value
     MrpActiveThreshold                    string `json:"mrpActiveThreshold,omitempty"` // Using string as "not present" is a value
@@ -54,24 +78,67 @@ type CommissionDevicePayload struct {
     VendorID                              string `json:"vendorId"`
     ProductID                             string `json:"productId"`
     LongDiscriminator                     string `json:"discriminator"`
+    ShortDiscriminator                    string `json:"shortDiscriminator,omitempty"` // 4-bit discriminator, e.g. from a manual pairing code; pairs with onnetwork-short
     PairingHint                           string `json:"pairingHint"`
     InstanceName                          string `json:"instanceName"`
     CommissioningMode                     string `json:"commissioningMode"`
     NodeID                                string `json:"nodeid"`
+    NodeIDToAssign                        string `json:"nodeIdToAssign,omitempty"` // Sent by the wizard; the backend picks the node ID itself
     EndpointId                            string `json:"endpointid"`
     SupportsCommissionerGeneratedPasscode string `json:"supportsCommissionerGeneratedPasscode"`
+    Name                                  string `json:"name,omitempty"`     // Friendly name, written to BasicInformation.NodeLabel after pairing
+    Room                                  string `json:"room,omitempty"`     // Room assignment, stored in the device registry
+    Location                              string `json:"location,omitempty"` // ISO 3166-1 alpha-2 country code for BasicInformation.Location
+    Force                                 bool   `json:"force,omitempty"`    // Commission even if the device looks already commissioned by this gateway
+    StorageDirectory                      string `json:"storageDirectory,omitempty"` // chip-tool --storage-directory, from the chipToolIdentities allowlist
+    CommissionerName                      string `json:"commissionerName,omitempty"` // chip-tool --commissioner-name, from the chipToolIdentities allowlist
+}
+
+// Validate implements Validator.
+func (p CommissionDevicePayload) Validate() error {
+	verr := &ValidationError{}
+	if err := normalizeCommissioningPayload(&p); err != nil {
+		verr.Fields = append(verr.Fields, err.(*ValidationError).Fields...)
+	}
+	if p.PairingMode != "" && p.PairingMode != pairingModeMDNS && p.PairingMode != pairingModeAddress {
+		verr.add("pairingMode", "must be \"mdns\" or \"address\"")
+	}
+	if port, err := strconv.Atoi(p.Port); p.Port != "" && (err != nil || port <= 0 || port > 65535) {
+		verr.add("port", "must be a port number")
+	}
+	if p.Interface != "" {
+		if err := validateInterfaceNames("interface", []string{p.Interface}); err != nil {
+			verr.Fields = append(verr.Fields, err.(*ValidationError).Fields...)
+		}
+	}
+	if err := validateChipToolIdentity(p.StorageDirectory, p.CommissionerName); err != nil {
+		verr.Fields = append(verr.Fields, err.(*ValidationError).Fields...)
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
 }
 
 // DeviceCommandPayload is the expected structure for "device_command" message from client
 type DeviceCommandPayload struct {
 	NodeID  string                 `json:"nodeId"`  // Node ID of the device to control
+	DeviceID string                `json:"deviceId,omitempty"` // Registry device ID; when set, overrides nodeId/endpointId (used for bridged devices)
 	Cluster string                 `json:"cluster"` // e.g., "OnOff", "LevelControl"
 	Command string                 `json:"command"` // e.g., "On", "Off", "MoveToLevel"
 	Params  map[string]interface{} `json:"params,omitempty"` // Command-specific parameters
+	StorageDirectory string        `json:"storageDirectory,omitempty"` // chip-tool --storage-directory, from the chipToolIdentities allowlist
+	CommissionerName string        `json:"commissionerName,omitempty"` // chip-tool --commissioner-name, from the chipToolIdentities allowlist
+	Force            bool          `json:"force,omitempty"`            // Send the command even if the cached state says it changes nothing (see commandstate.go)
+}
+
+// Validate implements Validator.
+func (p DeviceCommandPayload) Validate() error {
+	return validateChipToolIdentity(p.StorageDirectory, p.CommissionerName)
 }
 
 type GetStatusPayload struct {
-    NodeID  string                 `json:"nodeId"`  // Node ID of the device to control
+    NodeID  string                 `json:"nodeId" validate:"required"`  // Node ID of the device to control
     EndpointId                     string `json:"endpointId"`
 }
 
@@ -84,6 +151,8 @@ type CommissioningStatusPayload struct {
 	OriginalDiscriminator          string `json:"originalDiscriminator,omitempty"` // Helps frontend map back
     EndpointId                     string `json:"endpointId,omitempty"`
 	DiscriminatorAssociatedWithRequest string `json:"discriminatorAssociatedWithRequest,omitempty"` // From client request
+	Code                           string `json:"code,omitempty"` // Recognized failure, e.g. "wrong_passcode" (see commissioningfailure.go)
+	Hint                           string `json:"hint,omitempty"` // What to do about it
 }
 
 // AttributeUpdatePayload is sent to the client when a device attribute changes
@@ -92,7 +161,12 @@ type AttributeUpdatePayload struct {
 	EndpointID string      `json:"endpointId,omitempty"` // Typically "1" for simple devices
 	Cluster    string      `json:"cluster"`
 	Attribute  string      `json:"attribute"`
-	Value      interface{} `json:"value"`
+	Value      interface{} `json:"value"` // Normalised to Unit for known attributes (see transform.go)
+	RawValue   interface{} `json:"rawValue,omitempty"` // Value as reported by the device, when Value was converted
+	Unit       string      `json:"unit,omitempty"`
+	Display    string      `json:"display,omitempty"` // Value formatted with the client's unit preferences (see units.go)
+	Reading    *SensorReading `json:"reading,omitempty"` // Typed reading for known sensor clusters (see sensors.go)
+	Source     string      `json:"source,omitempty"` // "subscription" for reports, "poll" for values read by a polling profile (see poller.go)
 }
 
 // CommandResponsePayload is sent to the client after a device command attempt
@@ -101,6 +175,8 @@ type CommandResponsePayload struct {
 	NodeID  string `json:"nodeId,omitempty"`
 	Details string `json:"details,omitempty"`
 	Error   string `json:"error,omitempty"`
+	Skipped bool   `json:"skipped,omitempty"` // Not sent: the device already is in the requested state
+	Code    string `json:"code,omitempty"`    // Error code when the command wasn't sent, e.g. "unsupported_feature"
 }
 
 type StatusResponsePayload struct {
@@ -111,8 +187,204 @@ type StatusResponsePayload struct {
 	Error   string `json:"error,omitempty"`
 }
 
+// DiscoverDevicesPayload is the optional payload of "discover_devices".
+type DiscoverDevicesPayload struct {
+	Interfaces []string `json:"interfaces,omitempty"` // Only keep devices seen on these interfaces; overrides discoveryInterfaces
+}
+
+// Validate implements Validator.
+func (p DiscoverDevicesPayload) Validate() error {
+	return validateInterfaceNames("interfaces", p.Interfaces)
+}
+
 // DiscoveryResultPayload is sent to the client after a device discovery scan
 type DiscoveryResultPayload struct {
 	Devices []DiscoveredDevice `json:"devices"`
+	Interfaces []string         `json:"interfaces,omitempty"` // Interfaces the results were limited to
+	Error   string             `json:"error,omitempty"`
+}
+
+// SubscribeSensorBundlePayload is the expected structure for "subscribe_sensor_bundle" message from client
+type SubscribeSensorBundlePayload struct {
+	NodeID     string `json:"nodeId" validate:"required"`
+	EndpointID string `json:"endpointId"`
+	Bundle     string `json:"bundle" validate:"required"` // e.g., "air_quality"
+}
+
+// SensorReadingsPayload is sent to the client in response to "get_sensor_readings"
+type SensorReadingsPayload struct {
+	NodeID   string           `json:"nodeId"`
+	Readings []AttributeState `json:"readings"`
+}
+
+// AttributeHistoryRequestPayload is the expected structure for "get_attribute_history" message from client
+type AttributeHistoryRequestPayload struct {
+	NodeID     string `json:"nodeId" validate:"required"`
+	EndpointID string `json:"endpointId"`
+	Cluster    string `json:"cluster" validate:"required"`
+	Attribute  string `json:"attribute" validate:"required"`
+	Limit      int    `json:"limit,omitempty"` // Latest N samples, 0 for everything kept
+}
+
+// AttributeHistoryPayload is sent to the client in response to "get_attribute_history"
+type AttributeHistoryPayload struct {
+	NodeID     string         `json:"nodeId"`
+	EndpointID string         `json:"endpointId"`
+	Cluster    string         `json:"cluster"`
+	Attribute  string         `json:"attribute"`
+	Unit       string         `json:"unit,omitempty"` // Unit of the points' values, after the client's unit preferences
+	Points     []HistoryPoint `json:"points"`
+}
+
+// ButtonEventPayload is sent to the client when a Switch cluster event (button press) is reported
+type ButtonEventPayload struct {
+	NodeID     string    `json:"nodeId"`
+	EndpointID string    `json:"endpointId"`
+	Event      string    `json:"event"`                // "initial_press", "long_press", "short_release", "long_release", "multi_press_complete"
+	Position   int       `json:"position,omitempty"`   // Switch position reported by the event
+	PressCount int       `json:"pressCount,omitempty"` // TotalNumberOfPressesCounted for multi_press_complete
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// RuleIDPayload is the expected structure for messages addressing a single rule (e.g. "delete_rule")
+type RuleIDPayload struct {
+	ID string `json:"id" validate:"required"`
+}
+
+// RulesListPayload is sent to the client in response to "list_rules"
+type RulesListPayload struct {
+	Rules []Rule `json:"rules"`
+}
+
+// DeviceListPayload is sent to the client in response to "list_devices"
+type DeviceListPayload struct {
+	Devices []RegisteredDevice `json:"devices"`
+}
+
+// BridgedDevicesPayload is sent to the client after the bridged endpoints of a bridge were enumerated
+type BridgedDevicesPayload struct {
+	NodeID  string             `json:"nodeId"` // Node ID of the bridge
+	Devices []RegisteredDevice `json:"devices"`
 	Error   string             `json:"error,omitempty"`
 }
+
+// DeviceEndpointsPayload is sent to the client with the endpoint composition (device types, semantic tags) of a node
+type DeviceEndpointsPayload struct {
+	NodeID    string         `json:"nodeId"`
+	Endpoints []EndpointInfo `json:"endpoints"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// ChangeWiFiNetworkPayload is the expected structure for "change_wifi_network" message from client
+type ChangeWiFiNetworkPayload struct {
+	NodeID     string `json:"nodeId" validate:"required"`
+	SSID       string `json:"ssid" validate:"required"`
+	Password   string `json:"password"`
+	Breadcrumb int    `json:"breadcrumb,omitempty"`
+}
+
+// NetworkChangeStatusPayload is sent to the client while/after moving a device to another Wi-Fi network
+type NetworkChangeStatusPayload struct {
+	NodeID  string `json:"nodeId"`
+	SSID    string `json:"ssid"`
+	Step    string `json:"step"` // Step that failed, or "done"
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// SetFavoritePayload is the expected structure for "set_favorite" message from client
+type SetFavoritePayload struct {
+	DeviceID string `json:"deviceId" validate:"required"`
+	Favorite bool   `json:"favorite"`
+}
+
+// DeviceHealthListPayload is sent to the client in response to "get_device_health"
+type DeviceHealthListPayload struct {
+	Devices []DeviceHealthReport `json:"devices"`
+}
+
+// PipelineTarget is the payload of a configured pipeline message: the device the steps run against
+type PipelineTarget struct {
+	NodeID     string `json:"nodeId" validate:"required"`
+	EndpointID string `json:"endpointId,omitempty"`
+}
+
+// PipelineStepResult is streamed to the client after each pipeline step, and once more with type "done"
+type PipelineStepResult struct {
+	Pipeline   string      `json:"pipeline"`
+	Step       int         `json:"step,omitempty"`
+	Type       string      `json:"type"`
+	NodeID     string      `json:"nodeId"`
+	Success    bool        `json:"success"`
+	Value      interface{} `json:"value,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	DurationMs float64     `json:"durationMs,omitempty"`
+}
+
+// AuthenticatePayload is the expected structure for "authenticate" message from client
+type AuthenticatePayload struct {
+	Token string `json:"token" validate:"required"`
+}
+
+// RemoveDevicePayload is the expected structure for "remove_device" message from client
+type RemoveDevicePayload struct {
+	DeviceID  string `json:"deviceId" validate:"required"`
+	LocalOnly bool   `json:"localOnly,omitempty"` // Skip unpairing, e.g. for a device that was factory reset
+}
+
+// DeviceRemovedPayload is broadcast to all clients after a device was removed
+type DeviceRemovedPayload struct {
+	DeviceID             string   `json:"deviceId"`
+	NodeID               string   `json:"nodeId"`
+	Unpaired             bool     `json:"unpaired"`                 // Node removed from the fabric
+	RemovedDevices       []string `json:"removedDevices,omitempty"` // Registry entries deleted (bridged devices included)
+	StoppedSubscriptions int      `json:"stoppedSubscriptions"`
+	DeletedRules         []string `json:"deletedRules,omitempty"`
+	ModifiedRules        []string `json:"modifiedRules,omitempty"` // Rules that lost actions targeting the device
+}
+
+// OperationalNode is an operational instance found by "discover_operational"
+type OperationalNode struct {
+	OperationalInstance
+	OurFabric bool   `json:"ourFabric"`
+	DeviceID  string `json:"deviceId,omitempty"` // Registry device advertised by this instance
+}
+
+// OperationalNodesPayload is sent to the client in response to "discover_operational"
+type OperationalNodesPayload struct {
+	CompressedFabricID string            `json:"compressedFabricId,omitempty"` // Our fabric, configured or inferred
+	Nodes              []OperationalNode `json:"nodes"`
+	Missing            []string          `json:"missing,omitempty"` // Registered nodes not advertising, now marked unreachable
+	Error              string            `json:"error,omitempty"`
+}
+
+// DiagnoseDevicePayload is the expected structure for "diagnose_device" message from client
+type DiagnoseDevicePayload struct {
+	DeviceID string `json:"deviceId" validate:"required"`
+}
+
+// JobIDPayload is the expected structure for messages addressing a single job (e.g. "cancel_job")
+type JobIDPayload struct {
+	JobID string `json:"jobId" validate:"required"`
+}
+
+// FabricNodePayload is the expected structure for "adopt_node", "unpair_node" and "inspect_certificates" messages from client
+type FabricNodePayload struct {
+	NodeID string `json:"nodeId" validate:"required"`
+}
+
+// DeviceIDPayload is the expected structure for messages addressing a single registry device (e.g. "delete_polling_profile")
+type DeviceIDPayload struct {
+	DeviceID string `json:"deviceId" validate:"required"`
+}
+
+// AlertRulesListPayload is sent to the client in response to "list_alert_rules"
+type AlertRulesListPayload struct {
+	Rules []AlertRule `json:"rules"`
+}
+
+// AlertsPayload is sent to the client in response to "list_alerts"
+type AlertsPayload struct {
+	Active  []Alert `json:"active"`
+	History []Alert `json:"history"`
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modeFile is where the current house mode is persisted, relative to the data directory.
+const modeFile = "mode.json"
+
+// House modes.
+const (
+	modeHome  = "home"
+	modeAway  = "away"
+	modeNight = "night"
+)
+
+// validHouseModes are the valid modes.
+var validHouseModes = []string{modeHome, modeAway, modeNight}
+
+const (
+	defaultAwayAfterMinutes = 30
+	modeCheckInterval       = time.Minute
+)
+
+// Sources of a mode change.
+const (
+	modeSourceManual    = "manual"
+	modeSourceOccupancy = "occupancy"
+)
+
+// HouseMode is the current mode of the house and how it was set.
+type HouseMode struct {
+	Mode   string    `json:"mode"`
+	Since  time.Time `json:"since"`
+	Source string    `json:"source"` // "manual" or "occupancy"
+}
+
+// ModeChangedPayload is broadcast as "mode_changed" on every transition.
+type ModeChangedPayload struct {
+	Mode     string    `json:"mode"`
+	Previous string    `json:"previous"`
+	Source   string    `json:"source"`
+	Since    time.Time `json:"since"`
+}
+
+// SetModePayload is the payload of "set_mode" and of PUT /api/mode.
+type SetModePayload struct {
+	Mode string `json:"mode" validate:"required"`
+}
+
+// Validate implements Validator.
+func (p SetModePayload) Validate() error {
+	if !containsString(validHouseModes, p.Mode) {
+		return &ValidationError{Fields: []FieldError{{Field: "mode", Message: "must be one of " + strings.Join(validHouseModes, ", ")}}}
+	}
+	return nil
+}
+
+// HouseModes keeps the house mode. It is set by clients, or derived from the occupancy sensors when
+// modes.fromOccupancy is enabled: away once no sensor saw anyone for modes.awayAfterMinutes, home
+// (or night, within the night hours) as soon as one does. A manual mode holds until the derived mode
+// changes, so setting "away" while the house is still occupied isn't undone a minute later.
+type HouseModes struct {
+	mu          sync.Mutex
+	current     HouseMode
+	occupied    map[string]bool // Occupancy by sensor (node/endpoint)
+	lastPresent time.Time       // Last time a sensor reported occupancy
+	lastDerived string
+	path        string
+}
+
+// NewHouseModes creates HouseModes persisting the mode to path. The house starts at home.
+func NewHouseModes(path string) *HouseModes {
+	return &HouseModes{current: HouseMode{Mode: modeHome, Since: time.Now(), Source: modeSourceManual}, occupied: make(map[string]bool), path: path}
+}
+
+// Load reads the persisted mode. A missing file is not an error.
+func (h *HouseModes) Load() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var mode HouseMode
+	if err := loadJSONFile(h.path, &mode); err != nil {
+		return err
+	}
+	if containsString(validHouseModes, mode.Mode) {
+		h.current = mode
+	}
+	return nil
+}
+
+// Current returns the current mode.
+func (h *HouseModes) Current() HouseMode {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.current
+}
+
+// Set changes the mode, broadcasting "mode_changed" when it differs from the current one.
+func (h *HouseModes) Set(mode, source string) (HouseMode, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.setLocked(mode, source)
+}
+
+func (h *HouseModes) setLocked(mode, source string) (HouseMode, error) {
+	if h.current.Mode == mode {
+		return h.current, nil
+	}
+	previous := h.current.Mode
+	h.current = HouseMode{Mode: mode, Since: time.Now(), Source: source}
+	log.Printf("House mode changed from %s to %s (%s)", previous, mode, source)
+	broadcastToClients("mode_changed", ModeChangedPayload{Mode: mode, Previous: previous, Source: source, Since: h.current.Since})
+	return h.current, saveJSONFile(h.path, h.current)
+}
+
+// inNightHours reports whether the local hour is within modes.nightFromHour-nightToHour.
+func inNightHours(now time.Time) bool {
+	from, to := appConfig.Modes.NightFromHour, appConfig.Modes.NightToHour
+	if from == to {
+		return false
+	}
+	hour := now.Hour()
+	if from < to {
+		return hour >= from && hour < to
+	}
+	return hour >= from || hour < to
+}
+
+// HandleAttributeUpdate tracks the OccupancySensing reports.
+func (h *HouseModes) HandleAttributeUpdate(update AttributeUpdatePayload, at time.Time) {
+	if !strings.EqualFold(update.Cluster, "OccupancySensing") || update.Attribute != "occupancy" {
+		return
+	}
+	occupied := false
+	switch v := update.Value.(type) {
+	case bool:
+		occupied = v
+	default:
+		if n, ok := toFloat(v); ok {
+			occupied = int64(n)&0x1 != 0 // Occupancy bitmap, bit 0 = occupied
+		}
+	}
+	h.mu.Lock()
+	h.occupied[update.NodeID+"/"+update.EndpointID] = occupied
+	if occupied {
+		h.lastPresent = at
+	}
+	h.mu.Unlock()
+	h.evaluate(at)
+}
+
+// evaluate derives the mode from the occupancy sensors and applies it when the derived mode changed.
+func (h *HouseModes) evaluate(now time.Time) {
+	if !appConfig.Modes.FromOccupancy {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.occupied) == 0 {
+		return // No occupancy sensor reported yet
+	}
+	awayAfter := time.Duration(defaultAwayAfterMinutes) * time.Minute
+	if appConfig.Modes.AwayAfterMinutes > 0 {
+		awayAfter = time.Duration(appConfig.Modes.AwayAfterMinutes) * time.Minute
+	}
+	present := now.Sub(h.lastPresent) < awayAfter
+	for _, occupied := range h.occupied {
+		present = present || occupied
+	}
+	derived := modeAway
+	if present {
+		derived = modeHome
+		if inNightHours(now) {
+			derived = modeNight
+		}
+	}
+	if derived == h.lastDerived {
+		return
+	}
+	h.lastDerived = derived
+	if _, err := h.setLocked(derived, modeSourceOccupancy); err != nil {
+		log.Printf("Could not save the house mode: %v", err)
+	}
+}
+
+// Run re-evaluates the derived mode periodically, for the away delay and the night hours.
+func (h *HouseModes) Run() {
+	ticker := time.NewTicker(modeCheckInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		h.evaluate(now)
+	}
+}
+
+func handleGetMode(client *Client) {
+	client.sendPayload("mode", houseModes.Current())
+}
+
+func handleSetMode(client *Client, payload SetModePayload) {
+	mode, err := houseModes.Set(payload.Mode, modeSourceManual)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "set_mode failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("mode", mode)
+}
+
+// matchesMode reports whether a rule may run in the current mode: rules without modes run in any.
+func matchesMode(modes []string) bool {
+	return len(modes) == 0 || containsString(modes, houseModes.Current().Mode)
+}
+
+// validateRuleModes checks the modes a rule refers to.
+func validateRuleModes(rule Rule) error {
+	for _, mode := range rule.Modes {
+		if !containsString(validHouseModes, mode) {
+			return fmt.Errorf("unknown mode %q in rule modes", mode)
+		}
+	}
+	if rule.Trigger.Type == "mode_changed" && rule.Trigger.Mode != "" && !containsString(validHouseModes, rule.Trigger.Mode) {
+		return fmt.Errorf("unknown mode %q in rule trigger", rule.Trigger.Mode)
+	}
+	return nil
+}
+
+var houseModes = NewHouseModes(modeFile)
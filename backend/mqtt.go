@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT defaults, used when the config doesn't set them.
+const (
+	defaultMQTTTopicPrefix = "matter"
+	defaultMQTTClientID    = "matter-backend"
+	mqttKeepAlive          = 60 * time.Second
+	mqttDialTimeout        = 10 * time.Second
+	mqttAckTimeout         = 10 * time.Second
+)
+
+// mqttPublisher is a minimal MQTT 3.1.1 client: it only publishes, at QoS 1 so the journal knows
+// the broker got each message, and reconnects lazily when a publish finds the connection gone.
+// That is all the event sink needs.
+type mqttPublisher struct {
+	mu       sync.Mutex
+	cfg      MQTTConfig
+	conn     net.Conn
+	lastPing time.Time
+	packetID uint16
+	acks     chan uint16   // Packet IDs of the PUBACKs received on conn
+	closed   chan struct{} // Closed when conn is gone
+}
+
+// mqttString encodes a UTF-8 string as an MQTT length-prefixed string.
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// mqttPacket builds a packet from its fixed header byte and its body, encoding the remaining length.
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// connect opens the broker connection and waits for its CONNACK. Callers must hold p.mu.
+func (p *mqttPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.cfg.Broker, mqttDialTimeout)
+	if err != nil {
+		return err
+	}
+	clientID := p.cfg.ClientID
+	if clientID == "" {
+		clientID = defaultMQTTClientID
+	}
+	flags := byte(0x02) // Clean session
+	payload := mqttString(clientID)
+	if p.cfg.Username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(p.cfg.Username)...)
+		if p.cfg.Password != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(p.cfg.Password)...)
+		}
+	}
+	body := append(mqttString("MQTT"), 4, flags, byte(int(mqttKeepAlive.Seconds())>>8), byte(int(mqttKeepAlive.Seconds())))
+	body = append(body, payload...)
+	_ = conn.SetDeadline(time.Now().Add(mqttDialTimeout))
+	if _, err := conn.Write(mqttPacket(0x10, body)); err != nil {
+		conn.Close()
+		return err
+	}
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		conn.Close()
+		return fmt.Errorf("reading CONNACK: %w", err)
+	}
+	if ack[0] != 0x20 || ack[3] != 0 {
+		conn.Close()
+		return fmt.Errorf("broker refused the connection (return code %d)", ack[3])
+	}
+	_ = conn.SetDeadline(time.Time{})
+	p.conn, p.lastPing = conn, time.Now()
+	p.acks, p.closed = make(chan uint16, 16), make(chan struct{})
+	go p.drain(conn, p.acks, p.closed)
+	log.Printf("MQTT: connected to %s as %s", p.cfg.Broker, clientID)
+	return nil
+}
+
+// drain reads what the broker sends, passing on the PUBACKs and discarding the rest (PINGRESPs),
+// so its writes never block, and notices a closed connection.
+func (p *mqttPublisher) drain(conn net.Conn, acks chan<- uint16, closed chan struct{}) {
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+		length, multiplier := 0, 1
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				break
+			}
+			length += int(b&0x7f) * multiplier
+			multiplier *= 128
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			break
+		}
+		if header>>4 == 4 && length >= 2 { // PUBACK
+			select {
+			case acks <- uint16(body[0])<<8 | uint16(body[1]):
+			default:
+			}
+		}
+	}
+	close(closed)
+	p.mu.Lock()
+	if p.conn == conn {
+		p.conn = nil
+	}
+	p.mu.Unlock()
+	conn.Close()
+}
+
+// Publish sends a message to topic, connecting first if needed, and waits for the broker's PUBACK.
+func (p *mqttPublisher) Publish(topic string, message []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	p.packetID++
+	if p.packetID == 0 {
+		p.packetID = 1
+	}
+	id := p.packetID
+	header := byte(0x32) // PUBLISH, QoS 1
+	if p.cfg.Retain {
+		header |= 0x01
+	}
+	body := append(mqttString(topic), byte(id>>8), byte(id))
+	if err := p.write(mqttPacket(header, append(body, message...))); err != nil {
+		return err
+	}
+	acks, closed := p.acks, p.closed
+	timeout := time.NewTimer(mqttAckTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case acked := <-acks:
+			if acked == id {
+				return nil
+			}
+		case <-closed:
+			return errors.New("connection closed before the PUBACK")
+		case <-timeout.C:
+			p.conn.Close() // The broker is unresponsive; the next publish reconnects
+			p.conn = nil
+			return errors.New("no PUBACK from the broker")
+		}
+	}
+}
+
+// write sends a packet, pinging the broker first when the keep-alive is due. Callers must hold p.mu.
+func (p *mqttPublisher) write(packet []byte) error {
+	if p.conn == nil {
+		return errors.New("not connected")
+	}
+	_ = p.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if time.Since(p.lastPing) > mqttKeepAlive/2 {
+		if _, err := p.conn.Write([]byte{0xC0, 0}); err != nil {
+			p.conn.Close()
+			p.conn = nil
+			return err
+		}
+		p.lastPing = time.Now()
+	}
+	if _, err := p.conn.Write(packet); err != nil {
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+// mqttTopic returns the topic an event is published on: <prefix>/<type>, followed by the node and
+// endpoint for device events, e.g. "matter/alert_raised/12/1".
+func mqttTopic(prefix string, event Event) string {
+	parts := []string{prefix, event.Type}
+	data, _ := json.Marshal(event.Payload)
+	var target struct {
+		NodeID     string `json:"nodeId"`
+		EndpointID string `json:"endpointId"`
+	}
+	if json.Unmarshal(data, &target) == nil && target.NodeID != "" {
+		parts = append(parts, target.NodeID)
+		if target.EndpointID != "" {
+			parts = append(parts, target.EndpointID)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// mqttSink is the MQTT sink in use, replaced by applyMQTT on a config reload.
+var mqttSink struct {
+	mu        sync.Mutex
+	cfg       MQTTConfig
+	publisher *mqttPublisher
+	journal   *EventJournal // Nil when no broker is configured
+}
+
+// startMQTT subscribes the MQTT sink to the event bus, for the message types listed in the config.
+func startMQTT() {
+	applyMQTT(appConfig.MQTT)
+	eventBus.Subscribe("mqtt", func(event Event) {
+		mqttSink.mu.Lock()
+		defer mqttSink.mu.Unlock()
+		if mqttSink.journal != nil && containsString(mqttSink.cfg.Types, event.Type) && featureFlags.Enabled(featureMQTTBridge) {
+			mqttSink.journal.Append(event)
+		}
+	})
+}
+
+// applyMQTT switches the MQTT sink to cfg when it changed: the previous connection and journal
+// stop, and the journal of the new broker takes over.
+func applyMQTT(cfg MQTTConfig) {
+	mqttSink.mu.Lock()
+	defer mqttSink.mu.Unlock()
+	if mqttSink.journal != nil {
+		if reflect.DeepEqual(cfg, mqttSink.cfg) {
+			return
+		}
+		mqttSink.journal.Stop()
+		mqttSink.publisher.Close()
+		mqttSink.journal, mqttSink.publisher = nil, nil
+		log.Printf("MQTT broker %s no longer used", mqttSink.cfg.Broker)
+	}
+	mqttSink.cfg = cfg
+	if cfg.Broker == "" {
+		return
+	}
+	if len(cfg.Types) == 0 {
+		log.Printf("MQTT broker %s ignored: types is required", cfg.Broker)
+		return
+	}
+	prefix := cfg.TopicPrefix
+	if prefix == "" {
+		prefix = defaultMQTTTopicPrefix
+	}
+	publisher := &mqttPublisher{cfg: cfg}
+	mqttSink.publisher = publisher
+	mqttSink.journal = startJournal(journalName("mqtt", cfg.Broker), func(event Event) error {
+		message, err := json.Marshal(WebhookPayload{Type: event.Type, Data: event.Payload, Timestamp: event.Time})
+		if err != nil {
+			return err
+		}
+		return publisher.Publish(mqttTopic(prefix, event), message)
+	})
+	log.Printf("MQTT broker %s receives %v under %s/", cfg.Broker, cfg.Types, prefix)
+}
+
+// Close closes the broker connection, if any.
+func (p *mqttPublisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
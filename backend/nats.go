@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultNATSPort is used when the NATS URL has no port.
+const defaultNATSPort = "4222"
+
+// natsInfo is the part of the server's INFO the publisher uses.
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	MaxPayload  int  `json:"max_payload"`
+}
+
+// natsConnect is the CONNECT sent after the server's INFO.
+type natsConnect struct {
+	Verbose     bool   `json:"verbose"`
+	Pedantic    bool   `json:"pedantic"`
+	TLSRequired bool   `json:"tls_required"`
+	Name        string `json:"name"`
+	Lang        string `json:"lang"`
+	Version     string `json:"version"`
+	Protocol    int    `json:"protocol"`
+	User        string `json:"user,omitempty"`
+	Pass        string `json:"pass,omitempty"`
+	AuthToken   string `json:"auth_token,omitempty"`
+}
+
+// natsPublisher is a minimal NATS client: it only publishes. Core NATS doesn't acknowledge
+// messages, so each one is followed by a PING: the PONG tells the server processed it, and an
+// -ERR (e.g. a permissions violation) fails the publish. Like the MQTT publisher, it reconnects
+// lazily when a publish finds the connection gone.
+type natsPublisher struct {
+	mu         sync.Mutex
+	cfg        NATSConfig
+	server     *url.URL
+	conn       net.Conn
+	writeMu    sync.Mutex // Serializes the writes of Publish and of the PONGs answering the server
+	maxPayload int
+	pongs      chan struct{}
+	errs       chan error    // -ERR lines of the server
+	closed     chan struct{} // Closed when conn is gone
+}
+
+// newNATSPublisher checks the NATS settings and creates their publisher, not connected yet.
+func newNATSPublisher(cfg NATSConfig) (*natsPublisher, error) {
+	server, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if server.Scheme != "nats" && server.Scheme != "tls" {
+		return nil, fmt.Errorf("unsupported scheme %q, use nats:// or tls://", server.Scheme)
+	}
+	if server.Hostname() == "" {
+		return nil, errors.New("the URL has no host")
+	}
+	return &natsPublisher{cfg: cfg, server: server}, nil
+}
+
+// connect opens the server connection, upgrading it to TLS when asked or required, and waits for
+// the PONG of its first PING, which confirms the CONNECT was accepted. Callers must hold p.mu.
+func (p *natsPublisher) connect() error {
+	address := p.server.Host
+	if p.server.Port() == "" {
+		address = net.JoinHostPort(p.server.Hostname(), defaultNATSPort)
+	}
+	conn, err := net.DialTimeout("tcp", address, brokerDialTimeout)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(brokerDialTimeout))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("reading INFO: %w", err)
+	}
+	info := natsInfo{}
+	if rest, ok := strings.CutPrefix(strings.TrimSpace(line), "INFO "); !ok || json.Unmarshal([]byte(rest), &info) != nil {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+	secure := p.server.Scheme == "tls" || info.TLSRequired
+	if secure {
+		tlsConfig, err := brokerTLSConfig(p.cfg.TLS, p.server.Hostname())
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return fmt.Errorf("TLS handshake: %w", err)
+		}
+		conn, r = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	connect := natsConnect{TLSRequired: secure, Name: defaultMQTTClientID, Lang: "go", Version: "1.0", Protocol: 1,
+		User: p.cfg.Username, Pass: p.cfg.Password, AuthToken: p.cfg.Token}
+	if user := p.server.User; user != nil && connect.User == "" && connect.AuthToken == "" {
+		if password, ok := user.Password(); ok {
+			connect.User, connect.Pass = user.Username(), password
+		} else {
+			connect.AuthToken = user.Username()
+		}
+	}
+	data, _ := json.Marshal(connect)
+	if _, err := conn.Write([]byte("CONNECT " + string(data) + "\r\nPING\r\n")); err != nil {
+		conn.Close()
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("waiting for the server to accept the connection: %w", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if reason, ok := strings.CutPrefix(line, "-ERR "); ok {
+			conn.Close()
+			return fmt.Errorf("server refused the connection: %s", strings.Trim(reason, "'"))
+		}
+	}
+	_ = conn.SetDeadline(time.Time{})
+	p.conn, p.maxPayload = conn, info.MaxPayload
+	p.pongs, p.errs, p.closed = make(chan struct{}, 16), make(chan error, 16), make(chan struct{})
+	go p.drain(conn, r, p.pongs, p.errs, p.closed)
+	log.Printf("NATS: connected to %s", redactedURL(p.cfg.URL))
+	return nil
+}
+
+// drain reads what the server sends: it answers its PINGs, passes on the PONGs and -ERRs, and
+// notices a closed connection.
+func (p *natsPublisher) drain(conn net.Conn, r *bufio.Reader, pongs chan<- struct{}, errs chan<- error, closed chan struct{}) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			p.writeMu.Lock()
+			_, _ = conn.Write([]byte("PONG\r\n"))
+			p.writeMu.Unlock()
+		case line == "PONG":
+			select {
+			case pongs <- struct{}{}:
+			default:
+			}
+		case strings.HasPrefix(line, "-ERR "):
+			select {
+			case errs <- fmt.Errorf("server error: %s", strings.Trim(strings.TrimPrefix(line, "-ERR "), "'")):
+			default:
+			}
+		}
+	}
+	close(closed)
+	p.mu.Lock()
+	if p.conn == conn {
+		p.conn = nil
+	}
+	p.mu.Unlock()
+	conn.Close()
+}
+
+// Publish sends a message to subject, connecting first if needed, and waits for the PONG that
+// follows it.
+func (p *natsPublisher) Publish(subject string, message []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	if p.maxPayload > 0 && len(message) > p.maxPayload {
+		return fmt.Errorf("message of %d bytes exceeds the server's max_payload of %d", len(message), p.maxPayload)
+	}
+	pongs, errs, closed := p.pongs, p.errs, p.closed
+	for len(pongs) > 0 {
+		<-pongs // Left over from a timed out publish
+	}
+	for len(errs) > 0 {
+		<-errs
+	}
+	packet := fmt.Appendf(nil, "PUB %s %d\r\n", subject, len(message))
+	packet = append(append(packet, message...), "\r\nPING\r\n"...)
+	p.writeMu.Lock()
+	_ = p.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	_, err := p.conn.Write(packet)
+	p.writeMu.Unlock()
+	if err != nil {
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	timeout := time.NewTimer(brokerAckTimeout)
+	defer timeout.Stop()
+	select {
+	case <-pongs:
+		select {
+		case err := <-errs: // Read before the PONG, so about the message
+			return err
+		default:
+			return nil
+		}
+	case err := <-errs:
+		return err
+	case <-closed:
+		return errors.New("connection closed before the PONG")
+	case <-timeout.C:
+		p.conn.Close() // The server is unresponsive; the next publish reconnects
+		p.conn = nil
+		return errors.New("no PONG from the server")
+	}
+}
+
+// Close closes the server connection, if any.
+func (p *natsPublisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// applyNATS switches the NATS sink to cfg when it changed.
+func applyNATS(cfg NATSConfig) {
+	natsSink.apply(cfg, cfg.URL, cfg.Types, cfg.Subject, func() (eventPublisher, error) {
+		return newNATSPublisher(cfg)
+	})
+}
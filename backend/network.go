@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// wifiChangeFailSafeSeconds is how long the fail-safe stays armed while the device moves to the new network.
+// If the device doesn't come back on the new network in time it reverts to its previous configuration.
+const wifiChangeFailSafeSeconds = "180"
+
+// reNetworkingStatus matches the NetworkingStatus field of NetworkConfigResponse/ConnectNetworkResponse.
+var reNetworkingStatus = regexp.MustCompile(`NetworkingStatus:\s*(\d+)`)
+
+// networkingStatuses maps NetworkCommissioningStatusEnum values to readable names.
+var networkingStatuses = map[int]string{
+	0:  "success",
+	1:  "out_of_range",
+	2:  "bounds_exceeded",
+	3:  "network_id_not_found",
+	4:  "duplicate_network_id",
+	5:  "network_not_found",
+	6:  "regulatory_error",
+	7:  "auth_failure",
+	8:  "unsupported_security",
+	9:  "other_connection_failure",
+	10: "ipv6_failed",
+	11: "ip_bind_failed",
+	12: "unknown_error",
+}
+
+// NetworkOverview is GET /api/v1/network: the interface of the Matter traffic and the health of the
+// networks the devices are on.
+type NetworkOverview struct {
+	Interface string              `json:"interface,omitempty"` // networkInterface, when set
+	Thread    ThreadNetworkStatus `json:"thread"`              // From the border router (see threadbr.go)
+	WiFi      *WifiScanReport     `json:"wifi,omitempty"`      // Last Wi-Fi scan, when one ran (see wifiscan.go)
+}
+
+// networkOverview gathers the network health. With ?refresh=true the border router is polled first.
+func networkOverview(refresh bool) NetworkOverview {
+	overview := NetworkOverview{Interface: appConfig.NetworkInterface}
+	if refresh && appConfig.ThreadBorderRouter.URL != "" {
+		overview.Thread = threadBorderRouter.Poll()
+	} else {
+		overview.Thread = threadBorderRouter.Status()
+	}
+	if report, ok := wifiScanner.Last(); ok {
+		overview.WiFi = &report
+	}
+	return overview
+}
+
+// hexOctetString encodes a value as a chip-tool octet string argument, so SSIDs and passphrases with
+// spaces or special characters are passed through unchanged.
+func hexOctetString(value string) string {
+	return "hex:" + hex.EncodeToString([]byte(value))
+}
+
+// networkCommissioningStep runs one NetworkCommissioning/GeneralCommissioning command on endpoint 0
+// and checks the NetworkingStatus in its response, when the command has one. The node and endpoint
+// go after the command's positional arguments and before its optional "--" ones, as chip-tool
+// parses them in that order.
+func networkCommissioningStep(nodeID string, args ...string) error {
+	positional := len(args)
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "--") {
+			positional = i
+			break
+		}
+	}
+	args = append(append(append([]string{}, args[:positional]...), nodeID, "0"), args[positional:]...)
+	stdout, stderr, err := runChipTool(args...)
+	if chipToolFailed(stdout, stderr, err) {
+		return fmt.Errorf("%s failed: %v %s", strings.Join(args[:2], " "), err, strings.TrimSpace(stderr))
+	}
+	if m := reNetworkingStatus.FindStringSubmatch(stdout); len(m) == 2 {
+		status, _ := strconv.Atoi(m[1])
+		if status != 0 {
+			name, ok := networkingStatuses[status]
+			if !ok {
+				name = fmt.Sprintf("status_%d", status)
+			}
+			return fmt.Errorf("%s returned NetworkingStatus %s", strings.Join(args[:2], " "), name)
+		}
+	}
+	return nil
+}
+
+// changeWiFiNetwork moves an already commissioned Wi-Fi device to another SSID without a factory reset:
+// arm the fail-safe, add the new credentials, connect to the new network and confirm with CommissioningComplete.
+func changeWiFiNetwork(client *Client, payload ChangeWiFiNetworkPayload) {
+	report := func(step string, err error) {
+		status := NetworkChangeStatusPayload{NodeID: payload.NodeID, SSID: payload.SSID, Step: step, Success: err == nil}
+		if err != nil {
+			status.Error = err.Error()
+			log.Printf("Wi-Fi change for node %s failed at %s: %v", payload.NodeID, step, err)
+		}
+		client.sendPayload("network_change_status", status)
+	}
+	ssid := hexOctetString(payload.SSID)
+	breadcrumb := strconv.Itoa(payload.Breadcrumb)
+
+	steps := []struct {
+		name string
+		args []string
+	}{
+		{"arm_fail_safe", []string{"generalcommissioning", "arm-fail-safe", wifiChangeFailSafeSeconds, breadcrumb}},
+		{"add_or_update_wifi_network", []string{"networkcommissioning", "add-or-update-wi-fi-network", ssid, hexOctetString(payload.Password), "--Breadcrumb", breadcrumb}},
+		{"connect_network", []string{"networkcommissioning", "connect-network", ssid, "--Breadcrumb", breadcrumb}},
+		{"commissioning_complete", []string{"generalcommissioning", "commissioning-complete"}},
+	}
+	for _, step := range steps {
+		client.notifyClientLog("network_log", fmt.Sprintf("Node %s: %s", payload.NodeID, step.name))
+		if err := networkCommissioningStep(payload.NodeID, step.args...); err != nil {
+			report(step.name, err)
+			return
+		}
+	}
+	report("done", nil)
+}
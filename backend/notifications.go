@@ -0,0 +1,436 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notificationsFile is where the notification center is persisted, relative to the data directory.
+const notificationsFile = "notifications.json"
+
+// maxNotifications bounds the persisted notifications; the oldest resolved ones go first.
+const maxNotifications = 500
+
+// Notification severities.
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+var notificationSeverities = []string{severityInfo, severityWarning, severityCritical}
+
+// Notification states: a notification is raised active, may be acknowledged by a user, and is
+// resolved either by a user or when its condition clears.
+const (
+	notificationActive       = "active"
+	notificationAcknowledged = "acknowledged"
+	notificationResolved     = "resolved"
+)
+
+// Notification kinds.
+const (
+	notifyDeviceOffline  = "device_offline"
+	notifyDeviceDegraded = "device_degraded"
+	notifyLowBattery     = "low_battery"
+	notifyLockAlarm      = "lock_alarm"
+	notifyAlert          = "alert"
+	notifyRule           = "rule"
+)
+
+// Notification is a problem worth a user's attention, broadcast as "notification" whenever it is
+// raised, raised again, acknowledged or resolved.
+type Notification struct {
+	ID             string    `json:"id"`
+	Key            string    `json:"key"`  // The condition reported; raising it again while open bumps Count
+	Kind           string    `json:"kind"` // device_offline, device_degraded, low_battery, lock_alarm, alert or rule
+	Severity       string    `json:"severity"`
+	Title          string    `json:"title"`
+	Message        string    `json:"message,omitempty"`
+	DeviceID       string    `json:"deviceId,omitempty"`
+	NodeID         string    `json:"nodeId,omitempty"`
+	EndpointID     string    `json:"endpointId,omitempty"`
+	State          string    `json:"state"`
+	Count          int       `json:"count"`
+	RaisedAt       time.Time `json:"raisedAt"`
+	LastRaisedAt   time.Time `json:"lastRaisedAt"`
+	AcknowledgedAt time.Time `json:"acknowledgedAt,omitzero"`
+	AcknowledgedBy string    `json:"acknowledgedBy,omitempty"`
+	ResolvedAt     time.Time `json:"resolvedAt,omitzero"`
+	ResolvedBy     string    `json:"resolvedBy,omitempty"` // Empty when the condition cleared by itself
+}
+
+// NotificationCenter collects the problems reported by the alert engine, device health,
+// reachability, lock alarms and rules, so they don't end up buried in the log.
+type NotificationCenter struct {
+	mu    sync.Mutex
+	items []*Notification          // Oldest first
+	open  map[string]*Notification // Active and acknowledged notifications, by key
+	path  string
+}
+
+// NewNotificationCenter creates a notification center persisting to path.
+func NewNotificationCenter(path string) *NotificationCenter {
+	return &NotificationCenter{open: make(map[string]*Notification), path: path}
+}
+
+// Load reads the persisted notifications. A missing file is not an error.
+func (n *NotificationCenter) Load() error {
+	var items []*Notification
+	if err := loadJSONFile(n.path, &items); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.items = items
+	for _, item := range items {
+		if item.State != notificationResolved {
+			n.open[item.Key] = item
+		}
+	}
+	log.Printf("Loaded %d notification(s), %d open", len(items), len(n.open))
+	return nil
+}
+
+// save writes the notifications to disk. Callers must hold n.mu.
+func (n *NotificationCenter) save() {
+	if err := saveJSONFile(n.path, n.items); err != nil {
+		log.Printf("Could not save notifications: %v", err)
+	}
+}
+
+// pruneLocked drops the oldest resolved notifications beyond maxNotifications, then the oldest
+// open ones if that wasn't enough.
+func (n *NotificationCenter) pruneLocked() {
+	excess := len(n.items) - maxNotifications
+	if excess <= 0 {
+		return
+	}
+	kept := n.items[:0]
+	for _, item := range n.items {
+		if excess > 0 && item.State == notificationResolved {
+			excess--
+			continue
+		}
+		kept = append(kept, item)
+	}
+	for _, item := range kept[:excess] {
+		delete(n.open, item.Key)
+	}
+	n.items = kept[excess:]
+}
+
+// Raise opens a notification for its key, or raises the open one again with the new details.
+func (n *NotificationCenter) Raise(notification Notification) {
+	now := time.Now()
+	n.mu.Lock()
+	item, ok := n.open[notification.Key]
+	if ok {
+		item.Count++
+		item.LastRaisedAt = now
+		item.Severity, item.Title, item.Message = notification.Severity, notification.Title, notification.Message
+	} else {
+		item = &notification
+		item.ID = fmt.Sprintf("notif-%d", now.UnixNano())
+		item.State, item.Count = notificationActive, 1
+		item.RaisedAt, item.LastRaisedAt = now, now
+		n.items = append(n.items, item)
+		n.open[item.Key] = item
+		n.pruneLocked()
+		log.Printf("Notification %s (%s, %s): %s %s", item.ID, item.Kind, item.Severity, item.Title, item.Message)
+	}
+	raised := *item
+	n.save()
+	n.mu.Unlock()
+	broadcastToClients("notification", raised)
+}
+
+// Clear resolves the open notification of a key whose condition cleared by itself.
+func (n *NotificationCenter) Clear(key string) {
+	n.mu.Lock()
+	item, ok := n.open[key]
+	if !ok {
+		n.mu.Unlock()
+		return
+	}
+	resolved := n.resolveLocked(item, "")
+	n.mu.Unlock()
+	broadcastToClients("notification", resolved)
+}
+
+// ClearDevices resolves the open notifications of removed devices.
+func (n *NotificationCenter) ClearDevices(deviceIDs ...string) {
+	removed := make(map[string]bool)
+	for _, id := range deviceIDs {
+		removed[id] = true
+	}
+	var resolved []Notification
+	n.mu.Lock()
+	for _, item := range n.open {
+		if item.DeviceID != "" && removed[item.DeviceID] {
+			resolved = append(resolved, n.resolveLocked(item, ""))
+		}
+	}
+	n.mu.Unlock()
+	for _, item := range resolved {
+		broadcastToClients("notification", item)
+	}
+}
+
+// resolveLocked resolves an open notification and saves. Callers must hold n.mu.
+func (n *NotificationCenter) resolveLocked(item *Notification, by string) Notification {
+	item.State, item.ResolvedAt, item.ResolvedBy = notificationResolved, time.Now(), by
+	delete(n.open, item.Key)
+	n.save()
+	return *item
+}
+
+// findLocked returns a notification by ID. Callers must hold n.mu.
+func (n *NotificationCenter) findLocked(id string) (*Notification, error) {
+	for _, item := range n.items {
+		if item.ID == id {
+			return item, nil
+		}
+	}
+	return nil, fmt.Errorf("notification %q not found", id)
+}
+
+// Acknowledge records that a user has seen an open notification. It stays open until resolved.
+func (n *NotificationCenter) Acknowledge(id, by string) (Notification, error) {
+	n.mu.Lock()
+	item, err := n.findLocked(id)
+	if err != nil {
+		n.mu.Unlock()
+		return Notification{}, err
+	}
+	if item.State != notificationActive {
+		n.mu.Unlock()
+		return Notification{}, fmt.Errorf("notification %q is %s", id, item.State)
+	}
+	item.State, item.AcknowledgedAt, item.AcknowledgedBy = notificationAcknowledged, time.Now(), by
+	n.save()
+	acknowledged := *item
+	n.mu.Unlock()
+	broadcastToClients("notification", acknowledged)
+	return acknowledged, nil
+}
+
+// Resolve closes an open notification on a user's behalf. If its condition persists, the next
+// report raises a new one.
+func (n *NotificationCenter) Resolve(id, by string) (Notification, error) {
+	n.mu.Lock()
+	item, err := n.findLocked(id)
+	if err != nil {
+		n.mu.Unlock()
+		return Notification{}, err
+	}
+	if item.State == notificationResolved {
+		n.mu.Unlock()
+		return Notification{}, fmt.Errorf("notification %q is already resolved", id)
+	}
+	resolved := n.resolveLocked(item, by)
+	n.mu.Unlock()
+	broadcastToClients("notification", resolved)
+	return resolved, nil
+}
+
+// PruneBefore drops the notifications resolved before cutoff. It returns how many were dropped.
+func (n *NotificationCenter) PruneBefore(cutoff time.Time) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	kept := n.items[:0]
+	for _, item := range n.items {
+		if item.State != notificationResolved || !item.ResolvedAt.Before(cutoff) {
+			kept = append(kept, item)
+		}
+	}
+	pruned := len(n.items) - len(kept)
+	n.items = kept
+	if pruned > 0 {
+		n.save()
+	}
+	return pruned
+}
+
+// List returns the notifications in a state (all when empty), most recent first, at most limit
+// of them when limit is positive.
+func (n *NotificationCenter) List(state string, limit int) []Notification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	items := []Notification{}
+	for i := len(n.items) - 1; i >= 0; i-- {
+		if state != "" && n.items[i].State != state {
+			continue
+		}
+		items = append(items, *n.items[i])
+		if limit > 0 && len(items) == limit {
+			break
+		}
+	}
+	return items
+}
+
+// Counts returns how many notifications are active and acknowledged.
+func (n *NotificationCenter) Counts() (active, acknowledged int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, item := range n.open {
+		if item.State == notificationActive {
+			active++
+		} else {
+			acknowledged++
+		}
+	}
+	return active, acknowledged
+}
+
+// alertSeverity maps the free-text severity of an alert rule to a notification severity.
+func alertSeverity(severity string) string {
+	severity = strings.ToLower(severity)
+	if containsString(notificationSeverities, severity) {
+		return severity
+	}
+	return severityWarning
+}
+
+// alertNotificationKey identifies the notification of an alert rule on a node endpoint.
+func alertNotificationKey(alert Alert) string {
+	return "alert|" + alert.RuleID + "|" + alert.NodeID + "/" + alert.EndpointID
+}
+
+// alertNotification turns a raised alert into a notification; the built-in battery rules become
+// low_battery notifications.
+func alertNotification(alert Alert) Notification {
+	kind := notifyAlert
+	if alert.RuleID == lowBatteryRuleID || alert.RuleID == batteryReplacementRuleID {
+		kind = notifyLowBattery
+	}
+	title := alert.RuleName
+	if title == "" {
+		title = alert.RuleID
+	}
+	deviceID, _ := deviceIDForTarget(alert.NodeID, alert.EndpointID)
+	return Notification{
+		Key:        alertNotificationKey(alert),
+		Kind:       kind,
+		Severity:   alertSeverity(alert.Severity),
+		Title:      title,
+		Message:    fmt.Sprintf("%s.%s = %g%s (%s)", alert.Cluster, alert.Attribute, alert.Value, alert.Unit, alert.Condition),
+		DeviceID:   deviceID,
+		NodeID:     alert.NodeID,
+		EndpointID: alert.EndpointID,
+	}
+}
+
+// deviceName names a device in notifications.
+func deviceName(deviceID string) string {
+	if device, ok := deviceRegistry.Get(deviceID); ok && device.Name != "" {
+		return device.Name
+	}
+	return "Device " + deviceID
+}
+
+// HandleEvent turns device events into notifications: raised and cleared alerts, reachability and
+// health changes, and lock alarms.
+func (n *NotificationCenter) HandleEvent(event Event) {
+	switch payload := event.Payload.(type) {
+	case Alert:
+		if event.Type == "alert_cleared" {
+			n.Clear(alertNotificationKey(payload))
+			return
+		}
+		n.Raise(alertNotification(payload))
+	case DeviceReachabilityPayload:
+		key := "offline|" + payload.DeviceID
+		if payload.Reachable {
+			n.Clear(key)
+			return
+		}
+		n.Raise(Notification{Key: key, Kind: notifyDeviceOffline, Severity: severityWarning, Title: deviceName(payload.DeviceID) + " is offline",
+			DeviceID: payload.DeviceID, NodeID: payload.NodeID, EndpointID: payload.EndpointID})
+	case DeviceHealthReport:
+		key := "health|" + payload.NodeID
+		if payload.Status != healthDegraded {
+			n.Clear(key)
+			return
+		}
+		deviceID, _ := deviceIDForTarget(payload.NodeID, "")
+		n.Raise(Notification{Key: key, Kind: notifyDeviceDegraded, Severity: severityWarning, Title: deviceName(deviceID) + " responds poorly",
+			Message: strings.Join(payload.Reasons, "; "), DeviceID: deviceID, NodeID: payload.NodeID})
+	case LockAlarmPayload:
+		deviceID, _ := deviceIDForTarget(payload.NodeID, payload.EndpointID)
+		n.Raise(Notification{Key: fmt.Sprintf("lock|%s/%s|%d", payload.NodeID, payload.EndpointID, payload.AlarmCode), Kind: notifyLockAlarm,
+			Severity: lockAlarmSeverity(payload.AlarmCode), Title: deviceName(deviceID) + ": " + payload.Alarm,
+			DeviceID: deviceID, NodeID: payload.NodeID, EndpointID: payload.EndpointID})
+	}
+}
+
+// NotificationsRequestPayload is the payload of "list_notifications".
+type NotificationsRequestPayload struct {
+	State string `json:"state,omitempty"` // active, acknowledged or resolved; empty for all
+	Limit int    `json:"limit,omitempty"`
+}
+
+// Validate implements Validator.
+func (p NotificationsRequestPayload) Validate() error {
+	verr := &ValidationError{}
+	if p.State != "" && p.State != notificationActive && p.State != notificationAcknowledged && p.State != notificationResolved {
+		verr.add("state", "must be active, acknowledged or resolved")
+	}
+	if p.Limit < 0 {
+		verr.add("limit", "must not be negative")
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// NotificationsListPayload is sent in response to "list_notifications" and GET /api/notifications.
+type NotificationsListPayload struct {
+	Notifications []Notification `json:"notifications"`
+	Active        int            `json:"active"`
+	Acknowledged  int            `json:"acknowledged"`
+}
+
+// notificationsList builds the reply of "list_notifications".
+func notificationsList(state string, limit int) NotificationsListPayload {
+	active, acknowledged := notificationCenter.Counts()
+	return NotificationsListPayload{Notifications: notificationCenter.List(state, limit), Active: active, Acknowledged: acknowledged}
+}
+
+// NotificationIDPayload is the payload of "acknowledge_notification" and "resolve_notification".
+type NotificationIDPayload struct {
+	ID string `json:"id" validate:"required"`
+}
+
+// notificationActor names the user acting on a notification: the client's identity once it
+// identified, its connection otherwise.
+func notificationActor(client *Client) string {
+	base := client.base()
+	if identity := base.identity.Load(); identity != nil {
+		return identity.String()
+	}
+	return base.id
+}
+
+func handleListNotifications(client *Client, payload NotificationsRequestPayload) {
+	client.sendPayload("notifications_list", notificationsList(payload.State, payload.Limit))
+}
+
+func handleAcknowledgeNotification(client *Client, payload NotificationIDPayload) {
+	if _, err := notificationCenter.Acknowledge(payload.ID, notificationActor(client)); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "acknowledge_notification failed: " + err.Error()})
+	}
+}
+
+func handleResolveNotification(client *Client, payload NotificationIDPayload) {
+	if _, err := notificationCenter.Resolve(payload.ID, notificationActor(client)); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "resolve_notification failed: " + err.Error()})
+	}
+}
+
+var notificationCenter = NewNotificationCenter(notificationsFile)
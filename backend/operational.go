@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// avahiBrowsePath browses DNS-SD services. chip-tool can only resolve a known node ID, so operational
+// instances (_matter._tcp) are listed with avahi, which Raspberry Pi OS ships with.
+const avahiBrowsePath = "avahi-browse"
+
+// operationalBrowseTimeout bounds a _matter._tcp browse.
+const operationalBrowseTimeout = 10 * time.Second
+
+// Pairing states of discovered commissionable devices.
+const (
+	pairingStateNew              = "new"
+	pairingStateCommissionedHere = "commissioned_here"         // Already in this gateway's registry/fabric
+	pairingStateOtherFabric      = "commissioned_other_fabric" // Operational on another fabric (multi-admin window)
+)
+
+// OperationalInstance is a commissioned node advertising _matter._tcp. Its instance name is
+// "<compressed fabric ID>-<node ID>", both as 16 hex digits.
+type OperationalInstance struct {
+	InstanceName       string   `json:"instanceName"`
+	CompressedFabricID string   `json:"compressedFabricId"`
+	NodeID             string   `json:"nodeId"` // Decimal, like the node IDs in the registry
+	Hostname           string   `json:"hostname,omitempty"`
+	Addresses          []string `json:"addresses,omitempty"`
+	Port               int      `json:"port,omitempty"`
+}
+
+// parseOperationalInstanceName splits an operational instance name into compressed fabric ID and decimal node ID.
+func parseOperationalInstanceName(name string) (string, string, bool) {
+	fabric, node, ok := strings.Cut(name, "-")
+	if !ok || len(fabric) != 16 || len(node) != 16 {
+		return "", "", false
+	}
+	if _, err := strconv.ParseUint(fabric, 16, 64); err != nil {
+		return "", "", false
+	}
+	nodeID, err := strconv.ParseUint(node, 16, 64)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.ToUpper(fabric), strconv.FormatUint(nodeID, 10), true
+}
+
+// parseAvahiBrowse parses "avahi-browse -rpt" output, merging the IPv4/IPv6 records of each instance.
+// Resolved records look like: =;eth0;IPv6;<instance>;_matter._tcp;local;<host>;<address>;<port>;<txt>
+func parseAvahiBrowse(output string) []OperationalInstance {
+	var instances []OperationalInstance
+	index := make(map[string]int)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ";")
+		if len(fields) < 9 || fields[0] != "=" || fields[4] != "_matter._tcp" {
+			continue
+		}
+		fabric, nodeID, ok := parseOperationalInstanceName(fields[3])
+		if !ok {
+			continue
+		}
+		i, seen := index[fields[3]]
+		if !seen {
+			port, _ := strconv.Atoi(fields[8])
+			instances = append(instances, OperationalInstance{
+				InstanceName:       fields[3],
+				CompressedFabricID: fabric,
+				NodeID:             nodeID,
+				Hostname:           fields[6],
+				Port:               port,
+			})
+			i = len(instances) - 1
+			index[fields[3]] = i
+		}
+		if addr := withZone(fields[7], fields[1]); addr != "" && !containsString(instances[i].Addresses, addr) {
+			instances[i].Addresses = append(instances[i].Addresses, addr)
+		}
+	}
+	return instances
+}
+
+func containsString(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+// browseOperationalNodes lists the commissioned Matter nodes advertising on the network.
+func browseOperationalNodes() ([]OperationalInstance, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), operationalBrowseTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, avahiBrowsePath, "-rpt", "_matter._tcp").Output()
+	if err != nil && len(out) == 0 {
+		return nil, fmt.Errorf("browsing _matter._tcp failed: %v", err)
+	}
+	return parseAvahiBrowse(string(out)), nil
+}
+
+// sameNodeID compares node IDs numerically, as registry IDs may carry leading zeros.
+func sameNodeID(a, b string) bool {
+	x, errA := strconv.ParseUint(a, 10, 64)
+	y, errB := strconv.ParseUint(b, 10, 64)
+	return errA == nil && errB == nil && x == y
+}
+
+// ourCompressedFabricID returns the compressed fabric ID of this gateway: the configured one, or else
+// the fabric on which most of the registry's nodes are advertised.
+func ourCompressedFabricID(instances []OperationalInstance, devices []RegisteredDevice) string {
+	if appConfig.CompressedFabricID != "" {
+		return strings.ToUpper(appConfig.CompressedFabricID)
+	}
+	votes := make(map[string]int)
+	best := ""
+	for _, inst := range instances {
+		for _, device := range devices {
+			if device.BridgeID == "" && sameNodeID(device.NodeID, inst.NodeID) {
+				votes[inst.CompressedFabricID]++
+				if votes[inst.CompressedFabricID] > votes[best] {
+					best = inst.CompressedFabricID
+				}
+				break
+			}
+		}
+	}
+	return best
+}
+
+// sameHost compares DNS-SD host names, ignoring case and the ".local" suffix.
+func sameHost(a, b string) bool {
+	trim := func(h string) string {
+		return strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(h), "."), ".local")
+	}
+	return a != "" && b != "" && trim(a) == trim(b)
+}
+
+// PairingStateTracker keeps the pairing state of the devices found by the last discovery, by long discriminator.
+type PairingStateTracker struct {
+	mu     sync.Mutex
+	states map[string]DiscoveredDevice
+}
+
+// Classify labels each discovered commissionable device as new, already commissioned by this gateway
+// (found in the registry or advertised on our fabric) or commissioned on another fabric.
+func (t *PairingStateTracker) Classify(devices []DiscoveredDevice) {
+	registered := deviceRegistry.List()
+	instances, err := browseOperationalNodes()
+	if err != nil {
+		log.Printf("Operational discovery unavailable, pairing state from the registry only: %v", err)
+	}
+	ourFabric := ourCompressedFabricID(instances, registered)
+
+	for i := range devices {
+		d := &devices[i]
+		d.PairingState = pairingStateNew
+		for _, r := range registered {
+			if r.BridgeID != "" {
+				continue
+			}
+			if (r.InstanceName != "" && r.InstanceName == d.InstanceName) ||
+				(r.Discriminator != "" && r.Discriminator == d.Discriminator && r.VendorID == d.VendorID && r.ProductID == d.ProductID) {
+				d.PairingState, d.CommissionedNodeID = pairingStateCommissionedHere, r.NodeID
+				break
+			}
+		}
+		if d.PairingState != pairingStateNew {
+			continue
+		}
+		for _, inst := range instances {
+			if !sameHost(inst.Hostname, d.Name) && !containsString(inst.Addresses, d.IPAddress) {
+				continue
+			}
+			if ourFabric != "" && inst.CompressedFabricID == ourFabric {
+				d.PairingState, d.CommissionedNodeID = pairingStateCommissionedHere, inst.NodeID
+				break
+			}
+			d.PairingState = pairingStateOtherFabric
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.states = make(map[string]DiscoveredDevice)
+	for _, d := range devices {
+		if d.Discriminator != "" {
+			t.states[d.Discriminator] = d
+		}
+	}
+}
+
+// Lookup returns the last discovered device with the given long discriminator.
+func (t *PairingStateTracker) Lookup(discriminator string) (DiscoveredDevice, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.states[discriminator]
+	return d, ok
+}
+
+var pairingStates = &PairingStateTracker{states: make(map[string]DiscoveredDevice)}
+
+// discoverOperational browses the operational nodes, maps the ones on our fabric back to registry
+// devices and refreshes their reachability and addresses. Registered nodes not advertising are
+// marked unreachable, which requires knowing our compressed fabric ID.
+func discoverOperational(client *Client) {
+	instances, err := browseOperationalNodes()
+	if err != nil {
+		client.sendPayload("operational_nodes", OperationalNodesPayload{Error: err.Error()})
+		return
+	}
+	registered := deviceRegistry.List()
+	ourFabric := ourCompressedFabricID(instances, registered)
+	result := OperationalNodesPayload{CompressedFabricID: ourFabric, Nodes: make([]OperationalNode, 0, len(instances))}
+
+	advertised := make(map[string]bool)
+	for _, inst := range instances {
+		node := OperationalNode{OperationalInstance: inst, OurFabric: ourFabric != "" && inst.CompressedFabricID == ourFabric}
+		if node.OurFabric {
+			for _, device := range registered {
+				if device.BridgeID != "" || !sameNodeID(device.NodeID, inst.NodeID) {
+					continue
+				}
+				node.DeviceID = device.ID
+				advertised[device.ID] = true
+				if err := applyOperationalRecord(device, inst); err != nil {
+					log.Printf("Could not refresh node %s from its operational record: %v", device.NodeID, err)
+				}
+				break
+			}
+		}
+		result.Nodes = append(result.Nodes, node)
+	}
+	if ourFabric != "" {
+		for _, device := range registered {
+			if device.BridgeID == "" && !advertised[device.ID] && device.Reachable {
+				_ = deviceRegistry.Update(device.ID, func(d *RegisteredDevice) { d.Reachable = false })
+				result.Missing = append(result.Missing, device.ID)
+			}
+		}
+	}
+	log.Printf("Operational discovery: %d instance(s), %d on our fabric %q, %d registered node(s) missing", len(instances), len(advertised), ourFabric, len(result.Missing))
+	client.sendPayload("operational_nodes", result)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// photosDir is where device and room photos are stored, relative to the data directory: one file
+// per device or room, photos/device/<id> and photos/room/<name>, in the format it was uploaded in.
+const photosDir = "photos"
+
+// Default size limits of the photos.
+const (
+	defaultMaxPhotoBytes  = 512 * 1024
+	defaultMaxPhotosBytes = 50 * 1024 * 1024
+)
+
+// What a photo belongs to.
+const (
+	photoDevice = "device"
+	photoRoom   = "room"
+)
+
+// photoTypes are the accepted image formats, as sniffed from the content.
+var photoTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+var (
+	errPhotoNotFound = errors.New("no photo")
+	errPhotoTooLarge = errors.New("photo too large")
+	errPhotoInvalid  = errors.New("invalid photo")
+)
+
+// PhotosConfig bounds the device and room photos (see photos.go).
+type PhotosConfig struct {
+	// MaxBytes is the size limit of one photo. Zero uses 512 KiB.
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	// MaxTotalBytes is the size limit of all the photos together. Zero uses 50 MiB.
+	MaxTotalBytes int64 `json:"maxTotalBytes,omitempty"`
+}
+
+func (c PhotosConfig) maxBytes() int64 {
+	if c.MaxBytes > 0 {
+		return c.MaxBytes
+	}
+	return defaultMaxPhotoBytes
+}
+
+func (c PhotosConfig) maxTotalBytes() int64 {
+	if c.MaxTotalBytes > 0 {
+		return c.MaxTotalBytes
+	}
+	return defaultMaxPhotosBytes
+}
+
+// PhotoChangedPayload is broadcast as "photo_changed" when a photo is uploaded or removed, so
+// dashboards reload it.
+type PhotoChangedPayload struct {
+	Kind      string    `json:"kind"` // "device" or "room"
+	ID        string    `json:"id"`   // Device ID or room name
+	URL       string    `json:"url"`  // Relative to the API base URL, empty when removed
+	Removed   bool      `json:"removed,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// PhotoStore keeps the photos of the devices and rooms on disk, so dashboards can show the actual
+// lamp or plug instead of a generic icon.
+type PhotoStore struct {
+	mu  sync.Mutex // Serializes the writes, for the total size limit
+	dir string
+}
+
+// path returns the file of a photo. IDs are escaped, so bridged device IDs ("<node>:<endpoint>")
+// and room names can't leave the directory; escaping leaves "." and "..", which are refused.
+func (s *PhotoStore) path(kind, id string) (string, error) {
+	name := url.PathEscape(id)
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("%w: invalid %s id %q", errPhotoInvalid, kind, id)
+	}
+	return filepath.Join(dataFilePath(s.dir), kind, name), nil
+}
+
+// Open returns a photo for serving, with its modification time.
+func (s *PhotoStore) Open(kind, id string) (*os.File, time.Time, error) {
+	path, err := s.path(kind, id)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, errPhotoNotFound
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+	return f, info.ModTime(), nil
+}
+
+// Save checks and stores a photo, replacing the previous one. It reads at most the size limit
+// plus one byte of r.
+func (s *PhotoStore) Save(kind, id string, r io.Reader) (PhotoChangedPayload, error) {
+	limit := appConfig.Photos.maxBytes()
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return PhotoChangedPayload{}, err
+	}
+	if int64(len(data)) > limit {
+		return PhotoChangedPayload{}, fmt.Errorf("%w: at most %d bytes", errPhotoTooLarge, limit)
+	}
+	if len(data) == 0 {
+		return PhotoChangedPayload{}, fmt.Errorf("%w: the upload is empty", errPhotoInvalid)
+	}
+	if contentType := http.DetectContentType(data); !photoTypes[contentType] {
+		return PhotoChangedPayload{}, fmt.Errorf("%w: unsupported format %s, use JPEG, PNG, GIF or WebP", errPhotoInvalid, contentType)
+	}
+
+	path, err := s.path(kind, id)
+	if err != nil {
+		return PhotoChangedPayload{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := int64(0)
+	if info, err := os.Stat(path); err == nil {
+		previous = info.Size()
+	}
+	if total := s.totalBytes() - previous + int64(len(data)); total > appConfig.Photos.maxTotalBytes() {
+		return PhotoChangedPayload{}, fmt.Errorf("%w: the photos would take %d bytes, more than the %d allowed", errPhotoTooLarge, total, appConfig.Photos.maxTotalBytes())
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return PhotoChangedPayload{}, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		os.Remove(tmp)
+		return PhotoChangedPayload{}, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return PhotoChangedPayload{}, err
+	}
+	log.Printf("Stored the photo of %s %s (%d bytes)", kind, id, len(data))
+	return PhotoChangedPayload{Kind: kind, ID: id, URL: photoURL(kind, id), Size: int64(len(data)), UpdatedAt: time.Now()}, nil
+}
+
+// Delete removes a photo.
+func (s *PhotoStore) Delete(kind, id string) (PhotoChangedPayload, error) {
+	path, err := s.path(kind, id)
+	if err != nil {
+		return PhotoChangedPayload{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(path); os.IsNotExist(err) {
+		return PhotoChangedPayload{}, errPhotoNotFound
+	} else if err != nil {
+		return PhotoChangedPayload{}, err
+	}
+	return PhotoChangedPayload{Kind: kind, ID: id, Removed: true, UpdatedAt: time.Now()}, nil
+}
+
+// Forget removes the photos of removed devices, if any.
+func (s *PhotoStore) Forget(deviceIDs ...string) {
+	for _, id := range deviceIDs {
+		if _, err := s.Delete(photoDevice, id); err != nil && err != errPhotoNotFound {
+			log.Printf("Could not remove the photo of device %s: %v", id, err)
+		}
+	}
+}
+
+// totalBytes is the size of all the stored photos. The caller holds s.mu.
+func (s *PhotoStore) totalBytes() int64 {
+	var total int64
+	_ = filepath.WalkDir(dataFilePath(s.dir), func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// photoURL is where a photo is served, relative to the API base URL.
+func photoURL(kind, id string) string {
+	if kind == photoRoom {
+		return "/rooms/" + url.PathEscape(id) + "/photo"
+	}
+	return "/devices/" + url.PathEscape(id) + "/photo"
+}
+
+// photoUpload returns the uploaded image: the "photo" field of a multipart form, or else the raw
+// request body.
+func photoUpload(c *gin.Context) (io.ReadCloser, error) {
+	// Leave room for the multipart headers; Save checks the photo itself
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, appConfig.Photos.maxBytes()+64*1024)
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		header, err := c.FormFile("photo")
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, fmt.Errorf("%w: at most %d bytes", errPhotoTooLarge, appConfig.Photos.maxBytes())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errPhotoInvalid, err)
+		}
+		if header.Size > appConfig.Photos.maxBytes() {
+			return nil, fmt.Errorf("%w: at most %d bytes", errPhotoTooLarge, appConfig.Photos.maxBytes())
+		}
+		return header.Open()
+	}
+	return c.Request.Body, nil
+}
+
+// registerPhotoRoutes adds GET, PUT and DELETE /devices/:id/photo and /rooms/:room/photo to an API
+// version group.
+func registerPhotoRoutes(api *gin.RouterGroup) {
+	routes := map[string]struct {
+		path  string
+		param string
+		check func(id string) bool
+	}{
+		photoDevice: {"/devices/:id/photo", "id", func(id string) bool { _, ok := lookupDevice(id); return ok }},
+		photoRoom:   {"/rooms/:room/photo", "room", func(string) bool { return true }},
+	}
+	for kind, route := range routes {
+		api.GET(route.path, func(c *gin.Context) {
+			f, modified, err := photos.Open(kind, c.Param(route.param))
+			if err == errPhotoNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"error": errPhotoNotFound.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(photoErrorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			defer f.Close()
+			head := make([]byte, 512)
+			n, _ := io.ReadFull(f, head)
+			c.Header("Content-Type", http.DetectContentType(head[:n]))
+			c.Header("Cache-Control", "no-cache") // Revalidated with If-Modified-Since after a change
+			http.ServeContent(c.Writer, c.Request, "", modified, f)
+		})
+		api.PUT(route.path, func(c *gin.Context) {
+			id := c.Param(route.param)
+			if !route.check(id) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+				return
+			}
+			body, err := photoUpload(c)
+			if err != nil {
+				c.JSON(photoErrorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			defer body.Close()
+			changed, err := photos.Save(kind, id, body)
+			if err != nil {
+				c.JSON(photoErrorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			broadcastToClients("photo_changed", changed)
+			c.JSON(http.StatusOK, changed)
+		})
+		api.DELETE(route.path, func(c *gin.Context) {
+			changed, err := photos.Delete(kind, c.Param(route.param))
+			if err == errPhotoNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"error": errPhotoNotFound.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(photoErrorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			broadcastToClients("photo_changed", changed)
+			c.Status(http.StatusNoContent)
+		})
+	}
+}
+
+// photoErrorStatus maps an upload error to its HTTP status.
+func photoErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errPhotoTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errPhotoInvalid):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+var photos = &PhotoStore{dir: photosDir}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// pollingFile is where polling profiles are persisted, relative to the working directory.
+const pollingFile = "polling.json"
+
+// Polling defaults, used when the config doesn't set them.
+const (
+	defaultPollIntervalSeconds   = 30
+	defaultFailuresBeforePolling = 3
+	pollerTick                   = 5 * time.Second // Granularity of the polling schedule
+	minPollIntervalSeconds       = 5
+)
+
+// PolledAttribute is an attribute read by a polling profile.
+type PolledAttribute struct {
+	Cluster   string `json:"cluster" validate:"required"`
+	Attribute string `json:"attribute" validate:"required"` // chip-tool attribute name, e.g. "measured-value"
+}
+
+// PollingProfile reads a list of attributes of a device periodically, for devices whose
+// subscriptions don't work. Values go through the same attribute_update pipeline as subscriptions.
+type PollingProfile struct {
+	DeviceID        string            `json:"deviceId" validate:"required"`
+	NodeID          string            `json:"nodeId,omitempty"`     // Resolved from the registry
+	EndpointID      string            `json:"endpointId,omitempty"` // Resolved from the registry
+	Attributes      []PolledAttribute `json:"attributes" validate:"required"`
+	IntervalSeconds int               `json:"intervalSeconds,omitempty"` // Zero uses polling.defaultIntervalSeconds
+	Auto            bool              `json:"auto,omitempty"`            // Enabled because subscriptions kept failing
+	LastPoll        time.Time         `json:"lastPoll,omitzero"`
+}
+
+// Validate implements Validator.
+func (p PollingProfile) Validate() error {
+	if p.IntervalSeconds != 0 && p.IntervalSeconds < minPollIntervalSeconds {
+		return &ValidationError{Fields: []FieldError{{Field: "intervalSeconds", Message: fmt.Sprintf("must be at least %d", minPollIntervalSeconds)}}}
+	}
+	return nil
+}
+
+// Poller runs the polling profiles and enables them automatically for subscriptions that keep failing.
+type Poller struct {
+	mu       sync.Mutex
+	profiles map[string]*PollingProfile // By device ID
+	failures map[string]int             // Consecutive subscription failures, by subscription ID
+	path     string
+}
+
+// NewPoller creates a Poller persisting its profiles to path.
+func NewPoller(path string) *Poller {
+	return &Poller{profiles: make(map[string]*PollingProfile), failures: make(map[string]int), path: path}
+}
+
+func pollInterval(p *PollingProfile) time.Duration {
+	seconds := p.IntervalSeconds
+	if seconds <= 0 {
+		seconds = appConfig.Polling.DefaultIntervalSeconds
+	}
+	if seconds <= 0 {
+		seconds = defaultPollIntervalSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func failuresBeforePolling() int {
+	if appConfig.Polling.FailuresBeforePolling > 0 {
+		return appConfig.Polling.FailuresBeforePolling
+	}
+	return defaultFailuresBeforePolling
+}
+
+// Load reads the persisted profiles. A missing file is not an error.
+func (p *Poller) Load() error {
+	var profiles []*PollingProfile
+	if err := loadJSONFile(p.path, &profiles); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, profile := range profiles {
+		p.profiles[profile.DeviceID] = profile
+	}
+	log.Printf("Loaded %d polling profile(s) from %s", len(profiles), p.path)
+	return nil
+}
+
+// save writes the profiles to disk. Callers must hold p.mu.
+func (p *Poller) save() error {
+	return saveJSONFile(p.path, p.listLocked())
+}
+
+func (p *Poller) listLocked() []PollingProfile {
+	profiles := make([]PollingProfile, 0, len(p.profiles))
+	for _, profile := range p.profiles {
+		profiles = append(profiles, *profile)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].DeviceID < profiles[j].DeviceID })
+	return profiles
+}
+
+// List returns all profiles sorted by device ID.
+func (p *Poller) List() []PollingProfile {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.listLocked()
+}
+
+// Put creates or replaces the profile of a registry device.
+func (p *Poller) Put(profile PollingProfile) error {
+	nodeID, endpointID, err := deviceRegistry.resolveDeviceTarget(profile.DeviceID)
+	if err != nil {
+		return err
+	}
+	profile.NodeID, profile.EndpointID = nodeID, endpointID
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.profiles[profile.DeviceID] = &profile
+	return p.save()
+}
+
+// Delete removes the profile of a device.
+func (p *Poller) Delete(deviceID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.profiles[deviceID]; !ok {
+		return fmt.Errorf("no polling profile for device %q", deviceID)
+	}
+	delete(p.profiles, deviceID)
+	return p.save()
+}
+
+// deviceIDForTarget returns the registry device addressed by a node endpoint: the bridged device
+// on that endpoint, or else the node itself.
+func deviceIDForTarget(nodeID, endpointID string) (string, bool) {
+	if _, ok := deviceRegistry.Get(bridgedDeviceID(nodeID, endpointID)); ok {
+		return bridgedDeviceID(nodeID, endpointID), true
+	}
+	for _, device := range deviceRegistry.List() {
+		if device.BridgeID == "" && sameNodeID(device.NodeID, nodeID) {
+			return device.ID, true
+		}
+	}
+	return "", false
+}
+
+// SubscriptionFailed records a subscription that could not start or ended. After
+// polling.failuresBeforePolling failures in a row, the attribute is added to the device's profile.
+func (p *Poller) SubscriptionFailed(subscriptionID, nodeID, endpointID, cluster, attribute string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures[subscriptionID]++
+	if p.failures[subscriptionID] < failuresBeforePolling() {
+		return
+	}
+	deviceID, ok := deviceIDForTarget(nodeID, endpointID)
+	if !ok {
+		log.Printf("Subscription %s keeps failing, but node %s EP%s is not in the registry: not polling it", subscriptionID, nodeID, endpointID)
+		return
+	}
+	profile, ok := p.profiles[deviceID]
+	if !ok {
+		profile = &PollingProfile{DeviceID: deviceID, NodeID: nodeID, EndpointID: endpointID, Auto: true}
+		p.profiles[deviceID] = profile
+	}
+	for _, a := range profile.Attributes {
+		if a.Cluster == cluster && a.Attribute == attribute {
+			return
+		}
+	}
+	profile.Attributes = append(profile.Attributes, PolledAttribute{Cluster: cluster, Attribute: attribute})
+	log.Printf("Subscription %s failed %d times in a row: polling %s.%s of device %s instead", subscriptionID, p.failures[subscriptionID], cluster, attribute, deviceID)
+	if err := p.save(); err != nil {
+		log.Printf("Could not save polling profiles: %v", err)
+	}
+}
+
+// SubscriptionReported records a report received on a subscription. A working subscription
+// replaces the polling that was enabled automatically for it.
+func (p *Poller) SubscriptionReported(subscriptionID, nodeID, endpointID, cluster, attribute string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failures[subscriptionID] == 0 {
+		return
+	}
+	delete(p.failures, subscriptionID)
+	deviceID, ok := deviceIDForTarget(nodeID, endpointID)
+	if !ok {
+		return
+	}
+	profile, ok := p.profiles[deviceID]
+	if !ok || !profile.Auto {
+		return
+	}
+	kept := profile.Attributes[:0]
+	for _, a := range profile.Attributes {
+		if a.Cluster != cluster || a.Attribute != attribute {
+			kept = append(kept, a)
+		}
+	}
+	profile.Attributes = kept
+	if len(kept) == 0 {
+		delete(p.profiles, deviceID)
+	}
+	log.Printf("Subscription %s works again: stopped polling %s.%s of device %s", subscriptionID, cluster, attribute, deviceID)
+	if err := p.save(); err != nil {
+		log.Printf("Could not save polling profiles: %v", err)
+	}
+}
+
+// Forget removes the profile of a device and of the devices bridged behind a node.
+func (p *Poller) Forget(deviceIDs ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changed := false
+	for _, id := range deviceIDs {
+		if _, ok := p.profiles[id]; ok {
+			delete(p.profiles, id)
+			changed = true
+		}
+	}
+	if changed {
+		if err := p.save(); err != nil {
+			log.Printf("Could not save polling profiles: %v", err)
+		}
+	}
+}
+
+// due returns copies of the profiles whose interval elapsed, marking them as polled.
+func (p *Poller) due(now time.Time) []PollingProfile {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var due []PollingProfile
+	for _, profile := range p.profiles {
+		if now.Sub(profile.LastPoll) >= pollInterval(profile) {
+			profile.LastPoll = now
+			due = append(due, *profile)
+		}
+	}
+	return due
+}
+
+// poll reads the attributes of a profile and publishes the values.
+func (p *Poller) poll(profile PollingProfile) {
+	for _, a := range profile.Attributes {
+		value, err := readAttributeValue(profile.NodeID, profile.EndpointID, a.Cluster, a.Attribute)
+		if err != nil {
+			log.Printf("Polling device %s: %v", profile.DeviceID, err)
+			continue
+		}
+		publishAttributeUpdate(nil, AttributeUpdatePayload{
+			NodeID: profile.NodeID, EndpointID: profile.EndpointID, Cluster: a.Cluster, Attribute: a.Attribute, Value: value, Source: "poll",
+		})
+	}
+}
+
+// Run polls the due profiles forever.
+func (p *Poller) Run() {
+	for {
+		time.Sleep(pollerTick)
+		for _, profile := range p.due(time.Now()) {
+			p.poll(profile)
+		}
+	}
+}
+
+var poller = NewPoller(pollingFile)
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// defaultTrustedProxies are the proxies whose X-Forwarded-* headers are honored unless the config
+// lists others: a reverse proxy on the same host.
+var defaultTrustedProxies = []string{"127.0.0.1", "::1"}
+
+// trustedProxies returns the configured trusted proxies (IPs or CIDRs).
+func trustedProxies() []string {
+	if len(appConfig.TrustedProxies) > 0 {
+		return appConfig.TrustedProxies
+	}
+	return defaultTrustedProxies
+}
+
+// fromTrustedProxy reports whether a request comes straight from a trusted reverse proxy.
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range trustedProxies() {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHeader returns the first value of an X-Forwarded-* header, when the request comes from a trusted proxy.
+func forwardedHeader(r *http.Request, name string) string {
+	if !fromTrustedProxy(r) {
+		return ""
+	}
+	first, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(first)
+}
+
+// requestClientAddr is the address of the client behind the proxy (X-Forwarded-For), or the peer address.
+func requestClientAddr(r *http.Request) string {
+	if forwarded := forwardedHeader(r, "X-Forwarded-For"); forwarded != "" {
+		return forwarded
+	}
+	return r.RemoteAddr
+}
+
+// externalOrigin is the scheme and host the browser used to reach the backend, through the proxy if any.
+func externalOrigin(r *http.Request) (scheme, host string) {
+	scheme, host = "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := forwardedHeader(r, "X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	if forwardedHost := forwardedHeader(r, "X-Forwarded-Host"); forwardedHost != "" {
+		host = forwardedHost
+	}
+	return scheme, host
+}
+
+// normalizeBasePath turns the basePath config into "" or "/prefix", without a trailing slash.
+func normalizeBasePath(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return ""
+	}
+	return "/" + path
+}
+
+// externalBasePath is the path prefix the backend is reachable under: X-Forwarded-Prefix from a
+// trusted proxy, or the basePath config.
+func externalBasePath(r *http.Request) string {
+	if prefix := forwardedHeader(r, "X-Forwarded-Prefix"); prefix != "" {
+		return normalizeBasePath(prefix)
+	}
+	return normalizeBasePath(appConfig.BasePath)
+}
+
+// withBasePath serves the backend under basePath as well as at the root, so it works behind proxies
+// that strip the prefix (Traefik's StripPrefix, nginx "proxy_pass .../;") and behind ones that don't.
+func withBasePath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		base := normalizeBasePath(appConfig.BasePath)
+		if base != "" && (r.URL.Path == base || strings.HasPrefix(r.URL.Path, base+"/")) {
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = strings.TrimPrefix(r.URL.Path, base)
+			if r2.URL.Path == "" {
+				r2.URL.Path = "/"
+			}
+			r2.URL.RawPath = ""
+			r = r2
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkWebSocketOrigin accepts every origin unless allowedOrigins is configured. Then the origin must
+// be listed, or be the origin the browser reached the backend at (honoring X-Forwarded-Proto/Host).
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(appConfig.AllowedOrigins) == 0 {
+		return true
+	}
+	if containsString(appConfig.AllowedOrigins, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	scheme, host := externalOrigin(r)
+	return strings.EqualFold(u.Scheme, scheme) && strings.EqualFold(u.Host, host)
+}
+
+// HelloPayload is sent to every client when it connects: where to reach the backend from the
+// browser's point of view, so frontends behind a proxy build correct URLs.
+type HelloPayload struct {
+	WebSocketURL string `json:"wsUrl"`
+	APIBaseURL   string `json:"apiBaseUrl"`
+	BasePath     string `json:"basePath"`
+	Admin        bool   `json:"admin,omitempty"` // Connected to the admin API
+	AuthRequired bool   `json:"authRequired,omitempty"`
+	ReadOnly     bool   `json:"readOnly,omitempty"`    // Commissioning, commands and writes are refused (see readonly.go)
+	Maintenance  bool   `json:"maintenance,omitempty"` // Maintenance in progress (see maintenance.go)
+	// MatterAvailable is false in degraded mode, when Matter operations are refused (see degraded.go)
+	MatterAvailable bool `json:"matterAvailable"`
+	// SetupRequired asks the frontend to run the first-run setup at apiBaseUrl + "/setup" (see setup.go)
+	SetupRequired bool `json:"setupRequired,omitempty"`
+	// Features are the feature flags in effect, by name (see featureflags.go)
+	Features map[string]bool `json:"features"`
+}
+
+// buildHello computes the hello payload for a connection request.
+func buildHello(r *http.Request, admin bool) HelloPayload {
+	scheme, host := externalOrigin(r)
+	wsScheme := "ws"
+	if scheme == "https" {
+		wsScheme = "wss"
+	}
+	base := externalBasePath(r)
+	return HelloPayload{
+		WebSocketURL:    wsScheme + "://" + host + base + "/ws",
+		APIBaseURL:      scheme + "://" + host + base + apiV1Prefix,
+		BasePath:        base,
+		Admin:           admin,
+		AuthRequired:    appConfig.AuthToken != "",
+		ReadOnly:        readOnly.Enabled(),
+		Maintenance:     maintenance.Active(),
+		MatterAvailable: !degradedMode.Active(),
+		SetupRequired:   setup.Required(),
+		Features:        featureFlags.Active(),
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// jobMessageTypes are the messages that start a job (see jobs.go), counted by quotas.maxJobs.
+var jobMessageTypes = map[string]bool{
+	"discover_devices":        true,
+	"commission_device":       true,
+	"check_fabric":            true,
+	"wizard_step":             true,
+	"run_macro":               true,
+	"sync_time":               true,
+	"export_fabric_share":     true,
+	"run_lighting_transition": true,
+	"benchmark_device":        true,
+	"scan_wifi":               true,
+	"check_bluetooth":         true,
+}
+
+// QuotaUsage is the use of one quota; a zero Limit means unlimited.
+type QuotaUsage struct {
+	Used  int `json:"used"`
+	Limit int `json:"limit"`
+}
+
+// QuotaPayload is sent in response to "get_quota".
+type QuotaPayload struct {
+	Owner            string     `json:"owner"`
+	Subscriptions    QuotaUsage `json:"subscriptions"`
+	Jobs             QuotaUsage `json:"jobs"`
+	MaxHistoryPoints int        `json:"maxHistoryPoints"`
+}
+
+// quotaOwner names the holder of a client's quotas: its identity once it identified, so several
+// connections of one integration share them, else its connection ID. Backend-originated work
+// (nil client) has no owner and no quota.
+func quotaOwner(client *Client) string {
+	if client == nil || client.base().conn == nil {
+		return ""
+	}
+	base := client.base()
+	if identity := base.identity.Load(); identity != nil {
+		return identity.String()
+	}
+	return base.id
+}
+
+// quotaExceeded sends the quota_exceeded error of a refused request. quota is "subscriptions",
+// "jobs" or "history_points".
+func quotaExceeded(client *Client, msgType, quota string, limit int) {
+	log.Printf("Client %s: %s refused by the %s quota (%d)", client.logName(), msgType, quota, limit)
+	client.notifyClient("error", map[string]interface{}{
+		"message": fmt.Sprintf("%s refused: over the quota of %d %s", msgType, limit, strings.ReplaceAll(quota, "_", " ")),
+		"code":    errCodeQuotaExceeded,
+		"quota":   quota,
+		"limit":   limit,
+	})
+}
+
+// allowSubscription reports whether a client may start one more subscription. Restarting one it
+// already holds is always allowed.
+func allowSubscription(client *Client, subscriptionID string) bool {
+	limit := appConfig.Quotas.MaxSubscriptions
+	owner := quotaOwner(client)
+	if limit <= 0 || owner == "" || subscriptions.Has(subscriptionID) {
+		return true
+	}
+	if subscriptions.CountOwner(owner) < limit {
+		return true
+	}
+	quotaExceeded(client, "subscribe "+subscriptionID, "subscriptions", limit)
+	return false
+}
+
+// historyLimit returns the number of history points a client may get for a requested limit
+// (0 for everything kept), or false when it asks for more than quotas.maxHistoryPoints.
+func historyLimit(client *Client, requested int) (int, bool) {
+	limit := appConfig.Quotas.MaxHistoryPoints
+	switch {
+	case limit <= 0 || quotaOwner(client) == "":
+		return requested, true
+	case requested == 0:
+		return limit, true
+	case requested > limit:
+		quotaExceeded(client, "get_attribute_history", "history_points", limit)
+		return 0, false
+	}
+	return requested, true
+}
+
+// quotaMiddleware refuses the messages starting a job when the client already has
+// quotas.maxJobs jobs queued or running.
+func quotaMiddleware(msgType string, next HandlerFunc) HandlerFunc {
+	return func(client *Client, msg ClientMessage) {
+		limit := appConfig.Quotas.MaxJobs
+		if jobMessageTypes[msgType] && limit > 0 {
+			if owner := quotaOwner(client); owner != "" && jobs.ActiveFor(owner) >= limit {
+				quotaExceeded(client, msgType, "jobs", limit)
+				return
+			}
+		}
+		next(client, msg)
+	}
+}
+
+func handleGetQuota(client *Client) {
+	owner := quotaOwner(client)
+	client.sendPayload("quota", QuotaPayload{
+		Owner:            owner,
+		Subscriptions:    QuotaUsage{Used: subscriptions.CountOwner(owner), Limit: appConfig.Quotas.MaxSubscriptions},
+		Jobs:             QuotaUsage{Used: jobs.ActiveFor(owner), Limit: appConfig.Quotas.MaxJobs},
+		MaxHistoryPoints: appConfig.Quotas.MaxHistoryPoints,
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Raw chip-tool run limits.
+const (
+	defaultRawChipToolSeconds = 60
+	maxRawChipToolSeconds     = 600
+)
+
+// RawChipToolPayload is the payload of "raw_chiptool": chip-tool arguments, as on its command line.
+// They are passed to chip-tool as is, without a shell.
+type RawChipToolPayload struct {
+	Args           []string `json:"args" validate:"required"` // e.g. ["onoff", "read", "on-off", "42", "1"]
+	TimeoutSeconds int      `json:"timeoutSeconds,omitempty"` // Default 60, at most 600
+}
+
+// Validate implements Validator.
+func (p RawChipToolPayload) Validate() error {
+	verr := &ValidationError{}
+	if len(p.Args) == 0 {
+		verr.add("args", "is required")
+	}
+	if p.TimeoutSeconds < 0 || p.TimeoutSeconds > maxRawChipToolSeconds {
+		verr.add("timeoutSeconds", fmt.Sprintf("must be between 0 and %d", maxRawChipToolSeconds))
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// RawChipToolCancelPayload is the payload of "raw_chiptool_cancel".
+type RawChipToolCancelPayload struct {
+	RunID string `json:"runId" validate:"required"`
+}
+
+// RawChipToolStartedPayload is sent in response to "raw_chiptool".
+type RawChipToolStartedPayload struct {
+	RunID string   `json:"runId"`
+	Args  []string `json:"args"`
+}
+
+// RawChipToolOutputPayload is one line of output of a raw chip-tool run, sent as "raw_chiptool_output".
+type RawChipToolOutputPayload struct {
+	RunID  string `json:"runId"`
+	Stream string `json:"stream"` // "stdout" or "stderr"
+	Line   string `json:"line"`
+}
+
+// RawChipToolExitPayload is sent as "raw_chiptool_exit" when a raw chip-tool run ends.
+type RawChipToolExitPayload struct {
+	RunID      string `json:"runId"`
+	ExitCode   int    `json:"exitCode"`
+	Error      string `json:"error,omitempty"` // Why it didn't exit normally: timeout, cancelled...
+	DurationMs int64  `json:"durationMs"`
+}
+
+// rawChipToolFlags are the optional chip-tool flags a raw run may pass besides the identity flags.
+// They only shape the interaction; flags that read or write files on the host, such as
+// --paa-trust-store-path or --trace_file, aren't listed and are refused.
+var rawChipToolFlags = map[string]bool{
+	"--timeout": true, "--min-interval": true, "--max-interval": true, "--keepSubscriptions": true,
+	"--auto-resubscribe": true, "--fabric-filtered": true, "--data-version": true, "--is-urgent": true,
+	"--timedInteractionTimeoutMs": true, "--suppressResponse": true, "--busyWaitForMs": true,
+	"--repeat-count": true, "--repeat-delay-ms": true, "--allow-large-payload": true,
+}
+
+// rawChipToolRun is a running raw chip-tool command.
+type rawChipToolRun struct {
+	client *Client
+	cancel context.CancelFunc
+}
+
+// RawChipTool runs allowlisted chip-tool commands for the admin API, streaming their output to
+// the client that asked. It is an escape hatch for lab users who would otherwise need SSH. Runs
+// are killed when their client disconnects.
+type RawChipTool struct {
+	mu     sync.Mutex
+	runs   map[string]rawChipToolRun // Running commands, by run ID
+	nextID atomic.Uint64
+}
+
+// NewRawChipTool creates a RawChipTool with nothing running.
+func NewRawChipTool() *RawChipTool {
+	return &RawChipTool{runs: make(map[string]rawChipToolRun)}
+}
+
+// rawChipToolAllowed checks chip-tool arguments against admin.rawChipTool: each entry is a
+// command prefix such as "onoff", "descriptor read" or "*" for everything. Identity flags must be
+// listed in chipToolIdentities, other flags in rawChipToolFlags, and the interactive mode, which
+// needs a terminal, is refused.
+func rawChipToolAllowed(args []string) error {
+	allow := appConfig.Admin.RawChipTool
+	if len(allow) == 0 {
+		return errors.New("raw chip-tool commands are disabled: admin.rawChipTool is empty")
+	}
+	var words []string
+	for i := 0; i < len(args); i++ {
+		flag := strings.SplitN(args[i], "=", 2)[0]
+		switch {
+		case flag != args[i] && (rawChipToolFlags[flag] || flag == "--storage-directory" || flag == "--commissioner-name"):
+			return fmt.Errorf("pass %s as two arguments", flag)
+		case args[i] == "--storage-directory" || args[i] == "--commissioner-name":
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s needs a value", args[i])
+			}
+			storage, name := "", args[i+1]
+			if args[i] == "--storage-directory" {
+				storage, name = args[i+1], ""
+			}
+			if err := validateChipToolIdentity(storage, name); err != nil {
+				return err
+			}
+			i++
+		case rawChipToolFlags[args[i]]:
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s needs a value", args[i])
+			}
+			i++
+		case strings.HasPrefix(args[i], "--"):
+			return fmt.Errorf("chip-tool flag %s is not allowed in raw runs", flag)
+		default:
+			words = append(words, args[i])
+		}
+	}
+	if len(words) == 0 || words[0] == "interactive" {
+		return errors.New("a chip-tool command is required, and the interactive mode isn't available")
+	}
+	for _, entry := range allow {
+		prefix := strings.Fields(entry)
+		if entry == "*" || (len(prefix) > 0 && len(prefix) <= len(words) && strings.EqualFold(strings.Join(words[:len(prefix)], " "), strings.Join(prefix, " "))) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not allowed by admin.rawChipTool", strings.Join(words, " "))
+}
+
+// Start runs a chip-tool command in the background and returns its run ID. Output lines are sent
+// as they come, then the exit status; the run is killed after timeout or on Cancel.
+func (r *RawChipTool) Start(client *Client, args []string, timeout time.Duration) (string, error) {
+	if err := rawChipToolAllowed(args); err != nil {
+		return "", err
+	}
+	runID := fmt.Sprintf("raw-%d", r.nextID.Add(1))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	cmd := exec.CommandContext(ctx, chipToolPath, withChipToolStorage(args)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return "", err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		cancel()
+		return "", err
+	}
+	release := chipToolWatcher.Begin()
+	started := time.Now()
+	if err := cmd.Start(); err != nil {
+		release()
+		cancel()
+		return "", err
+	}
+	r.mu.Lock()
+	r.runs[runID] = rawChipToolRun{client: client, cancel: cancel}
+	r.mu.Unlock()
+	log.Printf("[%s] Raw chip-tool run for %s: %s", runID, client.logName(), strings.Join(args, " "))
+
+	var wg sync.WaitGroup
+	stream := func(name string, pipe io.Reader) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(pipe)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			client.sendPayload("raw_chiptool_output", RawChipToolOutputPayload{RunID: runID, Stream: name, Line: stripAnsi(scanner.Text())})
+		}
+	}
+	wg.Add(2)
+	go stream("stdout", stdout)
+	go stream("stderr", stderr)
+	go func() {
+		wg.Wait()
+		err := cmd.Wait()
+		release()
+		exit := RawChipToolExitPayload{RunID: runID, ExitCode: cmd.ProcessState.ExitCode(), DurationMs: time.Since(started).Milliseconds()}
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			exit.Error = fmt.Sprintf("killed after %v", timeout)
+		case errors.Is(ctx.Err(), context.Canceled):
+			exit.Error = "cancelled"
+		case err != nil:
+			exit.Error = err.Error()
+		}
+		cancel()
+		r.mu.Lock()
+		delete(r.runs, runID)
+		r.mu.Unlock()
+		client.audit("raw_chiptool_exit", map[string]interface{}{"runId": runID, "args": args, "exitCode": exit.ExitCode, "error": exit.Error})
+		client.sendPayload("raw_chiptool_exit", exit)
+	}()
+	return runID, nil
+}
+
+// Cancel kills a running command.
+func (r *RawChipTool) Cancel(runID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[runID]
+	if !ok {
+		return fmt.Errorf("no raw chip-tool run %q is running", runID)
+	}
+	run.cancel()
+	return nil
+}
+
+// Release kills the commands a disconnected client was running.
+func (r *RawChipTool) Release(client *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, run := range r.runs {
+		if run.client == client {
+			run.cancel()
+		}
+	}
+}
+
+func handleRawChipTool(client *Client, payload RawChipToolPayload) {
+	timeout := time.Duration(defaultRawChipToolSeconds) * time.Second
+	if payload.TimeoutSeconds > 0 {
+		timeout = time.Duration(payload.TimeoutSeconds) * time.Second
+	}
+	runID, err := rawChipTool.Start(client, payload.Args, timeout)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "raw_chiptool failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("raw_chiptool_started", RawChipToolStartedPayload{RunID: runID, Args: payload.Args})
+}
+
+func handleRawChipToolCancel(client *Client, payload RawChipToolCancelPayload) {
+	if err := rawChipTool.Cancel(payload.RunID); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "raw_chiptool_cancel failed: " + err.Error()})
+	}
+}
+
+var rawChipTool = NewRawChipTool()
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultAddressWatchIntervalSeconds is how often the operational advertisements are browsed for
+// address changes, unless addressWatch.intervalSeconds says otherwise.
+const defaultAddressWatchIntervalSeconds = 60
+
+// DeviceReaddressedPayload is broadcast as "device_readdressed" when a node is advertised at new
+// addresses, typically after its DHCP lease changed.
+type DeviceReaddressedPayload struct {
+	DeviceID          string   `json:"deviceId"`
+	NodeID            string   `json:"nodeId"`
+	PreviousAddresses []string `json:"previousAddresses"`
+	Addresses         []string `json:"addresses"`
+	Address           string   `json:"address"` // Best of Addresses (see addressing.go)
+	Resubscribed      int      `json:"resubscribed"`
+}
+
+// AddressWatcher follows the operational advertisements (_matter._tcp) of the registered nodes, so
+// a device that got a new address keeps working without anyone re-adding it: the registry gets the
+// new addresses, the device's subscriptions are restarted, as their sessions point at the old
+// address, and its warm session is forgotten. chip-tool resolves the node again on its next run.
+type AddressWatcher struct {
+	mu      sync.Mutex
+	failing bool // The last browse failed; logged once until one succeeds
+}
+
+func addressWatchInterval() time.Duration {
+	if s := appConfig.AddressWatch.IntervalSeconds; s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return defaultAddressWatchIntervalSeconds * time.Second
+}
+
+// sameAddresses compares two address lists regardless of order.
+func sameAddresses(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	x, y := slices.Clone(a), slices.Clone(b)
+	slices.Sort(x)
+	slices.Sort(y)
+	return slices.Equal(x, y)
+}
+
+// applyOperationalRecord refreshes a registered node from its operational advertisement. When the
+// node was known at other addresses, traffic is rerouted and "device_readdressed" broadcast.
+func applyOperationalRecord(device RegisteredDevice, inst OperationalInstance) error {
+	addresses := inst.Addresses
+	err := deviceRegistry.Update(device.ID, func(d *RegisteredDevice) {
+		d.Reachable, d.LastSeen = true, time.Now()
+		if len(addresses) > 0 {
+			d.Addresses, d.Address = addresses, bestAddress(addresses)
+		}
+	})
+	if err != nil || len(device.Addresses) == 0 || len(addresses) == 0 || sameAddresses(device.Addresses, addresses) {
+		return err
+	}
+	log.Printf("Node %s (%s) moved from %v to %v", device.NodeID, device.ID, device.Addresses, addresses)
+	sessionWarmer.Forget(device.NodeID)
+	restarted := subscriptions.Resubscribe(device.NodeID)
+	broadcastToClients("device_readdressed", DeviceReaddressedPayload{
+		DeviceID:          device.ID,
+		NodeID:            device.NodeID,
+		PreviousAddresses: device.Addresses,
+		Addresses:         addresses,
+		Address:           bestAddress(addresses),
+		Resubscribed:      restarted,
+	})
+	return nil
+}
+
+// Check browses the operational advertisements once and applies those of our fabric's nodes.
+func (w *AddressWatcher) Check() {
+	instances, err := browseOperationalNodes()
+	w.mu.Lock()
+	switch {
+	case err != nil && !w.failing:
+		log.Printf("Address watch: %v", err)
+	case err == nil && w.failing:
+		log.Printf("Address watch: browsing works again")
+	}
+	w.failing = err != nil
+	w.mu.Unlock()
+	if err != nil {
+		return
+	}
+	registered := deviceRegistry.List()
+	ourFabric := ourCompressedFabricID(instances, registered)
+	if ourFabric == "" {
+		return
+	}
+	for _, inst := range instances {
+		if inst.CompressedFabricID != ourFabric {
+			continue
+		}
+		for _, device := range registered {
+			if device.BridgeID != "" || !sameNodeID(device.NodeID, inst.NodeID) {
+				continue
+			}
+			if err := applyOperationalRecord(device, inst); err != nil {
+				log.Printf("Address watch: could not refresh node %s: %v", device.NodeID, err)
+			}
+			break
+		}
+	}
+}
+
+// Run checks the advertisements forever at the configured interval, unless addressWatch.disabled is set.
+func (w *AddressWatcher) Run() {
+	if appConfig.AddressWatch.Disabled {
+		return
+	}
+	for {
+		time.Sleep(addressWatchInterval())
+		w.Check()
+	}
+}
+
+var addressWatcher = &AddressWatcher{}
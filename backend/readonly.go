@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var readOnlyFlag = flag.Bool("read-only", false, "reject commissioning, device commands and writes, e.g. for a demo or kiosk dashboard")
+
+// readOnlyMessageTypes are the WebSocket messages refused in read-only mode: commissioning, device
+// commands and writes, and everything that sends them. Discovery, reads, subscriptions and the
+// backend's own settings (rules, alerts, favorites...) keep working.
+var readOnlyMessageTypes = map[string]bool{
+	"commission_device":       true,
+	"wizard_start":            true,
+	"wizard_step":             true,
+	"adopt_node":              true,
+	"device_command":          true,
+	"run_lighting_transition": true,
+	"run_macro":               true,
+	"set_mode":                true, // Mode changes run the rules triggered by them
+	"sync_time":               true,
+	"change_wifi_network":     true,
+	"export_fabric_share":     true,
+	"remove_device":           true,
+	"unpair_node":             true,
+	"raw_chiptool":            true,
+}
+
+// ReadOnlyState is the read-only mode, in GET /api/status and the read_only_mode message.
+type ReadOnlyState struct {
+	Enabled   bool      `json:"enabled"`
+	Source    string    `json:"source"` // "flag", "config" or "api"
+	ChangedAt time.Time `json:"changedAt,omitzero"`
+}
+
+// ReadOnlyMode holds the read-only switch. It starts from the -read-only flag or the readOnly
+// setting and can be toggled at runtime with set_read_only, until the next restart.
+type ReadOnlyMode struct {
+	mu    sync.RWMutex
+	state ReadOnlyState
+}
+
+// Init sets the startup state from the flag and the configuration.
+func (m *ReadOnlyMode) Init() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case *readOnlyFlag:
+		m.state = ReadOnlyState{Enabled: true, Source: "flag"}
+	case appConfig.ReadOnly:
+		m.state = ReadOnlyState{Enabled: true, Source: "config"}
+	default:
+		m.state = ReadOnlyState{Source: "config"}
+	}
+	if m.state.Enabled {
+		log.Printf("Read-only mode: commissioning, device commands and writes are rejected")
+	}
+}
+
+// Enabled reports whether read-only mode is on.
+func (m *ReadOnlyMode) Enabled() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state.Enabled
+}
+
+// State returns the read-only state.
+func (m *ReadOnlyMode) State() ReadOnlyState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state
+}
+
+// Set switches read-only mode and broadcasts the new state as read_only_mode.
+func (m *ReadOnlyMode) Set(enabled bool) ReadOnlyState {
+	m.mu.Lock()
+	changed := m.state.Enabled != enabled
+	if changed {
+		m.state = ReadOnlyState{Enabled: enabled, Source: "api", ChangedAt: time.Now()}
+	}
+	state := m.state
+	m.mu.Unlock()
+	if changed {
+		if enabled {
+			log.Printf("Read-only mode enabled")
+		} else {
+			log.Printf("Read-only mode disabled")
+		}
+		broadcastToClients("read_only_mode", state)
+	}
+	return state
+}
+
+// readOnlyMessage is the error of a request refused in read-only mode.
+func readOnlyMessage(what string) string {
+	return what + " is not allowed: the backend is in read-only mode."
+}
+
+// readOnlyMiddleware refuses the messages of readOnlyMessageTypes while read-only mode is on, and
+// always to the clients that connected read-only (see admission.go).
+func readOnlyMiddleware(msgType string, next HandlerFunc) HandlerFunc {
+	return func(client *Client, msg ClientMessage) {
+		if readOnlyMessageTypes[msgType] && readOnly.Enabled() {
+			client.notifyClient("error", map[string]interface{}{"message": readOnlyMessage(msgType), "code": errCodeReadOnly})
+			return
+		}
+		if readOnlyMessageTypes[msgType] && client.base().readOnly {
+			client.notifyClient("error", map[string]interface{}{"message": msgType + " is not allowed: this connection is read-only (readonly=true).", "code": errCodeReadOnly})
+			return
+		}
+		next(client, msg)
+	}
+}
+
+// rejectReadOnlyREST answers 403 to a REST request changing devices while read-only mode is on,
+// and reports whether it did.
+func rejectReadOnlyREST(c *gin.Context, what string) bool {
+	if !readOnly.Enabled() {
+		return false
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": readOnlyMessage(what), "code": errCodeReadOnly})
+	return true
+}
+
+// SetReadOnlyPayload toggles read-only mode (admin API).
+type SetReadOnlyPayload struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// Validate requires enabled.
+func (p SetReadOnlyPayload) Validate() error {
+	if p.Enabled == nil {
+		return &ValidationError{Fields: []FieldError{{Field: "enabled", Message: "is required"}}}
+	}
+	return nil
+}
+
+func handleSetReadOnly(client *Client, payload SetReadOnlyPayload) {
+	client.sendPayload("read_only_mode", readOnly.Set(*payload.Enabled))
+}
+
+func handleGetReadOnly(client *Client) {
+	client.sendPayload("read_only_mode", readOnly.State())
+}
+
+var readOnly = &ReadOnlyMode{}
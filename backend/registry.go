@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// devicesFile is where the device registry is persisted, relative to the working directory.
+const devicesFile = "devices.json"
+
+// RegisteredDevice is a device known to the gateway. Most devices are a whole node, but each device
+// behind a Matter bridge is registered separately with the bridged endpoint it lives on.
+type RegisteredDevice struct {
+	ID            string             `json:"id"`         // NodeID for regular devices, "<nodeId>:<endpointId>" for bridged ones
+	NodeID        string             `json:"nodeId"`     // Operational node ID (the bridge's node ID for bridged devices)
+	EndpointID    string             `json:"endpointId"` // Endpoint commands are sent to
+	Name          string             `json:"name,omitempty"`
+	Room          string             `json:"room,omitempty"`
+	Favorite      bool               `json:"favorite,omitempty"`      // Favorites are kept warm by the SessionWarmer
+	Hostname      string             `json:"hostname,omitempty"`      // DNS-SD host name seen at commissioning
+	InstanceName  string             `json:"instanceName,omitempty"`  // Commissionable instance name seen at commissioning
+	Discriminator string             `json:"discriminator,omitempty"` // Long discriminator used at commissioning
+	VendorID      string             `json:"vendorId,omitempty"`
+	ProductID     string             `json:"productId,omitempty"`
+	DeviceTypes   []uint32           `json:"deviceTypes,omitempty"`
+	IsBridge      bool               `json:"isBridge,omitempty"`  // Node exposes an Aggregator endpoint
+	BridgeID      string             `json:"bridgeId,omitempty"`  // Registry ID of the bridge, for bridged devices
+	Endpoints     []EndpointInfo     `json:"endpoints,omitempty"` // Composition of multi-endpoint devices, with semantic tags
+	Reachable     bool               `json:"reachable"`
+	Addresses     []string           `json:"addresses,omitempty"` // IP addresses from the last operational discovery, link-local ones with their zone
+	Address       string             `json:"address,omitempty"`   // Best of Addresses for direct interactions (see addressing.go)
+	LastSeen      time.Time          `json:"lastSeen,omitzero"`   // Last operational advertisement seen
+	Health        string             `json:"health,omitempty"`    // "degraded" when command latency/error rate exceed the thresholds
+	Orphaned      bool               `json:"orphaned,omitempty"`  // No longer resolves on the fabric (see removal.go)
+	Battery       *BatteryStatus     `json:"battery,omitempty"`   // Battery level of battery powered devices (see battery.go)
+	Version       *DeviceVersionInfo `json:"version,omitempty"`   // Firmware/hardware versions and serial number (see firmware.go)
+	Virtual       *VirtualDevice     `json:"virtual,omitempty"`   // Definition of a computed entity, never stored in the registry (see virtual.go)
+	Remote        string             `json:"remote,omitempty"`    // Remote hub the device is on, never stored in the registry (see federation.go)
+	CreatedAt     time.Time          `json:"createdAt"`
+	UpdatedAt     time.Time          `json:"updatedAt"`
+}
+
+// DeviceRegistry stores the devices commissioned through the gateway.
+type DeviceRegistry struct {
+	mu      sync.RWMutex
+	devices map[string]*RegisteredDevice
+	path    string
+}
+
+// NewDeviceRegistry creates a registry persisting its devices to path.
+func NewDeviceRegistry(path string) *DeviceRegistry {
+	return &DeviceRegistry{devices: make(map[string]*RegisteredDevice), path: path}
+}
+
+// bridgedDeviceID builds the registry ID of a device behind a bridge.
+func bridgedDeviceID(nodeID, endpointID string) string {
+	return fmt.Sprintf("%s:%s", nodeID, endpointID)
+}
+
+// Load reads the persisted registry. A missing file is not an error.
+func (r *DeviceRegistry) Load() error {
+	var devices []*RegisteredDevice
+	if err := loadJSONFile(r.path, &devices); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, device := range devices {
+		r.devices[device.ID] = device
+	}
+	log.Printf("Loaded %d device(s) from %s", len(devices), r.path)
+	return nil
+}
+
+// save writes the registry to disk. Callers must hold r.mu.
+func (r *DeviceRegistry) save() error {
+	return saveJSONFile(r.path, r.listLocked())
+}
+
+func (r *DeviceRegistry) listLocked() []RegisteredDevice {
+	devices := make([]RegisteredDevice, 0, len(r.devices))
+	for _, device := range r.devices {
+		devices = append(devices, *device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices
+}
+
+// List returns all registered devices sorted by ID.
+func (r *DeviceRegistry) List() []RegisteredDevice {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.listLocked()
+}
+
+// Get returns a device by registry ID.
+func (r *DeviceRegistry) Get(id string) (RegisteredDevice, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	device, ok := r.devices[id]
+	if !ok {
+		return RegisteredDevice{}, false
+	}
+	return *device, true
+}
+
+// Put adds or replaces a device, keeping its original creation time.
+func (r *DeviceRegistry) Put(device RegisteredDevice) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if existing, ok := r.devices[device.ID]; ok {
+		device.CreatedAt = existing.CreatedAt
+	} else {
+		device.CreatedAt = now
+	}
+	device.UpdatedAt = now
+	r.devices[device.ID] = &device
+	return r.save()
+}
+
+// DeviceReachabilityPayload is broadcast as "device_reachability" when a registered device goes
+// offline or comes back.
+type DeviceReachabilityPayload struct {
+	DeviceID   string `json:"deviceId"`
+	NodeID     string `json:"nodeId"`
+	EndpointID string `json:"endpointId"`
+	Reachable  bool   `json:"reachable"`
+}
+
+// Update applies fn to a registered device and persists the result. A change of reachability is
+// broadcast as "device_reachability".
+func (r *DeviceRegistry) Update(id string, fn func(*RegisteredDevice)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	device, ok := r.devices[id]
+	if !ok {
+		return fmt.Errorf("device %q not found", id)
+	}
+	wasReachable := device.Reachable
+	fn(device)
+	device.UpdatedAt = time.Now()
+	if device.Reachable != wasReachable {
+		broadcastToClients("device_reachability", DeviceReachabilityPayload{DeviceID: device.ID, NodeID: device.NodeID, EndpointID: device.EndpointID, Reachable: device.Reachable})
+	}
+	return r.save()
+}
+
+// Delete removes devices by registry ID. Unknown IDs are ignored.
+func (r *DeviceRegistry) Delete(ids ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range ids {
+		delete(r.devices, id)
+	}
+	return r.save()
+}
+
+// ApplyAttributeUpdate keeps registry fields that mirror attributes (reachability, names, battery) up to date.
+func (r *DeviceRegistry) ApplyAttributeUpdate(update AttributeUpdatePayload) {
+	if update.Cluster == "PowerSource" {
+		r.applyPowerSourceUpdate(update)
+		return
+	}
+	if strings.EqualFold(update.Cluster, "BasicInformation") && update.Attribute == "software-version" {
+		r.applySoftwareVersionUpdate(update)
+		return
+	}
+	if update.Cluster != "BridgedDeviceBasicInformation" {
+		return
+	}
+	id := bridgedDeviceID(update.NodeID, update.EndpointID)
+	if _, ok := r.Get(id); !ok {
+		return
+	}
+	err := r.Update(id, func(device *RegisteredDevice) {
+		switch update.Attribute {
+		case "reachable":
+			if reachable, ok := update.Value.(bool); ok {
+				device.Reachable = reachable
+			}
+		case "node-label":
+			if label, ok := update.Value.(string); ok && label != "" {
+				device.Name = label
+			}
+		}
+	})
+	if err != nil {
+		log.Printf("Could not update registry entry %s from %s.%s: %v", id, update.Cluster, update.Attribute, err)
+	}
+}
+
+// applyPowerSourceUpdate mirrors the battery attributes of a node endpoint in its registry device.
+func (r *DeviceRegistry) applyPowerSourceUpdate(update AttributeUpdatePayload) {
+	id, ok := deviceIDForTarget(update.NodeID, update.EndpointID)
+	if !ok {
+		return
+	}
+	if err := r.Update(id, func(device *RegisteredDevice) { applyBatteryUpdate(device, update) }); err != nil {
+		log.Printf("Could not update the battery of %s: %v", id, err)
+	}
+}
+
+// applySoftwareVersionUpdate records a reported software version, e.g. after an OTA update. A new
+// version invalidates the node's cached introspection reads; refresh_device_version reads the
+// version strings again.
+func (r *DeviceRegistry) applySoftwareVersionUpdate(update AttributeUpdatePayload) {
+	f, ok := toFloat(update.Value)
+	device, found := r.Get(update.NodeID)
+	if !ok || !found || device.BridgeID != "" {
+		return
+	}
+	version := uint64(f)
+	if device.Version != nil && device.Version.SoftwareVersion != nil && *device.Version.SoftwareVersion == version {
+		return
+	}
+	err := r.Update(update.NodeID, func(device *RegisteredDevice) {
+		if device.Version == nil {
+			device.Version = &DeviceVersionInfo{}
+		}
+		device.Version.SoftwareVersion = &version
+		device.Version.ReadAt = time.Now()
+	})
+	if err != nil {
+		log.Printf("Could not update the software version of node %s: %v", update.NodeID, err)
+		return
+	}
+	log.Printf("Node %s reports software version %d", update.NodeID, version)
+	introspectionCache.Invalidate(update.NodeID, fmt.Sprintf("software version %d reported", version))
+}
+
+// resolveDeviceTarget returns the node and endpoint commands for a registry device must be sent to.
+func (r *DeviceRegistry) resolveDeviceTarget(id string) (string, string, error) {
+	device, ok := r.Get(id)
+	if !ok {
+		return "", "", fmt.Errorf("device %q is not in the registry", id)
+	}
+	return device.NodeID, device.EndpointID, nil
+}
+
+var deviceRegistry = NewDeviceRegistry(devicesFile)
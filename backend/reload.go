@@ -0,0 +1,187 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// restartSettings are the settings only read at startup, by their JSON path: changing them in a
+// reload is reported, but they apply after a restart. Everything else is read where it is used,
+// or re-applied by applyReloadedConfig, and takes effect with the reload.
+var restartSettings = map[string]bool{
+	"controller":                   true,
+	"matterServerApi":              true,
+	"admin.listen":                 true,
+	"coap.listen":                  true,
+	"telemetry":                    true,
+	"api":                          true,
+	"storage":                      true,
+	"basePath":                     true,
+	"trustedProxies":               true,
+	"chipToolPath":                 true,
+	"chipToolMissing":              true,
+	"chipToolCheckIntervalSeconds": true,
+	"heartbeatIntervalSeconds":     true,
+	"slowConsumer.queuePercent":    true,
+	"slowConsumer.seconds":         true,
+	"timeSync.enabled":             true,
+	"timeSync.intervalHours":       true,
+	"readOnly":                     true, // Toggle it at runtime with set_read_only
+}
+
+// ConfigReloadResult reports a reload of the configuration file, in the "config_reloaded"
+// message and GET /api/v1/status.
+type ConfigReloadResult struct {
+	File            string    `json:"file"`
+	Trigger         string    `json:"trigger"` // "sighup" or "api"
+	At              time.Time `json:"at"`
+	Applied         []string  `json:"applied"`         // Changed settings in effect now
+	RestartRequired []string  `json:"restartRequired"` // Changed settings applied at the next restart
+	Error           string    `json:"error,omitempty"` // The file couldn't be read; the configuration is unchanged
+}
+
+// ConfigReloader reloads the configuration file on SIGHUP or on request.
+type ConfigReloader struct {
+	mu   sync.Mutex // Serializes the reloads
+	last *ConfigReloadResult
+}
+
+// Reload reads the configuration file again and applies what can be applied without a restart.
+// When the file can't be read or parsed, the configuration in use is kept.
+func (r *ConfigReloader) Reload(trigger string) (ConfigReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := ConfigReloadResult{File: configFile, Trigger: trigger, At: time.Now(), Applied: []string{}, RestartRequired: []string{}}
+	cfg := &Config{}
+	err := loadJSONFile(configFile, cfg)
+	if err == nil {
+		if _, statErr := os.Stat(configFile); statErr != nil {
+			err = statErr // A deleted file would silently reset everything to the defaults
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+		r.last = &result
+		log.Printf("WARNING: configuration not reloaded (%s): %v", trigger, err)
+		return result, err
+	}
+
+	previous := appConfig
+	for _, setting := range changedSettings("", reflect.ValueOf(*previous), reflect.ValueOf(*cfg)) {
+		if requiresRestart(setting) {
+			result.RestartRequired = append(result.RestartRequired, setting)
+		} else {
+			result.Applied = append(result.Applied, setting)
+		}
+	}
+	appConfig = cfg
+	applyReloadedConfig(previous, cfg)
+	r.last = &result
+	log.Printf("Configuration reloaded from %s (%s): applied %v, restart required for %v", configFile, trigger, result.Applied, result.RestartRequired)
+	broadcastToClients("config_reloaded", result)
+	return result, nil
+}
+
+// Last returns the latest reload, nil before the first one.
+func (r *ConfigReloader) Last() *ConfigReloadResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// applyReloadedConfig re-applies the settings that are wired up at startup but can change safely:
+// the integrations and the remote hubs. Only the sinks and hubs that changed are restarted, so the
+// subscriptions and the other sinks carry on.
+func applyReloadedConfig(previous, cfg *Config) {
+	if !reflect.DeepEqual(previous.Webhooks, cfg.Webhooks) {
+		applyWebhooks(cfg.Webhooks)
+	}
+	if !reflect.DeepEqual(previous.MQTT, cfg.MQTT) {
+		applyMQTT(cfg.MQTT)
+	}
+	applyNATS(cfg.NATS) // Unchanged settings keep their connection
+	applyAMQP(cfg.AMQP)
+	if !reflect.DeepEqual(previous.Federation, cfg.Federation) {
+		federation.Apply(cfg.Federation.Remotes)
+	}
+}
+
+// requiresRestart reports whether a setting, or the setting it is part of, is only read at startup.
+func requiresRestart(setting string) bool {
+	for path := setting; path != ""; {
+		if restartSettings[path] {
+			return true
+		}
+		i := strings.LastIndex(path, ".")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return false
+}
+
+// changedSettings lists the JSON paths of the settings that differ between two configurations,
+// descending into nested sections; lists and maps are compared as a whole.
+func changedSettings(prefix string, old, new reflect.Value) []string {
+	var changed []string
+	for i := 0; i < old.NumField(); i++ {
+		field := old.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		path := prefix + name
+		a, b := old.Field(i), new.Field(i)
+		if a.Kind() == reflect.Struct && a.Type() != reflect.TypeOf(time.Time{}) {
+			changed = append(changed, changedSettings(path+".", a, b)...)
+			continue
+		}
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
+
+// watchConfigReload reloads the configuration on SIGHUP, the usual "reload" of service managers.
+func watchConfigReload() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		_, _ = configReloader.Reload("sighup")
+	}
+}
+
+func handleReloadConfig(client *Client) {
+	result, err := configReloader.Reload("api")
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "reload_config failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("config_reloaded", result)
+}
+
+// registerConfigReloadREST adds POST /admin/config/reload to an API version group of the admin API.
+func registerConfigReloadREST(api *gin.RouterGroup) {
+	api.POST("/admin/config/reload", func(c *gin.Context) {
+		auditREST(c, "reload_config", nil)
+		result, err := configReloader.Reload("api")
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, result)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+}
+
+var configReloader = &ConfigReloader{}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reconciliation defaults, used when the config doesn't set them.
+const (
+	defaultReconcileIntervalMinutes = 60
+	defaultReconcileMaxMisses       = 3
+)
+
+// removeDevice removes a device and everything referring to it: its subscriptions, cached state
+// and history, raised alerts, warm-up and health data, rule references and registry entries. Removing a node also
+// removes the devices bridged behind it. With unpair set, the node is first removed from the fabric
+// ("pairing unpair"); the cascade only runs if that succeeds.
+func removeDevice(client *Client, deviceID string, unpair bool) (DeviceRemovedPayload, error) {
+	device, ok := deviceRegistry.Get(deviceID)
+	if !ok {
+		return DeviceRemovedPayload{}, fmt.Errorf("device %q is not in the registry", deviceID)
+	}
+	result := DeviceRemovedPayload{DeviceID: deviceID, NodeID: device.NodeID}
+
+	// A bridged device only goes away locally: its endpoint is owned by the bridge.
+	endpointID := ""
+	if device.BridgeID != "" {
+		endpointID = device.EndpointID
+	} else if unpair {
+		client.notifyClientLog("commissioning_log", fmt.Sprintf("Unpairing node %s...", device.NodeID))
+		stdout, stderr, err := runChipTool("pairing", "unpair", device.NodeID)
+		if chipToolFailed(stdout, stderr, err) {
+			return result, fmt.Errorf("unpairing node %s failed: %v %s", device.NodeID, err, strings.TrimSpace(stderr))
+		}
+		result.Unpaired = true
+	}
+
+	for _, d := range deviceRegistry.List() {
+		if d.ID == deviceID || (endpointID == "" && d.NodeID == device.NodeID) {
+			result.RemovedDevices = append(result.RemovedDevices, d.ID)
+		}
+	}
+	result.StoppedSubscriptions = subscriptions.Stop(device.NodeID, endpointID)
+	stateCache.Forget(device.NodeID, endpointID)
+	attributeHistory.Forget(device.NodeID, endpointID)
+	alertEngine.Forget(device.NodeID, endpointID)
+	attributeDebouncer.Forget(device.NodeID, endpointID)
+	driftMonitor.Forget(device.NodeID, endpointID)
+	if endpointID == "" {
+		sessionWarmer.Forget(device.NodeID)
+		deviceHealth.Forget(device.NodeID)
+		introspectionCache.Invalidate(device.NodeID, "removed")
+	}
+	deleted, modified, err := rulesEngine.RemoveDeviceReferences(device.NodeID, endpointID, result.RemovedDevices)
+	if err != nil {
+		log.Printf("Rules referring to %s not saved: %v", deviceID, err)
+	}
+	result.DeletedRules, result.ModifiedRules = deleted, modified
+	poller.Forget(result.RemovedDevices...)
+	notificationCenter.ClearDevices(result.RemovedDevices...)
+	energyReports.Forget(result.RemovedDevices...)
+	photos.Forget(result.RemovedDevices...)
+	if err := deviceRegistry.Delete(result.RemovedDevices...); err != nil {
+		return result, err
+	}
+	log.Printf("Removed device %s: %d registry entries, %d subscriptions, %d rules deleted, %d rules modified",
+		deviceID, len(result.RemovedDevices), result.StoppedSubscriptions, len(deleted), len(modified))
+	broadcastToClients("device_removed", result)
+	return result, nil
+}
+
+// Reconciler periodically checks that registered devices still resolve on the fabric. A node that
+// fails maxMisses checks in a row, or a bridged endpoint missing from its bridge, is flagged as orphaned.
+type Reconciler struct {
+	mu     sync.Mutex
+	misses map[string]int
+}
+
+// NewReconciler creates a Reconciler. Call Run to start the periodic checks.
+func NewReconciler() *Reconciler {
+	return &Reconciler{misses: make(map[string]int)}
+}
+
+func reconcileInterval() time.Duration {
+	if m := appConfig.Reconciliation.IntervalMinutes; m > 0 {
+		return time.Duration(m) * time.Minute
+	}
+	return defaultReconcileIntervalMinutes * time.Minute
+}
+
+func reconcileMaxMisses() int {
+	if n := appConfig.Reconciliation.MaxMisses; n > 0 {
+		return n
+	}
+	return defaultReconcileMaxMisses
+}
+
+// checkNode reads a cheap attribute of a node and updates its miss count. It returns whether the
+// node answered and whether it has now missed too many checks.
+func (r *Reconciler) checkNode(nodeID string) (bool, bool) {
+	_, err := readAttributeValue(nodeID, "0", "BasicInformation", "vendor-id")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		delete(r.misses, nodeID)
+		return true, false
+	}
+	r.misses[nodeID]++
+	log.Printf("Reconciliation: node %s did not answer (%d/%d): %v", nodeID, r.misses[nodeID], reconcileMaxMisses(), err)
+	return false, r.misses[nodeID] >= reconcileMaxMisses()
+}
+
+// missingBridgedEndpoints returns the registry IDs of bridged devices whose endpoint is no longer
+// listed by any Aggregator endpoint of their bridge.
+func missingBridgedEndpoints(bridgeID string, devices []RegisteredDevice) ([]string, error) {
+	aggregators, err := findAggregatorEndpoints(bridgeID)
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool)
+	for _, ep := range aggregators {
+		parts, err := readDescriptorList(bridgeID, ep, "parts-list")
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range parts {
+			present[strconv.FormatUint(uint64(part), 10)] = true
+		}
+	}
+	var missing []string
+	for _, d := range devices {
+		if d.BridgeID == bridgeID && !present[d.EndpointID] {
+			missing = append(missing, d.ID)
+		}
+	}
+	return missing, nil
+}
+
+// Reconcile checks every registered node once and returns the devices newly flagged as orphaned.
+// With autoRemove configured, orphaned devices are removed instead (without unpairing).
+func (r *Reconciler) Reconcile() []RegisteredDevice {
+	devices := deviceRegistry.List()
+	var orphanIDs []string
+	for _, device := range devices {
+		if device.BridgeID != "" {
+			continue
+		}
+		ok, orphaned := r.checkNode(device.NodeID)
+		switch {
+		case orphaned:
+			for _, d := range devices {
+				if d.NodeID == device.NodeID {
+					orphanIDs = append(orphanIDs, d.ID)
+				}
+			}
+		case ok && device.IsBridge:
+			missing, err := missingBridgedEndpoints(device.NodeID, devices)
+			if err != nil {
+				log.Printf("Reconciliation: bridged endpoints of node %s not checked: %v", device.NodeID, err)
+			}
+			orphanIDs = append(orphanIDs, missing...)
+		}
+		if ok {
+			r.clearOrphaned(device.NodeID, orphanIDs)
+		}
+	}
+
+	var flagged []RegisteredDevice
+	for _, id := range orphanIDs {
+		device, exists := deviceRegistry.Get(id)
+		if !exists || device.Orphaned {
+			continue
+		}
+		if appConfig.Reconciliation.AutoRemove {
+			if _, err := removeDevice(nil, id, false); err != nil {
+				log.Printf("Reconciliation: could not remove orphaned device %s: %v", id, err)
+			}
+			continue
+		}
+		err := deviceRegistry.Update(id, func(d *RegisteredDevice) {
+			d.Orphaned = true
+			d.Reachable = false
+		})
+		if err != nil {
+			log.Printf("Reconciliation: could not flag device %s: %v", id, err)
+			continue
+		}
+		device, _ = deviceRegistry.Get(id)
+		flagged = append(flagged, device)
+	}
+	if len(flagged) > 0 {
+		log.Printf("Reconciliation flagged %d orphaned device(s)", len(flagged))
+		broadcastToClients("orphaned_devices", DeviceListPayload{Devices: flagged})
+	}
+	return flagged
+}
+
+// clearOrphaned unflags the devices of a node that answered again, except those still orphaned.
+func (r *Reconciler) clearOrphaned(nodeID string, stillOrphaned []string) {
+	skip := make(map[string]bool)
+	for _, id := range stillOrphaned {
+		skip[id] = true
+	}
+	for _, d := range deviceRegistry.List() {
+		if d.NodeID == nodeID && d.Orphaned && !skip[d.ID] {
+			_ = deviceRegistry.Update(d.ID, func(device *RegisteredDevice) { device.Orphaned = false })
+		}
+	}
+}
+
+// Run reconciles the registry forever at the configured interval.
+func (r *Reconciler) Run() {
+	for {
+		time.Sleep(reconcileInterval())
+		r.Reconcile()
+	}
+}
+
+var reconciler = NewReconciler()
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Retention defaults, used when the configuration doesn't set them.
+const (
+	defaultRetentionIntervalMinutes = 60
+	defaultHistoryRetentionDays     = 7
+	defaultTraceRetentionHours      = 24
+	defaultAuditRetentionDays       = 90
+	defaultNotificationRetention    = 30 // Days resolved notifications are kept
+	defaultAlertHistoryDays         = 90
+	defaultLogMaxMB                 = 50
+	defaultSchemaBackupsKept        = 3
+)
+
+// RetentionConfig bounds how long the backend keeps its history, audit trail, traces,
+// notifications and logs (see retention.go). Zero values use the defaults; -1 keeps forever.
+type RetentionConfig struct {
+	IntervalMinutes   int `json:"intervalMinutes,omitempty"`   // How often the pruning runs
+	HistoryDays       int `json:"historyDays,omitempty"`       // Attribute history samples, in memory and history.jsonl
+	TraceHours        int `json:"traceHours,omitempty"`        // Request traces, by last activity
+	AuditDays         int `json:"auditDays,omitempty"`         // Records of audit.log
+	NotificationDays  int `json:"notificationDays,omitempty"`  // Resolved notifications
+	AlertHistoryDays  int `json:"alertHistoryDays,omitempty"`  // Past alerts of alert_history.json
+	LogMaxMB          int `json:"logMaxMB,omitempty"`          // backend.log is rotated to backend.log.1 beyond this size
+	SchemaBackupsKept int `json:"schemaBackupsKept,omitempty"` // Newest backups/ directories of the schema migrations
+}
+
+// retentionSetting returns a configured retention, its default when unset, or 0 for "keep forever".
+func retentionSetting(value, fallback int) int {
+	switch {
+	case value < 0:
+		return 0
+	case value == 0:
+		return fallback
+	}
+	return value
+}
+
+// retentionCutoff returns the time before which data older than n units goes, zero when kept forever.
+func retentionCutoff(now time.Time, n int, unit time.Duration) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return now.Add(-time.Duration(n) * unit)
+}
+
+// RetentionReport is the result of one pruning run, in GET /api/status and the "retention" job.
+type RetentionReport struct {
+	RanAt      time.Time      `json:"ranAt"`
+	Pruned     map[string]int `json:"pruned"` // Removed entries by kind, e.g. "history": 1200
+	FreedBytes int64          `json:"freedBytes"`
+	Errors     []string       `json:"errors,omitempty"`
+}
+
+// Retention prunes the data the backend accumulates, so a Raspberry Pi's SD card doesn't fill up.
+type Retention struct {
+	mu   sync.Mutex // Serializes the runs
+	last *RetentionReport
+}
+
+// Run prunes everything once, by the configured retention.
+func (r *Retention) Run() RetentionReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cfg := appConfig.Retention
+	now := time.Now()
+	report := RetentionReport{RanAt: now, Pruned: make(map[string]int)}
+	fail := func(kind string, err error) {
+		if err != nil {
+			report.Errors = append(report.Errors, kind+": "+err.Error())
+		}
+	}
+	if cutoff := retentionCutoff(now, retentionSetting(cfg.HistoryDays, defaultHistoryRetentionDays), 24*time.Hour); !cutoff.IsZero() {
+		report.Pruned["history"] = attributeHistory.PruneBefore(cutoff)
+	}
+	if cutoff := retentionCutoff(now, retentionSetting(cfg.TraceHours, defaultTraceRetentionHours), time.Hour); !cutoff.IsZero() {
+		report.Pruned["traces"] = traces.PruneBefore(cutoff)
+	}
+	if cutoff := retentionCutoff(now, retentionSetting(cfg.NotificationDays, defaultNotificationRetention), 24*time.Hour); !cutoff.IsZero() {
+		report.Pruned["notifications"] = notificationCenter.PruneBefore(cutoff)
+	}
+	if cutoff := retentionCutoff(now, retentionSetting(cfg.AlertHistoryDays, defaultAlertHistoryDays), 24*time.Hour); !cutoff.IsZero() {
+		report.Pruned["alertHistory"] = alertEngine.PruneHistoryBefore(cutoff)
+	}
+	if cutoff := retentionCutoff(now, retentionSetting(cfg.AuditDays, defaultAuditRetentionDays), 24*time.Hour); !cutoff.IsZero() {
+		pruned, freed, err := auditLog.PruneBefore(cutoff)
+		report.Pruned["audit"], report.FreedBytes = pruned, report.FreedBytes+freed
+		fail("audit", err)
+	}
+	if maxMB := retentionSetting(cfg.LogMaxMB, defaultLogMaxMB); maxMB > 0 {
+		freed, err := rotateLogFile(int64(maxMB) << 20)
+		if freed > 0 {
+			report.Pruned["logRotations"] = 1
+		}
+		report.FreedBytes += freed
+		fail("log", err)
+	}
+	if keep := retentionSetting(cfg.SchemaBackupsKept, defaultSchemaBackupsKept); keep > 0 {
+		pruned, freed, err := pruneSchemaBackups(keep)
+		report.Pruned["schemaBackups"], report.FreedBytes = pruned, report.FreedBytes+freed
+		fail("schemaBackups", err)
+	}
+	total := 0
+	for _, n := range report.Pruned {
+		total += n
+	}
+	if total > 0 {
+		log.Printf("Retention: pruned %v, freed %d bytes", report.Pruned, report.FreedBytes)
+	}
+	for _, err := range report.Errors {
+		log.Printf("Retention: %s", err)
+	}
+	r.last = &report
+	return report
+}
+
+// Last returns the report of the latest run, if any ran.
+func (r *Retention) Last() *RetentionReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// Loop prunes at the configured interval, forever. The first run happens right away.
+func (r *Retention) Loop() {
+	for {
+		r.Run()
+		minutes := retentionSetting(appConfig.Retention.IntervalMinutes, defaultRetentionIntervalMinutes)
+		if minutes == 0 {
+			return // -1 turns the periodic pruning off; run_retention still works
+		}
+		time.Sleep(time.Duration(minutes) * time.Minute)
+	}
+}
+
+// rotateLogFile moves backend.log to backend.log.1 once it outgrew maxBytes, replacing the previous
+// rotation, and empties it. The log is opened in append mode, so writes continue at the new end.
+func rotateLogFile(maxBytes int64) (int64, error) {
+	if logDir == "" {
+		return 0, nil
+	}
+	path := filepath.Join(logDir, logFileName)
+	info, err := os.Stat(path)
+	if err != nil || info.Size() <= maxBytes {
+		return 0, nil
+	}
+	var freed int64
+	if old, err := os.Stat(path + ".1"); err == nil {
+		freed = old.Size()
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := os.Create(path + ".1")
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return 0, err
+	}
+	if err := dst.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Truncate(path, 0); err != nil {
+		return 0, err
+	}
+	log.Printf("Retention: rotated %s (%d bytes) to %s.1", path, info.Size(), path)
+	return freed, nil
+}
+
+// pruneSchemaBackups removes all but the newest keep backups taken by the schema migrations.
+func pruneSchemaBackups(keep int) (int, int64, error) {
+	entries, err := os.ReadDir(dataFilePath(schemaBackupDir))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	if len(dirs) <= keep {
+		return 0, 0, nil
+	}
+	// Names end with the backup time, so they sort oldest first for a given version.
+	sort.Slice(dirs, func(i, j int) bool { return backupTime(dirs[i]).Before(backupTime(dirs[j])) })
+	var freed int64
+	pruned := 0
+	for _, name := range dirs[:len(dirs)-keep] {
+		path := filepath.Join(dataFilePath(schemaBackupDir), name)
+		size := directorySize(path)
+		if err := os.RemoveAll(path); err != nil {
+			return pruned, freed, err
+		}
+		pruned++
+		freed += size
+	}
+	return pruned, freed, nil
+}
+
+// backupTime reads the time a schema backup directory was taken from its name.
+func backupTime(name string) time.Time {
+	if len(name) < len("20060102-150405") {
+		return time.Time{}
+	}
+	t, _ := time.Parse("20060102-150405", name[len(name)-len("20060102-150405"):])
+	return t
+}
+
+// directorySize sums the sizes of the files under a path.
+func directorySize(path string) int64 {
+	var size int64
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// PruneBefore drops the audit records older than cutoff, from memory and from audit.log. It
+// returns the records dropped from the file and the bytes freed.
+func (a *AuditLog) PruneBefore(cutoff time.Time) (int, int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	i := sort.Search(len(a.records), func(i int) bool { return !a.records[i].Time.Before(cutoff) })
+	a.records = a.records[i:]
+
+	pruned := 0
+	var freed int64
+	err := a.file.Rewrite(func(data []byte) ([]byte, error) {
+		var kept bytes.Buffer
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+		for scanner.Scan() {
+			var record struct {
+				Time time.Time `json:"time"`
+			}
+			if json.Unmarshal(scanner.Bytes(), &record) == nil && record.Time.Before(cutoff) {
+				pruned++
+				continue
+			}
+			kept.Write(scanner.Bytes())
+			kept.WriteByte('\n')
+		}
+		freed = int64(len(data) - kept.Len())
+		return kept.Bytes(), scanner.Err()
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return pruned, freed, nil
+}
+
+// DiskUsage reports what the backend stores on disk and the space left, in GET /api/status.
+type DiskUsage struct {
+	DataBytes  int64            `json:"dataBytes"`            // Everything under the data directory
+	Files      map[string]int64 `json:"files"`                // Size of each entry of the data directory, directories summed
+	LogBytes   int64            `json:"logBytes"`             // The log directory, rotations included
+	FreeBytes  uint64           `json:"freeBytes,omitempty"`  // Available on the data directory's filesystem
+	TotalBytes uint64           `json:"totalBytes,omitempty"` // Size of that filesystem
+}
+
+// diskUsage measures the data and log directories.
+func diskUsage() DiskUsage {
+	usage := DiskUsage{Files: make(map[string]int64)}
+	if entries, err := os.ReadDir(dataFilePath(".")); err == nil {
+		for _, entry := range entries {
+			path := filepath.Join(dataFilePath("."), entry.Name())
+			if path == logDir {
+				continue // Counted as LogBytes
+			}
+			size := directorySize(path)
+			usage.Files[entry.Name()] = size
+			usage.DataBytes += size
+		}
+	}
+	if logDir != "" {
+		usage.LogBytes = directorySize(logDir)
+	}
+	usage.FreeBytes, usage.TotalBytes = filesystemSpace(dataFilePath("."))
+	return usage
+}
+
+// RetentionStatus is the "retention" part of GET /api/status.
+type RetentionStatus struct {
+	Disk    DiskUsage        `json:"disk"`
+	LastRun *RetentionReport `json:"lastRun,omitempty"`
+}
+
+// handleRunRetention prunes right away as a "retention" job, e.g. when the card is nearly full.
+func handleRunRetention(client *Client) {
+	jobs.Submit(client, "retention", func(ctx context.Context, job *Job) (interface{}, error) {
+		return retention.Run(), nil
+	})
+}
+
+var retention = &Retention{}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HandlerFunc handles one WebSocket message. Typed handlers are adapted to it by handle/handleNoPayload.
+type HandlerFunc func(client *Client, msg ClientMessage)
+
+// Middleware wraps every registered handler, e.g. for logging or authentication.
+type Middleware func(msgType string, next HandlerFunc) HandlerFunc
+
+// Validator is implemented by payloads with rules beyond `validate:"required"` tags (see decode.go).
+// It is called after decoding, so handlers only ever see valid payloads.
+type Validator interface {
+	Validate() error
+}
+
+// HandlerRegistry maps WebSocket message types to their handlers.
+type HandlerRegistry struct {
+	mu         sync.RWMutex
+	handlers   map[string]HandlerFunc
+	middleware []Middleware
+}
+
+// NewHandlerRegistry creates an empty HandlerRegistry.
+func NewHandlerRegistry() *HandlerRegistry {
+	return &HandlerRegistry{handlers: make(map[string]HandlerFunc)}
+}
+
+// Register adds the handler for a message type. A type can only be registered once.
+func (r *HandlerRegistry) Register(msgType string, handler HandlerFunc) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.handlers[msgType]; exists {
+		return fmt.Errorf("a handler for message type %q is already registered", msgType)
+	}
+	r.handlers[msgType] = handler
+	return nil
+}
+
+// Use appends a middleware. Middleware run in the order they were added, before the handler.
+func (r *HandlerRegistry) Use(mw Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middleware = append(r.middleware, mw)
+}
+
+// Types returns the registered message types, sorted.
+func (r *HandlerRegistry) Types() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	types := make([]string, 0, len(r.handlers))
+	for msgType := range r.handlers {
+		types = append(types, msgType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Dispatch runs the handler registered for msg.Type through the middleware chain.
+// It returns false when no handler is registered for the type.
+func (r *HandlerRegistry) Dispatch(client *Client, msg ClientMessage) bool {
+	r.mu.RLock()
+	handler, ok := r.handlers[msg.Type]
+	middleware := r.middleware
+	r.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](msg.Type, handler)
+	}
+	handler(client, msg)
+	return true
+}
+
+// handle registers a handler taking a decoded payload. Invalid payloads are answered with an "error" message.
+func handle[T any](r *HandlerRegistry, msgType string, fn func(client *Client, payload T)) {
+	err := r.Register(msgType, func(client *Client, msg ClientMessage) {
+		payload, err := decodePayload[T](msg.Payload)
+		if err != nil {
+			client.notifyClient("error", invalidPayloadError(msgType, err))
+			return
+		}
+		fn(client, payload)
+	})
+	if err != nil {
+		log.Fatalf("Handler registration failed: %v", err)
+	}
+}
+
+// handleNoPayload registers a handler for a message type without payload.
+func handleNoPayload(r *HandlerRegistry, msgType string, fn func(client *Client)) {
+	if err := r.Register(msgType, func(client *Client, msg ClientMessage) { fn(client) }); err != nil {
+		log.Fatalf("Handler registration failed: %v", err)
+	}
+}
+
+// loggingMiddleware logs every handled message and how long its handler took.
+func loggingMiddleware(msgType string, next HandlerFunc) HandlerFunc {
+	return func(client *Client, msg ClientMessage) {
+		started := time.Now()
+		next(client, msg)
+		debugf("Handled %s (requestId %q) in %s", msgType, msg.RequestID, time.Since(started).Round(time.Millisecond))
+	}
+}
+
+// authMiddleware rejects messages from unauthenticated clients when an authToken is configured.
+// Clients authenticate with the "authenticate" message or the ?token= query parameter of /ws.
+func authMiddleware(msgType string, next HandlerFunc) HandlerFunc {
+	return func(client *Client, msg ClientMessage) {
+		if msgType != "authenticate" && msgType != "identify" && appConfig.AuthToken != "" && !client.isAuthenticated() {
+			client.notifyClient("error", map[string]interface{}{"message": "Not authenticated: send an authenticate message first.", "code": errCodeUnauthenticated})
+			return
+		}
+		next(client, msg)
+	}
+}
+
+// messageHandlers is the registry of built-in message types. Custom handlers (plugins.go) are added to it too.
+var messageHandlers = newBuiltinHandlers()
+
+func newBuiltinHandlers() *HandlerRegistry {
+	r := NewHandlerRegistry()
+	r.Use(loggingMiddleware)
+	r.Use(authMiddleware)
+	r.Use(adminMiddleware)
+	r.Use(readOnlyMiddleware)
+	r.Use(federationMiddleware) // Before the local Matter checks: a remote hub may work when this one can't
+	r.Use(degradedMiddleware)
+	r.Use(maintenanceMiddleware)
+	r.Use(quotaMiddleware)
+	r.Use(captureMiddleware) // Last: only requests every other check let through start a capture
+
+	handle(r, "authenticate", handleAuthenticate)
+	handle(r, "identify", handleIdentify)
+	handleNoPayload(r, "get_quota", handleGetQuota)
+	handle(r, "set_unit_preferences", handleSetUnitPreferences)
+	handleNoPayload(r, "get_unit_preferences", handleGetUnitPreferences)
+	handle(r, "disconnect_client", handleDisconnectClient)
+	handle(r, "raw_chiptool", handleRawChipTool)
+	handle(r, "raw_chiptool_cancel", handleRawChipToolCancel)
+	handle(r, "export_fabric_share", handleExportFabricShare)
+	handle(r, "run_lighting_transition", handleRunLightingTransition)
+	handle(r, "discover_devices", handleDiscoverDevices)
+	handle(r, "commission_device", handleCommissionDevice)
+	handle(r, "device_command", handleDeviceCommand)
+	handle(r, "subscribe_attribute", handleSubscribeAttribute)
+	handle(r, "subscribe_sensor_bundle", handleSubscribeSensorBundle)
+	handle(r, "subscribe_switch_events", handleSubscribeSwitchEvents)
+	handle(r, "focus_device", handleFocusDevice)
+	handleNoPayload(r, "list_disabled_subscriptions", handleListDisabledSubscriptions)
+	handle(r, "enable_subscription", handleEnableSubscription)
+	handleNoPayload(r, "list_devices", handleListDevices)
+	handleNoPayload(r, "get_dashboard", handleGetDashboard)
+	handleNoPayload(r, "get_chip_tool_info", handleGetChipToolInfo)
+	handle(r, "get_device", handleGetDevice)
+	handle(r, "refresh_device_version", handleRefreshDeviceVersion)
+	handle(r, "remove_device", handleRemoveDevice)
+	handleNoPayload(r, "reconcile_devices", handleReconcileDevices)
+	handleNoPayload(r, "discover_operational", handleDiscoverOperational)
+	handle(r, "diagnose_device", handleDiagnoseDevice)
+	handle(r, "benchmark_device", handleBenchmarkDevice)
+	handle(r, "scan_wifi", handleScanWifi)
+	handle(r, "check_bluetooth", handleCheckBluetooth)
+	handle(r, "inspect_certificates", handleInspectCertificates)
+	handleNoPayload(r, "list_jobs", handleListJobs)
+	handleNoPayload(r, "list_polling_profiles", handleListPollingProfiles)
+	handle(r, "set_polling_profile", handleSetPollingProfile)
+	handle(r, "delete_polling_profile", handleDeletePollingProfile)
+	handleNoPayload(r, "check_fabric", handleCheckFabric)
+	handleNoPayload(r, "check_state_drift", handleCheckStateDrift)
+	handle(r, "adopt_node", handleAdoptNode)
+	handle(r, "unpair_node", handleUnpairNode)
+	handle(r, "cancel_job", handleCancelJob)
+	handle(r, "discover_bridged_devices", handleDiscoverBridgedDevices)
+	handle(r, "describe_endpoints", handleDescribeEndpoints)
+	handle(r, "get_capabilities", handleGetCapabilities)
+	handleNoPayload(r, "get_introspection_cache", handleGetIntrospectionCache)
+	handle(r, "clear_introspection_cache", handleClearIntrospectionCache)
+	handle(r, "change_wifi_network", handleChangeWiFiNetwork)
+	handle(r, "set_favorite", handleSetFavorite)
+	handleNoPayload(r, "get_hub_stats", handleGetHubStats)
+	handleNoPayload(r, "wizard_start", handleWizardStart)
+	handle(r, "wizard_step", handleWizardStep)
+	handle(r, "wizard_get", handleWizardGet)
+	handleNoPayload(r, "list_wizards", handleListWizards)
+	handle(r, "wizard_cancel", handleWizardCancel)
+	handle(r, "get_energy_report", handleGetEnergyReport)
+	handleNoPayload(r, "get_mode", handleGetMode)
+	handle(r, "set_mode", handleSetMode)
+	handle(r, "sync_time", handleSyncTime)
+	handleNoPayload(r, "get_latency_metrics", handleGetLatencyMetrics)
+	handleNoPayload(r, "get_device_health", handleGetDeviceHealth)
+	handleNoPayload(r, "list_rules", handleListRules)
+	handle(r, "add_rule", handleAddRule)
+	handle(r, "delete_rule", handleDeleteRule)
+	handleNoPayload(r, "list_macros", handleListMacros)
+	handle(r, "add_macro", handleAddMacro)
+	handle(r, "delete_macro", handleDeleteMacro)
+	handle(r, "run_macro", handleRunMacro)
+	handleNoPayload(r, "list_virtual_devices", handleListVirtualDevices)
+	handle(r, "add_virtual_device", handleAddVirtualDevice)
+	handle(r, "delete_virtual_device", handleDeleteVirtualDevice)
+	handleNoPayload(r, "list_alert_rules", handleListAlertRules)
+	handle(r, "add_alert_rule", handleAddAlertRule)
+	handle(r, "delete_alert_rule", handleDeleteAlertRule)
+	handleNoPayload(r, "list_alerts", handleListAlerts)
+	handleNoPayload(r, "run_retention", handleRunRetention)
+	handle(r, "set_read_only", handleSetReadOnly)
+	handleNoPayload(r, "get_read_only", handleGetReadOnly)
+	handle(r, "start_maintenance", handleStartMaintenance)
+	handleNoPayload(r, "end_maintenance", handleEndMaintenance)
+	handleNoPayload(r, "reload_config", handleReloadConfig)
+	handle(r, "set_feature_flag", handleSetFeatureFlag)
+	handle(r, "start_capture", handleStartCapture)
+	handle(r, "stop_capture", handleStopCapture)
+	handleNoPayload(r, "list_captures", handleListCaptures)
+	handleNoPayload(r, "get_feature_flags", handleGetFeatureFlags)
+	handleNoPayload(r, "get_maintenance", handleGetMaintenance)
+	handle(r, "list_notifications", handleListNotifications)
+	handle(r, "acknowledge_notification", handleAcknowledgeNotification)
+	handle(r, "resolve_notification", handleResolveNotification)
+	handle(r, "get_sensor_readings", handleGetSensorReadings)
+	handle(r, "get_attribute_history", handleGetAttributeHistory)
+	handleNoPayload(r, "list_custom_messages", handleListCustomMessages)
+	handle(r, "get_ui_preferences", handleGetUIPreferences)
+	handle(r, "set_ui_preferences", handleSetUIPreferences)
+	return r
+}
+
+// invalidPayloadError builds the "error" message payload for a payload that failed decodePayload.
+func invalidPayloadError(msgType string, err error) map[string]interface{} {
+	reply := map[string]interface{}{"message": fmt.Sprintf("Invalid %s payload: %v", msgType, err), "code": errCodeInvalidPayload}
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		reply["fields"] = verr.Fields
+	}
+	return reply
+}
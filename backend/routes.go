@@ -0,0 +1,291 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// registerAPIRoutes adds the REST endpoints of the main listener to an API version group: paths
+// are relative to its prefix, e.g. /status is served at /api/v1/status.
+func registerAPIRoutes(api *gin.RouterGroup, hub *Hub) {
+	// Health and configuration overview
+	api.GET("/status", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"status":            "Matter Backend Running",
+			"websocket_clients": hub.Stats().Clients,
+			"directories":       describeDataDirs(),
+			"schema":            schemaStatus(),
+			"readOnly":          readOnly.State(),
+			"maintenance":       maintenance.State(),
+			"chipTool":          chipToolSelection,
+			"degraded":          degradedMode.State(),
+			"retention":         RetentionStatus{Disk: diskUsage(), LastRun: retention.Last()},
+			"storage":           batchWriterStatuses(),
+			"api":               apiMetrics.Status(),
+			"setupRequired":     setup.Required(),
+			"configReload":      configReloader.Last(),
+			"features":          featureFlags.List(),
+			"federation":        federation.Status(),
+			"coap":              coapServer.Status(),
+		})
+	})
+
+	// Feature flags, toggled on the admin API
+	api.GET("/features", func(c *gin.Context) {
+		c.JSON(http.StatusOK, FeatureFlagsPayload{Flags: featureFlags.List()})
+	})
+
+	// First-run setup, driven by the frontend when there is no configuration file yet
+	registerSetupRoutes(api)
+
+	// Onboarding sessions, to resume an interrupted onboarding (steps are sent over /ws)
+	api.GET("/wizards", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"sessions": wizards.List()})
+	})
+	api.GET("/wizards/:id", func(c *gin.Context) {
+		session, ok := wizards.Get(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no such onboarding session"})
+			return
+		}
+		c.JSON(http.StatusOK, session)
+	})
+
+	// Energy consumption per device and room, e.g. /api/v1/energy?period=week&from=2024-01-01&to=2024-01-31
+	api.GET("/energy", func(c *gin.Context) {
+		query := EnergyReportPayload{Period: c.Query("period"), From: c.Query("from"), To: c.Query("to")}
+		if err := query.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": err.(*ValidationError).Fields})
+			return
+		}
+		c.JSON(http.StatusOK, energyReports.Report(query))
+	})
+
+	// House mode (home/away/night); changes are broadcast as mode_changed
+	api.GET("/mode", func(c *gin.Context) {
+		c.JSON(http.StatusOK, houseModes.Current())
+	})
+	api.PUT("/mode", func(c *gin.Context) {
+		if rejectReadOnlyREST(c, "set_mode") {
+			return
+		}
+		var payload SetModePayload
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := payload.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": err.(*ValidationError).Fields})
+			return
+		}
+		mode, err := houseModes.Set(payload.Mode, modeSourceManual)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, mode)
+	})
+
+	// Network health: the Thread border router's state, topology and dataset, and the Thread devices
+	api.GET("/network", func(c *gin.Context) {
+		c.JSON(http.StatusOK, networkOverview(c.Query("refresh") == "true"))
+	})
+
+	// Nearby Wi-Fi networks and channel congestion, when wifiScan.enabled; a recent scan is reused
+	// unless ?refresh=true
+	api.GET("/network/wifi", func(c *gin.Context) {
+		if !appConfig.WifiScan.Enabled {
+			c.JSON(http.StatusNotFound, gin.H{"error": errWifiScanDisabled.Error()})
+			return
+		}
+		report, err := wifiScanner.Scan(c.Request.Context(), c.Query("refresh") == "true")
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+
+	// Bluetooth adapter state; with ?scan=true also a BLE scan for the Matter devices advertising, or
+	// for the one with ?discriminator=/?shortDiscriminator=/?setupCode=. An adapter problem answers 503
+	// and a device not heard 404, with the pre-check code.
+	api.GET("/network/bluetooth", func(c *gin.Context) {
+		payload := CheckBluetoothPayload{
+			SetupCode:          c.Query("setupCode"),
+			Discriminator:      c.Query("discriminator"),
+			ShortDiscriminator: c.Query("shortDiscriminator"),
+			SkipScan:           c.Query("scan") != "true",
+		}
+		if err := payload.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": err.(*ValidationError).Fields})
+			return
+		}
+		result := bluetoothPrecheck(c.Request.Context(), payload)
+		status := http.StatusOK
+		if result.Code == errCodeBLEDeviceNotFound {
+			status = http.StatusNotFound
+		} else if !result.Success {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, result)
+	})
+
+	// Last time sync of each node; sync_time runs one on demand
+	api.GET("/time-sync", func(c *gin.Context) {
+		c.JSON(http.StatusOK, timeSync.Status())
+	})
+
+	// Cached structural reads (see introspection.go)
+	api.GET("/introspection-cache", func(c *gin.Context) {
+		c.JSON(http.StatusOK, introspectionCache.Stats())
+	})
+
+	// Client counts, delivered messages per topic and uptime; the connections are on the admin API
+	api.GET("/hub", func(c *gin.Context) {
+		c.JSON(http.StatusOK, hub.Stats().Summary())
+	})
+
+	// Outbound event journals of the webhooks and MQTT: undelivered events and the last error
+	api.GET("/journals", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"journals": journalStatuses()})
+	})
+
+	// Cold vs warm command latency, to judge the effect of pre-warming favorites
+	api.GET("/metrics/latency", func(c *gin.Context) {
+		c.JSON(http.StatusOK, sessionWarmer.Metrics())
+	})
+
+	// Per-device latency percentiles and error rates
+	api.GET("/metrics/devices", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"devices": deviceHealth.Reports()})
+	})
+
+	// Trace bundles of requests sent with "trace": true, for bug reports
+	api.GET("/traces", func(c *gin.Context) {
+		c.JSON(http.StatusOK, traces.List())
+	})
+	api.GET("/traces/:requestId", func(c *gin.Context) {
+		trace, ok := traces.Get(c.Param("requestId"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no trace for this request ID"})
+			return
+		}
+		c.Header("Content-Disposition", `attachment; filename="trace-`+sanitizeFileName(trace.RequestID)+`.json"`)
+		c.JSON(http.StatusOK, trace)
+	})
+
+	// OpenTelemetry export status
+	api.GET("/telemetry", func(c *gin.Context) {
+		c.JSON(http.StatusOK, tracer.Stats())
+	})
+
+	// The installed chip-tool binary and the command sets it supports
+	api.GET("/chip-tool", func(c *gin.Context) {
+		c.JSON(http.StatusOK, chipToolWatcher.Info())
+	})
+
+	// Everything the frontend shows on load in one call: counts, rooms, favorites and alerts
+	api.GET("/dashboard", func(c *gin.Context) {
+		dashboard := buildDashboard()
+		jsonWithETagOf(c, dashboard, dashboard.withoutGenerationTime())
+	})
+
+	// Devices commissioned through the gateway, including devices behind bridges. These device
+	// endpoints answer If-None-Match with 304 when nothing changed (see etag.go)
+	api.GET("/devices", func(c *gin.Context) {
+		jsonWithETag(c, gin.H{"devices": listDevices()})
+	})
+
+	api.GET("/devices/:id", func(c *gin.Context) {
+		device, ok := lookupDevice(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+			return
+		}
+		jsonWithETag(c, device)
+	})
+
+	// Remote hubs whose devices are listed with the local ones
+	registerFederationRoutes(api)
+
+	// Photos of the devices and rooms, uploaded as the raw image or a multipart "photo" field
+	registerPhotoRoutes(api)
+
+	// Cached attribute values of a device
+	api.GET("/devices/:id/state", func(c *gin.Context) {
+		device, ok := lookupDevice(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+			return
+		}
+		jsonWithETag(c, deviceState(device))
+	})
+
+	// Firmware versions by vendor/product, flagging devices behind the newest version seen
+	api.GET("/firmware", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"products": firmwareReport()})
+	})
+
+	// Latest state drift report; "check_state_drift" runs a check now
+	registerDriftRoutes(api)
+
+	// Device inventory and recorded telemetry as JSON or CSV, for spreadsheets and notebooks
+	registerExportRoutes(api)
+
+	// Scripted test sequences (commission, toggle, read, assert) run as jobs, with downloadable results
+	registerExperimentRoutes(api)
+
+	// Differences between the registry and chip-tool's fabric state, from the last check
+	api.GET("/fabric/discrepancies", func(c *gin.Context) {
+		c.JSON(http.StatusOK, fabricSync.Last())
+	})
+
+	// Raised alerts and the alert history
+	api.GET("/alerts", func(c *gin.Context) {
+		c.JSON(http.StatusOK, AlertsPayload{Active: alertEngine.Active(), History: alertEngine.History()})
+	})
+
+	// Notification center, most recent first; ?state=active|acknowledged|resolved and ?limit=N filter it
+	api.GET("/notifications", func(c *gin.Context) {
+		limit, _ := strconv.Atoi(c.Query("limit"))
+		c.JSON(http.StatusOK, notificationsList(c.Query("state"), limit))
+	})
+
+	// Decoded operational certificates (NOCs, trusted roots) of a node, for fabric debugging
+	api.GET("/nodes/:nodeId/certificates", func(c *gin.Context) {
+		report, err := inspectNodeCertificates(c.Param("nodeId"))
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+
+	// Background jobs (discovery, commissioning...) with their progress and results
+	api.GET("/jobs", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"jobs": jobs.List()})
+	})
+	api.GET("/jobs/:id", func(c *gin.Context) {
+		status, ok := jobs.Get(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": errJobNotFound.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, status)
+	})
+	api.POST("/jobs/:id/cancel", func(c *gin.Context) {
+		if err := jobs.Cancel(c.Param("id")); err == errJobNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"id": c.Param("id")})
+	})
+
+	// Frontend preferences (dashboard layout, favorites, theme) by user
+	registerUIPreferencesREST(api, hub)
+}
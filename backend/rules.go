@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rulesFile is where rules are persisted, relative to the working directory.
+const rulesFile = "rules.json"
+
+// RuleTrigger describes the event that fires a rule. Empty fields match anything.
+type RuleTrigger struct {
+	Type       string `json:"type"` // "button_event", "mode_changed" or "attribute"
+	NodeID     string `json:"nodeId"`
+	EndpointID string `json:"endpointId,omitempty"`
+	Event      string `json:"event,omitempty"`      // e.g. "initial_press", "multi_press_complete", "long_press"
+	Position   int    `json:"position,omitempty"`   // Switch position (button number on multi-button remotes)
+	PressCount int    `json:"pressCount,omitempty"` // For multi_press_complete, e.g. 2 for a double press
+	Mode       string `json:"mode,omitempty"`       // For mode_changed: the mode entered, e.g. "away"
+	// For attribute: the attribute watched, e.g. cluster "Virtual" and attribute "value" on node
+	// "virtual:<id>" for a virtual device. The rule fires when the value changes, to Value if set.
+	Cluster   string      `json:"cluster,omitempty"`
+	Attribute string      `json:"attribute,omitempty"`
+	Value     interface{} `json:"value,omitempty"`
+}
+
+// Rule runs a list of device commands when its trigger matches.
+type Rule struct {
+	ID      string                 `json:"id"`
+	Name    string                 `json:"name"`
+	Enabled bool                   `json:"enabled"`
+	Trigger RuleTrigger            `json:"trigger"`
+	Modes   []string               `json:"modes,omitempty"` // House modes the rule runs in (see modes.go); empty means any
+	Actions []DeviceCommandPayload `json:"actions"`
+	Notify  *RuleNotification      `json:"notify,omitempty"` // Raised in the notification center when the rule runs
+}
+
+// RuleNotification is the notification a rule raises when it runs (see notifications.go). It
+// stays open, counting the runs, until a user resolves it.
+type RuleNotification struct {
+	Severity string `json:"severity,omitempty"` // info, warning (default) or critical
+	Title    string `json:"title,omitempty"`    // Defaults to the rule name
+	Message  string `json:"message,omitempty"`
+}
+
+// RulesEngine holds the configured rules and evaluates incoming events against them.
+type RulesEngine struct {
+	mu    sync.RWMutex
+	rules map[string]*Rule
+	last  map[string]interface{} // Last value seen by each attribute rule, by rule ID
+	path  string
+}
+
+// NewRulesEngine creates a rules engine persisting its rules to path.
+func NewRulesEngine(path string) *RulesEngine {
+	return &RulesEngine{rules: make(map[string]*Rule), last: make(map[string]interface{}), path: path}
+}
+
+// Load reads the persisted rules. A missing file is not an error.
+func (e *RulesEngine) Load() error {
+	var rules []*Rule
+	if err := loadJSONFile(e.path, &rules); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, rule := range rules {
+		e.rules[rule.ID] = rule
+	}
+	log.Printf("Loaded %d rule(s) from %s", len(rules), e.path)
+	return nil
+}
+
+// save writes the rules to disk. Callers must hold e.mu.
+func (e *RulesEngine) save() error {
+	return saveJSONFile(e.path, e.listLocked())
+}
+
+func (e *RulesEngine) listLocked() []Rule {
+	rules := make([]Rule, 0, len(e.rules))
+	for _, rule := range e.rules {
+		rules = append(rules, *rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+	return rules
+}
+
+// List returns all rules sorted by ID.
+func (e *RulesEngine) List() []Rule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.listLocked()
+}
+
+// Put adds or replaces a rule, assigning an ID if it has none.
+func (e *RulesEngine) Put(rule Rule) (Rule, error) {
+	if rule.Trigger.Type == "" {
+		return rule, fmt.Errorf("rule trigger type is required")
+	}
+	if len(rule.Actions) == 0 && rule.Notify == nil {
+		return rule, fmt.Errorf("rule needs at least one action or a notification")
+	}
+	if rule.Notify != nil && rule.Notify.Severity != "" && !containsString(notificationSeverities, rule.Notify.Severity) {
+		return rule, fmt.Errorf("unknown notification severity %q", rule.Notify.Severity)
+	}
+	if err := validateRuleModes(rule); err != nil {
+		return rule, err
+	}
+	if rule.ID == "" {
+		rule.ID = fmt.Sprintf("rule-%d", time.Now().UnixNano())
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules[rule.ID] = &rule
+	delete(e.last, rule.ID)
+	return rule, e.save()
+}
+
+// Delete removes a rule by ID.
+func (e *RulesEngine) Delete(id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.rules[id]; !ok {
+		return fmt.Errorf("rule %q not found", id)
+	}
+	delete(e.rules, id)
+	delete(e.last, id)
+	return e.save()
+}
+
+// RemoveDeviceReferences cleans up the rules referring to a removed node endpoint (or the whole node
+// when endpointID is empty): rules triggered by it are deleted, and actions targeting it are dropped,
+// deleting rules left without actions or notification. It returns the IDs of the deleted and modified rules.
+func (e *RulesEngine) RemoveDeviceReferences(nodeID, endpointID string, deviceIDs []string) (deleted, modified []string, err error) {
+	isDevice := make(map[string]bool)
+	for _, id := range deviceIDs {
+		isDevice[id] = true
+	}
+	targets := func(action DeviceCommandPayload) bool {
+		return isDevice[action.DeviceID] || (endpointID == "" && action.DeviceID == "" && action.NodeID == nodeID)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for id, rule := range e.rules {
+		if rule.Trigger.NodeID == nodeID && (endpointID == "" || rule.Trigger.EndpointID == endpointID) {
+			delete(e.rules, id)
+			deleted = append(deleted, id)
+			continue
+		}
+		var actions []DeviceCommandPayload
+		for _, action := range rule.Actions {
+			if !targets(action) {
+				actions = append(actions, action)
+			}
+		}
+		switch {
+		case len(actions) == 0 && rule.Notify == nil:
+			delete(e.rules, id)
+			deleted = append(deleted, id)
+		case len(actions) != len(rule.Actions):
+			rule.Actions = actions
+			modified = append(modified, id)
+		}
+	}
+	if len(deleted) == 0 && len(modified) == 0 {
+		return nil, nil, nil
+	}
+	sort.Strings(deleted)
+	sort.Strings(modified)
+	return deleted, modified, e.save()
+}
+
+// matchesButtonEvent reports whether a button_event trigger matches the event.
+func (t RuleTrigger) matchesButtonEvent(event ButtonEventPayload) bool {
+	return t.Type == "button_event" &&
+		(t.NodeID == "" || t.NodeID == event.NodeID) &&
+		(t.EndpointID == "" || t.EndpointID == event.EndpointID) &&
+		(t.Event == "" || t.Event == event.Event) &&
+		(t.Position == 0 || t.Position == event.Position) &&
+		(t.PressCount == 0 || t.PressCount == event.PressCount)
+}
+
+// HandleButtonEvent runs the actions of every enabled rule triggered by the event.
+func (e *RulesEngine) HandleButtonEvent(event ButtonEventPayload) {
+	e.mu.RLock()
+	var matched []Rule
+	for _, rule := range e.rules {
+		if rule.Enabled && rule.Trigger.matchesButtonEvent(event) && matchesMode(rule.Modes) {
+			matched = append(matched, *rule)
+		}
+	}
+	e.mu.RUnlock()
+
+	for _, rule := range matched {
+		go e.run(rule)
+	}
+}
+
+// HandleModeChange runs the actions of every enabled rule triggered by entering a house mode.
+func (e *RulesEngine) HandleModeChange(change ModeChangedPayload) {
+	e.mu.RLock()
+	var matched []Rule
+	for _, rule := range e.rules {
+		if rule.Enabled && rule.Trigger.Type == "mode_changed" && (rule.Trigger.Mode == "" || rule.Trigger.Mode == change.Mode) && matchesMode(rule.Modes) {
+			matched = append(matched, *rule)
+		}
+	}
+	e.mu.RUnlock()
+
+	for _, rule := range matched {
+		go e.run(rule)
+	}
+}
+
+// matchesAttribute reports whether an attribute trigger watches the updated attribute.
+func (t RuleTrigger) matchesAttribute(update AttributeUpdatePayload) bool {
+	return t.Type == "attribute" &&
+		(t.NodeID == "" || t.NodeID == update.NodeID) &&
+		(t.EndpointID == "" || t.EndpointID == update.EndpointID) &&
+		strings.EqualFold(t.Cluster, update.Cluster) &&
+		strings.EqualFold(t.Attribute, update.Attribute)
+}
+
+// HandleAttributeUpdate runs the actions of every enabled attribute rule whose attribute changed,
+// to the trigger's value if it has one. The first value a rule sees is only remembered, so
+// restarts and new subscriptions don't fire rules for the current state.
+func (e *RulesEngine) HandleAttributeUpdate(update AttributeUpdatePayload) {
+	e.mu.Lock()
+	var matched []Rule
+	for id, rule := range e.rules {
+		if !rule.Trigger.matchesAttribute(update) {
+			continue
+		}
+		last, known := e.last[id]
+		e.last[id] = update.Value
+		if !known || sameValue(last, update.Value) {
+			continue
+		}
+		if rule.Trigger.Value != nil && !sameValue(update.Value, rule.Trigger.Value) {
+			continue
+		}
+		if rule.Enabled && matchesMode(rule.Modes) {
+			matched = append(matched, *rule)
+		}
+	}
+	e.mu.Unlock()
+
+	for _, rule := range matched {
+		go e.run(rule)
+	}
+}
+
+// run executes a rule's actions in order. Rules have no client, so results only go to the log.
+func (e *RulesEngine) run(rule Rule) {
+	log.Printf("Rule %s (%s) triggered, running %d action(s)", rule.ID, rule.Name, len(rule.Actions))
+	if rule.Notify != nil {
+		notificationCenter.Raise(rule.notification())
+	}
+	for _, action := range rule.Actions {
+		executeDeviceCommand(nil, action)
+	}
+}
+
+// notification builds the notification a rule raises.
+func (rule Rule) notification() Notification {
+	n := Notification{Key: "rule|" + rule.ID, Kind: notifyRule, Severity: rule.Notify.Severity, Title: rule.Notify.Title, Message: rule.Notify.Message}
+	if n.Severity == "" {
+		n.Severity = severityWarning
+	}
+	if n.Title == "" {
+		n.Title = rule.Name
+	}
+	return n
+}
+
+var rulesEngine = NewRulesEngine(rulesFile)
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// rvcCommands maps the robotic vacuum clusters' command names (as sent by the frontend)
+// to the chip-tool command names.
+var rvcCommands = map[string]map[string]string{
+	"RvcRunMode": {
+		"ChangeToMode": "change-to-mode",
+	},
+	"RvcCleanMode": {
+		"ChangeToMode": "change-to-mode",
+	},
+	"RvcOperationalState": {
+		"Pause":  "pause",
+		"Resume": "resume",
+		"GoHome": "go-home",
+	},
+}
+
+// rvcStateAttributes is the attribute read back after a command to confirm the new state.
+var rvcStateAttributes = map[string]string{
+	"RvcRunMode":          "current-mode",
+	"RvcCleanMode":        "current-mode",
+	"RvcOperationalState": "operational-state",
+}
+
+// rvcOperationalStates maps RvcOperationalState.OperationalState values to readable names,
+// including the RVC specific states (0x40-0x42).
+var rvcOperationalStates = map[int64]string{
+	0x00: "stopped",
+	0x01: "running",
+	0x02: "paused",
+	0x03: "error",
+	0x40: "seeking_charger",
+	0x41: "charging",
+	0x42: "docked",
+}
+
+func isRvcCluster(cluster string) bool {
+	_, ok := rvcCommands[cluster]
+	return ok
+}
+
+// buildRvcCommandArgs builds the chip-tool arguments for an RVC command.
+// ChangeToMode requires a numeric "newMode" param (one of the device's SupportedModes).
+func buildRvcCommandArgs(payload DeviceCommandPayload, endpointID string) ([]string, error) {
+	chipCommand, ok := rvcCommands[payload.Cluster][payload.Command]
+	if !ok {
+		return nil, fmt.Errorf("unsupported %s command %q", payload.Cluster, payload.Command)
+	}
+	args := []string{strings.ToLower(payload.Cluster), chipCommand}
+	if payload.Command == "ChangeToMode" {
+		newMode, ok := payload.Params["newMode"].(float64)
+		if !ok {
+			if s, isString := payload.Params["newMode"].(string); isString {
+				parsed, err := strconv.Atoi(s)
+				if err != nil {
+					return nil, fmt.Errorf("invalid 'newMode' parameter %q", s)
+				}
+				newMode, ok = float64(parsed), true
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("missing or invalid 'newMode' parameter for ChangeToMode")
+		}
+		args = append(args, strconv.Itoa(int(newMode)))
+	}
+	return append(args, payload.NodeID, endpointID), nil
+}
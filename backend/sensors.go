@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SensorReading is a typed, unit-normalised view of a sensor attribute value.
+type SensorReading struct {
+	Kind  string  `json:"kind"`            // e.g. "air_quality", "co2", "pm25", "tvoc", "rvc_operational_state"
+	Value float64 `json:"value"`           // Value after scaling to Unit
+	Unit  string  `json:"unit,omitempty"`  // e.g. "ppm", "ug/m3", "ppb"
+	Level string  `json:"level,omitempty"` // Textual level for enum attributes (AirQuality, RVC operational state)
+}
+
+// sensorDefinition describes how a sensor attribute is interpreted and subscribed by default.
+type sensorDefinition struct {
+	Cluster     string
+	Attribute   string
+	Kind        string
+	MinInterval string // Default subscription min interval in seconds
+	MaxInterval string // Default subscription max interval in seconds
+	// CanonicalUnit is the unit concentration values are scaled to. Empty for enum sensors and
+	// sensors reported in a fixed unit (DefaultUnit).
+	CanonicalUnit string
+	// DefaultUnit is assumed when the device's MeasurementUnit attribute hasn't been read yet.
+	DefaultUnit string
+	// LevelNames maps enum values to readable levels. Set for enum attributes instead of CanonicalUnit.
+	LevelNames map[int64]string
+}
+
+// sensorDefinitions lists the sensor attributes we know how to type, keyed by "Cluster/attribute".
+var sensorDefinitions = map[string]sensorDefinition{
+	"AirQuality/air-quality": {
+		Cluster: "AirQuality", Attribute: "air-quality", Kind: "air_quality",
+		MinInterval: "10", MaxInterval: "300", LevelNames: airQualityLevels,
+	},
+	"CarbonDioxideConcentrationMeasurement/measured-value": {
+		Cluster: "CarbonDioxideConcentrationMeasurement", Attribute: "measured-value", Kind: "co2",
+		MinInterval: "30", MaxInterval: "300", CanonicalUnit: "ppm", DefaultUnit: "ppm",
+	},
+	"Pm25ConcentrationMeasurement/measured-value": {
+		Cluster: "Pm25ConcentrationMeasurement", Attribute: "measured-value", Kind: "pm25",
+		MinInterval: "30", MaxInterval: "300", CanonicalUnit: "ug/m3", DefaultUnit: "ug/m3",
+	},
+	"TotalVolatileOrganicCompoundsConcentrationMeasurement/measured-value": {
+		Cluster: "TotalVolatileOrganicCompoundsConcentrationMeasurement", Attribute: "measured-value", Kind: "tvoc",
+		MinInterval: "30", MaxInterval: "300", CanonicalUnit: "ppb", DefaultUnit: "ppb",
+	},
+	"PowerSource/bat-percent-remaining": {
+		Cluster: "PowerSource", Attribute: "bat-percent-remaining", Kind: "battery",
+		MinInterval: "60", MaxInterval: "3600", DefaultUnit: "%",
+	},
+	"PowerSource/bat-charge-level": {
+		Cluster: "PowerSource", Attribute: "bat-charge-level", Kind: "battery_charge_level",
+		MinInterval: "60", MaxInterval: "3600", LevelNames: batChargeLevels,
+	},
+	"PowerSource/bat-replacement-needed": {
+		Cluster: "PowerSource", Attribute: "bat-replacement-needed", Kind: "battery_replacement_needed",
+		MinInterval: "60", MaxInterval: "3600", LevelNames: map[int64]string{0: "no", 1: "yes"},
+	},
+	"RvcOperationalState/operational-state": {
+		Cluster: "RvcOperationalState", Attribute: "operational-state", Kind: "rvc_operational_state",
+		MinInterval: "1", MaxInterval: "60", LevelNames: rvcOperationalStates,
+	},
+}
+
+// sensorBundles groups sensor attributes that are usually subscribed together.
+var sensorBundles = map[string][]string{
+	"air_quality": {
+		"AirQuality/air-quality",
+		"CarbonDioxideConcentrationMeasurement/measured-value",
+		"Pm25ConcentrationMeasurement/measured-value",
+		"TotalVolatileOrganicCompoundsConcentrationMeasurement/measured-value",
+	},
+	"battery": {
+		"PowerSource/bat-percent-remaining",
+		"PowerSource/bat-charge-level",
+		"PowerSource/bat-replacement-needed",
+	},
+}
+
+// airQualityLevels maps the AirQualityEnum of the AirQuality cluster to readable levels.
+var airQualityLevels = map[int64]string{
+	0: "unknown", 1: "good", 2: "fair", 3: "moderate", 4: "poor", 5: "very_poor", 6: "extremely_poor",
+}
+
+// measurementUnits maps the MeasurementUnitEnum shared by the concentration measurement clusters.
+var measurementUnits = []string{"ppm", "ppb", "ppt", "mg/m3", "ug/m3", "ng/m3", "p/m3", "bq/m3"}
+
+// unitScale gives each unit's factor relative to the first unit of its family.
+// Units of different families (e.g. ppm vs ug/m3) can't be converted without knowing the gas.
+var unitScale = map[string]struct {
+	family string
+	factor float64
+}{
+	"ppm":   {"ratio", 1},
+	"ppb":   {"ratio", 1e-3},
+	"ppt":   {"ratio", 1e-6},
+	"mg/m3": {"mass", 1},
+	"ug/m3": {"mass", 1e-3},
+	"ng/m3": {"mass", 1e-6},
+}
+
+func lookupSensorDefinition(cluster, attribute string) (sensorDefinition, bool) {
+	def, ok := sensorDefinitions[cluster+"/"+attribute]
+	return def, ok
+}
+
+// toFloat converts the loosely typed values produced by the chip-tool parsers to float64.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// convertUnit scales value from one unit to another of the same family.
+func convertUnit(value float64, from, to string) (float64, bool) {
+	if from == to {
+		return value, true
+	}
+	src, okFrom := unitScale[from]
+	dst, okTo := unitScale[to]
+	if !okFrom || !okTo || src.family != dst.family {
+		return value, false
+	}
+	return value * src.factor / dst.factor, true
+}
+
+// buildSensorReading returns the typed reading for an attribute update, if the attribute is a known sensor.
+func buildSensorReading(update AttributeUpdatePayload) (SensorReading, bool) {
+	def, ok := lookupSensorDefinition(update.Cluster, update.Attribute)
+	if !ok {
+		return SensorReading{}, false
+	}
+	raw, ok := toFloat(update.Value)
+	if !ok {
+		return SensorReading{}, false
+	}
+
+	if def.LevelNames != nil {
+		level, ok := def.LevelNames[int64(raw)]
+		if !ok {
+			level = fmt.Sprintf("unknown_0x%02x", int64(raw))
+		}
+		return SensorReading{Kind: def.Kind, Value: raw, Level: level}, true
+	}
+
+	// Concentration clusters report a float in the unit given by their MeasurementUnit attribute.
+	unit := def.DefaultUnit
+	if state, ok := stateCache.Get(update.NodeID, update.EndpointID, update.Cluster, "measurement-unit"); ok {
+		if idx, ok := toFloat(state.Value); ok && int(idx) >= 0 && int(idx) < len(measurementUnits) {
+			unit = measurementUnits[int(idx)]
+		}
+	}
+	if scaled, ok := convertUnit(raw, unit, def.CanonicalUnit); ok {
+		return SensorReading{Kind: def.Kind, Value: scaled, Unit: def.CanonicalUnit}, true
+	}
+	return SensorReading{Kind: def.Kind, Value: raw, Unit: unit}, true
+}
+
+// sensorReadingsForNode returns the cached typed readings of a node.
+func sensorReadingsForNode(nodeID string) []AttributeState {
+	var readings []AttributeState
+	for _, state := range stateCache.NodeAttributes(nodeID) {
+		if state.Reading != nil {
+			readings = append(readings, state)
+		}
+	}
+	return readings
+}
+
+// subscribeSensorBundle starts a subscription for every attribute of a bundle using the default intervals.
+// The measurement-unit attributes are read first so the readings can be scaled correctly.
+func subscribeSensorBundle(client *Client, nodeID, endpointID, bundle string) error {
+	keys, ok := sensorBundles[bundle]
+	if !ok {
+		return fmt.Errorf("unknown sensor bundle %q", bundle)
+	}
+	for _, key := range keys {
+		def := sensorDefinitions[key]
+		if def.CanonicalUnit != "" {
+			readAttribute(client, nodeID, endpointID, def.Cluster, "measurement-unit")
+		}
+		go startAttributeSubscription(client, nodeID, endpointID, def.Cluster, def.Attribute, def.MinInterval, def.MaxInterval)
+	}
+	return nil
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupFile keeps the progress of the first-run setup, relative to the data directory, so an
+// interrupted setup resumes where it stopped.
+const setupFile = "setup.json"
+
+// Steps of the first-run setup, in order. Each one is done with POST /api/v1/setup/<step>; a step
+// can be redone, except the admin one, but not started before the previous ones are done.
+const (
+	setupStepAdmin     = "admin"
+	setupStepChipTool  = "chip-tool"
+	setupStepStorage   = "storage"
+	setupStepDiscovery = "discovery"
+)
+
+var setupSteps = []string{setupStepAdmin, setupStepChipTool, setupStepStorage, setupStepDiscovery}
+
+// Bounds of the discovery test.
+const (
+	defaultSetupDiscoverySeconds = 10
+	maxSetupDiscoverySeconds     = 60
+)
+
+var (
+	errSetupNotAvailable = errors.New("setup is only available on first run, before a configuration file exists")
+	errSetupOutOfOrder   = errors.New("the previous setup steps are not done yet")
+	errSetupClaimed      = errors.New("the admin step is done: this instance is claimed")
+	errSetupUnauthorized = errors.New("setup requires the setup token from the backend log (X-Setup-Token), or the claimed authToken (Authorization: Bearer) after the admin step")
+)
+
+// setupTokenHeader carries the one-time setup token printed to the log at startup.
+const setupTokenHeader = "X-Setup-Token"
+
+// SetupStepState is the outcome of a setup step.
+type SetupStepState struct {
+	Name    string    `json:"name"`
+	Done    bool      `json:"done"`
+	Skipped bool      `json:"skipped,omitempty"` // The discovery test was skipped
+	Result  string    `json:"result,omitempty"`  // What the step found or set, for the frontend to show
+	At      time.Time `json:"at,omitzero"`
+}
+
+// SetupDraft is the configuration the setup builds, written to the configuration file on completion.
+type SetupDraft struct {
+	AuthToken          string `json:"authToken,omitempty"`
+	ChipToolPath       string `json:"chipToolPath,omitempty"`
+	ChipToolStorageDir string `json:"chipToolStorageDir,omitempty"`
+}
+
+// SetupState is the answer of the setup endpoints.
+type SetupState struct {
+	Required    bool             `json:"required"` // First run: no configuration file yet
+	Completed   bool             `json:"completed"`
+	CompletedAt time.Time        `json:"completedAt,omitzero"`
+	CurrentStep string           `json:"currentStep,omitempty"` // First step not done, empty when all are
+	Steps       []SetupStepState `json:"steps"`
+	ConfigFile  string           `json:"configFile"`
+	// Draft is what will be written; the authToken is only shown by the admin step that set it
+	Draft SetupDraft `json:"draft"`
+	// RestartRequired is set on completion when a setting only applies after a restart
+	RestartRequired bool `json:"restartRequired,omitempty"`
+}
+
+// SetupAdminPayload is the body of POST /setup/admin. An empty AuthToken generates one.
+type SetupAdminPayload struct {
+	AuthToken string `json:"authToken,omitempty"`
+}
+
+// SetupChipToolPayload is the body of POST /setup/chip-tool. An empty Path looks for chip-tool in
+// the usual locations, as at startup.
+type SetupChipToolPayload struct {
+	Path string `json:"path,omitempty"`
+}
+
+// SetupStoragePayload is the body of POST /setup/storage. An empty ChipToolStorageDir keeps the
+// default: the "chip-tool" directory of the data directory, or chip-tool's own /tmp.
+type SetupStoragePayload struct {
+	ChipToolStorageDir string `json:"chipToolStorageDir,omitempty"`
+}
+
+// SetupDiscoveryPayload is the body of POST /setup/discovery.
+type SetupDiscoveryPayload struct {
+	Seconds int  `json:"seconds,omitempty"` // How long to browse, default 10
+	Skip    bool `json:"skip,omitempty"`    // E.g. no device at hand yet
+}
+
+// setupProgress is what setupFile holds.
+type setupProgress struct {
+	Completed   bool                      `json:"completed"`
+	CompletedAt time.Time                 `json:"completedAt,omitzero"`
+	Steps       map[string]SetupStepState `json:"steps"`
+	Draft       SetupDraft                `json:"draft"`
+}
+
+// Setup is the first-run setup the frontend drives when the backend starts without a
+// configuration file: it sets the admin token, the chip-tool to run and its storage directory,
+// tests discovery, and writes the configuration file, so nothing has to be edited by hand.
+//
+// The steps set the token of the instance and run the chip-tool they are given, so they are not
+// open to the network: until the admin step claims the instance they need the one-time token
+// logged at startup, and then the authToken that step set.
+type Setup struct {
+	mu       sync.Mutex
+	progress setupProgress
+	path     string
+	token    string // One-time setup token, only kept in memory
+}
+
+// Load reads the setup progress. A missing file is not an error.
+func (s *Setup) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := loadJSONFile(s.path, &s.progress); err != nil {
+		return err
+	}
+	if s.progress.Steps == nil {
+		s.progress.Steps = make(map[string]SetupStepState)
+	}
+	if s.requiredLocked() {
+		b := make([]byte, 16)
+		randomBytes(b)
+		s.token = hex.EncodeToString(b)
+		log.Printf("No configuration file at %s: the first-run setup is available at %s/setup", configFile, apiV1Prefix)
+		log.Printf("First-run setup token (send it as %s): %s", setupTokenHeader, s.token)
+	}
+	return nil
+}
+
+// Required reports whether the setup is offered: on first run, until it completes.
+func (s *Setup) Required() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requiredLocked()
+}
+
+func (s *Setup) requiredLocked() bool {
+	return !configFound && !s.progress.Completed
+}
+
+// State returns the setup progress.
+func (s *Setup) State() SetupState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stateLocked()
+}
+
+func (s *Setup) stateLocked() SetupState {
+	state := SetupState{
+		Required:    s.requiredLocked(),
+		Completed:   s.progress.Completed,
+		CompletedAt: s.progress.CompletedAt,
+		ConfigFile:  configFile,
+		Draft:       s.progress.Draft,
+		Steps:       make([]SetupStepState, 0, len(setupSteps)),
+	}
+	if state.Draft.AuthToken != "" {
+		state.Draft.AuthToken = "(set)"
+	}
+	for _, name := range setupSteps {
+		step, ok := s.progress.Steps[name]
+		if !ok {
+			step = SetupStepState{Name: name}
+		}
+		if !step.Done && state.CurrentStep == "" {
+			state.CurrentStep = name
+		}
+		state.Steps = append(state.Steps, step)
+	}
+	return state
+}
+
+// Authorized reports whether a request may run setup steps: with the setup token until the admin
+// step is done, with the authToken it set afterwards.
+func (s *Setup) Authorized(c *gin.Context) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.progress.Steps[setupStepAdmin].Done {
+		return s.progress.Draft.AuthToken != "" && tokensEqual(c.GetHeader("Authorization"), "Bearer "+s.progress.Draft.AuthToken)
+	}
+	return s.token != "" && tokensEqual(c.GetHeader(setupTokenHeader), s.token)
+}
+
+// begin checks that a step may run now. The caller holds s.mu.
+func (s *Setup) begin(step string) error {
+	if !s.requiredLocked() {
+		return errSetupNotAvailable
+	}
+	for _, name := range setupSteps {
+		if name == step {
+			return nil
+		}
+		if !s.progress.Steps[name].Done {
+			return fmt.Errorf("%w: %s comes first", errSetupOutOfOrder, name)
+		}
+	}
+	return fmt.Errorf("unknown setup step %q", step)
+}
+
+// finish records a done step and persists the progress. The caller holds s.mu.
+func (s *Setup) finish(step SetupStepState) (SetupState, error) {
+	step.Done, step.At = true, time.Now()
+	s.progress.Steps[step.Name] = step
+	if err := saveJSONFile(s.path, s.progress); err != nil {
+		return SetupState{}, err
+	}
+	return s.stateLocked(), nil
+}
+
+// Admin sets the authToken every client will have to present, generating one when none is given.
+// The token is returned once, in the result of the step.
+func (s *Setup) Admin(payload SetupAdminPayload) (SetupState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.begin(setupStepAdmin); err != nil {
+		return SetupState{}, err
+	}
+	if s.progress.Steps[setupStepAdmin].Done {
+		return SetupState{}, errSetupClaimed
+	}
+	token := payload.AuthToken
+	if token == "" {
+		b := make([]byte, 16)
+		randomBytes(b)
+		token = hex.EncodeToString(b)
+	} else if len(token) < 12 {
+		return SetupState{}, &ValidationError{Fields: []FieldError{{Field: "authToken", Message: "must be at least 12 characters"}}}
+	}
+	s.progress.Draft.AuthToken = token
+	state, err := s.finish(SetupStepState{Name: setupStepAdmin, Result: "authToken set"})
+	if err == nil {
+		state.Draft.AuthToken = token // Shown once, to be saved by the admin
+	}
+	return state, err
+}
+
+// ChipTool checks the given chip-tool, or looks for one, and selects it.
+func (s *Setup) ChipTool(payload SetupChipToolPayload) (SetupState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.begin(setupStepChipTool); err != nil {
+		return SetupState{}, err
+	}
+	candidates := []string{payload.Path}
+	switch {
+	case payload.Path != "":
+	case *simulateFlag:
+		candidates = []string{chipToolPath} // The simulated chip-tool
+	default:
+		candidates = expandChipToolCandidates()
+	}
+	var tried []string
+	for _, path := range candidates {
+		resolved, err := checkChipToolCandidate(path)
+		if err != nil {
+			tried = append(tried, path+" ("+err.Error()+")")
+			continue
+		}
+		s.progress.Draft.ChipToolPath = path
+		return s.finish(SetupStepState{Name: setupStepChipTool, Result: "using " + path + " (" + resolved + ")"})
+	}
+	return SetupState{}, fmt.Errorf("no working chip-tool: tried %s", strings.Join(tried, ", "))
+}
+
+// Storage checks that the chip-tool storage directory can be written, creating it.
+func (s *Setup) Storage(payload SetupStoragePayload) (SetupState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.begin(setupStepStorage); err != nil {
+		return SetupState{}, err
+	}
+	dir := payload.ChipToolStorageDir
+	if dir != "" {
+		if !filepath.IsAbs(dir) {
+			return SetupState{}, &ValidationError{Fields: []FieldError{{Field: "chipToolStorageDir", Message: "must be an absolute path"}}}
+		}
+		if err := checkWritableDir(dir); err != nil {
+			return SetupState{}, err
+		}
+	}
+	s.progress.Draft.ChipToolStorageDir = dir
+	result := "chip-tool storage in " + dir
+	if dir == "" {
+		result = "default chip-tool storage"
+		if current := chipToolStorageDir(); current != "" {
+			result += " (" + current + ")"
+		}
+	}
+	return s.finish(SetupStepState{Name: setupStepStorage, Result: result})
+}
+
+// checkWritableDir creates a directory and checks a file can be written in it.
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".setup-probe-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// Discovery browses for commissionable devices with the selected chip-tool and storage, to check
+// they work together before the configuration is written. Finding no device is not a failure:
+// chip-tool ran, there may just be none in pairing mode.
+func (s *Setup) Discovery(ctx context.Context, payload SetupDiscoveryPayload) (SetupState, error) {
+	s.mu.Lock()
+	if err := s.begin(setupStepDiscovery); err != nil {
+		s.mu.Unlock()
+		return SetupState{}, err
+	}
+	draft := s.progress.Draft
+	s.mu.Unlock()
+
+	step := SetupStepState{Name: setupStepDiscovery, Skipped: payload.Skip, Result: "skipped"}
+	if !payload.Skip {
+		seconds := payload.Seconds
+		if seconds <= 0 {
+			seconds = defaultSetupDiscoverySeconds
+		}
+		seconds = min(seconds, maxSetupDiscoverySeconds)
+		devices, err := setupDiscovery(ctx, draft, time.Duration(seconds)*time.Second)
+		if err != nil {
+			return SetupState{}, err
+		}
+		step.Result = fmt.Sprintf("%d commissionable device(s) found", len(devices))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.finish(step)
+}
+
+// setupDiscovery runs "chip-tool discover commissionables" with the draft settings for a while.
+func setupDiscovery(ctx context.Context, draft SetupDraft, timeout time.Duration) ([]DiscoveredDevice, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	args := []string{"discover", "commissionables"}
+	if draft.ChipToolStorageDir != "" {
+		args = append(args, "--storage-directory", draft.ChipToolStorageDir)
+	} else {
+		args = withChipToolStorage(args)
+	}
+	var stdout, stderr strings.Builder
+	cmd := exec.CommandContext(ctx, draft.ChipToolPath, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	// chip-tool browses until it is stopped: a timeout is how a good run ends
+	if err != nil && ctx.Err() == nil {
+		return nil, fmt.Errorf("chip-tool discovery failed: %v %s", err, strings.TrimSpace(stripAnsi(stderr.String())))
+	}
+	return parseDiscoveryOutput(stdout.String(), nil), nil
+}
+
+// Complete writes the draft to the configuration file and loads it. The settings read at startup
+// only (the selected chip-tool when the backend runs degraded) need a restart.
+func (s *Setup) Complete() (SetupState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.requiredLocked() {
+		return SetupState{}, errSetupNotAvailable
+	}
+	for _, name := range setupSteps {
+		if !s.progress.Steps[name].Done {
+			return SetupState{}, fmt.Errorf("%w: %s is not done", errSetupOutOfOrder, name)
+		}
+	}
+	if err := writeSetupConfig(s.progress.Draft); err != nil {
+		return SetupState{}, err
+	}
+	s.progress.Completed, s.progress.CompletedAt = true, time.Now()
+	if err := saveJSONFile(s.path, s.progress); err != nil {
+		return SetupState{}, err
+	}
+	if err := loadConfig(configFile); err != nil {
+		return SetupState{}, err
+	}
+	chipToolSelection = selectChipTool()
+	state := s.stateLocked()
+	state.RestartRequired = degradedMode.Active()
+	log.Printf("First-run setup completed, configuration written to %s", configFile)
+	return state, nil
+}
+
+// writeSetupConfig writes the draft settings to the configuration file, keeping any other setting
+// already in it.
+func writeSetupConfig(draft SetupDraft) error {
+	settings := map[string]interface{}{}
+	if err := loadJSONFile(configFile, &settings); err != nil {
+		return err
+	}
+	settings["authToken"] = draft.AuthToken
+	if !*simulateFlag { // The simulated chip-tool is this binary, only for this run
+		settings["chipToolPath"] = draft.ChipToolPath
+	}
+	if draft.ChipToolStorageDir != "" {
+		settings["chipToolStorageDir"] = draft.ChipToolStorageDir
+	}
+	if err := os.MkdirAll(filepath.Dir(configFile), 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The file holds the authToken: readable by the backend's user only
+	tmp := configFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, configFile)
+}
+
+// registerSetupRoutes adds /setup and its steps to an API version group.
+func registerSetupRoutes(api *gin.RouterGroup) {
+	api.GET("/setup", func(c *gin.Context) {
+		c.JSON(http.StatusOK, setup.State())
+	})
+	api.POST("/setup/admin", setupStep(func(c *gin.Context) (SetupState, error) {
+		var payload SetupAdminPayload
+		if err := bindOptionalJSON(c, &payload); err != nil {
+			return SetupState{}, err
+		}
+		return setup.Admin(payload)
+	}))
+	api.POST("/setup/chip-tool", setupStep(func(c *gin.Context) (SetupState, error) {
+		var payload SetupChipToolPayload
+		if err := bindOptionalJSON(c, &payload); err != nil {
+			return SetupState{}, err
+		}
+		return setup.ChipTool(payload)
+	}))
+	api.POST("/setup/storage", setupStep(func(c *gin.Context) (SetupState, error) {
+		var payload SetupStoragePayload
+		if err := bindOptionalJSON(c, &payload); err != nil {
+			return SetupState{}, err
+		}
+		return setup.Storage(payload)
+	}))
+	api.POST("/setup/discovery", setupStep(func(c *gin.Context) (SetupState, error) {
+		var payload SetupDiscoveryPayload
+		if err := bindOptionalJSON(c, &payload); err != nil {
+			return SetupState{}, err
+		}
+		return setup.Discovery(c.Request.Context(), payload)
+	}))
+	api.POST("/setup/complete", setupStep(func(*gin.Context) (SetupState, error) {
+		return setup.Complete()
+	}))
+}
+
+// bindOptionalJSON decodes the request body into v; an empty body keeps the zero value.
+func bindOptionalJSON(c *gin.Context, v interface{}) error {
+	if c.Request.ContentLength == 0 {
+		return nil
+	}
+	if err := c.ShouldBindJSON(v); err != nil {
+		return &ValidationError{Fields: []FieldError{{Field: "body", Message: err.Error()}}}
+	}
+	return nil
+}
+
+// setupStep answers a setup step: 401 without the setup token, 400 for invalid input, 409 when
+// the step can't run now and 422 when it ran but failed, e.g. no chip-tool was found.
+func setupStep(run func(c *gin.Context) (SetupState, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if setup.Required() && !setup.Authorized(c) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": errSetupUnauthorized.Error()})
+			return
+		}
+		state, err := run(c)
+		var verr *ValidationError
+		switch {
+		case err == nil:
+			c.JSON(http.StatusOK, state)
+		case errors.As(err, &verr):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": verr.Fields})
+		case errors.Is(err, errSetupNotAvailable), errors.Is(err, errSetupOutOfOrder), errors.Is(err, errSetupClaimed):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "setup": setup.State()})
+		default:
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		}
+	}
+}
+
+var setup = &Setup{path: setupFile, progress: setupProgress{Steps: make(map[string]SetupStepState)}}
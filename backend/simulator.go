@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var simulateFlag = flag.Bool("simulate", false, "run against simulated devices instead of chip-tool, for frontend tests")
+
+// simulatorURLEnv tells a re-executed backend binary to act as chip-tool for the simulator at that URL.
+const simulatorURLEnv = "MATTER_BACKEND_SIMULATOR_URL"
+
+// simFaultMessages are the chip-tool errors of the named faults; any other name is used as the message.
+var simFaultMessages = map[string]string{
+	"attestation":    "CHIP Error 0x000000CA: Device attestation failed (PAA not found in trust store)",
+	"timeout":        "CHIP Error 0x00000032: Timeout",
+	"busy":           "CHIP Error 0x0000009C: Busy",
+	"unsupported":    "CHIP Error 0x00000595: IM Error 0x00000586: General error: 0xc3 (UNSUPPORTED_ATTRIBUTE)",
+	"wrong_passcode": "CHIP Error 0x00000038: Integrity check failed (PASE: failed to verify peer's MAC)",
+	"fabric_full":    "CHIP Error 0x000000AC: Internal error (NOCResponse: TableFull)",
+	"unreachable":    "CHIP Error 0x02000065: POSIX Error 0x00000065: Network is unreachable",
+}
+
+// simClusterIDs are the IDs reported in the Descriptor server-list of simulated endpoints.
+var simClusterIDs = map[string]uint32{
+	"onoff": 0x0006, "levelcontrol": 0x0008, "descriptor": 0x001D, "basicinformation": 0x0028,
+	"powersource": 0x002F, "timesynchronization": 0x0038, "booleanstate": 0x0045, "temperaturemeasurement": 0x0402,
+	"relativehumiditymeasurement": 0x0405, "occupancysensing": 0x0406, "colorcontrol": 0x0300,
+}
+
+// SimDevice is a simulated Matter device. Attributes are keyed by endpoint, then by
+// "cluster/attribute" in chip-tool's lower-case names, e.g. "temperaturemeasurement/measured-value".
+// Values are in the device's raw units (0.01 °C for temperatures).
+type SimDevice struct {
+	ID            string                            `json:"id"`
+	Name          string                            `json:"name"`
+	VendorID      string                            `json:"vendorId"`
+	ProductID     string                            `json:"productId"`
+	Discriminator string                            `json:"discriminator"`
+	NodeID        string                            `json:"nodeId,omitempty"` // Set once commissioned
+	Attributes    map[string]map[string]interface{} `json:"attributes"`
+}
+
+// SimFault makes the next runs of an operation fail.
+type SimFault struct {
+	Operation string `json:"operation" binding:"required"` // "discovery", "commissioning", "read", "subscribe", "command", "unpair" or "open_window"
+	Error     string `json:"error" binding:"required"`     // A name of simFaultMessages or a chip-tool error message
+	NodeID    string `json:"nodeId,omitempty"`             // Only runs targeting this node
+	Count     int    `json:"count,omitempty"`              // Number of runs to fail; 0 until cleared
+}
+
+// SimAttributeWrite is the body of PUT /api/sim/devices/:id/attributes.
+type SimAttributeWrite struct {
+	EndpointID string      `json:"endpointId"` // Default "1"
+	Cluster    string      `json:"cluster" binding:"required"`
+	Attribute  string      `json:"attribute" binding:"required"`
+	Value      interface{} `json:"value"`
+}
+
+// Simulator plays chip-tool against scripted virtual devices. The backend runs its own binary as
+// chipToolPath; that process forwards its arguments to the simulator and prints what it answers,
+// so every chip-tool code path of the backend is exercised unchanged.
+type Simulator struct {
+	mu       sync.Mutex
+	devices  map[string]*SimDevice
+	faults   []SimFault
+	watchers map[chan struct{}]bool // Subscription streams, woken on every attribute change
+}
+
+// NewSimulator creates a simulator with the default virtual devices.
+func NewSimulator() *Simulator {
+	s := &Simulator{watchers: make(map[chan struct{}]bool)}
+	s.Reset()
+	return s
+}
+
+// Reset restores the default devices, all uncommissioned, and clears the faults.
+func (s *Simulator) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices = map[string]*SimDevice{
+		"sim-light": {
+			ID: "sim-light", Name: "Simulated Light", VendorID: "65521", ProductID: "32769", Discriminator: "3840",
+			Attributes: map[string]map[string]interface{}{
+				"1": {
+					"onoff/on-off": false, "levelcontrol/current-level": int64(254),
+					"colorcontrol/feature-map": int64(0x10), "colorcontrol/color-temperature-mireds": int64(250), // Color temperature only
+				},
+			},
+		},
+		"sim-sensor": {
+			ID: "sim-sensor", Name: "Simulated Temperature Sensor", VendorID: "65521", ProductID: "32770", Discriminator: "3841",
+			Attributes: map[string]map[string]interface{}{
+				"0": {
+					"powersource/feature-map": int64(powerSourceFeatureBattery), "powersource/bat-percent-remaining": int64(180),
+					"timesynchronization/feature-map": int64(timeSyncFeatureTimeZone), "timesynchronization/utctime": int64(0),
+				},
+				"1": {"temperaturemeasurement/measured-value": int64(2150)},
+			},
+		},
+	}
+	for _, device := range s.devices {
+		if device.Attributes["0"] == nil {
+			device.Attributes["0"] = make(map[string]interface{})
+		}
+		device.Attributes["0"]["basicinformation/vendor-id"], _ = strconv.ParseInt(device.VendorID, 10, 64)
+		device.Attributes["0"]["basicinformation/product-id"], _ = strconv.ParseInt(device.ProductID, 10, 64)
+		device.Attributes["0"]["basicinformation/node-label"] = device.Name
+		device.Attributes["0"]["basicinformation/software-version"] = int64(1)
+		device.Attributes["0"]["basicinformation/software-version-string"] = "1.0-sim"
+	}
+	s.faults = nil
+	s.notifyLocked()
+}
+
+// List returns the devices, sorted by ID.
+func (s *Simulator) List() []SimDevice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices := make([]SimDevice, 0, len(s.devices))
+	for _, device := range s.devices {
+		devices = append(devices, *device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices
+}
+
+// SetAttribute changes an attribute of a device and wakes the subscriptions.
+func (s *Simulator) SetAttribute(deviceID string, write SimAttributeWrite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	device, ok := s.devices[deviceID]
+	if !ok {
+		return fmt.Errorf("no simulated device %q", deviceID)
+	}
+	if write.EndpointID == "" {
+		write.EndpointID = "1"
+	}
+	if device.Attributes[write.EndpointID] == nil {
+		device.Attributes[write.EndpointID] = make(map[string]interface{})
+	}
+	value := write.Value
+	if f, ok := value.(float64); ok && f == float64(int64(f)) {
+		value = int64(f) // JSON numbers: keep integers integers, as chip-tool prints them
+	}
+	device.Attributes[write.EndpointID][strings.ToLower(write.Cluster)+"/"+write.Attribute] = value
+	s.notifyLocked()
+	return nil
+}
+
+// AddFault queues a fault.
+func (s *Simulator) AddFault(fault SimFault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, fault)
+}
+
+// ClearFaults removes every fault.
+func (s *Simulator) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Faults returns the pending faults.
+func (s *Simulator) Faults() []SimFault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SimFault{}, s.faults...)
+}
+
+// takeFaultLocked returns the error message of a fault matching the run, consuming one count.
+func (s *Simulator) takeFaultLocked(operation, nodeID string) (string, bool) {
+	for i, fault := range s.faults {
+		if fault.Operation != operation || (fault.NodeID != "" && !sameNodeID(fault.NodeID, nodeID)) {
+			continue
+		}
+		if fault.Count > 0 {
+			s.faults[i].Count--
+			if s.faults[i].Count == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		if message, ok := simFaultMessages[fault.Error]; ok {
+			return message, true
+		}
+		return fault.Error, true
+	}
+	return "", false
+}
+
+func (s *Simulator) notifyLocked() {
+	for ch := range s.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// nodeLocked returns the commissioned device with a node ID.
+func (s *Simulator) nodeLocked(nodeID string) *SimDevice {
+	for _, device := range s.devices {
+		if device.NodeID != "" && sameNodeID(device.NodeID, nodeID) {
+			return device
+		}
+	}
+	return nil
+}
+
+// simOutput collects what the simulated chip-tool prints.
+type simOutput struct {
+	stdout, stderr strings.Builder
+	exitCode       int
+}
+
+func (o *simOutput) fail(message string) {
+	fmt.Fprintf(&o.stderr, "[TOO] Run command failure: %s\n", message)
+	o.exitCode = 1
+}
+
+// stripFlags drops the --flag value pairs (storage directory, commissioner name, trust store...).
+func stripFlags(args []string) []string {
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		if strings.HasPrefix(args[i], "--") {
+			i++
+			continue
+		}
+		positional = append(positional, args[i])
+	}
+	return positional
+}
+
+// formatSimValue prints a value like chip-tool's read output does.
+func formatSimValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(value)
+}
+
+// simValueType is the data type chip-tool prints in subscription reports.
+func simValueType(value interface{}) string {
+	switch value.(type) {
+	case bool:
+		return "BOOLEAN"
+	case float64:
+		return "FLOAT"
+	case string:
+		return "UTF8S"
+	}
+	return "INT64S"
+}
+
+// Exec runs one simulated chip-tool invocation. Subscriptions are handled by Subscribe.
+func (s *Simulator) Exec(args []string) *simOutput {
+	out := &simOutput{}
+	args = stripFlags(args)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case len(args) == 0:
+		out.stdout.WriteString("Usage:\n  chip-tool command_set_name command_name [param1 param2 ...]\n\n  | Command sets:  |\n")
+		names := append([]string{"levelcontrol", "temperaturemeasurement", "powersource", "switch"}, requiredChipToolCommands...)
+		for _, name := range names {
+			fmt.Fprintf(&out.stdout, "  | * %-24s |\n", name)
+		}
+		out.exitCode = 1
+	case args[0] == "discover":
+		if message, failed := s.takeFaultLocked("discovery", ""); failed {
+			out.fail(message)
+			return out
+		}
+		for _, device := range s.devices {
+			if device.NodeID != "" {
+				continue
+			}
+			fmt.Fprintf(&out.stdout, "[DIS] Discovered commissionable/commissioner node:\n")
+			fmt.Fprintf(&out.stdout, "[DIS] \tHostname: %s\n", strings.ToUpper(strings.ReplaceAll(device.ID, "-", "")))
+			fmt.Fprintf(&out.stdout, "[DIS] \tIP Address #1: 127.0.0.1\n[DIS] \tPort: 5540\n")
+			fmt.Fprintf(&out.stdout, "[DIS] \tVendor ID: %s\n[DIS] \tProduct ID: %s\n", device.VendorID, device.ProductID)
+			fmt.Fprintf(&out.stdout, "[DIS] \tLong Discriminator: %s\n[DIS] \tPairing Hint: 33\n", device.Discriminator)
+			fmt.Fprintf(&out.stdout, "[DIS] \tInstance Name: %016X\n[DIS] \tCommissioning Mode: 1\n", len(device.ID)*0x1111)
+		}
+	case args[0] == "pairing" && len(args) >= 3 && args[1] == "unpair":
+		if message, failed := s.takeFaultLocked("unpair", args[2]); failed {
+			out.fail(message)
+			return out
+		}
+		if device := s.nodeLocked(args[2]); device != nil {
+			device.NodeID = ""
+		}
+		out.stdout.WriteString("[CTL] Unpair: device removed from the fabric\n")
+	case args[0] == "pairing" && len(args) >= 7 && args[1] == "open-commissioning-window":
+		device := s.nodeLocked(args[2])
+		if device == nil {
+			out.fail("CHIP Error 0x00000032: Timeout")
+			return out
+		}
+		if message, failed := s.takeFaultLocked("open_window", args[2]); failed {
+			out.fail(message)
+			return out
+		}
+		discriminator, _ := strconv.Atoi(args[6])
+		fmt.Fprintf(&out.stdout, "[CTL] Successfully opened pairing window on the device\n")
+		fmt.Fprintf(&out.stdout, "[CTL] Manual pairing code: [%011d]\n", 34970000000+discriminator)
+		fmt.Fprintf(&out.stdout, "[CTL] SetupQRCode: [MT:SIM%04X.%s]\n", discriminator, device.NodeID)
+	case args[0] == "pairing" && len(args) >= 3:
+		nodeID := args[2]
+		if message, failed := s.takeFaultLocked("commissioning", nodeID); failed {
+			out.fail(message)
+			return out
+		}
+		var target *SimDevice
+		for _, device := range s.devices {
+			if device.NodeID == "" && (target == nil || containsString(args[3:], device.Discriminator)) {
+				target = device
+			}
+		}
+		if target == nil {
+			out.fail("CHIP Error 0x00000032: Timeout (no commissionable device found)")
+			return out
+		}
+		target.NodeID = nodeID
+		fmt.Fprintf(&out.stdout, "[CTL] Successfully finished commissioning step 'Cleanup'\n[TOO] Device commissioning completed with success\n")
+	case len(args) >= 5 && args[1] == "read":
+		nodeID, endpointID := args[3], args[4]
+		device := s.nodeLocked(nodeID)
+		if device == nil {
+			out.fail("CHIP Error 0x00000032: Timeout")
+			return out
+		}
+		if message, failed := s.takeFaultLocked("read", nodeID); failed {
+			out.fail(message)
+			return out
+		}
+		s.readLocked(out, device, args[0], args[2], endpointID)
+	case len(args) >= 3:
+		// Cluster command: the node and endpoint are the last two arguments
+		nodeID, endpointID := args[len(args)-2], args[len(args)-1]
+		device := s.nodeLocked(nodeID)
+		if device == nil {
+			out.fail("CHIP Error 0x00000032: Timeout")
+			return out
+		}
+		if message, failed := s.takeFaultLocked("command", nodeID); failed {
+			out.fail(message)
+			return out
+		}
+		s.commandLocked(device, args[0], args[1], args[2:len(args)-2], endpointID)
+		fmt.Fprintf(&out.stdout, "[TOO] Received Command Response Status for Endpoint=%s Command=%s Status=0x0\n", endpointID, args[1])
+	default:
+		out.fail("unknown command " + strings.Join(args, " "))
+	}
+	return out
+}
+
+// readLocked prints an attribute read. Descriptor lists and attribute lists are derived from the
+// device's attributes.
+func (s *Simulator) readLocked(out *simOutput, device *SimDevice, cluster, attribute, endpointID string) {
+	if attribute == "attribute-list" && cluster != "descriptor" {
+		var entries []uint32
+		for key := range device.Attributes[endpointID] {
+			name, attr, _ := strings.Cut(key, "/")
+			if name != cluster {
+				continue
+			}
+			if id, ok := matterClusters[cluster].Attributes[attr]; ok {
+				entries = append(entries, id)
+			} else if id, ok := globalAttributes[attr]; ok {
+				entries = append(entries, id)
+			}
+		}
+		if len(entries) == 0 {
+			out.fail(simFaultMessages["unsupported"])
+			return
+		}
+		entries = append(entries, attributeListID)
+		sort.Slice(entries, func(i, j int) bool { return entries[i] < entries[j] })
+		fmt.Fprintf(&out.stdout, "[TOO] Endpoint: %s Cluster: %s Attribute: %s\n", endpointID, cluster, attribute)
+		for i, entry := range entries {
+			fmt.Fprintf(&out.stdout, "[TOO]   [%d]: %d\n", i+1, entry)
+		}
+		return
+	}
+	if cluster == "descriptor" {
+		var entries []uint32
+		switch attribute {
+		case "parts-list":
+			if endpointID == "0" {
+				for ep := range device.Attributes {
+					if n, err := strconv.ParseUint(ep, 10, 32); err == nil && n != 0 {
+						entries = append(entries, uint32(n))
+					}
+				}
+			}
+		case "server-list":
+			seen := map[uint32]bool{}
+			for key := range device.Attributes[endpointID] {
+				name, _, _ := strings.Cut(key, "/")
+				if id, ok := simClusterIDs[name]; ok && !seen[id] {
+					seen[id] = true
+					entries = append(entries, id)
+				}
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i] < entries[j] })
+		fmt.Fprintf(&out.stdout, "[TOO] Endpoint: %s Cluster: Descriptor Attribute: %s\n", endpointID, attribute)
+		for i, entry := range entries {
+			fmt.Fprintf(&out.stdout, "[TOO]   [%d]: %d\n", i+1, entry)
+		}
+		return
+	}
+	value, ok := device.Attributes[endpointID][cluster+"/"+attribute]
+	if !ok {
+		out.fail(simFaultMessages["unsupported"])
+		return
+	}
+	fmt.Fprintf(&out.stdout, "[TOO] Endpoint: %s Cluster: %s Attribute: %s\n[DMG] Data = %s,\n", endpointID, cluster, attribute, formatSimValue(value))
+}
+
+// commandLocked applies the effect of the cluster commands the simulated devices understand.
+func (s *Simulator) commandLocked(device *SimDevice, cluster, command string, params []string, endpointID string) {
+	attrs := device.Attributes[endpointID]
+	if attrs == nil {
+		return
+	}
+	switch cluster + "/" + command {
+	case "onoff/on":
+		attrs["onoff/on-off"] = true
+	case "onoff/off":
+		attrs["onoff/on-off"] = false
+	case "onoff/toggle":
+		on, _ := attrs["onoff/on-off"].(bool)
+		attrs["onoff/on-off"] = !on
+	case "timesynchronization/set-utctime":
+		if len(params) > 0 {
+			if utc, err := strconv.ParseInt(params[0], 10, 64); err == nil {
+				attrs["timesynchronization/utctime"] = utc
+			}
+		}
+	case "colorcontrol/move-to-color-temperature":
+		if len(params) > 0 {
+			if mireds, err := strconv.ParseInt(params[0], 10, 64); err == nil {
+				attrs["colorcontrol/color-temperature-mireds"] = mireds
+			}
+		}
+	case "levelcontrol/move-to-level", "levelcontrol/move-to-level-with-on-off":
+		if len(params) > 0 {
+			if level, err := strconv.ParseInt(params[0], 10, 64); err == nil {
+				attrs["levelcontrol/current-level"] = level
+			}
+		}
+	default:
+		return
+	}
+	s.notifyLocked()
+}
+
+// Subscribe streams subscription reports of one attribute to w until done is closed: one report
+// right away, then one whenever the value changes.
+func (s *Simulator) Subscribe(args []string, w *bufio.Writer, flush func(), done <-chan struct{}) {
+	args = stripFlags(args)
+	if len(args) < 7 {
+		return
+	}
+	cluster, attribute, nodeID, endpointID := args[0], args[2], args[5], args[6]
+	wake := make(chan struct{}, 1)
+	s.mu.Lock()
+	if message, failed := s.takeFaultLocked("subscribe", nodeID); failed {
+		s.mu.Unlock()
+		fmt.Fprintf(w, "2 [TOO] Run command failure: %s\n", message)
+		fmt.Fprintln(w, "x 1")
+		flush()
+		return
+	}
+	s.watchers[wake] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, wake)
+		s.mu.Unlock()
+	}()
+
+	var last interface{}
+	first := true
+	for {
+		s.mu.Lock()
+		var value interface{}
+		found := false
+		if device := s.nodeLocked(nodeID); device != nil {
+			value, found = device.Attributes[endpointID][cluster+"/"+attribute]
+		}
+		s.mu.Unlock()
+		if found && (first || value != last) {
+			fmt.Fprintf(w, "1 CHIP:DMG: ReportDataMessage =\n1 CHIP:DMG:   Data = %s (%s)\n1 CHIP:DMG: }\n", formatSimValue(value), simValueType(value))
+			flush()
+			last, first = value, false
+		}
+		select {
+		case <-done:
+			return
+		case <-wake:
+		}
+	}
+}
+
+// handleExec serves the simulated chip-tool processes. The response is a line stream: "1 <line>"
+// for stdout, "2 <line>" for stderr and a final "x <exit code>".
+func (s *Simulator) handleExec(c *gin.Context) {
+	if host, _, _ := net.SplitHostPort(c.Request.RemoteAddr); !net.ParseIP(host).IsLoopback() {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	var args []string
+	if err := c.ShouldBindJSON(&args); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	w := bufio.NewWriter(c.Writer)
+	flush := func() {
+		w.Flush()
+		c.Writer.Flush()
+	}
+	c.Status(http.StatusOK)
+	positional := stripFlags(args)
+	if len(positional) >= 2 && (positional[1] == "subscribe" || positional[1] == "subscribe-event") {
+		if positional[1] == "subscribe" {
+			s.Subscribe(args, w, flush, c.Request.Context().Done())
+		} else {
+			<-c.Request.Context().Done() // Simulated switches never send events
+		}
+		flush()
+		return
+	}
+	out := s.Exec(args)
+	for _, line := range strings.SplitAfter(out.stdout.String(), "\n") {
+		if line != "" {
+			fmt.Fprintf(w, "1 %s", strings.TrimSuffix(line, "\n")+"\n")
+		}
+	}
+	for _, line := range strings.SplitAfter(out.stderr.String(), "\n") {
+		if line != "" {
+			fmt.Fprintf(w, "2 %s", strings.TrimSuffix(line, "\n")+"\n")
+		}
+	}
+	fmt.Fprintf(w, "x %d\n", out.exitCode)
+	flush()
+}
+
+// registerSimulatorRoutes adds the simulator endpoints: the one the simulated chip-tool calls and
+// the scripting API for frontend tests.
+func registerSimulatorRoutes(router *gin.Engine) {
+	router.POST("/api/sim/exec", simulator.handleExec)
+	router.GET("/api/sim/devices", func(c *gin.Context) {
+		c.JSON(http.StatusOK, simulator.List())
+	})
+	// e.g. {"cluster": "TemperatureMeasurement", "attribute": "measured-value", "value": 2500} for 25 °C
+	router.PUT("/api/sim/devices/:id/attributes", func(c *gin.Context) {
+		var write SimAttributeWrite
+		if err := c.ShouldBindJSON(&write); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := simulator.SetAttribute(c.Param("id"), write); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+	router.GET("/api/sim/faults", func(c *gin.Context) {
+		c.JSON(http.StatusOK, simulator.Faults())
+	})
+	// e.g. {"operation": "commissioning", "error": "attestation", "count": 1}
+	router.POST("/api/sim/faults", func(c *gin.Context) {
+		var fault SimFault
+		if err := c.ShouldBindJSON(&fault); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		simulator.AddFault(fault)
+		c.Status(http.StatusNoContent)
+	})
+	router.DELETE("/api/sim/faults", func(c *gin.Context) {
+		simulator.ClearFaults()
+		c.Status(http.StatusNoContent)
+	})
+	router.POST("/api/sim/reset", func(c *gin.Context) {
+		simulator.Reset()
+		c.Status(http.StatusNoContent)
+	})
+}
+
+// startSimulation makes the backend run its own binary as chip-tool, answering from the simulator.
+func startSimulation(listenAddr string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return err
+	}
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	os.Setenv(simulatorURLEnv, "http://"+net.JoinHostPort(host, port)+"/api/sim/exec")
+	chipToolPath = self
+	log.Printf("SIMULATION MODE: chip-tool is simulated, script the devices with /api/sim/*")
+	return nil
+}
+
+// runSimulatedChipTool is main when the binary runs as the simulated chip-tool: it forwards its
+// arguments to the simulator and replays the answer on stdout/stderr. It returns the exit code.
+func runSimulatedChipTool(url string, args []string) int {
+	body, _ := json.Marshal(args)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	for attempt := 0; err != nil && attempt < 20; attempt++ {
+		time.Sleep(250 * time.Millisecond) // The backend may still be starting its listener
+		resp, err = http.Post(url, "application/json", bytes.NewReader(body))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "CHIP Error: simulator unreachable: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		kind, line, _ := strings.Cut(scanner.Text(), " ")
+		switch kind {
+		case "1":
+			fmt.Fprintln(os.Stdout, line)
+		case "2":
+			fmt.Fprintln(os.Stderr, line)
+		case "x":
+			code, _ := strconv.Atoi(line)
+			return code
+		}
+	}
+	return 0
+}
+
+// simulator holds the virtual devices of simulation mode.
+var simulator = NewSimulator()
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Defaults of the slow-consumer policy, used when the slowConsumer settings are zero.
+const (
+	defaultSlowQueuePercent   = 80
+	defaultSlowConsumerPeriod = 10 * time.Second
+	slowConsumerCheckInterval = time.Second
+	maxRecentEvictions        = 20
+)
+
+// Machine-readable reasons of an eviction, sent as the reason of the going-away close frame so a
+// client can tell it from a restart and, e.g., reconnect with batching or fewer subscriptions.
+const (
+	evictionSlowConsumer = "slow_consumer" // The send queue stayed above the threshold
+	evictionWriteTimeout = "write_timeout" // A single message took longer than the write deadline
+)
+
+// SlowConsumerConfig sets when a WebSocket client that can't keep up is disconnected.
+type SlowConsumerConfig struct {
+	// QueuePercent is how full the client's send queue must be to count as slow. Zero uses 80.
+	QueuePercent int `json:"queuePercent,omitempty"`
+	// Seconds is how long the queue must stay above QueuePercent before the client is evicted.
+	// Zero uses 10; negative disables eviction, leaving only the drops.
+	Seconds int `json:"seconds,omitempty"`
+	// WriteTimeoutSeconds is the deadline of each message written to a client; a client missing it
+	// is disconnected. Zero uses writeWait.
+	WriteTimeoutSeconds int `json:"writeTimeoutSeconds,omitempty"`
+}
+
+// writeDeadline is the time allowed to write one message or control frame to a client. A client
+// missing it is closed and counted as a write_timeout eviction, so one that reads nothing at all
+// doesn't linger until its queue fills up.
+func writeDeadline() time.Duration {
+	if appConfig.SlowConsumer.WriteTimeoutSeconds > 0 {
+		return time.Duration(appConfig.SlowConsumer.WriteTimeoutSeconds) * time.Second
+	}
+	return writeWait
+}
+
+// consumerHealth tracks how a client keeps up with its send queue. The hub holds it under h.mu.
+type consumerHealth struct {
+	slowSince time.Time // When the queue went above the threshold, zero while below
+	dropped   int       // Messages dropped because the queue was full
+	evicted   bool      // Set once the close was queued, so it isn't evicted twice
+}
+
+// Eviction records a client disconnected for not keeping up.
+type Eviction struct {
+	ClientID string          `json:"clientId"`
+	Addr     string          `json:"addr"`
+	Identity *ClientIdentity `json:"identity,omitempty"`
+	Reason   string          `json:"reason"` // evictionSlowConsumer or evictionWriteTimeout
+	Detail   string          `json:"detail"`
+	Queued   int             `json:"queued"`
+	Dropped  int             `json:"dropped"` // Messages it lost before being evicted
+	At       time.Time       `json:"at"`
+}
+
+// EvictionStats is the "evictions" part of the hub stats.
+type EvictionStats struct {
+	Total    int            `json:"total"`
+	ByReason map[string]int `json:"byReason,omitempty"`
+	Dropped  int            `json:"dropped"`          // Messages dropped on full queues since startup, all clients
+	Recent   []Eviction     `json:"recent,omitempty"` // Latest evictions, newest last
+}
+
+// health returns the tracking of a client, creating it. The caller holds h.mu.
+func (h *Hub) health(client *Client) *consumerHealth {
+	health, ok := h.consumers[client]
+	if !ok {
+		health = &consumerHealth{}
+		h.consumers[client] = health
+	}
+	return health
+}
+
+// recordDrop counts a message dropped because the client's queue was full. The caller holds h.mu.
+func (h *Hub) recordDrop(client *Client) {
+	h.health(client).dropped++
+	h.evictions.Dropped++
+}
+
+// recordEvictionLocked adds an eviction to the stats. The caller holds h.mu.
+func (h *Hub) recordEvictionLocked(client *Client, reason, detail string) {
+	health := h.health(client)
+	health.evicted = true
+	eviction := Eviction{
+		ClientID: client.id,
+		Addr:     client.remoteAddr(),
+		Identity: client.identity.Load(),
+		Reason:   reason,
+		Detail:   detail,
+		Queued:   len(client.send),
+		Dropped:  health.dropped,
+		At:       time.Now(),
+	}
+	h.evictions.Total++
+	if h.evictions.ByReason == nil {
+		h.evictions.ByReason = make(map[string]int)
+	}
+	h.evictions.ByReason[reason]++
+	h.evictions.Recent = append(h.evictions.Recent, eviction)
+	if len(h.evictions.Recent) > maxRecentEvictions {
+		h.evictions.Recent = h.evictions.Recent[len(h.evictions.Recent)-maxRecentEvictions:]
+	}
+	log.Printf("Evicting client %s (%s): %s", client.logName(), reason, detail)
+}
+
+// recordWriteTimeout counts a client whose write missed the deadline; writePump then closes it.
+func (h *Hub) recordWriteTimeout(client *Client, err error) {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[client]; !ok || h.health(client).evicted {
+		return
+	}
+	h.recordEvictionLocked(client, evictionWriteTimeout, fmt.Sprintf("a message wasn't written within %s", writeDeadline()))
+}
+
+// checkSlowConsumers evicts the clients whose send queue stayed above the threshold for the
+// configured period: they get a going-away close with the evictionSlowConsumer reason, sent on the
+// control lane ahead of their backlog.
+func (h *Hub) checkSlowConsumers(threshold int, period time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for client := range h.clients {
+		queued := len(client.send)
+		health, tracked := h.consumers[client]
+		if queued*100 < threshold*cap(client.send) {
+			if tracked {
+				health.slowSince = time.Time{}
+			}
+			continue
+		}
+		health = h.health(client)
+		if health.evicted {
+			continue
+		}
+		if health.slowSince.IsZero() {
+			health.slowSince = now
+			log.Printf("Client %s is slow: %d/%d messages queued", client.logName(), queued, cap(client.send))
+			continue
+		}
+		if now.Sub(health.slowSince) < period {
+			continue
+		}
+		h.recordEvictionLocked(client, evictionSlowConsumer, fmt.Sprintf("send queue above %d%% for %s (%d/%d queued, %d dropped)", threshold, now.Sub(health.slowSince).Round(time.Second), queued, cap(client.send), health.dropped))
+		client.closeWith(websocket.CloseGoingAway, evictionSlowConsumer)
+		conn := client.conn
+		// A client that doesn't read at all also blocks the close frame; drop the connection
+		// once the write deadline had a chance to expire.
+		time.AfterFunc(2*writeDeadline(), func() { conn.Close() })
+	}
+}
+
+// RunSlowConsumerCheck applies the slow-consumer policy until the process exits.
+func (h *Hub) RunSlowConsumerCheck() {
+	threshold, period := defaultSlowQueuePercent, defaultSlowConsumerPeriod
+	if p := appConfig.SlowConsumer.QueuePercent; p > 0 && p <= 100 {
+		threshold = p
+	}
+	if s := appConfig.SlowConsumer.Seconds; s < 0 {
+		log.Printf("Slow-consumer eviction disabled")
+		return
+	} else if s > 0 {
+		period = time.Duration(s) * time.Second
+	}
+	ticker := time.NewTicker(slowConsumerCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.checkSlowConsumers(threshold, period)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxHistoryPoints is how many samples are kept per attribute in the in-memory history.
+const maxHistoryPoints = 500
+
+// historyFile is where the history samples are appended as JSON lines, in the data directory.
+const historyFile = "history.jsonl"
+
+// AttributeState is the last known value of a single attribute on a node/endpoint.
+type AttributeState struct {
+	NodeID     string         `json:"nodeId"`
+	EndpointID string         `json:"endpointId"`
+	Cluster    string         `json:"cluster"`
+	Attribute  string         `json:"attribute"`
+	Value      interface{}    `json:"value"`
+	RawValue   interface{}    `json:"rawValue,omitempty"`
+	Unit       string         `json:"unit,omitempty"`
+	Display    string         `json:"display,omitempty"` // Value formatted with the client's unit preferences (see units.go)
+	Reading    *SensorReading `json:"reading,omitempty"` // Typed sensor reading, only for known sensor attributes
+	Source     string         `json:"source,omitempty"`  // Source of the last update, e.g. "optimistic" (see commandstate.go)
+	UpdatedAt  time.Time      `json:"updatedAt"`
+}
+
+// StateCache keeps the latest value of every attribute we have seen, from reads or subscriptions.
+type StateCache struct {
+	mu      sync.RWMutex
+	entries map[string]*AttributeState
+}
+
+// NewStateCache creates an empty StateCache.
+func NewStateCache() *StateCache {
+	return &StateCache{entries: make(map[string]*AttributeState)}
+}
+
+// stateKey builds the cache/history key for an attribute.
+func stateKey(nodeID, endpointID, cluster, attribute string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", nodeID, endpointID, cluster, attribute)
+}
+
+// Update stores the value carried by an attribute update.
+func (s *StateCache) Update(update AttributeUpdatePayload, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[stateKey(update.NodeID, update.EndpointID, update.Cluster, update.Attribute)] = &AttributeState{
+		NodeID:     update.NodeID,
+		EndpointID: update.EndpointID,
+		Cluster:    update.Cluster,
+		Attribute:  update.Attribute,
+		Value:      update.Value,
+		RawValue:   update.RawValue,
+		Unit:       update.Unit,
+		Reading:    update.Reading,
+		Source:     update.Source,
+		UpdatedAt:  at,
+	}
+}
+
+// Get returns the cached state of an attribute, if any.
+func (s *StateCache) Get(nodeID, endpointID, cluster, attribute string) (AttributeState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.entries[stateKey(nodeID, endpointID, cluster, attribute)]
+	if !ok {
+		return AttributeState{}, false
+	}
+	return *entry, true
+}
+
+// NodeAttributes returns every cached attribute of a node, sorted by key.
+func (s *StateCache) NodeAttributes(nodeID string) []AttributeState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []string
+	for key, entry := range s.entries {
+		if entry.NodeID == nodeID {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	states := make([]AttributeState, 0, len(keys))
+	for _, key := range keys {
+		states = append(states, *s.entries[key])
+	}
+	return states
+}
+
+// Forget drops the cached attributes of a node endpoint, or of the whole node when endpointID is empty.
+func (s *StateCache) Forget(nodeID, endpointID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range s.entries {
+		if entry.NodeID == nodeID && (endpointID == "" || entry.EndpointID == endpointID) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// HistoryPoint is a single recorded attribute sample.
+type HistoryPoint struct {
+	Value     interface{}    `json:"value"`
+	RawValue  interface{}    `json:"rawValue,omitempty"`
+	Reading   *SensorReading `json:"reading,omitempty"`
+	Timestamp time.Time      `json:"timestamp"`
+}
+
+// historyRecord is a line of historyFile: a sample and the attribute it belongs to.
+type historyRecord struct {
+	Key string `json:"key"`
+	HistoryPoint
+}
+
+// AttributeHistory keeps a bounded list of samples per attribute. Samples are appended to
+// historyFile in batches (see writebatch.go), which is compacted to the kept samples once it holds
+// too many dropped ones, so the history survives restarts.
+type AttributeHistory struct {
+	mu        sync.RWMutex
+	maxPoints int
+	series    map[string][]HistoryPoint
+	file      *BatchWriter
+	appended  int // Lines appended to the file since it was last compacted
+}
+
+// NewAttributeHistory creates an AttributeHistory keeping at most maxPoints samples per attribute.
+func NewAttributeHistory(maxPoints int) *AttributeHistory {
+	return &AttributeHistory{maxPoints: maxPoints, series: make(map[string][]HistoryPoint), file: NewBatchWriter(historyFile, 0o644)}
+}
+
+// Load replays historyFile, keeping the latest maxPoints samples per attribute, then compacts it.
+// Damaged lines, such as a last line cut by a crash, are skipped.
+func (h *AttributeHistory) Load() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	damaged := 0
+	err := h.file.Rewrite(func(data []byte) ([]byte, error) {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+		for scanner.Scan() {
+			var record historyRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || record.Key == "" {
+				damaged++
+				continue
+			}
+			points := append(h.series[record.Key], record.HistoryPoint)
+			if len(points) > h.maxPoints {
+				points = points[len(points)-h.maxPoints:]
+			}
+			h.series[record.Key] = points
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return h.encodeLocked()
+	})
+	if damaged > 0 {
+		log.Printf("Skipped %d damaged line(s) of %s", damaged, historyFile)
+	}
+	h.appended = 0
+	return err
+}
+
+// encodeLocked renders the kept samples as the content of historyFile, oldest first per
+// attribute. Callers must hold h.mu.
+func (h *AttributeHistory) encodeLocked() ([]byte, error) {
+	var buf bytes.Buffer
+	for key, points := range h.series {
+		for _, point := range points {
+			line, err := json.Marshal(historyRecord{Key: key, HistoryPoint: point})
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// compactLocked rewrites historyFile with the kept samples only. Callers must hold h.mu.
+func (h *AttributeHistory) compactLocked() {
+	err := h.file.Rewrite(func([]byte) ([]byte, error) { return h.encodeLocked() })
+	if err != nil {
+		log.Printf("Could not compact %s: %v", historyFile, err)
+		return
+	}
+	h.appended = 0
+}
+
+// Append records a sample, dropping the oldest one when the series is full.
+func (h *AttributeHistory) Append(update AttributeUpdatePayload, at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := stateKey(update.NodeID, update.EndpointID, update.Cluster, update.Attribute)
+	point := HistoryPoint{Value: update.Value, RawValue: update.RawValue, Reading: update.Reading, Timestamp: at}
+	points := append(h.series[key], point)
+	if len(points) > h.maxPoints {
+		points = points[len(points)-h.maxPoints:]
+	}
+	h.series[key] = points
+
+	line, err := json.Marshal(historyRecord{Key: key, HistoryPoint: point})
+	if err != nil {
+		log.Printf("History: could not encode a sample of %s: %v", key, err)
+		return
+	}
+	h.file.Append(line)
+	h.appended++
+	// Once the file holds more dropped samples than a full history, rewrite it.
+	if h.appended > len(h.series)*h.maxPoints+10000 {
+		h.compactLocked()
+	}
+}
+
+// Query returns the latest samples of an attribute (oldest first). limit <= 0 returns everything kept.
+func (h *AttributeHistory) Query(nodeID, endpointID, cluster, attribute string, limit int) []HistoryPoint {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	points := h.series[stateKey(nodeID, endpointID, cluster, attribute)]
+	if limit > 0 && len(points) > limit {
+		points = points[len(points)-limit:]
+	}
+	result := make([]HistoryPoint, len(points))
+	copy(result, points)
+	return result
+}
+
+// Range returns the samples taken between from and to (zero for no bound) of the attributes whose
+// key keep accepts, by key, oldest first.
+func (h *AttributeHistory) Range(keep func(key string) bool, from, to time.Time) map[string][]HistoryPoint {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	result := make(map[string][]HistoryPoint)
+	for key, points := range h.series {
+		if !keep(key) {
+			continue
+		}
+		start, end := 0, len(points)
+		if !from.IsZero() {
+			start = sort.Search(len(points), func(i int) bool { return !points[i].Timestamp.Before(from) })
+		}
+		if !to.IsZero() {
+			end = sort.Search(len(points), func(i int) bool { return points[i].Timestamp.After(to) })
+		}
+		if start < end {
+			result[key] = append([]HistoryPoint(nil), points[start:end]...)
+		}
+	}
+	return result
+}
+
+// Forget drops the history of a node endpoint, or of the whole node when endpointID is empty.
+func (h *AttributeHistory) Forget(nodeID, endpointID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	prefix := nodeID + "/"
+	if endpointID != "" {
+		prefix += endpointID + "/"
+	}
+	forgotten := false
+	for key := range h.series {
+		if strings.HasPrefix(key, prefix) {
+			delete(h.series, key)
+			forgotten = true
+		}
+	}
+	if forgotten {
+		h.compactLocked()
+	}
+}
+
+// PruneBefore drops the samples older than cutoff and the series left empty. It returns the
+// number of samples dropped.
+func (h *AttributeHistory) PruneBefore(cutoff time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pruned := 0
+	for key, points := range h.series {
+		i := sort.Search(len(points), func(i int) bool { return !points[i].Timestamp.Before(cutoff) })
+		if i == 0 {
+			continue
+		}
+		pruned += i
+		if i == len(points) {
+			delete(h.series, key)
+			continue
+		}
+		h.series[key] = append([]HistoryPoint(nil), points[i:]...)
+	}
+	if pruned > 0 {
+		h.compactLocked()
+	}
+	return pruned
+}
+
+var (
+	stateCache       = NewStateCache()
+	attributeHistory = NewAttributeHistory(maxHistoryPoints)
+)
+
+// publishAttributeUpdate is the single path every attribute value takes (reads and subscriptions):
+// it normalises the value to a common unit, attaches a typed reading for known sensors, debounces it (see debounce.go), updates the state cache, and publishes it (the history recorder subscribes to it).
+// Updates without a client (rules, polling) are broadcast to every client.
+func publishAttributeUpdate(client *Client, update AttributeUpdatePayload) {
+	now := time.Now()
+	normalizeAttributeUpdate(&update)
+	if reading, ok := buildSensorReading(update); ok {
+		update.Reading = &reading
+	}
+	if attributeDebouncer.Hold(client, update, now) {
+		return
+	}
+	recordAttributeUpdate(client, update, now)
+}
+
+// recordAttributeUpdate caches and publishes a normalised attribute update.
+func recordAttributeUpdate(client *Client, update AttributeUpdatePayload, now time.Time) {
+	stateCache.Update(update, now)
+	deviceRegistry.ApplyAttributeUpdate(update)
+	log.Printf("Attribute update recorded: Node %s EP%s %s.%s = %v", update.NodeID, update.EndpointID, update.Cluster, update.Attribute, update.Value)
+	if client == nil {
+		broadcastToClients("attribute_update", update)
+		return
+	}
+	client.sendPayload("attribute_update", update)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// loadJSONFile decodes a JSON file into v. A missing file leaves v untouched and is not an error.
+// Relative paths are in the data directory (see datadir.go).
+func loadJSONFile(path string, v interface{}) error {
+	path = dataFilePath(path)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// saveJSONFile writes v as indented JSON. The data is written to a temporary file first and
+// renamed over the target, so a crash mid-write never leaves a truncated file behind.
+// Relative paths are in the data directory (see datadir.go).
+func saveJSONFile(path string, v interface{}) error {
+	path = dataFilePath(path)
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
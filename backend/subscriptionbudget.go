@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Subscription error budget defaults, used when the config doesn't set them.
+const (
+	defaultMaxRapidFailures    = 5
+	defaultRapidFailureSeconds = 60
+	subscriptionRestartMin     = 5 * time.Second
+	subscriptionRestartMax     = 5 * time.Minute
+)
+
+// SubscriptionBudgetEntry is the failure record of an attribute subscription.
+type SubscriptionBudgetEntry struct {
+	SubscriptionID string    `json:"subscriptionId"`
+	NodeID         string    `json:"nodeId"`
+	EndpointID     string    `json:"endpointId"`
+	Cluster        string    `json:"cluster"`
+	Attribute      string    `json:"attribute"`
+	Failures       int       `json:"failures"` // Rapid failures in a row
+	Disabled       bool      `json:"disabled"`
+	Reason         string    `json:"reason,omitempty"` // Why it was disabled, e.g. chip-tool's last error
+	LastFailure    time.Time `json:"lastFailure,omitzero"`
+	DisabledAt     time.Time `json:"disabledAt,omitzero"`
+}
+
+// EnableSubscriptionPayload is the payload of "enable_subscription".
+type EnableSubscriptionPayload struct {
+	SubscriptionID string `json:"subscriptionId" validate:"required"`
+}
+
+// DisabledSubscriptionsPayload is sent in response to "list_disabled_subscriptions" and "enable_subscription".
+type DisabledSubscriptionsPayload struct {
+	Subscriptions []SubscriptionBudgetEntry `json:"subscriptions"`
+}
+
+// SubscriptionBudget restarts attribute subscriptions whose chip-tool process exited, with a
+// growing delay, and stops when a subscription keeps crashing right after it started (an
+// unsupported attribute, a wrong endpoint): after subscriptionBudget.maxRapidFailures such
+// failures in a row it is disabled with a reason, and later attempts to start it are refused
+// until "enable_subscription". This keeps a misconfigured subscription from spawning chip-tool
+// processes forever.
+type SubscriptionBudget struct {
+	mu      sync.Mutex
+	entries map[string]*SubscriptionBudgetEntry // By subscription ID
+}
+
+// NewSubscriptionBudget creates a SubscriptionBudget with no failures recorded.
+func NewSubscriptionBudget() *SubscriptionBudget {
+	return &SubscriptionBudget{entries: make(map[string]*SubscriptionBudgetEntry)}
+}
+
+func rapidFailureWindow() time.Duration {
+	if appConfig.SubscriptionBudget.RapidFailureSeconds > 0 {
+		return time.Duration(appConfig.SubscriptionBudget.RapidFailureSeconds) * time.Second
+	}
+	return defaultRapidFailureSeconds * time.Second
+}
+
+func maxRapidFailures() int {
+	if appConfig.SubscriptionBudget.MaxRapidFailures > 0 {
+		return appConfig.SubscriptionBudget.MaxRapidFailures
+	}
+	return defaultMaxRapidFailures
+}
+
+// Disabled returns the record of a subscription when it is disabled.
+func (b *SubscriptionBudget) Disabled(subscriptionID string) (SubscriptionBudgetEntry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.entries[subscriptionID]
+	if !ok || !entry.Disabled {
+		return SubscriptionBudgetEntry{}, false
+	}
+	return *entry, true
+}
+
+// Reported clears the failures of a subscription that delivered a report.
+func (b *SubscriptionBudget) Reported(subscriptionID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if entry, ok := b.entries[subscriptionID]; ok && !entry.Disabled {
+		delete(b.entries, subscriptionID)
+	}
+}
+
+// Failed records the unexpected exit of a subscription process that ran for ranFor and delivered
+// reports or not. It returns the delay before restarting it, or disabled when the subscription
+// ran out of budget.
+func (b *SubscriptionBudget) Failed(target SubscriptionBudgetEntry, ranFor time.Duration, reported bool, lastError string) (restartIn time.Duration, entry SubscriptionBudgetEntry, disabled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[target.SubscriptionID]
+	if !ok {
+		e = &target
+		b.entries[target.SubscriptionID] = e
+	}
+	e.LastFailure = time.Now()
+	if reported || ranFor >= rapidFailureWindow() {
+		e.Failures = 0
+		return subscriptionRestartMin, *e, false
+	}
+	e.Failures++
+	if e.Failures >= maxRapidFailures() {
+		e.Disabled, e.DisabledAt = true, time.Now()
+		e.Reason = fmt.Sprintf("exited %d times in a row within %v of starting, without a report", e.Failures, rapidFailureWindow())
+		if lastError != "" {
+			e.Reason += ": " + lastError
+		}
+		return 0, *e, true
+	}
+	return min(subscriptionRestartMin<<(e.Failures-1), subscriptionRestartMax), *e, false
+}
+
+// Enable clears the failures of a subscription, so it can be started again.
+func (b *SubscriptionBudget) Enable(subscriptionID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.entries[subscriptionID]; !ok {
+		return fmt.Errorf("subscription %q is not disabled", subscriptionID)
+	}
+	delete(b.entries, subscriptionID)
+	log.Printf("[%s] Subscription enabled again", subscriptionID)
+	return nil
+}
+
+// ListDisabled returns the disabled subscriptions, sorted by ID.
+func (b *SubscriptionBudget) ListDisabled() []SubscriptionBudgetEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	disabled := make([]SubscriptionBudgetEntry, 0)
+	for _, entry := range b.entries {
+		if entry.Disabled {
+			disabled = append(disabled, *entry)
+		}
+	}
+	sort.Slice(disabled, func(i, j int) bool { return disabled[i].SubscriptionID < disabled[j].SubscriptionID })
+	return disabled
+}
+
+func handleListDisabledSubscriptions(client *Client) {
+	client.sendPayload("disabled_subscriptions", DisabledSubscriptionsPayload{Subscriptions: subscriptionBudget.ListDisabled()})
+}
+
+func handleEnableSubscription(client *Client, payload EnableSubscriptionPayload) {
+	if err := subscriptionBudget.Enable(payload.SubscriptionID); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "enable_subscription failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("disabled_subscriptions", DisabledSubscriptionsPayload{Subscriptions: subscriptionBudget.ListDisabled()})
+}
+
+var subscriptionBudget = NewSubscriptionBudget()
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// trackedSubscription is a running chip-tool subscribe process.
+type trackedSubscription struct {
+	nodeID     string
+	endpointID string
+	cmd        *exec.Cmd
+	owner      string // quotaOwner of the client that started it, empty for the backend's own (see quotas.go)
+	// For attribute subscriptions: the intervals asked for, the max interval the process runs with
+	// (see focus.go) and a function starting the subscription again. Event subscriptions have no restart.
+	minInterval string
+	maxInterval string
+	running     string
+	restart     func()
+}
+
+// pendingRestart is a subscription waiting to be restarted after its process exited (see subscriptionbudget.go).
+type pendingRestart struct {
+	nodeID     string
+	endpointID string
+	timer      *time.Timer
+}
+
+// SubscriptionTracker keeps the running chip-tool subscription processes, so they can be stopped
+// when their device is removed.
+type SubscriptionTracker struct {
+	mu      sync.Mutex
+	subs    map[string]trackedSubscription
+	pending map[string]pendingRestart
+}
+
+// NewSubscriptionTracker creates an empty SubscriptionTracker.
+func NewSubscriptionTracker() *SubscriptionTracker {
+	return &SubscriptionTracker{subs: make(map[string]trackedSubscription), pending: make(map[string]pendingRestart)}
+}
+
+// Track records a started subscription process under its subscription ID, replacing a pending restart.
+func (t *SubscriptionTracker) Track(subscriptionID string, sub trackedSubscription) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.pending[subscriptionID]; ok {
+		p.timer.Stop()
+		delete(t.pending, subscriptionID)
+	}
+	t.subs[subscriptionID] = sub
+}
+
+// ScheduleRestart runs restart after delay, unless the node's subscriptions are stopped meanwhile
+// or the subscription is started again some other way.
+func (t *SubscriptionTracker) ScheduleRestart(subscriptionID, nodeID, endpointID string, delay time.Duration, restart func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.pending[subscriptionID]; ok {
+		p.timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		t.mu.Lock()
+		current, ok := t.pending[subscriptionID]
+		if !ok || current.timer != timer {
+			t.mu.Unlock()
+			return
+		}
+		delete(t.pending, subscriptionID)
+		t.mu.Unlock()
+		restart()
+	})
+	t.pending[subscriptionID] = pendingRestart{nodeID: nodeID, endpointID: endpointID, timer: timer}
+}
+
+// Untrack forgets a subscription once its process has exited. A newer process started
+// under the same ID is kept. It reports false when the process was no longer tracked, i.e. it
+// was stopped or restarted on purpose.
+func (t *SubscriptionTracker) Untrack(subscriptionID string, cmd *exec.Cmd) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if sub, ok := t.subs[subscriptionID]; ok && sub.cmd == cmd {
+		delete(t.subs, subscriptionID)
+		return true
+	}
+	return false
+}
+
+// Count returns the number of running subscription processes of a node.
+func (t *SubscriptionTracker) Count(nodeID string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, sub := range t.subs {
+		if sub.nodeID == nodeID {
+			n++
+		}
+	}
+	return n
+}
+
+// Has reports whether a subscription process runs under the ID.
+func (t *SubscriptionTracker) Has(subscriptionID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.subs[subscriptionID]
+	return ok
+}
+
+// CountOwner returns the number of running subscription processes started by a quota owner.
+func (t *SubscriptionTracker) CountOwner(owner string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, sub := range t.subs {
+		if sub.owner == owner {
+			n++
+		}
+	}
+	return n
+}
+
+// Total returns the number of running subscription processes.
+func (t *SubscriptionTracker) Total() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.subs)
+}
+
+// Stop kills the subscription processes of a node endpoint, or of the whole node when endpointID
+// is empty, and returns how many were stopped.
+func (t *SubscriptionTracker) Stop(nodeID, endpointID string) int {
+	t.mu.Lock()
+	var stop []string
+	for id, sub := range t.subs {
+		if sub.nodeID == nodeID && (endpointID == "" || sub.endpointID == endpointID) {
+			stop = append(stop, id)
+		}
+	}
+	cmds := make([]*exec.Cmd, 0, len(stop))
+	for _, id := range stop {
+		cmds = append(cmds, t.subs[id].cmd)
+		delete(t.subs, id)
+	}
+	for id, p := range t.pending {
+		if p.nodeID == nodeID && (endpointID == "" || p.endpointID == endpointID) {
+			p.timer.Stop()
+			delete(t.pending, id)
+		}
+	}
+	t.mu.Unlock()
+	for i, cmd := range cmds {
+		if err := cmd.Process.Kill(); err != nil {
+			log.Printf("[%s] Could not stop subscription: %v", stop[i], err)
+		}
+	}
+	return len(cmds)
+}
+
+// Retune restarts the attribute subscriptions of a node whose max interval no longer matches the
+// one wanted by subscriptionFocus, and returns how many were restarted.
+func (t *SubscriptionTracker) Retune(nodeID string) int {
+	t.mu.Lock()
+	var stale []trackedSubscription
+	for id, sub := range t.subs {
+		if sub.nodeID != nodeID || sub.restart == nil {
+			continue
+		}
+		if subscriptionFocus.MaxInterval(nodeID, sub.minInterval, sub.maxInterval) != sub.running {
+			stale = append(stale, sub)
+			delete(t.subs, id)
+		}
+	}
+	t.mu.Unlock()
+	for _, sub := range stale {
+		if err := sub.cmd.Process.Kill(); err != nil {
+			log.Printf("Could not stop a subscription of node %s to restart it: %v", nodeID, err)
+			continue
+		}
+		go sub.restart()
+	}
+	return len(stale)
+}
+
+// Resubscribe restarts the attribute subscriptions of a node, for instance after it moved to another
+// address, and returns how many were restarted. Event subscriptions can't be restarted and are left alone.
+func (t *SubscriptionTracker) Resubscribe(nodeID string) int {
+	t.mu.Lock()
+	var restart []trackedSubscription
+	for id, sub := range t.subs {
+		if sub.nodeID == nodeID && sub.restart != nil {
+			restart = append(restart, sub)
+			delete(t.subs, id)
+		}
+	}
+	t.mu.Unlock()
+	for _, sub := range restart {
+		if err := sub.cmd.Process.Kill(); err != nil {
+			log.Printf("Could not stop a subscription of node %s to restart it: %v", nodeID, err)
+			continue
+		}
+		go sub.restart()
+	}
+	return len(restart)
+}
+
+// ResubscribeAll restarts the attribute subscriptions of every node, and returns how many were restarted.
+func (t *SubscriptionTracker) ResubscribeAll() int {
+	t.mu.Lock()
+	nodes := make(map[string]bool)
+	for _, sub := range t.subs {
+		nodes[sub.nodeID] = true
+	}
+	t.mu.Unlock()
+	n := 0
+	for nodeID := range nodes {
+		n += t.Resubscribe(nodeID)
+	}
+	return n
+}
+
+var subscriptions = NewSubscriptionTracker()
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// switchClusterID is the Matter cluster ID of the Switch cluster (0x003B).
+const switchClusterID = 0x003B
+
+// switchEvents are the chip-tool event names of the Switch cluster we turn into button events,
+// mapped to the event name used in button_event payloads.
+var switchEvents = map[string]string{
+	"initial-press":        "initial_press",
+	"long-press":           "long_press",
+	"short-release":        "short_release",
+	"long-release":         "long_release",
+	"multi-press-complete": "multi_press_complete",
+}
+
+// Default subscription intervals for Switch events. Events are delivered as they happen,
+// the max interval only controls how often the device confirms the subscription is alive.
+const (
+	switchEventMinInterval = "0"
+	switchEventMaxInterval = "300"
+)
+
+var (
+	reEventHeader = regexp.MustCompile(`\[TOO\]\s+Endpoint:\s*(\d+)\s+Cluster:\s*\S+\s+Event\s+\S+`)
+	reEventField  = regexp.MustCompile(`\[TOO\]\s+([A-Za-z]+):\s*(\d+)`)
+)
+
+// subscribeSwitchEvents starts one chip-tool event subscription per Switch event on the endpoint.
+func subscribeSwitchEvents(client *Client, nodeID, endpointID string) {
+	for chipEvent, eventName := range switchEvents {
+		go startSwitchEventSubscription(client, nodeID, endpointID, chipEvent, eventName)
+	}
+}
+
+// detectAndSubscribeSwitchEvents checks the endpoint's Descriptor for the Switch cluster and,
+// if present, subscribes to its events. Used right after commissioning.
+func detectAndSubscribeSwitchEvents(client *Client, nodeID, endpointID string) {
+	hasSwitch, err := endpointHasCluster(nodeID, endpointID, switchClusterID)
+	if err != nil {
+		log.Printf("Could not check Switch cluster on Node %s EP%s: %v", nodeID, endpointID, err)
+		return
+	}
+	if !hasSwitch {
+		return
+	}
+	client.notifyClientLog("subscription_log", fmt.Sprintf("Node %s EP%s exposes the Switch cluster, subscribing to button events.", nodeID, endpointID))
+	subscribeSwitchEvents(client, nodeID, endpointID)
+}
+
+func startSwitchEventSubscription(client *Client, nodeID, endpointID, chipEvent, eventName string) {
+	subscriptionID := fmt.Sprintf("evt-%s-%s-switch-%s", nodeID, endpointID, chipEvent)
+	cmdArgs := []string{"switch", "subscribe-event", chipEvent, switchEventMinInterval, switchEventMaxInterval, nodeID, endpointID}
+	cmd := exec.Command(chipToolPath, withChipToolStorage(cmdArgs)...)
+
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Printf("[%s] Error creating stdout pipe for event subscription: %v", subscriptionID, err)
+		client.notifyClientLog("subscription_log", fmt.Sprintf("Error starting Switch %s subscription: %v", chipEvent, err))
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("[%s] Error starting chip-tool subscribe-event command: %v", subscriptionID, err)
+		client.notifyClientLog("subscription_log", fmt.Sprintf("Error starting Switch %s subscription: %v", chipEvent, err))
+		return
+	}
+	log.Printf("[%s] chip-tool subscribe-event process started (PID: %d).", subscriptionID, cmd.Process.Pid)
+	subscriptions.Track(subscriptionID, trackedSubscription{nodeID: nodeID, endpointID: endpointID, cmd: cmd})
+	defer subscriptions.Untrack(subscriptionID, cmd)
+
+	scanner := bufio.NewScanner(stdoutPipe)
+	var current *ButtonEventPayload
+	flush := func() {
+		if current != nil {
+			publishButtonEvent(client, *current)
+			current = nil
+		}
+	}
+	for scanner.Scan() {
+		line := stripAnsi(scanner.Text())
+		if reEventHeader.MatchString(line) {
+			// A new event report starts; the previous one (if any) is complete.
+			flush()
+			current = &ButtonEventPayload{NodeID: nodeID, EndpointID: endpointID, Event: eventName}
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		if m := reEventField.FindStringSubmatch(line); len(m) == 3 {
+			n, _ := strconv.Atoi(m[2])
+			switch m[1] {
+			case "NewPosition", "PreviousPosition":
+				current.Position = n
+			case "TotalNumberOfPressesCounted":
+				current.PressCount = n
+			}
+		}
+		if strings.Contains(line, "}") && current.Position != 0 {
+			flush()
+		}
+	}
+	flush()
+	waitErr := cmd.Wait()
+	log.Printf("[%s] chip-tool subscribe-event command finished. Exit error: %v", subscriptionID, waitErr)
+	client.notifyClientLog("subscription_log", fmt.Sprintf("Switch %s subscription on Node %s EP%s ended. Error: %v", chipEvent, nodeID, endpointID, waitErr))
+}
+
+// publishButtonEvent publishes a button event for the client; the rules engine subscribes to it.
+func publishButtonEvent(client *Client, event ButtonEventPayload) {
+	event.Timestamp = time.Now()
+	log.Printf("Button event: Node %s EP%s %s position=%d presses=%d", event.NodeID, event.EndpointID, event.Event, event.Position, event.PressCount)
+	client.sendPayload("button_event", event)
+}
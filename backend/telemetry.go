@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Telemetry defaults and limits.
+const (
+	defaultTelemetryServiceName = "matter-backend"
+	telemetryExportInterval     = 5 * time.Second
+	telemetryExportTimeout      = 10 * time.Second
+	telemetryBatchSize          = 512
+	telemetryQueueSize          = 4096 // Spans waiting for export; more are dropped
+	maxSpanEvents               = 128
+)
+
+// OpenTelemetry span kinds and status codes (OTLP).
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanStatusError  = 2
+)
+
+// spanEvent is a timestamped annotation of a span: here, a message sent to the client.
+type spanEvent struct {
+	name string
+	time time.Time
+}
+
+// Span is an OpenTelemetry span. A nil *Span is valid and records nothing, which is what the
+// tracer hands out when telemetry is disabled, so callers never check.
+type Span struct {
+	mu         sync.Mutex
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte // Zero for a root span
+	name       string
+	kind       int
+	start, end time.Time
+	attributes map[string]interface{}
+	events     []spanEvent
+	errMsg     string
+	ended      bool
+}
+
+// Tracer builds spans and exports them in batches to an OTLP/HTTP collector (Jaeger, the
+// OpenTelemetry Collector...) as JSON, so no OpenTelemetry SDK is needed.
+type Tracer struct {
+	mu       sync.Mutex
+	cfg      TelemetryConfig
+	enabled  bool
+	queue    chan *Span
+	dropped  int
+	exported int
+	failing  bool // The last export failed; logged once until one succeeds
+	client   *http.Client
+}
+
+// NewTracer creates a disabled Tracer; Start enables it.
+func NewTracer() *Tracer {
+	return &Tracer{client: &http.Client{Timeout: telemetryExportTimeout}}
+}
+
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand doesn't fail on supported platforms
+	}
+}
+
+// traceContextFor derives the trace context of a request from its requestId, so a request can be
+// found in the tracing backend by the ID the client chose: a W3C traceparent
+// ("00-<trace ID>-<parent span ID>-01") joins the caller's trace, a 32-digit hex ID or a UUID is
+// the trace ID, and any other ID is hashed into one. Without a requestId the trace ID is random.
+func traceContextFor(requestID string) (traceID [16]byte, parentID [8]byte) {
+	if parts := strings.Split(requestID, "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		t, errT := hex.DecodeString(parts[1])
+		p, errP := hex.DecodeString(parts[2])
+		if errT == nil && errP == nil {
+			copy(traceID[:], t)
+			copy(parentID[:], p)
+			return traceID, parentID
+		}
+	}
+	if id := strings.ReplaceAll(requestID, "-", ""); len(id) == 32 {
+		if t, err := hex.DecodeString(id); err == nil {
+			copy(traceID[:], t)
+			return traceID, parentID
+		}
+	}
+	if requestID == "" {
+		randomBytes(traceID[:])
+		return traceID, parentID
+	}
+	sum := sha256.Sum256([]byte(requestID))
+	copy(traceID[:], sum[:16])
+	return traceID, parentID
+}
+
+// StartRequest opens the server span of a WebSocket message or REST call, in the trace of its
+// requestId (or traceparent header). It returns nil when telemetry is disabled.
+func (t *Tracer) StartRequest(name, requestID string) *Span {
+	if !t.isEnabled() {
+		return nil
+	}
+	traceID, parentID := traceContextFor(requestID)
+	span := &Span{traceID: traceID, parentID: parentID, name: name, kind: spanKindServer, start: time.Now(), attributes: make(map[string]interface{})}
+	randomBytes(span.spanID[:])
+	if requestID != "" {
+		span.attributes["matter.request_id"] = requestID
+	}
+	return span
+}
+
+func (t *Tracer) isEnabled() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.enabled
+}
+
+// Child opens a span inside this one, starting now.
+func (s *Span) Child(name string) *Span {
+	return s.ChildAt(name, time.Now())
+}
+
+// ChildAt opens a span inside this one that started at a given time, for work timed before the
+// span could be made (a chip-tool run recorded when it finished).
+func (s *Span) ChildAt(name string, start time.Time) *Span {
+	if s == nil {
+		return nil
+	}
+	child := &Span{traceID: s.traceID, parentID: s.spanID, name: name, kind: spanKindInternal, start: start, attributes: make(map[string]interface{})}
+	randomBytes(child.spanID[:])
+	return child
+}
+
+// SetAttribute sets an attribute of the span: a string, bool, integer or float.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errMsg = message
+}
+
+// recordMessage adds a message sent to the client as an event, failing the span on errors.
+func (s *Span) recordMessage(msgType string, payload interface{}) {
+	if s == nil {
+		return
+	}
+	status, code := envelopeStatus(msgType, payload)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.events) < maxSpanEvents {
+		s.events = append(s.events, spanEvent{name: msgType, time: time.Now()})
+	}
+	if status == statusError && s.errMsg == "" {
+		s.errMsg = msgType + ": " + code
+	}
+}
+
+// End ends the span now and queues it for export.
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt ends the span at a given time and queues it for export. Ending it again does nothing.
+func (s *Span) EndAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.end = true, end
+	s.mu.Unlock()
+	tracer.enqueue(s)
+}
+
+// traceparent is the W3C trace context header naming this span.
+func (s *Span) traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		t.mu.Lock()
+		t.dropped++
+		t.mu.Unlock()
+	}
+}
+
+// otlpValue encodes an attribute value as an OTLP AnyValue.
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(attributes))
+	for key, value := range attributes {
+		list = append(list, map[string]interface{}{"key": key, "value": otlpValue(value)})
+	}
+	return list
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otlpSpan encodes a span in the OTLP/JSON shape.
+func (s *Span) otlpSpan() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	span := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": unixNano(s.start),
+		"endTimeUnixNano":   unixNano(s.end),
+		"attributes":        otlpAttributes(s.attributes),
+	}
+	if s.parentID != [8]byte{} {
+		span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if len(s.events) > 0 {
+		events := make([]map[string]interface{}, 0, len(s.events))
+		for _, e := range s.events {
+			events = append(events, map[string]interface{}{"name": e.name, "timeUnixNano": unixNano(e.time)})
+		}
+		span["events"] = events
+	}
+	if s.errMsg != "" {
+		span["status"] = map[string]interface{}{"code": spanStatusError, "message": s.errMsg}
+	}
+	return span
+}
+
+// export POSTs a batch of spans to the collector's /v1/traces.
+func (t *Tracer) export(batch []*Span) error {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, s.otlpSpan())
+	}
+	body, err := json.Marshal(map[string]interface{}{"resourceSpans": []interface{}{map[string]interface{}{
+		"resource":   map[string]interface{}{"attributes": otlpAttributes(map[string]interface{}{"service.name": t.cfg.ServiceName})},
+		"scopeSpans": []interface{}{map[string]interface{}{"scope": map[string]interface{}{"name": defaultTelemetryServiceName}, "spans": spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(t.cfg.Endpoint, "/")+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// flush exports a batch, logging the first failure and the recovery. Spans of a failed export are lost.
+func (t *Tracer) flush(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	err := t.export(batch)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case err != nil && !t.failing:
+		log.Printf("Telemetry: exporting %d spans to %s failed: %v", len(batch), t.cfg.Endpoint, err)
+		t.failing = true
+	case err == nil && t.failing:
+		log.Printf("Telemetry: exporting to %s works again", t.cfg.Endpoint)
+		t.failing = false
+	}
+	if err == nil {
+		t.exported += len(batch)
+	} else {
+		t.dropped += len(batch)
+	}
+}
+
+// Start enables tracing when telemetry.endpoint is set, and exports the ended spans until the
+// process exits: every few seconds, or as soon as a batch is full.
+func (t *Tracer) Start(cfg TelemetryConfig) {
+	if cfg.Endpoint == "" {
+		return
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = defaultTelemetryServiceName
+	}
+	t.mu.Lock()
+	t.cfg, t.enabled, t.queue = cfg, true, make(chan *Span, telemetryQueueSize)
+	t.mu.Unlock()
+	log.Printf("Telemetry: exporting OpenTelemetry spans to %s as %q", cfg.Endpoint, cfg.ServiceName)
+	go func() {
+		ticker := time.NewTicker(telemetryExportInterval)
+		defer ticker.Stop()
+		var batch []*Span
+		for {
+			select {
+			case s := <-t.queue:
+				if batch = append(batch, s); len(batch) < telemetryBatchSize {
+					continue
+				}
+			case <-ticker.C:
+			}
+			t.flush(batch)
+			batch = nil
+		}
+	}()
+}
+
+// Stats reports whether tracing is on and how many spans were exported or dropped.
+func (t *Tracer) Stats() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return map[string]interface{}{"enabled": t.enabled, "endpoint": t.cfg.Endpoint, "exported": t.exported, "dropped": t.dropped, "failing": t.failing}
+}
+
+// telemetryMiddleware traces REST calls. The trace context comes from a traceparent header, else
+// X-Request-Id; the span's traceparent is sent back so callers can find it.
+func telemetryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader("traceparent")
+		if requestID == "" {
+			requestID = c.GetHeader("X-Request-Id")
+		}
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		span := tracer.StartRequest("HTTP "+c.Request.Method+" "+route, requestID)
+		if span == nil {
+			c.Next()
+			return
+		}
+		c.Header("traceparent", span.traceparent())
+		span.SetAttribute("http.method", c.Request.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("net.peer.ip", c.ClientIP())
+		c.Next()
+		status := c.Writer.Status()
+		span.SetAttribute("http.status_code", status)
+		if status >= 500 {
+			span.SetError(http.StatusText(status))
+		}
+		span.End()
+	}
+}
+
+// withSpan returns a view of the client whose messages and chip-tool runs are recorded in span.
+func (c *Client) withSpan(span *Span) *Client {
+	view := c.view()
+	view.span = span
+	return view
+}
+
+// traceSpan returns the span of the request this client view handles, nil when it isn't traced.
+func (c *Client) traceSpan() *Span {
+	if c == nil {
+		return nil
+	}
+	return c.span
+}
+
+var tracer = NewTracer()
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The Thread devices reach the gateway through a border router. When an OpenThread Border Router
+// runs next to the backend (typically on the same RPi), its REST API (otbr-agent --rest-listen-address)
+// tells whether the Thread network itself is healthy: the border router's role, the active dataset
+// and the topology from the network diagnostics. The backend polls it, lists the registered devices
+// found in the Thread network, and explains why an unreachable Thread device is unreachable.
+
+// Thread border router settings; zero config values use the defaults here.
+const (
+	defaultThreadPollInterval = 30 * time.Second
+	threadRequestTimeout      = 10 * time.Second // /diagnostics queries the whole network and takes a few seconds
+	threadStartDelay          = 5 * time.Second
+)
+
+// Thread network health, summarising the border router status.
+const (
+	threadHealthOK       = "ok"
+	threadHealthDegraded = "degraded" // Some registered Thread devices are missing or unreachable
+	threadHealthDown     = "down"     // The border router is unavailable or not attached to a Thread network
+)
+
+// Likely causes of an unreachable Thread device.
+const (
+	threadCauseBorderRouter = "border_router_unavailable"
+	threadCauseNetworkDown  = "thread_network_down"
+	threadCauseLeft         = "not_in_thread_network"
+	threadCauseIPRouting    = "in_thread_network"
+)
+
+// threadCauseHints explain the likely causes to the user.
+var threadCauseHints = map[string]string{
+	threadCauseBorderRouter: "The Thread border router's API doesn't answer: check that otbr-agent is running. Every Thread device is cut off without it.",
+	threadCauseNetworkDown:  "The border router isn't attached to the Thread network (detached or disabled): every Thread device is cut off until it forms or joins the network again.",
+	threadCauseLeft:         "The device isn't in the Thread network topology: it is probably powered off, out of range of every router, or rejoining.",
+	threadCauseIPRouting:    "The device is in the Thread network but doesn't answer over IP: check the border router's routing (off-mesh-routable prefix, SRP) and the device's Matter session.",
+}
+
+// threadRoles are the names of the otDeviceRole values, reported as numbers by older otbr-agent versions.
+var threadRoles = []string{"disabled", "detached", "child", "router", "leader"}
+
+// ThreadNode is a node of the Thread network, from the network diagnostics.
+type ThreadNode struct {
+	ExtAddress string   `json:"extAddress"`
+	Rloc16     string   `json:"rloc16"`
+	Role       string   `json:"role"`             // "router" or "child"
+	Parent     string   `json:"parent,omitempty"` // RLOC16 of the parent router, for children
+	Children   int      `json:"children,omitempty"`
+	Addresses  []string `json:"addresses,omitempty"`
+	DeviceIDs  []string `json:"deviceIds,omitempty"` // Registered devices with one of the node's addresses
+}
+
+// ThreadTopology summarises the network diagnostics.
+type ThreadTopology struct {
+	Routers  int          `json:"routers"`
+	Children int          `json:"children"`
+	Nodes    []ThreadNode `json:"nodes"`
+	Error    string       `json:"error,omitempty"` // The diagnostics failed; the other status is still valid
+}
+
+// ThreadDeviceStatus is a registered device on the Thread network, with the likely cause when it is
+// unreachable.
+type ThreadDeviceStatus struct {
+	DeviceID  string `json:"deviceId"`
+	NodeID    string `json:"nodeId"`
+	Name      string `json:"name,omitempty"`
+	Reachable bool   `json:"reachable"`
+	InNetwork bool   `json:"inNetwork"` // Found in the topology of the last poll
+	Rloc16    string `json:"rloc16,omitempty"`
+	Role      string `json:"role,omitempty"`
+	Parent    string `json:"parent,omitempty"`
+	Cause     string `json:"cause,omitempty"` // Set for unreachable devices and devices missing from the topology
+	Hint      string `json:"hint,omitempty"`
+}
+
+// ThreadNetworkStatus is the Thread network health in GET /api/v1/network.
+type ThreadNetworkStatus struct {
+	Configured      bool                   `json:"configured"` // threadBorderRouter.url is set
+	URL             string                 `json:"url,omitempty"`
+	Health          string                 `json:"health,omitempty"`
+	Available       bool                   `json:"available"`
+	Error           string                 `json:"error,omitempty"`
+	CheckedAt       time.Time              `json:"checkedAt,omitzero"`
+	LastAvailableAt time.Time              `json:"lastAvailableAt,omitzero"`
+	State           string                 `json:"state,omitempty"` // Border router role: "leader", "router", "child", "detached" or "disabled"
+	NetworkName     string                 `json:"networkName,omitempty"`
+	ExtPanID        string                 `json:"extPanId,omitempty"`
+	Node            map[string]interface{} `json:"node,omitempty"`    // The border router's /node, as reported
+	Dataset         map[string]interface{} `json:"dataset,omitempty"` // Active operational dataset; the network key and PSKc are masked unless threadBorderRouter.includeSecrets
+	Topology        *ThreadTopology        `json:"topology,omitempty"`
+	Devices         []ThreadDeviceStatus   `json:"devices"`
+}
+
+// ThreadBorderRouter polls the border router and keeps the last status.
+type ThreadBorderRouter struct {
+	mu              sync.Mutex
+	client          *http.Client
+	last            ThreadNetworkStatus // Without Devices, computed on demand from the registry
+	prefixes        []netip.Prefix      // /64 prefixes of the Thread nodes' addresses
+	seen            map[string]bool     // Registered devices seen in the topology since startup
+	lastAvailableAt time.Time
+}
+
+// NewThreadBorderRouter creates a poller without status.
+func NewThreadBorderRouter() *ThreadBorderRouter {
+	return &ThreadBorderRouter{client: &http.Client{Timeout: threadRequestTimeout}, seen: make(map[string]bool)}
+}
+
+var threadBorderRouter = NewThreadBorderRouter()
+
+// getJSON decodes a GET of the border router's REST API.
+func (b *ThreadBorderRouter) getJSON(baseURL, path string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(baseURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("GET %s: %s %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// threadRole names a role reported as a string or an otDeviceRole number.
+func threadRole(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return strings.ToLower(v)
+	case float64:
+		if i := int(v); i >= 0 && i < len(threadRoles) {
+			return threadRoles[i]
+		}
+	}
+	return ""
+}
+
+// rloc16String formats an RLOC16 the way the OpenThread CLI does, e.g. "0x6c01".
+func rloc16String(value interface{}) (string, uint16) {
+	switch v := value.(type) {
+	case float64:
+		return fmt.Sprintf("0x%04x", uint16(v)), uint16(v)
+	case string:
+		var n uint16
+		if _, err := fmt.Sscanf(strings.TrimPrefix(strings.ToLower(v), "0x"), "%x", &n); err == nil {
+			return fmt.Sprintf("0x%04x", n), n
+		}
+		return v, 0
+	}
+	return "", 0
+}
+
+// threadDiagnostic is the part of a network diagnostic TLV set the topology uses.
+type threadDiagnostic struct {
+	ExtAddress     string        `json:"ExtAddress"`
+	Rloc16         interface{}   `json:"Rloc16"`
+	IP6AddressList []string      `json:"IP6AddressList"`
+	ChildTable     []interface{} `json:"ChildTable"`
+}
+
+// buildTopology summarises the network diagnostics.
+func buildTopology(diagnostics []threadDiagnostic) ThreadTopology {
+	topology := ThreadTopology{Nodes: []ThreadNode{}}
+	for _, d := range diagnostics {
+		rloc, n := rloc16String(d.Rloc16)
+		node := ThreadNode{ExtAddress: d.ExtAddress, Rloc16: rloc, Role: "router", Children: len(d.ChildTable), Addresses: d.IP6AddressList}
+		if n&0x1ff != 0 { // A child's RLOC16 is its parent's with a child ID
+			node.Role, node.Parent = "child", fmt.Sprintf("0x%04x", n&^0x1ff)
+			topology.Children++
+		} else {
+			topology.Routers++
+		}
+		topology.Nodes = append(topology.Nodes, node)
+	}
+	sort.Slice(topology.Nodes, func(i, j int) bool { return topology.Nodes[i].Rloc16 < topology.Nodes[j].Rloc16 })
+	return topology
+}
+
+// maskDatasetSecrets hides the network key and PSKc of a dataset: anyone with them can join the network.
+func maskDatasetSecrets(dataset map[string]interface{}) {
+	for _, name := range []string{"NetworkKey", "PSKc"} {
+		if _, ok := dataset[name]; ok {
+			dataset[name] = "***"
+		}
+	}
+}
+
+// Poll reads the border router's status, dataset and topology.
+func (b *ThreadBorderRouter) Poll() ThreadNetworkStatus {
+	cfg := appConfig.ThreadBorderRouter
+	status := ThreadNetworkStatus{Configured: cfg.URL != "", URL: cfg.URL, CheckedAt: time.Now()}
+	if cfg.URL == "" {
+		b.store(status, nil)
+		return b.Status()
+	}
+	var node map[string]interface{}
+	if err := b.getJSON(cfg.URL, "/node", &node); err != nil {
+		status.Error = err.Error()
+		b.store(status, nil)
+		return b.Status()
+	}
+	status.Available, status.Node = true, node
+	status.State = threadRole(node["State"])
+	status.NetworkName, _ = node["NetworkName"].(string)
+	status.ExtPanID, _ = node["ExtPanId"].(string)
+
+	var dataset map[string]interface{}
+	if err := b.getJSON(cfg.URL, "/node/dataset/active", &dataset); err == nil && len(dataset) > 0 {
+		if !cfg.IncludeSecrets {
+			maskDatasetSecrets(dataset)
+		}
+		status.Dataset = dataset
+	}
+
+	var diagnostics []threadDiagnostic
+	var prefixes []netip.Prefix
+	if err := b.getJSON(cfg.URL, "/diagnostics", &diagnostics); err != nil {
+		status.Topology = &ThreadTopology{Nodes: []ThreadNode{}, Error: err.Error()}
+	} else {
+		topology := buildTopology(diagnostics)
+		status.Topology = &topology
+		prefixes = threadPrefixes(topology, dataset)
+	}
+	b.store(status, prefixes)
+	return b.Status()
+}
+
+// threadPrefixes returns the /64 prefixes of the Thread nodes' addresses and the mesh-local prefix:
+// a registered device with an address in one of them is a Thread device.
+func threadPrefixes(topology ThreadTopology, dataset map[string]interface{}) []netip.Prefix {
+	seen := map[netip.Prefix]bool{}
+	var prefixes []netip.Prefix
+	add := func(p netip.Prefix) {
+		if !seen[p] {
+			seen[p] = true
+			prefixes = append(prefixes, p)
+		}
+	}
+	for _, node := range topology.Nodes {
+		for _, address := range node.Addresses {
+			if addr, err := netip.ParseAddr(address); err == nil && addr.Is6() && !addr.IsLinkLocalUnicast() {
+				prefix, _ := addr.Prefix(64)
+				add(prefix)
+			}
+		}
+	}
+	if meshLocal, ok := dataset["MeshLocalPrefix"].(string); ok {
+		if prefix, err := netip.ParsePrefix(meshLocal); err == nil {
+			add(prefix.Masked())
+		}
+	}
+	return prefixes
+}
+
+// store keeps a poll's status and broadcasts "thread_network_status" when the border router becomes
+// available or unavailable, or changes role.
+func (b *ThreadBorderRouter) store(status ThreadNetworkStatus, prefixes []netip.Prefix) {
+	b.mu.Lock()
+	previous := b.last
+	if status.Available {
+		b.lastAvailableAt = status.CheckedAt
+		if status.Topology != nil && status.Topology.Error == "" {
+			b.prefixes = prefixes
+		}
+	}
+	status.LastAvailableAt = b.lastAvailableAt
+	b.last = status
+	b.mu.Unlock()
+
+	first := previous.CheckedAt.IsZero() || previous.URL != status.URL
+	changed := previous.Available != status.Available || previous.State != status.State
+	if !status.Configured || !first && !changed {
+		return
+	}
+	if status.Available {
+		log.Printf("Thread border router %s is %s on %q", status.URL, status.State, status.NetworkName)
+	} else {
+		log.Printf("Thread border router %s unavailable: %s", status.URL, status.Error)
+	}
+	if !first {
+		broadcastToClients("thread_network_status", b.Status())
+	}
+}
+
+// isThreadDevice tells whether a device is on the Thread network, and finds its node in the topology.
+// Callers must hold b.mu.
+func (b *ThreadBorderRouter) isThreadDevice(device RegisteredDevice) (bool, *ThreadNode) {
+	addresses := map[string]bool{}
+	for _, address := range append([]string{device.Address}, device.Addresses...) {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(address)); err == nil {
+			addresses[addr.WithZone("").String()] = true
+		}
+	}
+	if b.last.Topology != nil {
+		for i := range b.last.Topology.Nodes {
+			node := &b.last.Topology.Nodes[i]
+			for _, address := range node.Addresses {
+				if addr, err := netip.ParseAddr(address); err == nil && addresses[addr.String()] {
+					return true, node
+				}
+			}
+		}
+	}
+	for address := range addresses {
+		addr, _ := netip.ParseAddr(address)
+		for _, prefix := range b.prefixes {
+			if prefix.Contains(addr) {
+				return true, nil
+			}
+		}
+	}
+	return b.seen[device.ID], nil
+}
+
+// deviceStatus correlates a Thread device with the border router status. Callers must hold b.mu.
+func (b *ThreadBorderRouter) deviceStatus(device RegisteredDevice, node *ThreadNode) ThreadDeviceStatus {
+	status := ThreadDeviceStatus{DeviceID: device.ID, NodeID: device.NodeID, Name: device.Name, Reachable: device.Reachable}
+	if node != nil {
+		status.InNetwork, status.Rloc16, status.Role, status.Parent = true, node.Rloc16, node.Role, node.Parent
+	}
+	diagnosed := b.last.Topology != nil && b.last.Topology.Error == ""
+	switch {
+	case !b.last.Available:
+		status.Cause = threadCauseBorderRouter
+	case b.last.State == "disabled" || b.last.State == "detached":
+		status.Cause = threadCauseNetworkDown
+	case diagnosed && !status.InNetwork:
+		status.Cause = threadCauseLeft
+	case !device.Reachable && status.InNetwork:
+		status.Cause = threadCauseIPRouting
+	}
+	if status.Reachable && status.Cause == threadCauseBorderRouter {
+		status.Cause = "" // Reachable anyway: the API is down, not the router
+	}
+	status.Hint = threadCauseHints[status.Cause]
+	return status
+}
+
+// Status returns the last poll, with the registered Thread devices correlated with it.
+func (b *ThreadBorderRouter) Status() ThreadNetworkStatus {
+	devices := deviceRegistry.List()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := b.last
+	status.Devices = []ThreadDeviceStatus{}
+	if !status.Configured {
+		return status
+	}
+	if status.Topology != nil { // Copied, as the registered devices are added to its nodes
+		topology := *status.Topology
+		topology.Nodes = append([]ThreadNode(nil), topology.Nodes...)
+		status.Topology = &topology
+	}
+	for _, device := range devices {
+		thread, node := b.isThreadDevice(device)
+		if !thread {
+			continue
+		}
+		if node != nil {
+			b.seen[device.ID] = true
+			for i := range status.Topology.Nodes {
+				if status.Topology.Nodes[i].Rloc16 == node.Rloc16 {
+					status.Topology.Nodes[i].DeviceIDs = append(status.Topology.Nodes[i].DeviceIDs, device.ID)
+				}
+			}
+		}
+		status.Devices = append(status.Devices, b.deviceStatus(device, node))
+	}
+	status.Health = threadHealthOK
+	switch {
+	case !status.Available || status.State == "disabled" || status.State == "detached":
+		status.Health = threadHealthDown
+	default:
+		for _, device := range status.Devices {
+			if device.Cause != "" {
+				status.Health = threadHealthDegraded
+			}
+		}
+	}
+	return status
+}
+
+// DeviceStatus returns the Thread status of a registered device, if it is a Thread device.
+func (b *ThreadBorderRouter) DeviceStatus(deviceID string) (ThreadDeviceStatus, bool) {
+	for _, device := range b.Status().Devices {
+		if device.DeviceID == deviceID {
+			return device, true
+		}
+	}
+	return ThreadDeviceStatus{}, false
+}
+
+// Run polls the border router every pollSeconds while threadBorderRouter.url is set.
+func (b *ThreadBorderRouter) Run() {
+	time.Sleep(threadStartDelay)
+	for {
+		interval := defaultThreadPollInterval
+		if appConfig.ThreadBorderRouter.PollSeconds > 0 {
+			interval = time.Duration(appConfig.ThreadBorderRouter.PollSeconds) * time.Second
+		}
+		if appConfig.ThreadBorderRouter.URL != "" || b.Status().Configured {
+			b.Poll()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// dispatchThreadEvents explains why a Thread device went offline: "thread_device_unreachable" carries
+// the border router's view of it, polled again for an up-to-date topology.
+func dispatchThreadEvents(event Event) {
+	reachability, ok := event.Payload.(DeviceReachabilityPayload)
+	if event.Type != "device_reachability" || !ok || reachability.Reachable || appConfig.ThreadBorderRouter.URL == "" {
+		return
+	}
+	if _, thread := threadBorderRouter.DeviceStatus(reachability.DeviceID); !thread {
+		return
+	}
+	threadBorderRouter.Poll()
+	status, thread := threadBorderRouter.DeviceStatus(reachability.DeviceID)
+	if !thread || status.Reachable {
+		return
+	}
+	log.Printf("Thread device %s unreachable: %s", status.DeviceID, status.Cause)
+	broadcastToClients("thread_device_unreachable", status)
+}
+
+func init() {
+	eventBus.Subscribe("thread", dispatchThreadEvents, topicDevice)
+}
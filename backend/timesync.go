@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time synchronization defaults, used when the config doesn't set them.
+const (
+	defaultTimeSyncIntervalHours = 24
+	timeSyncStartDelay           = 2 * time.Minute // First sync after startup, once the subscriptions are up
+)
+
+// TimeSynchronization cluster values (Matter spec 11.17).
+const (
+	timeSyncFeatureTimeZone     = 0x1 // TZ feature: the device accepts SetTimeZone and SetDSTOffset
+	timeGranularityMilliseconds = 3   // GranularityEnum kMillisecondsGranularity
+)
+
+// SyncTimePayload is the payload of "sync_time". An empty nodeId syncs every node.
+type SyncTimePayload struct {
+	NodeID   string `json:"nodeId,omitempty"`
+	DeviceID string `json:"deviceId,omitempty"` // Registry device ID, instead of nodeId
+}
+
+// TimeSyncStartedPayload is sent in response to "sync_time"; the results are the job's result.
+type TimeSyncStartedPayload struct {
+	JobID string `json:"jobId"`
+}
+
+// TimeSyncResult is the outcome of a sync of one node.
+type TimeSyncResult struct {
+	NodeID   string    `json:"nodeId"`
+	Success  bool      `json:"success"`
+	Skipped  bool      `json:"skipped,omitempty"`  // The node has no TimeSynchronization cluster
+	TimeZone bool      `json:"timeZone,omitempty"` // The time zone and DST offsets were set too
+	Error    string    `json:"error,omitempty"`
+	SyncedAt time.Time `json:"syncedAt"`
+}
+
+// TimeSyncStatus is returned by GET /api/time-sync.
+type TimeSyncStatus struct {
+	Enabled  bool             `json:"enabled"`
+	TimeZone string           `json:"timeZone"`
+	LastRun  time.Time        `json:"lastRun,omitzero"`
+	Nodes    []TimeSyncResult `json:"nodes"`
+}
+
+// TimeSync sets the UTC time, time zone and DST offsets of the devices with a TimeSynchronization
+// cluster, which need wall-clock time for schedules (thermostats, door locks) but have no time
+// source of their own. With timeSync enabled, every node is synced at startup and then every
+// intervalHours; "sync_time" syncs on demand.
+type TimeSync struct {
+	mu      sync.Mutex
+	results map[string]TimeSyncResult // Last sync of each node
+	lastRun time.Time
+}
+
+// NewTimeSync creates a TimeSync that hasn't synced anything yet.
+func NewTimeSync() *TimeSync {
+	return &TimeSync{results: make(map[string]TimeSyncResult)}
+}
+
+// timeSyncLocation returns the time zone sent to the devices: timeSync.timeZone, else the host's.
+func timeSyncLocation() (*time.Location, error) {
+	name := appConfig.TimeSync.TimeZone
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// matterEpochMicros converts a time to Matter's epoch-us.
+func matterEpochMicros(t time.Time) int64 {
+	return t.Sub(matterEpoch).Microseconds()
+}
+
+// timeZoneParams builds the SetTimeZone and SetDSTOffset fields of a location at a time: its
+// standard offset and, when it observes DST, the current or next DST period.
+func timeZoneParams(loc *time.Location, now time.Time) (map[string]interface{}, map[string]interface{}) {
+	now = now.In(loc)
+	_, winter := time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, loc).Zone()
+	_, summer := time.Date(now.Year(), time.July, 1, 0, 0, 0, 0, loc).Zone()
+	standard := min(winter, summer)
+	name := loc.String()
+	if name == "Local" {
+		name, _ = now.Zone()
+	}
+	timeZone := map[string]interface{}{"timeZone": []map[string]interface{}{{"offset": standard, "validAt": 0, "name": name}}}
+
+	offsets := []map[string]interface{}{}
+	if winter != summer {
+		start, end := now.ZoneBounds()
+		if _, offset := now.Zone(); offset == standard && !end.IsZero() {
+			start, end = end.ZoneBounds() // The next DST period
+		}
+		if _, offset := start.Zone(); offset != standard {
+			period := map[string]interface{}{"offset": offset - standard, "validStarting": matterEpochMicros(start), "validUntil": nil}
+			if !end.IsZero() {
+				period["validUntil"] = matterEpochMicros(end)
+			}
+			offsets = append(offsets, period)
+		}
+	}
+	return timeZone, map[string]interface{}{"DSTOffset": offsets}
+}
+
+// SyncNode sets the time of a node. The time zone and DST offsets are only sent to devices
+// supporting the TZ feature.
+func (s *TimeSync) SyncNode(nodeID string) TimeSyncResult {
+	result := s.syncNode(nodeID)
+	s.mu.Lock()
+	s.results[nodeID] = result
+	s.mu.Unlock()
+	return result
+}
+
+func (s *TimeSync) syncNode(nodeID string) TimeSyncResult {
+	result := TimeSyncResult{NodeID: nodeID, SyncedAt: time.Now()}
+	featureMap, err := introspectionCache.ReadAttribute(nodeID, "0", "timesynchronization", "feature-map")
+	if err != nil {
+		if strings.Contains(strings.ToUpper(err.Error()), "UNSUPPORTED") {
+			result.Skipped, result.Error = true, "no TimeSynchronization cluster on endpoint 0"
+		} else {
+			result.Error = err.Error()
+		}
+		return result
+	}
+	loc, err := timeSyncLocation()
+	if err != nil {
+		result.Error = fmt.Sprintf("time zone %q: %v", appConfig.TimeSync.TimeZone, err)
+		return result
+	}
+	now := time.Now()
+	if err := controller.InvokeCommand(nodeID, "0", "TimeSynchronization", "SetUTCTime", map[string]interface{}{
+		"UTCTime": matterEpochMicros(now), "granularity": timeGranularityMilliseconds,
+	}); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if features, ok := toFloat(featureMap); ok && int64(features)&timeSyncFeatureTimeZone != 0 {
+		timeZone, dstOffsets := timeZoneParams(loc, now)
+		if err := controller.InvokeCommand(nodeID, "0", "TimeSynchronization", "SetTimeZone", timeZone); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		if err := controller.InvokeCommand(nodeID, "0", "TimeSynchronization", "SetDSTOffset", dstOffsets); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		result.TimeZone = true
+	}
+	result.Success = true
+	log.Printf("Time synced on node %s (time zone sent: %v)", nodeID, result.TimeZone)
+	return result
+}
+
+// timeSyncNodes lists the nodes of the registry. Bridged devices share their bridge's node.
+func timeSyncNodes() []string {
+	seen := make(map[string]bool)
+	var nodes []string
+	for _, device := range deviceRegistry.List() {
+		if device.NodeID == "" || device.BridgeID != "" || seen[device.NodeID] {
+			continue
+		}
+		seen[device.NodeID] = true
+		nodes = append(nodes, device.NodeID)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Start queues a "time_sync" job syncing the given nodes, or every node when there are none.
+func (s *TimeSync) Start(client *Client, nodes []string) *Job {
+	return jobs.Submit(client, "time_sync", func(ctx context.Context, job *Job) (interface{}, error) {
+		if len(nodes) == 0 {
+			nodes = timeSyncNodes()
+		}
+		results := make([]TimeSyncResult, 0, len(nodes))
+		failed := 0
+		for i, nodeID := range nodes {
+			if ctx.Err() != nil {
+				return results, ctx.Err()
+			}
+			job.SetProgress(i*100/len(nodes), fmt.Sprintf("Syncing the time of node %s", nodeID))
+			result := s.SyncNode(nodeID)
+			if !result.Success && !result.Skipped {
+				failed++
+			}
+			results = append(results, result)
+		}
+		s.mu.Lock()
+		s.lastRun = time.Now()
+		s.mu.Unlock()
+		if failed > 0 {
+			return results, fmt.Errorf("time sync failed on %d of %d node(s)", failed, len(nodes))
+		}
+		return results, nil
+	})
+}
+
+// Status returns the last sync of each node.
+func (s *TimeSync) Status() TimeSyncStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := TimeSyncStatus{Enabled: appConfig.TimeSync.Enabled, TimeZone: "Local", LastRun: s.lastRun, Nodes: make([]TimeSyncResult, 0, len(s.results))}
+	if loc, err := timeSyncLocation(); err == nil {
+		status.TimeZone = loc.String()
+	}
+	for _, result := range s.results {
+		status.Nodes = append(status.Nodes, result)
+	}
+	sort.Slice(status.Nodes, func(i, j int) bool { return status.Nodes[i].NodeID < status.Nodes[j].NodeID })
+	return status
+}
+
+// Run syncs every node shortly after startup and then every intervalHours, when timeSync is enabled.
+func (s *TimeSync) Run() {
+	if !appConfig.TimeSync.Enabled {
+		return
+	}
+	interval := time.Duration(defaultTimeSyncIntervalHours) * time.Hour
+	if appConfig.TimeSync.IntervalHours > 0 {
+		interval = time.Duration(appConfig.TimeSync.IntervalHours) * time.Hour
+	}
+	time.Sleep(timeSyncStartDelay)
+	for {
+		s.Start(nil, nil)
+		time.Sleep(interval)
+	}
+}
+
+func handleSyncTime(client *Client, payload SyncTimePayload) {
+	var nodes []string
+	switch {
+	case payload.DeviceID != "":
+		nodeID, _, err := deviceRegistry.resolveDeviceTarget(payload.DeviceID)
+		if err != nil {
+			client.notifyClient("error", map[string]interface{}{"message": "sync_time failed: " + err.Error()})
+			return
+		}
+		nodes = []string{nodeID}
+	case payload.NodeID != "":
+		nodes = []string{payload.NodeID}
+	}
+	job := timeSync.Start(client, nodes)
+	client.sendPayload("time_sync_started", TimeSyncStartedPayload{JobID: job.Status().ID})
+}
+
+var timeSync = NewTimeSync()
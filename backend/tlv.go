@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// tlvElement is a decoded Matter TLV element. Containers (structures, arrays, lists) have Children;
+// other elements have a Value: int64, uint64, bool, float64, string, []byte or nil (null).
+type tlvElement struct {
+	Tag         uint64 // Context-specific tag number, or the tag number of a profile tag
+	TagType     byte   // Tag control bits (0 anonymous, 1 context-specific, 2-7 profile/implicit tags)
+	ElementType byte
+	Value       interface{}
+	Children    []tlvElement
+}
+
+// TLV element types (low 5 bits of the control byte).
+const (
+	tlvTypeStruct    = 0x15
+	tlvTypeArray     = 0x16
+	tlvTypeList      = 0x17
+	tlvTypeEndOfCont = 0x18
+)
+
+var errTLVTruncated = errors.New("TLV data is truncated")
+
+// tlvReader decodes Matter TLV (Matter core specification, appendix A).
+type tlvReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *tlvReader) take(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, errTLVTruncated
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *tlvReader) uint(n int) (uint64, error) {
+	b, err := r.take(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := n - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+// tagSizes is the size of the tag for each tag control value.
+var tagSizes = [8]int{0, 1, 2, 4, 2, 4, 6, 8}
+
+// next decodes the next element, including the children of a container. It returns
+// an element of type tlvTypeEndOfCont at the end of the enclosing container.
+func (r *tlvReader) next() (tlvElement, error) {
+	control, err := r.take(1)
+	if err != nil {
+		return tlvElement{}, err
+	}
+	el := tlvElement{TagType: control[0] >> 5, ElementType: control[0] & 0x1F}
+	tag, err := r.uint(tagSizes[el.TagType])
+	if err != nil {
+		return el, err
+	}
+	if el.TagType >= 6 {
+		tag >>= 32 // Fully qualified tags: vendor and profile IDs, then the tag number
+	}
+	el.Tag = tag
+
+	switch t := el.ElementType; {
+	case t <= 0x03: // Signed integers, 1/2/4/8 bytes
+		n := 1 << t
+		v, err := r.uint(n)
+		if err != nil {
+			return el, err
+		}
+		shift := 64 - 8*n
+		el.Value = int64(v<<shift) >> shift
+	case t <= 0x07: // Unsigned integers
+		v, err := r.uint(1 << (t - 4))
+		if err != nil {
+			return el, err
+		}
+		el.Value = v
+	case t == 0x08 || t == 0x09:
+		el.Value = t == 0x09
+	case t == 0x0A:
+		v, err := r.uint(4)
+		if err != nil {
+			return el, err
+		}
+		el.Value = float64(math.Float32frombits(uint32(v)))
+	case t == 0x0B:
+		v, err := r.uint(8)
+		if err != nil {
+			return el, err
+		}
+		el.Value = math.Float64frombits(v)
+	case t >= 0x0C && t <= 0x13: // UTF-8 and octet strings, with a 1/2/4/8 byte length
+		length, err := r.uint(1 << (t & 0x03))
+		if err != nil {
+			return el, err
+		}
+		b, err := r.take(int(length))
+		if err != nil {
+			return el, err
+		}
+		if t <= 0x0F {
+			el.Value = string(b)
+		} else {
+			el.Value = append([]byte(nil), b...)
+		}
+	case t == 0x14:
+		el.Value = nil
+	case t == tlvTypeStruct || t == tlvTypeArray || t == tlvTypeList:
+		for {
+			child, err := r.next()
+			if err != nil {
+				return el, err
+			}
+			if child.ElementType == tlvTypeEndOfCont {
+				break
+			}
+			el.Children = append(el.Children, child)
+		}
+	case t == tlvTypeEndOfCont:
+	default:
+		return el, fmt.Errorf("unknown TLV element type 0x%02x at offset %d", t, r.pos-1)
+	}
+	return el, nil
+}
+
+// decodeTLV decodes a single top-level TLV element.
+func decodeTLV(data []byte) (tlvElement, error) {
+	r := &tlvReader{data: data}
+	return r.next()
+}
+
+// child returns the first child with a context-specific tag.
+func (e tlvElement) child(tag uint64) (tlvElement, bool) {
+	for _, c := range e.Children {
+		if c.TagType == 1 && c.Tag == tag {
+			return c, true
+		}
+	}
+	return tlvElement{}, false
+}
+
+// uintValue returns the value of an unsigned (or non-negative signed) integer element.
+func (e tlvElement) uintValue() (uint64, bool) {
+	switch v := e.Value.(type) {
+	case uint64:
+		return v, true
+	case int64:
+		return uint64(v), v >= 0
+	}
+	return 0, false
+}
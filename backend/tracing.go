@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// maxTraces bounds the traces kept in memory; the oldest are dropped first.
+const maxTraces = 50
+
+// maxTracedOutput bounds the stdout/stderr kept per chip-tool run in a trace.
+const maxTracedOutput = 256 * 1024
+
+// TraceRun is one chip-tool run recorded in a trace.
+type TraceRun struct {
+	Argv       []string  `json:"argv"`
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs"`
+	Error      string    `json:"error,omitempty"` // Exit status or start failure
+	Stdout     string    `json:"stdout"`
+	Stderr     string    `json:"stderr"`
+	Truncated  bool      `json:"truncated,omitempty"`
+}
+
+// TraceMessage is a message sent to the client while handling the traced request.
+type TraceMessage struct {
+	Time    time.Time   `json:"time"`
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload"`
+}
+
+// Trace records everything a single traced request did: the request, the chip-tool runs with their
+// raw output, and the messages (logs, parsed results) it produced. Background work started by the
+// request, such as a commissioning job, keeps adding to it after the handler returned.
+type Trace struct {
+	mu              sync.Mutex
+	RequestID       string          `json:"requestId"`
+	Type            string          `json:"type"`
+	Payload         json.RawMessage `json:"payload,omitempty"`
+	StartedAt       time.Time       `json:"startedAt"`
+	HandlerReturned *time.Time      `json:"handlerReturnedAt,omitempty"`
+	LastActivity    time.Time       `json:"lastActivityAt"`
+	Runs            []TraceRun      `json:"runs"`
+	Messages        []TraceMessage  `json:"messages"`
+	Captures        []CaptureStatus `json:"captures,omitempty"` // Packet captures of the request (see capture.go)
+}
+
+// TraceSummary lists a trace in GET /api/traces.
+type TraceSummary struct {
+	RequestID    string    `json:"requestId"`
+	Type         string    `json:"type"`
+	StartedAt    time.Time `json:"startedAt"`
+	LastActivity time.Time `json:"lastActivityAt"`
+	Runs         int       `json:"runs"`
+	Messages     int       `json:"messages"`
+}
+
+// truncateOutput bounds traced output, reporting whether it was cut.
+func truncateOutput(s string) (string, bool) {
+	if len(s) <= maxTracedOutput {
+		return s, false
+	}
+	return s[:maxTracedOutput], true
+}
+
+// addRun records a chip-tool run.
+func (t *Trace) addRun(argv []string, started time.Time, stdout, stderr string, err error) {
+	run := TraceRun{Argv: append([]string{chipToolPath}, argv...), StartedAt: started, DurationMs: time.Since(started).Milliseconds()}
+	var cutOut, cutErr bool
+	run.Stdout, cutOut = truncateOutput(stdout)
+	run.Stderr, cutErr = truncateOutput(stderr)
+	run.Truncated = cutOut || cutErr
+	if err != nil {
+		run.Error = err.Error()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Runs = append(t.Runs, run)
+	t.LastActivity = time.Now()
+}
+
+// addMessage records a message sent to the client.
+func (t *Trace) addMessage(msgType string, payload interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.Messages = append(t.Messages, TraceMessage{Time: now, Type: msgType, Payload: payload})
+	t.LastActivity = now
+}
+
+// setCapture records a packet capture of the request, replacing its earlier status.
+func (t *Trace) setCapture(status CaptureStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.Captures {
+		if t.Captures[i].ID == status.ID {
+			t.Captures[i] = status
+			return
+		}
+	}
+	t.Captures = append(t.Captures, status)
+	t.LastActivity = time.Now()
+}
+
+// handlerDone marks the end of the request's handler.
+func (t *Trace) handlerDone() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.HandlerReturned, t.LastActivity = &now, now
+}
+
+// MarshalJSON encodes a consistent snapshot of the trace.
+func (t *Trace) MarshalJSON() ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	type bundle Trace // Without the methods, to avoid recursing
+	return json.Marshal((*bundle)(t))
+}
+
+// TraceStore keeps the latest traces by request ID.
+type TraceStore struct {
+	mu     sync.Mutex
+	traces map[string]*Trace
+	order  []string // Request IDs, oldest first
+}
+
+// NewTraceStore creates an empty store.
+func NewTraceStore() *TraceStore {
+	return &TraceStore{traces: make(map[string]*Trace)}
+}
+
+// Start opens the trace of a request, replacing an older trace with the same request ID.
+func (s *TraceStore) Start(msg ClientMessage) *Trace {
+	now := time.Now()
+	trace := &Trace{RequestID: msg.RequestID, Type: msg.Type, Payload: msg.Payload, StartedAt: now, LastActivity: now, Runs: []TraceRun{}, Messages: []TraceMessage{}}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.traces[msg.RequestID]; !exists {
+		s.order = append(s.order, msg.RequestID)
+	}
+	s.traces[msg.RequestID] = trace
+	for len(s.order) > maxTraces {
+		delete(s.traces, s.order[0])
+		s.order = s.order[1:]
+	}
+	return trace
+}
+
+// PruneBefore drops the traces without activity since cutoff. It returns how many were dropped.
+func (s *TraceStore) PruneBefore(cutoff time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.order[:0]
+	for _, requestID := range s.order {
+		trace := s.traces[requestID]
+		trace.mu.Lock()
+		stale := trace.LastActivity.Before(cutoff)
+		trace.mu.Unlock()
+		if stale {
+			delete(s.traces, requestID)
+			continue
+		}
+		kept = append(kept, requestID)
+	}
+	pruned := len(s.order) - len(kept)
+	s.order = kept
+	return pruned
+}
+
+// Get returns the trace of a request.
+func (s *TraceStore) Get(requestID string) (*Trace, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	trace, ok := s.traces[requestID]
+	return trace, ok
+}
+
+// List summarises the stored traces, most recent first.
+func (s *TraceStore) List() []TraceSummary {
+	s.mu.Lock()
+	traces := make([]*Trace, 0, len(s.order))
+	for i := len(s.order) - 1; i >= 0; i-- {
+		traces = append(traces, s.traces[s.order[i]])
+	}
+	s.mu.Unlock()
+	summaries := make([]TraceSummary, 0, len(traces))
+	for _, t := range traces {
+		t.mu.Lock()
+		summaries = append(summaries, TraceSummary{RequestID: t.RequestID, Type: t.Type, StartedAt: t.StartedAt, LastActivity: t.LastActivity, Runs: len(t.Runs), Messages: len(t.Messages)})
+		t.mu.Unlock()
+	}
+	return summaries
+}
+
+// sanitizeFileName keeps the characters of a request ID that are safe in a download file name.
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// traceChipToolRun records a chip-tool run in the client's trace, when the request is traced, and
+// as a span of the request's OpenTelemetry trace (see telemetry.go).
+func (c *Client) traceChipToolRun(argv []string, started time.Time, stdout, stderr string, err error) {
+	if c == nil {
+		return
+	}
+	if c.trace != nil {
+		c.trace.addRun(argv, started, stdout, stderr, err)
+	}
+	if c.span != nil {
+		name := "chip-tool"
+		for _, arg := range argv[:min(2, len(argv))] {
+			name += " " + arg
+		}
+		span := c.span.ChildAt(name, started)
+		span.SetAttribute("process.command_args", strings.Join(argv, " "))
+		span.SetAttribute("chip_tool.stdout_bytes", len(stdout))
+		if err != nil {
+			span.SetError(err.Error())
+		} else if chipToolFailed(stdout, stderr, err) {
+			span.SetError("chip-tool reported an error")
+		}
+		span.End()
+	}
+}
+
+// traces holds the recorded traces.
+var traces = NewTraceStore()
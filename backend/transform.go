@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+)
+
+// valueTransform converts the raw value of an attribute, as encoded on the wire, to a common unit.
+type valueTransform struct {
+	Unit    string
+	Convert func(float64) (float64, bool)
+}
+
+func scaleBy(divisor float64) func(float64) (float64, bool) {
+	return func(v float64) (float64, bool) {
+		return math.Round(v/divisor*100) / 100, true
+	}
+}
+
+// miredsToKelvin converts a color temperature in mireds (micro reciprocal degrees) to Kelvin.
+func miredsToKelvin(v float64) (float64, bool) {
+	if v <= 0 {
+		return 0, false
+	}
+	return math.Round(1e6 / v), true
+}
+
+// levelToPercent converts a LevelControl level (0-254) to a percentage.
+func levelToPercent(v float64) (float64, bool) {
+	if v < 0 || v > 254 {
+		return 0, false
+	}
+	return math.Round(v / 254 * 100), true
+}
+
+// illuminanceToLux converts a logarithmic IlluminanceMeasurement value (10000*log10(lux)+1) to lux.
+func illuminanceToLux(v float64) (float64, bool) {
+	if v <= 0 {
+		return 0, false // 0 means too low to be measured
+	}
+	return math.Round(math.Pow(10, (v-1)/10000)*100) / 100, true
+}
+
+// Attribute transforms, keyed by "Cluster/attribute" like sensorDefinitions.
+var (
+	celsius100ths  = valueTransform{Unit: "°C", Convert: scaleBy(100)}
+	percent100ths  = valueTransform{Unit: "%", Convert: scaleBy(100)}
+	halfPercent    = valueTransform{Unit: "%", Convert: scaleBy(2)}
+	kelvin         = valueTransform{Unit: "K", Convert: miredsToKelvin}
+	levelPercent   = valueTransform{Unit: "%", Convert: levelToPercent}
+	hectopascal    = valueTransform{Unit: "hPa", Convert: scaleBy(1)} // PressureMeasurement uses 0.1 kPa
+	lux            = valueTransform{Unit: "lx", Convert: illuminanceToLux}
+	attrTransforms = map[string]valueTransform{
+		"TemperatureMeasurement/measured-value":              celsius100ths,
+		"TemperatureMeasurement/min-measured-value":          celsius100ths,
+		"TemperatureMeasurement/max-measured-value":          celsius100ths,
+		"Thermostat/local-temperature":                       celsius100ths,
+		"Thermostat/occupied-heating-setpoint":               celsius100ths,
+		"Thermostat/occupied-cooling-setpoint":               celsius100ths,
+		"RelativeHumidityMeasurement/measured-value":         percent100ths,
+		"WindowCovering/current-position-lift-percent100ths": percent100ths,
+		"WindowCovering/current-position-tilt-percent100ths": percent100ths,
+		"WindowCovering/target-position-lift-percent100ths":  percent100ths,
+		"WindowCovering/target-position-tilt-percent100ths":  percent100ths,
+		"PowerSource/bat-percent-remaining":                  halfPercent,
+		"ColorControl/color-temperature-mireds":              kelvin,
+		"ColorControl/color-temp-physical-min-mireds":        kelvin,
+		"ColorControl/color-temp-physical-max-mireds":        kelvin,
+		"LevelControl/current-level":                         levelPercent,
+		"PressureMeasurement/measured-value":                 hectopascal,
+		"IlluminanceMeasurement/measured-value":              lux,
+		"IlluminanceMeasurement/min-measured-value":          lux,
+		"IlluminanceMeasurement/max-measured-value":          lux,
+		"TemperatureControl/temperature-setpoint":            celsius100ths,
+		"ElectricalPowerMeasurement/active-power":            {Unit: "W", Convert: scaleBy(1000)}, // mW
+	}
+)
+
+// normalizeAttributeUpdate converts the value of known attributes to a common unit, keeping the
+// original in RawValue. Unknown attributes and values that can't be converted are left untouched.
+func normalizeAttributeUpdate(update *AttributeUpdatePayload) {
+	t, ok := attrTransforms[update.Cluster+"/"+update.Attribute]
+	if !ok || update.RawValue != nil {
+		return
+	}
+	raw, ok := toFloat(update.Value)
+	if !ok {
+		return
+	}
+	converted, ok := t.Convert(raw)
+	if !ok {
+		return
+	}
+	update.RawValue, update.Value, update.Unit = update.Value, converted, t.Unit
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uiPreferencesFile is where the frontend preferences are persisted, relative to the data directory.
+const uiPreferencesFile = "ui_preferences.json"
+
+// Bounds of a preference set, so the store stays a settings store and not a blob store.
+const (
+	maxUIPreferenceKeys     = 64
+	maxUIPreferenceKeyLen   = 64
+	maxUIPreferenceValueLen = 16 * 1024
+)
+
+// UIPreferences is the preference set of a user: free-form JSON values by key, as the frontend
+// wants them, e.g. "dashboardLayout", "favoriteDevices" and "theme". It is the payload of
+// "ui_preferences", sent in response to "get_ui_preferences" and "set_ui_preferences" and to the
+// user's other connections when it changes.
+type UIPreferences struct {
+	User      string                     `json:"user"`
+	Values    map[string]json.RawMessage `json:"values"`
+	UpdatedAt time.Time                  `json:"updatedAt,omitzero"`
+}
+
+// UIPreferencesPayload is the payload of "get_ui_preferences" and "set_ui_preferences". User
+// defaults to the user, or else the device, the connection sent with "identify".
+type UIPreferencesPayload struct {
+	User string `json:"user,omitempty"`
+	// Values are merged into the stored ones; a null value removes its key (set_ui_preferences)
+	Values map[string]json.RawMessage `json:"values,omitempty"`
+	// Replace drops the keys missing from Values (set_ui_preferences)
+	Replace bool `json:"replace,omitempty"`
+}
+
+// Validate implements Validator.
+func (p UIPreferencesPayload) Validate() error {
+	verr := &ValidationError{}
+	if len(p.User) > maxIdentityFieldLength {
+		verr.add("user", fmt.Sprintf("must be at most %d characters", maxIdentityFieldLength))
+	}
+	if len(p.Values) > maxUIPreferenceKeys {
+		verr.add("values", fmt.Sprintf("must have at most %d keys", maxUIPreferenceKeys))
+	}
+	for key, value := range p.Values {
+		if key == "" || len(key) > maxUIPreferenceKeyLen {
+			verr.add("values", fmt.Sprintf("keys must be 1 to %d characters", maxUIPreferenceKeyLen))
+		} else if len(value) > maxUIPreferenceValueLen {
+			verr.add("values."+key, fmt.Sprintf("must be at most %d bytes of JSON", maxUIPreferenceValueLen))
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// errNoPreferencesUser is returned when a connection asks for its preferences without saying whose.
+var errNoPreferencesUser = errors.New(`no user: pass "user" or send "identify" with a user or device first`)
+
+// preferencesUser returns whose preferences a connection works on.
+func (c *Client) preferencesUser(user string) (string, error) {
+	if user != "" {
+		return user, nil
+	}
+	if identity := c.base().identity.Load(); identity != nil {
+		if identity.User != "" {
+			return identity.User, nil
+		}
+		if identity.Device != "" {
+			return identity.Device, nil
+		}
+	}
+	return "", errNoPreferencesUser
+}
+
+// UIPreferencesStore keeps the frontend preferences of each user on the backend, so dashboard
+// layout, favorites and theme follow the user across browsers instead of living in localStorage.
+type UIPreferencesStore struct {
+	mu    sync.Mutex
+	users map[string]*UIPreferences
+	path  string
+}
+
+// NewUIPreferencesStore creates a UIPreferencesStore persisting the preferences to path.
+func NewUIPreferencesStore(path string) *UIPreferencesStore {
+	return &UIPreferencesStore{users: make(map[string]*UIPreferences), path: path}
+}
+
+// Load reads the persisted preferences. A missing file is not an error.
+func (s *UIPreferencesStore) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var users []*UIPreferences
+	if err := loadJSONFile(s.path, &users); err != nil {
+		return err
+	}
+	for _, prefs := range users {
+		if prefs.Values == nil {
+			prefs.Values = make(map[string]json.RawMessage)
+		}
+		s.users[prefs.User] = prefs
+	}
+	return nil
+}
+
+// save writes the preferences to disk, sorted by user. The caller must hold s.mu.
+func (s *UIPreferencesStore) save() error {
+	users := make([]*UIPreferences, 0, len(s.users))
+	for _, prefs := range s.users {
+		users = append(users, prefs)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].User < users[j].User })
+	return saveJSONFile(s.path, users)
+}
+
+// Get returns the preferences of a user, empty when none were saved.
+func (s *UIPreferencesStore) Get(user string) UIPreferences {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefs, ok := s.users[user]
+	if !ok {
+		return UIPreferences{User: user, Values: map[string]json.RawMessage{}}
+	}
+	return prefs.copy()
+}
+
+// Set merges values into the preferences of a user, or replaces them, and persists them. A null
+// value removes its key.
+func (s *UIPreferencesStore) Set(user string, values map[string]json.RawMessage, replace bool) (UIPreferences, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefs, ok := s.users[user]
+	if !ok || replace {
+		prefs = &UIPreferences{User: user, Values: make(map[string]json.RawMessage)}
+	}
+	merged := prefs.copy()
+	for key, value := range values {
+		if len(value) == 0 || string(value) == "null" {
+			delete(merged.Values, key)
+			continue
+		}
+		merged.Values[key] = value
+	}
+	if len(merged.Values) > maxUIPreferenceKeys {
+		return UIPreferences{}, fmt.Errorf("at most %d preferences per user", maxUIPreferenceKeys)
+	}
+	merged.UpdatedAt = time.Now()
+	previous, existed := s.users[user]
+	if len(merged.Values) == 0 {
+		delete(s.users, user)
+	} else {
+		s.users[user] = &merged
+	}
+	if err := s.save(); err != nil {
+		if existed {
+			s.users[user] = previous
+		} else {
+			delete(s.users, user)
+		}
+		return UIPreferences{}, err
+	}
+	return merged.copy(), nil
+}
+
+// Delete removes all the preferences of a user.
+func (s *UIPreferencesStore) Delete(user string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[user]; !ok {
+		return false, nil
+	}
+	delete(s.users, user)
+	return true, s.save()
+}
+
+// copy returns a copy whose Values can be changed.
+func (p *UIPreferences) copy() UIPreferences {
+	copied := *p
+	copied.Values = make(map[string]json.RawMessage, len(p.Values))
+	for key, value := range p.Values {
+		copied.Values[key] = value
+	}
+	return copied
+}
+
+// sendToUser sends a message to every connection of a user but one, e.g. the one that made the
+// change.
+func (h *Hub) sendToUser(user string, except *Client, msgType string, payload interface{}) {
+	if except != nil {
+		except = except.base()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		if client == except {
+			continue
+		}
+		if owner, err := client.preferencesUser(""); err == nil && owner == user {
+			h.queueMessage(client, msgType, "", payload)
+		}
+	}
+}
+
+func handleGetUIPreferences(client *Client, payload UIPreferencesPayload) {
+	user, err := client.preferencesUser(payload.User)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "get_ui_preferences failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("ui_preferences", uiPreferences.Get(user))
+}
+
+func handleSetUIPreferences(client *Client, payload UIPreferencesPayload) {
+	user, err := client.preferencesUser(payload.User)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "set_ui_preferences failed: " + err.Error()})
+		return
+	}
+	prefs, err := uiPreferences.Set(user, payload.Values, payload.Replace)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "set_ui_preferences failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("ui_preferences", prefs)
+	client.hub.sendToUser(user, client, "ui_preferences", prefs) // The user's other browsers follow
+}
+
+// registerUIPreferencesREST adds /preferences/:user to an API version group.
+func registerUIPreferencesREST(api *gin.RouterGroup, hub *Hub) {
+	api.GET("/preferences/:user", func(c *gin.Context) {
+		jsonWithETag(c, uiPreferences.Get(c.Param("user")))
+	})
+	// PATCH merges the values, PUT replaces them
+	setPreferences := func(replace bool) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			var payload UIPreferencesPayload
+			if err := c.ShouldBindJSON(&payload); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := payload.Validate(); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": err.(*ValidationError).Fields})
+				return
+			}
+			user := c.Param("user")
+			prefs, err := uiPreferences.Set(user, payload.Values, replace || payload.Replace)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			hub.sendToUser(user, nil, "ui_preferences", prefs)
+			c.JSON(http.StatusOK, prefs)
+		}
+	}
+	api.PUT("/preferences/:user", setPreferences(true))
+	api.PATCH("/preferences/:user", setPreferences(false))
+	api.DELETE("/preferences/:user", func(c *gin.Context) {
+		user := c.Param("user")
+		found, err := uiPreferences.Delete(user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no preferences for this user"})
+			return
+		}
+		hub.sendToUser(user, nil, "ui_preferences", UIPreferences{User: user, Values: map[string]json.RawMessage{}})
+		c.Status(http.StatusNoContent)
+	})
+}
+
+var uiPreferences = NewUIPreferencesStore(uiPreferencesFile)
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Unit preference values. Values are normalised to Celsius and timestamps are formatted in 24h
+// unless a client or the config asks otherwise.
+const (
+	unitCelsius    = "celsius"
+	unitFahrenheit = "fahrenheit"
+	timeFormat24h  = "24h"
+	timeFormat12h  = "12h"
+)
+
+// timeAttributes are the attributes holding an epoch-us timestamp, shown as a date and time.
+var timeAttributes = map[string]bool{
+	"TimeSynchronization/utctime":    true,
+	"TimeSynchronization/local-time": true,
+}
+
+// UnitPreferences selects how values are presented to a client: the temperature unit and the
+// clock used in the display strings. It is the payload of "set_unit_preferences"; empty fields
+// fall back to the config's units.
+type UnitPreferences struct {
+	Temperature string `json:"temperature,omitempty"` // "celsius" or "fahrenheit"
+	TimeFormat  string `json:"timeFormat,omitempty"`  // "24h" or "12h"
+}
+
+// Validate implements Validator.
+func (p UnitPreferences) Validate() error {
+	verr := &ValidationError{}
+	if p.Temperature != "" && p.Temperature != unitCelsius && p.Temperature != unitFahrenheit {
+		verr.add("temperature", `must be "celsius" or "fahrenheit"`)
+	}
+	if p.TimeFormat != "" && p.TimeFormat != timeFormat24h && p.TimeFormat != timeFormat12h {
+		verr.add("timeFormat", `must be "24h" or "12h"`)
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// withDefaults fills the empty fields from the config's units, then from the built-in defaults.
+func (p UnitPreferences) withDefaults() UnitPreferences {
+	global := appConfig.Units
+	if p.Temperature == "" {
+		p.Temperature = global.Temperature
+	}
+	if p.Temperature == "" {
+		p.Temperature = unitCelsius
+	}
+	if p.TimeFormat == "" {
+		p.TimeFormat = global.TimeFormat
+	}
+	if p.TimeFormat == "" {
+		p.TimeFormat = timeFormat24h
+	}
+	return p
+}
+
+// unitPreferences returns the preferences in effect for a connection.
+func (c *Client) unitPreferences() UnitPreferences {
+	if prefs := c.base().units.Load(); prefs != nil {
+		return prefs.withDefaults()
+	}
+	return UnitPreferences{}.withDefaults()
+}
+
+// localizeValue converts a normalised value to the preferred unit and formats it for display.
+// Only Celsius values are converted; the other units have no alternative.
+func localizeValue(key string, value interface{}, unit string, prefs UnitPreferences) (interface{}, string, string) {
+	if timeAttributes[key] {
+		if us, ok := toFloat(value); ok && us > 0 {
+			return value, unit, formatLocalTime(matterEpoch.Add(time.Duration(us)*time.Microsecond), prefs)
+		}
+		return value, unit, ""
+	}
+	v, ok := toFloat(value)
+	if !ok || unit == "" {
+		return value, unit, ""
+	}
+	if unit == "°C" && prefs.Temperature == unitFahrenheit {
+		v, unit = math.Round((v*9/5+32)*100)/100, "°F"
+		value = v
+	}
+	display := strconv.FormatFloat(v, 'f', -1, 64)
+	if unit == "%" {
+		return value, unit, display + "%"
+	}
+	return value, unit, display + " " + unit
+}
+
+// formatLocalTime formats a timestamp in the time sync time zone with the preferred clock.
+func formatLocalTime(t time.Time, prefs UnitPreferences) string {
+	if loc, err := timeSyncLocation(); err == nil {
+		t = t.In(loc)
+	}
+	if prefs.TimeFormat == timeFormat12h {
+		return t.Format("2006-01-02 3:04:05 PM")
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// localizeReading converts a typed sensor reading to the preferred temperature unit.
+func localizeReading(reading *SensorReading, prefs UnitPreferences) *SensorReading {
+	if reading == nil || reading.Unit != "°C" || prefs.Temperature != unitFahrenheit {
+		return reading
+	}
+	converted := *reading
+	converted.Value, converted.Unit = math.Round((reading.Value*9/5+32)*100)/100, "°F"
+	return &converted
+}
+
+// localizeState applies the preferences to a cached attribute state.
+func localizeState(state AttributeState, prefs UnitPreferences) AttributeState {
+	state.Value, state.Unit, state.Display = localizeValue(state.Cluster+"/"+state.Attribute, state.Value, state.Unit, prefs)
+	state.Reading = localizeReading(state.Reading, prefs)
+	return state
+}
+
+// localizePayload applies a client's unit preferences to the messages carrying attribute values:
+// attribute updates, sensor readings and attribute histories. The value transformation layer
+// (transform.go) normalises them to one unit; here each client gets them in its own, with a display
+// string. Other payloads are returned unchanged. The payload is copied, never modified.
+func localizePayload(payload interface{}, prefs UnitPreferences) interface{} {
+	switch p := payload.(type) {
+	case AttributeUpdatePayload:
+		p.Value, p.Unit, p.Display = localizeValue(p.Cluster+"/"+p.Attribute, p.Value, p.Unit, prefs)
+		p.Reading = localizeReading(p.Reading, prefs)
+		return p
+	case SensorReadingsPayload:
+		readings := make([]AttributeState, len(p.Readings))
+		for i, state := range p.Readings {
+			readings[i] = localizeState(state, prefs)
+		}
+		p.Readings = readings
+		return p
+	case AttributeHistoryPayload:
+		t, ok := attrTransforms[p.Cluster+"/"+p.Attribute]
+		if !ok {
+			return p
+		}
+		p.Unit = t.Unit
+		if t.Unit != "°C" || prefs.Temperature != unitFahrenheit {
+			return p
+		}
+		points := make([]HistoryPoint, len(p.Points))
+		for i, point := range p.Points {
+			if point.RawValue != nil { // Values that couldn't be converted keep their raw form
+				point.Value, p.Unit, _ = localizeValue(p.Cluster+"/"+p.Attribute, point.Value, t.Unit, prefs)
+			}
+			point.Reading = localizeReading(point.Reading, prefs)
+			points[i] = point
+		}
+		p.Points = points
+		return p
+	}
+	return payload
+}
+
+func handleSetUnitPreferences(client *Client, payload UnitPreferences) {
+	client.base().units.Store(&payload)
+	log.Printf("Client %s unit preferences: %+v", client.logName(), payload.withDefaults())
+	client.sendPayload("unit_preferences", client.unitPreferences())
+}
+
+func handleGetUnitPreferences(client *Client) {
+	client.sendPayload("unit_preferences", client.unitPreferences())
+}
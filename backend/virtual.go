@@ -0,0 +1,440 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// virtualDevicesFile is where virtual devices are persisted, relative to the data directory.
+const virtualDevicesFile = "virtual_devices.json"
+
+// Virtual devices publish their value on this node prefix, endpoint, cluster and attribute, so
+// they are subscribed to and used in rules like any attribute.
+const (
+	virtualNodePrefix = "virtual:"
+	virtualEndpointID = "1"
+	virtualCluster    = "Virtual"
+	virtualAttribute  = "value"
+)
+
+// Virtual device functions: the numeric ones combine the source values, the boolean ones compare
+// each of them with Equals.
+const (
+	virtualAverage = "average"
+	virtualMin     = "min"
+	virtualMax     = "max"
+	virtualSum     = "sum"
+	virtualAny     = "any"
+	virtualAll     = "all"
+	virtualCount   = "count"
+)
+
+var virtualFunctions = []string{virtualAverage, virtualMin, virtualMax, virtualSum, virtualAny, virtualAll, virtualCount}
+
+// reVirtualDeviceID is the form of virtual device IDs, which are part of their node ID.
+var reVirtualDeviceID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// sourceVirtual marks the attribute updates carrying a virtual device's value.
+const sourceVirtual = "virtual"
+
+// VirtualSource is a real device attribute a virtual device is computed from.
+type VirtualSource struct {
+	DeviceID   string `json:"deviceId,omitempty"` // Registry device, instead of nodeId/endpointId
+	NodeID     string `json:"nodeId,omitempty"`
+	EndpointID string `json:"endpointId,omitempty"`
+	Cluster    string `json:"cluster"`   // As in attribute_update, e.g. "TemperatureMeasurement"; compared case-insensitively
+	Attribute  string `json:"attribute"` // e.g. "measured-value"
+}
+
+// VirtualDevice is an entity computed from real device attributes, such as the average
+// temperature of a room or whether any of its windows is open.
+type VirtualDevice struct {
+	ID       string          `json:"id"`
+	Name     string          `json:"name"`
+	Room     string          `json:"room,omitempty"`
+	Function string          `json:"function"` // average, min, max, sum, any, all or count
+	Sources  []VirtualSource `json:"sources"`
+	// Equals is the value the boolean functions look for in each source, true by default; e.g.
+	// false for open windows with BooleanState contact sensors.
+	Equals interface{} `json:"equals,omitempty"`
+}
+
+// Validate implements Validator.
+func (v VirtualDevice) Validate() error {
+	verr := &ValidationError{}
+	if v.ID != "" && !reVirtualDeviceID.MatchString(v.ID) {
+		verr.add("id", "may only contain letters, digits, '-' and '_'")
+	}
+	if v.Name == "" {
+		verr.add("name", "is required")
+	}
+	if !containsString(virtualFunctions, v.Function) {
+		verr.add("function", "must be one of "+strings.Join(virtualFunctions, ", "))
+	}
+	if len(v.Sources) == 0 {
+		verr.add("sources", "needs at least one source")
+	}
+	for i, source := range v.Sources {
+		field := fmt.Sprintf("sources[%d]", i)
+		if (source.DeviceID == "") == (source.NodeID == "") {
+			verr.add(field, "needs either deviceId or nodeId")
+		}
+		if source.Cluster == "" || source.Attribute == "" {
+			verr.add(field, "needs cluster and attribute")
+		}
+		if isVirtualNode(source.NodeID) || strings.HasPrefix(source.DeviceID, virtualNodePrefix) {
+			verr.add(field, "can't be another virtual device")
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// nodeID returns the node ID a virtual device publishes on.
+func (v VirtualDevice) nodeID() string {
+	return virtualNodePrefix + v.ID
+}
+
+// isVirtualNode reports whether a node ID is a virtual device's.
+func isVirtualNode(nodeID string) bool {
+	return strings.HasPrefix(nodeID, virtualNodePrefix)
+}
+
+// resolve returns the node and endpoint of a source; deviceId sources follow the registry.
+func (s VirtualSource) resolve() (nodeID, endpointID string, ok bool) {
+	if s.DeviceID != "" {
+		device, found := deviceRegistry.Get(s.DeviceID)
+		if !found {
+			return "", "", false
+		}
+		nodeID, endpointID = device.NodeID, device.EndpointID
+	} else {
+		nodeID, endpointID = s.NodeID, s.EndpointID
+	}
+	if s.EndpointID != "" {
+		endpointID = s.EndpointID
+	}
+	if endpointID == "" {
+		endpointID = "1"
+	}
+	return nodeID, endpointID, true
+}
+
+// matches reports whether an attribute update is about the source.
+func (s VirtualSource) matches(update AttributeUpdatePayload) bool {
+	if !strings.EqualFold(s.Cluster, update.Cluster) || !strings.EqualFold(s.Attribute, update.Attribute) {
+		return false
+	}
+	nodeID, endpointID, ok := s.resolve()
+	return ok && nodeID == update.NodeID && endpointID == update.EndpointID
+}
+
+// state returns the cached value of the source, whatever the case its cluster was published with.
+func (s VirtualSource) state() (AttributeState, bool) {
+	nodeID, endpointID, ok := s.resolve()
+	if !ok {
+		return AttributeState{}, false
+	}
+	for _, state := range stateCache.NodeAttributes(nodeID) {
+		if state.EndpointID == endpointID && strings.EqualFold(state.Cluster, s.Cluster) && strings.EqualFold(state.Attribute, s.Attribute) {
+			return state, true
+		}
+	}
+	return AttributeState{}, false
+}
+
+// compute combines the known source values. ok is false while no source has a usable value.
+func (v VirtualDevice) compute() (value interface{}, unit string, ok bool) {
+	var numbers []float64
+	matched, known := 0, 0
+	equals := v.Equals
+	if equals == nil {
+		equals = true
+	}
+	for _, source := range v.Sources {
+		state, found := source.state()
+		if !found || state.Source == sourceOptimistic {
+			continue
+		}
+		known++
+		if sameValue(state.Value, equals) {
+			matched++
+		}
+		if f, isNumber := toFloat(state.Value); isNumber {
+			numbers = append(numbers, f)
+			if unit == "" {
+				unit = state.Unit
+			}
+		}
+	}
+	switch v.Function {
+	case virtualAny:
+		return matched > 0, "", known > 0
+	case virtualAll:
+		return known == len(v.Sources) && matched == known, "", known > 0
+	case virtualCount:
+		return int64(matched), "", known > 0
+	}
+	if len(numbers) == 0 {
+		return nil, "", false
+	}
+	result := numbers[0]
+	for _, f := range numbers[1:] {
+		switch v.Function {
+		case virtualMin:
+			result = min(result, f)
+		case virtualMax:
+			result = max(result, f)
+		default:
+			result += f
+		}
+	}
+	if v.Function == virtualAverage {
+		result /= float64(len(numbers))
+	}
+	return result, unit, true
+}
+
+// asDevice lists a virtual device with the registry devices.
+func (v VirtualDevice) asDevice(updatedAt time.Time) RegisteredDevice {
+	_, _, ok := v.compute()
+	definition := v
+	return RegisteredDevice{
+		ID:         v.ID,
+		NodeID:     v.nodeID(),
+		EndpointID: virtualEndpointID,
+		Name:       v.Name,
+		Room:       v.Room,
+		Reachable:  ok,
+		Virtual:    &definition,
+		CreatedAt:  updatedAt,
+		UpdatedAt:  updatedAt,
+	}
+}
+
+// VirtualDeviceStore keeps the virtual devices and republishes their value whenever one of their
+// sources changes.
+type VirtualDeviceStore struct {
+	mu      sync.RWMutex
+	devices map[string]*VirtualDevice
+	last    map[string]interface{} // Last published value, by ID
+	updated map[string]time.Time   // When the definition was saved, by ID
+	path    string
+}
+
+// NewVirtualDeviceStore creates a store persisting its virtual devices to path.
+func NewVirtualDeviceStore(path string) *VirtualDeviceStore {
+	return &VirtualDeviceStore{devices: make(map[string]*VirtualDevice), last: make(map[string]interface{}), updated: make(map[string]time.Time), path: path}
+}
+
+// Load reads the persisted virtual devices. A missing file is not an error.
+func (s *VirtualDeviceStore) Load() error {
+	var devices []*VirtualDevice
+	if err := loadJSONFile(s.path, &devices); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, device := range devices {
+		s.devices[device.ID] = device
+		s.updated[device.ID] = time.Now()
+	}
+	log.Printf("Loaded %d virtual device(s) from %s", len(devices), s.path)
+	return nil
+}
+
+// save writes the virtual devices to disk. Callers must hold s.mu.
+func (s *VirtualDeviceStore) save() error {
+	return saveJSONFile(s.path, s.listLocked())
+}
+
+func (s *VirtualDeviceStore) listLocked() []VirtualDevice {
+	devices := make([]VirtualDevice, 0, len(s.devices))
+	for _, device := range s.devices {
+		devices = append(devices, *device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices
+}
+
+// List returns the virtual devices sorted by ID.
+func (s *VirtualDeviceStore) List() []VirtualDevice {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.listLocked()
+}
+
+// Devices returns the virtual devices in the shape of registry devices.
+func (s *VirtualDeviceStore) Devices() []RegisteredDevice {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	devices := make([]RegisteredDevice, 0, len(s.devices))
+	for _, device := range s.listLocked() {
+		devices = append(devices, device.asDevice(s.updated[device.ID]))
+	}
+	return devices
+}
+
+// Get returns a virtual device in the shape of a registry device.
+func (s *VirtualDeviceStore) Get(id string) (RegisteredDevice, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	device, ok := s.devices[id]
+	if !ok {
+		return RegisteredDevice{}, false
+	}
+	return device.asDevice(s.updated[id]), true
+}
+
+// Put adds or replaces a virtual device, assigning an ID if it has none, and publishes its value.
+func (s *VirtualDeviceStore) Put(device VirtualDevice) (VirtualDevice, error) {
+	if err := device.Validate(); err != nil {
+		return device, err
+	}
+	if device.ID == "" {
+		device.ID = fmt.Sprintf("virtual-%d", time.Now().UnixNano())
+	}
+	if _, taken := deviceRegistry.Get(device.ID); taken {
+		return device, fmt.Errorf("%q is the ID of a registry device", device.ID)
+	}
+	s.mu.Lock()
+	s.devices[device.ID] = &device
+	s.updated[device.ID] = time.Now()
+	delete(s.last, device.ID)
+	err := s.save()
+	s.mu.Unlock()
+	s.refresh(device)
+	return device, err
+}
+
+// Delete removes a virtual device and its cached value.
+func (s *VirtualDeviceStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	device, ok := s.devices[id]
+	if !ok {
+		return fmt.Errorf("virtual device %q not found", id)
+	}
+	delete(s.devices, id)
+	delete(s.last, id)
+	delete(s.updated, id)
+	stateCache.Forget(device.nodeID(), "")
+	return s.save()
+}
+
+// refresh computes a virtual device and publishes its value when it changed, to every client and
+// the internal subscribers: rules, alerts and history see it like any attribute.
+func (s *VirtualDeviceStore) refresh(device VirtualDevice) {
+	value, unit, ok := device.compute()
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	last, published := s.last[device.ID]
+	if published && sameValue(last, value) {
+		s.mu.Unlock()
+		return
+	}
+	s.last[device.ID] = value
+	s.mu.Unlock()
+	recordAttributeUpdate(nil, device.update(value, unit), time.Now())
+}
+
+// update builds the attribute update carrying a virtual device's value.
+func (v VirtualDevice) update(value interface{}, unit string) AttributeUpdatePayload {
+	return AttributeUpdatePayload{NodeID: v.nodeID(), EndpointID: virtualEndpointID, Cluster: virtualCluster, Attribute: virtualAttribute, Value: value, Unit: unit, Source: sourceVirtual}
+}
+
+// HandleAttributeUpdate recomputes the virtual devices the update is a source of.
+func (s *VirtualDeviceStore) HandleAttributeUpdate(update AttributeUpdatePayload) {
+	if isVirtualNode(update.NodeID) {
+		return
+	}
+	var affected []VirtualDevice
+	s.mu.RLock()
+	for _, device := range s.devices {
+		for _, source := range device.Sources {
+			if source.matches(update) {
+				affected = append(affected, *device)
+				break
+			}
+		}
+	}
+	s.mu.RUnlock()
+	for _, device := range affected {
+		s.refresh(device)
+	}
+}
+
+// Subscribe answers "subscribe_attribute" on a virtual device: its changes are broadcast anyway,
+// so the client only gets the current value.
+func (s *VirtualDeviceStore) Subscribe(client *Client, nodeID string) error {
+	id := strings.TrimPrefix(nodeID, virtualNodePrefix)
+	s.mu.RLock()
+	device, ok := s.devices[id]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("virtual device %q not found", id)
+	}
+	client.notifyClientLog("subscription_log", fmt.Sprintf("Virtual device %s is updated whenever one of its %d source(s) changes.", id, len(device.Sources)))
+	if value, unit, ok := device.compute(); ok {
+		client.sendPayload("attribute_update", device.update(value, unit))
+	}
+	return nil
+}
+
+// listDevices returns the registry devices followed by the virtual ones.
+func listDevices() []RegisteredDevice {
+	return append(append(deviceRegistry.List(), virtualDevices.Devices()...), federation.Devices()...)
+}
+
+// lookupDevice returns a registry, virtual or remote device by ID.
+func lookupDevice(id string) (RegisteredDevice, bool) {
+	if device, ok := deviceRegistry.Get(id); ok {
+		return device, true
+	}
+	if device, ok := federation.Device(id); ok {
+		return device, true
+	}
+	return virtualDevices.Get(id)
+}
+
+// VirtualDeviceIDPayload is the payload of "delete_virtual_device".
+type VirtualDeviceIDPayload struct {
+	ID string `json:"id" validate:"required"`
+}
+
+// VirtualDevicesListPayload is sent in response to "list_virtual_devices" and "delete_virtual_device".
+type VirtualDevicesListPayload struct {
+	Devices []VirtualDevice `json:"devices"`
+}
+
+func handleListVirtualDevices(client *Client) {
+	client.sendPayload("virtual_devices_list", VirtualDevicesListPayload{Devices: virtualDevices.List()})
+}
+
+func handleAddVirtualDevice(client *Client, device VirtualDevice) {
+	saved, err := virtualDevices.Put(device)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "add_virtual_device failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("virtual_device_saved", saved)
+}
+
+func handleDeleteVirtualDevice(client *Client, payload VirtualDeviceIDPayload) {
+	if err := virtualDevices.Delete(payload.ID); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "delete_virtual_device failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("virtual_devices_list", VirtualDevicesListPayload{Devices: virtualDevices.List()})
+}
+
+var virtualDevices = NewVirtualDeviceStore(virtualDevicesFile)
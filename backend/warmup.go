@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Defaults for session pre-warming, used when the configuration doesn't set them.
+const (
+	defaultWarmupIntervalSeconds = 240
+	defaultWarmWindowSeconds     = 300
+)
+
+// LatencyStats aggregates command round-trip latency for one category (cold or warm).
+type LatencyStats struct {
+	Count        int     `json:"count"`
+	AverageMs    float64 `json:"averageMs"`
+	MaxMs        float64 `json:"maxMs"`
+	totalLatency time.Duration
+}
+
+func (s *LatencyStats) add(d time.Duration) {
+	s.Count++
+	s.totalLatency += d
+	s.AverageMs = float64(s.totalLatency.Milliseconds()) / float64(s.Count)
+	if ms := float64(d.Milliseconds()); ms > s.MaxMs {
+		s.MaxMs = ms
+	}
+}
+
+// CommandLatencyMetrics compares commands sent to devices we talked to recently (warm) with the others (cold).
+// Without a controller keeping sessions open, every command is cold.
+type CommandLatencyMetrics struct {
+	Cold            LatencyStats `json:"cold"`
+	Warm            LatencyStats `json:"warm"`
+	Warmups         int          `json:"warmups"`         // Pre-warm reads performed
+	Failures        int          `json:"warmupFailures"`  // Pre-warm reads that failed
+	SessionsPersist bool         `json:"sessionsPersist"` // The controller keeps CASE sessions between operations
+}
+
+// SessionWarmer periodically performs a cheap read on favorite devices, so the first command after
+// a quiet period doesn't pay for a cold CASE establishment/address resolution. It only works with a
+// controller keeping its sessions between operations, the matter-server one: each chip-tool run is
+// a process with a CASE session of its own, which a previous run can't warm.
+type SessionWarmer struct {
+	mu          sync.Mutex
+	lastContact map[string]time.Time
+	metrics     CommandLatencyMetrics
+}
+
+// NewSessionWarmer creates an idle SessionWarmer. Call Run to start the periodic warm-up.
+func NewSessionWarmer() *SessionWarmer {
+	return &SessionWarmer{lastContact: make(map[string]time.Time)}
+}
+
+func warmupInterval() time.Duration {
+	if s := appConfig.SessionWarmup.IntervalSeconds; s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return defaultWarmupIntervalSeconds * time.Second
+}
+
+func warmWindow() time.Duration {
+	if s := appConfig.SessionWarmup.WarmWindowSeconds; s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return defaultWarmWindowSeconds * time.Second
+}
+
+// MarkContact records a successful interaction with a node.
+func (w *SessionWarmer) MarkContact(nodeID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastContact[nodeID] = time.Now()
+}
+
+// sessionsPersist reports whether the controller keeps CASE sessions open between operations.
+func sessionsPersist() bool {
+	return !usesChipTool()
+}
+
+// IsWarm reports whether we successfully talked to the node within the warm window, through a
+// controller keeping the session open.
+func (w *SessionWarmer) IsWarm(nodeID string) bool {
+	if !sessionsPersist() {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	last, ok := w.lastContact[nodeID]
+	return ok && time.Since(last) < warmWindow()
+}
+
+// RecordCommand adds a command round trip to the cold or warm latency statistics.
+func (w *SessionWarmer) RecordCommand(nodeID string, latency time.Duration, wasWarm, success bool) {
+	w.mu.Lock()
+	if wasWarm {
+		w.metrics.Warm.add(latency)
+	} else {
+		w.metrics.Cold.add(latency)
+	}
+	w.mu.Unlock()
+	if success {
+		w.MarkContact(nodeID)
+	}
+}
+
+// Forget drops the last contact time of a node.
+func (w *SessionWarmer) Forget(nodeID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.lastContact, nodeID)
+}
+
+// Metrics returns a snapshot of the latency metrics.
+func (w *SessionWarmer) Metrics() CommandLatencyMetrics {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	metrics := w.metrics
+	metrics.SessionsPersist = sessionsPersist()
+	return metrics
+}
+
+// warmNode performs the cheap read used to keep a node warm.
+func (w *SessionWarmer) warmNode(nodeID string) {
+	_, err := readAttributeValue(nodeID, "0", "BasicInformation", "vendor-id")
+	w.mu.Lock()
+	w.metrics.Warmups++
+	if err != nil {
+		w.metrics.Failures++
+	}
+	w.mu.Unlock()
+	if err != nil {
+		log.Printf("Session warm-up of node %s failed: %v", nodeID, err)
+		return
+	}
+	w.MarkContact(nodeID)
+}
+
+// Run warms every favorite node that isn't warm anymore, forever. Bridged favorites warm their bridge node.
+// With the chip-tool controller there is no session to keep warm, so it returns right away.
+func (w *SessionWarmer) Run() {
+	if !sessionsPersist() {
+		log.Printf("Session warm-up off: the %s controller opens a new session per operation", controller.Name())
+		return
+	}
+	for {
+		time.Sleep(warmupInterval())
+		warmed := make(map[string]bool)
+		for _, device := range deviceRegistry.List() {
+			if !device.Favorite || warmed[device.NodeID] || w.IsWarm(device.NodeID) {
+				continue
+			}
+			warmed[device.NodeID] = true
+			w.warmNode(device.NodeID)
+		}
+	}
+}
+
+var sessionWarmer = NewSessionWarmer()
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// webhookTimeout bounds a webhook delivery.
+const webhookTimeout = 10 * time.Second
+
+// WebhookPayload is the JSON body POSTed to webhooks.
+type WebhookPayload struct {
+	Type      string      `json:"type"`
+	Data      interface{} `json:"data"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// deliverWebhook POSTs an event to a webhook URL.
+func deliverWebhook(url string, event Event) error {
+	body, err := json.Marshal(WebhookPayload{Type: event.Type, Data: event.Payload, Timestamp: event.Time})
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookSink is a configured webhook: the message types it receives and its journal.
+type webhookSink struct {
+	types   []string
+	journal *EventJournal
+}
+
+// webhookSinks are the webhooks in use, by URL. applyWebhooks changes them on a config reload.
+var (
+	webhooksMu   sync.Mutex
+	webhookSinks = make(map[string]*webhookSink)
+)
+
+// startWebhooks subscribes the configured webhooks to the event bus, for the message types each one
+// lists. Events go through the webhook's journal (see journal.go), so they are retried until delivered.
+func startWebhooks() {
+	applyWebhooks(appConfig.Webhooks)
+	eventBus.Subscribe("webhooks", func(event Event) {
+		webhooksMu.Lock()
+		defer webhooksMu.Unlock()
+		for _, sink := range webhookSinks {
+			if containsString(sink.types, event.Type) {
+				sink.journal.Append(event)
+			}
+		}
+	})
+}
+
+// applyWebhooks makes the webhooks in use match hooks: new URLs get a journal, kept ones take the
+// new types, and removed ones stop, keeping their undelivered events for when they come back.
+func applyWebhooks(hooks []WebhookConfig) {
+	wanted := make(map[string][]string)
+	for _, hook := range hooks {
+		if hook.URL == "" || len(hook.Types) == 0 {
+			log.Printf("Webhook %q ignored: url and types are required", hook.URL)
+			continue
+		}
+		wanted[hook.URL] = hook.Types
+	}
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	for url, sink := range webhookSinks {
+		if _, ok := wanted[url]; !ok {
+			sink.journal.Stop()
+			delete(webhookSinks, url)
+			log.Printf("Webhook %s removed", url)
+		}
+	}
+	for url, types := range wanted {
+		if sink, ok := webhookSinks[url]; ok {
+			sink.types = types
+			continue
+		}
+		url := url
+		journal := startJournal(journalName("webhook", url), func(event Event) error {
+			return deliverWebhook(url, event)
+		})
+		webhookSinks[url] = &webhookSink{types: types, journal: journal}
+		log.Printf("Webhook %s receives %v", url, types)
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Most Matter Wi-Fi devices only have a 2.4 GHz radio, and a crowded channel is the usual reason they
+// drop off. The Wi-Fi scan lists the access points the gateway hears (with nmcli or iw) and rates the
+// congestion of each channel from the neighbours on and around it, so the user can see whether the
+// home network's channel is a good one and which of 1, 6 and 11 would be better.
+
+// Wi-Fi scan settings; zero config values use the defaults here.
+const (
+	defaultWifiScanInterface = "wlan0"
+	defaultWifiScanCache     = time.Minute
+	wifiScanTimeout          = 30 * time.Second
+)
+
+// Congestion levels of a channel.
+const (
+	congestionLow    = "low"
+	congestionMedium = "medium"
+	congestionHigh   = "high"
+)
+
+// wifiNonOverlapping24 are the 2.4 GHz channels that don't overlap each other, the only sensible choices.
+var wifiNonOverlapping24 = []int{1, 6, 11}
+
+// WifiNetwork is an access point heard by the scan.
+type WifiNetwork struct {
+	SSID         string  `json:"ssid"` // Empty for hidden networks
+	BSSID        string  `json:"bssid"`
+	FrequencyMHz int     `json:"frequencyMHz"`
+	Channel      int     `json:"channel"`
+	Band         string  `json:"band"` // "2.4GHz", "5GHz" or "6GHz"
+	SignalDbm    float64 `json:"signalDbm"`
+	Security     string  `json:"security,omitempty"`
+	Utilization  *int    `json:"utilization,omitempty"` // Channel utilisation in percent from the BSS Load element, when advertised
+	Stations     *int    `json:"stations,omitempty"`    // Associated stations from the BSS Load element
+	Connected    bool    `json:"connected,omitempty"`   // The gateway's own network
+}
+
+// WifiChannelStats is the congestion of a channel.
+type WifiChannelStats struct {
+	Channel        int    `json:"channel"`
+	Band           string `json:"band"`
+	Networks       int    `json:"networks"`              // Access points on the channel
+	StrongNetworks int    `json:"strongNetworks"`        // Of them, heard above -70 dBm
+	Overlapping    int    `json:"overlapping"`           // Access points on the neighbouring 2.4 GHz channels, which interfere too
+	Utilization    *int   `json:"utilization,omitempty"` // Highest utilisation advertised by the channel's access points
+	Score          int    `json:"score"`                 // 0 (quiet) to 100 (saturated)
+	Congestion     string `json:"congestion"`            // "low", "medium" or "high"
+	Connected      bool   `json:"connected,omitempty"`   // The gateway's network uses this channel
+}
+
+// WifiScanReport is the result of a Wi-Fi scan (GET /api/v1/network/wifi, "scan_wifi").
+type WifiScanReport struct {
+	Interface          string             `json:"interface"`
+	Tool               string             `json:"tool"`
+	ScannedAt          time.Time          `json:"scannedAt"`
+	Networks           []WifiNetwork      `json:"networks"`
+	Channels           []WifiChannelStats `json:"channels"` // Only the channels with networks on or around them
+	ConnectedChannel   int                `json:"connectedChannel,omitempty"`
+	RecommendedChannel int                `json:"recommendedChannel,omitempty"` // Least congested of 1, 6 and 11
+	Summary            string             `json:"summary"`
+}
+
+// WifiDeviceEnvironment is the Wi-Fi environment of a device, in its diagnose_device report.
+type WifiDeviceEnvironment struct {
+	Channel            int               `json:"channel,omitempty"` // From the device's WiFiNetworkDiagnostics, when it answered
+	RSSI               *int              `json:"rssi,omitempty"`    // dBm, as the device hears its access point
+	ChannelStats       *WifiChannelStats `json:"channelStats,omitempty"`
+	RecommendedChannel int               `json:"recommendedChannel,omitempty"`
+	ScannedAt          time.Time         `json:"scannedAt"`
+	Summary            string            `json:"summary"`
+	Error              string            `json:"error,omitempty"` // The scan failed
+}
+
+// ScanWifiPayload requests a scan ("scan_wifi"). A recent scan is reused unless refresh is set.
+type ScanWifiPayload struct {
+	Refresh bool `json:"refresh,omitempty"`
+}
+
+// WifiScanner runs the scans and caches the last report.
+type WifiScanner struct {
+	scanning sync.Mutex // Held during a scan: a second request waits for it instead of scanning again
+	mu       sync.Mutex
+	last     *WifiScanReport
+}
+
+var wifiScanner = &WifiScanner{}
+
+// errWifiScanDisabled is returned while wifiScan.enabled isn't set.
+var errWifiScanDisabled = errors.New("Wi-Fi scan is disabled (set wifiScan.enabled)")
+
+// wifiScanSettings returns the scan config with its defaults applied. The tool is nmcli when
+// NetworkManager is installed, iw otherwise.
+func wifiScanSettings() (tool, iface string, cache time.Duration) {
+	cfg := appConfig.WifiScan
+	tool, iface, cache = cfg.Tool, cfg.Interface, defaultWifiScanCache
+	if iface == "" {
+		iface = defaultWifiScanInterface
+	}
+	if tool == "" {
+		tool = "iw"
+		if _, err := exec.LookPath("nmcli"); err == nil {
+			tool = "nmcli"
+		}
+	}
+	if cfg.CacheSeconds > 0 {
+		cache = time.Duration(cfg.CacheSeconds) * time.Second
+	}
+	return tool, iface, cache
+}
+
+// Scan returns the last report if it is recent enough, or scans again.
+func (s *WifiScanner) Scan(ctx context.Context, refresh bool) (WifiScanReport, error) {
+	if !appConfig.WifiScan.Enabled {
+		return WifiScanReport{}, errWifiScanDisabled
+	}
+	tool, iface, cache := wifiScanSettings()
+	s.scanning.Lock()
+	defer s.scanning.Unlock()
+	if last, ok := s.Last(); ok && !refresh && time.Since(last.ScannedAt) < cache && last.Interface == iface {
+		return last, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, wifiScanTimeout)
+	defer cancel()
+	var networks []WifiNetwork
+	var err error
+	if strings.HasPrefix(filepath.Base(tool), "nmcli") {
+		networks, err = scanWithNmcli(ctx, tool, iface)
+	} else {
+		networks, err = scanWithIw(ctx, tool, iface)
+	}
+	if err != nil {
+		return WifiScanReport{}, err
+	}
+	report := buildWifiReport(networks)
+	report.Interface, report.Tool, report.ScannedAt = iface, tool, time.Now()
+	s.mu.Lock()
+	s.last = &report
+	s.mu.Unlock()
+	return report, nil
+}
+
+// Last returns the last report, if a scan ran.
+func (s *WifiScanner) Last() (WifiScanReport, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil {
+		return WifiScanReport{}, false
+	}
+	return *s.last, true
+}
+
+// runScanTool runs a scan command, returning its output or the error it printed.
+func runScanTool(ctx context.Context, tool string, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, tool, args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return "", fmt.Errorf("%s: %s", tool, msg)
+		}
+		return "", fmt.Errorf("%s: %w", tool, err)
+	}
+	return string(out), nil
+}
+
+// scanWithNmcli scans with NetworkManager, which doesn't need root. nmcli reports the signal as a
+// percentage, converted to dBm the way NetworkManager derives it.
+func scanWithNmcli(ctx context.Context, tool, iface string) ([]WifiNetwork, error) {
+	out, err := runScanTool(ctx, tool, "-t", "-e", "yes", "-f", "IN-USE,BSSID,SSID,FREQ,SIGNAL,SECURITY",
+		"device", "wifi", "list", "ifname", iface, "--rescan", "yes")
+	if err != nil {
+		return nil, err
+	}
+	var networks []WifiNetwork
+	for _, line := range strings.Split(out, "\n") {
+		fields := splitNmcliFields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		freq, _ := strconv.Atoi(strings.Fields(fields[3] + " 0")[0]) // "2437 MHz"
+		signal, _ := strconv.Atoi(fields[4])
+		network := WifiNetwork{SSID: fields[2], BSSID: strings.ToLower(fields[1]), FrequencyMHz: freq, SignalDbm: float64(signal)/2 - 100,
+			Security: fields[5], Connected: strings.TrimSpace(fields[0]) == "*"}
+		if network.Security == "--" {
+			network.Security = ""
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// splitNmcliFields splits a terse nmcli line on the colons not escaped with a backslash.
+func splitNmcliFields(line string) []string {
+	var fields []string
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case line[i] == ':':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(line[i])
+		}
+	}
+	return append(fields, field.String())
+}
+
+var (
+	reIwBSS         = regexp.MustCompile(`^BSS ([0-9a-fA-F:]{17})`)
+	reIwFreq        = regexp.MustCompile(`^\s*freq: ([\d.]+)`)
+	reIwSignal      = regexp.MustCompile(`^\s*signal: (-?[\d.]+) dBm`)
+	reIwSSID        = regexp.MustCompile(`^\s*SSID: (.*)$`)
+	reIwUtilisation = regexp.MustCompile(`channel utilisation: (\d+)/255`)
+	reIwStations    = regexp.MustCompile(`station count: (\d+)`)
+)
+
+// scanWithIw scans with iw, which needs CAP_NET_ADMIN to trigger a scan, and reports the BSS Load
+// (channel utilisation) the access points advertise.
+func scanWithIw(ctx context.Context, tool, iface string) ([]WifiNetwork, error) {
+	out, err := runScanTool(ctx, tool, "dev", iface, "scan")
+	if err != nil {
+		return nil, err
+	}
+	var networks []WifiNetwork
+	var current *WifiNetwork
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := reIwBSS.FindStringSubmatch(line); m != nil {
+			networks = append(networks, WifiNetwork{BSSID: strings.ToLower(m[1]), Connected: strings.Contains(line, "-- associated")})
+			current = &networks[len(networks)-1]
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		switch {
+		case reIwFreq.MatchString(line):
+			freq, _ := strconv.ParseFloat(reIwFreq.FindStringSubmatch(line)[1], 64)
+			current.FrequencyMHz = int(freq)
+		case reIwSignal.MatchString(line):
+			current.SignalDbm, _ = strconv.ParseFloat(reIwSignal.FindStringSubmatch(line)[1], 64)
+		case reIwSSID.MatchString(line):
+			current.SSID = reIwSSID.FindStringSubmatch(line)[1]
+		case reIwUtilisation.MatchString(line):
+			raw, _ := strconv.Atoi(reIwUtilisation.FindStringSubmatch(line)[1])
+			percent := raw * 100 / 255
+			current.Utilization = &percent
+		case reIwStations.MatchString(line):
+			stations, _ := strconv.Atoi(reIwStations.FindStringSubmatch(line)[1])
+			current.Stations = &stations
+		case strings.Contains(line, "RSN:"):
+			current.Security = "WPA2"
+		case strings.Contains(line, "WPA:") && current.Security == "":
+			current.Security = "WPA"
+		}
+	}
+	return networks, nil
+}
+
+// wifiChannel returns the channel and band of a frequency.
+func wifiChannel(freqMHz int) (int, string) {
+	switch {
+	case freqMHz == 2484:
+		return 14, "2.4GHz"
+	case freqMHz >= 2412 && freqMHz < 2484:
+		return (freqMHz - 2407) / 5, "2.4GHz"
+	case freqMHz > 5950 && freqMHz <= 7125:
+		return (freqMHz - 5950) / 5, "6GHz"
+	case freqMHz >= 5000 && freqMHz <= 5925:
+		return (freqMHz - 5000) / 5, "5GHz"
+	}
+	return 0, ""
+}
+
+// signalWeight rates how much an access point disturbs a channel from its signal: 0 at -90 dBm and
+// below, 1 at -40 dBm and above.
+func signalWeight(dbm float64) float64 {
+	return math.Max(0, math.Min(1, (dbm+90)/50))
+}
+
+// congestionLevel names a congestion score.
+func congestionLevel(score int) string {
+	switch {
+	case score >= 60:
+		return congestionHigh
+	case score >= 30:
+		return congestionMedium
+	}
+	return congestionLow
+}
+
+// channelStats rates a channel from the access points on it and, on 2.4 GHz where a transmission
+// spreads over about four channels on each side, on the neighbouring channels, weighted by overlap.
+// The utilisation advertised in BSS Load elements raises the score when it is higher.
+func channelStats(channel int, band string, networks []WifiNetwork) WifiChannelStats {
+	stats := WifiChannelStats{Channel: channel, Band: band}
+	load := 0.0
+	for _, n := range networks {
+		if n.Band != band {
+			continue
+		}
+		distance := n.Channel - channel
+		if distance < 0 {
+			distance = -distance
+		}
+		switch {
+		case distance == 0:
+			stats.Networks++
+			if n.SignalDbm > -70 {
+				stats.StrongNetworks++
+			}
+			load += signalWeight(n.SignalDbm)
+			if n.Utilization != nil && (stats.Utilization == nil || *n.Utilization > *stats.Utilization) {
+				utilization := *n.Utilization
+				stats.Utilization = &utilization
+			}
+		case band == "2.4GHz" && distance <= 4:
+			stats.Overlapping++
+			load += signalWeight(n.SignalDbm) * (1 - float64(distance)/5)
+		}
+	}
+	stats.Score = int(math.Min(100, math.Round(load*20))) // Five strong neighbours saturate a channel
+	if stats.Utilization != nil && *stats.Utilization > stats.Score {
+		stats.Score = *stats.Utilization
+	}
+	stats.Congestion = congestionLevel(stats.Score)
+	return stats
+}
+
+// buildWifiReport rates the channels of the scanned networks.
+func buildWifiReport(networks []WifiNetwork) WifiScanReport {
+	report := WifiScanReport{Networks: []WifiNetwork{}, Channels: []WifiChannelStats{}}
+	type key struct {
+		channel int
+		band    string
+	}
+	channels := map[key]bool{}
+	for _, n := range networks {
+		n.Channel, n.Band = wifiChannel(n.FrequencyMHz)
+		if n.Channel == 0 {
+			continue
+		}
+		report.Networks = append(report.Networks, n)
+		channels[key{n.Channel, n.Band}] = true
+		if n.Connected {
+			report.ConnectedChannel = n.Channel
+		}
+	}
+	sort.Slice(report.Networks, func(i, j int) bool { return report.Networks[i].SignalDbm > report.Networks[j].SignalDbm })
+	for _, channel := range wifiNonOverlapping24 {
+		channels[key{channel, "2.4GHz"}] = true
+	}
+	for k := range channels {
+		stats := channelStats(k.channel, k.band, report.Networks)
+		stats.Connected = k.channel == report.ConnectedChannel && k.band == connectedBand(report.Networks)
+		if stats.Networks > 0 || stats.Overlapping > 0 || stats.Connected {
+			report.Channels = append(report.Channels, stats)
+		}
+	}
+	sort.Slice(report.Channels, func(i, j int) bool {
+		if report.Channels[i].Band != report.Channels[j].Band {
+			return report.Channels[i].Band < report.Channels[j].Band
+		}
+		return report.Channels[i].Channel < report.Channels[j].Channel
+	})
+
+	best := channelStats(wifiNonOverlapping24[0], "2.4GHz", report.Networks)
+	for _, channel := range wifiNonOverlapping24[1:] {
+		if stats := channelStats(channel, "2.4GHz", report.Networks); stats.Score < best.Score {
+			best = stats
+		}
+	}
+	report.RecommendedChannel = best.Channel
+	report.Summary = fmt.Sprintf("%d networks heard; channel %d is the least congested of 1, 6 and 11 (%s).", len(report.Networks), best.Channel, best.Congestion)
+	if band := connectedBand(report.Networks); band == "2.4GHz" {
+		current := channelStats(report.ConnectedChannel, band, report.Networks)
+		report.Summary = fmt.Sprintf("%d networks heard; the gateway's channel %d has %s congestion (score %d).", len(report.Networks), current.Channel, current.Congestion, current.Score)
+		if current.Congestion != congestionLow && current.Score-best.Score >= 20 && best.Channel != current.Channel {
+			report.Summary += fmt.Sprintf(" Moving the access point to channel %d (score %d) should help flaky 2.4 GHz devices.", best.Channel, best.Score)
+		}
+	}
+	return report
+}
+
+// connectedBand returns the band of the gateway's own network, if it uses Wi-Fi.
+func connectedBand(networks []WifiNetwork) string {
+	for _, n := range networks {
+		if n.Connected {
+			return n.Band
+		}
+	}
+	return ""
+}
+
+// wifiDeviceEnvironment rates the Wi-Fi channel of a device for its diagnose_device report. The
+// channel comes from the device's WiFiNetworkDiagnostics when it answers (readable is false when its
+// Matter read already failed); otherwise the gateway's channel stands in. Nil is returned when the
+// scan is disabled or the device isn't on Wi-Fi.
+func wifiDeviceEnvironment(device RegisteredDevice, readable bool) *WifiDeviceEnvironment {
+	if !appConfig.WifiScan.Enabled || device.BridgeID != "" {
+		return nil
+	}
+	if _, thread := threadBorderRouter.DeviceStatus(device.ID); thread {
+		return nil
+	}
+	env := &WifiDeviceEnvironment{}
+	if readable {
+		channel, err := readAttributeValue(device.NodeID, "0", "WiFiNetworkDiagnostics", "channel-number")
+		if err != nil {
+			return nil // No WiFiNetworkDiagnostics: Ethernet or Thread
+		}
+		number, _ := toFloat(channel)
+		env.Channel = int(number)
+		if rssi, err := readAttributeValue(device.NodeID, "0", "WiFiNetworkDiagnostics", "rssi"); err == nil {
+			if dbm, ok := toFloat(rssi); ok {
+				value := int(dbm)
+				env.RSSI = &value
+			}
+		}
+	}
+	report, err := wifiScanner.Scan(context.Background(), false)
+	if err != nil {
+		env.Error = err.Error()
+		return env
+	}
+	env.ScannedAt, env.RecommendedChannel = report.ScannedAt, report.RecommendedChannel
+	channel := env.Channel
+	if channel == 0 {
+		channel = report.ConnectedChannel
+	}
+	if channel == 0 {
+		env.Summary = report.Summary
+		return env
+	}
+	stats := channelStats(channel, "2.4GHz", report.Networks)
+	if channel > 14 {
+		stats = channelStats(channel, "5GHz", report.Networks)
+	}
+	env.ChannelStats = &stats
+	env.Summary = fmt.Sprintf("Channel %d has %s congestion (score %d, %d networks on it, %d overlapping).", channel, stats.Congestion, stats.Score, stats.Networks, stats.Overlapping)
+	if env.RSSI != nil && *env.RSSI < -75 {
+		env.Summary += fmt.Sprintf(" The device hears its access point weakly (%d dBm).", *env.RSSI)
+	}
+	return env
+}
+
+// handleScanWifi scans the Wi-Fi environment in a job and sends "wifi_scan_result".
+func handleScanWifi(client *Client, payload ScanWifiPayload) {
+	if !appConfig.WifiScan.Enabled {
+		client.notifyClient("error", map[string]interface{}{"message": "scan_wifi failed: " + errWifiScanDisabled.Error()})
+		return
+	}
+	jobs.Submit(client, "wifi_scan", func(ctx context.Context, job *Job) (interface{}, error) {
+		job.SetProgress(0, "Scanning")
+		report, err := wifiScanner.Scan(ctx, payload.Refresh)
+		if err != nil {
+			return nil, err
+		}
+		client.sendPayload("wifi_scan_result", report)
+		return report, nil
+	})
+}
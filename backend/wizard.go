@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// wizardsFile is where onboarding sessions are persisted, so an interrupted onboarding can be resumed.
+const wizardsFile = "wizards.json"
+
+// wizardSessionTTL is how long an unfinished onboarding session is kept after its last change.
+const wizardSessionTTL = 7 * 24 * time.Hour
+
+// Onboarding steps, in order. A session only accepts its current step.
+const (
+	wizardStepDiscover     = "discover"      // Pick a discovered device, or none to pair with a manual code only
+	wizardStepValidateCode = "validate_code" // Check the setup code against the picked device
+	wizardStepCommission   = "commission"    // Pair the device (runs as a commissioning job)
+	wizardStepIntrospect   = "introspect"    // Read the endpoint composition
+	wizardStepAssign       = "assign"        // Name, room and location
+	wizardStepSubscribe    = "subscribe"     // Start the default (or chosen) subscriptions
+	wizardStepDone         = "done"
+)
+
+var wizardSteps = []string{wizardStepDiscover, wizardStepValidateCode, wizardStepCommission, wizardStepIntrospect, wizardStepAssign, wizardStepSubscribe, wizardStepDone}
+
+// defaultSubscriptions are the attributes subscribed for each device type found by introspection.
+// Battery attributes are subscribed after commissioning anyway (see battery.go).
+var defaultSubscriptions = map[uint32][]WizardSubscription{
+	0x0100: {{Cluster: "OnOff", Attribute: "on-off"}},
+	0x0101: {{Cluster: "OnOff", Attribute: "on-off"}, {Cluster: "LevelControl", Attribute: "current-level"}},
+	0x010C: {{Cluster: "OnOff", Attribute: "on-off"}, {Cluster: "LevelControl", Attribute: "current-level"}, {Cluster: "ColorControl", Attribute: "color-temperature-mireds"}},
+	0x010D: {{Cluster: "OnOff", Attribute: "on-off"}, {Cluster: "LevelControl", Attribute: "current-level"}, {Cluster: "ColorControl", Attribute: "color-temperature-mireds"}},
+	0x010A: {{Cluster: "OnOff", Attribute: "on-off"}},
+	0x010B: {{Cluster: "OnOff", Attribute: "on-off"}, {Cluster: "LevelControl", Attribute: "current-level"}},
+	0x0015: {{Cluster: "BooleanState", Attribute: "state-value"}},
+	0x0107: {{Cluster: "OccupancySensing", Attribute: "occupancy"}},
+	0x0302: {{Cluster: "TemperatureMeasurement", Attribute: "measured-value"}},
+	0x0307: {{Cluster: "RelativeHumidityMeasurement", Attribute: "measured-value"}},
+	0x000A: {{Cluster: "DoorLock", Attribute: "lock-state"}},
+	0x0301: {{Cluster: "Thermostat", Attribute: "local-temperature"}, {Cluster: "Thermostat", Attribute: "occupied-heating-setpoint"}},
+	0x0202: {{Cluster: "WindowCovering", Attribute: "current-position-lift-percent100ths"}},
+	0x002B: {{Cluster: "FanControl", Attribute: "percent-current"}},
+}
+
+// WizardSubscription is one subscription of the subscribe step.
+type WizardSubscription struct {
+	EndpointID  string `json:"endpointId,omitempty"`
+	Cluster     string `json:"cluster"`
+	Attribute   string `json:"attribute"`
+	MinInterval string `json:"minInterval,omitempty"` // Defaults to "1"
+	MaxInterval string `json:"maxInterval,omitempty"` // Defaults to "60"
+}
+
+// WizardSession is the server-side state of one device onboarding.
+type WizardSession struct {
+	ID        string    `json:"id"`
+	Step      string    `json:"step"`           // Next step the session accepts
+	Busy      bool      `json:"busy,omitempty"` // A step runs in the background (commissioning, introspection)
+	JobID     string    `json:"jobId,omitempty"`
+	Error     string    `json:"error,omitempty"` // Why the last attempt of the current step failed
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	Device             *DiscoveredDevice    `json:"device,omitempty"` // Picked in the discover step
+	Discriminator      string               `json:"discriminator,omitempty"`
+	ShortDiscriminator string               `json:"shortDiscriminator,omitempty"`
+	NodeID             string               `json:"nodeId,omitempty"`
+	EndpointID         string               `json:"endpointId,omitempty"`
+	Endpoints          []EndpointInfo       `json:"endpoints,omitempty"`
+	Name               string               `json:"name,omitempty"`
+	Room               string               `json:"room,omitempty"`
+	Subscriptions      []WizardSubscription `json:"subscriptions,omitempty"` // Suggested after introspection, started in the subscribe step
+
+	// setupCode is the normalized passcode; never persisted, so a session resumed after a restart
+	// before commissioning asks for it again.
+	setupCode string
+}
+
+// WizardStepPayload advances an onboarding session. Only the fields of the step are used.
+type WizardStepPayload struct {
+	SessionID     string               `json:"sessionId" validate:"required"`
+	Step          string               `json:"step" validate:"required"`
+	Discriminator string               `json:"discriminator,omitempty"` // discover: long discriminator of a device from the last discovery
+	SetupCode     string               `json:"setupCode,omitempty"`     // validate_code: passcode or manual pairing code
+	Name          string               `json:"name,omitempty"`          // assign
+	Room          string               `json:"room,omitempty"`          // assign
+	Location      string               `json:"location,omitempty"`      // assign: ISO 3166-1 alpha-2 country code
+	Subscriptions []WizardSubscription `json:"subscriptions,omitempty"` // subscribe: overrides the suggested ones
+}
+
+// Validate implements Validator.
+func (p WizardStepPayload) Validate() error {
+	if !containsString(wizardSteps[:len(wizardSteps)-1], p.Step) {
+		verr := &ValidationError{}
+		verr.add("step", "is not an onboarding step")
+		return verr
+	}
+	return nil
+}
+
+// WizardSessionPayload names an onboarding session.
+type WizardSessionPayload struct {
+	SessionID string `json:"sessionId" validate:"required"`
+}
+
+// WizardStore holds the onboarding sessions and persists them to wizardsFile.
+type WizardStore struct {
+	mu       sync.Mutex
+	sessions map[string]*WizardSession
+	path     string
+}
+
+// NewWizardStore creates an empty store persisting to path.
+func NewWizardStore(path string) *WizardStore {
+	return &WizardStore{sessions: make(map[string]*WizardSession), path: path}
+}
+
+// Load reads the persisted sessions. Sessions interrupted while busy are retried from their step.
+func (s *WizardStore) Load() error {
+	var sessions []*WizardSession
+	if err := loadJSONFile(s.path, &sessions); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, session := range sessions {
+		session.Busy, session.JobID = false, ""
+		if session.Step == wizardStepCommission {
+			session.Step = wizardStepValidateCode // The setup code isn't persisted
+		}
+		s.sessions[session.ID] = session
+	}
+	log.Printf("Loaded %d onboarding session(s) from %s", len(sessions), s.path)
+	return nil
+}
+
+// save writes the sessions to disk, dropping expired ones. Callers must hold s.mu.
+func (s *WizardStore) save() error {
+	sessions := make([]*WizardSession, 0, len(s.sessions))
+	for id, session := range s.sessions {
+		if time.Since(session.UpdatedAt) > wizardSessionTTL {
+			delete(s.sessions, id)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+	return saveJSONFile(s.path, sessions)
+}
+
+// Start creates a session at the discover step.
+func (s *WizardStore) Start() WizardSession {
+	now := time.Now()
+	session := &WizardSession{ID: fmt.Sprintf("wizard-%d", now.UnixNano()), Step: wizardStepDiscover, CreatedAt: now, UpdatedAt: now}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ID] = session
+	if err := s.save(); err != nil {
+		log.Printf("Could not save onboarding sessions: %v", err)
+	}
+	return *session
+}
+
+// Get returns a copy of a session.
+func (s *WizardStore) Get(id string) (WizardSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return WizardSession{}, false
+	}
+	return *session, true
+}
+
+// List returns every session, oldest first.
+func (s *WizardStore) List() []WizardSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]WizardSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		list = append(list, *session)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// Cancel deletes a session, cancelling its commissioning job if one runs.
+func (s *WizardStore) Cancel(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return errors.New("no onboarding session " + id)
+	}
+	if session.JobID != "" {
+		_ = jobs.Cancel(session.JobID)
+	}
+	delete(s.sessions, id)
+	return s.save()
+}
+
+// update changes a session under the lock, saves the store and broadcasts the new state.
+func (s *WizardStore) update(id string, change func(*WizardSession) error) (WizardSession, error) {
+	s.mu.Lock()
+	session, ok := s.sessions[id]
+	if !ok {
+		s.mu.Unlock()
+		return WizardSession{}, errors.New("no onboarding session " + id)
+	}
+	err := change(session)
+	session.UpdatedAt = time.Now()
+	if saveErr := s.save(); saveErr != nil {
+		log.Printf("Could not save onboarding sessions: %v", saveErr)
+	}
+	snapshot := *session
+	s.mu.Unlock()
+	broadcastToClients("wizard_state", snapshot)
+	return snapshot, err
+}
+
+// advance checks a step request against the session and moves it to the following step once
+// run succeeds. Failures keep the session on the step with its error, so it can be retried.
+func (s *WizardStore) advance(id, step string, run func(*WizardSession) error) (WizardSession, error) {
+	return s.update(id, func(session *WizardSession) error {
+		if session.Busy {
+			return fmt.Errorf("step %s is still running", session.Step)
+		}
+		if session.Step != step {
+			return fmt.Errorf("expected step %s, got %s", session.Step, step)
+		}
+		if err := run(session); err != nil {
+			session.Error = err.Error()
+			return err
+		}
+		session.Error = ""
+		if !session.Busy {
+			session.Step = nextWizardStep(step)
+		}
+		return nil
+	})
+}
+
+// nextWizardStep returns the step following step.
+func nextWizardStep(step string) string {
+	for i, s := range wizardSteps[:len(wizardSteps)-1] {
+		if s == step {
+			return wizardSteps[i+1]
+		}
+	}
+	return wizardStepDone
+}
+
+// commissioningPayload builds the commission_device request of a session.
+func (session *WizardSession) commissioningPayload() CommissionDevicePayload {
+	payload := CommissionDevicePayload{SetupCode: session.setupCode, LongDiscriminator: session.Discriminator, ShortDiscriminator: session.ShortDiscriminator}
+	if d := session.Device; d != nil {
+		payload.VendorID, payload.ProductID = d.VendorID, d.ProductID
+		payload.Hostname, payload.InstanceName = d.Name, d.InstanceName
+		payload.IPAddress, payload.Addresses, payload.Interface = d.IPAddress, d.Addresses, d.Interface
+		if d.Port > 0 {
+			payload.Port = fmt.Sprint(d.Port)
+		}
+	}
+	return payload
+}
+
+// suggestedSubscriptions returns the default subscriptions of every introspected endpoint.
+func suggestedSubscriptions(endpoints []EndpointInfo) []WizardSubscription {
+	var subscriptions []WizardSubscription
+	for _, ep := range endpoints {
+		seen := map[string]bool{}
+		for _, deviceType := range ep.DeviceTypes {
+			for _, sub := range defaultSubscriptions[deviceType] {
+				if key := sub.Cluster + "/" + sub.Attribute; !seen[key] {
+					seen[key] = true
+					sub.EndpointID = ep.EndpointID
+					subscriptions = append(subscriptions, sub)
+				}
+			}
+		}
+	}
+	return subscriptions
+}
+
+// runWizardStep performs one step of a session. Commissioning and introspection run in the
+// background; the session is busy meanwhile and its new state is broadcast when they finish.
+func runWizardStep(client *Client, payload WizardStepPayload) (WizardSession, error) {
+	return wizards.advance(payload.SessionID, payload.Step, func(session *WizardSession) error {
+		switch payload.Step {
+		case wizardStepDiscover:
+			session.Device, session.Discriminator, session.ShortDiscriminator = nil, "", ""
+			if payload.Discriminator == "" {
+				return nil // Manual code only: the discriminator comes from the code
+			}
+			long, err := normalizeDiscriminator(payload.Discriminator, maxLongDiscriminator)
+			if err != nil {
+				return fmt.Errorf("discriminator %s", err)
+			}
+			device, ok := pairingStates.Lookup(long)
+			if !ok {
+				return fmt.Errorf("no device with discriminator %s in the last discovery", long)
+			}
+			if device.PairingState == pairingStateCommissionedHere {
+				return fmt.Errorf("device with discriminator %s is already commissioned by this gateway", long)
+			}
+			session.Device, session.Discriminator, session.ShortDiscriminator = &device, device.Discriminator, device.ShortDiscriminator
+		case wizardStepValidateCode:
+			candidate := CommissionDevicePayload{SetupCode: payload.SetupCode, LongDiscriminator: session.Discriminator}
+			if err := normalizeCommissioningPayload(&candidate); err != nil {
+				return err
+			}
+			if session.Discriminator == "" && candidate.ShortDiscriminator == "" {
+				return errors.New("without a discovered device the setup code must be a manual pairing code")
+			}
+			session.setupCode, session.ShortDiscriminator = candidate.SetupCode, candidate.ShortDiscriminator
+		case wizardStepCommission:
+			if session.setupCode == "" {
+				session.Step = wizardStepValidateCode
+				return errors.New("the setup code was lost (backend restart); validate it again")
+			}
+			commission := session.commissioningPayload()
+			id := session.ID
+			session.Busy = true
+			job := jobs.Submit(client, "commissioning", func(ctx context.Context, job *Job) (interface{}, error) {
+				result, err := commissionDevice(ctx, job, client, commission)
+				finishWizardCommissioning(id, result, err)
+				return result, err
+			})
+			session.JobID = job.Status().ID
+		case wizardStepIntrospect:
+			nodeID, id := session.NodeID, session.ID
+			session.Busy = true
+			go func() {
+				endpoints, err := describeEndpoints(nodeID)
+				if err == nil {
+					if err := deviceRegistry.Update(nodeID, func(device *RegisteredDevice) { device.Endpoints = endpoints }); err != nil {
+						log.Printf("Endpoints of node %s not stored: %v", nodeID, err)
+					}
+				}
+				_, _ = wizards.update(id, func(session *WizardSession) error {
+					session.Busy = false
+					if err != nil {
+						session.Error = err.Error()
+						return err
+					}
+					session.Endpoints, session.Subscriptions, session.Error = endpoints, suggestedSubscriptions(endpoints), ""
+					session.Step = wizardStepAssign
+					return nil
+				})
+			}()
+		case wizardStepAssign:
+			session.Name, session.Room = payload.Name, payload.Room
+			go applyDeviceAssignment(client, session.NodeID, payload.Name, payload.Room, payload.Location)
+		case wizardStepSubscribe:
+			if payload.Subscriptions != nil {
+				session.Subscriptions = payload.Subscriptions
+			}
+			for _, sub := range session.Subscriptions {
+				endpointID := sub.EndpointID
+				if endpointID == "" {
+					endpointID = session.EndpointID
+				}
+				minInterval, maxInterval := sub.MinInterval, sub.MaxInterval
+				if minInterval == "" {
+					minInterval = "1"
+				}
+				if maxInterval == "" {
+					maxInterval = "60"
+				}
+				go startAttributeSubscription(client, session.NodeID, endpointID, sub.Cluster, sub.Attribute, minInterval, maxInterval)
+			}
+		}
+		return nil
+	})
+}
+
+// finishWizardCommissioning records the result of a session's commissioning job.
+func finishWizardCommissioning(id string, result interface{}, err error) {
+	_, _ = wizards.update(id, func(session *WizardSession) error {
+		session.Busy, session.JobID = false, ""
+		status, ok := result.(CommissioningStatusPayload)
+		if err != nil || !ok || !status.Success {
+			session.Error = "commissioning failed"
+			if err != nil {
+				session.Error += ": " + err.Error()
+			}
+			return nil
+		}
+		session.NodeID, session.EndpointID, session.Error = status.NodeID, status.EndpointId, ""
+		session.setupCode = ""
+		session.Step = wizardStepIntrospect
+		return nil
+	})
+}
+
+// handleWizardStart starts an onboarding session.
+func handleWizardStart(client *Client) {
+	client.sendPayload("wizard_state", wizards.Start())
+}
+
+// handleWizardStep runs the requested step of an onboarding session.
+func handleWizardStep(client *Client, payload WizardStepPayload) {
+	session, err := runWizardStep(client, payload)
+	if err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "wizard_step failed: " + err.Error(), "session": session})
+		return
+	}
+	client.sendPayload("wizard_state", session)
+}
+
+// handleWizardGet sends the state of an onboarding session, to resume it.
+func handleWizardGet(client *Client, payload WizardSessionPayload) {
+	session, ok := wizards.Get(payload.SessionID)
+	if !ok {
+		client.notifyClient("error", map[string]interface{}{"message": "wizard_get failed: no onboarding session " + payload.SessionID})
+		return
+	}
+	client.sendPayload("wizard_state", session)
+}
+
+// handleListWizards sends every onboarding session.
+func handleListWizards(client *Client) {
+	client.sendPayload("wizard_list", map[string]interface{}{"sessions": wizards.List()})
+}
+
+// handleWizardCancel abandons an onboarding session.
+func handleWizardCancel(client *Client, payload WizardSessionPayload) {
+	if err := wizards.Cancel(payload.SessionID); err != nil {
+		client.notifyClient("error", map[string]interface{}{"message": "wizard_cancel failed: " + err.Error()})
+		return
+	}
+	client.sendPayload("wizard_cancelled", payload)
+}
+
+var wizards = NewWizardStore(wizardsFile)
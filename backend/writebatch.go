@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Write batching defaults, used when the configuration doesn't set them.
+const (
+	defaultFlushIntervalSeconds = 5
+	batchWriterFlushBytes       = 256 << 10 // A buffer this large is flushed without waiting for the interval
+	batchWriterMaxBuffer        = 16 << 20  // Buffered bytes kept while the disk fails; older lines are dropped beyond it
+)
+
+// StorageConfig sets how the append-only state files (history, audit log) reach the disk (see writebatch.go).
+type StorageConfig struct {
+	// FlushIntervalSeconds is how often buffered lines are written and synced. A crash loses at
+	// most that much; longer intervals spare SD cards. Zero uses the default, 5.
+	FlushIntervalSeconds int `json:"flushIntervalSeconds,omitempty"`
+}
+
+// BatchWriterStatus describes an append-only file in GET /api/status.
+type BatchWriterStatus struct {
+	File          string    `json:"file"`
+	BufferedLines int       `json:"bufferedLines"`
+	Flushes       int       `json:"flushes"`
+	LinesWritten  int       `json:"linesWritten"`
+	LastFlush     time.Time `json:"lastFlush,omitzero"`
+	LastError     string    `json:"lastError,omitempty"`
+}
+
+// BatchWriter appends JSON lines to a file in batches: lines are buffered in memory and written
+// with a single write and fsync per flush interval, instead of one write per line, which wears SD
+// cards out with chatty sensors. Whole lines are appended and readers skip a damaged last line,
+// so a crash costs at most the lines of the current interval, never the file.
+type BatchWriter struct {
+	mu        sync.Mutex
+	path      string // Relative to the data directory
+	perm      os.FileMode
+	buf       bytes.Buffer
+	lines     int
+	flushes   int
+	written   int
+	lastFlush time.Time
+	lastError string
+}
+
+var (
+	batchWritersMu sync.Mutex
+	batchWriters   []*BatchWriter
+)
+
+// NewBatchWriter creates the batch writer of a file and registers it for the periodic flush.
+func NewBatchWriter(path string, perm os.FileMode) *BatchWriter {
+	w := &BatchWriter{path: path, perm: perm}
+	batchWritersMu.Lock()
+	batchWriters = append(batchWriters, w)
+	batchWritersMu.Unlock()
+	return w
+}
+
+// Append buffers a line; it reaches the disk at the next flush.
+func (w *BatchWriter) Append(line []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(line)
+	w.buf.WriteByte('\n')
+	w.lines++
+	if w.buf.Len() >= batchWriterFlushBytes {
+		w.flushLocked()
+	}
+}
+
+// Flush writes and syncs the buffered lines.
+func (w *BatchWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushLocked()
+}
+
+// flushLocked writes the buffer in one append and syncs it. On failure the lines stay buffered
+// for the next flush, up to batchWriterMaxBuffer. Callers must hold w.mu.
+func (w *BatchWriter) flushLocked() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	err := w.appendToFile(w.buf.Bytes())
+	if err != nil {
+		if w.lastError == "" {
+			log.Printf("Could not write %s, keeping %d line(s) buffered: %v", w.path, w.lines, err)
+		}
+		w.lastError = err.Error()
+		if w.buf.Len() > batchWriterMaxBuffer {
+			log.Printf("Dropping %d buffered line(s) of %s", w.lines, w.path)
+			w.buf.Reset()
+			w.lines = 0
+		}
+		return err
+	}
+	w.flushes++
+	w.written += w.lines
+	w.lastFlush, w.lastError = time.Now(), ""
+	w.buf.Reset()
+	w.lines = 0
+	return nil
+}
+
+func (w *BatchWriter) appendToFile(data []byte) error {
+	f, err := os.OpenFile(dataFilePath(w.path), os.O_APPEND|os.O_CREATE|os.O_WRONLY, w.perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Rewrite flushes the buffer, then replaces the file with what fn returns from its current
+// content (nil when it doesn't exist), through a synced temporary file renamed over it.
+func (w *BatchWriter) Rewrite(fn func(data []byte) ([]byte, error)) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	path := dataFilePath(w.path)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	replacement, err := fn(data)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, w.perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(replacement); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Status describes the writer.
+func (w *BatchWriter) Status() BatchWriterStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return BatchWriterStatus{File: filepath.Base(w.path), BufferedLines: w.lines, Flushes: w.flushes, LinesWritten: w.written, LastFlush: w.lastFlush, LastError: w.lastError}
+}
+
+// flushBatchWriters flushes every batch writer.
+func flushBatchWriters() {
+	batchWritersMu.Lock()
+	writers := append([]*BatchWriter(nil), batchWriters...)
+	batchWritersMu.Unlock()
+	for _, w := range writers {
+		w.Flush()
+	}
+}
+
+// batchWriterStatuses lists the batch writers by file.
+func batchWriterStatuses() []BatchWriterStatus {
+	batchWritersMu.Lock()
+	writers := append([]*BatchWriter(nil), batchWriters...)
+	batchWritersMu.Unlock()
+	statuses := make([]BatchWriterStatus, 0, len(writers))
+	for _, w := range writers {
+		statuses = append(statuses, w.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].File < statuses[j].File })
+	return statuses
+}
+
+// runBatchWriters flushes the batch writers at the configured interval, and once more when the
+// backend is stopped with SIGINT or SIGTERM (e.g. by systemd), before exiting.
+func runBatchWriters() {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-stop
+		log.Printf("Received %v, flushing buffered writes before exiting", sig)
+		flushBatchWriters()
+		os.Exit(0)
+	}()
+	for {
+		seconds := appConfig.Storage.FlushIntervalSeconds
+		if seconds <= 0 {
+			seconds = defaultFlushIntervalSeconds
+		}
+		time.Sleep(time.Duration(seconds) * time.Second)
+		flushBatchWriters()
+	}
+}